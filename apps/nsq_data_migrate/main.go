@@ -0,0 +1,294 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/internal/protocol"
+	"github.com/youzan/nsq/internal/version"
+	"github.com/youzan/nsq/nsqd"
+)
+
+var (
+	showVersion = flag.Bool("version", false, "print version string")
+
+	srcDataPath = flag.String("src_data_path", "", "the data path of the upstream nsqd")
+	srcNodeID   = flag.Int64("src_node_id", -1, "the node id of the upstream nsqd before v1.0 (metadata file is nsqd.<id>.dat), -1 for nsqd.dat")
+	dstDataPath = flag.String("dst_data_path", "", "the data path of the new nsqd, the nsqd should not be running")
+	dstNodeID   = flag.Int64("dst_worker_id", nsqd.NewOptions().ID, "the worker-id of the new nsqd")
+	topic       = flag.String("topic", "", "only migrate the topic (all topics if empty)")
+	partition   = flag.Int("partition", 0, "the topic partition in the new nsqd")
+	isExt       = flag.Bool("ext", false, "create the topic with extension for message")
+	logLevel    = flag.Int("level", 2, "log level")
+)
+
+type migrateStats struct {
+	topicMsgs   int64
+	channelMsgs map[string]int64
+}
+
+func newMessage(t *nsqd.Topic, m *upstreamMessage) *nsqd.Message {
+	var msg *nsqd.Message
+	if t.IsExt() {
+		msg = nsqd.NewMessageWithExt(0, m.Body, ext.NO_EXT_VER, nil)
+	} else {
+		msg = nsqd.NewMessage(0, m.Body)
+	}
+	msg.Timestamp = m.Timestamp
+	msg.Attempts = m.Attempts
+	return msg
+}
+
+// queuePos is the position in the topic queue before the message written
+type queuePos struct {
+	offset nsqd.BackendOffset
+	cnt    int64
+}
+
+func putMessage(t *nsqd.Topic, m *upstreamMessage) (queuePos, error) {
+	_, _, _, dend, err := t.PutMessage(newMessage(t, m))
+	if err != nil {
+		return queuePos{}, err
+	}
+	return queuePos{dend.Offset(), dend.TotalMsgCnt()}, nil
+}
+
+func putDelayedMessage(t *nsqd.Topic, chName string, m *upstreamMessage) error {
+	msg := newMessage(t, m)
+	msg.DelayedType = nsqd.ChannelDelayed
+	msg.DelayedTs = time.Now().UnixNano()
+	msg.DelayedOrigID = t.NextMsgID()
+	msg.DelayedChannel = chName
+	t.Lock()
+	defer t.Unlock()
+	dq, err := t.GetOrCreateDelayedQueueNoLock(nil)
+	if err != nil {
+		return err
+	}
+	_, _, _, _, err = dq.PutDelayMessage(msg)
+	return err
+}
+
+func readMessageIDs(q *upstreamDiskQueue) ([][upstreamMsgIDLength]byte, error) {
+	ids := make([][upstreamMsgIDLength]byte, 0, q.Depth())
+	_, err := q.ForEach(func(m *upstreamMessage) error {
+		ids = append(ids, m.ID)
+		return nil
+	})
+	return ids, err
+}
+
+// isSuffixOf returns true if the ids are the last messages of the base
+func isSuffixOf(ids [][upstreamMsgIDLength]byte, base [][upstreamMsgIDLength]byte) bool {
+	if len(ids) > len(base) {
+		return false
+	}
+	start := len(base) - len(ids)
+	for i, id := range ids {
+		if id != base[start+i] {
+			return false
+		}
+	}
+	return true
+}
+
+// migrateTopic converts the unconsumed messages of the upstream topic and channels.
+// Since the upstream channel has its own queue while all the channels share the topic
+// queue in the new nsqd, the longest channel backlog is written to the topic queue
+// before the topic backlog. The upstream topic delivers the messages to all the channels
+// in the same order, so the backlog of the other channel is usually the last messages of
+// the longest one, and the channel will start consuming at the offset of its first
+// message in the topic queue, so the consume offsets and the message order are kept.
+// Otherwise (the requeued messages flushed to the backlog while upstream exiting) the
+// channel backlog will be written to the delayed queue for that channel only and will
+// be delivered immediately after the new nsqd started.
+func migrateTopic(n *nsqd.NSQD, meta upstreamTopicMeta) (*migrateStats, error) {
+	var t *nsqd.Topic
+	if *isExt {
+		t = n.GetTopicWithExt(meta.Name, *partition)
+	} else {
+		t = n.GetTopic(meta.Name, *partition)
+	}
+	if t.TotalDataSize() > 0 {
+		return nil, fmt.Errorf("topic %v is not empty in the new nsqd", t.GetFullName())
+	}
+	if meta.Paused {
+		log.Printf("topic %v is paused in upstream, the pause state will not be migrated", meta.Name)
+	}
+
+	stats := &migrateStats{
+		channelMsgs: make(map[string]int64),
+	}
+	channelQueues := make(map[string]*upstreamDiskQueue)
+	channelIDs := make(map[string][][upstreamMsgIDLength]byte)
+	baseChannel := ""
+	for _, chMeta := range meta.Channels {
+		if strings.HasSuffix(chMeta.Name, upstreamEphemeralSuffix) {
+			continue
+		}
+		if !protocol.IsValidChannelName(chMeta.Name) {
+			log.Printf("ignore invalid channel %v of topic %v", chMeta.Name, meta.Name)
+			continue
+		}
+		q, err := newUpstreamDiskQueue(meta.Name+":"+chMeta.Name, *srcDataPath)
+		if err != nil {
+			return nil, err
+		}
+		ids, err := readMessageIDs(q)
+		if err != nil {
+			return nil, err
+		}
+		channelQueues[chMeta.Name] = q
+		channelIDs[chMeta.Name] = ids
+		if baseChannel == "" || len(ids) > len(channelIDs[baseChannel]) {
+			baseChannel = chMeta.Name
+		}
+		// the channel should be created before any message written, so it will
+		// consume from the start of the topic queue.
+		ch := t.GetChannel(chMeta.Name)
+		if chMeta.Paused {
+			ch.Pause()
+		}
+	}
+	t.SaveChannelMeta()
+
+	// the positions of the base backlog messages and the end of the backlog
+	basePos := []queuePos{{}}
+	if baseChannel != "" {
+		cnt, err := channelQueues[baseChannel].ForEach(func(m *upstreamMessage) error {
+			pos, err := putMessage(t, m)
+			if err == nil {
+				basePos = append(basePos, pos)
+			}
+			return err
+		})
+		stats.channelMsgs[baseChannel] = cnt
+		if err != nil {
+			return stats, err
+		}
+		if int(cnt) != len(channelIDs[baseChannel]) {
+			return stats, fmt.Errorf("channel %v backlog changed while migrating", baseChannel)
+		}
+	}
+	baseIDs := channelIDs[baseChannel]
+	channelStart := make(map[string]queuePos)
+	for chName, q := range channelQueues {
+		if chName == baseChannel {
+			continue
+		}
+		ids := channelIDs[chName]
+		if isSuffixOf(ids, baseIDs) {
+			channelStart[chName] = basePos[len(baseIDs)-len(ids)]
+			stats.channelMsgs[chName] = int64(len(ids))
+			continue
+		}
+		// the channel skips the base backlog and consumes its own in the delayed queue
+		channelStart[chName] = basePos[len(baseIDs)]
+		cnt, err := q.ForEach(func(m *upstreamMessage) error {
+			return putDelayedMessage(t, chName, m)
+		})
+		stats.channelMsgs[chName] = cnt
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	q, err := newUpstreamDiskQueue(meta.Name, *srcDataPath)
+	if err != nil {
+		return stats, err
+	}
+	stats.topicMsgs, err = q.ForEach(func(m *upstreamMessage) error {
+		_, err := putMessage(t, m)
+		return err
+	})
+	if err != nil {
+		return stats, err
+	}
+	t.ForceFlush()
+	if dq := t.GetDelayedQueue(); dq != nil {
+		dq.ForceFlush()
+	}
+	for chName, pos := range channelStart {
+		if pos.cnt == 0 {
+			continue
+		}
+		err = t.GetChannel(chName).ConfirmBackendQueueOnSlave(pos.offset, pos.cnt, false)
+		if err != nil {
+			return stats, fmt.Errorf("set channel %v consume offset %v failed: %v", chName, pos, err)
+		}
+	}
+	return stats, nil
+}
+
+func main() {
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("nsq_data_migrate v%s\n", version.Binary)
+		return
+	}
+
+	nsqd.SetLogger(levellogger.NewSimpleLog())
+	nsqd.NsqLogger().SetLevel(int32(*logLevel))
+
+	if *srcDataPath == "" {
+		log.Fatal("--src_data_path is required")
+	}
+	if *dstDataPath == "" {
+		log.Fatal("--dst_data_path is required")
+	}
+	if *srcDataPath == *dstDataPath {
+		log.Fatal("--dst_data_path should not be the same as --src_data_path")
+	}
+	if *partition < 0 {
+		log.Fatal("--partition is invalid")
+	}
+
+	meta, err := loadUpstreamMetaData(*srcDataPath, *srcNodeID)
+	if err != nil {
+		log.Fatalf("load upstream metadata failed: %v", err)
+	}
+	log.Printf("upstream nsqd version %v, topics: %v", meta.Version, len(meta.Topics))
+
+	opts := nsqd.NewOptions()
+	opts.ID = *dstNodeID
+	opts.DataPath = *dstDataPath
+	n := nsqd.New(opts)
+	// load the existing topics, so they will be kept in the metadata after exit
+	n.LoadMetadata(0)
+	n.Start()
+
+	hasErr := false
+	for _, topicMeta := range meta.Topics {
+		if *topic != "" && topicMeta.Name != *topic {
+			continue
+		}
+		if strings.HasSuffix(topicMeta.Name, upstreamEphemeralSuffix) {
+			log.Printf("ignore ephemeral topic %v", topicMeta.Name)
+			continue
+		}
+		if !protocol.IsValidTopicName(topicMeta.Name) {
+			log.Printf("ignore invalid topic %v", topicMeta.Name)
+			continue
+		}
+		stats, err := migrateTopic(n, topicMeta)
+		if stats != nil {
+			log.Printf("topic %v migrated messages: %v, channels: %v", topicMeta.Name, stats.topicMsgs, stats.channelMsgs)
+		}
+		if err != nil {
+			log.Printf("migrate topic %v failed: %v", topicMeta.Name, err)
+			hasErr = true
+		}
+	}
+	n.NotifyPersistMetadata()
+	n.Exit()
+	if hasErr {
+		log.Fatal("migrate finished with error")
+	}
+	log.Printf("migrate finished")
+}
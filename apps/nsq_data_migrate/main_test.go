@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/nsqd"
+)
+
+type testUpstreamMsg struct {
+	id   string
+	body string
+}
+
+// writeUpstreamQueue writes the messages as the unconsumed backlog of the upstream diskqueue
+func writeUpstreamQueue(t *testing.T, dataPath string, name string, msgs []testUpstreamMsg) {
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		var id [upstreamMsgIDLength]byte
+		copy(id[:], m.id)
+		var header [4 + upstreamMinMessageSize]byte
+		binary.BigEndian.PutUint32(header[:4], uint32(upstreamMinMessageSize+len(m.body)))
+		binary.BigEndian.PutUint64(header[4:12], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint16(header[12:14], 1)
+		copy(header[14:], id[:])
+		buf.Write(header[:])
+		buf.WriteString(m.body)
+	}
+	q := &upstreamDiskQueue{name: name, dataPath: dataPath}
+	err := ioutil.WriteFile(q.fileName(0), buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := fmt.Sprintf("%d\n%d,%d\n%d,%d\n", len(msgs), 0, 0, 0, buf.Len())
+	err = ioutil.WriteFile(q.metaDataFileName(), []byte(meta), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testUpstreamMsgs(from int, to int) []testUpstreamMsg {
+	var msgs []testUpstreamMsg
+	for i := from; i < to; i++ {
+		msgs = append(msgs, testUpstreamMsg{fmt.Sprintf("%016d", i), fmt.Sprintf("body-%d", i)})
+	}
+	return msgs
+}
+
+func TestUpstreamDiskQueueForEach(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsq-migrate-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataPath)
+	writeUpstreamQueue(t, dataPath, "test", testUpstreamMsgs(0, 3))
+
+	q, err := newUpstreamDiskQueue("test", dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	cnt, err := q.ForEach(func(m *upstreamMessage) error {
+		bodies = append(bodies, string(m.Body))
+		return nil
+	})
+	if err != nil || cnt != 3 || q.Depth() != 3 {
+		t.Fatalf("read upstream queue failed: %v, %v, %v", err, cnt, q.Depth())
+	}
+	if bodies[0] != "body-0" || bodies[2] != "body-2" {
+		t.Fatalf("unexpected message bodies: %v", bodies)
+	}
+
+	// the queue never written
+	q, err = newUpstreamDiskQueue("test:ch", dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnt, err = q.ForEach(func(m *upstreamMessage) error { return nil })
+	if err != nil || cnt != 0 {
+		t.Fatalf("read empty upstream queue failed: %v, %v", err, cnt)
+	}
+}
+
+func TestMigrateTopicPreserveOffsets(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsq-migrate-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataPath)
+	*srcDataPath = dataPath
+	// ch1 has the longest backlog, ch2 consumed the first 3 messages of ch1,
+	// ch3 has the requeued message flushed at the end, and ch4 has no backlog.
+	writeUpstreamQueue(t, dataPath, "test", testUpstreamMsgs(10, 12))
+	writeUpstreamQueue(t, dataPath, "test:ch1", testUpstreamMsgs(0, 10))
+	writeUpstreamQueue(t, dataPath, "test:ch2", testUpstreamMsgs(3, 10))
+	writeUpstreamQueue(t, dataPath, "test:ch3", append(testUpstreamMsgs(6, 10), testUpstreamMsgs(5, 6)...))
+
+	opts := nsqd.NewOptions()
+	opts.DataPath = path.Join(dataPath, "dst")
+	os.MkdirAll(opts.DataPath, 0755)
+	n := nsqd.New(opts)
+	n.Start()
+	defer n.Exit()
+
+	stats, err := migrateTopic(n, upstreamTopicMeta{
+		Name: "test",
+		Channels: []upstreamChannelMeta{
+			{Name: "ch1"}, {Name: "ch2"}, {Name: "ch3"}, {Name: "ch4"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.topicMsgs != 2 || stats.channelMsgs["ch1"] != 10 || stats.channelMsgs["ch2"] != 7 ||
+		stats.channelMsgs["ch3"] != 5 || stats.channelMsgs["ch4"] != 0 {
+		t.Fatalf("unexpected migrate stats: %v", stats)
+	}
+	topic := n.GetTopic("test", 0)
+	if topic.TotalMessageCnt() != 12 {
+		t.Fatalf("topic should have 12 messages: %v", topic.TotalMessageCnt())
+	}
+	depths := map[string]int64{"ch1": 12, "ch2": 9, "ch3": 2, "ch4": 2}
+	for chName, depth := range depths {
+		ch := topic.GetChannel(chName)
+		if ch.Depth() != depth {
+			t.Errorf("channel %v depth should be %v: %v", chName, depth, ch.Depth())
+		}
+		if ch.GetConfirmed().TotalMsgCnt() != 12-depth {
+			t.Errorf("channel %v should start at %v: %v", chName, 12-depth, ch.GetConfirmed())
+		}
+	}
+	dq := topic.GetDelayedQueue()
+	if dq == nil {
+		t.Fatal("the backlog of ch3 should be in the delayed queue")
+	}
+	cnt, _ := dq.GetCurrentDelayedCnt(nsqd.ChannelDelayed, "ch3")
+	if cnt != 5 {
+		t.Fatalf("ch3 should have 5 delayed messages: %v", cnt)
+	}
+
+	// the topic not empty should not be migrated again
+	_, err = migrateTopic(n, upstreamTopicMeta{Name: "test"})
+	if err == nil {
+		t.Fatal("migrate to the topic not empty should fail")
+	}
+}
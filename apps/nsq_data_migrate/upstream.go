@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+const (
+	// upstream message: [8 bytes timestamp][2 bytes attempts][16 bytes hex id][body]
+	upstreamMsgIDLength      = 16
+	upstreamMinMessageSize   = 8 + 2 + upstreamMsgIDLength
+	upstreamMaxMessageSize   = 1024 * 1024 * 100
+	upstreamEphemeralSuffix  = "#ephemeral"
+	upstreamMetaDataFileName = "nsqd.dat"
+)
+
+var errUpstreamInvalidMessage = errors.New("invalid upstream message")
+
+type upstreamChannelMeta struct {
+	Name   string `json:"name"`
+	Paused bool   `json:"paused"`
+}
+
+type upstreamTopicMeta struct {
+	Name     string                `json:"name"`
+	Paused   bool                  `json:"paused"`
+	Channels []upstreamChannelMeta `json:"channels"`
+}
+
+type upstreamMetaData struct {
+	Version string              `json:"version"`
+	Topics  []upstreamTopicMeta `json:"topics"`
+}
+
+type upstreamMessage struct {
+	ID        [upstreamMsgIDLength]byte
+	Timestamp int64
+	Attempts  uint16
+	Body      []byte
+}
+
+// the metadata file is nsqd.dat since upstream v1.0, and the older version
+// use nsqd.<id>.dat
+func loadUpstreamMetaData(dataPath string, nodeID int64) (*upstreamMetaData, error) {
+	fn := path.Join(dataPath, upstreamMetaDataFileName)
+	if nodeID >= 0 {
+		fn = path.Join(dataPath, fmt.Sprintf("nsqd.%d.dat", nodeID))
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var meta upstreamMetaData
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metadata %v - %v", fn, err)
+	}
+	return &meta, nil
+}
+
+func decodeUpstreamMessage(b []byte) (*upstreamMessage, error) {
+	if len(b) < upstreamMinMessageSize {
+		return nil, errUpstreamInvalidMessage
+	}
+	var msg upstreamMessage
+	msg.Timestamp = int64(binary.BigEndian.Uint64(b[:8]))
+	msg.Attempts = binary.BigEndian.Uint16(b[8:10])
+	copy(msg.ID[:], b[10:10+upstreamMsgIDLength])
+	msg.Body = b[upstreamMinMessageSize:]
+	return &msg, nil
+}
+
+// upstreamDiskQueue reads the unconsumed messages of the upstream diskqueue,
+// the topic queue name is the topic name and the channel queue name is topic:channel.
+type upstreamDiskQueue struct {
+	name         string
+	dataPath     string
+	depth        int64
+	readFileNum  int64
+	readPos      int64
+	writeFileNum int64
+	writePos     int64
+}
+
+func newUpstreamDiskQueue(name string, dataPath string) (*upstreamDiskQueue, error) {
+	q := &upstreamDiskQueue{
+		name:     name,
+		dataPath: dataPath,
+	}
+	f, err := os.Open(q.metaDataFileName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			// the queue has never been written
+			return q, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
+		&q.depth,
+		&q.readFileNum, &q.readPos,
+		&q.writeFileNum, &q.writePos)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata of queue %v - %v", name, err)
+	}
+	return q, nil
+}
+
+func (q *upstreamDiskQueue) metaDataFileName() string {
+	return path.Join(q.dataPath, fmt.Sprintf("%s.diskqueue.meta.dat", q.name))
+}
+
+func (q *upstreamDiskQueue) fileName(fileNum int64) string {
+	return path.Join(q.dataPath, fmt.Sprintf("%s.diskqueue.%06d.dat", q.name, fileNum))
+}
+
+func (q *upstreamDiskQueue) Depth() int64 {
+	return q.depth
+}
+
+// ForEach reads the messages from the read position to the write position in order.
+func (q *upstreamDiskQueue) ForEach(fn func(msg *upstreamMessage) error) (int64, error) {
+	var cnt int64
+	for fileNum := q.readFileNum; fileNum <= q.writeFileNum; fileNum++ {
+		var startPos int64
+		if fileNum == q.readFileNum {
+			startPos = q.readPos
+		}
+		endPos := int64(-1)
+		if fileNum == q.writeFileNum {
+			endPos = q.writePos
+		}
+		n, err := q.readFile(fileNum, startPos, endPos, fn)
+		cnt += n
+		if err != nil {
+			return cnt, err
+		}
+	}
+	return cnt, nil
+}
+
+func (q *upstreamDiskQueue) readFile(fileNum int64, startPos int64, endPos int64,
+	fn func(msg *upstreamMessage) error) (int64, error) {
+	if endPos >= 0 && startPos >= endPos {
+		return 0, nil
+	}
+	f, err := os.Open(q.fileName(fileNum))
+	if err != nil {
+		if os.IsNotExist(err) && endPos < 0 {
+			// the file may be removed after all read
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	if startPos > 0 {
+		_, err = f.Seek(startPos, 0)
+		if err != nil {
+			return 0, err
+		}
+	}
+	r := bufio.NewReader(f)
+	pos := startPos
+	var cnt int64
+	var sizeBuf [4]byte
+	for endPos < 0 || pos < endPos {
+		_, err = io.ReadFull(r, sizeBuf[:])
+		if err != nil {
+			if err == io.EOF && endPos < 0 {
+				return cnt, nil
+			}
+			return cnt, fmt.Errorf("read %v at %v failed: %v", q.fileName(fileNum), pos, err)
+		}
+		size := int32(binary.BigEndian.Uint32(sizeBuf[:]))
+		if size < upstreamMinMessageSize || size > upstreamMaxMessageSize {
+			return cnt, fmt.Errorf("invalid message size %v in %v at %v", size, q.fileName(fileNum), pos)
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return cnt, fmt.Errorf("read %v at %v failed: %v", q.fileName(fileNum), pos, err)
+		}
+		pos += 4 + int64(size)
+		msg, err := decodeUpstreamMessage(data)
+		if err != nil {
+			return cnt, err
+		}
+		err = fn(msg)
+		if err != nil {
+			return cnt, err
+		}
+		cnt++
+	}
+	return cnt, nil
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/judwhite/go-svc/svc"
 	"github.com/mreiferson/go-options"
 	"github.com/youzan/nsq/internal/app"
+	"github.com/youzan/nsq/internal/levellogger"
 	"github.com/youzan/nsq/internal/version"
 	"github.com/youzan/nsq/nsqd"
 	"github.com/youzan/nsq/nsqdserver"
@@ -94,6 +95,8 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.String("reverse-proxy-port", opts.ReverseProxyPort, "<port> for reverse proxy port")
 	authHTTPAddresses := app.StringArray{}
 	flagSet.Var(&authHTTPAddresses, "auth-http-address", "<addr>:<port> to query auth server (may be given multiple times)")
+	flagSet.String("acl-file", opts.ACLFile, "path to the json acl file with the allow/deny rules for the identities on topics")
+	flagSet.String("selftest-auth-secret", opts.SelfTestAuthSecret, "the secret sent by the self test client to the auth server if the auth is enabled")
 	flagSet.String("broadcast-address", opts.BroadcastAddress, "address that will be registered with lookupd (defaults to the OS hostname)")
 	flagSet.String("broadcast-interface", opts.BroadcastInterface, "address that will be registered with lookupd (defaults to the OS hostname)")
 	lookupdTCPAddrs := app.StringArray{}
@@ -113,9 +116,27 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-msg-size", opts.MaxMsgSize, "maximum size of a single message in bytes")
 	flagSet.Duration("max-req-timeout", opts.MaxReqTimeout, "maximum requeuing timeout for a message")
 	flagSet.Duration("req-to-end-threshold", opts.ReqToEndThreshold, "duration threshold for requeue message to queue end")
+	flagSet.Int64("inflight-spill-threshold", opts.InFlightSpillThreshold, "release the in-flight message body from memory if the channel in-flight count is more than this (0 to disable)")
+	flagSet.Duration("max-reply-channel-ttl", opts.MaxReplyChannelTTL, "maximum (and default) duration before the reply channel created by client expired")
+	flagSet.Duration("max-heartbeat-rtt", opts.MaxHeartbeatRTT, "close the client connection if the heartbeat round-trip time exceeds this (0 to disable)")
+	flagSet.Duration("producer-idle-timeout", opts.ProducerIdleTimeout, "close the client connection not consuming if no publish in this duration (0 to disable)")
+	flagSet.Duration("max-conn-lifetime", opts.MaxConnLifetime, "close the client connection after this duration with up to 10% jitter to force rebalancing and re-auth (0 to disable)")
+	flagSet.Int64("max-conns-per-ip", opts.MaxConnsPerIP, "maximum concurrent tcp connections from a single remote ip (0 for no limit)")
+	flagSet.Int64("max-conns-per-identity", opts.MaxConnsPerIdentity, "maximum concurrent tcp connections of a single auth or tls identity (0 for no limit)")
+	flagSet.Int64("max-topic-publishers", opts.MaxTopicPublishers, "maximum tcp connections publishing to a single topic partition (0 for no limit)")
+	flagSet.Duration("ordered-stuck-timeout", opts.OrderedStuckTimeout, "mark the ordered channel as stuck if the delivery is not advanced in this duration (0 to disable)")
 	// remove, deprecated
 	flagSet.Int64("max-message-size", opts.MaxMsgSize, "(deprecated use --max-msg-size) maximum size of a single message in bytes")
 	flagSet.Int64("max-body-size", opts.MaxBodySize, "maximum size of a single command body")
+	flagSet.Int64("max-http-mpub-batch-size", opts.MaxHTTPMPubBatchSize, "size in bytes of the batch written while reading the http mpub body, the mpub larger than the batch is not atomic (0 to disable)")
+	flagSet.Duration("slow-disk-sync-threshold", opts.SlowDiskSyncThreshold, "the partition is degraded if the average fsync latency exceeds this for a while (0 to disable)")
+	flagSet.Duration("slow-disk-write-threshold", opts.SlowDiskWriteThreshold, "the partition is degraded if the average disk write latency exceeds this for a while (0 to disable)")
+	flagSet.Bool("slow-disk-auto-transfer", opts.SlowDiskAutoTransfer, "transfer the leadership of the degraded partition to the other isr node")
+	flagSet.String("alert-webhook", opts.AlertWebhook, "url to post the alert events (json) of the slow disk and the slo to")
+	flagSet.String("conn-event-webhook", opts.ConnEventWebhook, "url to post the tcp client connection events (json) to")
+	flagSet.Int64("pub-backpressure-depth", opts.PubBackpressureDepth, "reject the publish with retry after if the channel backlog messages of the topic exceeds this (0 to disable)")
+	flagSet.Int64("pub-backpressure-bytes", opts.PubBackpressureBytes, "reject the publish with retry after if the channel backlog bytes of the topic exceeds this (0 to disable)")
+	flagSet.Duration("pub-backpressure-retry-after", opts.PubBackpressureRetryAfter, "the retry after returned to the producer rejected by the backpressure")
 
 	// client overridable configuration options
 	flagSet.Duration("max-heartbeat-interval", opts.MaxHeartbeatInterval, "maximum client configurable duration of time between client heartbeats")
@@ -123,6 +144,15 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-output-buffer-size", opts.MaxOutputBufferSize, "maximum client configurable size (in bytes) for a client output buffer")
 	flagSet.Duration("max-output-buffer-timeout", opts.MaxOutputBufferTimeout, "maximum client configurable duration of time between flushing to a client")
 	flagSet.Int64("max-confirm-win", opts.MaxConfirmWin, "maximum confirm window (in bytes)")
+	flagSet.Int("max-tcp-buffer-size", opts.MaxTCPBufferSize, "maximum client configurable size (in bytes) for the tcp socket send/receive buffer")
+
+	// tcp options for client connections
+	flagSet.Bool("tcp-no-delay", opts.TCPNoDelay, "enable TCP_NODELAY for client connections")
+	flagSet.Int("tcp-send-buffer-size", opts.TCPSendBufferSize, "SO_SNDBUF (in bytes) for client connections (0 for system default)")
+	flagSet.Int("tcp-recv-buffer-size", opts.TCPRecvBufferSize, "SO_RCVBUF (in bytes) for client connections (0 for system default)")
+	flagSet.Duration("tcp-keepalive-period", opts.TCPKeepAlivePeriod, "tcp keepalive period for client connections (0 for system default, negative to disable)")
+	tcpListeners := app.StringArray{}
+	flagSet.Var(&tcpListeners, "tcp-listener", "extra <addr>:<port>[,tcp_no_delay=..,tcp_send_buffer_size=..,tcp_recv_buffer_size=..,tcp_keepalive_period=..] to listen on for TCP clients with own tcp options (may be given multiple times)")
 
 	// statsd integration options
 	flagSet.String("statsd-address", opts.StatsdAddress, " <addr>:<port> of a statsd daemon for pushing stats")
@@ -131,6 +161,16 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Bool("statsd-mem-stats", opts.StatsdMemStats, "toggle sending memory and GC stats to statsd")
 	flagSet.String("statsd-prefix", opts.StatsdPrefix, "prefix used for keys sent to statsd (%s for host replacement)")
 
+	// client pub stats options
+	flagSet.String("pub-stats-aggregate-key", opts.PubStatsAggregateKey, "aggregate the client pub stats by the 'remote' address or by the user agent and 'identity'")
+	flagSet.Int("max-pub-client-stats", opts.MaxPubClientStats, "maximum client pub stats kept for each topic, the least recently used will be evicted")
+	flagSet.Duration("pub-client-stats-ttl", opts.PubClientStatsTTL, "duration of the client pub stats kept since last updated")
+	flagSet.Duration("pub-client-stats-gc-interval", opts.PubClientStatsGCInterval, "interval to remove the expired client pub stats (0 to disable)")
+
+	// channel depth history options
+	flagSet.Duration("depth-history-interval", opts.DepthHistoryInterval, "duration between sampling the channel depth history, such as 1m (default 0 to disable)")
+	flagSet.Duration("depth-history-retention", opts.DepthHistoryRetention, "duration of the channel depth history kept")
+
 	// End to end percentile flags
 	e2eProcessingLatencyPercentiles := app.FloatArray{}
 	flagSet.Var(&e2eProcessingLatencyPercentiles, "e2e-processing-latency-percentile", "message processing time percentiles (as float (0, 1.0]) to track (can be specified multiple times or comma separated '1.0,0.99,0.95', default none)")
@@ -141,6 +181,8 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.String("tls-key", opts.TLSKey, "path to key file")
 	flagSet.String("tls-client-auth-policy", opts.TLSClientAuthPolicy, "client certificate auth policy ('require' or 'require-verify')")
 	flagSet.String("tls-root-ca-file", opts.TLSRootCAFile, "path to certificate authority file")
+	flagSet.String("tls-identity-mode", opts.TLSIdentityMode, "use the client certificate as the client identity ('cn' or 'san')")
+	flagSet.String("mtls-required-for", opts.MTLSRequiredFor, "require mutual TLS only for publish or subscribe ('pub' or 'sub'), the other can be plaintext")
 	tlsRequired := tlsRequiredOption(opts.TLSRequired)
 	tlsMinVersion := tlsMinVersionOption(opts.TLSMinVersion)
 	flagSet.Var(&tlsRequired, "tls-required", "require TLS for client connections (true, false, tcp-https)")
@@ -152,10 +194,20 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Bool("snappy", opts.SnappyEnabled, "enable snappy feature negotiation (client compression)")
 	flagSet.Int("log-level", int(opts.LogLevel), "log verbose level")
 	flagSet.String("log-dir", opts.LogDir, "directory for logs")
+	flagSet.String("log-format", opts.LogFormat, "log output format (text or json)")
+	flagSet.String("log-sinks", opts.LogSinks, "comma separated log sinks (glog, stdout, stderr), use glog if empty")
 	flagSet.String("remote-tracer", opts.RemoteTracer, "server for message tracing")
+	flagSet.String("otlp-endpoint", opts.OTLPEndpoint, "OTLP/HTTP collector (http://host:4318) to export the spans of the messages carrying traceparent, disabled if empty")
+	flagSet.String("otlp-service-name", opts.OTLPServiceName, "service name of the exported spans")
+	flagSet.String("archive-store", opts.ArchiveStore, "cold storage for the consumed segments of the archived topics (file:///path or s3://bucket/prefix)")
+	flagSet.String("archive-s3-endpoint", opts.ArchiveS3Endpoint, "endpoint of the S3 compatible service (default https://s3.amazonaws.com)")
+	flagSet.String("archive-s3-region", opts.ArchiveS3Region, "region of the S3 bucket (default us-east-1)")
+	flagSet.String("archive-s3-access-key", opts.ArchiveS3AccessKey, "access key of the S3 bucket")
+	flagSet.String("archive-s3-secret-key", opts.ArchiveS3SecretKey, "secret key of the S3 bucket")
 	flagSet.Int("retention-days", int(opts.RetentionDays), "the default retention days for topic data")
 	flagSet.Int64("retention-size-per-day", int64(opts.RetentionSizePerDay), "the default retention bytes in a day for topic data")
 	flagSet.Bool("start-as-fix-mode", opts.StartAsFixMode, "enable data fix at start")
+	flagSet.Bool("read-only-recovery", opts.ReadOnlyRecovery, "start to serve the existing data for consumption only, reject all publishes and never become leader")
 	flagSet.Bool("allow-ext-compatible", opts.AllowExtCompatible, "allow pub ext to non-ext topic(ignore ext) .")
 	flagSet.Bool("allow-sub-ext-compatible", opts.AllowSubExtCompatible, "allow sub ext-topic without ext in message.")
 
@@ -248,14 +300,27 @@ func (p *program) Start() error {
 		glog.SetGLogDir(opts.LogDir)
 	}
 	glog.StartWorker(time.Second * 2)
+	if opts.LogSinks != "" {
+		logger, err := levellogger.NewSinkLogger(opts.LogSinks)
+		if err != nil {
+			log.Fatalf("ERROR: invalid log sinks - %s", err)
+		}
+		opts.Logger = logger
+	}
+	if err := levellogger.SetLogFormat(opts.LogFormat); err != nil {
+		log.Fatalf("ERROR: invalid log format %v - %s", opts.LogFormat, err)
+	}
 
 	// if we are using the coordinator, we should disable the topic at startup
 	initDisabled := int32(0)
-	if opts.RPCPort != "" {
+	// in read only recovery mode the coordinator is not started, so the topics
+	// should be loaded as enabled to allow consuming the existing data
+	if opts.RPCPort != "" && !opts.ReadOnlyRecovery {
 		initDisabled = 1
 	}
 	nsqd.SetLogger(opts.Logger)
 	nsqd.SetRemoteMsgTracer(opts.RemoteTracer)
+	nsqd.SetOTLPExporter(opts.OTLPEndpoint, opts.OTLPServiceName)
 
 	nsqd, nsqdServer := nsqdserver.NewNsqdServer(opts)
 
@@ -271,5 +336,6 @@ func (p *program) Stop() error {
 	if p.nsqdServer != nil {
 		p.nsqdServer.Exit()
 	}
+	nsqd.StopOTLPExporter()
 	return nil
 }
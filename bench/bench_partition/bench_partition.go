@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spaolacci/murmur3"
+	"github.com/youzan/go-nsq"
+	"github.com/youzan/nsq/internal/app"
+	"github.com/youzan/nsq/nsqd"
+)
+
+// the partition aware benchmark, the pub is routed to the partitions by the
+// lookupd and the latency is counted in the same buckets as the
+// msg_write_latency_stats of nsqd, so the client side latency can be compared
+// with the /stats of the partitions.
+var (
+	flagSet = flag.NewFlagSet("bench_partition", flag.ExitOnError)
+
+	mode           = flagSet.String("mode", "pubsub", "the load to run (pub/sub/pubsub)")
+	lookupAddress  = flagSet.String("lookupd-http-address", "127.0.0.1:4161", "<addr>:<port> to connect to nsqlookupd")
+	topics         = app.StringArray{}
+	channel        = flagSet.String("channel", "bench_ch", "the channel to consume")
+	runfor         = flagSet.Duration("runfor", 10*time.Second, "duration of time to run")
+	drainTimeout   = flagSet.Duration("drain-timeout", 10*time.Second, "the max time to wait the sub catching up the pub after runfor in pubsub mode")
+	size           = flagSet.Int("size", 100, "size of messages")
+	batchSize      = flagSet.Int("batch-size", 1, "batch size of messages, use mpub if larger than 1")
+	pubConcurrency = flagSet.Int("pub-c", 16, "concurrency of pub goroutine for each topic")
+	subConcurrency = flagSet.Int("sub-c", 16, "concurrency of sub handler for each topic")
+	pubRate        = flagSet.Int("rate", 0, "the max messages pub per second for each topic, 0 for no limit")
+	shardingKeys   = flagSet.Int("sharding-keys", 0, "pub ordered by the random sharding key in the number of keys, 0 to pub round robin to the partitions")
+	reportInterval = flagSet.Duration("report-interval", 5*time.Second, "interval of the throughput report")
+	reportJSON     = flagSet.String("report-json", "", "the file to write the final report in json")
+	deadline       = flagSet.String("deadline", "", "deadline to start the benchmark run")
+)
+
+var percentiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+func init() {
+	flagSet.Var(&topics, "bench-topics", "the topic list for benchmark [t1, t2, t3]")
+}
+
+type partitionCounter struct {
+	pubCount  int64
+	pubErrors int64
+	subCount  int64
+	// the pub latency is the round trip of the pub command, and the e2e latency
+	// is from the message written to consumed
+	pubLatency nsqd.TopicMsgStatsInfo
+	e2eLatency nsqd.TopicMsgStatsInfo
+}
+
+type benchStats struct {
+	sync.Mutex
+	partitions map[string]*partitionCounter
+	total      partitionCounter
+}
+
+func (s *benchStats) get(key string) *partitionCounter {
+	s.Lock()
+	c, ok := s.partitions[key]
+	if !ok {
+		c = &partitionCounter{}
+		s.partitions[key] = c
+	}
+	s.Unlock()
+	return c
+}
+
+func (s *benchStats) pubDone(topic string, pid int, cnt int64, cost time.Duration) {
+	us := int64(cost / time.Microsecond)
+	for _, c := range []*partitionCounter{s.get(partitionName(topic, pid)), &s.total} {
+		atomic.AddInt64(&c.pubCount, cnt)
+		c.pubLatency.BatchUpdateMsgLatencyStats(us, cnt)
+	}
+}
+
+func (s *benchStats) pubFailed(topic string) {
+	// the partition is unknown if failed
+	atomic.AddInt64(&s.get(topic+"-unknown").pubErrors, 1)
+	atomic.AddInt64(&s.total.pubErrors, 1)
+}
+
+func (s *benchStats) subDone(topic string, pid int, cost time.Duration) {
+	us := int64(cost / time.Microsecond)
+	for _, c := range []*partitionCounter{s.get(partitionName(topic, pid)), &s.total} {
+		atomic.AddInt64(&c.subCount, 1)
+		c.e2eLatency.UpdateMsgLatencyStats(us)
+	}
+}
+
+// LatencyReport is the percentiles estimated from the latency buckets, the buckets
+// are the same as the msg_write_latency_stats of nsqd.
+type LatencyReport struct {
+	Buckets     []int64          `json:"buckets"`
+	Percentiles map[string]int64 `json:"percentiles_us"`
+}
+
+type PartitionReport struct {
+	Name       string        `json:"name"`
+	PubCount   int64         `json:"pub_count"`
+	PubErrors  int64         `json:"pub_errors"`
+	PubRate    float64       `json:"pub_rate"`
+	SubCount   int64         `json:"sub_count"`
+	SubRate    float64       `json:"sub_rate"`
+	PubLatency LatencyReport `json:"pub_latency"`
+	E2eLatency LatencyReport `json:"e2e_latency"`
+}
+
+type BenchReport struct {
+	Mode       string            `json:"mode"`
+	Duration   string            `json:"duration"`
+	MsgSize    int               `json:"msg_size"`
+	BatchSize  int               `json:"batch_size"`
+	Total      PartitionReport   `json:"total"`
+	Partitions []PartitionReport `json:"partitions"`
+}
+
+type PartitionReportList []PartitionReport
+
+func (l PartitionReportList) Len() int {
+	return len(l)
+}
+
+func (l PartitionReportList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l PartitionReportList) Less(i, j int) bool {
+	return l[i].Name < l[j].Name
+}
+
+func newLatencyReport(stats *nsqd.TopicMsgStatsInfo) LatencyReport {
+	r := LatencyReport{
+		Buckets:     make([]int64, len(stats.MsgWriteLatencyStats)),
+		Percentiles: make(map[string]int64),
+	}
+	for i := range stats.MsgWriteLatencyStats {
+		r.Buckets[i] = atomic.LoadInt64(&stats.MsgWriteLatencyStats[i])
+	}
+	for _, p := range percentiles {
+		latency, _ := nsqd.WriteLatencyPercentile(r.Buckets, p)
+		r.Percentiles["p"+strconv.FormatFloat(p*100, 'f', -1, 64)] = int64(latency / time.Microsecond)
+	}
+	return r
+}
+
+// the pub rate is counted in the pub duration, and the sub rate is counted in the
+// whole duration including the drain time.
+func newPartitionReport(name string, c *partitionCounter, pubDuration time.Duration, d time.Duration) PartitionReport {
+	r := PartitionReport{
+		Name:       name,
+		PubCount:   atomic.LoadInt64(&c.pubCount),
+		PubErrors:  atomic.LoadInt64(&c.pubErrors),
+		SubCount:   atomic.LoadInt64(&c.subCount),
+		PubLatency: newLatencyReport(&c.pubLatency),
+		E2eLatency: newLatencyReport(&c.e2eLatency),
+	}
+	r.PubRate = float64(r.PubCount) / pubDuration.Seconds()
+	r.SubRate = float64(r.SubCount) / d.Seconds()
+	return r
+}
+
+func (s *benchStats) report(pubDuration time.Duration, d time.Duration) *BenchReport {
+	r := &BenchReport{
+		Mode:      *mode,
+		Duration:  d.String(),
+		MsgSize:   *size,
+		BatchSize: *batchSize,
+		Total:     newPartitionReport("total", &s.total, pubDuration, d),
+	}
+	s.Lock()
+	for name, c := range s.partitions {
+		r.Partitions = append(r.Partitions, newPartitionReport(name, c, pubDuration, d))
+	}
+	s.Unlock()
+	sort.Sort(PartitionReportList(r.Partitions))
+	return r
+}
+
+func logPartitionReport(r PartitionReport) {
+	log.Printf("%v: pub %v (%.03fops/s, errors %v), pub latency(us) %v, sub %v (%.03fops/s), e2e latency(us) %v",
+		r.Name, r.PubCount, r.PubRate, r.PubErrors, r.PubLatency.Percentiles,
+		r.SubCount, r.SubRate, r.E2eLatency.Percentiles)
+}
+
+func partitionName(topic string, pid int) string {
+	return topic + "-" + strconv.Itoa(pid)
+}
+
+func getPartitionID(msgID nsq.NewMessageID) int {
+	return int(uint64(msgID) >> 50)
+}
+
+func pubWorker(stats *benchStats, pubMgr *nsq.TopicProducerMgr, topic string, endTime time.Time, goChan chan int) {
+	batch := make([][]byte, *batchSize)
+	for i := range batch {
+		batch[i] = make([]byte, *size)
+	}
+	traceIDs := make([]uint64, len(batch))
+	var ticker *time.Ticker
+	if *pubRate > 0 {
+		interval := time.Duration(float64(time.Second) * float64(*pubConcurrency**batchSize) / float64(*pubRate))
+		ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	<-goChan
+	for time.Now().Before(endTime) {
+		if ticker != nil {
+			<-ticker.C
+		}
+		var id nsq.NewMessageID
+		var err error
+		start := time.Now()
+		if *shardingKeys > 0 {
+			key := []byte(strconv.Itoa(r.Intn(*shardingKeys)))
+			id, _, _, err = pubMgr.PublishOrdered(topic, key, batch[0])
+		} else if len(batch) > 1 {
+			id, _, _, err = pubMgr.MultiPublishAndTrace(topic, traceIDs, batch)
+		} else {
+			id, _, _, err = pubMgr.PublishAndTrace(topic, 0, batch[0])
+		}
+		if err != nil {
+			stats.pubFailed(topic)
+			log.Printf("topic %v pub error: %v", topic, err)
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+		stats.pubDone(topic, getPartitionID(id), int64(len(batch)), time.Since(start))
+	}
+}
+
+type benchHandler struct {
+	topic string
+	stats *benchStats
+}
+
+func (h *benchHandler) HandleMessage(message *nsq.Message) error {
+	id := nsq.GetNewMessageID(message.ID[:8])
+	h.stats.subDone(h.topic, getPartitionID(id), time.Since(time.Unix(0, message.Timestamp)))
+	return nil
+}
+
+func newConfig() *nsq.Config {
+	config := nsq.NewConfig()
+	config.PubStrategy = nsq.PubRR
+	config.EnableTrace = true
+	config.MaxInFlight = *subConcurrency * 2
+	config.OutputBufferSize = 1024 * 32
+	if *shardingKeys > 0 {
+		config.EnableOrdered = true
+		config.Hasher = murmur3.New32()
+	}
+	return config
+}
+
+func startPub(stats *benchStats, goChan chan int, wg *sync.WaitGroup, endTime time.Time) {
+	config := newConfig()
+	for _, t := range topics {
+		for i := 0; i < *pubConcurrency; i++ {
+			pubMgr, err := nsq.NewTopicProducerMgr([]string{t}, config)
+			if err != nil {
+				log.Fatalf("init error: %v", err)
+			}
+			pubMgr.SetLogger(log.New(os.Stderr, "", log.LstdFlags), nsq.LogLevelInfo)
+			err = pubMgr.ConnectToNSQLookupd(*lookupAddress)
+			if err != nil {
+				log.Fatalf("lookup connect error: %v", err)
+			}
+			wg.Add(1)
+			go func(topic string) {
+				defer wg.Done()
+				defer pubMgr.Stop()
+				pubWorker(stats, pubMgr, topic, endTime, goChan)
+			}(t)
+		}
+	}
+}
+
+func startSub(stats *benchStats) []*nsq.Consumer {
+	config := newConfig()
+	consumers := make([]*nsq.Consumer, 0, len(topics))
+	for _, t := range topics {
+		consumer, err := nsq.NewConsumer(t, *channel, config)
+		if err != nil {
+			log.Fatalf("init consumer error: %v", err)
+		}
+		consumer.SetLogger(log.New(os.Stderr, "", log.LstdFlags), nsq.LogLevelInfo)
+		consumer.AddConcurrentHandlers(&benchHandler{topic: t, stats: stats}, *subConcurrency)
+		err = consumer.ConnectToNSQLookupd(*lookupAddress)
+		if err != nil {
+			log.Fatalf("lookup connect error: %v", err)
+		}
+		consumers = append(consumers, consumer)
+	}
+	return consumers
+}
+
+func main() {
+	flagSet.Parse(os.Args[1:])
+	log.SetPrefix("[bench_partition] ")
+	if len(topics) == 0 {
+		log.Fatal("--bench-topics required")
+	}
+	if *mode != "pub" && *mode != "sub" && *mode != "pubsub" {
+		log.Fatalf("invalid mode: %v", *mode)
+	}
+	if *batchSize <= 0 || *shardingKeys > 0 {
+		// the ordered pub is not batched
+		*batchSize = 1
+	}
+
+	if *deadline != "" {
+		t, err := time.Parse("2006-01-02 15:04:05", *deadline)
+		if err != nil {
+			log.Fatal(err)
+		}
+		d := t.Sub(time.Now())
+		log.Printf("sleeping until %s (%s)", t, d)
+		time.Sleep(d)
+	}
+
+	stats := &benchStats{partitions: make(map[string]*partitionCounter)}
+	var wg sync.WaitGroup
+	var consumers []*nsq.Consumer
+	goChan := make(chan int)
+	start := time.Now()
+	endTime := start.Add(*runfor)
+	if *mode != "pub" {
+		consumers = startSub(stats)
+	}
+	if *mode != "sub" {
+		startPub(stats, goChan, &wg, endTime)
+	}
+	close(goChan)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(*reportInterval)
+		defer ticker.Stop()
+		var prevPub, prevSub int64
+		prev := start
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				pub := atomic.LoadInt64(&stats.total.pubCount)
+				sub := atomic.LoadInt64(&stats.total.subCount)
+				d := now.Sub(prev).Seconds()
+				log.Printf("pub: %.03fops/s - %.03fmb/s, sub: %.03fops/s, pub errors: %v",
+					float64(pub-prevPub)/d, float64((pub-prevPub)*int64(*size))/d/1024/1024,
+					float64(sub-prevSub)/d, atomic.LoadInt64(&stats.total.pubErrors))
+				prevPub, prevSub, prev = pub, sub, now
+			}
+		}
+	}()
+
+	wg.Wait()
+	pubDuration := time.Since(start)
+	if *mode == "sub" {
+		time.Sleep(*runfor)
+	} else if *mode == "pubsub" {
+		drainEnd := time.Now().Add(*drainTimeout)
+		for time.Now().Before(drainEnd) &&
+			atomic.LoadInt64(&stats.total.subCount) < atomic.LoadInt64(&stats.total.pubCount) {
+			time.Sleep(time.Millisecond * 100)
+		}
+	}
+	duration := time.Since(start)
+	close(done)
+	for _, c := range consumers {
+		c.Stop()
+		<-c.StopChan
+	}
+
+	report := stats.report(pubDuration, duration)
+	for _, p := range report.Partitions {
+		logPartitionReport(p)
+	}
+	logPartitionReport(report.Total)
+	if *reportJSON != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ioutil.WriteFile(*reportJSON, data, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
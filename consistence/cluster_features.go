@@ -0,0 +1,293 @@
+package consistence
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/blang/semver"
+)
+
+const (
+	FeatureDedupIndex     = "dedup_index"
+	FeatureTopicArchive   = "topic_archive"
+	FeatureChannelCompact = "channel_compact"
+)
+
+var ErrClusterFeatureDisabled = errors.New("the feature is not enabled in cluster until all nodes support it")
+
+// the error returned to nsqd by rpc while the feature is not enabled
+var ErrClusterFeatureNotEnabled = NewCoordErr(ErrClusterFeatureDisabled.Error(), CoordCommonErr)
+
+// ClusterFeature is the new on-disk or protocol feature which can only be
+// enabled after all the nodes in cluster are upgraded to the min version.
+type ClusterFeature struct {
+	Name       string
+	MinVersion string
+	Desc       string
+}
+
+var clusterFeatures = []ClusterFeature{
+	{FeatureDedupIndex, "0.3.7-HA.1.7.0", "persisted dedup index for the topic"},
+	{FeatureTopicArchive, "0.3.7-HA.1.7.0", "archive the consumed topic segments to the object store"},
+	{FeatureChannelCompact, "0.3.7-HA.1.7.0", "compacted channel delivering the latest message of each key"},
+}
+
+// the offline node will be forgotten after this time even it is still in the topic replicas
+var NsqdVersionOfflineExpire = time.Hour * 24
+
+// NsqdNodeVersion is the version of the nsqd node persisted in the cluster, it is kept
+// while the node is offline.
+type NsqdNodeVersion struct {
+	Version      string `json:"version"`
+	OfflineSince int64  `json:"offline_since,omitempty"`
+}
+
+type ClusterFeatureStatus struct {
+	Name             string   `json:"name"`
+	MinVersion       string   `json:"min_version"`
+	Desc             string   `json:"desc"`
+	Enabled          bool     `json:"enabled"`
+	UnsupportedNodes []string `json:"unsupported_nodes,omitempty"`
+}
+
+type ClusterVersionStatus struct {
+	Upgrading       bool                   `json:"upgrading"`
+	NsqdVersions    map[string]string      `json:"nsqd_versions"`
+	LookupdVersions map[string]string      `json:"lookupd_versions"`
+	Features        []ClusterFeatureStatus `json:"features"`
+}
+
+// IsVersionSupported returns false if the version is unknown (the node is older than
+// the version advertising) or less than the min version.
+func IsVersionSupported(ver string, minVer string) bool {
+	if ver == "" {
+		return false
+	}
+	v, err := semver.Parse(ver)
+	if err != nil {
+		return false
+	}
+	minV, err := semver.Parse(minVer)
+	if err != nil {
+		return false
+	}
+	return v.GTE(minV)
+}
+
+func getClusterFeatureStatus(nodeVersions map[string]string, upgrading bool) []ClusterFeatureStatus {
+	ret := make([]ClusterFeatureStatus, 0, len(clusterFeatures))
+	for _, f := range clusterFeatures {
+		st := ClusterFeatureStatus{
+			Name:       f.Name,
+			MinVersion: f.MinVersion,
+			Desc:       f.Desc,
+		}
+		for nid, ver := range nodeVersions {
+			if !IsVersionSupported(ver, f.MinVersion) {
+				st.UnsupportedNodes = append(st.UnsupportedNodes, nid)
+			}
+		}
+		sort.Strings(st.UnsupportedNodes)
+		st.Enabled = !upgrading && len(st.UnsupportedNodes) == 0
+		ret = append(ret, st)
+	}
+	return ret
+}
+
+// the versions of the nsqd nodes are persisted and kept even the node is offline, so the node
+// restarting for rolling upgrade will not enable the new features even the lookup leader changed.
+// The versions written are cached to avoid writing again for each nodes change.
+func (self *NsqLookupCoordinator) updateNsqdNodeVersions(nodes map[string]NsqdNodeInfo) {
+	for nid, n := range nodes {
+		self.nodesMutex.RLock()
+		old, ok := self.nsqdNodeVersions[nid]
+		self.nodesMutex.RUnlock()
+		if ok && old == n.Version {
+			continue
+		}
+		if ok {
+			coordLog.Infof("nsqd node %v version changed from %v to %v", nid, old, n.Version)
+		}
+		if self.leadership != nil {
+			err := self.leadership.UpdateNsqdNodeVersion(nid, &NsqdNodeVersion{Version: n.Version})
+			if err != nil {
+				coordLog.Infof("update nsqd node %v version failed: %v", nid, err)
+				continue
+			}
+		}
+		self.nodesMutex.Lock()
+		self.nsqdNodeVersions[nid] = n.Version
+		self.nodesMutex.Unlock()
+	}
+}
+
+func (self *NsqLookupCoordinator) forgetNsqdNodeVersion(nid string) {
+	if self.leadership != nil {
+		err := self.leadership.DeleteNsqdNodeVersion(nid)
+		if err != nil && err != ErrKeyNotFound {
+			coordLog.Infof("delete nsqd node %v version failed: %v", nid, err)
+			return
+		}
+	}
+	self.nodesMutex.Lock()
+	delete(self.nsqdNodeVersions, nid)
+	self.nodesMutex.Unlock()
+}
+
+// the offline node which is not in any topic replicas will not come back with the topic data,
+// and the node offline too long is not expected to come back for the rolling upgrade,
+// so the versions of them are forgotten to allow the new features enabled without them.
+func (self *NsqLookupCoordinator) cleanStaleNsqdNodeVersions(topics []TopicPartitionMetaInfo) {
+	if self.leadership == nil {
+		return
+	}
+	versions, err := self.leadership.GetNsqdNodeVersions()
+	if err != nil {
+		coordLog.Infof("get nsqd node versions failed: %v", err)
+		return
+	}
+	inReplicas := make(map[string]bool)
+	for _, t := range topics {
+		inReplicas[t.Leader] = true
+		for _, nid := range t.ISR {
+			inReplicas[nid] = true
+		}
+		for _, nid := range t.CatchupList {
+			inReplicas[nid] = true
+		}
+		for _, nid := range t.StandbyList {
+			inReplicas[nid] = true
+		}
+	}
+	now := time.Now()
+	for nid, v := range versions {
+		self.nodesMutex.RLock()
+		_, alive := self.nsqdNodes[nid]
+		_, removing := self.removingNodes[nid]
+		self.nodesMutex.RUnlock()
+		if alive && v.OfflineSince != 0 {
+			v.OfflineSince = 0
+			err := self.leadership.UpdateNsqdNodeVersion(nid, &v)
+			if err != nil {
+				coordLog.Infof("update nsqd node %v version failed: %v", nid, err)
+			}
+		}
+		if alive || removing {
+			continue
+		}
+		if v.OfflineSince == 0 {
+			v.OfflineSince = now.Unix()
+			err := self.leadership.UpdateNsqdNodeVersion(nid, &v)
+			if err != nil {
+				coordLog.Infof("update nsqd node %v version failed: %v", nid, err)
+			}
+		}
+		if inReplicas[nid] && now.Sub(time.Unix(v.OfflineSince, 0)) < NsqdVersionOfflineExpire {
+			continue
+		}
+		coordLog.Infof("forget the version %v of the offline nsqd node %v, offline since: %v",
+			v.Version, nid, time.Unix(v.OfflineSince, 0))
+		self.forgetNsqdNodeVersion(nid)
+	}
+}
+
+func (self *NsqLookupCoordinator) GetClusterVersionStatus() (*ClusterVersionStatus, error) {
+	status := &ClusterVersionStatus{
+		Upgrading:       atomic.LoadInt32(&self.isUpgrading) == 1,
+		NsqdVersions:    make(map[string]string),
+		LookupdVersions: make(map[string]string),
+	}
+	allVersions := make(map[string]string)
+	if self.leadership != nil {
+		versions, err := self.leadership.GetNsqdNodeVersions()
+		if err != nil {
+			return nil, err
+		}
+		for nid, v := range versions {
+			status.NsqdVersions[nid] = v.Version
+			allVersions[nid] = v.Version
+		}
+	}
+	self.nodesMutex.RLock()
+	for nid, ver := range self.nsqdNodeVersions {
+		status.NsqdVersions[nid] = ver
+		allVersions[nid] = ver
+	}
+	for nid, n := range self.nsqdNodes {
+		status.NsqdVersions[nid] = n.Version
+		allVersions[nid] = n.Version
+	}
+	self.nodesMutex.RUnlock()
+	if self.leadership != nil {
+		lookupNodes, err := self.leadership.GetAllLookupdNodes()
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range lookupNodes {
+			status.LookupdVersions[n.GetID()] = n.Version
+			allVersions[n.GetID()] = n.Version
+		}
+	}
+	status.Features = getClusterFeatureStatus(allVersions, status.Upgrading)
+	return status, nil
+}
+
+func (self *NsqLookupCoordinator) IsClusterFeatureEnabled(name string) (bool, error) {
+	status, err := self.GetClusterVersionStatus()
+	if err != nil {
+		return false, err
+	}
+	for _, f := range status.Features {
+		if f.Name == name {
+			return f.Enabled, nil
+		}
+	}
+	return false, errors.New("unknown cluster feature: " + name)
+}
+
+// CheckClusterFeature should be called before enabling any new feature in cluster.
+func (self *NsqLookupCoordinator) CheckClusterFeature(name string) error {
+	enabled, err := self.IsClusterFeatureEnabled(name)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		coordLog.Infof("cluster feature %v is not enabled", name)
+		return ErrClusterFeatureDisabled
+	}
+	return nil
+}
+
+// the node versions are only collected on the leader
+func (self *NsqLookupCoordinator) handleRequestCheckClusterFeature(name string) *CoordErr {
+	if self.leaderNode.GetID() != self.myNode.GetID() {
+		return &CoordErr{ErrNotNsqLookupLeader.Error(), RpcCommonErr, CoordClusterErr}
+	}
+	err := self.CheckClusterFeature(name)
+	if err == ErrClusterFeatureDisabled {
+		return ErrClusterFeatureNotEnabled
+	} else if err != nil {
+		return &CoordErr{err.Error(), RpcCommonErr, CoordCommonErr}
+	}
+	return nil
+}
+
+// CheckClusterFeature asks the nsqlookupd leader whether the new feature can be
+// enabled, the feature is always enabled if the node is not in cluster.
+func (self *NsqdCoordinator) CheckClusterFeature(name string) error {
+	c, coordErr := self.getLookupRemoteProxy()
+	if coordErr != nil {
+		return coordErr.ToErrorType()
+	}
+	coordErr = c.RequestCheckClusterFeature(name)
+	if coordErr == nil {
+		return nil
+	}
+	if coordErr.IsEqual(ErrClusterFeatureNotEnabled) {
+		return ErrClusterFeatureDisabled
+	}
+	coordLog.Infof("check cluster feature %v failed: %v", name, coordErr)
+	return coordErr.ToErrorType()
+}
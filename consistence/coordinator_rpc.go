@@ -341,7 +341,8 @@ func (self *NsqdCoordRpcServer) UpdateTopicInfo(rpcTopicReq *RpcAdminTopicInfo)
 	}
 	if rpcTopicReq.Leader != myID &&
 		FindSlice(rpcTopicReq.ISR, myID) == -1 &&
-		FindSlice(rpcTopicReq.CatchupList, myID) == -1 {
+		FindSlice(rpcTopicReq.CatchupList, myID) == -1 &&
+		FindSlice(rpcTopicReq.StandbyList, myID) == -1 {
 		// a topic info not belong to me,
 		// check if we need to delete local
 		coordLog.Infof("Not a topic(%s) related to me. isr is : %v", rpcTopicReq.Name, rpcTopicReq.ISR)
@@ -582,6 +583,9 @@ func (self *NsqdCoordRpcServer) GetTopicStats(topic string) *NodeTopicStats {
 			}
 			stat.ChannelList[ts.TopicFullName] = chList
 			stat.ChannelMetas[ts.TopicFullName] = localTopic.GetChannelMeta()
+			if localTopic.IsChannelAutoCreateDisabled() {
+				stat.ChannelAutoCreateDisabled[ts.TopicFullName] = true
+			}
 			stat.ChannelNum[ts.TopicFullName] = len(chList)
 		}
 	}
@@ -604,6 +608,14 @@ type RpcChannelState struct {
 	Channel string
 	Paused  int
 	Skipped int
+	// the unix time to resume the paused channel automatically and the pause reason
+	PausedUntil  int64
+	PausedReason string
+}
+
+type RpcTopicPolicy struct {
+	RpcTopicData
+	Policy []byte
 }
 
 type RpcChannelOffsetArg struct {
@@ -743,7 +755,24 @@ func (self *NsqdCoordRpcServer) UpdateChannelState(state *RpcChannelState) *Coor
 		return &ret
 	}
 	// update local channel offset
-	err = self.nsqdCoord.updateChannelStateOnSlave(tc.GetData(), state.Channel, state.Paused, state.Skipped)
+	err = self.nsqdCoord.updateChannelStateOnSlave(tc.GetData(), state.Channel, state.Paused, state.Skipped,
+		state.PausedUntil, state.PausedReason)
+	if err != nil {
+		ret = *err
+		return &ret
+	}
+	return &ret
+}
+
+func (self *NsqdCoordRpcServer) UpdateTopicPolicy(info *RpcTopicPolicy) *CoordErr {
+	var ret CoordErr
+	defer coordErrStats.incCoordErr(&ret)
+	tc, err := self.nsqdCoord.checkWriteForRpcCall(info.RpcTopicData)
+	if err != nil {
+		ret = *err
+		return &ret
+	}
+	err = self.nsqdCoord.updateTopicPolicyOnSlave(tc.GetData(), info.Policy)
 	if err != nil {
 		ret = *err
 		return &ret
@@ -133,16 +133,29 @@ type CatchupStat struct {
 	Progress int    `json:"progress"`
 }
 
+// StandbyStat is the sync state of the standby replica, the log id lag is the
+// difference of the last commit log id between leader and standby before last sync,
+// -1 means unknown.
+type StandbyStat struct {
+	HostName   string `json:"hostname"`
+	NodeID     string `json:"node_id"`
+	LogIDLag   int64  `json:"log_id_lag"`
+	LastSynced int64  `json:"last_synced"`
+}
+
 type TopicCoordStat struct {
 	Node         string        `json:"node"`
 	Name         string        `json:"name"`
 	Partition    int           `json:"partition"`
 	ISRStats     []ISRStat     `json:"isr_stats"`
 	CatchupStats []CatchupStat `json:"catchup_stats"`
+	StandbyStats []StandbyStat `json:"standby_stats"`
 }
 
 type CoordStats struct {
 	RpcStats        *gorpc.ConnStats `json:"rpc_stats"`
 	ErrStats        CoordErrStatsData
 	TopicCoordStats []TopicCoordStat `json:"topic_coord_stats"`
+	// the replication throughput and the limits on this node
+	Replication *ReplicationStats `json:"replication,omitempty"`
 }
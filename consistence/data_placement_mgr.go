@@ -142,6 +142,8 @@ type NodeTopicStats struct {
 	ChannelNum             map[string]int
 	ChannelList            map[string][]string
 	ChannelMetas           map[string][]nsqd.ChannelMetaInfo
+	// the topics which disabled the channel auto creation on subscribe
+	ChannelAutoCreateDisabled map[string]bool
 }
 
 func NewNodeTopicStats(nid string, cap int, cpus int) *NodeTopicStats {
@@ -155,6 +157,8 @@ func NewNodeTopicStats(nid string, cap int, cpus int) *NodeTopicStats {
 		ChannelList:            make(map[string][]string),
 		ChannelMetas:           make(map[string][]nsqd.ChannelMetaInfo),
 		NodeCPUs:               cpus,
+
+		ChannelAutoCreateDisabled: make(map[string]bool),
 	}
 }
 
@@ -1151,6 +1155,9 @@ func (self *DataPlacement) getExcludeNodesForTopic(topicInfo *TopicPartitionMeta
 	for _, v := range topicInfo.CatchupList {
 		excludeNodes[v] = struct{}{}
 	}
+	for _, v := range topicInfo.StandbyList {
+		excludeNodes[v] = struct{}{}
+	}
 	// exclude other partition node with the same topic
 	meta, _, err := self.lookupCoord.leadership.GetTopicMetaInfo(topicInfo.Name)
 	if err != nil {
@@ -10,6 +10,7 @@ var (
 	ErrLeaderSessionNotExist     = errors.New("session not exist")
 	ErrKeyAlreadyExist           = errors.New("Key already exist")
 	ErrKeyNotFound               = errors.New("Key not found")
+	ErrTopicOwnerMetaChanged     = errors.New("topic owner meta changed since read")
 )
 
 type EpochType int64
@@ -20,6 +21,7 @@ type NsqdNodeInfo struct {
 	TcpPort  string
 	RpcPort  string
 	HttpPort string
+	Version  string
 }
 
 func (self *NsqdNodeInfo) GetID() string {
@@ -33,6 +35,7 @@ type NsqLookupdNodeInfo struct {
 	HttpPort string
 	RpcPort  string
 	Epoch    EpochType
+	Version  string
 }
 
 func (self *NsqLookupdNodeInfo) GetID() string {
@@ -61,11 +64,23 @@ type TopicMetaInfo struct {
 	Ext bool
 }
 
+// the owner and contact of the topic, so we know who is in charge of the topic.
+// It is stored separately from the topic meta since it is not used by the data path.
+type TopicOwnerMeta struct {
+	Owner       string `json:"owner"`
+	Team        string `json:"team"`
+	Contact     string `json:"contact"`
+	Description string `json:"description"`
+}
+
 type TopicPartitionReplicaInfo struct {
 	Leader      string
 	ISR         []string
 	CatchupList []string
 	Channels    []string
+	// the standby replicas only pull data from leader, never join the isr and never
+	// become leader automatically, used as cheap copy for disaster recovery
+	StandbyList []string
 	// this is only used for write operation
 	// if this changed during write, mean the current write should be abort
 	EpochForWrite EpochType
@@ -164,6 +179,17 @@ type NSQLookupdLeadership interface {
 	ReleaseTopicLeader(topic string, partition int, session *TopicLeaderSession) error
 	// get topic meta info map with passin topics slice
 	GetTopicsMetaInfoMap(topics []string) (map[string]*TopicMetaInfo, error)
+	// get the topic owner meta with the epoch, should return empty with 0 epoch if not set
+	GetTopicOwnerMeta(topic string) (TopicOwnerMeta, EpochType, error)
+	// update should fail with ErrTopicOwnerMetaChanged if the epoch changed since read
+	UpdateTopicOwnerMeta(topic string, meta *TopicOwnerMeta, oldGen EpochType) error
+	// the cluster limits of the replication bandwidth
+	GetReplicationLimits() (ReplicationLimits, error)
+	UpdateReplicationLimits(limits *ReplicationLimits) error
+	// the versions of all the nsqd nodes ever joined, should return empty if not set
+	GetNsqdNodeVersions() (map[string]NsqdNodeVersion, error)
+	UpdateNsqdNodeVersion(nid string, v *NsqdNodeVersion) error
+	DeleteNsqdNodeVersion(nid string) error
 }
 
 type NSQDLeadership interface {
@@ -182,4 +208,6 @@ type NSQDLeadership interface {
 	GetTopicInfo(topic string, partition int) (*TopicPartitionMetaInfo, error)
 	// get leadership information, if not exist should return ErrLeaderSessionNotExist as error
 	GetTopicLeaderSession(topic string, partition int) (*TopicLeaderSession, error)
+	// the cluster limits of the replication bandwidth, empty limits if not set
+	GetReplicationLimits() (ReplicationLimits, error)
 }
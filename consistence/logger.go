@@ -17,5 +17,6 @@ func SetCoordLogLevel(level int32) {
 }
 
 func init() {
+	levellogger.RegisterSubsystem("coordinator", coordLog)
 	SetEtcdLogger(coordLog.Logger, coordLog.Level())
 }
@@ -672,6 +672,99 @@ func (self *NsqLookupdEtcdMgr) UpdateTopicMetaInfo(topic string, meta *TopicMeta
 	return nil
 }
 
+func (self *NsqLookupdEtcdMgr) GetTopicOwnerMeta(topic string) (TopicOwnerMeta, EpochType, error) {
+	var ownerMeta TopicOwnerMeta
+	rsp, err := self.client.Get(self.createTopicOwnerMetaPath(topic), false, false)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return ownerMeta, 0, nil
+		}
+		return ownerMeta, 0, err
+	}
+	err = json.Unmarshal([]byte(rsp.Node.Value), &ownerMeta)
+	if err != nil {
+		return ownerMeta, 0, err
+	}
+	return ownerMeta, EpochType(rsp.Node.ModifiedIndex), nil
+}
+
+func (self *NsqLookupdEtcdMgr) UpdateTopicOwnerMeta(topic string, meta *TopicOwnerMeta, oldGen EpochType) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	coordLog.Infof("update topic owner meta: %s %s %d", topic, string(value), oldGen)
+	if oldGen == 0 {
+		_, err = self.client.Create(self.createTopicOwnerMetaPath(topic), string(value), 0)
+	} else {
+		_, err = self.client.CompareAndSwap(self.createTopicOwnerMetaPath(topic), string(value), 0, "", uint64(oldGen))
+	}
+	if IsEtcdNodeExist(err) || IsEtcdCompareFailed(err) || client.IsKeyNotFound(err) {
+		return ErrTopicOwnerMetaChanged
+	}
+	return err
+}
+
+func (self *NsqLookupdEtcdMgr) GetReplicationLimits() (ReplicationLimits, error) {
+	var limits ReplicationLimits
+	rsp, err := self.client.Get(self.createReplicationLimitsPath(), false, false)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return limits, nil
+		}
+		return limits, err
+	}
+	err = json.Unmarshal([]byte(rsp.Node.Value), &limits)
+	return limits, err
+}
+
+func (self *NsqLookupdEtcdMgr) UpdateReplicationLimits(limits *ReplicationLimits) error {
+	value, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+	coordLog.Infof("update replication limits: %s", string(value))
+	_, err = self.client.Set(self.createReplicationLimitsPath(), string(value), 0)
+	return err
+}
+
+func (self *NsqLookupdEtcdMgr) GetNsqdNodeVersions() (map[string]NsqdNodeVersion, error) {
+	versions := make(map[string]NsqdNodeVersion)
+	rsp, err := self.client.Get(self.createNsqdVersionsPath(), false, false)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return versions, nil
+		}
+		return nil, err
+	}
+	for _, node := range rsp.Node.Nodes {
+		var v NsqdNodeVersion
+		if err = json.Unmarshal([]byte(node.Value), &v); err != nil {
+			continue
+		}
+		versions[path.Base(node.Key)] = v
+	}
+	return versions, nil
+}
+
+func (self *NsqLookupdEtcdMgr) UpdateNsqdNodeVersion(nid string, v *NsqdNodeVersion) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	coordLog.Infof("update nsqd node version: %s %s", nid, string(value))
+	_, err = self.client.Set(path.Join(self.createNsqdVersionsPath(), nid), string(value), 0)
+	return err
+}
+
+func (self *NsqLookupdEtcdMgr) DeleteNsqdNodeVersion(nid string) error {
+	_, err := self.client.Delete(path.Join(self.createNsqdVersionsPath(), nid), false)
+	if err != nil && client.IsKeyNotFound(err) {
+		return ErrKeyNotFound
+	}
+	return err
+}
+
 func (self *NsqLookupdEtcdMgr) DeleteWholeTopic(topic string) error {
 	self.tmiMutex.Lock()
 	delete(self.topicMetaMap, topic)
@@ -917,6 +1010,18 @@ func (self *NsqLookupdEtcdMgr) createTopicMetaPath(topic string) string {
 	return path.Join(self.topicRoot, topic, NSQ_TOPIC_META)
 }
 
+func (self *NsqLookupdEtcdMgr) createTopicOwnerMetaPath(topic string) string {
+	return path.Join(self.topicRoot, topic, NSQ_TOPIC_OWNER_META)
+}
+
+func (self *NsqLookupdEtcdMgr) createReplicationLimitsPath() string {
+	return path.Join(self.clusterPath, NSQ_REPLICATION_LIMITS)
+}
+
+func (self *NsqLookupdEtcdMgr) createNsqdVersionsPath() string {
+	return path.Join(self.clusterPath, NSQ_NSQD_VERSIONS)
+}
+
 func (self *NsqLookupdEtcdMgr) createTopicPartitionPath(topic string, partition int) string {
 	return path.Join(self.topicRoot, topic, strconv.Itoa(partition))
 }
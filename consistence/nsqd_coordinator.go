@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/youzan/nsq/internal/protocol"
+	"github.com/youzan/nsq/internal/version"
 	"github.com/youzan/nsq/nsqd"
 )
 
@@ -31,6 +32,7 @@ const (
 
 var (
 	MaxRetryWait                = time.Second * 3
+	StandbySyncInterval         = time.Second * 5
 	ForceFixLeaderData          = false
 	MaxTopicRetentionSizePerDay = int64(1024 * 1024 * 1024 * 16)
 )
@@ -148,6 +150,11 @@ type NsqdCoordinator struct {
 	enableBenchCost        bool
 	stopping               int32
 	catchupRunning         int32
+	stopped                int32
+	leaving                int32
+	// refuse to be the new topic leader while draining the node
+	draining     int32
+	replThrottle *replicationThrottle
 }
 
 func NewNsqdCoordinator(cluster, ip, tcpport, rpcport, httpport, extraID string, rootPath string, nsqd *nsqd.NSQD) *NsqdCoordinator {
@@ -156,6 +163,7 @@ func NewNsqdCoordinator(cluster, ip, tcpport, rpcport, httpport, extraID string,
 		TcpPort:  tcpport,
 		RpcPort:  rpcport,
 		HttpPort: httpport,
+		Version:  version.Binary,
 	}
 	nodeInfo.ID = GenNsqdNodeID(&nodeInfo, extraID)
 	nsqdCoord := &NsqdCoordinator{
@@ -171,6 +179,7 @@ func NewNsqdCoordinator(cluster, ip, tcpport, rpcport, httpport, extraID string,
 		tryCheckUnsynced:       make(chan bool, 1),
 		lookupRemoteCreateFunc: NewNsqLookupRpcClient,
 		lookupRemoteClients:    make(map[string]INsqlookupRemoteProxy),
+		replThrottle:           newReplicationThrottle(),
 	}
 
 	if nsqdCoord.leadership != nil {
@@ -263,16 +272,20 @@ func (self *NsqdCoordinator) Start() error {
 	go self.periodFlushCommitLogs()
 	self.wg.Add(1)
 	go self.checkAndCleanOldData()
+	self.wg.Add(1)
+	go self.syncStandbyTopics()
+	self.wg.Add(1)
+	go self.refreshReplicationLimits()
 	return nil
 }
 
 func (self *NsqdCoordinator) Stop() {
-	if atomic.LoadInt32(&self.stopping) == 1 {
+	if !atomic.CompareAndSwapInt32(&self.stopped, 0, 1) {
 		return
 	}
 	// give up the leadership on the topic to
 	// allow other isr take over to avoid electing.
-	self.prepareLeavingCluster()
+	self.LeaveCluster()
 	close(self.stopChan)
 	self.rpcServer.stop()
 	self.rpcServer = nil
@@ -407,6 +420,62 @@ func (self *NsqdCoordinator) checkAndCleanOldData() {
 	}
 }
 
+// keep pulling data from leader for all the topics on which I am the standby replica,
+// and check the lag of the standby replicas for the topics on which I am the leader.
+func (self *NsqdCoordinator) syncStandbyTopics() {
+	defer self.wg.Done()
+	ticker := time.NewTicker(StandbySyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.stopChan:
+			return
+		}
+		standbyList := make([]TopicPartitionMetaInfo, 0)
+		leaderList := make([]*TopicCoordinator, 0)
+		self.coordMutex.RLock()
+		for _, tc := range self.topicCoords {
+			for _, tpc := range tc {
+				tcData := tpc.GetData()
+				if tpc.IsExiting() {
+					continue
+				}
+				if FindSlice(tcData.topicInfo.StandbyList, self.myNode.GetID()) != -1 {
+					standbyList = append(standbyList, tcData.topicInfo)
+				} else if len(tcData.topicInfo.StandbyList) > 0 && tcData.GetLeader() == self.myNode.GetID() {
+					leaderList = append(leaderList, tpc)
+				}
+			}
+		}
+		self.coordMutex.RUnlock()
+		for _, tc := range leaderList {
+			select {
+			case <-self.stopChan:
+				return
+			default:
+			}
+			tcData := tc.GetData()
+			lags := make(map[string]int64, len(tcData.topicInfo.StandbyList))
+			for _, nid := range tcData.topicInfo.StandbyList {
+				lags[nid] = self.getStandbyLagOnLeader(tcData, nid)
+			}
+			tc.updateStandbyLagsOnLeader(lags)
+		}
+		for _, topicInfo := range standbyList {
+			select {
+			case <-self.stopChan:
+				return
+			default:
+			}
+			err := self.catchupFromLeader(topicInfo, "")
+			if err != nil && err != ErrTopicCatchupAlreadyRunning {
+				coordLog.Infof("standby topic %v sync failed: %v", topicInfo.GetTopicDesp(), err)
+			}
+		}
+	}
+}
+
 // since we only commit log in buffer, we need flush period,
 // also we will flush while the leader switched.
 func (self *NsqdCoordinator) periodFlushCommitLogs() {
@@ -630,7 +699,7 @@ func (self *NsqdCoordinator) loadLocalTopicData() error {
 				continue
 			}
 			coordLog.Infof("loading topic: %v-%v", topicName, partition)
-			if topicName == "" {
+			if topicName == "" || nsqd.IsHiddenTopic(topicName) {
 				continue
 			}
 			topicInfo, commonErr := self.leadership.GetTopicInfo(topicName, partition)
@@ -655,7 +724,8 @@ func (self *NsqdCoordinator) loadLocalTopicData() error {
 			// Otherwise we need catchup from leader.
 			// In some case, we still keep leader (maybe only one replica), We need check local data and try to get the leader session again.
 			// If we are removed from both ISR and catchups, we can safely remove local topic data
-			shouldLoad := FindSlice(topicInfo.ISR, self.myNode.GetID()) != -1 || FindSlice(topicInfo.CatchupList, self.myNode.GetID()) != -1
+			shouldLoad := FindSlice(topicInfo.ISR, self.myNode.GetID()) != -1 || FindSlice(topicInfo.CatchupList, self.myNode.GetID()) != -1 ||
+				FindSlice(topicInfo.StandbyList, self.myNode.GetID()) != -1
 			if shouldLoad {
 				basepath := GetTopicPartitionBasePath(self.dataRootPath, topicInfo.Name, topicInfo.Partition)
 				tc, err := NewTopicCoordinator(topicInfo.Name, topicInfo.Partition, basepath,
@@ -718,6 +788,8 @@ func (self *NsqdCoordinator) loadLocalTopicData() error {
 				RetentionDay: topicInfo.RetentionDay,
 				OrderedMulti: topicInfo.OrderedMulti,
 				Ext:          topicInfo.Ext,
+				PartitionNum: topicInfo.PartitionNum,
+				Replica:      topicInfo.Replica,
 			}
 			tc.GetData().updateBufferSize(int(dyConf.SyncEvery - 1))
 			maybeInitDelayedQ(tc.GetData(), topic)
@@ -768,6 +840,9 @@ func (self *NsqdCoordinator) loadLocalTopicData() error {
 			} else if FindSlice(topicInfo.CatchupList, self.myNode.GetID()) != -1 {
 				coordLog.Infof("topic %v starting as catchup", topicInfo.GetTopicDesp())
 				go self.catchupFromLeader(*topicInfo, "")
+			} else if FindSlice(topicInfo.StandbyList, self.myNode.GetID()) != -1 {
+				coordLog.Infof("topic %v starting as standby", topicInfo.GetTopicDesp())
+				go self.catchupFromLeader(*topicInfo, "")
 			}
 		}
 	}
@@ -981,6 +1056,8 @@ func (self *NsqdCoordinator) checkForUnsyncedTopics() {
 				}
 				if FindSlice(topicMeta.CatchupList, self.myNode.GetID()) != -1 {
 					go self.catchupFromLeader(*topicMeta, "")
+				} else if FindSlice(topicMeta.StandbyList, self.myNode.GetID()) != -1 {
+					// standby is synced in the standby loop
 				} else if FindSlice(topicMeta.ISR, self.myNode.GetID()) == -1 {
 					if len(topicMeta.ISR)+len(topicMeta.CatchupList) >= topicMeta.Replica {
 						coordLog.Infof("the topic should be clean since not relevance to me: %v", topicMeta)
@@ -1062,6 +1139,59 @@ func (self *NsqdCoordinator) IsMineLeaderForTopic(topic string, part int) bool {
 	return tcData.GetLeader() == self.myNode.GetID() && tcData.GetLeaderSessionID() == self.myNode.GetID()
 }
 
+// TransferTopicLeader requests the nsqlookupd to transfer the topic leader from this node to
+// the new leader in isr, and wait until the new leader is acknowledged. The error of the
+// transfer on the nsqlookupd is returned.
+func (self *NsqdCoordinator) TransferTopicLeader(topic string, part int, newLeader string, timeout time.Duration) error {
+	if !self.IsMineLeaderForTopic(topic, part) {
+		return ErrNotTopicLeader.ToErrorType()
+	}
+	if newLeader == self.myNode.GetID() {
+		return nil
+	}
+	c, coordErr := self.getLookupRemoteProxy()
+	if coordErr != nil {
+		return coordErr.ToErrorType()
+	}
+	coordLog.Infof("request transfer topic %v-%v leader to %v", topic, part, newLeader)
+	start := time.Now()
+	// the nsqlookupd returns the result of the election, half of the timeout for
+	// the new leader catchup and the other half for the election.
+	coordErr = c.RequestTransferTopicLeader(topic, part, self.myNode.GetID(), newLeader, timeout/2)
+	if coordErr != nil {
+		coordLog.Infof("request transfer topic leader failed: %v", coordErr)
+		return coordErr.ToErrorType()
+	}
+	for {
+		tcData, coordErr := self.getTopicCoordData(topic, part)
+		if coordErr != nil {
+			return coordErr.ToErrorType()
+		}
+		if tcData.GetLeader() == newLeader && tcData.GetLeaderSessionID() == newLeader {
+			return nil
+		}
+		if time.Since(start) > timeout {
+			return ErrLeaderTransferNotSynced.ToErrorType()
+		}
+		select {
+		case <-self.stopChan:
+			return ErrTopicExiting.ToErrorType()
+		case <-time.After(time.Millisecond * 200):
+		}
+	}
+}
+
+// GetTopicISR returns the isr nodes of the topic partition on this node
+func (self *NsqdCoordinator) GetTopicISR(topic string, part int) ([]string, error) {
+	tcData, err := self.getTopicCoordData(topic, part)
+	if err != nil {
+		return nil, err.ToErrorType()
+	}
+	isr := make([]string, len(tcData.topicInfo.ISR))
+	copy(isr, tcData.topicInfo.ISR)
+	return isr, nil
+}
+
 func (self *NsqdCoordinator) SearchLogByMsgID(topic string, part int, msgID int64) (*CommitLogData, int64, int64, error) {
 	tcData, err := self.getTopicCoordData(topic, part)
 	if err != nil || tcData.logMgr == nil {
@@ -1640,6 +1770,14 @@ func (self *NsqdCoordinator) pullCatchupDataFromLeader(tc *TopicCoordinator,
 		}
 		coordLog.Infof("topic %v pulled logs :%v from offset: %v:%v:%v", topicInfo.GetTopicDesp(),
 			len(logs), logIndex, offset, countNumIndex)
+		var pulledBytes int64
+		for _, d := range dataList {
+			pulledBytes += int64(len(d))
+		}
+		if pulledBytes > 0 {
+			self.replThrottle.waitCatchup(topicInfo.Name, topicInfo.Partition, topicInfo.Leader,
+				self.GetMyID(), pulledBytes, self.stopChan)
+		}
 		localTopic.Lock()
 		hasErr := false
 		var lastCommitOffset nsqd.BackendQueueEnd
@@ -1781,12 +1919,13 @@ func (self *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInfo,
 		coordLog.Infof("decide topic %v catchup log failed:%v", topicInfo.GetTopicDesp(), coordErr)
 		return coordErr
 	}
-
 	dyConf := &nsqd.TopicDynamicConf{SyncEvery: int64(topicInfo.SyncEvery),
 		AutoCommit:   0,
 		RetentionDay: topicInfo.RetentionDay,
 		OrderedMulti: topicInfo.OrderedMulti,
 		Ext:          topicInfo.Ext,
+		PartitionNum: topicInfo.PartitionNum,
+		Replica:      topicInfo.Replica,
 	}
 	tc.GetData().updateBufferSize(int(dyConf.SyncEvery - 1))
 	localTopic.SetDynamicInfo(*dyConf, tc.GetData().logMgr)
@@ -1846,6 +1985,10 @@ func (self *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInfo,
 			// sync channels from leader
 			localTopic.GetDetailStats().ResetHistoryInitPub(localTopic.TotalDataSize())
 			localTopic.GetDetailStats().UpdateHistory(stat.TopicHourlyPubDataList[topicInfo.GetTopicDesp()])
+			disabled := stat.ChannelAutoCreateDisabled[topicInfo.GetTopicDesp()]
+			if disabled != localTopic.IsChannelAutoCreateDisabled() {
+				localTopic.SetChannelAutoCreateDisabled(disabled)
+			}
 			chList, ok := stat.ChannelList[topicInfo.GetTopicDesp()]
 			coordLog.Infof("topic %v sync channel list from leader: %v", topicInfo.GetTopicDesp(), chList)
 			if ok && len(chList) > 0 {
@@ -1864,10 +2007,23 @@ func (self *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInfo,
 					if meta, ok := metaMaps[chName]; ok {
 						if meta.Paused {
 							ch.Pause()
+							var until time.Time
+							if meta.PausedUntil > 0 {
+								until = time.Unix(meta.PausedUntil, 0)
+							}
+							ch.SetPauseInfo(until, meta.PausedReason)
 						}
 						if meta.Skipped {
 							ch.Skip()
 						}
+						ch.SetRegistered(meta.Registered)
+						ch.SetReqBackoff(meta.ReqBackoffBase, meta.ReqBackoffMax)
+						ch.SetDeliveryWindow(meta.DeliveryWindow)
+						ch.SetSLO(meta.SLO)
+						ch.SetReplayRate(meta.ReplayRate)
+						if meta.Compacted != ch.IsCompacted() {
+							ch.SetCompacted(meta.Compacted)
+						}
 					}
 					delete(oldChList, chName)
 				}
@@ -1878,7 +2034,19 @@ func (self *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInfo,
 				localTopic.SaveChannelMeta()
 			}
 		}
-		if !tc.IsExiting() {
+		if FindSlice(topicInfo.StandbyList, self.myNode.GetID()) != -1 {
+			// the standby replica never join the isr, just keep the data synced from leader
+			// and the lag is the new data written on leader while pulling.
+			leaderLogID, coordErr := c.GetLastCommitLogID(&topicInfo)
+			if coordErr != nil {
+				coordLog.Infof("get topic %v leader last log failed:%v", topicInfo.GetTopicDesp(), coordErr)
+				return coordErr
+			}
+			tc.updateStandbyLag(leaderLogID - tc.GetData().logMgr.GetLastCommitLogID())
+			tc.updateStandbySynced(time.Now())
+			coordLog.Debugf("standby topic synced: %v", topicInfo.GetTopicDesp())
+			return nil
+		} else if !tc.IsExiting() {
 			go func() {
 				err := self.requestJoinTopicISR(&topicInfo)
 				if err != nil {
@@ -2036,6 +2204,9 @@ func (self *NsqdCoordinator) updateTopicInfo(topicCoord *TopicCoordinator, shoul
 			case self.tryCheckUnsynced <- true:
 			default:
 			}
+		} else if FindSlice(newTopicInfo.StandbyList, self.myNode.GetID()) != -1 {
+			coordLog.Infof("I am in standby list.")
+			go self.catchupFromLeader(*newTopicInfo, "")
 		}
 	}
 	self.switchStateForMaster(topicCoord, localTopic, false)
@@ -2046,6 +2217,10 @@ func (self *NsqdCoordinator) notifyAcquireTopicLeader(coord *coordData) *CoordEr
 	if atomic.LoadInt32(&self.stopping) == 1 {
 		return ErrClusterChanged
 	}
+	if self.IsDraining() {
+		coordLog.Infof("refuse to acquire topic leader %v while draining.", coord.topicInfo.GetTopicDesp())
+		return ErrClusterChanged
+	}
 	coordLog.Infof("I am notified to acquire topic leader %v.", coord.topicInfo)
 	go self.acquireTopicLeader(&coord.topicInfo)
 	return nil
@@ -2197,6 +2372,8 @@ func (self *NsqdCoordinator) updateTopicLeaderSession(topicCoord *TopicCoordinat
 		RetentionDay: tcData.topicInfo.RetentionDay,
 		OrderedMulti: tcData.topicInfo.OrderedMulti,
 		Ext:          tcData.topicInfo.Ext,
+		PartitionNum: tcData.topicInfo.PartitionNum,
+		Replica:      tcData.topicInfo.Replica,
 	}
 	tcData.updateBufferSize(int(dyConf.SyncEvery - 1))
 	localTopic.SetDynamicInfo(*dyConf, tcData.logMgr)
@@ -2464,6 +2641,8 @@ func (self *NsqdCoordinator) updateLocalTopic(topicInfo *TopicPartitionMetaInfo,
 		RetentionDay: topicInfo.RetentionDay,
 		OrderedMulti: topicInfo.OrderedMulti,
 		Ext:          topicInfo.Ext,
+		PartitionNum: topicInfo.PartitionNum,
+		Replica:      topicInfo.Replica,
 	}
 	tcData.updateBufferSize(int(dyConf.SyncEvery - 1))
 	localErr = maybeInitDelayedQ(tcData, t)
@@ -2475,6 +2654,28 @@ func (self *NsqdCoordinator) updateLocalTopic(topicInfo *TopicPartitionMetaInfo,
 	return t, nil
 }
 
+// LeaveCluster transfers the topic leaders to others and unregisters this node,
+// it can be called before stopping while draining the node.
+func (self *NsqdCoordinator) LeaveCluster() {
+	if !atomic.CompareAndSwapInt32(&self.leaving, 0, 1) {
+		return
+	}
+	self.prepareLeavingCluster()
+}
+
+// SetDraining makes this node refuse to acquire the new topic leadership
+func (self *NsqdCoordinator) SetDraining(draining bool) {
+	if draining {
+		atomic.StoreInt32(&self.draining, 1)
+	} else {
+		atomic.StoreInt32(&self.draining, 0)
+	}
+}
+
+func (self *NsqdCoordinator) IsDraining() bool {
+	return atomic.LoadInt32(&self.draining) == 1
+}
+
 // before shutdown, we transfer the leader to others to reduce
 // the unavailable time.
 func (self *NsqdCoordinator) prepareLeavingCluster() {
@@ -2555,18 +2756,55 @@ func (self *NsqdCoordinator) prepareLeavingCluster() {
 	}
 }
 
+// the last synced time of standby replica is only known on the standby node itself,
+// the lag on the leader is checked in the standby sync loop.
+func (self *NsqdCoordinator) getStandbyStats(tc *TopicCoordinator) []StandbyStat {
+	var stats []StandbyStat
+	tcData := tc.GetData()
+	for _, nid := range tcData.topicInfo.StandbyList {
+		stat := StandbyStat{HostName: "", NodeID: nid, LogIDLag: -1}
+		if nid == self.myNode.GetID() {
+			stat.LogIDLag, stat.LastSynced = tc.getStandbySyncState()
+		} else if tcData.GetLeader() == self.myNode.GetID() {
+			stat.LogIDLag = tc.getStandbyLagOnLeader(nid)
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// return -1 if the standby node is not available
+func (self *NsqdCoordinator) getStandbyLagOnLeader(tcData *coordData, nid string) int64 {
+	c, coordErr := self.acquireRpcClient(nid)
+	if coordErr != nil {
+		return -1
+	}
+	standbyLogID, coordErr := c.GetLastCommitLogID(&tcData.topicInfo)
+	if coordErr != nil {
+		coordLog.Infof("get topic %v standby %v last log failed:%v", tcData.topicInfo.GetTopicDesp(), nid, coordErr)
+		return -1
+	}
+	lag := tcData.logMgr.GetLastCommitLogID() - standbyLogID
+	if lag < 0 {
+		lag = 0
+	}
+	return lag
+}
+
 func (self *NsqdCoordinator) Stats(topic string, part int) *CoordStats {
 	s := &CoordStats{}
 	if self.rpcServer != nil && self.rpcServer.rpcServer != nil {
 		s.RpcStats = self.rpcServer.rpcServer.Stats.Snapshot()
 	}
 	s.ErrStats = *coordErrStats.GetCopy()
+	s.Replication = self.replThrottle.getStats()
 	s.TopicCoordStats = make([]TopicCoordStat, 0)
 	if len(topic) > 0 {
 		if part >= 0 {
-			tcData, err := self.getTopicCoordData(topic, part)
+			tc, err := self.getTopicCoord(topic, part)
 			if err != nil {
 			} else {
+				tcData := tc.GetData()
 				var stat TopicCoordStat
 				stat.Name = topic
 				stat.Partition = part
@@ -2576,6 +2814,7 @@ func (self *NsqdCoordinator) Stats(topic string, part int) *CoordStats {
 				for _, nid := range tcData.topicInfo.CatchupList {
 					stat.CatchupStats = append(stat.CatchupStats, CatchupStat{HostName: "", NodeID: nid, Progress: 0})
 				}
+				stat.StandbyStats = self.getStandbyStats(tc)
 				s.TopicCoordStats = append(s.TopicCoordStats, stat)
 			}
 		} else {
@@ -2593,6 +2832,7 @@ func (self *NsqdCoordinator) Stats(topic string, part int) *CoordStats {
 					for _, nid := range tc.topicInfo.CatchupList {
 						stat.CatchupStats = append(stat.CatchupStats, CatchupStat{HostName: "", NodeID: nid, Progress: 0})
 					}
+					stat.StandbyStats = self.getStandbyStats(tc)
 
 					s.TopicCoordStats = append(s.TopicCoordStats, stat)
 				}
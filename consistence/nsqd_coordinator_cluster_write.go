@@ -165,6 +165,9 @@ func (self *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 			if putErr != nil {
 				coordLog.Infof("sync write to replica %v failed: %v. put offset:%v, logmgr: %v, %v",
 					nodeID, putErr, commitLog, logMgr.pLogID, logMgr.nLogID)
+			} else {
+				self.replThrottle.addSyncBytes(tcData.topicInfo.Name, tcData.topicInfo.Partition,
+					self.GetMyID(), nodeID, int64(commitLog.MsgSize))
 			}
 			return putErr
 		}
@@ -273,6 +276,9 @@ func (self *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 		if putErr != nil {
 			coordLog.Infof("sync write to replica %v failed: %v, put offset: %v, logmgr: %v, %v",
 				nodeID, putErr, commitLog, logMgr.pLogID, logMgr.nLogID)
+		} else {
+			self.replThrottle.addSyncBytes(tcData.topicInfo.Name, tcData.topicInfo.Partition,
+				self.GetMyID(), nodeID, int64(commitLog.MsgSize))
 		}
 		return putErr
 	}
@@ -946,7 +952,11 @@ func (self *NsqdCoordinator) SetChannelConsumeOffsetToCluster(ch *nsqd.Channel,
 	return nil
 }
 
-func (self *NsqdCoordinator) UpdateChannelStateToCluster(channel *nsqd.Channel, paused int, skipped int) error {
+// UpdateChannelStateToCluster updates the pause and skip state of the channel, the paused
+// until time and the reason are only used while pausing, the zero time means paused until
+// resumed manually.
+func (self *NsqdCoordinator) UpdateChannelStateToCluster(channel *nsqd.Channel, paused int, skipped int,
+	pausedUntil time.Time, pausedReason string) error {
 	topicName := channel.GetTopicName()
 	partition := channel.GetTopicPart()
 	coord, checkErr := self.getTopicCoord(topicName, partition)
@@ -966,6 +976,9 @@ func (self *NsqdCoordinator) UpdateChannelStateToCluster(channel *nsqd.Channel,
 			coordLog.Warningf("update channel(%v) state pause:%v failed: %v, topic %v,%v", channel.GetName(), paused, pauseErr, topicName, partition)
 			return &CoordErr{pauseErr.Error(), RpcNoErr, CoordLocalErr}
 		}
+		if paused == 1 {
+			channel.SetPauseInfo(pausedUntil, pausedReason)
+		}
 
 		var skipErr error
 		switch skipped {
@@ -991,7 +1004,12 @@ func (self *NsqdCoordinator) UpdateChannelStateToCluster(channel *nsqd.Channel,
 	}
 	doSlaveSync := func(c *NsqdRpcClient, nodeID string, tcData *coordData) *CoordErr {
 		var rpcErr *CoordErr
-		rpcErr = c.UpdateChannelState(&tcData.topicLeaderSession, &tcData.topicInfo, channel.GetName(), paused, skipped)
+		var untilTs int64
+		if !pausedUntil.IsZero() {
+			untilTs = pausedUntil.Unix()
+		}
+		rpcErr = c.UpdateChannelState(&tcData.topicLeaderSession, &tcData.topicInfo, channel.GetName(), paused, skipped,
+			untilTs, pausedReason)
 		if rpcErr != nil {
 			coordLog.Infof("sync channel(%v) state pause:%v, skip:%v to replica %v failed: %v, topic %v,%v", channel.GetName(), paused, skipped, nodeID, rpcErr, topicName, partition)
 		}
@@ -1008,6 +1026,51 @@ func (self *NsqdCoordinator) UpdateChannelStateToCluster(channel *nsqd.Channel,
 	return nil
 }
 
+// UpdateTopicPolicyToCluster syncs the policy of the leader topic partition to the
+// replicas, the policy changed on leader should be synced so it will not be lost
+// after the leader changed.
+func (self *NsqdCoordinator) UpdateTopicPolicyToCluster(topic *nsqd.Topic) error {
+	topicName := topic.GetTopicName()
+	partition := topic.GetTopicPart()
+	coord, checkErr := self.getTopicCoord(topicName, partition)
+	if checkErr != nil {
+		return checkErr.ToErrorType()
+	}
+	policy, err := topic.GetTopicPolicyData()
+	if err != nil {
+		return err
+	}
+
+	doLocalWrite := func(d *coordData) *CoordErr {
+		return nil
+	}
+	doLocalExit := func(err *CoordErr) {}
+	doLocalCommit := func() error {
+		return nil
+	}
+	doLocalRollback := func() {
+	}
+	doRefresh := func(d *coordData) *CoordErr {
+		return nil
+	}
+	doSlaveSync := func(c *NsqdRpcClient, nodeID string, tcData *coordData) *CoordErr {
+		rpcErr := c.UpdateTopicPolicy(&tcData.topicLeaderSession, &tcData.topicInfo, policy)
+		if rpcErr != nil {
+			coordLog.Infof("sync topic policy to replica %v failed: %v, topic %v,%v", nodeID, rpcErr, topicName, partition)
+		}
+		return rpcErr
+	}
+	handleSyncResult := func(successNum int, tcData *coordData) bool {
+		return true
+	}
+	clusterErr := self.doSyncOpToCluster(false, coord, doLocalWrite, doLocalExit, doLocalCommit, doLocalRollback,
+		doRefresh, doSlaveSync, handleSyncResult)
+	if clusterErr != nil {
+		return clusterErr.ToErrorType()
+	}
+	return nil
+}
+
 func (self *NsqdCoordinator) FinishMessageToCluster(channel *nsqd.Channel, clientID int64, clientAddr string, msgID nsqd.MessageID) error {
 	topicName := channel.GetTopicName()
 	partition := channel.GetTopicPart()
@@ -1103,7 +1166,8 @@ func (self *NsqdCoordinator) FinishMessageToCluster(channel *nsqd.Channel, clien
 	return nil
 }
 
-func (self *NsqdCoordinator) updateChannelStateOnSlave(tc *coordData, channelName string, paused int, skipped int) *CoordErr {
+func (self *NsqdCoordinator) updateChannelStateOnSlave(tc *coordData, channelName string, paused int, skipped int,
+	pausedUntil int64, pausedReason string) *CoordErr {
 	topicName := tc.topicInfo.Name
 	partition := tc.topicInfo.Partition
 
@@ -1149,6 +1213,13 @@ func (self *NsqdCoordinator) updateChannelStateOnSlave(tc *coordData, channelNam
 		coordLog.Errorf("fail to pause/unpause %v, channel: %v, %v", paused, topic.GetTopicName(), channelName)
 		return ErrLocalChannelPauseFailed
 	}
+	if paused == 1 {
+		var until time.Time
+		if pausedUntil > 0 {
+			until = time.Unix(pausedUntil, 0)
+		}
+		ch.SetPauseInfo(until, pausedReason)
+	}
 
 	var skipErr error
 	switch skipped {
@@ -1165,6 +1236,26 @@ func (self *NsqdCoordinator) updateChannelStateOnSlave(tc *coordData, channelNam
 	return nil
 }
 
+func (self *NsqdCoordinator) updateTopicPolicyOnSlave(tc *coordData, policy []byte) *CoordErr {
+	topicName := tc.topicInfo.Name
+	partition := tc.topicInfo.Partition
+
+	if !tc.IsMineISR(self.myNode.GetID()) {
+		return ErrTopicWriteOnNonISR
+	}
+	topic, localErr := self.localNsqd.GetExistingTopic(topicName, partition)
+	if localErr != nil {
+		coordLog.Warningf("slave missing topic : %v", topicName)
+		return &CoordErr{localErr.Error(), RpcCommonErr, CoordSlaveErr}
+	}
+	localErr = topic.ApplyTopicPolicyData(policy)
+	if localErr != nil {
+		coordLog.Errorf("fail to update topic %v policy on slave: %v", topic.GetFullName(), localErr)
+		return &CoordErr{localErr.Error(), RpcCommonErr, CoordLocalErr}
+	}
+	return nil
+}
+
 func (self *NsqdCoordinator) updateChannelOffsetOnSlave(tc *coordData, channelName string, offset ChannelConsumerOffset) *CoordErr {
 	topicName := tc.topicInfo.Name
 	partition := tc.topicInfo.Partition
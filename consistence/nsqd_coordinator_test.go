@@ -40,6 +40,8 @@ func (c *fakeConsumer) Stats() nsqdNs.ClientStats {
 }
 func (c *fakeConsumer) Exit() {
 }
+func (c *fakeConsumer) ExitWithReason(reason string) {
+}
 func (c *fakeConsumer) Empty() {
 }
 func (c *fakeConsumer) String() string {
@@ -99,6 +101,20 @@ func (self *fakeLookupRemoteProxy) RequestCheckTopicConsistence(topic string, pa
 	return
 }
 
+func (self *fakeLookupRemoteProxy) RequestTransferTopicLeader(topic string, partition int, nid string, newLeader string, timeout time.Duration) *CoordErr {
+	if self.t != nil {
+		self.t.Log("requesting transfer topic leader")
+	}
+	return nil
+}
+
+func (self *fakeLookupRemoteProxy) RequestCheckClusterFeature(feature string) *CoordErr {
+	if self.t != nil {
+		self.t.Log("requesting check cluster feature")
+	}
+	return nil
+}
+
 func (self *fakeLookupRemoteProxy) RequestJoinCatchup(topic string, partition int, nid string) *CoordErr {
 	if self.t != nil {
 		self.t.Log("requesting join catchup")
@@ -362,6 +362,19 @@ func (self *NsqdEtcdMgr) GetTopicLeaderSession(topic string, partition int) (*To
 	return &topicLeaderSession, nil
 }
 
+func (self *NsqdEtcdMgr) GetReplicationLimits() (ReplicationLimits, error) {
+	var limits ReplicationLimits
+	rsp, err := self.client.Get(self.createReplicationLimitsPath(), false, false)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return limits, nil
+		}
+		return limits, err
+	}
+	err = json.Unmarshal([]byte(rsp.Node.Value), &limits)
+	return limits, err
+}
+
 func (self *NsqdEtcdMgr) createNsqdNodePath(nodeData *NsqdNodeInfo) string {
 	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_NODE_DIR, "Node-"+nodeData.ID)
 }
@@ -378,6 +391,10 @@ func (self *NsqdEtcdMgr) createTopicReplicaInfoPath(topic string, partition int)
 	return path.Join(self.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_REPLICA_INFO)
 }
 
+func (self *NsqdEtcdMgr) createReplicationLimitsPath() string {
+	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_REPLICATION_LIMITS)
+}
+
 func (self *NsqdEtcdMgr) createLookupdRootPath() string {
 	return path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_NODE_DIR)
 }
@@ -318,7 +318,8 @@ func (self *NsqdRpcClient) DeleteChannel(leaderSession *TopicLeaderSession, info
 	return convertRpcError(err, retErr)
 }
 
-func (self *NsqdRpcClient) UpdateChannelState(leaderSession *TopicLeaderSession, info *TopicPartitionMetaInfo, channel string, paused int, skipped int) *CoordErr {
+func (self *NsqdRpcClient) UpdateChannelState(leaderSession *TopicLeaderSession, info *TopicPartitionMetaInfo, channel string, paused int, skipped int,
+	pausedUntil int64, pausedReason string) *CoordErr {
 	var channelState RpcChannelState
 	channelState.TopicName = info.Name
 	channelState.TopicPartition = info.Partition
@@ -329,11 +330,27 @@ func (self *NsqdRpcClient) UpdateChannelState(leaderSession *TopicLeaderSession,
 	channelState.Channel = channel
 	channelState.Paused = paused
 	channelState.Skipped = skipped
+	channelState.PausedUntil = pausedUntil
+	channelState.PausedReason = pausedReason
 
 	retErr, err := self.CallWithRetry("UpdateChannelState", &channelState)
 	return convertRpcError(err, retErr)
 }
 
+func (self *NsqdRpcClient) UpdateTopicPolicy(leaderSession *TopicLeaderSession, info *TopicPartitionMetaInfo, policy []byte) *CoordErr {
+	var updateInfo RpcTopicPolicy
+	updateInfo.TopicName = info.Name
+	updateInfo.TopicPartition = info.Partition
+	updateInfo.TopicWriteEpoch = info.EpochForWrite
+	updateInfo.Epoch = info.Epoch
+	updateInfo.TopicLeaderSessionEpoch = leaderSession.LeaderEpoch
+	updateInfo.TopicLeaderSession = leaderSession.Session
+	updateInfo.Policy = policy
+
+	retErr, err := self.CallWithRetry("UpdateTopicPolicy", &updateInfo)
+	return convertRpcError(err, retErr)
+}
+
 func (self *NsqdRpcClient) UpdateChannelOffset(leaderSession *TopicLeaderSession, info *TopicPartitionMetaInfo, channel string, offset ChannelConsumerOffset) *CoordErr {
 	// it seems grpc is slower, so disable it.
 	if self.grpcClient != nil && false {
@@ -21,6 +21,7 @@ type fakeNsqdLeadership struct {
 	regData              map[string]*NsqdNodeInfo
 	fakeTopicsLeaderData map[string]map[int]*TopicCoordinator
 	fakeTopicsInfo       map[string]map[int]*TopicPartitionMetaInfo
+	replLimits           ReplicationLimits
 }
 
 func NewFakeNSQDLeadership() NSQDLeadership {
@@ -155,6 +156,12 @@ func (self *fakeNsqdLeadership) GetTopicInfo(topic string, partition int) (*Topi
 	return nil, errors.New("topic not exist")
 }
 
+func (self *fakeNsqdLeadership) GetReplicationLimits() (ReplicationLimits, error) {
+	self.Lock()
+	defer self.Unlock()
+	return self.replLimits, nil
+}
+
 func (self *fakeNsqdLeadership) GetTopicLeaderSession(topic string, partition int) (*TopicLeaderSession, error) {
 	self.Lock()
 	defer self.Unlock()
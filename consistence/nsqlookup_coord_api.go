@@ -56,6 +56,63 @@ func (self *NsqLookupCoordinator) GetTopicLeaderNodes(topicName string) (map[str
 	return ret, nil
 }
 
+// GetTopicPartitionsInfo returns the replication info of all the partitions for the topic,
+// which can be used to show the placement of the topic partitions.
+func (self *NsqLookupCoordinator) GetTopicPartitionsInfo(topicName string) ([]TopicPartitionMetaInfo, error) {
+	meta, _, err := self.leadership.GetTopicMetaInfo(topicName)
+	if err != nil {
+		coordLog.Infof("failed to get topic %v meta: %v", topicName, err)
+		return nil, err
+	}
+	ret := make([]TopicPartitionMetaInfo, 0, meta.PartitionNum)
+	for i := 0; i < meta.PartitionNum; i++ {
+		info, err := self.leadership.GetTopicInfo(topicName, i)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, *info)
+	}
+	return ret, nil
+}
+
+func (self *NsqLookupCoordinator) GetTopicOwnerMeta(topic string) (TopicOwnerMeta, EpochType, error) {
+	if ok, _ := self.leadership.IsExistTopic(topic); !ok {
+		return TopicOwnerMeta{}, 0, ErrTopicNotCreated
+	}
+	return self.leadership.GetTopicOwnerMeta(topic)
+}
+
+// UpdateTopicOwnerMeta should pass the epoch returned by GetTopicOwnerMeta, and
+// should read and retry if ErrTopicOwnerMetaChanged returned.
+func (self *NsqLookupCoordinator) UpdateTopicOwnerMeta(topic string, meta TopicOwnerMeta, oldGen EpochType) error {
+	if self.leaderNode.GetID() != self.myNode.GetID() {
+		coordLog.Infof("not leader while update topic owner meta")
+		return ErrNotNsqLookupLeader
+	}
+	if ok, _ := self.leadership.IsExistTopic(topic); !ok {
+		coordLog.Infof("topic not exist %v", topic)
+		return ErrTopicNotCreated
+	}
+	return self.leadership.UpdateTopicOwnerMeta(topic, &meta, oldGen)
+}
+
+func (self *NsqLookupCoordinator) GetReplicationLimits() (ReplicationLimits, error) {
+	return self.leadership.GetReplicationLimits()
+}
+
+// UpdateReplicationLimits changes the cluster limits of the replication bandwidth, the
+// nsqd nodes will load the new limits in ReplicationLimitsRefreshInterval.
+func (self *NsqLookupCoordinator) UpdateReplicationLimits(limits ReplicationLimits) error {
+	if self.leaderNode.GetID() != self.myNode.GetID() {
+		coordLog.Infof("not leader while update replication limits")
+		return ErrNotNsqLookupLeader
+	}
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+	return self.leadership.UpdateReplicationLimits(&limits)
+}
+
 func (self *NsqLookupCoordinator) IsMineLeader() bool {
 	return self.leaderNode.GetID() == self.myNode.GetID()
 }
@@ -118,6 +175,134 @@ func (self *NsqLookupCoordinator) MoveTopicPartitionDataByManual(topicName strin
 	return err
 }
 
+// TransferTopicLeader moves the leader of the topic partition to another node in isr, and
+// the old leader will stay in isr as a replica.
+func (self *NsqLookupCoordinator) TransferTopicLeader(topicName string, partitionID int,
+	newLeader string, waitTimeout time.Duration) error {
+	if !self.IsMineLeader() {
+		return ErrNotNsqLookupLeader
+	}
+	if !atomic.CompareAndSwapInt32(&self.balanceWaiting, 0, 1) {
+		coordLog.Infof("another balance is running, should wait")
+		return ErrClusterBalanceRunning
+	}
+	defer atomic.StoreInt32(&self.balanceWaiting, 0)
+	if !self.IsClusterStable() {
+		return ErrClusterUnstable
+	}
+	topicInfo, err := self.leadership.GetTopicInfo(topicName, partitionID)
+	if err != nil {
+		coordLog.Infof("failed to get topic info: %v-%v: %v", topicName, partitionID, err)
+		return err
+	}
+	if topicInfo.Leader == newLeader {
+		return nil
+	}
+	if FindSlice(topicInfo.ISR, newLeader) == -1 {
+		return errors.New("the new leader is not in the isr")
+	}
+	currentNodes, currentNodesEpoch := self.getCurrentNodesWithEpoch()
+	if _, ok := currentNodes[newLeader]; !ok {
+		return errors.New("the new leader is not found in cluster")
+	}
+	coordLog.Infof("try transfer topic %v leader from %v to %v", topicInfo.GetTopicDesp(), topicInfo.Leader, newLeader)
+	// wait the new leader catchup before disable the write, so the write will
+	// be disabled as short as possible.
+	waitStart := time.Now()
+	for {
+		leaderLogID, coordErr := self.getNsqdLastCommitLogID(topicInfo.Leader, topicInfo)
+		if coordErr != nil {
+			return coordErr.ToErrorType()
+		}
+		logID, coordErr := self.getNsqdLastCommitLogID(newLeader, topicInfo)
+		if coordErr != nil {
+			return coordErr.ToErrorType()
+		}
+		if logID >= leaderLogID {
+			break
+		}
+		if time.Since(waitStart) > waitTimeout {
+			coordLog.Infof("timeout waiting new leader %v catchup: %v, %v", newLeader, logID, leaderLogID)
+			return ErrLeaderTransferNotSynced.ToErrorType()
+		}
+		select {
+		case <-self.stopChan:
+			return errors.New("quiting")
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+	coordErr := self.handleTopicLeaderElectionWithPrefer(topicInfo, currentNodes, currentNodesEpoch, true, newLeader)
+	if coordErr != nil {
+		coordLog.Infof("transfer topic %v leader to %v failed: %v", topicInfo.GetTopicDesp(), newLeader, coordErr)
+		return coordErr.ToErrorType()
+	}
+	coordLog.Infof("topic %v leader transferred to %v", topicInfo.GetTopicDesp(), newLeader)
+	return nil
+}
+
+// AddTopicStandbyReplica add a standby replica for the topic partition, the standby replica
+// will keep pulling data from leader, but it will never join the isr and never become leader automatically.
+func (self *NsqLookupCoordinator) AddTopicStandbyReplica(topicName string, partitionID int, nodeID string) error {
+	if !self.IsMineLeader() {
+		return ErrNotNsqLookupLeader
+	}
+	if !self.IsClusterStable() {
+		return ErrClusterUnstable
+	}
+	topicInfo, err := self.leadership.GetTopicInfo(topicName, partitionID)
+	if err != nil {
+		coordLog.Infof("failed to get topic info: %v-%v: %v", topicName, partitionID, err)
+		return err
+	}
+	if FindSlice(topicInfo.StandbyList, nodeID) != -1 {
+		return nil
+	}
+	if topicInfo.Leader == nodeID || FindSlice(topicInfo.ISR, nodeID) != -1 ||
+		FindSlice(topicInfo.CatchupList, nodeID) != -1 {
+		return errors.New("the node is already a replica of the topic")
+	}
+	currentNodes := self.getCurrentNodes()
+	if _, ok := currentNodes[nodeID]; !ok {
+		return errors.New("the standby node is not found in cluster")
+	}
+	topicInfo.StandbyList = append(topicInfo.StandbyList, nodeID)
+	err = self.leadership.UpdateTopicNodeInfo(topicInfo.Name, topicInfo.Partition,
+		&topicInfo.TopicPartitionReplicaInfo, topicInfo.Epoch)
+	if err != nil {
+		coordLog.Infof("update topic node info failed: %v", err.Error())
+		return err
+	}
+	coordLog.Infof("topic %v standby replica %v added", topicInfo.GetTopicDesp(), nodeID)
+	self.notifyTopicMetaInfo(topicInfo)
+	return nil
+}
+
+func (self *NsqLookupCoordinator) RemoveTopicStandbyReplica(topicName string, partitionID int, nodeID string) error {
+	if !self.IsMineLeader() {
+		return ErrNotNsqLookupLeader
+	}
+	topicInfo, err := self.leadership.GetTopicInfo(topicName, partitionID)
+	if err != nil {
+		coordLog.Infof("failed to get topic info: %v-%v: %v", topicName, partitionID, err)
+		return err
+	}
+	if FindSlice(topicInfo.StandbyList, nodeID) == -1 {
+		return nil
+	}
+	topicInfo.StandbyList = FilterList(topicInfo.StandbyList, []string{nodeID})
+	err = self.leadership.UpdateTopicNodeInfo(topicInfo.Name, topicInfo.Partition,
+		&topicInfo.TopicPartitionReplicaInfo, topicInfo.Epoch)
+	if err != nil {
+		coordLog.Infof("update topic node info failed: %v", err.Error())
+		return err
+	}
+	coordLog.Infof("topic %v standby replica %v removed", topicInfo.GetTopicDesp(), nodeID)
+	self.notifyTopicMetaInfo(topicInfo)
+	// notify the removed node to clean the local data
+	self.notifyOldNsqdsForTopicMetaInfo(topicInfo, []string{nodeID})
+	return nil
+}
+
 func (self *NsqLookupCoordinator) GetClusterNodeLoadFactor() (map[string]float64, map[string]float64) {
 	currentNodes := self.getCurrentNodes()
 	leaderFactors := make(map[string]float64, len(currentNodes))
@@ -323,6 +508,17 @@ func (self *NsqLookupCoordinator) deleteTopicPartition(topic string, pid int) er
 			coordLog.Infof("failed to call rpc : %v, %v", id, rpcErr)
 		}
 	}
+	for _, id := range topicInfo.StandbyList {
+		c, rpcErr := self.acquireRpcClient(id)
+		if rpcErr != nil {
+			coordLog.Infof("failed to get rpc client: %v, %v", id, rpcErr)
+			continue
+		}
+		rpcErr = c.DeleteNsqdTopic(self.leaderNode.Epoch, topicInfo)
+		if rpcErr != nil {
+			coordLog.Infof("failed to call rpc : %v, %v", id, rpcErr)
+		}
+	}
 	for _, id := range topicInfo.ISR {
 		c, rpcErr := self.acquireRpcClient(id)
 		if rpcErr != nil {
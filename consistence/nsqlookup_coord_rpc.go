@@ -48,6 +48,18 @@ type RpcReqLeaveFromISRByLeader struct {
 	LeaderSession TopicLeaderSession
 }
 
+type RpcReqTransferTopicLeader struct {
+	RpcLookupReqBase
+	NewLeader string
+	// the timeout waiting the new leader catchup, the result is returned after
+	// the election is done
+	Timeout time.Duration
+}
+
+type RpcReqCheckClusterFeature struct {
+	Feature string
+}
+
 type NsqLookupCoordRpcServer struct {
 	nsqLookupCoord *NsqLookupCoordinator
 	rpcDispatcher  *gorpc.Dispatcher
@@ -171,6 +183,26 @@ func (self *NsqLookupCoordRpcServer) RequestLeaveFromISRByLeader(req *RpcReqLeav
 	return &ret
 }
 
+func (self *NsqLookupCoordRpcServer) RequestTransferTopicLeader(req *RpcReqTransferTopicLeader) *CoordErr {
+	var ret CoordErr
+	err := self.nsqLookupCoord.handleRequestTransferTopicLeader(req.TopicName, req.TopicPartition, req.NodeID, req.NewLeader, req.Timeout)
+	if err != nil {
+		ret = *err
+		return &ret
+	}
+	return &ret
+}
+
+func (self *NsqLookupCoordRpcServer) RequestCheckClusterFeature(req *RpcReqCheckClusterFeature) *CoordErr {
+	var ret CoordErr
+	err := self.nsqLookupCoord.handleRequestCheckClusterFeature(req.Feature)
+	if err != nil {
+		ret = *err
+		return &ret
+	}
+	return &ret
+}
+
 func (self *NsqLookupCoordRpcServer) RequestNotifyNewTopicInfo(req *RpcReqNewTopicInfo) *CoordErr {
 	var coordErr CoordErr
 	if time.Since(self.lastNotify) < time.Millisecond*10 {
@@ -32,11 +32,13 @@ var (
 	ErrClusterNodeRemoving      = NewCoordErr("the node is mark as removed", CoordTmpErr)
 	ErrTopicNodeConflict        = NewCoordErr("the topic node info is conflicted", CoordElectionErr)
 	ErrLeadershipServerUnstable = NewCoordErr("the leadership server is unstable", CoordTmpErr)
+	ErrLeaderTransferNotSynced  = NewCoordErr("the new leader is not synced with the old leader", CoordTmpErr)
 )
 
 const (
 	waitMigrateInterval          = time.Minute * 10
 	waitEmergencyMigrateInterval = time.Second * 10
+	defaultLeaderTransferTimeout = time.Second * 10
 )
 
 type JoinISRState struct {
@@ -65,6 +67,7 @@ func getOthersExceptLeader(topicInfo *TopicPartitionMetaInfo) []string {
 		others = append(others, n)
 	}
 	others = append(others, topicInfo.CatchupList...)
+	others = append(others, topicInfo.StandbyList...)
 	return others
 }
 
@@ -88,6 +91,7 @@ type NsqLookupCoordinator struct {
 	leadership         NSQLookupdLeadership
 	nodesMutex         sync.RWMutex
 	nsqdNodes          map[string]NsqdNodeInfo
+	nsqdNodeVersions   map[string]string
 	removingNodes      map[string]string
 	nodesEpoch         int64
 	rpcMutex           sync.RWMutex
@@ -114,6 +118,7 @@ func NewNsqLookupCoordinator(cluster string, n *NsqLookupdNodeInfo, opts *Option
 		myNode:             *n,
 		leadership:         nil,
 		nsqdNodes:          make(map[string]NsqdNodeInfo),
+		nsqdNodeVersions:   make(map[string]string),
 		removingNodes:      make(map[string]string),
 		nsqdRpcClients:     make(map[string]*NsqdRpcClient),
 		checkTopicFailChan: make(chan TopicNameInfo, 3),
@@ -317,7 +322,8 @@ func (self *NsqLookupCoordinator) notifyTopicsToSingleNsqdForReload(topics []Top
 			return
 		default:
 		}
-		if FindSlice(v.ISR, nodeID) != -1 || FindSlice(v.CatchupList, nodeID) != -1 {
+		if FindSlice(v.ISR, nodeID) != -1 || FindSlice(v.CatchupList, nodeID) != -1 ||
+			FindSlice(v.StandbyList, nodeID) != -1 {
 			self.notifySingleNsqdForTopicReload(v, nodeID)
 		}
 	}
@@ -382,6 +388,10 @@ func (self *NsqLookupCoordinator) handleNsqdNodes(monitorChan chan struct{}) {
 		go self.leadership.WatchNsqdNodes(nsqdNodesChan, monitorChan)
 	}
 	coordLog.Debugf("start watch the nsqd nodes.")
+	// the versions may be changed by other leader, write them again
+	self.nodesMutex.Lock()
+	self.nsqdNodeVersions = make(map[string]string)
+	self.nodesMutex.Unlock()
 	defer func() {
 		coordLog.Infof("stop watch the nsqd nodes.")
 	}()
@@ -420,6 +430,7 @@ func (self *NsqLookupCoordinator) handleNsqdNodes(monitorChan chan struct{}) {
 				atomic.AddInt64(&self.nodesEpoch, 1)
 			}
 			self.nodesMutex.Unlock()
+			self.updateNsqdNodeVersions(newNodes)
 
 			if self.leadership == nil {
 				continue
@@ -503,8 +514,10 @@ func (self *NsqLookupCoordinator) handleRemovingNodes(monitorChan chan struct{})
 				moved := 0
 				for _, topicInfo := range allTopics {
 					if FindSlice(topicInfo.ISR, nid) == -1 {
-						if FindSlice(topicInfo.CatchupList, nid) != -1 {
+						if FindSlice(topicInfo.CatchupList, nid) != -1 ||
+							FindSlice(topicInfo.StandbyList, nid) != -1 {
 							topicInfo.CatchupList = FilterList(topicInfo.CatchupList, []string{nid})
+							topicInfo.StandbyList = FilterList(topicInfo.StandbyList, []string{nid})
 							self.notifyOldNsqdsForTopicMetaInfo(&topicInfo, []string{nid})
 							err := self.leadership.UpdateTopicNodeInfo(topicInfo.Name, topicInfo.Partition,
 								&topicInfo.TopicPartitionReplicaInfo, topicInfo.Epoch)
@@ -558,13 +571,14 @@ func (self *NsqLookupCoordinator) handleRemovingNodes(monitorChan chan struct{})
 						if removingNodes[nid] == "data_transferred" {
 							removingNodes[nid] = "done"
 						} else if removingNodes[nid] == "done" {
-							self.nodesMutex.Lock()
+							self.nodesMutex.RLock()
 							_, ok := self.nsqdNodes[nid]
+							self.nodesMutex.RUnlock()
 							if !ok {
 								delete(removingNodes, nid)
+								self.forgetNsqdNodeVersion(nid)
 								coordLog.Infof("the node %v is removed finally since not alive in cluster", nid)
 							}
-							self.nodesMutex.Unlock()
 						}
 					}
 				}
@@ -640,6 +654,7 @@ func (self *NsqLookupCoordinator) doCheckTopics(monitorChan chan struct{}, faile
 			return
 		}
 		coordLog.Debugf("scan found topics: %v", topics)
+		self.cleanStaleNsqdNodeVersions(topics)
 	} else {
 		var err error
 		coordLog.Infof("check single topic : %v ", failedInfo)
@@ -884,6 +899,13 @@ func (self *NsqLookupCoordinator) doCheckTopics(monitorChan chan struct{}, faile
 
 func (self *NsqLookupCoordinator) handleTopicLeaderElection(topicInfo *TopicPartitionMetaInfo, currentNodes map[string]NsqdNodeInfo,
 	currentNodesEpoch int64, isOldLeaderAlive bool) *CoordErr {
+	return self.handleTopicLeaderElectionWithPrefer(topicInfo, currentNodes, currentNodesEpoch, isOldLeaderAlive, "")
+}
+
+// the prefer leader will be elected only if it has the newest commit log after the write disabled,
+// otherwise the election will fail and the write will be enabled again by the topic checking.
+func (self *NsqLookupCoordinator) handleTopicLeaderElectionWithPrefer(topicInfo *TopicPartitionMetaInfo, currentNodes map[string]NsqdNodeInfo,
+	currentNodesEpoch int64, isOldLeaderAlive bool, preferLeader string) *CoordErr {
 	_, leaderSession, state, coordErr := self.prepareJoinState(topicInfo.Name, topicInfo.Partition, false)
 	if coordErr != nil {
 		coordLog.Infof("prepare join state failed: %v", coordErr)
@@ -937,6 +959,19 @@ func (self *NsqLookupCoordinator) handleTopicLeaderElection(topicInfo *TopicPart
 	if coordErr != nil {
 		return coordErr
 	}
+	if preferLeader != "" && preferLeader != newLeader {
+		cid, coordErr := self.getNsqdLastCommitLogID(preferLeader, topicInfo)
+		if coordErr != nil {
+			return coordErr
+		}
+		if cid < newestLogID {
+			coordLog.Infof("topic %v prefer leader %v commit id %v is behind the newest %v",
+				topicInfo.GetTopicDesp(), preferLeader, cid, newestLogID)
+			return ErrLeaderTransferNotSynced
+		}
+		newLeader = preferLeader
+		newestLogID = cid
+	}
 
 	if leaderSession != nil {
 		// notify old leader node to release leader
@@ -1761,6 +1796,35 @@ func (self *NsqLookupCoordinator) handleRequestCheckTopicConsistence(topic strin
 	return nil
 }
 
+// handleRequestTransferTopicLeader returns after the transfer is done, the zero
+// timeout is the default timeout waiting the new leader catchup.
+func (self *NsqLookupCoordinator) handleRequestTransferTopicLeader(topic string, partition int, nodeID string,
+	newLeader string, timeout time.Duration) *CoordErr {
+	topicInfo, err := self.leadership.GetTopicInfo(topic, partition)
+	if err != nil {
+		coordLog.Infof("get topic info failed : %v", err.Error())
+		return &CoordErr{err.Error(), RpcCommonErr, CoordCommonErr}
+	}
+	if topicInfo.Leader != nodeID {
+		return &CoordErr{"the leader transfer should be requested by the topic leader", RpcCommonErr, CoordCommonErr}
+	}
+	if FindSlice(topicInfo.ISR, newLeader) == -1 {
+		return &CoordErr{"the new leader is not in the isr", RpcCommonErr, CoordCommonErr}
+	}
+	if timeout <= 0 {
+		timeout = defaultLeaderTransferTimeout
+	}
+	err = self.TransferTopicLeader(topic, partition, newLeader, timeout)
+	if err != nil {
+		coordLog.Infof("transfer topic %v-%v leader requested by %v failed: %v", topic, partition, nodeID, err)
+		if cerr, ok := err.(*CommonCoordErr); ok {
+			return &cerr.CoordErr
+		}
+		return &CoordErr{err.Error(), RpcCommonErr, CoordCommonErr}
+	}
+	return nil
+}
+
 func (self *NsqLookupCoordinator) handleRequestNewTopicInfo(topic string, partition int, nodeID string) *CoordErr {
 	topicInfo, err := self.leadership.GetTopicInfo(topic, partition)
 	if err != nil {
@@ -15,6 +15,7 @@ import (
 	"github.com/absolute8511/glog"
 	"github.com/youzan/nsq/internal/levellogger"
 	"github.com/youzan/nsq/internal/test"
+	"github.com/youzan/nsq/internal/version"
 )
 
 const (
@@ -32,6 +33,10 @@ type FakeNsqlookupLeadership struct {
 	dataMutex            sync.Mutex
 	fakeTopics           map[string]map[int]*fakeTopicData
 	fakeTopicMetaInfo    map[string]TopicMetaInfo
+	fakeTopicOwnerMeta   map[string]TopicOwnerMeta
+	fakeTopicOwnerEpoch  map[string]EpochType
+	fakeReplLimits       ReplicationLimits
+	fakeNsqdVersions     map[string]NsqdNodeVersion
 	fakeNsqdNodes        map[string]NsqdNodeInfo
 	nodeChanged          chan struct{}
 	fakeEpoch            EpochType
@@ -46,6 +51,9 @@ func NewFakeNsqlookupLeadership() *FakeNsqlookupLeadership {
 	return &FakeNsqlookupLeadership{
 		fakeTopics:           make(map[string]map[int]*fakeTopicData),
 		fakeTopicMetaInfo:    make(map[string]TopicMetaInfo),
+		fakeTopicOwnerMeta:   make(map[string]TopicOwnerMeta),
+		fakeTopicOwnerEpoch:  make(map[string]EpochType),
+		fakeNsqdVersions:     make(map[string]NsqdNodeVersion),
 		fakeNsqdNodes:        make(map[string]NsqdNodeInfo),
 		nodeChanged:          make(chan struct{}, 1),
 		leaderChanged:        make(chan struct{}, 1),
@@ -68,6 +76,63 @@ func (self *FakeNsqlookupLeadership) GetTopicsMetaInfoMap(topics []string) (map[
 	return metas, nil
 }
 
+func (self *FakeNsqlookupLeadership) GetTopicOwnerMeta(topic string) (TopicOwnerMeta, EpochType, error) {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	return self.fakeTopicOwnerMeta[topic], self.fakeTopicOwnerEpoch[topic], nil
+}
+
+func (self *FakeNsqlookupLeadership) UpdateTopicOwnerMeta(topic string, meta *TopicOwnerMeta, oldGen EpochType) error {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	if self.fakeTopicOwnerEpoch[topic] != oldGen {
+		return ErrTopicOwnerMetaChanged
+	}
+	self.fakeTopicOwnerMeta[topic] = *meta
+	self.fakeTopicOwnerEpoch[topic] = oldGen + 1
+	return nil
+}
+
+func (self *FakeNsqlookupLeadership) GetReplicationLimits() (ReplicationLimits, error) {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	return self.fakeReplLimits, nil
+}
+
+func (self *FakeNsqlookupLeadership) UpdateReplicationLimits(limits *ReplicationLimits) error {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	self.fakeReplLimits = *limits
+	return nil
+}
+
+func (self *FakeNsqlookupLeadership) GetNsqdNodeVersions() (map[string]NsqdNodeVersion, error) {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	versions := make(map[string]NsqdNodeVersion, len(self.fakeNsqdVersions))
+	for nid, v := range self.fakeNsqdVersions {
+		versions[nid] = v
+	}
+	return versions, nil
+}
+
+func (self *FakeNsqlookupLeadership) UpdateNsqdNodeVersion(nid string, v *NsqdNodeVersion) error {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	self.fakeNsqdVersions[nid] = *v
+	return nil
+}
+
+func (self *FakeNsqlookupLeadership) DeleteNsqdNodeVersion(nid string) error {
+	self.dataMutex.Lock()
+	defer self.dataMutex.Unlock()
+	if _, ok := self.fakeNsqdVersions[nid]; !ok {
+		return ErrKeyNotFound
+	}
+	delete(self.fakeNsqdVersions, nid)
+	return nil
+}
+
 func (self *FakeNsqlookupLeadership) GetClusterEpoch() (EpochType, error) {
 	return self.clusterEpoch, nil
 }
@@ -602,6 +667,119 @@ func TestNsqLookupLeadershipChange(t *testing.T) {
 	coord2.Stop()
 }
 
+func TestClusterFeatureStatusWithVersionSkew(t *testing.T) {
+	test.Equal(t, true, IsVersionSupported("0.3.7-HA.1.7.0", "0.3.7-HA.1.7.0"))
+	test.Equal(t, true, IsVersionSupported("0.3.7-HA.1.7.1", "0.3.7-HA.1.7.0"))
+	test.Equal(t, false, IsVersionSupported("0.3.7-HA.1.6.6.1", "0.3.7-HA.1.7.0"))
+	test.Equal(t, false, IsVersionSupported("0.3.7-HA.1.6.5", "0.3.7-HA.1.7.0"))
+	for _, f := range clusterFeatures {
+		test.Equal(t, true, IsVersionSupported(version.Binary, f.MinVersion))
+		test.Equal(t, false, IsVersionSupported("0.3.7-HA.1.6.5", f.MinVersion))
+	}
+	test.Equal(t, false, IsVersionSupported("", "0.3.7-HA.1.7.0"))
+	test.Equal(t, false, IsVersionSupported("invalid", "0.3.7-HA.1.7.0"))
+
+	nodeVersions := map[string]string{
+		"node1": "0.3.7-HA.1.7.0",
+		"node2": "0.3.7-HA.1.7.0",
+	}
+	for _, f := range getClusterFeatureStatus(nodeVersions, false) {
+		test.Equal(t, true, f.Enabled)
+		test.Equal(t, 0, len(f.UnsupportedNodes))
+	}
+	// should not enable while upgrading
+	for _, f := range getClusterFeatureStatus(nodeVersions, true) {
+		test.Equal(t, false, f.Enabled)
+	}
+	// old node without version advertised
+	nodeVersions["node3"] = ""
+	for _, f := range getClusterFeatureStatus(nodeVersions, false) {
+		test.Equal(t, false, f.Enabled)
+		test.Equal(t, []string{"node3"}, f.UnsupportedNodes)
+	}
+}
+
+func TestCheckClusterFeature(t *testing.T) {
+	coord := &NsqLookupCoordinator{
+		nsqdNodeVersions: map[string]string{
+			"node1": version.Binary,
+			"node2": version.Binary,
+		},
+	}
+	coord.myNode.ID = "lookup1"
+	coord.leaderNode.ID = "lookup1"
+	test.Nil(t, coord.CheckClusterFeature(FeatureDedupIndex))
+	test.Nil(t, coord.handleRequestCheckClusterFeature(FeatureTopicArchive))
+	test.NotNil(t, coord.CheckClusterFeature("unknown"))
+
+	atomic.StoreInt32(&coord.isUpgrading, 1)
+	test.Equal(t, ErrClusterFeatureDisabled, coord.CheckClusterFeature(FeatureDedupIndex))
+	atomic.StoreInt32(&coord.isUpgrading, 0)
+
+	coord.nsqdNodeVersions["node3"] = ""
+	test.Equal(t, ErrClusterFeatureDisabled, coord.CheckClusterFeature(FeatureChannelCompact))
+	test.Equal(t, true, coord.handleRequestCheckClusterFeature(FeatureChannelCompact).IsEqual(ErrClusterFeatureNotEnabled))
+	// only the leader knows the versions of all nodes
+	coord.leaderNode.ID = "lookup2"
+	test.NotNil(t, coord.handleRequestCheckClusterFeature(FeatureDedupIndex))
+}
+
+func TestClusterFeatureWithOfflineOldNode(t *testing.T) {
+	fakeLeadership := NewFakeNsqlookupLeadership()
+	fakeLeadership.fakeLeader = &NsqLookupdNodeInfo{ID: "lookup1", Version: version.Binary}
+	newCoord := func() *NsqLookupCoordinator {
+		coord := &NsqLookupCoordinator{
+			leadership:       fakeLeadership,
+			nsqdNodes:        make(map[string]NsqdNodeInfo),
+			nsqdNodeVersions: make(map[string]string),
+			removingNodes:    make(map[string]string),
+		}
+		coord.myNode.ID = "lookup1"
+		coord.leaderNode.ID = "lookup1"
+		return coord
+	}
+	coord := newCoord()
+	nodes := map[string]NsqdNodeInfo{
+		"node1": {ID: "node1", Version: version.Binary},
+		"node2": {ID: "node2", Version: "0.3.7-HA.1.6.5"},
+	}
+	coord.nsqdNodes = nodes
+	coord.updateNsqdNodeVersions(nodes)
+	test.Equal(t, ErrClusterFeatureDisabled, coord.CheckClusterFeature(FeatureDedupIndex))
+
+	// the old node is offline while the lookup leader changed
+	coord = newCoord()
+	coord.nsqdNodes = map[string]NsqdNodeInfo{"node1": nodes["node1"]}
+	coord.updateNsqdNodeVersions(coord.nsqdNodes)
+	status, err := coord.GetClusterVersionStatus()
+	test.Nil(t, err)
+	test.Equal(t, "0.3.7-HA.1.6.5", status.NsqdVersions["node2"])
+	test.Equal(t, ErrClusterFeatureDisabled, coord.CheckClusterFeature(FeatureDedupIndex))
+
+	// the offline node still in the topic replicas may come back
+	var topicInfo TopicPartitionMetaInfo
+	topicInfo.Name = "test"
+	topicInfo.Leader = "node1"
+	topicInfo.ISR = []string{"node1"}
+	topicInfo.CatchupList = []string{"node2"}
+	coord.cleanStaleNsqdNodeVersions([]TopicPartitionMetaInfo{topicInfo})
+	test.Equal(t, ErrClusterFeatureDisabled, coord.CheckClusterFeature(FeatureDedupIndex))
+	test.NotEqual(t, int64(0), fakeLeadership.fakeNsqdVersions["node2"].OfflineSince)
+
+	// the offline node not in any topic replicas is forgotten
+	topicInfo.CatchupList = nil
+	coord.cleanStaleNsqdNodeVersions([]TopicPartitionMetaInfo{topicInfo})
+	test.Nil(t, coord.CheckClusterFeature(FeatureDedupIndex))
+
+	// the node offline too long is forgotten even in the topic replicas
+	fakeLeadership.fakeNsqdVersions["node3"] = NsqdNodeVersion{Version: "0.3.7-HA.1.6.5",
+		OfflineSince: time.Now().Add(-1 * NsqdVersionOfflineExpire).Unix()}
+	topicInfo.CatchupList = []string{"node3"}
+	test.Equal(t, ErrClusterFeatureDisabled, coord.CheckClusterFeature(FeatureDedupIndex))
+	coord.cleanStaleNsqdNodeVersions([]TopicPartitionMetaInfo{topicInfo})
+	test.Nil(t, coord.CheckClusterFeature(FeatureDedupIndex))
+}
+
 func TestFakeNsqLookupNsqdNodesChange(t *testing.T) {
 	testNsqLookupNsqdNodesChange(t, true)
 }
@@ -1715,6 +1893,315 @@ func TestNsqLookupMovePartition(t *testing.T) {
 	SetCoordLogger(newTestLogger(t), levellogger.LOG_ERR)
 }
 
+func TestNsqLookupTransferTopicLeader(t *testing.T) {
+	if testing.Verbose() {
+		SetCoordLogger(levellogger.NewSimpleLog(), levellogger.LOG_INFO)
+		glog.SetFlags(0, "", "", true, true, 1)
+		glog.StartWorker(time.Second)
+	} else {
+		SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	}
+
+	idList := []string{"id1", "id2", "id3", "id4"}
+	lookupCoord, nodeInfoList := prepareCluster(t, idList, false)
+	for _, n := range nodeInfoList {
+		defer os.RemoveAll(n.dataPath)
+		defer n.localNsqd.Exit()
+		defer n.nsqdCoord.Stop()
+	}
+
+	topic_p1_r3 := "test-nsqlookup-topic-unit-test-transfer-p1-r3"
+	lookupLeadership := lookupCoord.leadership
+
+	checkDeleteErr(t, lookupCoord.DeleteTopic(topic_p1_r3, "**"))
+	time.Sleep(time.Second * 3)
+	defer func() {
+		waitClusterStable(lookupCoord, time.Second*3)
+		checkDeleteErr(t, lookupCoord.DeleteTopic(topic_p1_r3, "**"))
+		time.Sleep(time.Second * 3)
+		lookupCoord.Stop()
+	}()
+
+	err := lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	test.Nil(t, err)
+	waitClusterStable(lookupCoord, time.Second*5)
+
+	t0, err := lookupLeadership.GetTopicInfo(topic_p1_r3, 0)
+	test.Nil(t, err)
+	test.Equal(t, len(t0.ISR), 3)
+	oldLeader := t0.Leader
+	toNode := ""
+	notISRNode := ""
+	for _, node := range nodeInfoList {
+		nid := node.nodeInfo.GetID()
+		if FindSlice(t0.ISR, nid) == -1 {
+			notISRNode = nid
+		} else if nid != oldLeader && toNode == "" {
+			toNode = nid
+		}
+	}
+	// transfer to the non-isr node should fail
+	err = lookupCoord.TransferTopicLeader(topic_p1_r3, 0, notISRNode, time.Second*3)
+	test.NotNil(t, err)
+	t0, err = lookupLeadership.GetTopicInfo(topic_p1_r3, 0)
+	test.Nil(t, err)
+	test.Equal(t, oldLeader, t0.Leader)
+
+	// the transfer requested by the leader returns after the election
+	coordErr := lookupCoord.handleRequestTransferTopicLeader(topic_p1_r3, 0, oldLeader, toNode, time.Second*3)
+	test.Nil(t, coordErr)
+	t0, err = lookupLeadership.GetTopicInfo(topic_p1_r3, 0)
+	test.Nil(t, err)
+	test.Equal(t, toNode, t0.Leader)
+	// the old leader can not request again
+	coordErr = lookupCoord.handleRequestTransferTopicLeader(topic_p1_r3, 0, oldLeader, toNode, time.Second*3)
+	test.NotNil(t, coordErr)
+	waitClusterStable(lookupCoord, time.Second*5)
+
+	t0, err = lookupLeadership.GetTopicInfo(topic_p1_r3, 0)
+	test.Nil(t, err)
+	test.Equal(t, toNode, t0.Leader)
+	test.Equal(t, len(t0.ISR) >= t0.Replica, true)
+	// the old leader should rejoin as isr
+	lookupCoord.triggerCheckTopics("", 0, 0)
+	waitClusterStable(lookupCoord, time.Second*5)
+	t0, err = lookupLeadership.GetTopicInfo(topic_p1_r3, 0)
+	test.Nil(t, err)
+	test.Equal(t, toNode, t0.Leader)
+	test.Equal(t, FindSlice(t0.ISR, oldLeader) != -1, true)
+
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_ERR)
+}
+
+func TestNsqLookupCreateTopicPlacement(t *testing.T) {
+	if testing.Verbose() {
+		SetCoordLogger(levellogger.NewSimpleLog(), levellogger.LOG_INFO)
+		glog.SetFlags(0, "", "", true, true, 1)
+		glog.StartWorker(time.Second)
+	} else {
+		SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	}
+
+	idList := []string{"id1", "id2", "id3", "id4"}
+	lookupCoord, nodeInfoList := prepareCluster(t, idList, false)
+	for _, n := range nodeInfoList {
+		defer os.RemoveAll(n.dataPath)
+		defer n.localNsqd.Exit()
+		defer n.nsqdCoord.Stop()
+	}
+
+	topic_p2_r2 := "test-nsqlookup-topic-unit-test-placement-p2-r2"
+	checkDeleteErr(t, lookupCoord.DeleteTopic(topic_p2_r2, "**"))
+	time.Sleep(time.Second * 3)
+	defer func() {
+		waitClusterStable(lookupCoord, time.Second*3)
+		checkDeleteErr(t, lookupCoord.DeleteTopic(topic_p2_r2, "**"))
+		time.Sleep(time.Second * 3)
+		lookupCoord.Stop()
+	}()
+
+	_, err := lookupCoord.GetTopicPartitionsInfo(topic_p2_r2)
+	test.NotNil(t, err)
+
+	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	test.Nil(t, err)
+	partInfos, err := lookupCoord.GetTopicPartitionsInfo(topic_p2_r2)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(partInfos))
+	for i, info := range partInfos {
+		test.Equal(t, i, info.Partition)
+		test.Equal(t, 2, info.Replica)
+		test.Equal(t, 2, len(info.ISR))
+		test.NotEqual(t, -1, FindSlice(info.ISR, info.Leader))
+	}
+	waitClusterStable(lookupCoord, time.Second*5)
+
+	// the replication meta should be updated to the local topic for stats
+	for _, info := range partInfos {
+		localTopic, err := nodeInfoList[info.Leader].localNsqd.GetExistingTopic(topic_p2_r2, info.Partition)
+		test.Nil(t, err)
+		dyConf := localTopic.GetDynamicInfo()
+		test.Equal(t, 2, dyConf.PartitionNum)
+		test.Equal(t, 2, dyConf.Replica)
+	}
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_ERR)
+}
+
+func TestNsqLookupTopicOwnerMeta(t *testing.T) {
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	idList := []string{"id1", "id2"}
+	lookupCoord, nodeInfoList := prepareCluster(t, idList, false)
+	for _, n := range nodeInfoList {
+		defer os.RemoveAll(n.dataPath)
+		defer n.localNsqd.Exit()
+		defer n.nsqdCoord.Stop()
+	}
+
+	topic := "test-nsqlookup-topic-unit-test-owner-meta"
+	checkDeleteErr(t, lookupCoord.DeleteTopic(topic, "**"))
+	time.Sleep(time.Second)
+	defer func() {
+		checkDeleteErr(t, lookupCoord.DeleteTopic(topic, "**"))
+		time.Sleep(time.Second)
+		lookupCoord.Stop()
+	}()
+
+	owner := TopicOwnerMeta{Owner: "user1", Team: "team1", Contact: "user1@example.com", Description: "test topic"}
+	err := lookupCoord.UpdateTopicOwnerMeta(topic, owner, 0)
+	test.Equal(t, ErrTopicNotCreated, err)
+
+	err = lookupCoord.CreateTopic(topic, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	test.Nil(t, err)
+	meta, epoch, err := lookupCoord.GetTopicOwnerMeta(topic)
+	test.Nil(t, err)
+	test.Equal(t, TopicOwnerMeta{}, meta)
+
+	err = lookupCoord.UpdateTopicOwnerMeta(topic, owner, epoch)
+	test.Nil(t, err)
+	meta, newEpoch, err := lookupCoord.GetTopicOwnerMeta(topic)
+	test.Nil(t, err)
+	test.Equal(t, owner, meta)
+	test.NotEqual(t, epoch, newEpoch)
+
+	// the update based on the stale read should not overwrite the new meta
+	stale := owner
+	stale.Contact = "user2@example.com"
+	err = lookupCoord.UpdateTopicOwnerMeta(topic, stale, epoch)
+	test.Equal(t, ErrTopicOwnerMetaChanged, err)
+	meta, _, err = lookupCoord.GetTopicOwnerMeta(topic)
+	test.Nil(t, err)
+	test.Equal(t, owner, meta)
+	err = lookupCoord.UpdateTopicOwnerMeta(topic, stale, newEpoch)
+	test.Nil(t, err)
+	meta, _, err = lookupCoord.GetTopicOwnerMeta(topic)
+	test.Nil(t, err)
+	test.Equal(t, stale, meta)
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_ERR)
+}
+
+func TestNsqLookupTopicStandbyReplica(t *testing.T) {
+	if testing.Verbose() {
+		SetCoordLogger(levellogger.NewSimpleLog(), levellogger.LOG_INFO)
+		glog.SetFlags(0, "", "", true, true, 1)
+		glog.StartWorker(time.Second)
+	} else {
+		SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	}
+	oldInterval := StandbySyncInterval
+	StandbySyncInterval = time.Millisecond * 500
+	defer func() {
+		StandbySyncInterval = oldInterval
+	}()
+
+	idList := []string{"id1", "id2", "id3", "id4"}
+	lookupCoord, nodeInfoList := prepareCluster(t, idList, false)
+	for _, n := range nodeInfoList {
+		defer os.RemoveAll(n.dataPath)
+		defer n.localNsqd.Exit()
+		defer n.nsqdCoord.Stop()
+	}
+
+	topic_p1_r2 := "test-nsqlookup-topic-unit-test-standby-p1-r2"
+	lookupLeadership := lookupCoord.leadership
+
+	checkDeleteErr(t, lookupCoord.DeleteTopic(topic_p1_r2, "**"))
+	time.Sleep(time.Second * 3)
+	defer func() {
+		waitClusterStable(lookupCoord, time.Second*3)
+		checkDeleteErr(t, lookupCoord.DeleteTopic(topic_p1_r2, "**"))
+		time.Sleep(time.Second * 3)
+		lookupCoord.Stop()
+	}()
+
+	err := lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{1, 2, 0, 0, 0, 0, false, false})
+	test.Nil(t, err)
+	waitClusterStable(lookupCoord, time.Second*5)
+
+	t0, err := lookupLeadership.GetTopicInfo(topic_p1_r2, 0)
+	test.Nil(t, err)
+	test.Equal(t, len(t0.ISR), 2)
+	standbyNode := ""
+	for _, node := range nodeInfoList {
+		nid := node.nodeInfo.GetID()
+		if FindSlice(t0.ISR, nid) == -1 {
+			standbyNode = nid
+			break
+		}
+	}
+	// the isr node can not be standby
+	err = lookupCoord.AddTopicStandbyReplica(topic_p1_r2, 0, t0.ISR[0])
+	test.NotNil(t, err)
+
+	err = lookupCoord.AddTopicStandbyReplica(topic_p1_r2, 0, standbyNode)
+	test.Nil(t, err)
+	waitClusterStable(lookupCoord, time.Second*3)
+	t0, err = lookupLeadership.GetTopicInfo(topic_p1_r2, 0)
+	test.Nil(t, err)
+	test.Equal(t, []string{standbyNode}, t0.StandbyList)
+	test.Equal(t, len(t0.ISR), 2)
+	test.Equal(t, FindSlice(t0.ISR, standbyNode), -1)
+
+	leaderCoord := nodeInfoList[t0.Leader].nsqdCoord
+	leaderTopic, err := nodeInfoList[t0.Leader].localNsqd.GetExistingTopic(topic_p1_r2, 0)
+	test.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		_, _, _, _, err := leaderCoord.PutMessageBodyToCluster(leaderTopic, []byte("123"), 0)
+		test.Nil(t, err)
+	}
+	leaderTc, coordErr := leaderCoord.getTopicCoord(topic_p1_r2, 0)
+	test.Nil(t, coordErr)
+	leaderLogID := leaderTc.GetData().logMgr.GetLastCommitLogID()
+
+	standbyCoord := nodeInfoList[standbyNode].nsqdCoord
+	start := time.Now()
+	for {
+		standbyTc, coordErr := standbyCoord.getTopicCoord(topic_p1_r2, 0)
+		if coordErr == nil && standbyTc.GetData().logMgr.GetLastCommitLogID() == leaderLogID {
+			_, lastSynced := standbyTc.getStandbySyncState()
+			test.NotEqual(t, int64(0), lastSynced)
+			break
+		}
+		if time.Since(start) > time.Second*10 {
+			t.Fatalf("standby replica not synced from leader")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	stats := standbyCoord.Stats(topic_p1_r2, 0)
+	test.Equal(t, 1, len(stats.TopicCoordStats))
+	test.Equal(t, 1, len(stats.TopicCoordStats[0].StandbyStats))
+	test.Equal(t, standbyNode, stats.TopicCoordStats[0].StandbyStats[0].NodeID)
+	// the leader checks the lag of the standby node in background
+	start = time.Now()
+	for {
+		stats = leaderCoord.Stats(topic_p1_r2, 0)
+		test.Equal(t, 1, len(stats.TopicCoordStats[0].StandbyStats))
+		if stats.TopicCoordStats[0].StandbyStats[0].LogIDLag == 0 {
+			break
+		}
+		if time.Since(start) > time.Second*10 {
+			t.Fatalf("standby lag not checked on leader")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	// the standby should never join the isr
+	lookupCoord.triggerCheckTopics("", 0, 0)
+	waitClusterStable(lookupCoord, time.Second*3)
+	t0, err = lookupLeadership.GetTopicInfo(topic_p1_r2, 0)
+	test.Nil(t, err)
+	test.Equal(t, FindSlice(t0.ISR, standbyNode), -1)
+
+	err = lookupCoord.RemoveTopicStandbyReplica(topic_p1_r2, 0, standbyNode)
+	test.Nil(t, err)
+	waitClusterStable(lookupCoord, time.Second*3)
+	t0, err = lookupLeadership.GetTopicInfo(topic_p1_r2, 0)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(t0.StandbyList))
+	_, coordErr = standbyCoord.getTopicCoord(topic_p1_r2, 0)
+	test.NotNil(t, coordErr)
+
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_ERR)
+}
+
 func TestNsqLookupOrderedTopicCreate(t *testing.T) {
 	if testing.Verbose() {
 		SetCoordLogger(levellogger.NewSimpleLog(), levellogger.LOG_INFO)
@@ -17,6 +17,8 @@ type INsqlookupRemoteProxy interface {
 	RequestLeaveFromISRByLeader(topic string, partition int, nid string, leaderSession *TopicLeaderSession) *CoordErr
 	RequestNotifyNewTopicInfo(topic string, partition int, nid string)
 	RequestCheckTopicConsistence(topic string, partition int)
+	RequestTransferTopicLeader(topic string, partition int, nid string, newLeader string, timeout time.Duration) *CoordErr
+	RequestCheckClusterFeature(feature string) *CoordErr
 }
 
 type nsqlookupRemoteProxyCreateFunc func(string, time.Duration) (INsqlookupRemoteProxy, error)
@@ -190,3 +192,23 @@ func (self *NsqLookupRpcClient) RequestCheckTopicConsistence(topic string, parti
 	req.TopicPartition = partition
 	self.CallWithRetry("RequestCheckTopicConsistence", &req)
 }
+
+// RequestTransferTopicLeader waits the transfer done on the nsqlookupd, the catchup
+// of the new leader takes the timeout at most and the election takes the same.
+func (self *NsqLookupRpcClient) RequestTransferTopicLeader(topic string, partition int, nid string, newLeader string, timeout time.Duration) *CoordErr {
+	var req RpcReqTransferTopicLeader
+	req.NodeID = nid
+	req.TopicName = topic
+	req.TopicPartition = partition
+	req.NewLeader = newLeader
+	req.Timeout = timeout
+	ret, err := self.dc.CallTimeout("RequestTransferTopicLeader", &req, timeout*2)
+	return convertRpcError(err, ret)
+}
+
+func (self *NsqLookupRpcClient) RequestCheckClusterFeature(feature string) *CoordErr {
+	var req RpcReqCheckClusterFeature
+	req.Feature = feature
+	ret, err := self.CallWithRetry("RequestCheckClusterFeature", &req)
+	return convertRpcError(err, ret)
+}
@@ -0,0 +1,353 @@
+package consistence
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ReplicationLimitsRefreshInterval = time.Second * 10
+	// the max wait for the throttle each time, so the catchup can check the leader
+	// change and the exit while throttled.
+	maxReplicationThrottleWait = time.Second * 5
+)
+
+var ErrInvalidReplicationLimits = errors.New("invalid replication limits")
+
+// ReplicationLimits is the cluster config of the max bytes per second for the
+// catchup replication (the new replica pulling data from the leader), so the
+// re-replication after the node lost will not saturate the network used by
+// the production traffic. The zero rate means no limit. The sync write from the
+// leader to the isr is never throttled.
+type ReplicationLimits struct {
+	// the default limit for each topic partition
+	TopicRate int64 `json:"topic_rate"`
+	// the limit for the topic partitions of the topic, override the default
+	TopicRates map[string]int64 `json:"topic_rates,omitempty"`
+	// the default limit for each node pair from the leader to the replica
+	NodePairRate int64 `json:"node_pair_rate"`
+	// the limit for the node pair by ReplicationNodePairKey, override the default
+	NodePairRates map[string]int64 `json:"node_pair_rates,omitempty"`
+}
+
+func replicationTopicKey(topic string, partition int) string {
+	return topic + "-" + strconv.Itoa(partition)
+}
+
+func ReplicationNodePairKey(from string, to string) string {
+	return from + "->" + to
+}
+
+func (l *ReplicationLimits) Validate() error {
+	if l.TopicRate < 0 || l.NodePairRate < 0 {
+		return ErrInvalidReplicationLimits
+	}
+	for _, r := range l.TopicRates {
+		if r < 0 {
+			return ErrInvalidReplicationLimits
+		}
+	}
+	for _, r := range l.NodePairRates {
+		if r < 0 {
+			return ErrInvalidReplicationLimits
+		}
+	}
+	return nil
+}
+
+func (l *ReplicationLimits) GetTopicRate(topic string) int64 {
+	if r, ok := l.TopicRates[topic]; ok {
+		return r
+	}
+	return l.TopicRate
+}
+
+func (l *ReplicationLimits) GetNodePairRate(from string, to string) int64 {
+	if r, ok := l.NodePairRates[ReplicationNodePairKey(from, to)]; ok {
+		return r
+	}
+	return l.NodePairRate
+}
+
+// the token bucket allows the burst of one second, the tokens can be negative
+// so the large batch will wait for the tokens taken ahead.
+type byteRateLimiter struct {
+	sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newByteRateLimiter(rate int64) *byteRateLimiter {
+	return &byteRateLimiter{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes the bytes and returns the duration to wait
+func (l *byteRateLimiter) reserve(now time.Time, n int64) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+type replicationCounter struct {
+	syncBytes    int64
+	catchupBytes int64
+	throttled    int64
+	// the rates computed in the last refresh interval
+	lastSync    int64
+	lastCatchup int64
+	syncRate    int64
+	catchupRate int64
+}
+
+type ReplicationThroughput struct {
+	Name         string `json:"name"`
+	SyncBytes    int64  `json:"sync_bytes"`
+	CatchupBytes int64  `json:"catchup_bytes"`
+	SyncRate     int64  `json:"sync_bytes_per_sec"`
+	CatchupRate  int64  `json:"catchup_bytes_per_sec"`
+	CatchupLimit int64  `json:"catchup_limit,omitempty"`
+	// the total time in milliseconds the catchup waited for the limit
+	ThrottledMs int64 `json:"throttled_ms"`
+}
+
+type ReplicationStats struct {
+	Limits    ReplicationLimits       `json:"limits"`
+	Topics    []ReplicationThroughput `json:"topics"`
+	NodePairs []ReplicationThroughput `json:"node_pairs"`
+}
+
+type replicationThroughputList []ReplicationThroughput
+
+func (l replicationThroughputList) Len() int           { return len(l) }
+func (l replicationThroughputList) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l replicationThroughputList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// replicationThrottle limits the catchup traffic by the cluster replication limits,
+// and counts the replication throughput for each topic partition and node pair.
+type replicationThrottle struct {
+	sync.Mutex
+	limits        ReplicationLimits
+	topicLimiters map[string]*byteRateLimiter
+	pairLimiters  map[string]*byteRateLimiter
+	topicCounters map[string]*replicationCounter
+	pairCounters  map[string]*replicationCounter
+	lastRefresh   time.Time
+}
+
+func newReplicationThrottle() *replicationThrottle {
+	return &replicationThrottle{
+		topicLimiters: make(map[string]*byteRateLimiter),
+		pairLimiters:  make(map[string]*byteRateLimiter),
+		topicCounters: make(map[string]*replicationCounter),
+		pairCounters:  make(map[string]*replicationCounter),
+		lastRefresh:   time.Now(),
+	}
+}
+
+func (t *replicationThrottle) setLimits(limits ReplicationLimits) {
+	t.Lock()
+	defer t.Unlock()
+	t.limits = limits
+	// the limiters will be created again with the new rate while used
+	t.topicLimiters = make(map[string]*byteRateLimiter)
+	t.pairLimiters = make(map[string]*byteRateLimiter)
+}
+
+func (t *replicationThrottle) getLimits() ReplicationLimits {
+	t.Lock()
+	defer t.Unlock()
+	return t.limits
+}
+
+func getOrCreateLimiter(limiters map[string]*byteRateLimiter, key string, rate int64) *byteRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	l, ok := limiters[key]
+	if !ok {
+		l = newByteRateLimiter(rate)
+		limiters[key] = l
+	}
+	return l
+}
+
+func getOrCreateCounter(counters map[string]*replicationCounter, key string) *replicationCounter {
+	c, ok := counters[key]
+	if !ok {
+		c = &replicationCounter{}
+		counters[key] = c
+	}
+	return c
+}
+
+func (t *replicationThrottle) addSyncBytes(topic string, partition int, from string, to string, n int64) {
+	t.Lock()
+	tc := getOrCreateCounter(t.topicCounters, replicationTopicKey(topic, partition))
+	pc := getOrCreateCounter(t.pairCounters, ReplicationNodePairKey(from, to))
+	t.Unlock()
+	atomic.AddInt64(&tc.syncBytes, n)
+	atomic.AddInt64(&pc.syncBytes, n)
+}
+
+// waitCatchup counts the bytes pulled from the leader and waits if the catchup
+// exceeds the limits of the topic or the node pair. It returns the waited time.
+func (t *replicationThrottle) waitCatchup(topic string, partition int, from string, to string,
+	n int64, stopChan chan struct{}) time.Duration {
+	topicKey := replicationTopicKey(topic, partition)
+	pairKey := ReplicationNodePairKey(from, to)
+	t.Lock()
+	tl := getOrCreateLimiter(t.topicLimiters, topicKey, t.limits.GetTopicRate(topic))
+	pl := getOrCreateLimiter(t.pairLimiters, pairKey, t.limits.GetNodePairRate(from, to))
+	tc := getOrCreateCounter(t.topicCounters, topicKey)
+	pc := getOrCreateCounter(t.pairCounters, pairKey)
+	t.Unlock()
+	atomic.AddInt64(&tc.catchupBytes, n)
+	atomic.AddInt64(&pc.catchupBytes, n)
+
+	now := time.Now()
+	var wait time.Duration
+	if tl != nil {
+		wait = tl.reserve(now, n)
+	}
+	if pl != nil {
+		if w := pl.reserve(now, n); w > wait {
+			wait = w
+		}
+	}
+	if wait <= 0 {
+		return 0
+	}
+	if wait > maxReplicationThrottleWait {
+		wait = maxReplicationThrottleWait
+	}
+	atomic.AddInt64(&tc.throttled, int64(wait/time.Millisecond))
+	atomic.AddInt64(&pc.throttled, int64(wait/time.Millisecond))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-stopChan:
+	}
+	return wait
+}
+
+// updateRates computes the throughput since the last refresh
+func (t *replicationThrottle) updateRates(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	secs := now.Sub(t.lastRefresh).Seconds()
+	t.lastRefresh = now
+	if secs <= 0 {
+		return
+	}
+	for _, counters := range []map[string]*replicationCounter{t.topicCounters, t.pairCounters} {
+		for _, c := range counters {
+			syncBytes := atomic.LoadInt64(&c.syncBytes)
+			catchupBytes := atomic.LoadInt64(&c.catchupBytes)
+			c.syncRate = int64(float64(syncBytes-c.lastSync) / secs)
+			c.catchupRate = int64(float64(catchupBytes-c.lastCatchup) / secs)
+			c.lastSync = syncBytes
+			c.lastCatchup = catchupBytes
+		}
+	}
+}
+
+func (t *replicationThrottle) getStats() *ReplicationStats {
+	t.Lock()
+	defer t.Unlock()
+	s := &ReplicationStats{
+		Limits:    t.limits,
+		Topics:    make([]ReplicationThroughput, 0, len(t.topicCounters)),
+		NodePairs: make([]ReplicationThroughput, 0, len(t.pairCounters)),
+	}
+	toThroughput := func(name string, c *replicationCounter, limiter *byteRateLimiter) ReplicationThroughput {
+		r := ReplicationThroughput{
+			Name:         name,
+			SyncBytes:    atomic.LoadInt64(&c.syncBytes),
+			CatchupBytes: atomic.LoadInt64(&c.catchupBytes),
+			SyncRate:     c.syncRate,
+			CatchupRate:  c.catchupRate,
+			ThrottledMs:  atomic.LoadInt64(&c.throttled),
+		}
+		if limiter != nil {
+			r.CatchupLimit = limiter.rate
+		}
+		return r
+	}
+	for name, c := range t.topicCounters {
+		s.Topics = append(s.Topics, toThroughput(name, c, t.topicLimiters[name]))
+	}
+	for name, c := range t.pairCounters {
+		s.NodePairs = append(s.NodePairs, toThroughput(name, c, t.pairLimiters[name]))
+	}
+	sort.Sort(replicationThroughputList(s.Topics))
+	sort.Sort(replicationThroughputList(s.NodePairs))
+	return s
+}
+
+// refreshReplicationLimits loads the cluster replication limits periodically
+func (self *NsqdCoordinator) refreshReplicationLimits() {
+	defer self.wg.Done()
+	ticker := time.NewTicker(ReplicationLimitsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.stopChan:
+			return
+		}
+		self.replThrottle.updateRates(time.Now())
+		if self.leadership == nil {
+			continue
+		}
+		limits, err := self.leadership.GetReplicationLimits()
+		if err != nil {
+			coordLog.Infof("failed to get the replication limits: %v", err)
+			continue
+		}
+		if !isSameReplicationLimits(limits, self.replThrottle.getLimits()) {
+			coordLog.Infof("replication limits changed to: %+v", limits)
+			self.replThrottle.setLimits(limits)
+		}
+	}
+}
+
+func isSameReplicationLimits(l ReplicationLimits, r ReplicationLimits) bool {
+	if l.TopicRate != r.TopicRate || l.NodePairRate != r.NodePairRate ||
+		len(l.TopicRates) != len(r.TopicRates) || len(l.NodePairRates) != len(r.NodePairRates) {
+		return false
+	}
+	for k, v := range l.TopicRates {
+		if rv, ok := r.TopicRates[k]; !ok || rv != v {
+			return false
+		}
+	}
+	for k, v := range l.NodePairRates {
+		if rv, ok := r.NodePairRates[k]; !ok || rv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *NsqdCoordinator) GetReplicationStats() *ReplicationStats {
+	return self.replThrottle.getStats()
+}
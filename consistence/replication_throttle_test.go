@@ -0,0 +1,59 @@
+package consistence
+
+import (
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestReplicationThrottleLimits(t *testing.T) {
+	throttle := newReplicationThrottle()
+	stopChan := make(chan struct{})
+	// the closed stop chan make the wait return at once
+	close(stopChan)
+
+	wait := throttle.waitCatchup("test", 0, "leader", "replica", 1024*1024*10, stopChan)
+	test.Equal(t, time.Duration(0), wait)
+
+	limits := ReplicationLimits{
+		TopicRate:     1024 * 1024,
+		TopicRates:    map[string]int64{"test_fast": 1024 * 1024 * 100},
+		NodePairRate:  1024 * 1024 * 10,
+		NodePairRates: map[string]int64{ReplicationNodePairKey("leader", "slow"): 1024},
+	}
+	test.Nil(t, limits.Validate())
+	throttle.setLimits(limits)
+	// the burst of one second is allowed
+	wait = throttle.waitCatchup("test", 0, "leader", "replica", 1024*1024, stopChan)
+	test.Equal(t, time.Duration(0), wait)
+	wait = throttle.waitCatchup("test", 0, "leader", "replica", 1024*512, stopChan)
+	test.Equal(t, true, wait > time.Millisecond*400)
+	test.Equal(t, true, wait <= time.Millisecond*500)
+	// the other partition has its own limit
+	wait = throttle.waitCatchup("test", 1, "leader", "replica", 1024*512, stopChan)
+	test.Equal(t, time.Duration(0), wait)
+	// override the default topic limit, but the node pair limit is shared
+	wait = throttle.waitCatchup("test_fast", 0, "leader", "replica", 1024*1024*9, stopChan)
+	test.Equal(t, true, wait > 0)
+	// the wait is limited each time
+	wait = throttle.waitCatchup("test_fast", 0, "leader", "slow", 1024*1024, stopChan)
+	test.Equal(t, maxReplicationThrottleWait, wait)
+
+	throttle.addSyncBytes("test", 0, "leader", "replica", 100)
+	throttle.updateRates(time.Now().Add(time.Second))
+	s := throttle.getStats()
+	test.Equal(t, limits.TopicRate, s.Limits.TopicRate)
+	test.Equal(t, 3, len(s.Topics))
+	test.Equal(t, "test-0", s.Topics[0].Name)
+	test.Equal(t, int64(100), s.Topics[0].SyncBytes)
+	test.Equal(t, int64(1024*1024*10+1024*1024+1024*512), s.Topics[0].CatchupBytes)
+	test.Equal(t, limits.TopicRate, s.Topics[0].CatchupLimit)
+	test.Equal(t, true, s.Topics[0].ThrottledMs > 0)
+	test.Equal(t, 2, len(s.NodePairs))
+	test.Equal(t, ReplicationNodePairKey("leader", "replica"), s.NodePairs[0].Name)
+
+	test.NotNil(t, (&ReplicationLimits{TopicRate: -1}).Validate())
+	test.Equal(t, true, isSameReplicationLimits(limits, throttle.getLimits()))
+	test.Equal(t, false, isSameReplicationLimits(limits, ReplicationLimits{}))
+}
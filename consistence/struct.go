@@ -11,12 +11,15 @@ const (
 	NSQ_ROOT_DIR               = "NSQMetaData"
 	NSQ_TOPIC_DIR              = "Topics"
 	NSQ_TOPIC_META             = "TopicMeta"
+	NSQ_TOPIC_OWNER_META       = "TopicOwnerMeta"
 	NSQ_TOPIC_REPLICA_INFO     = "ReplicaInfo"
 	NSQ_TOPIC_LEADER_SESSION   = "LeaderSession"
 	NSQ_NODE_DIR               = "NsqdNodes"
 	NSQ_LOOKUPD_DIR            = "NsqlookupdInfo"
 	NSQ_LOOKUPD_NODE_DIR       = "NsqlookupdNodes"
 	NSQ_LOOKUPD_LEADER_SESSION = "LookupdLeaderSession"
+	NSQ_REPLICATION_LIMITS     = "ReplicationLimits"
+	NSQ_NSQD_VERSIONS          = "NsqdVersions"
 )
 
 const (
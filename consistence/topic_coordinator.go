@@ -6,6 +6,7 @@ import (
 	"path"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type ChannelConsumerOffset struct {
@@ -77,6 +78,12 @@ type TopicCoordinator struct {
 	disableWrite   int32
 	exiting        int32
 	basePath       string
+	// sync state if I am the standby replica
+	standbyLogIDLag   int64
+	standbyLastSynced int64
+	// the lag of the standby replicas checked in background if I am the leader
+	standbyLagMutex sync.Mutex
+	standbyLags     map[string]int64
 }
 
 func NewTopicCoordinator(name string, partition int, basepath string,
@@ -190,6 +197,38 @@ func (self *TopicCoordinator) DisableWrite(disable bool) {
 	self.writeHold.Unlock()
 }
 
+func (self *TopicCoordinator) updateStandbyLag(lag int64) {
+	if lag < 0 {
+		lag = 0
+	}
+	atomic.StoreInt64(&self.standbyLogIDLag, lag)
+}
+
+func (self *TopicCoordinator) updateStandbySynced(t time.Time) {
+	atomic.StoreInt64(&self.standbyLastSynced, t.Unix())
+}
+
+func (self *TopicCoordinator) getStandbySyncState() (int64, int64) {
+	return atomic.LoadInt64(&self.standbyLogIDLag), atomic.LoadInt64(&self.standbyLastSynced)
+}
+
+func (self *TopicCoordinator) updateStandbyLagsOnLeader(lags map[string]int64) {
+	self.standbyLagMutex.Lock()
+	self.standbyLags = lags
+	self.standbyLagMutex.Unlock()
+}
+
+// return -1 if the lag of the standby replica is not checked or not available
+func (self *TopicCoordinator) getStandbyLagOnLeader(nid string) int64 {
+	self.standbyLagMutex.Lock()
+	defer self.standbyLagMutex.Unlock()
+	lag, ok := self.standbyLags[nid]
+	if !ok {
+		return -1
+	}
+	return lag
+}
+
 func (self *TopicCoordinator) IsExiting() bool {
 	return atomic.LoadInt32(&self.exiting) == 1
 }
@@ -55,6 +55,10 @@ func IsEtcdNodeExist(err error) bool {
 	return isEtcdErrorNum(err, client.ErrorCodeNodeExist)
 }
 
+func IsEtcdCompareFailed(err error) bool {
+	return isEtcdErrorNum(err, client.ErrorCodeTestFailed)
+}
+
 func isEtcdErrorNum(err error, errorCode int) bool {
 	if err != nil {
 		if etcdError, ok := err.(client.Error); ok {
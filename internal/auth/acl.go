@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+const (
+	ACLOpPub           = "PUB"
+	ACLOpSub           = "SUB"
+	ACLOpChannelCreate = "CHANNEL_CREATE"
+	ACLOpChannelDelete = "CHANNEL_DELETE"
+
+	ACLActionAllow = "allow"
+	ACLActionDeny  = "deny"
+)
+
+var ACLOperations = []string{ACLOpPub, ACLOpSub, ACLOpChannelCreate, ACLOpChannelDelete}
+
+// ACLRule allows or denies the operations for the identities and the topics
+// matching the given regular expressions. Empty identity or topic matches all.
+type ACLRule struct {
+	Identity   string   `json:"identity"`
+	Topic      string   `json:"topic"`
+	Operations []string `json:"operations"`
+	Action     string   `json:"action"`
+
+	identityRegex *regexp.Regexp
+	topicRegex    *regexp.Regexp
+}
+
+func (r *ACLRule) compile() error {
+	var err error
+	if r.Identity != "" {
+		r.identityRegex, err = regexp.Compile(r.Identity)
+		if err != nil {
+			return fmt.Errorf("invalid identity pattern %q: %v", r.Identity, err)
+		}
+	}
+	if r.Topic != "" {
+		r.topicRegex, err = regexp.Compile(r.Topic)
+		if err != nil {
+			return fmt.Errorf("invalid topic pattern %q: %v", r.Topic, err)
+		}
+	}
+	if r.Action != ACLActionAllow && r.Action != ACLActionDeny {
+		return fmt.Errorf("invalid action %q", r.Action)
+	}
+	if len(r.Operations) == 0 {
+		return errors.New("no operations in acl rule")
+	}
+	for i, op := range r.Operations {
+		op = strings.ToUpper(op)
+		if op != "*" && !isACLOperation(op) {
+			return fmt.Errorf("invalid operation %q", op)
+		}
+		r.Operations[i] = op
+	}
+	return nil
+}
+
+func (r *ACLRule) match(identity, topic, op string) bool {
+	if r.identityRegex != nil && !r.identityRegex.MatchString(identity) {
+		return false
+	}
+	if r.topicRegex != nil && !r.topicRegex.MatchString(topic) {
+		return false
+	}
+	for _, o := range r.Operations {
+		if o == "*" || o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is the ordered rule list, the first matched rule decides the result and
+// the default action is used if no rule matched.
+type ACL struct {
+	Default string    `json:"default"`
+	Rules   []ACLRule `json:"rules"`
+}
+
+func isACLOperation(op string) bool {
+	for _, o := range ACLOperations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+func NewACL(data []byte) (*ACL, error) {
+	acl := &ACL{}
+	err := json.Unmarshal(data, acl)
+	if err != nil {
+		return nil, err
+	}
+	if acl.Default == "" {
+		acl.Default = ACLActionAllow
+	}
+	if acl.Default != ACLActionAllow && acl.Default != ACLActionDeny {
+		return nil, fmt.Errorf("invalid default action %q", acl.Default)
+	}
+	for i := range acl.Rules {
+		if err := acl.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("acl rule %v: %v", i, err)
+		}
+	}
+	return acl, nil
+}
+
+func LoadACLFile(fileName string) (*ACL, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return NewACL(data)
+}
+
+func (a *ACL) IsAllowed(identity, topic, op string) bool {
+	for i := range a.Rules {
+		if a.Rules[i].match(identity, topic, op) {
+			return a.Rules[i].Action == ACLActionAllow
+		}
+	}
+	return a.Default == ACLActionAllow
+}
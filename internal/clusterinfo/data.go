@@ -12,6 +12,7 @@ import (
 	"errors"
 	"math"
 	"sync/atomic"
+	"time"
 
 	"github.com/blang/semver"
 	"github.com/youzan/nsq/internal/http_api"
@@ -746,6 +747,43 @@ func (c *ClusterInfo) GetNSQDMessageHistoryStats(nsqdHTTPAddr string, selectedTo
 	return historyStatsResp.HistoryStat, nil
 }
 
+// GetLookupdTopicOwnerMeta returns the owner meta of the topic from the first
+// nsqlookupd which responds successfully.
+func (c *ClusterInfo) GetLookupdTopicOwnerMeta(topic string, lookupdHTTPAddrs []string) (*TopicOwnerMeta, error) {
+	var errs []error
+	for _, addr := range lookupdHTTPAddrs {
+		endpoint := fmt.Sprintf("http://%s/topic/owner?topic=%s", addr, url.QueryEscape(topic))
+		c.logf("CI: querying nsqlookupd %s", endpoint)
+
+		var meta TopicOwnerMeta
+		err := c.client.NegotiateV1(endpoint, &meta)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return &meta, nil
+	}
+	return nil, fmt.Errorf("Failed to query any nsqlookupd: %s", ErrList(errs))
+}
+
+// GetNSQDChannelDepthHistory returns the depth samples of the channel on the
+// partition for the time range ago from now.
+func (c *ClusterInfo) GetNSQDChannelDepthHistory(nsqdHTTPAddr string, selectedTopic string, par string,
+	channel string, ago time.Duration) ([]DepthHistoryPoint, error) {
+	endpoint := fmt.Sprintf("http://%s/channel/depth/history?topic=%s&partition=%s&channel=%s&ago=%s&samples=true",
+		nsqdHTTPAddr, url.QueryEscape(selectedTopic), url.QueryEscape(par), url.QueryEscape(channel), ago)
+	c.logf("CI: querying nsqd %s", endpoint)
+
+	var depthHistoryResp struct {
+		Samples []DepthHistoryPoint `json:"samples"`
+	}
+	err := c.client.NegotiateV1(endpoint, &depthHistoryResp)
+	if err != nil {
+		return nil, err
+	}
+	return depthHistoryResp.Samples, nil
+}
+
 func (c *ClusterInfo) GetNSQDMessageByID(p Producer, selectedTopic string,
 	part string, msgID int64) (string, int64, error) {
 	if selectedTopic == "" {
@@ -959,6 +997,63 @@ func (c *ClusterInfo) GetNSQDStats(producers Producers, selectedTopic string, so
 	return topicStatsList, channelStatsMap, nil
 }
 
+// GetClusterTopicStats returns the cluster view of the topics from the given Producers.
+//
+// The stats of all partitions and replicas for the same topic are merged into one
+// TopicStats. Only the leader of each partition is counted into the aggregate, and
+// the replicas are listed in the nodes with is_leader marked. If no leader is
+// found for a partition, the replica with the most messages will be counted.
+func (c *ClusterInfo) GetClusterTopicStats(producers Producers, selectedTopic string) ([]*TopicStats, error) {
+	topicStatsList, _, err := c.GetNSQDStats(producers, selectedTopic, "partition", false)
+	if err != nil {
+		if _, ok := err.(PartialErr); !ok {
+			return nil, err
+		}
+	}
+
+	type partitionKey struct {
+		topic     string
+		partition string
+	}
+	counted := make(map[partitionKey]*TopicStats)
+	for _, t := range topicStatsList {
+		key := partitionKey{t.TopicName, t.TopicPartition}
+		old, ok := counted[key]
+		if !ok || (!old.IsLeader && (t.IsLeader || t.MessageCount > old.MessageCount)) {
+			counted[key] = t
+		}
+	}
+
+	clusterStatsMap := make(map[string]*TopicStats)
+	var clusterStatsList TopicStatsList
+	for _, t := range topicStatsList {
+		clusterStats, ok := clusterStatsMap[t.TopicName]
+		if !ok {
+			clusterStats = &TopicStats{
+				Node:           "*",
+				TopicName:      t.TopicName,
+				StatsdName:     t.TopicName,
+				IsMultiOrdered: t.IsMultiOrdered,
+				IsExt:          t.IsExt,
+			}
+			clusterStatsMap[t.TopicName] = clusterStats
+			clusterStatsList = append(clusterStatsList, clusterStats)
+		}
+		if counted[partitionKey{t.TopicName, t.TopicPartition}] == t {
+			clusterStats.AddToCluster(t)
+		} else {
+			clusterStats.AddReplica(t)
+		}
+	}
+	for _, t := range clusterStatsList {
+		for _, channel := range t.Channels {
+			t.TotalChannelDepth += channel.Depth
+		}
+	}
+	sort.Sort(TopicStatsByName{clusterStatsList})
+	return clusterStatsList, err
+}
+
 // TombstoneNodeForTopic tombstones the given node for the given topic on all the given nsqlookupd
 // and deletes the topic from the node
 func (c *ClusterInfo) TombstoneNodeForTopic(topic string, node string, lookupdHTTPAddrs []string) error {
@@ -1256,6 +1351,40 @@ func (c *ClusterInfo) ResetChannel(topicName string, channelName string, lookupd
 	return c.actionHelperWithContent(topicName, lookupdHTTPAddrs, nil, "", "channel/setoffset", qs, resetBy)
 }
 
+// TransferTopicLeader requests the current leader of the topic partition to transfer
+// the leadership to the new leader node.
+func (c *ClusterInfo) TransferTopicLeader(topicName string, partition string, newLeader string, lookupdHTTPAddrs []string) error {
+	var errs []error
+
+	_, partitionProducers, err := c.GetTopicProducers(topicName, lookupdHTTPAddrs, nil)
+	if err != nil {
+		pe, ok := err.(PartialErr)
+		if !ok {
+			return err
+		}
+		errs = append(errs, pe.Errors()...)
+	}
+	pp, ok := partitionProducers[partition]
+	if !ok || len(pp) == 0 {
+		errs = append(errs, fmt.Errorf("no leader found for topic %v partition %v", topicName, partition))
+		return ErrList(errs)
+	}
+	qs := fmt.Sprintf("topic=%s&partition=%s&node=%s", url.QueryEscape(topicName),
+		url.QueryEscape(partition), url.QueryEscape(newLeader))
+	err = c.versionPivotProducers(pp, "", "topic/leader/transfer", qs)
+	if err != nil {
+		pe, ok := err.(PartialErr)
+		if !ok {
+			return err
+		}
+		errs = append(errs, pe.Errors()...)
+	}
+	if len(errs) > 0 {
+		return ErrList(errs)
+	}
+	return nil
+}
+
 func (c *ClusterInfo) actionHelperWithContent(topicName string, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string, deprecatedURI string, v1URI string, qs string, content string) error {
 	var errs []error
 
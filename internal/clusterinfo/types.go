@@ -96,6 +96,7 @@ func (p *Producer) IsInconsistent(numLookupd int) bool {
 type ClientPubStats struct {
 	RemoteAddress string `json:"remote_address"`
 	UserAgent     string `json:"user_agent"`
+	Identity      string `json:"identity,omitempty"`
 	Protocol      string `json:"protocol"`
 	PubCount      int64  `json:"pub_count"`
 	ErrCount      int64  `json:"err_count"`
@@ -277,6 +278,78 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 	sort.Sort(ClientsByHost{c.Clients})
 }
 
+// AddToCluster merges the stats of the partition leader into the cluster view of
+// the topic. Unlike Add used by nsqadmin, the hourly publish size and the
+// histograms are also summed, and the channels are merged into the new aggregate
+// channels so the channel stats of the node are not changed.
+func (t *TopicStats) AddToCluster(a *TopicStats) {
+	t.Depth += a.Depth
+	t.MemoryDepth += a.MemoryDepth
+	t.BackendDepth += a.BackendDepth
+	t.MessageCount += a.MessageCount
+	t.HourlyPubSize += a.HourlyPubSize
+	for i, v := range a.MessageSizeStats {
+		t.MessageSizeStats[i] += v
+	}
+	for i, v := range a.MessageLatencyStats {
+		t.MessageLatencyStats[i] += v
+	}
+	if a.Paused {
+		t.Paused = a.Paused
+	}
+	for _, aChannelStats := range a.Channels {
+		var channelStats *ChannelStats
+		for _, c := range t.Channels {
+			if aChannelStats.ChannelName == c.ChannelName {
+				channelStats = c
+				break
+			}
+		}
+		if channelStats == nil {
+			channelStats = &ChannelStats{
+				TopicName:      aChannelStats.TopicName,
+				TopicPartition: aChannelStats.TopicPartition,
+				ChannelName:    aChannelStats.ChannelName,
+				IsMultiOrdered: aChannelStats.IsMultiOrdered,
+				IsExt:          aChannelStats.IsExt,
+			}
+			t.Channels = append(t.Channels, channelStats)
+		}
+		channelStats.Add(aChannelStats)
+		channelStats.MsgConsumeLatencyStats = mergeHistogram(channelStats.MsgConsumeLatencyStats, aChannelStats.MsgConsumeLatencyStats)
+		channelStats.MsgDeliveryLatencyStats = mergeHistogram(channelStats.MsgDeliveryLatencyStats, aChannelStats.MsgDeliveryLatencyStats)
+	}
+	t.NodeStats = append(t.NodeStats, a)
+	sort.Sort(TopicStatsByPartitionAndHost{t.NodeStats})
+	if t.E2eProcessingLatency == nil {
+		t.E2eProcessingLatency = &quantile.E2eProcessingLatencyAggregate{
+			Addr:  t.Node,
+			Topic: t.TopicName,
+		}
+	}
+	t.E2eProcessingLatency.Add(a.E2eProcessingLatency)
+}
+
+// AddReplica adds the stats of a non-leader replica to the node list
+// without counting it into the aggregate, since the replica has the same
+// messages as the leader.
+func (t *TopicStats) AddReplica(a *TopicStats) {
+	t.NodeStats = append(t.NodeStats, a)
+	sort.Sort(TopicStatsByPartitionAndHost{t.NodeStats})
+}
+
+func mergeHistogram(h []int64, a []int64) []int64 {
+	if len(h) < len(a) {
+		nh := make([]int64, len(a))
+		copy(nh, h)
+		h = nh
+	}
+	for i, v := range a {
+		h[i] += v
+	}
+	return h
+}
+
 type ClientStats struct {
 	Node              string        `json:"node"`
 	RemoteAddress     string        `json:"remote_address"`
@@ -303,6 +376,11 @@ type ClientStats struct {
 
 	DesiredTag string `json:"desired_tag"`
 
+	TCPNoDelay         bool  `json:"tcp_no_delay"`
+	TCPSendBufferSize  int   `json:"tcp_send_buffer_size"`
+	TCPRecvBufferSize  int   `json:"tcp_recv_buffer_size"`
+	TCPKeepAlivePeriod int64 `json:"tcp_keepalive_period"`
+
 	TLS                           bool   `json:"tls"`
 	CipherSuite                   string `json:"tls_cipher_suite"`
 	TLSVersion                    string `json:"tls_version"`
@@ -432,6 +510,14 @@ func (c TopicStatsByMessageCount) Less(i, j int) bool {
 	return l > r
 }
 
+type TopicStatsByName struct {
+	TopicStatsList
+}
+
+func (c TopicStatsByName) Less(i, j int) bool {
+	return c.TopicStatsList[i].TopicName < c.TopicStatsList[j].TopicName
+}
+
 type Producers []*Producer
 
 func (t Producers) Len() int      { return len(t) }
@@ -473,12 +559,20 @@ type CatchupStat struct {
 	Progress int    `json:"progress"`
 }
 
+type StandbyStat struct {
+	HostName   string `json:"hostname"`
+	NodeID     string `json:"node_id"`
+	LogIDLag   int64  `json:"log_id_lag"`
+	LastSynced int64  `json:"last_synced"`
+}
+
 type TopicCoordStat struct {
 	Node         string        `json:"node"`
 	Name         string        `json:"name"`
 	Partition    int           `json:"partition"`
 	ISRStats     []ISRStat     `json:"isr_stats"`
 	CatchupStats []CatchupStat `json:"catchup_stats"`
+	StandbyStats []StandbyStat `json:"standby_stats"`
 }
 
 type CoordStats struct {
@@ -506,3 +600,76 @@ type NodeHourlyPubsize struct {
 	TopicPartition string `json:"topic_partition"`
 	HourlyPubSize  int64  `json:"hourly_pub_size"`
 }
+
+type HistoryPoint struct {
+	Ts    int64 `json:"ts"`
+	Value int64 `json:"value"`
+}
+
+type DepthHistoryPoint struct {
+	Ts        int64 `json:"ts"`
+	Depth     int64 `json:"depth"`
+	DepthSize int64 `json:"depth_size"`
+}
+
+// MergeDepthHistory sums the depth history of all the partitions into the points
+// aligned by step between start and end. For each partition the latest sample
+// not after the point is used, and the points before any sample are dropped.
+func MergeDepthHistory(series [][]DepthHistoryPoint, start int64, end int64, step int64) []DepthHistoryPoint {
+	if step <= 0 || end < start {
+		return nil
+	}
+	points := make([]DepthHistoryPoint, 0, (end-start)/step+1)
+	for ts := start; ts <= end; ts += step {
+		points = append(points, DepthHistoryPoint{Ts: ts})
+	}
+	firstValid := len(points)
+	for _, samples := range series {
+		idx := 0
+		var last *DepthHistoryPoint
+		for i := range points {
+			for idx < len(samples) && samples[idx].Ts <= points[i].Ts {
+				last = &samples[idx]
+				idx++
+			}
+			if last == nil {
+				continue
+			}
+			if i < firstValid {
+				firstValid = i
+			}
+			points[i].Depth += last.Depth
+			points[i].DepthSize += last.DepthSize
+		}
+	}
+	return points[firstValid:]
+}
+
+// MergeHourlyPubSize sums the hourly pub size history of all the partitions, the
+// history from nsqd is in order from the oldest hour to the last hour.
+func MergeHourlyPubSize(series [][]int64, lastHour time.Time) []HistoryPoint {
+	var points []HistoryPoint
+	for _, hourly := range series {
+		if len(points) < len(hourly) {
+			points = append(points, make([]HistoryPoint, len(hourly)-len(points))...)
+		}
+	}
+	for i := range points {
+		points[i].Ts = lastHour.Add(-1 * time.Duration(len(points)-1-i) * time.Hour).Unix()
+	}
+	for _, hourly := range series {
+		// align the last hour of all the partitions
+		offset := len(points) - len(hourly)
+		for i, v := range hourly {
+			points[offset+i].Value += v
+		}
+	}
+	return points
+}
+
+type TopicOwnerMeta struct {
+	Owner       string `json:"owner"`
+	Team        string `json:"team"`
+	Contact     string `json:"contact"`
+	Description string `json:"description"`
+}
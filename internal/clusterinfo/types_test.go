@@ -0,0 +1,57 @@
+package clusterinfo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeDepthHistory(t *testing.T) {
+	series := [][]DepthHistoryPoint{
+		{{Ts: 95, Depth: 1, DepthSize: 10}, {Ts: 120, Depth: 3, DepthSize: 30}},
+		{{Ts: 115, Depth: 5, DepthSize: 50}},
+		// the partition without samples
+		nil,
+	}
+	points := MergeDepthHistory(series, 80, 140, 20)
+	// the point at 80 is dropped since it is before any sample
+	expected := []DepthHistoryPoint{
+		{Ts: 100, Depth: 1, DepthSize: 10},
+		{Ts: 120, Depth: 8, DepthSize: 80},
+		{Ts: 140, Depth: 8, DepthSize: 80},
+	}
+	if len(points) != len(expected) {
+		t.Fatalf("unexpected merged points: %v", points)
+	}
+	for i, p := range expected {
+		if points[i] != p {
+			t.Fatalf("point %v should be %v: %v", i, p, points[i])
+		}
+	}
+
+	if points := MergeDepthHistory(series, 140, 80, 20); len(points) != 0 {
+		t.Fatalf("should be empty if end is before start: %v", points)
+	}
+	if points := MergeDepthHistory(nil, 80, 140, 20); len(points) != 0 {
+		t.Fatalf("should be empty without samples: %v", points)
+	}
+}
+
+func TestMergeHourlyPubSize(t *testing.T) {
+	lastHour := time.Unix(1500000000, 0).Truncate(time.Hour)
+	points := MergeHourlyPubSize([][]int64{{1, 2, 3}, {10}}, lastHour)
+	if len(points) != 3 {
+		t.Fatalf("unexpected merged points: %v", points)
+	}
+	// the shorter history is aligned at the last hour
+	values := []int64{1, 2, 13}
+	for i, v := range values {
+		ts := lastHour.Add(-1 * time.Duration(2-i) * time.Hour).Unix()
+		if points[i].Ts != ts || points[i].Value != v {
+			t.Fatalf("point %v should be %v at %v: %v", i, v, ts, points[i])
+		}
+	}
+
+	if points := MergeHourlyPubSize(nil, lastHour); len(points) != 0 {
+		t.Fatalf("should be empty without history: %v", points)
+	}
+}
@@ -12,6 +12,10 @@ const (
 
 	CLIENT_DISPATCH_TAG_KEY = "##client_dispatch_tag"
 	TRACE_ID_KEY            = "##trace_id"
+	DLQ_REASON_KEY          = "##dlq_reason"
+	REPLAY_KEY              = "##replay"
+	COMPACT_KEY             = "##compact_key"
+	DEDUP_KEY               = "##dedup_key"
 	MaxExtLen               = 65535
 )
 
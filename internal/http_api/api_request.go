@@ -188,6 +188,45 @@ retry:
 	return resp.StatusCode, nil
 }
 
+// POSTV1WithResult is a helper function to perform a V1 HTTP POST request
+// and parse the response data into v, with deadlines.
+func (c *Client) POSTV1WithResult(endpoint string, v interface{}) (int, error) {
+retry:
+	req, err := http.NewRequest("POST", endpoint, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return -1, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode != 200 {
+		if resp.StatusCode == 403 && !strings.HasPrefix(endpoint, "https") {
+			endpoint, err = httpsEndpoint(endpoint, body)
+			if err != nil {
+				return resp.StatusCode, err
+			}
+			goto retry
+		}
+		return resp.StatusCode, fmt.Errorf("got response %s %q", resp.Status, body)
+	}
+	err = json.Unmarshal(body, &v)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	return resp.StatusCode, nil
+}
+
 func (c *Client) POSTV1WithContent(endpoint string, content string) (int, error) {
 retry:
 	req, err := http.NewRequest("POST", endpoint, strings.NewReader(content))
@@ -5,17 +5,28 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"errors"
 	"github.com/julienschmidt/httprouter"
 	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/internal/protocol"
 )
 
 var (
 	ErrDeprecatedAPI = errors.New("deprecated api")
 )
 
+const (
+	// the request header to ask for the structured error in the response body
+	StructuredErrorHeader = "X-NSQ-Structured-Error"
+
+	ErrorCodeHeader      = "X-NSQ-Error-Code"
+	ErrorCategoryHeader  = "X-NSQ-Error-Category"
+	ErrorRetryableHeader = "X-NSQ-Error-Retryable"
+)
+
 type Decorator func(APIHandler) APIHandler
 
 type APIHandler func(http.ResponseWriter, *http.Request, httprouter.Params) (interface{}, error)
@@ -29,6 +40,81 @@ func (e Err) Error() string {
 	return e.Text
 }
 
+// DetailErr is the Err with the details returned in the structured error
+type DetailErr struct {
+	Err
+	Details map[string]string
+}
+
+func NewDetailErr(code int, text string, details map[string]string) DetailErr {
+	return DetailErr{Err{code, text}, details}
+}
+
+func errStatusCode(err error) int {
+	switch e := err.(type) {
+	case Err:
+		return e.Code
+	case DetailErr:
+		return e.Code
+	}
+	return 500
+}
+
+// ToStructuredErr converts the error returned by the api handler, the category of
+// the unregistered code is decided by the http status code.
+func ToStructuredErr(status int, err error) *protocol.StructuredErr {
+	var details map[string]string
+	if e, ok := err.(DetailErr); ok {
+		details = e.Details
+	}
+	code, msg := protocol.ParseErrorCode(err.Error())
+	se := protocol.NewStructuredErr(code, msg, details)
+	if se.Category != protocol.ErrCategoryUnknown {
+		return se
+	}
+	switch {
+	case status == 403:
+		se.Category = protocol.ErrCategoryAuth
+	case status == 404:
+		se.Category = protocol.ErrCategoryNotFound
+	case status == 429:
+		se.Category = protocol.ErrCategoryThrottled
+		se.Retryable = true
+	case status == 503:
+		se.Category = protocol.ErrCategoryUnavailable
+		se.Retryable = true
+	case status >= 500:
+		se.Category = protocol.ErrCategoryServer
+		se.Retryable = true
+	case status >= 400:
+		se.Category = protocol.ErrCategoryInvalid
+	}
+	return se
+}
+
+// respondV1Err adds the error code headers, and returns the structured error body
+// only if asked, since the old client may depend on the message body.
+func respondV1Err(w http.ResponseWriter, req *http.Request, status int, err error) {
+	se := ToStructuredErr(status, err)
+	setErrorHeaders(w, se)
+	if req.Header.Get(StructuredErrorHeader) == "" {
+		RespondV1(w, status, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+	w.WriteHeader(status)
+	w.Write(se.JSON())
+}
+
+func setErrorHeaders(w http.ResponseWriter, se *protocol.StructuredErr) {
+	if se.Code != "" {
+		w.Header().Set(ErrorCodeHeader, se.Code)
+	}
+	w.Header().Set(ErrorCategoryHeader, se.Category)
+	w.Header().Set(ErrorRetryableHeader, strconv.FormatBool(se.Retryable))
+}
+
 func acceptVersion(req *http.Request) int {
 	if req.Header.Get("accept") == "application/vnd.nsq; version=1.0" {
 		return 1
@@ -42,7 +128,8 @@ func PlainText(f APIHandler) APIHandler {
 		code := 200
 		data, err := f(w, req, ps)
 		if err != nil {
-			code = err.(Err).Code
+			code = errStatusCode(err)
+			setErrorHeaders(w, ToStructuredErr(code, err))
 			data = err.Error()
 		}
 		switch d := data.(type) {
@@ -72,8 +159,9 @@ func NegotiateVersion(f APIHandler) APIHandler {
 		data, err := f(w, req, ps)
 		if err != nil {
 			if acceptVersion(req) == 1 {
-				RespondV1(w, err.(Err).Code, err)
+				respondV1Err(w, req, errStatusCode(err), err)
 			} else {
+				setErrorHeaders(w, ToStructuredErr(errStatusCode(err), err))
 				// this handler always returns 500 for backwards compatibility
 				Respond(w, 500, err.Error(), nil)
 			}
@@ -92,7 +180,7 @@ func V1(f APIHandler) APIHandler {
 	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 		data, err := f(w, req, ps)
 		if err != nil {
-			RespondV1(w, err.(Err).Code, err)
+			respondV1Err(w, req, errStatusCode(err), err)
 			return nil, nil
 		}
 		RespondV1(w, 200, data)
@@ -104,7 +192,7 @@ func V1Stream(f APIHandler) APIHandler {
 	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 		_, err := f(w, req, ps)
 		if err != nil {
-			RespondV1(w, err.(Err).Code, err)
+			respondV1Err(w, req, errStatusCode(err), err)
 			return nil, nil
 		}
 		return nil, nil
@@ -201,8 +289,8 @@ func levelLog(l *levellogger.LevelLogger, level int32) Decorator {
 			response, err := f(w, req, ps)
 			elapsed := time.Since(start)
 			status := 200
-			if e, ok := err.(Err); ok {
-				status = e.Code
+			if err != nil {
+				status = errStatusCode(err)
 			}
 			if l != nil && l.Logger != nil {
 				if status != 200 || (status == 200 && l.Level() >= level) {
@@ -71,9 +71,16 @@ const (
 	LOG_DETAIL
 )
 
+// the subsystem logger with this level will use the parent level
+const LOG_INHERIT int32 = -1
+
 type LevelLogger struct {
 	Logger Logger
 	level  int32
+	// the subsystem logger will use the parent logger sink, and the parent
+	// level if the level is not set for the subsystem
+	parent    *LevelLogger
+	subsystem string
 }
 
 func NewLevelLogger(level int32, l Logger) *LevelLogger {
@@ -83,64 +90,113 @@ func NewLevelLogger(level int32, l Logger) *LevelLogger {
 	}
 }
 
+// Subsystem returns the logger for the subsystem (protocol, diskqueue, ...) which can
+// change the level at runtime without affecting others.
+func (self *LevelLogger) Subsystem(name string) *LevelLogger {
+	l := &LevelLogger{
+		level:     LOG_INHERIT,
+		parent:    self,
+		subsystem: name,
+	}
+	RegisterSubsystem(name, l)
+	return l
+}
+
+func (self *LevelLogger) getLogger() Logger {
+	if self.Logger == nil && self.parent != nil {
+		return self.parent.getLogger()
+	}
+	return self.Logger
+}
+
 func (self *LevelLogger) SetLevel(l int32) {
 	atomic.StoreInt32(&self.level, l)
 }
 
 func (self *LevelLogger) Level() int32 {
-	return atomic.LoadInt32(&self.level)
+	l := atomic.LoadInt32(&self.level)
+	if l == LOG_INHERIT && self.parent != nil {
+		return self.parent.Level()
+	}
+	return l
 }
 
 func (self *LevelLogger) Logf(f string, args ...interface{}) {
-	if self.Logger != nil && self.Level() >= LOG_INFO {
-		self.Logger.Output(2, fmt.Sprintf(f, args...))
+	if l := self.getLogger(); l != nil && self.Level() >= LOG_INFO {
+		l.Output(2, self.format(LOG_INFO, fmt.Sprintf(f, args...), nil))
 	}
 }
 
 func (self *LevelLogger) LogDebugf(f string, args ...interface{}) {
-	if self.Logger != nil && self.Level() >= LOG_DEBUG {
-		self.Logger.Output(2, fmt.Sprintf(f, args...))
+	if l := self.getLogger(); l != nil && self.Level() >= LOG_DEBUG {
+		l.Output(2, self.format(LOG_DEBUG, fmt.Sprintf(f, args...), nil))
 	}
 }
 
 func (self *LevelLogger) LogErrorf(f string, args ...interface{}) {
-	if self.Logger != nil {
-		self.Logger.OutputErr(2, fmt.Sprintf(f, args...))
+	if l := self.getLogger(); l != nil {
+		l.OutputErr(2, self.format(LOG_ERR, fmt.Sprintf(f, args...), nil))
 	}
 }
 
 func (self *LevelLogger) LogWarningf(f string, args ...interface{}) {
-	if self.Logger != nil && self.Level() >= LOG_WARN {
-		self.Logger.OutputWarning(2, fmt.Sprintf(f, args...))
+	if l := self.getLogger(); l != nil && self.Level() >= LOG_WARN {
+		l.OutputWarning(2, self.format(LOG_WARN, fmt.Sprintf(f, args...), nil))
 	}
 }
 
 func (self *LevelLogger) Infof(f string, args ...interface{}) {
-	if self.Logger != nil && self.Level() >= LOG_INFO {
-		self.Logger.Output(2, fmt.Sprintf(f, args...))
+	if l := self.getLogger(); l != nil && self.Level() >= LOG_INFO {
+		l.Output(2, self.format(LOG_INFO, fmt.Sprintf(f, args...), nil))
 	}
 }
 
 func (self *LevelLogger) Debugf(f string, args ...interface{}) {
-	if self.Logger != nil && self.Level() >= LOG_DEBUG {
-		self.Logger.Output(2, fmt.Sprintf(f, args...))
+	if l := self.getLogger(); l != nil && self.Level() >= LOG_DEBUG {
+		l.Output(2, self.format(LOG_DEBUG, fmt.Sprintf(f, args...), nil))
 	}
 }
 
 func (self *LevelLogger) Errorf(f string, args ...interface{}) {
-	if self.Logger != nil {
-		self.Logger.OutputErr(2, fmt.Sprintf(f, args...))
+	if l := self.getLogger(); l != nil {
+		l.OutputErr(2, self.format(LOG_ERR, fmt.Sprintf(f, args...), nil))
 	}
 }
 
 func (self *LevelLogger) Warningf(f string, args ...interface{}) {
-	if self.Logger != nil && self.Level() >= LOG_WARN {
-		self.Logger.OutputWarning(2, fmt.Sprintf(f, args...))
+	if l := self.getLogger(); l != nil && self.Level() >= LOG_WARN {
+		l.OutputWarning(2, self.format(LOG_WARN, fmt.Sprintf(f, args...), nil))
 	}
 }
 
 func (self *LevelLogger) Warningln(f string) {
-	if self.Logger != nil && self.Level() >= LOG_WARN {
-		self.Logger.OutputWarning(2, f)
+	if l := self.getLogger(); l != nil && self.Level() >= LOG_WARN {
+		l.OutputWarning(2, self.format(LOG_WARN, f, nil))
+	}
+}
+
+// InfoKV logs the message with the key value pairs, the output will be
+// "msg key1=value1 key2=value2" in text format or a json object in json format.
+func (self *LevelLogger) InfoKV(msg string, kvs ...interface{}) {
+	if l := self.getLogger(); l != nil && self.Level() >= LOG_INFO {
+		l.Output(2, self.format(LOG_INFO, msg, kvs))
+	}
+}
+
+func (self *LevelLogger) DebugKV(msg string, kvs ...interface{}) {
+	if l := self.getLogger(); l != nil && self.Level() >= LOG_DEBUG {
+		l.Output(2, self.format(LOG_DEBUG, msg, kvs))
+	}
+}
+
+func (self *LevelLogger) WarningKV(msg string, kvs ...interface{}) {
+	if l := self.getLogger(); l != nil && self.Level() >= LOG_WARN {
+		l.OutputWarning(2, self.format(LOG_WARN, msg, kvs))
+	}
+}
+
+func (self *LevelLogger) ErrorKV(msg string, kvs ...interface{}) {
+	if l := self.getLogger(); l != nil {
+		l.OutputErr(2, self.format(LOG_ERR, msg, kvs))
 	}
 }
@@ -0,0 +1,260 @@
+package levellogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var ErrInvalidLogFormat = errors.New("invalid log format")
+var ErrInvalidLogLevel = errors.New("invalid log level")
+var ErrUnknownSubsystem = errors.New("unknown log subsystem")
+
+var jsonFormat int32
+
+// SetLogFormat changes the output format for all the level loggers, the text
+// format is used by default.
+func SetLogFormat(format string) error {
+	switch format {
+	case FormatText, "":
+		atomic.StoreInt32(&jsonFormat, 0)
+	case FormatJSON:
+		atomic.StoreInt32(&jsonFormat, 1)
+	default:
+		return ErrInvalidLogFormat
+	}
+	return nil
+}
+
+func GetLogFormat() string {
+	if atomic.LoadInt32(&jsonFormat) == 1 {
+		return FormatJSON
+	}
+	return FormatText
+}
+
+var levelNames = []string{"error", "warning", "info", "debug", "detail"}
+
+func levelName(l int32) string {
+	if l >= 0 && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return strconv.Itoa(int(l))
+}
+
+func (self *LevelLogger) format(l int32, msg string, kvs []interface{}) string {
+	if atomic.LoadInt32(&jsonFormat) == 1 {
+		return self.formatJSON(l, msg, kvs)
+	}
+	if len(kvs) == 0 {
+		return msg
+	}
+	var buf bytes.Buffer
+	buf.WriteString(msg)
+	if self.subsystem != "" {
+		buf.WriteString(" subsystem=")
+		buf.WriteString(self.subsystem)
+	}
+	for i := 0; i < len(kvs); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(kvKey(kvs, i))
+		buf.WriteByte('=')
+		v := kvValueString(kvs, i)
+		if v == "" || strings.ContainsAny(v, " =\"\t\n") {
+			v = strconv.Quote(v)
+		}
+		buf.WriteString(v)
+	}
+	return buf.String()
+}
+
+func (self *LevelLogger) formatJSON(l int32, msg string, kvs []interface{}) string {
+	var buf bytes.Buffer
+	buf.WriteString(`{"ts":`)
+	writeJSONValue(&buf, time.Now().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(&buf, levelName(l))
+	if self.subsystem != "" {
+		buf.WriteString(`,"subsystem":`)
+		writeJSONValue(&buf, self.subsystem)
+	}
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(&buf, msg)
+	for i := 0; i < len(kvs); i += 2 {
+		buf.WriteByte(',')
+		writeJSONValue(&buf, kvKey(kvs, i))
+		buf.WriteByte(':')
+		if i+1 >= len(kvs) {
+			buf.WriteString("null")
+			continue
+		}
+		switch v := kvs[i+1].(type) {
+		case error:
+			writeJSONValue(&buf, v.Error())
+		case fmt.Stringer:
+			writeJSONValue(&buf, v.String())
+		default:
+			writeJSONValue(&buf, v)
+		}
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+func kvKey(kvs []interface{}, i int) string {
+	if k, ok := kvs[i].(string); ok {
+		return k
+	}
+	return fmt.Sprint(kvs[i])
+}
+
+func kvValueString(kvs []interface{}, i int) string {
+	if i+1 >= len(kvs) {
+		return ""
+	}
+	if kvs[i+1] == nil {
+		return "<nil>"
+	}
+	return fmt.Sprint(kvs[i+1])
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		d, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(d)
+}
+
+var subsystemLock sync.Mutex
+var subsystems = make(map[string]*LevelLogger)
+
+// RegisterSubsystem makes the level of the logger changeable by the subsystem name
+func RegisterSubsystem(name string, l *LevelLogger) {
+	subsystemLock.Lock()
+	subsystems[name] = l
+	subsystemLock.Unlock()
+}
+
+// SetSubsystemLevel changes the level of the subsystem logger, the LOG_INHERIT
+// level will reset the subsystem to use the parent level.
+func SetSubsystemLevel(name string, level int32) error {
+	subsystemLock.Lock()
+	l, ok := subsystems[name]
+	subsystemLock.Unlock()
+	if !ok {
+		return ErrUnknownSubsystem
+	}
+	if level < LOG_INHERIT || (level == LOG_INHERIT && l.parent == nil) {
+		return ErrInvalidLogLevel
+	}
+	l.SetLevel(level)
+	return nil
+}
+
+// GetSubsystemLevels returns the current level of all the registered subsystems
+func GetSubsystemLevels() map[string]int32 {
+	subsystemLock.Lock()
+	defer subsystemLock.Unlock()
+	ret := make(map[string]int32, len(subsystems))
+	for name, l := range subsystems {
+		ret[name] = l.Level()
+	}
+	return ret
+}
+
+// WriterLogger writes each log as a line to the writer without any prefix, used
+// as the sink for the log pipeline which parses the json output from stdout.
+type WriterLogger struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func NewWriterLogger(w io.Writer) *WriterLogger {
+	return &WriterLogger{w: w}
+}
+
+func (self *WriterLogger) write(s string) error {
+	self.Lock()
+	defer self.Unlock()
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	_, err := io.WriteString(self.w, s)
+	return err
+}
+
+func (self *WriterLogger) Output(maxdepth int, s string) error {
+	return self.write(s)
+}
+
+func (self *WriterLogger) OutputErr(maxdepth int, s string) error {
+	return self.write(s)
+}
+
+func (self *WriterLogger) OutputWarning(maxdepth int, s string) error {
+	return self.write(s)
+}
+
+// MultiLogger writes the log to all the sinks
+type MultiLogger []Logger
+
+func (self MultiLogger) Output(maxdepth int, s string) error {
+	for _, l := range self {
+		l.Output(maxdepth+1, s)
+	}
+	return nil
+}
+
+func (self MultiLogger) OutputErr(maxdepth int, s string) error {
+	for _, l := range self {
+		l.OutputErr(maxdepth+1, s)
+	}
+	return nil
+}
+
+func (self MultiLogger) OutputWarning(maxdepth int, s string) error {
+	for _, l := range self {
+		l.OutputWarning(maxdepth+1, s)
+	}
+	return nil
+}
+
+// NewSinkLogger creates the logger from the comma separated sink names,
+// supported sinks: glog, stdout, stderr.
+func NewSinkLogger(sinks string) (Logger, error) {
+	var ret MultiLogger
+	for _, name := range strings.Split(sinks, ",") {
+		switch strings.TrimSpace(name) {
+		case "glog":
+			ret = append(ret, &GLogger{})
+		case "stdout":
+			ret = append(ret, NewWriterLogger(os.Stdout))
+		case "stderr":
+			ret = append(ret, NewWriterLogger(os.Stderr))
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown log sink: %v", name)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no log sink in %v", sinks)
+	}
+	if len(ret) == 1 {
+		return ret[0], nil
+	}
+	return ret, nil
+}
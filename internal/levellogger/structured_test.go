@@ -0,0 +1,72 @@
+package levellogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStructuredLog(t *testing.T) {
+	var buf bytes.Buffer
+	root := NewLevelLogger(LOG_INFO, NewWriterLogger(&buf))
+	sub := root.Subsystem("test_sub")
+	defer SetLogFormat(FormatText)
+
+	sub.InfoKV("client closed", "client", "127.0.0.1:1234", "reason", "client close", "error", errors.New("eof"))
+	line := strings.TrimSpace(buf.String())
+	if line != `client closed subsystem=test_sub client=127.0.0.1:1234 reason="client close" error=eof` {
+		t.Fatalf("unexpected text log: %v", line)
+	}
+
+	buf.Reset()
+	if err := SetLogFormat(FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	sub.WarningKV("stats evicted", "clients", 10)
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("invalid json log %v: %v", buf.String(), err)
+	}
+	if m["level"] != "warning" || m["subsystem"] != "test_sub" || m["msg"] != "stats evicted" || m["clients"] != float64(10) {
+		t.Fatalf("unexpected json log: %v", m)
+	}
+	if SetLogFormat("xml") != ErrInvalidLogFormat {
+		t.Fatal("xml format should be invalid")
+	}
+}
+
+func TestSubsystemLevel(t *testing.T) {
+	var buf bytes.Buffer
+	root := NewLevelLogger(LOG_INFO, NewWriterLogger(&buf))
+	sub := root.Subsystem("test_level")
+
+	sub.DebugKV("debug")
+	if buf.Len() != 0 {
+		t.Fatalf("debug log should be ignored: %v", buf.String())
+	}
+	if err := SetSubsystemLevel("test_level", LOG_DEBUG); err != nil {
+		t.Fatal(err)
+	}
+	if GetSubsystemLevels()["test_level"] != LOG_DEBUG {
+		t.Fatal("subsystem level not changed")
+	}
+	sub.DebugKV("debug")
+	root.LogDebugf("root debug")
+	if strings.TrimSpace(buf.String()) != "debug" {
+		t.Fatalf("only the subsystem debug log should be written: %v", buf.String())
+	}
+
+	// reset to the parent level
+	if err := SetSubsystemLevel("test_level", LOG_INHERIT); err != nil {
+		t.Fatal(err)
+	}
+	root.SetLevel(LOG_WARN)
+	if sub.Level() != LOG_WARN {
+		t.Fatalf("subsystem level should follow the parent: %v", sub.Level())
+	}
+	if SetSubsystemLevel("not_exist", LOG_DEBUG) != ErrUnknownSubsystem {
+		t.Fatal("unknown subsystem should fail")
+	}
+}
@@ -0,0 +1,261 @@
+package otlptrace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+	SpanKindProducer = 4
+	SpanKindConsumer = 5
+
+	statusCodeError = 2
+
+	defaultQueueSize     = 10000
+	defaultBatchSize     = 512
+	defaultFlushInterval = 5 * time.Second
+)
+
+type Span struct {
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	Name         string
+	Kind         int
+	Start        time.Time
+	End          time.Time
+	// only string and int64 values are supported
+	Attributes map[string]interface{}
+	Err        string
+}
+
+type ExporterStats struct {
+	Exported int64 `json:"exported"`
+	Dropped  int64 `json:"dropped"`
+	Failed   int64 `json:"failed"`
+}
+
+// Exporter sends the spans in batches to the collector using the OTLP/HTTP json encoding,
+// the spans will be dropped if the queue is full so the caller will never be blocked.
+type Exporter struct {
+	exported int64
+	dropped  int64
+	failed   int64
+
+	url         string
+	serviceName string
+	client      *http.Client
+	spanChan    chan *Span
+	onError     func(error)
+	exitChan    chan struct{}
+	wg          sync.WaitGroup
+}
+
+// NewExporter creates the exporter for the collector endpoint (http://host:4318),
+// the spans will be posted to the /v1/traces path.
+func NewExporter(endpoint string, serviceName string, onError func(error)) *Exporter {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "http://" + endpoint
+	}
+	return &Exporter{
+		url:         endpoint + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spanChan:    make(chan *Span, defaultQueueSize),
+		onError:     onError,
+		exitChan:    make(chan struct{}),
+	}
+}
+
+func (e *Exporter) Start() {
+	e.wg.Add(1)
+	go e.loop()
+}
+
+// Stop flushes the spans in queue and waits the exporter exit
+func (e *Exporter) Stop() {
+	close(e.exitChan)
+	e.wg.Wait()
+}
+
+func (e *Exporter) Export(s *Span) {
+	select {
+	case e.spanChan <- s:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+func (e *Exporter) Stats() ExporterStats {
+	return ExporterStats{
+		Exported: atomic.LoadInt64(&e.exported),
+		Dropped:  atomic.LoadInt64(&e.dropped),
+		Failed:   atomic.LoadInt64(&e.failed),
+	}
+}
+
+func (e *Exporter) loop() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(defaultFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, defaultBatchSize)
+	for {
+		select {
+		case s := <-e.spanChan:
+			batch = append(batch, s)
+			if len(batch) >= defaultBatchSize {
+				e.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.flush(batch)
+			batch = batch[:0]
+		case <-e.exitChan:
+			for {
+				select {
+				case s := <-e.spanChan:
+					batch = append(batch, s)
+				default:
+					e.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *Exporter) flush(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	data, err := json.Marshal(e.encode(batch))
+	if err == nil {
+		err = e.post(data)
+	}
+	if err != nil {
+		atomic.AddInt64(&e.failed, int64(len(batch)))
+		if e.onError != nil {
+			e.onError(err)
+		}
+		return
+	}
+	atomic.AddInt64(&e.exported, int64(len(batch)))
+}
+
+func (e *Exporter) post(data []byte) error {
+	rsp, err := e.client.Post(e.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("export spans to %v failed: %v", e.url, rsp.Status)
+	}
+	return nil
+}
+
+// the json mapping of the OTLP trace request
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func newKeyValue(k string, v interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: k}
+	switch t := v.(type) {
+	case int64:
+		s := strconv.FormatInt(t, 10)
+		kv.Value.IntValue = &s
+	case int:
+		s := strconv.Itoa(t)
+		kv.Value.IntValue = &s
+	case string:
+		kv.Value.StringValue = &t
+	default:
+		s := fmt.Sprint(t)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func (e *Exporter) encode(batch []*Span) *otlpTraceRequest {
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpKeyValue{newKeyValue("service.name", e.serviceName)}
+	var ss otlpScopeSpans
+	ss.Scope.Name = e.serviceName
+	ss.Spans = make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		sp := otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.ParentSpanID.IsValid() {
+			sp.ParentSpanID = s.ParentSpanID.String()
+		}
+		for k, v := range s.Attributes {
+			sp.Attributes = append(sp.Attributes, newKeyValue(k, v))
+		}
+		if s.Err != "" {
+			sp.Status.Code = statusCodeError
+			sp.Status.Message = s.Err
+		}
+		ss.Spans = append(ss.Spans, sp)
+	}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return &otlpTraceRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
@@ -0,0 +1,91 @@
+package otlptrace
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	s := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tp, err := ParseTraceParent(s)
+	test.Nil(t, err)
+	test.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", tp.TraceID.String())
+	test.Equal(t, "00f067aa0ba902b7", tp.ParentID.String())
+	test.Equal(t, true, tp.IsSampled())
+	test.Equal(t, s, tp.String())
+
+	tp, err = ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	test.Nil(t, err)
+	test.Equal(t, false, tp.IsSampled())
+
+	invalids := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, s := range invalids {
+		_, err = ParseTraceParent(s)
+		test.Equal(t, ErrInvalidTraceParent, err)
+	}
+	// the future version may have more fields
+	_, err = ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	test.Nil(t, err)
+}
+
+func TestExporter(t *testing.T) {
+	var lock sync.Mutex
+	var received []otlpTraceRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		test.Equal(t, "/v1/traces", req.URL.Path)
+		body, _ := ioutil.ReadAll(req.Body)
+		var r otlpTraceRequest
+		test.Nil(t, json.Unmarshal(body, &r))
+		lock.Lock()
+		received = append(received, r)
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	tp, _ := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	e := NewExporter(srv.URL, "nsqd-test", nil)
+	e.Start()
+	now := time.Now()
+	e.Export(&Span{
+		TraceID:      tp.TraceID,
+		SpanID:       NewSpanID(),
+		ParentSpanID: tp.ParentID,
+		Name:         "test publish",
+		Kind:         SpanKindServer,
+		Start:        now.Add(-time.Second),
+		End:          now,
+		Attributes:   map[string]interface{}{"messaging.nsq.offset": int64(10)},
+		Err:          "failed",
+	})
+	e.Stop()
+
+	test.Equal(t, int64(1), e.Stats().Exported)
+	lock.Lock()
+	defer lock.Unlock()
+	test.Equal(t, 1, len(received))
+	rs := received[0].ResourceSpans[0]
+	test.Equal(t, "service.name", rs.Resource.Attributes[0].Key)
+	test.Equal(t, "nsqd-test", *rs.Resource.Attributes[0].Value.StringValue)
+	sp := rs.ScopeSpans[0].Spans[0]
+	test.Equal(t, tp.TraceID.String(), sp.TraceID)
+	test.Equal(t, tp.ParentID.String(), sp.ParentSpanID)
+	test.Equal(t, "test publish", sp.Name)
+	test.Equal(t, SpanKindServer, sp.Kind)
+	test.Equal(t, "10", *sp.Attributes[0].Value.IntValue)
+	test.Equal(t, statusCodeError, sp.Status.Code)
+}
@@ -0,0 +1,94 @@
+package otlptrace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// the header key used to carry the W3C trace context in the message json header ext
+const TraceParentKey = "traceparent"
+
+var ErrInvalidTraceParent = errors.New("invalid traceparent")
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+func NewSpanID() SpanID {
+	var s SpanID
+	for !s.IsValid() {
+		rand.Read(s[:])
+	}
+	return s
+}
+
+// TraceParent is the W3C trace context in the format: version-traceid-parentid-flags
+type TraceParent struct {
+	TraceID  TraceID
+	ParentID SpanID
+	Flags    byte
+}
+
+func decodeHex(dst []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return ErrInvalidTraceParent
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	if err != nil {
+		return ErrInvalidTraceParent
+	}
+	return nil
+}
+
+func ParseTraceParent(s string) (TraceParent, error) {
+	var tp TraceParent
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 {
+		return tp, ErrInvalidTraceParent
+	}
+	var ver [1]byte
+	if err := decodeHex(ver[:], parts[0]); err != nil || ver[0] == 0xff {
+		return tp, ErrInvalidTraceParent
+	}
+	// the version 00 has exactly 4 parts, the future versions may append more
+	if ver[0] == 0 && len(parts) != 4 {
+		return tp, ErrInvalidTraceParent
+	}
+	if err := decodeHex(tp.TraceID[:], parts[1]); err != nil || !tp.TraceID.IsValid() {
+		return tp, ErrInvalidTraceParent
+	}
+	if err := decodeHex(tp.ParentID[:], parts[2]); err != nil || !tp.ParentID.IsValid() {
+		return tp, ErrInvalidTraceParent
+	}
+	var flags [1]byte
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return tp, ErrInvalidTraceParent
+	}
+	tp.Flags = flags[0]
+	return tp, nil
+}
+
+func (tp TraceParent) IsSampled() bool {
+	return tp.Flags&0x01 == 0x01
+}
+
+func (tp TraceParent) String() string {
+	return "00-" + tp.TraceID.String() + "-" + tp.ParentID.String() + "-" + hex.EncodeToString([]byte{tp.Flags})
+}
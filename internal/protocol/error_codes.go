@@ -0,0 +1,244 @@
+package protocol
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The category of the error code, so the client library can decide how to handle
+// the error without parsing the error text.
+const (
+	// the request is invalid, retry the same request will fail again
+	ErrCategoryInvalid = "invalid"
+	// the client is not authorized, retry after the auth changed
+	ErrCategoryAuth = "auth"
+	// the topic or channel is not found on this node, retry after the lookup refreshed
+	ErrCategoryNotFound = "not_found"
+	// the node is not the leader of the topic partition, retry after the lookup refreshed
+	ErrCategoryNotLeader = "not_leader"
+	// the request is rejected by the limit or the quota, retry later with backoff
+	ErrCategoryThrottled = "throttled"
+	// the node can not serve the request currently, retry on the other node
+	ErrCategoryUnavailable = "unavailable"
+	// the server failed to handle the request, retry is safe
+	ErrCategoryServer  = "server"
+	ErrCategoryUnknown = "unknown"
+)
+
+// ErrorCode describes the error code returned by the tcp protocol or the http api
+type ErrorCode struct {
+	Code        string `json:"code"`
+	Category    string `json:"category"`
+	Retryable   bool   `json:"retryable"`
+	Description string `json:"description"`
+}
+
+// StructuredErr is the error returned to the client which asked for the structured
+// error, the message is the same as the text error without the code.
+type StructuredErr struct {
+	Code      string            `json:"code"`
+	Category  string            `json:"category"`
+	Retryable bool              `json:"retryable"`
+	Message   string            `json:"message"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+func (e *StructuredErr) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + " " + e.Message
+}
+
+func (e *StructuredErr) JSON() []byte {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return []byte(e.Error())
+	}
+	return data
+}
+
+var (
+	errorCodesLock sync.RWMutex
+	errorCodes     = make(map[string]ErrorCode)
+)
+
+// RegisterErrorCode adds the error code to the registry, the code registered
+// already is replaced.
+func RegisterErrorCode(code string, category string, retryable bool, desc string) {
+	errorCodesLock.Lock()
+	errorCodes[code] = ErrorCode{
+		Code:        code,
+		Category:    category,
+		Retryable:   retryable,
+		Description: desc,
+	}
+	errorCodesLock.Unlock()
+}
+
+// GetErrorCode returns the registered error code, the unregistered code is
+// guessed by the naming convention of the code.
+func GetErrorCode(code string) (ErrorCode, bool) {
+	errorCodesLock.RLock()
+	ec, ok := errorCodes[code]
+	errorCodesLock.RUnlock()
+	if ok {
+		return ec, true
+	}
+	ec = ErrorCode{Code: code, Category: ErrCategoryUnknown}
+	switch {
+	case strings.HasPrefix(code, "MISSING_ARG_"), strings.HasPrefix(code, "INVALID_"),
+		strings.HasPrefix(code, "E_BAD_"), strings.HasPrefix(code, "E_INVALID"):
+		ec.Category = ErrCategoryInvalid
+	case strings.HasSuffix(code, "_NOT_FOUND"), strings.HasSuffix(code, "_NOT_EXIST"):
+		ec.Category = ErrCategoryNotFound
+		ec.Retryable = true
+	}
+	return ec, false
+}
+
+type errorCodeList []ErrorCode
+
+func (l errorCodeList) Len() int           { return len(l) }
+func (l errorCodeList) Less(i, j int) bool { return l[i].Code < l[j].Code }
+func (l errorCodeList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// ErrorCodes returns all the registered error codes sorted by the code
+func ErrorCodes() []ErrorCode {
+	errorCodesLock.RLock()
+	codes := make([]ErrorCode, 0, len(errorCodes))
+	for _, ec := range errorCodes {
+		codes = append(codes, ec)
+	}
+	errorCodesLock.RUnlock()
+	sort.Sort(errorCodeList(codes))
+	return codes
+}
+
+func isErrorCode(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseErrorCode splits the text error such as "E_INVALID xxx" or
+// "INVALID_ARG_TOPIC: xxx" into the code and the message, the code is empty if
+// the text is not started with the code.
+func ParseErrorCode(text string) (string, string) {
+	i := strings.IndexAny(text, " :")
+	code := text
+	if i >= 0 {
+		code = text[:i]
+	}
+	if !isErrorCode(code) {
+		return "", text
+	}
+	if i < 0 {
+		return code, ""
+	}
+	return code, strings.TrimLeft(text[i:], " :")
+}
+
+// NewStructuredErr creates the structured error from the code, the category and
+// the retryable are from the registry.
+func NewStructuredErr(code string, message string, details map[string]string) *StructuredErr {
+	ec, _ := GetErrorCode(code)
+	return &StructuredErr{
+		Code:      code,
+		Category:  ec.Category,
+		Retryable: ec.Retryable,
+		Message:   message,
+		Details:   details,
+	}
+}
+
+// ToStructuredErr converts the error returned by the protocol handler, the code
+// of the text error is parsed from the text.
+func ToStructuredErr(err error) *StructuredErr {
+	switch e := err.(type) {
+	case *StructuredErr:
+		return e
+	case *ClientErr:
+		return NewStructuredErr(e.Code, e.Desc, e.Details)
+	case *FatalClientErr:
+		return NewStructuredErr(e.Code, e.Desc, e.Details)
+	}
+	code, msg := ParseErrorCode(err.Error())
+	if code == "" {
+		return &StructuredErr{Category: ErrCategoryUnknown, Message: msg}
+	}
+	return NewStructuredErr(code, msg, nil)
+}
+
+func init() {
+	for _, ec := range []ErrorCode{
+		// the tcp protocol
+		{"E_INVALID", ErrCategoryInvalid, false, "the command or the parameters are invalid"},
+		{"E_BAD_PROTOCOL", ErrCategoryInvalid, false, "the protocol magic is not supported"},
+		{"E_BAD_BODY", ErrCategoryInvalid, false, "the command body is invalid or too big"},
+		{"E_BAD_MESSAGE", ErrCategoryInvalid, false, "the message body is invalid or too big"},
+		{"E_BAD_TOPIC", ErrCategoryInvalid, false, "the topic name is invalid"},
+		{"E_BAD_CHANNEL", ErrCategoryInvalid, false, "the channel name is invalid"},
+		{"E_BAD_PARTITION", ErrCategoryInvalid, false, "the topic partition is invalid"},
+		{"E_BAD_PARTITIONID", ErrCategoryInvalid, false, "the topic partition is invalid"},
+		{"E_BAD_TAG", ErrCategoryInvalid, false, "the desired tag is invalid"},
+		{"E_BAD_EXT", ErrCategoryInvalid, false, "the message extend data is invalid"},
+		{"E_INVALID_JSON_HEADER", ErrCategoryInvalid, false, "the json header of the message extend is invalid"},
+		{"E_EXT_NOT_SUPPORT", ErrCategoryInvalid, false, "the message extend is not supported by the topic"},
+		{"E_IDENTIFY_FAILED", ErrCategoryInvalid, false, "the identify is invalid"},
+		{"E_SUB_ORDER_IS_MUST", ErrCategoryInvalid, false, "the ordered topic must be consumed in order"},
+		{"E_SUB_EXTEND_NEED", ErrCategoryInvalid, false, "the extend topic must be consumed by the client with extend support"},
+		{"E_SUB_EXTEND_FORBIDDON", ErrCategoryInvalid, false, "the non-extend topic can not be consumed with extend support"},
+		{"E_TOO_MANY_REPLY_CHANNELS", ErrCategoryInvalid, false, "too many channels subscribed by the connection"},
+		{"E_FIN_FAILED", ErrCategoryInvalid, false, "the message is not in flight, it may be timed out and delivered again"},
+		{"E_REQ_FAILED", ErrCategoryInvalid, false, "the message is not in flight, it may be timed out and delivered again"},
+		{"E_TOUCH_FAILED", ErrCategoryInvalid, false, "the message is not in flight, it may be timed out and delivered again"},
+		{"E_DUP_MSG", ErrCategoryInvalid, false, "the message is rejected as duplicated"},
+		{"E_AUTH_FIRST", ErrCategoryAuth, false, "the auth is required before the command"},
+		{"E_AUTH_DISABLED", ErrCategoryInvalid, false, "the auth is not enabled on the server"},
+		{"E_AUTH_FAILED", ErrCategoryAuth, false, "the auth secret is rejected"},
+		{"E_UNAUTHORIZED", ErrCategoryAuth, false, "the client is not authorized for the command"},
+		{"E_AUTH_ERROR", ErrCategoryServer, true, "the auth server failed"},
+		{"E_TOPIC_NOT_EXIST", ErrCategoryNotFound, true, "the topic partition is not found on the node"},
+		{"E_CHANNEL_NOT_EXIST", ErrCategoryNotFound, true, "the channel is not found on the node"},
+		{"E_FAILED_ON_NOT_LEADER", ErrCategoryNotLeader, true, "the node is not the leader of the topic partition"},
+		{"E_FAILED_ON_NOT_WRITABLE", ErrCategoryUnavailable, true, "the topic partition is not writable currently"},
+		{"E_READ_ONLY", ErrCategoryUnavailable, true, "the node is read only"},
+		{"E_DRAINING", ErrCategoryUnavailable, true, "the node is draining and not accepting new connections or publishes"},
+		{"E_NOT_READY", ErrCategoryUnavailable, true, "the node is not ready"},
+		{"E_NAMESPACE_QUOTA", ErrCategoryThrottled, true, "the namespace quota is exceeded"},
+		{"E_PUB_BACKPRESSURE", ErrCategoryThrottled, true, "the topic backlog exceeded the high watermark, retry after the duration in the details"},
+		{"E_TOO_MANY_CONNS", ErrCategoryThrottled, true, "too many connections from the remote ip or of the identity"},
+		{"E_TOO_MANY_PUBLISHERS", ErrCategoryThrottled, true, "too many connections publishing to the topic partition"},
+		{"E_CREATE_TOPIC_FAILED", ErrCategoryServer, true, "failed to create the topic"},
+		{"E_PUB_FAILED", ErrCategoryServer, true, "failed to publish the message"},
+		{"E_MPUB_FAILED", ErrCategoryServer, true, "failed to publish the messages"},
+		// the http api
+		{"NOT_FOUND", ErrCategoryInvalid, false, "the api is not found"},
+		{"METHOD_NOT_ALLOWED", ErrCategoryInvalid, false, "the api method is not allowed"},
+		{"TOPIC_NOT_FOUND", ErrCategoryNotFound, true, "the topic is not found on the node"},
+		{"CHANNEL_NOT_FOUND", ErrCategoryNotFound, true, "the channel is not found on the node"},
+		{"ACL_DENIED", ErrCategoryAuth, false, "the request is denied by the acl"},
+		{"MTLS_REQUIRED", ErrCategoryAuth, false, "the client certificate is required"},
+		{"MSG_EMPTY", ErrCategoryInvalid, false, "the message body is empty"},
+		{"MSG_TOO_BIG", ErrCategoryInvalid, false, "the message body is too big"},
+		{"BODY_TOO_BIG", ErrCategoryInvalid, false, "the request body is too big"},
+		{"BAD_BODY", ErrCategoryInvalid, false, "the request body is invalid"},
+		{"NAMESPACE_QUOTA_EXCEEDED", ErrCategoryThrottled, true, "the namespace quota is exceeded"},
+		{"PUB_BACKPRESSURE", ErrCategoryThrottled, true, "the topic backlog exceeded the high watermark, retry after the Retry-After header"},
+		{"MISSING_COORDINATOR", ErrCategoryInvalid, false, "the api is only supported in the cluster mode"},
+		{"MISSING_LOOKUP_LEADER", ErrCategoryUnavailable, true, "the lookup leader is not found"},
+		{"SELFTEST_FAILED", ErrCategoryServer, true, "the node self test failed"},
+		{"INTERNAL_ERROR", ErrCategoryServer, true, "the server failed to handle the request"},
+	} {
+		RegisterErrorCode(ec.Code, ec.Category, ec.Retryable, ec.Description)
+	}
+}
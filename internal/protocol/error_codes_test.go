@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseErrorCode(t *testing.T) {
+	cases := []struct {
+		text string
+		code string
+		msg  string
+	}{
+		{"E_INVALID invalid command", "E_INVALID", "invalid command"},
+		{"E_TOPIC_NOT_EXIST ", "E_TOPIC_NOT_EXIST", ""},
+		{"MSG_EMPTY", "MSG_EMPTY", ""},
+		{"INVALID_ARG_TOPIC: bad name", "INVALID_ARG_TOPIC", "bad name"},
+		{"failed to write", "", "failed to write"},
+		{"", "", ""},
+	}
+	for _, c := range cases {
+		code, msg := ParseErrorCode(c.text)
+		if code != c.code || msg != c.msg {
+			t.Errorf("parse %q got %q %q, expected %q %q", c.text, code, msg, c.code, c.msg)
+		}
+	}
+}
+
+func TestStructuredErr(t *testing.T) {
+	err := NewFatalClientErr(nil, "E_FAILED_ON_NOT_LEADER", "").WithDetails(map[string]string{"topic": "test"})
+	se := ToStructuredErr(err)
+	if se.Category != ErrCategoryNotLeader || !se.Retryable || se.Details["topic"] != "test" {
+		t.Errorf("unexpected structured error: %+v", se)
+	}
+	var decoded StructuredErr
+	if err := json.Unmarshal(se.JSON(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Code != se.Code || decoded.Details["topic"] != "test" {
+		t.Errorf("unexpected decoded error: %+v", decoded)
+	}
+
+	se = ToStructuredErr(NewClientErr(nil, "E_INVALID", "bad command"))
+	if se.Category != ErrCategoryInvalid || se.Retryable || se.Message != "bad command" {
+		t.Errorf("unexpected structured error: %+v", se)
+	}
+	// the unregistered code is guessed by the name
+	se = ToStructuredErr(errors.New("MISSING_ARG_NEW"))
+	if se.Code != "MISSING_ARG_NEW" || se.Category != ErrCategoryInvalid {
+		t.Errorf("unexpected structured error: %+v", se)
+	}
+	se = ToStructuredErr(errors.New("some error"))
+	if se.Code != "" || se.Category != ErrCategoryUnknown || se.Message != "some error" {
+		t.Errorf("unexpected structured error: %+v", se)
+	}
+
+	codes := ErrorCodes()
+	for i := 1; i < len(codes); i++ {
+		if codes[i-1].Code >= codes[i].Code {
+			t.Errorf("error codes not sorted: %v, %v", codes[i-1].Code, codes[i].Code)
+		}
+	}
+}
@@ -12,6 +12,8 @@ type ClientErr struct {
 	ParentErr error
 	Code      string
 	Desc      string
+	// the details returned to the client asked for the structured error
+	Details map[string]string
 }
 
 // Error returns the machine readable form
@@ -26,13 +28,20 @@ func (e *ClientErr) Parent() error {
 
 // NewClientErr creates a ClientErr with the supplied human and machine readable strings
 func NewClientErr(parent error, code string, description string) *ClientErr {
-	return &ClientErr{parent, code, description}
+	return &ClientErr{ParentErr: parent, Code: code, Desc: description}
+}
+
+// WithDetails adds the details for the structured error
+func (e *ClientErr) WithDetails(details map[string]string) *ClientErr {
+	e.Details = details
+	return e
 }
 
 type FatalClientErr struct {
 	ParentErr error
 	Code      string
 	Desc      string
+	Details   map[string]string
 }
 
 // Error returns the machine readable form
@@ -47,5 +56,11 @@ func (e *FatalClientErr) Parent() error {
 
 // NewClientErr creates a ClientErr with the supplied human and machine readable strings
 func NewFatalClientErr(parent error, code string, description string) *FatalClientErr {
-	return &FatalClientErr{parent, code, description}
+	return &FatalClientErr{ParentErr: parent, Code: code, Desc: description}
+}
+
+// WithDetails adds the details for the structured error
+func (e *FatalClientErr) WithDetails(details map[string]string) *FatalClientErr {
+	e.Details = details
+	return e
 }
@@ -24,6 +24,14 @@ func isValidName(name string) bool {
 	return validTopicChannelNameRegex.MatchString(name)
 }
 
+// ReplyChannelPrefix is reserved for the reply channels created by the client
+// for request/reply, the channel with this prefix can not be created by SUB.
+const ReplyChannelPrefix = "_reply."
+
+func IsReplyChannel(name string) bool {
+	return strings.HasPrefix(name, ReplyChannelPrefix) && IsEphemeral(name)
+}
+
 func IsEphemeral(name string) bool {
 	if strings.HasSuffix(name, "#ephemeral") {
 		return true
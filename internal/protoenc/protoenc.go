@@ -0,0 +1,383 @@
+// Package protoenc encodes the go structs to the protobuf (proto3) wire format by
+// the field number in the pb tag, such as `pb:"1"`, and generates the proto3 schema
+// from the same tags, so the stats structs can be encoded without the generated code.
+// The fields without the pb tag are ignored.
+package protoenc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type fieldPlan struct {
+	index    int
+	num      int
+	name     string
+	typ      reflect.Type
+	repeated bool
+	isMap    bool
+}
+
+type structPlan struct {
+	name   string
+	fields []fieldPlan
+}
+
+var (
+	plansLock sync.RWMutex
+	plans     = make(map[reflect.Type]*structPlan)
+)
+
+func fieldName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		name = strings.ToLower(f.Name)
+	}
+	return name
+}
+
+func isScalar(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.String:
+		return true
+	}
+	return false
+}
+
+func isPackable(k reflect.Kind) bool {
+	return isScalar(k) && k != reflect.String
+}
+
+// messageType returns the struct type of the message field, nil if not message
+func messageType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Struct {
+		return t
+	}
+	return nil
+}
+
+func getPlan(t reflect.Type) (*structPlan, error) {
+	plansLock.RLock()
+	p, ok := plans[t]
+	plansLock.RUnlock()
+	if ok {
+		return p, nil
+	}
+	p = &structPlan{name: t.Name()}
+	nums := make(map[int]bool)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("pb")
+		if tag == "" {
+			continue
+		}
+		num, err := strconv.Atoi(tag)
+		if err != nil || num <= 0 || nums[num] {
+			return nil, fmt.Errorf("invalid pb tag %q of %v.%v", tag, t.Name(), f.Name)
+		}
+		nums[num] = true
+		fp := fieldPlan{index: i, num: num, name: fieldName(f), typ: f.Type}
+		switch {
+		case isScalar(f.Type.Kind()) || messageType(f.Type) != nil:
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Uint8:
+		case f.Type.Kind() == reflect.Slice &&
+			(isScalar(f.Type.Elem().Kind()) || messageType(f.Type.Elem()) != nil):
+			fp.repeated = true
+		case f.Type.Kind() == reflect.Map && f.Type.Key().Kind() == reflect.String &&
+			isScalar(f.Type.Elem().Kind()):
+			fp.isMap = true
+		default:
+			return nil, fmt.Errorf("unsupported type %v of %v.%v", f.Type, t.Name(), f.Name)
+		}
+		p.fields = append(p.fields, fp)
+	}
+	plansLock.Lock()
+	plans[t] = p
+	plansLock.Unlock()
+	return p, nil
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func appendTag(buf []byte, num int, wireType int) []byte {
+	return appendVarint(buf, uint64(num)<<3|uint64(wireType))
+}
+
+func wireType(k reflect.Kind) int {
+	switch k {
+	case reflect.Float64:
+		return wireFixed64
+	case reflect.Float32:
+		return wireFixed32
+	case reflect.String:
+		return wireBytes
+	}
+	return wireVarint
+}
+
+// appendScalarValue appends the value without the tag
+func appendScalarValue(buf []byte, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 1)
+		}
+		return append(buf, 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendVarint(buf, uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return appendVarint(buf, v.Uint())
+	case reflect.Float64:
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v.Float()))
+		return append(buf, b[:]...)
+	case reflect.Float32:
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(v.Float())))
+		return append(buf, b[:]...)
+	case reflect.String:
+		buf = appendVarint(buf, uint64(v.Len()))
+		return append(buf, v.String()...)
+	}
+	return buf
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// appendLengthPrefixed encodes by the fn after the start, and inserts the length
+// before the encoded data.
+func appendLengthPrefixed(buf []byte, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	start := len(buf)
+	buf, err := fn(buf)
+	if err != nil {
+		return buf, err
+	}
+	size := len(buf) - start
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := len(appendVarint(lenBuf[:0], uint64(size)))
+	buf = append(buf, lenBuf[:n]...)
+	copy(buf[start+n:], buf[start:start+size])
+	copy(buf[start:], lenBuf[:n])
+	return buf, nil
+}
+
+func appendMessage(buf []byte, num int, v reflect.Value) ([]byte, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return buf, nil
+		}
+		v = v.Elem()
+	}
+	buf = appendTag(buf, num, wireBytes)
+	return appendLengthPrefixed(buf, func(b []byte) ([]byte, error) {
+		return appendStruct(b, v)
+	})
+}
+
+func appendField(buf []byte, fp *fieldPlan, v reflect.Value) ([]byte, error) {
+	var err error
+	switch {
+	case fp.isMap:
+		keys := v.MapKeys()
+		sort.Sort(stringValues(keys))
+		for _, k := range keys {
+			buf = appendTag(buf, fp.num, wireBytes)
+			mv := v.MapIndex(k)
+			buf, _ = appendLengthPrefixed(buf, func(b []byte) ([]byte, error) {
+				b = appendTag(b, 1, wireBytes)
+				b = appendScalarValue(b, k)
+				if !isZero(mv) {
+					b = appendTag(b, 2, wireType(mv.Kind()))
+					b = appendScalarValue(b, mv)
+				}
+				return b, nil
+			})
+		}
+	case fp.repeated && isPackable(fp.typ.Elem().Kind()):
+		buf = appendTag(buf, fp.num, wireBytes)
+		buf, _ = appendLengthPrefixed(buf, func(b []byte) ([]byte, error) {
+			for i := 0; i < v.Len(); i++ {
+				b = appendScalarValue(b, v.Index(i))
+			}
+			return b, nil
+		})
+	case fp.repeated:
+		for i := 0; i < v.Len(); i++ {
+			ev := v.Index(i)
+			if ev.Kind() == reflect.String {
+				buf = appendTag(buf, fp.num, wireBytes)
+				buf = appendScalarValue(buf, ev)
+				continue
+			}
+			buf, err = appendMessage(buf, fp.num, ev)
+			if err != nil {
+				return buf, err
+			}
+		}
+	case fp.typ.Kind() == reflect.Slice:
+		// the bytes
+		buf = appendTag(buf, fp.num, wireBytes)
+		buf = appendVarint(buf, uint64(v.Len()))
+		buf = append(buf, v.Bytes()...)
+	case messageType(fp.typ) != nil:
+		return appendMessage(buf, fp.num, v)
+	default:
+		buf = appendTag(buf, fp.num, wireType(v.Kind()))
+		buf = appendScalarValue(buf, v)
+	}
+	return buf, nil
+}
+
+func appendStruct(buf []byte, v reflect.Value) ([]byte, error) {
+	p, err := getPlan(v.Type())
+	if err != nil {
+		return buf, err
+	}
+	for i := range p.fields {
+		fp := &p.fields[i]
+		fv := v.Field(fp.index)
+		// the zero value is the default in proto3, but the message is always kept
+		if fv.Kind() != reflect.Struct && isZero(fv) {
+			continue
+		}
+		buf, err = appendField(buf, fp, fv)
+		if err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+// Marshal encodes the struct or the pointer to the struct
+func Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("protoenc: unsupported type %T", v)
+	}
+	return appendStruct(make([]byte, 0, 1024), rv)
+}
+
+type stringValues []reflect.Value
+
+func (s stringValues) Len() int           { return len(s) }
+func (s stringValues) Less(i, j int) bool { return s[i].String() < s[j].String() }
+func (s stringValues) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func protoScalarType(k reflect.Kind) string {
+	switch k {
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return "int32"
+	case reflect.Int, reflect.Int64:
+		return "int64"
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return "uint32"
+	case reflect.Uint, reflect.Uint64:
+		return "uint64"
+	case reflect.Float32:
+		return "float"
+	case reflect.Float64:
+		return "double"
+	case reflect.String:
+		return "string"
+	}
+	return ""
+}
+
+// Schema generates the proto3 definition of the struct and all the nested structs
+// in the package, the message name is the go type name.
+func Schema(pkg string, v interface{}) (string, error) {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return "", fmt.Errorf("protoenc: unsupported type %v", t)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("syntax = \"proto3\";\n\n")
+	buf.WriteString(fmt.Sprintf("package %v;\n", pkg))
+	done := map[reflect.Type]bool{t: true}
+	pending := []reflect.Type{t}
+	for len(pending) > 0 {
+		t = pending[0]
+		pending = pending[1:]
+		p, err := getPlan(t)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(fmt.Sprintf("\nmessage %v {\n", p.name))
+		for _, fp := range p.fields {
+			var typ string
+			switch {
+			case fp.isMap:
+				typ = fmt.Sprintf("map<string, %v>", protoScalarType(fp.typ.Elem().Kind()))
+			case fp.typ.Kind() == reflect.Slice && fp.typ.Elem().Kind() == reflect.Uint8:
+				typ = "bytes"
+			default:
+				ft := fp.typ
+				if fp.repeated {
+					ft = ft.Elem()
+					typ = "repeated "
+				}
+				if mt := messageType(ft); mt != nil {
+					typ += mt.Name()
+					if !done[mt] {
+						done[mt] = true
+						pending = append(pending, mt)
+					}
+				} else {
+					typ += protoScalarType(ft.Kind())
+				}
+			}
+			buf.WriteString(fmt.Sprintf("  %v %v = %v;\n", typ, fp.name, fp.num))
+		}
+		buf.WriteString("}\n")
+	}
+	return buf.String(), nil
+}
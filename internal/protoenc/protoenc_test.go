@@ -0,0 +1,93 @@
+package protoenc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type testInner struct {
+	Name  string `json:"name" pb:"1"`
+	Count int64  `json:"count" pb:"2"`
+}
+
+type testMsg struct {
+	ID      int64            `json:"id" pb:"1"`
+	Name    string           `json:"name" pb:"2"`
+	Ok      bool             `json:"ok" pb:"3"`
+	Rate    float64          `json:"rate" pb:"4"`
+	Nums    []int64          `json:"nums" pb:"5"`
+	Inner   *testInner       `json:"inner" pb:"6"`
+	Inners  []testInner      `json:"inners" pb:"7"`
+	Counts  map[string]int64 `json:"counts" pb:"8"`
+	Ignored string           `json:"ignored"`
+}
+
+func TestMarshal(t *testing.T) {
+	cases := []struct {
+		msg      testMsg
+		expected []byte
+	}{
+		{testMsg{}, []byte{}},
+		{testMsg{ID: 150}, []byte{0x08, 0x96, 0x01}},
+		{testMsg{ID: -1}, []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{testMsg{Name: "testing"}, []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}},
+		{testMsg{Ok: true, Ignored: "x"}, []byte{0x18, 0x01}},
+		{testMsg{Rate: 1}, []byte{0x21, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+		{testMsg{Nums: []int64{3, 270}}, []byte{0x2a, 0x03, 0x03, 0x8e, 0x02}},
+		{testMsg{Inner: &testInner{Name: "a", Count: 1}}, []byte{0x32, 0x05, 0x0a, 0x01, 'a', 0x10, 0x01}},
+		{testMsg{Inners: []testInner{{}, {Count: 2}}}, []byte{0x3a, 0x00, 0x3a, 0x02, 0x10, 0x02}},
+		{testMsg{Counts: map[string]int64{"b": 2, "a": 1}},
+			[]byte{0x42, 0x05, 0x0a, 0x01, 'a', 0x10, 0x01, 0x42, 0x05, 0x0a, 0x01, 'b', 0x10, 0x02}},
+	}
+	for _, c := range cases {
+		data, err := Marshal(&c.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, c.expected) {
+			t.Errorf("marshal %+v got %x, expected %x", c.msg, data, c.expected)
+		}
+	}
+
+	// the length prefix longer than one byte
+	data, err := Marshal(&testMsg{Inner: &testInner{Name: strings.Repeat("a", 200)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1+2+1+2+200 || !bytes.Equal(data[:5], []byte{0x32, 0xcb, 0x01, 0x0a, 0xc8}) {
+		t.Errorf("unexpected data: %x", data[:5])
+	}
+
+	type badTag struct {
+		A int64 `pb:"1"`
+		B int64 `pb:"1"`
+	}
+	if _, err := Marshal(&badTag{}); err == nil {
+		t.Error("the duplicate field number should fail")
+	}
+}
+
+func TestSchema(t *testing.T) {
+	s, err := Schema("test", &testMsg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"package test;",
+		"message testMsg {",
+		"  int64 id = 1;",
+		"  repeated int64 nums = 5;",
+		"  testInner inner = 6;",
+		"  repeated testInner inners = 7;",
+		"  map<string, int64> counts = 8;",
+		"message testInner {",
+	} {
+		if !strings.Contains(s, line+"\n") {
+			t.Errorf("schema missing %q: %v", line, s)
+		}
+	}
+	if strings.Contains(s, "ignored") || strings.Count(s, "message testInner") != 1 {
+		t.Errorf("unexpected schema: %v", s)
+	}
+}
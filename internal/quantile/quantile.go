@@ -1,14 +1,28 @@
 package quantile
 
 import (
+	"math"
+	"math/bits"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/bmizerany/perks/quantile"
 	"github.com/youzan/nsq/internal/stringy"
 )
 
+const (
+	// each power of 2 range is split into 8 sub buckets, so the relative error
+	// of the value is less than 12.5%
+	subBucketBits  = 3
+	subBucketCount = 1 << subBucketBits
+	// the latency below 1024ns is counted in the first bucket, and above 2^40ns (about 18 minutes)
+	// is counted in the last bucket
+	minExp      = 10
+	maxExp      = 40
+	bucketCount = (maxExp-minExp)*subBucketCount + 1
+)
+
 type Result struct {
 	Count       int                  `json:"count"`
 	Percentiles []map[string]float64 `json:"percentiles"`
@@ -22,12 +36,56 @@ func (r *Result) String() string {
 	return strings.Join(s, ", ")
 }
 
+func bucketIndex(v int64) int {
+	if v < 1<<minExp {
+		return 0
+	}
+	exp := bits.Len64(uint64(v)) - 1
+	if exp >= maxExp {
+		return bucketCount - 1
+	}
+	sub := int(v>>uint(exp-subBucketBits)) & (subBucketCount - 1)
+	return 1 + (exp-minExp)*subBucketCount + sub
+}
+
+// bucketValue returns the highest value counted in the bucket
+func bucketValue(i int) int64 {
+	if i == 0 {
+		return 1 << minExp
+	}
+	exp := uint(minExp + (i-1)/subBucketCount)
+	sub := int64((i - 1) % subBucketCount)
+	return int64(1)<<exp + (sub+1)<<(exp-subBucketBits)
+}
+
+type histogram struct {
+	counts [bucketCount]int64
+	total  int64
+}
+
+func (h *histogram) reset() {
+	for i := range h.counts {
+		atomic.StoreInt64(&h.counts[i], 0)
+	}
+	atomic.StoreInt64(&h.total, 0)
+}
+
+func (h *histogram) add(other *histogram) {
+	for i := range other.counts {
+		atomic.AddInt64(&h.counts[i], atomic.LoadInt64(&other.counts[i]))
+	}
+	atomic.AddInt64(&h.total, atomic.LoadInt64(&other.total))
+}
+
+// Quantile tracks the latency in the fixed buckets histogram of the sliding window,
+// so merging is just adding the bucket counts. The counts are atomic, so the insert
+// and the result only take the lock while moving the window.
 type Quantile struct {
 	sync.Mutex
-	streams        [2]quantile.Stream
-	currentIndex   uint8
-	lastMoveWindow time.Time
-	currentStream  *quantile.Stream
+	windows [2]histogram
+	// unix nano time
+	lastMoveWindow int64
+	currentIndex   int32
 
 	Percentiles    []float64
 	MoveWindowTime time.Duration
@@ -35,15 +93,11 @@ type Quantile struct {
 
 func New(WindowTime time.Duration, Percentiles []float64) *Quantile {
 	q := Quantile{
+		lastMoveWindow: time.Now().UnixNano(),
 		currentIndex:   0,
-		lastMoveWindow: time.Now(),
 		MoveWindowTime: WindowTime / 2,
 		Percentiles:    Percentiles,
 	}
-	for i := 0; i < 2; i++ {
-		q.streams[i] = *quantile.NewTargeted(Percentiles...)
-	}
-	q.currentStream = &q.streams[0]
 	return &q
 }
 
@@ -51,70 +105,95 @@ func (q *Quantile) Result() *Result {
 	if q == nil {
 		return &Result{}
 	}
-	queryHandler := q.QueryHandler()
+	q.checkMoveWindow(time.Now())
+	var counts [bucketCount]int64
+	var total int64
+	for i := 0; i < bucketCount; i++ {
+		counts[i] = atomic.LoadInt64(&q.windows[0].counts[i]) + atomic.LoadInt64(&q.windows[1].counts[i])
+		total += counts[i]
+	}
 	result := Result{
-		Count:       queryHandler.Count(),
+		Count:       int(total),
 		Percentiles: make([]map[string]float64, len(q.Percentiles)),
 	}
 	for i, p := range q.Percentiles {
-		value := queryHandler.Query(p)
+		value := query(&counts, p, total)
 		result.Percentiles[i] = map[string]float64{"quantile": p, "value": value}
 	}
 	return &result
 }
 
-func (q *Quantile) Insert(msgStartTime int64) {
-	q.Lock()
+func query(counts *[bucketCount]int64, p float64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var cnt int64
+	for i := 0; i < bucketCount; i++ {
+		cnt += counts[i]
+		if cnt >= rank {
+			return float64(bucketValue(i))
+		}
+	}
+	return float64(bucketValue(bucketCount - 1))
+}
 
+func (q *Quantile) Insert(msgStartTime int64) {
 	now := time.Now()
-	for q.IsDataStale(now) {
-		q.moveWindow()
+	q.checkMoveWindow(now)
+
+	latency := now.UnixNano() - msgStartTime
+	if latency < 0 {
+		latency = 0
 	}
+	h := &q.windows[atomic.LoadInt32(&q.currentIndex)]
+	atomic.AddInt64(&h.counts[bucketIndex(latency)], 1)
+	atomic.AddInt64(&h.total, 1)
+}
 
-	q.currentStream.Insert(float64(now.UnixNano() - msgStartTime))
-	q.Unlock()
+func (q *Quantile) IsDataStale(now time.Time) bool {
+	return now.UnixNano() > atomic.LoadInt64(&q.lastMoveWindow)+int64(q.MoveWindowTime)
 }
 
-func (q *Quantile) QueryHandler() *quantile.Stream {
+// checkMoveWindow moves the window with the lock if the data is stale
+func (q *Quantile) checkMoveWindow(now time.Time) {
+	if !q.IsDataStale(now) {
+		return
+	}
 	q.Lock()
-	now := time.Now()
 	for q.IsDataStale(now) {
 		q.moveWindow()
 	}
-
-	merged := quantile.NewTargeted(q.Percentiles...)
-	merged.Merge(q.streams[0].Samples())
-	merged.Merge(q.streams[1].Samples())
 	q.Unlock()
-	return merged
-}
-
-func (q *Quantile) IsDataStale(now time.Time) bool {
-	return now.After(q.lastMoveWindow.Add(q.MoveWindowTime))
 }
 
 func (q *Quantile) Merge(them *Quantile) {
 	q.Lock()
 	them.Lock()
-	iUs := q.currentIndex
-	iThem := them.currentIndex
+	iUs := atomic.LoadInt32(&q.currentIndex)
+	iThem := atomic.LoadInt32(&them.currentIndex)
 
-	q.streams[iUs].Merge(them.streams[iThem].Samples())
+	q.windows[iUs].add(&them.windows[iThem])
 
 	iUs ^= 0x1
 	iThem ^= 0x1
-	q.streams[iUs].Merge(them.streams[iThem].Samples())
+	q.windows[iUs].add(&them.windows[iThem])
 
-	if q.lastMoveWindow.Before(them.lastMoveWindow) {
-		q.lastMoveWindow = them.lastMoveWindow
+	if last := atomic.LoadInt64(&them.lastMoveWindow); atomic.LoadInt64(&q.lastMoveWindow) < last {
+		atomic.StoreInt64(&q.lastMoveWindow, last)
 	}
 	q.Unlock()
 	them.Unlock()
 }
 
+// moveWindow should be called with the lock held, the new current window is
+// reset before used.
 func (q *Quantile) moveWindow() {
-	q.currentIndex ^= 0x1
-	q.currentStream = &q.streams[q.currentIndex]
-	q.lastMoveWindow = q.lastMoveWindow.Add(q.MoveWindowTime)
-	q.currentStream.Reset()
+	next := atomic.LoadInt32(&q.currentIndex) ^ 0x1
+	q.windows[next].reset()
+	atomic.StoreInt32(&q.currentIndex, next)
+	atomic.AddInt64(&q.lastMoveWindow, int64(q.MoveWindowTime))
 }
@@ -0,0 +1,106 @@
+package quantile
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketIndex(t *testing.T) {
+	if bucketIndex(0) != 0 || bucketIndex(1<<minExp-1) != 0 {
+		t.Fatalf("the latency below %v should be in the first bucket", 1<<minExp)
+	}
+	if bucketIndex(1<<maxExp) != bucketCount-1 || bucketIndex(1<<62) != bucketCount-1 {
+		t.Fatalf("the latency above %v should be in the last bucket", int64(1)<<maxExp)
+	}
+	last := 0
+	for v := int64(1 << minExp); v < 1<<maxExp; v += v/7 + 1 {
+		i := bucketIndex(v)
+		if i < last {
+			t.Fatalf("bucket index of %v should not decrease: %v < %v", v, i, last)
+		}
+		last = i
+		upper := bucketValue(i)
+		if v >= upper {
+			t.Fatalf("value %v should be below the bucket %v value %v", v, i, upper)
+		}
+		if float64(upper-v)/float64(v) > 0.125 {
+			t.Fatalf("value %v in bucket %v value %v exceeds the relative error", v, i, upper)
+		}
+	}
+}
+
+func insertLatency(q *Quantile, latency time.Duration, cnt int) {
+	for i := 0; i < cnt; i++ {
+		q.Insert(time.Now().UnixNano() - int64(latency))
+	}
+}
+
+func checkValue(t *testing.T, r *Result, i int, expected time.Duration) {
+	v := r.Percentiles[i]["value"]
+	if v < float64(expected) || v > float64(expected)*1.125 {
+		t.Fatalf("percentile %v value %v, expected about %v", r.Percentiles[i]["quantile"], v, expected)
+	}
+}
+
+func TestQuantileResult(t *testing.T) {
+	var nilQ *Quantile
+	if r := nilQ.Result(); r.Count != 0 || len(r.Percentiles) != 0 {
+		t.Fatalf("unexpected result of nil quantile: %v", r)
+	}
+
+	q := New(time.Minute, []float64{0.5, 0.99, 1})
+	r := q.Result()
+	if r.Count != 0 || r.Percentiles[0]["value"] != 0 {
+		t.Fatalf("unexpected result of empty quantile: %v", r)
+	}
+	insertLatency(q, time.Millisecond, 90)
+	insertLatency(q, 100*time.Millisecond, 9)
+	insertLatency(q, time.Second, 1)
+	r = q.Result()
+	if r.Count != 100 {
+		t.Fatalf("count should be 100: %v", r.Count)
+	}
+	checkValue(t, r, 0, time.Millisecond)
+	checkValue(t, r, 1, 100*time.Millisecond)
+	checkValue(t, r, 2, time.Second)
+}
+
+func TestQuantileMerge(t *testing.T) {
+	q1 := New(time.Minute, []float64{0.5, 0.9})
+	q2 := New(time.Minute, []float64{0.5, 0.9})
+	insertLatency(q1, time.Millisecond, 50)
+	insertLatency(q2, 100*time.Millisecond, 50)
+	q1.Merge(q2)
+	r := q1.Result()
+	if r.Count != 100 {
+		t.Fatalf("count should be 100 after merged: %v", r.Count)
+	}
+	checkValue(t, r, 0, time.Millisecond)
+	checkValue(t, r, 1, 100*time.Millisecond)
+	// the merged one is not changed
+	if r2 := q2.Result(); r2.Count != 50 {
+		t.Fatalf("count of the merged should be 50: %v", r2.Count)
+	}
+}
+
+func TestQuantileMoveWindow(t *testing.T) {
+	q := New(100*time.Millisecond, []float64{0.5})
+	insertLatency(q, time.Millisecond, 10)
+	time.Sleep(60 * time.Millisecond)
+	insertLatency(q, 10*time.Millisecond, 10)
+	if r := q.Result(); r.Count != 20 {
+		t.Fatalf("count should be 20 in the window: %v", r.Count)
+	}
+	// the older half window is dropped
+	time.Sleep(60 * time.Millisecond)
+	r := q.Result()
+	if r.Count != 10 {
+		t.Fatalf("count should be 10 after the window moved: %v", r.Count)
+	}
+	checkValue(t, r, 0, 10*time.Millisecond)
+	// all the data is stale
+	time.Sleep(120 * time.Millisecond)
+	if r := q.Result(); r.Count != 0 {
+		t.Fatalf("count should be 0 after the window expired: %v", r.Count)
+	}
+}
@@ -98,6 +98,8 @@ func NewHTTPServer(ctx *Context) *httpServer {
 	router.Handle("GET", "/api/coordinators/:node/:topic/:partition", http_api.Decorate(s.coordinatorHandler, log, http_api.V1))
 	router.Handle("GET", "/api/lookup/nodes", http_api.Decorate(s.lookupNodesHandler, log, http_api.V1))
 	router.Handle("GET", "/api/topics/:topic/:channel", http_api.Decorate(s.channelHandler, log, http_api.V1))
+	router.Handle("GET", "/api/history/:topic", http_api.Decorate(s.topicHistoryHandler, log, http_api.V1))
+	router.Handle("GET", "/api/history/:topic/:channel", http_api.Decorate(s.channelHistoryHandler, log, http_api.V1))
 	router.Handle("GET", "/api/nodes", http_api.Decorate(s.nodesHandler, log, http_api.V1))
 	router.Handle("GET", "/api/nodes/:node", http_api.Decorate(s.nodeHandler, log, http_api.V1))
 	router.Handle("POST", "/api/search/messages", http_api.Decorate(s.searchMessageTrace, s.authCheck, log, http_api.V1))
@@ -105,6 +107,7 @@ func NewHTTPServer(ctx *Context) *httpServer {
 	router.Handle("POST", "/api/topics/:topic", http_api.Decorate(s.topicActionHandler, s.authCheck, log, http_api.V1))
 	router.Handle("POST", "/api/topics/:topic/:channel", http_api.Decorate(s.channelActionHandler, s.authCheck, log, http_api.V1))
 	router.Handle("POST", "/api/topics/:topic/:channel/client", http_api.Decorate(s.channelClientActionHandler, s.authCheck, log, http_api.V1))
+	router.Handle("POST", "/api/bulk", http_api.Decorate(s.bulkActionHandler, s.authCheck, log, http_api.V1))
 	router.Handle("DELETE", "/api/nodes/:node", http_api.Decorate(s.tombstoneNodeForTopicHandler, s.authCheck, log, http_api.V1))
 	router.Handle("DELETE", "/api/topics/:topic", http_api.Decorate(s.deleteTopicHandler, s.authCheck, log, http_api.V1))
 	router.Handle("DELETE", "/api/topics/:topic/:channel", http_api.Decorate(s.deleteChannelHandler, s.authCheck, log, http_api.V1))
@@ -479,10 +482,19 @@ func (s *httpServer) topicHandler(w http.ResponseWriter, req *http.Request, ps h
 		allNodesTopicStats.Add(t)
 	}
 
+	var owner *clusterinfo.TopicOwnerMeta
+	if len(s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses) > 0 {
+		owner, err = s.ci.GetLookupdTopicOwnerMeta(topicName, s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses)
+		if err != nil {
+			s.ctx.nsqadmin.logf("WARNING: failed to get topic %v owner meta - %s", topicName, err)
+		}
+	}
+
 	return struct {
 		*clusterinfo.TopicStats
-		Message string `json:"message"`
-	}{allNodesTopicStats, maybeWarnMsg(messages)}, nil
+		Owner   *clusterinfo.TopicOwnerMeta `json:"owner,omitempty"`
+		Message string                      `json:"message"`
+	}{allNodesTopicStats, owner, maybeWarnMsg(messages)}, nil
 }
 
 func (s *httpServer) channelHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -527,6 +539,157 @@ func (s *httpServer) channelHandler(w http.ResponseWriter, req *http.Request, ps
 	}{allChannelStats[channelName], maybeWarnMsg(messages)}, nil
 }
 
+// the time ranges can be selected for the history graphs
+var historyRanges = []string{"1h", "6h", "12h", "24h"}
+
+const (
+	defaultHistoryRange = "1h"
+	maxHistoryRange     = time.Hour * 24
+	// the max points of the depth history for each graph
+	maxHistoryPoints = 120
+)
+
+type channelDepthHistory struct {
+	ChannelName string                          `json:"channel_name"`
+	Depth       []clusterinfo.DepthHistoryPoint `json:"depth"`
+}
+
+type channelDepthHistoryByName []*channelDepthHistory
+
+func (c channelDepthHistoryByName) Len() int      { return len(c) }
+func (c channelDepthHistoryByName) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c channelDepthHistoryByName) Less(i, j int) bool {
+	return c[i].ChannelName < c[j].ChannelName
+}
+
+func (s *httpServer) topicHistoryHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.getHistory(req, ps.ByName("topic"), "")
+}
+
+func (s *httpServer) channelHistoryHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.getHistory(req, ps.ByName("topic"), ps.ByName("channel"))
+}
+
+// getHistory returns the pub throughput and the channel depth history of the topic
+// from the stats history kept by nsqd, so the graphs can be rendered without graphite.
+// If the channel is not empty, only the depth history of the channel is returned.
+func (s *httpServer) getHistory(req *http.Request, topicName string, channelName string) (interface{}, error) {
+	var messages []string
+
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	rangeStr := reqParams.Get("range")
+	if rangeStr == "" {
+		rangeStr = defaultHistoryRange
+	}
+	historyRange, err := time.ParseDuration(rangeStr)
+	if err != nil || historyRange <= 0 || historyRange > maxHistoryRange {
+		return nil, http_api.Err{400, "INVALID_ARG_RANGE"}
+	}
+
+	producers, _, err := s.ci.GetTopicProducers(topicName,
+		s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses,
+		s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf("ERROR: failed to get topic producers - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf("WARNING: %s", err)
+		messages = append(messages, pe.Error())
+	}
+	topicStats, _, err := s.ci.GetNSQDStats(producers, topicName, "partition", true)
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf("ERROR: failed to get topic metadata - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf("WARNING: %s", err)
+		messages = append(messages, pe.Error())
+	}
+
+	now := time.Now()
+	step := historyRange / maxHistoryPoints
+	if step < time.Minute {
+		step = time.Minute
+	}
+	stepSec := int64(step / time.Second)
+	end := now.Unix() / stepSec * stepSec
+	start := end - int64(historyRange/time.Second)
+
+	var hourlySeries [][]int64
+	depthSeries := make(map[string][][]clusterinfo.DepthHistoryPoint)
+	for _, t := range topicStats {
+		hourly, err := s.ci.GetNSQDMessageHistoryStats(t.Node, t.TopicName, t.TopicPartition)
+		if err != nil {
+			s.ctx.nsqadmin.logf("WARNING: %s", err)
+			messages = append(messages, err.Error())
+		} else {
+			hourlySeries = append(hourlySeries, hourly)
+		}
+		for _, c := range t.Channels {
+			if channelName != "" && c.ChannelName != channelName {
+				continue
+			}
+			samples, err := s.ci.GetNSQDChannelDepthHistory(t.Node, t.TopicName, t.TopicPartition,
+				c.ChannelName, historyRange)
+			if err != nil {
+				s.ctx.nsqadmin.logf("WARNING: %s", err)
+				messages = append(messages, err.Error())
+			}
+			depthSeries[c.ChannelName] = append(depthSeries[c.ChannelName], samples)
+		}
+	}
+	if channelName != "" && len(depthSeries) == 0 {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	// the hourly pub size from nsqd ends at the last hour since the current hour is not finished
+	lastHour := now.Truncate(time.Hour).Add(-1 * time.Hour)
+	hourlyPubSize := make([]clusterinfo.HistoryPoint, 0)
+	for _, p := range clusterinfo.MergeHourlyPubSize(hourlySeries, lastHour) {
+		if p.Ts+int64(time.Hour/time.Second) > start {
+			hourlyPubSize = append(hourlyPubSize, p)
+		}
+	}
+	channels := make([]*channelDepthHistory, 0, len(depthSeries))
+	for name, series := range depthSeries {
+		channels = append(channels, &channelDepthHistory{
+			ChannelName: name,
+			Depth:       clusterinfo.MergeDepthHistory(series, start, end, stepSec),
+		})
+	}
+	sort.Sort(channelDepthHistoryByName(channels))
+
+	return struct {
+		TopicName     string                     `json:"topic_name"`
+		ChannelName   string                     `json:"channel_name,omitempty"`
+		Range         string                     `json:"range"`
+		Ranges        []string                   `json:"ranges"`
+		Start         int64                      `json:"start"`
+		End           int64                      `json:"end"`
+		Step          int64                      `json:"step"`
+		HourlyPubSize []clusterinfo.HistoryPoint `json:"hourly_pub_size"`
+		Channels      []*channelDepthHistory     `json:"channels"`
+		Message       string                     `json:"message"`
+	}{
+		TopicName:     topicName,
+		ChannelName:   channelName,
+		Range:         rangeStr,
+		Ranges:        historyRanges,
+		Start:         start,
+		End:           end,
+		Step:          stepSec,
+		HourlyPubSize: hourlyPubSize,
+		Channels:      channels,
+		Message:       maybeWarnMsg(messages),
+	}, nil
+}
+
 func (s *httpServer) nodesHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 
@@ -946,9 +1109,7 @@ func (s *httpServer) deleteTopicHandler(w http.ResponseWriter, req *http.Request
 
 	topicName := ps.ByName("topic")
 
-	err := s.ci.DeleteTopic(topicName,
-		s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses,
-		s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+	err := s.doDeleteTopic(req, topicName)
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
@@ -959,22 +1120,26 @@ func (s *httpServer) deleteTopicHandler(w http.ResponseWriter, req *http.Request
 		messages = append(messages, pe.Error())
 	}
 
-	s.notifyAdminActionWithUser("delete_topic", topicName, "", "", req)
-
 	return struct {
 		Message string `json:"message"`
 	}{maybeWarnMsg(messages)}, nil
 }
 
+func (s *httpServer) doDeleteTopic(req *http.Request, topicName string) error {
+	err := s.ci.DeleteTopic(topicName,
+		s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses,
+		s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+	s.notifyAdminActionWithUser("delete_topic", topicName, "", "", req)
+	return err
+}
+
 func (s *httpServer) deleteChannelHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 
 	topicName := ps.ByName("topic")
 	channelName := ps.ByName("channel")
 
-	err := s.ci.DeleteChannel(topicName, channelName,
-		s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses,
-		s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+	err := s.doDeleteChannel(req, topicName, channelName)
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
@@ -985,13 +1150,19 @@ func (s *httpServer) deleteChannelHandler(w http.ResponseWriter, req *http.Reque
 		messages = append(messages, pe.Error())
 	}
 
-	s.notifyAdminActionWithUser("delete_channel", topicName, channelName, "", req)
-
 	return struct {
 		Message string `json:"message"`
 	}{maybeWarnMsg(messages)}, nil
 }
 
+func (s *httpServer) doDeleteChannel(req *http.Request, topicName string, channelName string) error {
+	err := s.ci.DeleteChannel(topicName, channelName,
+		s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses,
+		s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+	s.notifyAdminActionWithUser("delete_channel", topicName, channelName, "", req)
+	return err
+}
+
 func (s *httpServer) topicActionHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	topicName := ps.ByName("topic")
 	return s.topicChannelAction(req, topicName, "")
@@ -1050,18 +1221,45 @@ func (s *httpServer) channelActionHandler(w http.ResponseWriter, req *http.Reque
 	return s.topicChannelAction(req, topicName, channelName)
 }
 
+type topicChannelActionReq struct {
+	Action    string `json:"action"`
+	Timestamp string `json:"timestamp"`
+	Partition string `json:"partition"`
+	Node      string `json:"node"`
+}
+
 func (s *httpServer) topicChannelAction(req *http.Request, topicName string, channelName string) (interface{}, error) {
 	var messages []string
 
-	var body struct {
-		Action    string `json:"action"`
-		Timestamp string `json:"timestamp"`
-	}
+	var body topicChannelActionReq
 	err := json.NewDecoder(req.Body).Decode(&body)
 	if err != nil {
 		return nil, http_api.Err{400, err.Error()}
 	}
 
+	err = s.doTopicChannelAction(req, topicName, channelName, &body)
+	if err != nil {
+		if e, ok := err.(http_api.Err); ok {
+			return nil, e
+		}
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf("ERROR: failed to %s topic/channel - %s", body.Action, err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf("WARNING: %s", err)
+		messages = append(messages, pe.Error())
+	}
+
+	return struct {
+		Message string `json:"message"`
+	}{maybeWarnMsg(messages)}, nil
+}
+
+// doTopicChannelAction does the action for the topic, or the channel if the
+// channel is not empty, the invalid request returns the http_api.Err.
+func (s *httpServer) doTopicChannelAction(req *http.Request, topicName string, channelName string, body *topicChannelActionReq) error {
+	var err error
 	switch body.Action {
 	case "pause":
 		if channelName != "" {
@@ -1141,23 +1339,187 @@ func (s *httpServer) topicChannelAction(req *http.Request, topicName string, cha
 			s.notifyAdminActionWithUser("reset_channel", topicName, channelName, "", req)
 
 		}
+	case "transfer_leader":
+		if channelName == "" {
+			if body.Partition == "" || body.Node == "" {
+				return http_api.Err{400, "MISSING_ARG_PARTITION_OR_NODE"}
+			}
+			err = s.ci.TransferTopicLeader(topicName, body.Partition, body.Node,
+				s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses)
+			s.notifyAdminActionWithUser("transfer_topic_leader", topicName, "", body.Node, req)
+		}
+	default:
+		return http_api.Err{400, "INVALID_ACTION"}
+	}
+	return err
+}
+
+type bulkTarget struct {
+	Topic   string `json:"topic"`
+	Channel string `json:"channel,omitempty"`
+	Result  string `json:"result"`
+	Error   string `json:"error,omitempty"`
+}
+
+// bulkActionHandler do the action for all the topics/channels matching the pattern,
+// the pattern is the same as path.Match, such as "*_retry". The targets are resolved
+// once before any action, and the result of each target is reported.
+// If the channel pattern is empty, the action is done for the matched topics, and
+// the topic pattern should not be wildcard in this case. The empty and delete
+// actions are done only if confirm is true.
+func (s *httpServer) bulkActionHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var messages []string
+
+	var body struct {
+		Action  string `json:"action"`
+		Topic   string `json:"topic"`
+		Channel string `json:"channel"`
+		DryRun  bool   `json:"dry_run"`
+		Confirm bool   `json:"confirm"`
+	}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	if body.Topic == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	if _, err := path.Match(body.Topic, ""); err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC"}
+	}
+	if _, err := path.Match(body.Channel, ""); err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_CHANNEL"}
+	}
+	wildcardTopic := strings.ContainsAny(body.Topic, "*?[\\")
+	switch body.Action {
+	case "pause", "unpause", "empty":
+		// never pause or empty all the topics by one request
+		if body.Channel == "" && wildcardTopic {
+			return nil, http_api.Err{400, "WILDCARD_TOPIC_NOT_ALLOWED_FOR_" + strings.ToUpper(body.Action)}
+		}
+	case "delete":
+		// never delete all the topics by one request
+		if wildcardTopic {
+			return nil, http_api.Err{400, "WILDCARD_TOPIC_NOT_ALLOWED_FOR_DELETE"}
+		}
+	case "skip", "unskip":
+		if body.Channel == "" {
+			return nil, http_api.Err{400, "MISSING_ARG_CHANNEL"}
+		}
 	default:
 		return nil, http_api.Err{400, "INVALID_ACTION"}
 	}
+	// the destructive action should be checked by the dry run first and confirmed
+	if (body.Action == "empty" || body.Action == "delete") && !body.DryRun && !body.Confirm {
+		return nil, http_api.Err{400, "MISSING_ARG_CONFIRM"}
+	}
 
+	var topicNames []string
+	if len(s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses) != 0 {
+		topicNames, err = s.ci.GetLookupdTopics(s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses)
+	} else {
+		var topics []*clusterinfo.TopicInfo
+		topics, err = s.ci.GetNSQDTopics(s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+		for _, t := range topics {
+			topicNames = append(topicNames, t.TopicName)
+		}
+	}
 	if err != nil {
 		pe, ok := err.(clusterinfo.PartialErr)
 		if !ok {
-			s.ctx.nsqadmin.logf("ERROR: failed to %s topic/channel - %s", body.Action, err)
+			s.ctx.nsqadmin.logf("ERROR: failed to get topics - %s", err)
 			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 		}
 		s.ctx.nsqadmin.logf("WARNING: %s", err)
 		messages = append(messages, pe.Error())
 	}
+	sort.Strings(topicNames)
+
+	targets := make([]*bulkTarget, 0)
+	for _, topicName := range topicNames {
+		if ok, _ := path.Match(body.Topic, topicName); !ok {
+			continue
+		}
+		if body.Channel == "" {
+			targets = append(targets, &bulkTarget{Topic: topicName})
+			continue
+		}
+		channelNames, err := s.getTopicChannelNames(topicName)
+		if err != nil {
+			s.ctx.nsqadmin.logf("WARNING: failed to get channels of topic %v - %s", topicName, err)
+			messages = append(messages, err.Error())
+		}
+		for _, channelName := range channelNames {
+			if ok, _ := path.Match(body.Channel, channelName); ok {
+				targets = append(targets, &bulkTarget{Topic: topicName, Channel: channelName})
+			}
+		}
+	}
+
+	failed := 0
+	for _, target := range targets {
+		if body.DryRun {
+			target.Result = "dry_run"
+			continue
+		}
+		err := s.doBulkTargetAction(req, body.Action, target.Topic, target.Channel)
+		if err != nil {
+			s.ctx.nsqadmin.logf("ERROR: failed to %s topic %v channel %v - %s",
+				body.Action, target.Topic, target.Channel, err)
+			target.Result = "error"
+			target.Error = err.Error()
+			failed++
+		} else {
+			target.Result = "ok"
+		}
+	}
+	if failed > 0 {
+		messages = append(messages, fmt.Sprintf("%v of %v targets failed", failed, len(targets)))
+	}
 
 	return struct {
-		Message string `json:"message"`
-	}{maybeWarnMsg(messages)}, nil
+		Action  string        `json:"action"`
+		DryRun  bool          `json:"dry_run"`
+		Targets []*bulkTarget `json:"targets"`
+		Message string        `json:"message"`
+	}{body.Action, body.DryRun, targets, maybeWarnMsg(messages)}, nil
+}
+
+// getTopicChannelNames returns the channels of the topic from the leaders of all the partitions
+func (s *httpServer) getTopicChannelNames(topicName string) ([]string, error) {
+	producers, _, err := s.ci.GetTopicProducers(topicName,
+		s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses,
+		s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+	if err != nil {
+		if _, ok := err.(clusterinfo.PartialErr); !ok {
+			return nil, err
+		}
+	}
+	_, allChannelStats, statsErr := s.ci.GetNSQDStats(producers, topicName, "", true)
+	if statsErr != nil {
+		if _, ok := statsErr.(clusterinfo.PartialErr); !ok {
+			return nil, statsErr
+		}
+		err = statsErr
+	}
+	channelNames := make([]string, 0, len(allChannelStats))
+	for name := range allChannelStats {
+		channelNames = append(channelNames, name)
+	}
+	sort.Strings(channelNames)
+	return channelNames, err
+}
+
+// doBulkTargetAction does the action for one target in the same way as the
+// topic/channel action and delete handlers.
+func (s *httpServer) doBulkTargetAction(req *http.Request, action string, topicName string, channelName string) error {
+	if action == "delete" {
+		if channelName == "" {
+			return s.doDeleteTopic(req, topicName)
+		}
+		return s.doDeleteChannel(req, topicName, channelName)
+	}
+	return s.doTopicChannelAction(req, topicName, channelName, &topicChannelActionReq{Action: action})
 }
 
 type counterStats struct {
@@ -246,6 +246,53 @@ func TestHTTPChannelGET(t *testing.T) {
 	equal(t, len(js.Get("clients").MustArray()), 0)
 }
 
+func TestHTTPChannelHistoryGET(t *testing.T) {
+	dataPath, _, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "test_channel_history" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqds[0].GetNsqdInstance().GetTopic(topicName, 0)
+	topic.GetChannel("ch")
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/api/history/%s/ch?range=6h", nsqadmin1.RealHTTPAddr(), topicName)
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := client.Do(req)
+	equal(t, err, nil)
+	equal(t, resp.StatusCode, 200)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Log(string(body))
+	js, err := simplejson.NewJson(body)
+	equal(t, err, nil)
+	equal(t, js.Get("topic_name").MustString(), topicName)
+	equal(t, js.Get("channel_name").MustString(), "ch")
+	equal(t, js.Get("range").MustString(), "6h")
+	equal(t, len(js.Get("ranges").MustArray()), 4)
+	equal(t, js.Get("end").MustInt64()-js.Get("start").MustInt64(), int64(6*3600))
+	equal(t, len(js.Get("channels").MustArray()), 1)
+	equal(t, js.Get("channels").GetIndex(0).Get("channel_name").MustString(), "ch")
+
+	url = fmt.Sprintf("http://%s/api/history/%s?range=48h", nsqadmin1.RealHTTPAddr(), topicName)
+	req, _ = http.NewRequest("GET", url, nil)
+	resp, err = client.Do(req)
+	equal(t, err, nil)
+	resp.Body.Close()
+	equal(t, resp.StatusCode, 400)
+
+	url = fmt.Sprintf("http://%s/api/history/%s/not_exist_ch", nsqadmin1.RealHTTPAddr(), topicName)
+	req, _ = http.NewRequest("GET", url, nil)
+	resp, err = client.Do(req)
+	equal(t, err, nil)
+	resp.Body.Close()
+	equal(t, resp.StatusCode, 404)
+}
+
 func TestHTTPCreateTopicPOST(t *testing.T) {
 	dataPath, _, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -446,6 +493,121 @@ func TestHTTPPauseChannelPOST(t *testing.T) {
 	resp.Body.Close()
 }
 
+func TestHTTPBulkPauseChannelPOST(t *testing.T) {
+	dataPath, _, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "test_bulk_pause_channel_post" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqds[0].GetNsqdInstance().GetTopic(topicName, 0)
+	retryCh := topic.GetChannel("ch_retry")
+	ch := topic.GetChannel("ch")
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/api/bulk", nsqadmin1.RealHTTPAddr())
+	body, _ := json.Marshal(map[string]interface{}{
+		"action":  "pause",
+		"topic":   topicName,
+		"channel": "*_retry",
+		"dry_run": true,
+	})
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	resp, err := client.Do(req)
+	equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	equal(t, resp.StatusCode, 200)
+	resp.Body.Close()
+	t.Log(string(body))
+	js, err := simplejson.NewJson(body)
+	equal(t, err, nil)
+	equal(t, len(js.Get("targets").MustArray()), 1)
+	equal(t, js.Get("targets").GetIndex(0).Get("channel").MustString(), "ch_retry")
+	equal(t, js.Get("targets").GetIndex(0).Get("result").MustString(), "dry_run")
+	equal(t, retryCh.IsPaused(), false)
+
+	body, _ = json.Marshal(map[string]interface{}{
+		"action":  "pause",
+		"topic":   topicName,
+		"channel": "*_retry",
+	})
+	req, _ = http.NewRequest("POST", url, bytes.NewBuffer(body))
+	resp, err = client.Do(req)
+	equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	equal(t, resp.StatusCode, 200)
+	resp.Body.Close()
+	js, err = simplejson.NewJson(body)
+	equal(t, err, nil)
+	equal(t, js.Get("targets").GetIndex(0).Get("result").MustString(), "ok")
+	equal(t, retryCh.IsPaused(), true)
+	equal(t, ch.IsPaused(), false)
+
+	body, _ = json.Marshal(map[string]interface{}{
+		"action": "skip",
+		"topic":  topicName,
+	})
+	req, _ = http.NewRequest("POST", url, bytes.NewBuffer(body))
+	resp, err = client.Do(req)
+	equal(t, err, nil)
+	resp.Body.Close()
+	equal(t, resp.StatusCode, 400)
+
+	// the wildcard topic is not allowed for delete
+	body, _ = json.Marshal(map[string]interface{}{
+		"action":  "delete",
+		"topic":   "*",
+		"dry_run": true,
+	})
+	req, _ = http.NewRequest("POST", url, bytes.NewBuffer(body))
+	resp, err = client.Do(req)
+	equal(t, err, nil)
+	resp.Body.Close()
+	equal(t, resp.StatusCode, 400)
+	_, err = nsqds[0].GetNsqdInstance().GetExistingTopic(topicName, 0)
+	equal(t, err, nil)
+
+	// the wildcard topic is not allowed for the topic level empty and pause
+	for _, action := range []string{"empty", "pause", "unpause"} {
+		body, _ = json.Marshal(map[string]interface{}{
+			"action":  action,
+			"topic":   "*",
+			"confirm": true,
+		})
+		req, _ = http.NewRequest("POST", url, bytes.NewBuffer(body))
+		resp, err = client.Do(req)
+		equal(t, err, nil)
+		resp.Body.Close()
+		equal(t, resp.StatusCode, 400)
+	}
+
+	// the empty should be confirmed
+	body, _ = json.Marshal(map[string]interface{}{
+		"action":  "empty",
+		"topic":   topicName,
+		"channel": "*_retry",
+	})
+	req, _ = http.NewRequest("POST", url, bytes.NewBuffer(body))
+	resp, err = client.Do(req)
+	equal(t, err, nil)
+	resp.Body.Close()
+	equal(t, resp.StatusCode, 400)
+
+	body, _ = json.Marshal(map[string]interface{}{
+		"action":  "empty",
+		"topic":   topicName,
+		"channel": "*_retry",
+		"confirm": true,
+	})
+	req, _ = http.NewRequest("POST", url, bytes.NewBuffer(body))
+	resp, err = client.Do(req)
+	equal(t, err, nil)
+	resp.Body.Close()
+	equal(t, resp.StatusCode, 200)
+}
+
 func TestHTTPGetStatisticsRanks(t *testing.T) {
 	dataPath, _, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -0,0 +1,58 @@
+var _ = require('underscore');
+var AppState = require('../app_state');
+var Backbone = require('backbone');
+
+// History holds the pub throughput and channel depth history of a topic (or a
+// single channel) from the stats history kept by nsqd, no graphite needed.
+var History = Backbone.Model.extend({
+    defaults: function() {
+        return {
+            'range': '1h'
+        };
+    },
+
+    constructor: function History() {
+        Backbone.Model.prototype.constructor.apply(this, arguments);
+    },
+
+    url: function() {
+        var url = '/history/' + encodeURIComponent(this.get('topic'));
+        if (this.get('channel')) {
+            url += '/' + encodeURIComponent(this.get('channel'));
+        }
+        return AppState.url(url + '?range=' + encodeURIComponent(this.get('range')));
+    },
+
+    parse: function(response) {
+        var selected = response['range'];
+        // data for the time range selector
+        response['range_options'] = _.map(response['ranges'] || [], function(r) {
+            return {'name': r, 'selected': r === selected};
+        });
+        response['hourly_pub_size'] = _.map(response['hourly_pub_size'] || [], function(p) {
+            p['hour'] = new Date(p['ts'] * 1000).getHours() + ':00';
+            return p;
+        });
+        var start = response['start'];
+        var span = Math.max(response['end'] - start, 1);
+        response['channels'] = _.map(response['channels'] || [], function(channel) {
+            channel['depth'] = channel['depth'] || [];
+            var last = _.last(channel['depth']);
+            channel['current_depth'] = last ? last['depth'] : 0;
+            channel['max_depth'] = _.reduce(channel['depth'], function(max, p) {
+                return Math.max(max, p['depth']);
+            }, 0);
+            // the polyline points of the depth graph in the 240x30 box
+            var maxDepth = Math.max(channel['max_depth'], 1);
+            channel['depth_points'] = _.map(channel['depth'], function(p) {
+                var x = (p['ts'] - start) * 240 / span;
+                var y = 30 - p['depth'] * 28 / maxDepth - 1;
+                return x.toFixed(1) + ',' + y.toFixed(1);
+            }).join(' ');
+            return channel;
+        });
+        return response;
+    }
+});
+
+module.exports = History;
@@ -6,8 +6,10 @@ var bootbox = require('bootbox');
 
 var Pubsub = require('../lib/pubsub');
 var AppState = require('../app_state');
+var History = require('../models/history');
 
 var BaseView = require('./base');
+var HistoryView = require('./history');
 var click2Show=" >>>";
 var click2Hide=" <<<";
 var ChannelView = BaseView.extend({
@@ -48,6 +50,16 @@ var ChannelView = BaseView.extend({
         }
     },
 
+    postRender: function() {
+        // the history graphs are shown once the channel is fetched
+        if (this.$('.history-graphs').length) {
+            this.appendSubview(new HistoryView({'model': new History({
+                'topic': this.model.get('topic'),
+                'channel': this.model.get('name')
+            })}), '.history-graphs');
+        }
+    },
+
     initialize: function() {
         BaseView.prototype.initialize.apply(this, arguments);
         this.listenTo(AppState, 'change:graph_interval', this.render);
@@ -0,0 +1,38 @@
+var $ = require('jquery');
+
+var BaseView = require('./base');
+
+// HistoryView renders the pub throughput and channel depth history from nsqd,
+// it is used as the subview of the topic and channel view.
+var HistoryView = BaseView.extend({
+    className: 'history container-fluid',
+
+    template: require('./spinner.hbs'),
+
+    events: {
+        'change .history-range': 'onRangeChange'
+    },
+
+    initialize: function() {
+        BaseView.prototype.initialize.apply(this, arguments);
+        this.fetch();
+    },
+
+    fetch: function() {
+        this.model.fetch()
+            .done(function(data) {
+                this.template = require('./history.hbs');
+                this.render({'message': data['message']});
+            }.bind(this))
+            .fail(this.handleViewError.bind(this));
+    },
+
+    onRangeChange: function(e) {
+        e.preventDefault();
+        e.stopPropagation();
+        this.model.set('range', $(e.currentTarget).val());
+        this.fetch();
+    }
+});
+
+module.exports = HistoryView;
@@ -6,8 +6,10 @@ var bootbox = require('bootbox');
 
 var Pubsub = require('../lib/pubsub');
 var AppState = require('../app_state');
+var History = require('../models/history');
 
 var BaseView = require('./base');
+var HistoryView = require('./history');
 
 var click2Show=" >>>";
 var click2Hide=" <<<";
@@ -19,11 +21,21 @@ var TopicView = BaseView.extend({
 
     events: {
         'click .topic-actions button': 'topicAction',
+        'click .leader-actions button': 'onTransferLeader',
         'click .channel-action .hierarchy button': 'onCreateTopicChannel',
         'click .toggle h4': 'onToggle',
         'click .toggle h4 span a': 'onToggle',
     },
 
+    postRender: function() {
+        // the history graphs are shown once the topic is fetched
+        if (this.$('.history-graphs').length) {
+            this.appendSubview(new HistoryView({'model': new History({
+                'topic': this.model.get('name')
+            })}), '.history-graphs');
+        }
+    },
+
     initialize: function() {
         BaseView.prototype.initialize.apply(this, arguments);
         this.listenTo(AppState, 'change:graph_interval', this.render);
@@ -77,6 +89,27 @@ var TopicView = BaseView.extend({
         }.bind(this));
     },
 
+    onTransferLeader: function(e) {
+        e.preventDefault();
+        e.stopPropagation();
+        var partition = String($(e.currentTarget).data('partition'));
+        var node = $(e.currentTarget).data('node');
+        var txt = 'Are you sure you want to transfer the leader of <em>' +
+            this.model.get('name') + '-' + partition + '</em> to <strong>' + node + '</strong>?';
+        bootbox.confirm(txt, function(result) {
+            if (result !== true) {
+                return;
+            }
+            $.post(this.model.url(), JSON.stringify({
+                    'action': 'transfer_leader',
+                    'partition': partition,
+                    'node': node
+                }))
+                .done(function() { window.location.reload(true); })
+                .fail(this.handleAJAXError.bind(this));
+        }.bind(this));
+    },
+
     onCreateTopicChannel: function(e) {
         e.preventDefault();
         e.stopPropagation();
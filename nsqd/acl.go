@@ -0,0 +1,126 @@
+package nsqd
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/youzan/nsq/internal/auth"
+)
+
+type aclDeniedStats struct {
+	sync.Mutex
+	// topic -> operation -> denied count, only the topics on this node are counted
+	// by topic since the topic name is given by the client.
+	topicDenied map[string]map[string]*int64
+	// operation -> denied count of the topics not on this node
+	otherDenied map[string]*int64
+}
+
+func newACLDeniedStats() *aclDeniedStats {
+	return &aclDeniedStats{
+		topicDenied: make(map[string]map[string]*int64),
+		otherDenied: make(map[string]*int64),
+	}
+}
+
+func (self *aclDeniedStats) incr(topic string, op string, topicExist bool) {
+	self.Lock()
+	opStats := self.otherDenied
+	if topicExist {
+		var ok bool
+		opStats, ok = self.topicDenied[topic]
+		if !ok {
+			opStats = make(map[string]*int64)
+			self.topicDenied[topic] = opStats
+		}
+	}
+	cnt, ok := opStats[op]
+	if !ok {
+		cnt = new(int64)
+		opStats[op] = cnt
+	}
+	self.Unlock()
+	atomic.AddInt64(cnt, 1)
+}
+
+func (self *aclDeniedStats) getTopicStats(topic string) map[string]int64 {
+	self.Lock()
+	defer self.Unlock()
+	opStats, ok := self.topicDenied[topic]
+	if !ok {
+		return nil
+	}
+	ret := make(map[string]int64, len(opStats))
+	for op, cnt := range opStats {
+		ret[op] = atomic.LoadInt64(cnt)
+	}
+	return ret
+}
+
+func (self *aclDeniedStats) getTotalStats() map[string]int64 {
+	self.Lock()
+	defer self.Unlock()
+	ret := make(map[string]int64, len(auth.ACLOperations))
+	for _, opStats := range self.topicDenied {
+		for op, cnt := range opStats {
+			ret[op] += atomic.LoadInt64(cnt)
+		}
+	}
+	for op, cnt := range self.otherDenied {
+		ret[op] += atomic.LoadInt64(cnt)
+	}
+	return ret
+}
+
+// remove drops the stats of the topic deleted from this node
+func (self *aclDeniedStats) remove(topic string) {
+	self.Lock()
+	delete(self.topicDenied, topic)
+	self.Unlock()
+}
+
+func (n *NSQD) loadACL(fileName string) error {
+	if fileName == "" {
+		n.acl.Store((*auth.ACL)(nil))
+		return nil
+	}
+	acl, err := auth.LoadACLFile(fileName)
+	if err != nil {
+		return err
+	}
+	n.acl.Store(acl)
+	nsqLog.Logf("acl loaded from %v with %v rules", fileName, len(acl.Rules))
+	return nil
+}
+
+func (n *NSQD) ReloadACL() error {
+	return n.loadACL(n.GetOpts().ACLFile)
+}
+
+func (n *NSQD) GetACL() *auth.ACL {
+	acl, _ := n.acl.Load().(*auth.ACL)
+	return acl
+}
+
+// CheckACL returns whether the identity is allowed to do the operation on the
+// topic, the denied operation will be counted.
+func (n *NSQD) CheckACL(identity string, topic string, op string) bool {
+	acl := n.GetACL()
+	if acl == nil {
+		return true
+	}
+	if acl.IsAllowed(identity, topic, op) {
+		return true
+	}
+	n.aclDenied.incr(topic, op, len(n.GetTopicPartitions(topic)) > 0)
+	nsqLog.Debugf("acl denied %v on topic %v for identity %q", op, topic, identity)
+	return false
+}
+
+func (n *NSQD) GetACLDeniedStats(topic string) map[string]int64 {
+	return n.aclDenied.getTopicStats(topic)
+}
+
+func (n *NSQD) GetACLDeniedTotalStats() map[string]int64 {
+	return n.aclDenied.getTotalStats()
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"path"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -22,6 +23,8 @@ const (
 	resetReaderTimeoutSec = 10
 	MAX_MEM_REQ_TIMES     = 10
 	MaxWaitingDelayed     = 100
+	// log the reload failure of the spilled message once for each interval
+	maxSpillReloadLogInterval = 100
 )
 
 var (
@@ -32,6 +35,7 @@ var (
 	ErrMsgDeferred                    = errors.New("Message is deferred")
 	ErrSetConsumeOffsetNotFirstClient = errors.New("consume offset can only be changed by the first consume client")
 	ErrNotDiskQueueReader             = errors.New("the consume channel is not disk queue reader")
+	ErrReqBackoffDisabled             = errors.New("the req backoff is not enabled for channel")
 )
 
 type Consumer interface {
@@ -42,6 +46,7 @@ type Consumer interface {
 	FinishedMessage()
 	Stats() ClientStats
 	Exit()
+	ExitWithReason(reason string)
 	Empty()
 	String() string
 	GetID() int64
@@ -75,8 +80,16 @@ type Channel struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	requeueCount      uint64
 	timeoutCount      uint64
+	spilledCount      uint64
 	deferredCount     int64
 	deferredFromDelay int64
+	inFlightCnt       int64
+	// the in-memory deferred count which the timeout is computed by the req backoff
+	backoffDeferredCount int64
+	// the req backoff in nanoseconds used while the client REQ without timeout,
+	// disabled if the base is 0
+	reqBackoffBase int64
+	reqBackoffMax  int64
 
 	sync.RWMutex
 
@@ -108,9 +121,13 @@ type Channel struct {
 	paused           int32
 	skipped          int32
 	ephemeral        bool
+	registered       int32
 	deleteCallback   func(*Channel)
 	deleter          sync.Once
 	moreDataCallback func(*Channel)
+	// the unix time to resume the paused channel automatically (0 if not) and the reason
+	pausedUntil  int64
+	pausedReason atomic.Value
 
 	// Stats tracking
 	e2eProcessingLatencyStream *quantile.Quantile
@@ -146,6 +163,34 @@ type Channel struct {
 
 	//channel msg stats
 	channelStatsInfo *ChannelStatsInfo
+	depthHistory     *ChannelDepthHistory
+	// copy of the clients for reading stats without lock
+	clientsSnapshot atomic.Value
+	// the *DeliveryWindow, nil means no limit for delivery time
+	deliveryWindow atomic.Value
+	// the count of the closed client connections by the disconnect reason
+	disconnectLock sync.Mutex
+	// map[string]int64, replaced on each disconnect so the stats can read it without lock
+	disconnectReasons atomic.Value
+	// the *channelSLOTracker, nil if no slo defined
+	sloTracker atomic.Value
+	// the *replayLimiter, nil if the replay messages are not limited
+	replayLimiter   atomic.Value
+	replayDelivered int64
+	replayDeferred  int64
+	// the count of the replayMsgs, for the stats without the inFlightMutex
+	replayWaiting int64
+	// the replay messages deferred by the replay rate, they are kept apart from
+	// the in-flight messages and protected by the inFlightMutex
+	replayPQ   inFlightPqueue
+	replayMsgs map[MessageID]*Message
+	// the *channelCompact, nil if not compacted
+	compact atomic.Value
+	// the progress of the ordered delivery for the stuck detection
+	orderedProgress orderedProgress
+	// the snapshot reused for reloading the spilled message body
+	spillSnapMutex sync.Mutex
+	spillSnap      *DiskQueueSnapshot
 }
 
 // NewChannel creates a new instance of the Channel type and returns a pointer
@@ -194,6 +239,14 @@ func NewChannel(topicName string, part int, channelName string, chEnd BackendQue
 
 	//initialize channel stats
 	c.channelStatsInfo = &ChannelStatsInfo{}
+	if opt.DepthHistoryInterval > 0 {
+		c.depthHistory = NewChannelDepthHistory(int(opt.DepthHistoryRetention/opt.DepthHistoryInterval) + 1)
+	}
+	c.clientsSnapshot.Store(make([]Consumer, 0))
+	c.deliveryWindow.Store((*DeliveryWindow)(nil))
+	c.sloTracker.Store((*channelSLOTracker)(nil))
+	c.replayLimiter.Store((*replayLimiter)(nil))
+	c.compact.Store((*channelCompact)(nil))
 
 	c.initPQ()
 
@@ -332,6 +385,234 @@ func (c *Channel) IsEphemeral() bool {
 	return c.ephemeral
 }
 
+// IsRegistered returns true if the channel is pre-registered by the admin API,
+// false if it is created implicitly by the consumer.
+func (c *Channel) IsRegistered() bool {
+	return atomic.LoadInt32(&c.registered) == 1
+}
+
+func (c *Channel) SetRegistered(registered bool) {
+	if registered {
+		atomic.StoreInt32(&c.registered, 1)
+	} else {
+		atomic.StoreInt32(&c.registered, 0)
+	}
+}
+
+func (c *Channel) getPolicy() channelPolicy {
+	base, max := c.GetReqBackoff()
+	return channelPolicy{
+		Registered:     c.IsRegistered(),
+		ReqBackoffBase: base,
+		ReqBackoffMax:  max,
+		DeliveryWindow: c.GetDeliveryWindow(),
+		ReplayRate:     c.GetReplayRate(),
+		Compacted:      c.IsCompacted(),
+	}
+}
+
+// applyPolicy changes the channel settings to the policy synced from the leader,
+// it returns true if anything changed.
+func (c *Channel) applyPolicy(p *channelPolicy) bool {
+	old := c.getPolicy()
+	if old.Registered == p.Registered && old.ReqBackoffBase == p.ReqBackoffBase &&
+		old.ReqBackoffMax == p.ReqBackoffMax && old.DeliveryWindow.equal(p.DeliveryWindow) &&
+		old.ReplayRate == p.ReplayRate && old.Compacted == p.Compacted {
+		return false
+	}
+	c.SetRegistered(p.Registered)
+	c.SetReqBackoff(p.ReqBackoffBase, p.ReqBackoffMax)
+	if err := c.SetDeliveryWindow(p.DeliveryWindow); err != nil {
+		nsqLog.LogWarningf("channel %v failed to apply the delivery window %v: %v", c.GetName(), p.DeliveryWindow, err)
+	}
+	if err := c.SetReplayRate(p.ReplayRate); err != nil {
+		nsqLog.LogWarningf("channel %v failed to apply the replay rate %v: %v", c.GetName(), p.ReplayRate, err)
+	}
+	// the snapshot will be built again if enabled again
+	if old.Compacted != p.Compacted {
+		c.SetCompacted(p.Compacted)
+	}
+	return true
+}
+
+func (c *Channel) GetDeliveryWindow() *DeliveryWindow {
+	return c.deliveryWindow.Load().(*DeliveryWindow)
+}
+
+// SetDeliveryWindow limits the delivery time of day for the channel,
+// nil will remove the limit.
+func (c *Channel) SetDeliveryWindow(w *DeliveryWindow) error {
+	if w != nil {
+		// parse again since the window may be loaded from the json meta
+		var err error
+		w, err = ParseDeliveryWindow(w.Start, w.End, w.Timezone)
+		if err != nil {
+			return err
+		}
+	}
+	c.deliveryWindow.Store(w)
+	return nil
+}
+
+// IsInDeliveryWindow returns false if the messages should be held
+// since the time is outside the delivery window.
+func (c *Channel) IsInDeliveryWindow(now time.Time) bool {
+	w := c.GetDeliveryWindow()
+	if w == nil {
+		return true
+	}
+	return w.Contains(now)
+}
+
+func (c *Channel) getSLOTracker() *channelSLOTracker {
+	return c.sloTracker.Load().(*channelSLOTracker)
+}
+
+func (c *Channel) GetSLO() *ChannelSLO {
+	t := c.getSLOTracker()
+	if t == nil {
+		return nil
+	}
+	slo := t.slo
+	return &slo
+}
+
+// SetSLO starts tracking the compliance of the slo, nil will remove the slo.
+// The counters will be kept if the slo is not changed.
+func (c *Channel) SetSLO(slo *ChannelSLO) error {
+	if slo == nil {
+		c.sloTracker.Store((*channelSLOTracker)(nil))
+		return nil
+	}
+	newSLO := *slo
+	if err := newSLO.Validate(); err != nil {
+		return err
+	}
+	if old := c.getSLOTracker(); old != nil && old.slo == newSLO {
+		return nil
+	}
+	c.sloTracker.Store(newChannelSLOTracker(newSLO))
+	return nil
+}
+
+// GetSLOStats returns the rolling compliance of the slo, nil if no slo defined
+func (c *Channel) GetSLOStats(now time.Time) *ChannelSLOStats {
+	t := c.getSLOTracker()
+	if t == nil {
+		return nil
+	}
+	return t.stats(now)
+}
+
+// CheckSLO counts the stuck messages in flight and checks the slo, it should be
+// called periodically. The second return is false if no slo.
+func (c *Channel) CheckSLO(now time.Time) (ChannelSLOCheck, bool) {
+	t := c.getSLOTracker()
+	if t == nil {
+		return ChannelSLOCheck{}, false
+	}
+	since := now.Add(-t.slo.Latency).UnixNano()
+	var stuck int64
+	c.inFlightMutex.Lock()
+	for _, m := range c.inFlightMessages {
+		if m.Timestamp < since {
+			stuck++
+		}
+	}
+	c.inFlightMutex.Unlock()
+	return t.check(now, stuck), true
+}
+
+func (c *Channel) IncrDisconnectReason(reason string) {
+	c.disconnectLock.Lock()
+	old, _ := c.disconnectReasons.Load().(map[string]int64)
+	reasons := make(map[string]int64, len(old)+1)
+	for k, v := range old {
+		reasons[k] = v
+	}
+	reasons[reason]++
+	c.disconnectReasons.Store(reasons)
+	c.disconnectLock.Unlock()
+}
+
+func (c *Channel) GetDisconnectReasons() map[string]int64 {
+	reasons, _ := c.disconnectReasons.Load().(map[string]int64)
+	if len(reasons) == 0 {
+		return nil
+	}
+	ret := make(map[string]int64, len(reasons))
+	for k, v := range reasons {
+		ret[k] = v
+	}
+	return ret
+}
+
+// GetReqBackoff returns the backoff config used to compute the requeue timeout
+// on server, the base is 0 if disabled.
+func (c *Channel) GetReqBackoff() (time.Duration, time.Duration) {
+	return time.Duration(atomic.LoadInt64(&c.reqBackoffBase)),
+		time.Duration(atomic.LoadInt64(&c.reqBackoffMax))
+}
+
+func (c *Channel) SetReqBackoff(base time.Duration, max time.Duration) {
+	if base > 0 && max < base {
+		max = base
+	}
+	atomic.StoreInt64(&c.reqBackoffBase, int64(base))
+	atomic.StoreInt64(&c.reqBackoffMax, int64(max))
+}
+
+func (c *Channel) IsReqBackoffEnabled() bool {
+	return atomic.LoadInt64(&c.reqBackoffBase) > 0
+}
+
+// computeReqBackoff doubles the base for each attempt and limit it to the max.
+func computeReqBackoff(attempts uint16, base time.Duration, max time.Duration) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := base
+	for i := uint16(1); i < attempts; i++ {
+		backoff *= 2
+		if backoff >= max || backoff <= 0 {
+			return max
+		}
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
+
+// GetReqBackoffTimeout returns the requeue timeout computed by the attempts of
+// the in-flight message.
+func (c *Channel) GetReqBackoffTimeout(clientID int64, id MessageID) (time.Duration, error) {
+	base, max := c.GetReqBackoff()
+	if base <= 0 {
+		return 0, ErrReqBackoffDisabled
+	}
+	c.inFlightMutex.Lock()
+	msg, ok := c.inFlightMessages[id]
+	if !ok {
+		c.inFlightMutex.Unlock()
+		return 0, ErrMsgNotInFlight
+	}
+	if msg.GetClientID() != clientID {
+		c.inFlightMutex.Unlock()
+		return 0, fmt.Errorf("client does not own message %v: %v vs %v", id,
+			msg.GetClientID(), clientID)
+	}
+	attempts := msg.Attempts
+	c.inFlightMutex.Unlock()
+	return computeReqBackoff(attempts, base, max), nil
+}
+
+// DeleteAsync removes the channel from the topic in background, it will be done only
+// once for the temporary channel.
+func (c *Channel) DeleteAsync() {
+	go c.deleter.Do(func() { c.deleteCallback(c) })
+}
+
 func (c *Channel) SetDelayedQueue(dq *DelayQueue) {
 	c.delayedLock.Lock()
 	c.delayedQueue = dq
@@ -441,7 +722,12 @@ func (c *Channel) initPQ() {
 	}
 	c.inFlightMessages = make(map[MessageID]*Message, pqSize)
 	c.inFlightPQ = newInFlightPqueue(pqSize)
+	c.replayMsgs = make(map[MessageID]*Message)
+	c.replayPQ = newInFlightPqueue(1)
+	atomic.StoreInt64(&c.replayWaiting, 0)
+	atomic.StoreInt64(&c.inFlightCnt, 0)
 	atomic.StoreInt64(&c.deferredCount, 0)
+	atomic.StoreInt64(&c.backoffDeferredCount, 0)
 	c.inFlightMutex.Unlock()
 }
 
@@ -466,7 +752,7 @@ func (c *Channel) Close() error {
 // waiting in delayed inflight
 // waiting requeued
 func (c *Channel) IsWaitingMoreDiskData() bool {
-	if c.IsPaused() || c.IsConsumeDisabled() || c.IsSkipped() {
+	if c.IsPaused() || c.IsConsumeDisabled() || c.IsSkipped() || !c.IsInDeliveryWindow(time.Now()) {
 		return false
 	}
 	d, ok := c.backend.(*diskQueueReader)
@@ -479,7 +765,7 @@ func (c *Channel) IsWaitingMoreDiskData() bool {
 // waiting more data is indicated all msgs are consumed
 // if some delayed message in channel, waiting more data is not true
 func (c *Channel) IsWaitingMoreData() bool {
-	if c.IsPaused() || c.IsConsumeDisabled() || c.IsSkipped() {
+	if c.IsPaused() || c.IsConsumeDisabled() || c.IsSkipped() || !c.IsInDeliveryWindow(time.Now()) {
 		return false
 	}
 	d, ok := c.backend.(*diskQueueReader)
@@ -509,14 +795,19 @@ func (c *Channel) exit(deleted bool) error {
 
 	// this forceably closes clients, client will be removed by client before the
 	// client read loop exit.
+	reason := DisconnectServerExit
+	if deleted {
+		reason = DisconnectServerEvicted
+	}
 	c.RLock()
 	for _, client := range c.clients {
-		client.Exit()
+		client.ExitWithReason(reason)
 	}
 	c.RUnlock()
 
 	close(c.exitChan)
 	<-c.exitSyncChan
+	c.closeSpillSnapshot()
 
 	// write anything leftover to disk
 	c.flush()
@@ -567,10 +858,56 @@ func (c *Channel) DepthSize() int64 {
 	return 0
 }
 
+// GetQueueEndMsgCnt returns the total message count need to be consumed
+func (c *Channel) GetQueueEndMsgCnt() uint64 {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return uint64(atomic.LoadInt64(&d.endMsgCnt))
+	}
+	return uint64(c.backend.GetQueueReadEnd().TotalMsgCnt())
+}
+
+// GetDiskReadBytes returns the bytes read from the disk by the channel
+func (c *Channel) GetDiskReadBytes() int64 {
+	if d, ok := c.backend.(*diskQueueReader); ok {
+		return atomic.LoadInt64(&d.readBytes)
+	}
+	return 0
+}
+
 func (c *Channel) DepthTimestamp() int64 {
 	return atomic.LoadInt64(&c.waitingProcessMsgTs)
 }
 
+func (c *Channel) SampleDepthHistory(now time.Time) {
+	if c.depthHistory == nil {
+		return
+	}
+	c.depthHistory.Add(DepthSample{
+		Ts:        now.Unix(),
+		Depth:     c.Depth(),
+		DepthSize: c.DepthSize(),
+	})
+}
+
+// GetDepthAt returns the depth sample of the channel at the given unix time (in seconds)
+func (c *Channel) GetDepthAt(ts int64) (DepthSample, bool) {
+	if c.depthHistory == nil {
+		return DepthSample{}, false
+	}
+	return c.depthHistory.DepthAt(ts)
+}
+
+func (c *Channel) GetDepthHistory(since int64) []DepthSample {
+	if c.depthHistory == nil {
+		return nil
+	}
+	return c.depthHistory.Samples(since)
+}
+
+func (c *Channel) IsDepthHistoryEnabled() bool {
+	return c.depthHistory != nil
+}
+
 func (c *Channel) Pause() error {
 	return c.doPause(true)
 }
@@ -584,6 +921,7 @@ func (c *Channel) doPause(pause bool) error {
 		atomic.StoreInt32(&c.paused, 1)
 	} else {
 		atomic.StoreInt32(&c.paused, 0)
+		c.SetPauseInfo(time.Time{}, "")
 	}
 
 	c.RLock()
@@ -602,6 +940,41 @@ func (c *Channel) IsPaused() bool {
 	return atomic.LoadInt32(&c.paused) == 1
 }
 
+// SetPauseInfo records why the channel is paused and the time to resume it
+// automatically, the zero time means paused until resumed manually. The info
+// is cleared while resumed.
+func (c *Channel) SetPauseInfo(until time.Time, reason string) {
+	var ts int64
+	if !until.IsZero() {
+		ts = until.Unix()
+	}
+	atomic.StoreInt64(&c.pausedUntil, ts)
+	c.pausedReason.Store(reason)
+}
+
+func (c *Channel) GetPauseInfo() (time.Time, string) {
+	var until time.Time
+	if ts := atomic.LoadInt64(&c.pausedUntil); ts > 0 {
+		until = time.Unix(ts, 0)
+	}
+	reason, _ := c.pausedReason.Load().(string)
+	return until, reason
+}
+
+func (c *Channel) getPausedMeta() (int64, string) {
+	until, reason := c.GetPauseInfo()
+	if until.IsZero() {
+		return 0, reason
+	}
+	return until.Unix(), reason
+}
+
+// IsPauseExpired returns true if the channel is paused with the duration expired
+func (c *Channel) IsPauseExpired(now time.Time) bool {
+	ts := atomic.LoadInt64(&c.pausedUntil)
+	return ts > 0 && c.IsPaused() && now.Unix() >= ts
+}
+
 func (c *Channel) Skip() error {
 	return c.doSkip(true)
 }
@@ -909,6 +1282,7 @@ func (c *Channel) internalFinishMessage(clientID int64, clientAddr string,
 			nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "FIN_INTERNAL", msg.TraceID, msg, clientAddr, ackCost)
 		}
 	}
+	exportDeliverySpan(c.GetTopicName(), c.GetName(), msg, clientAddr, "FIN")
 	if c.e2eProcessingLatencyStream != nil {
 		c.e2eProcessingLatencyStream.Insert(msg.Timestamp)
 	}
@@ -922,6 +1296,9 @@ func (c *Channel) internalFinishMessage(clientID int64, clientAddr string,
 	}
 	c.channelStatsInfo.UpdateDelivery2ACKStats(ackCost / int64(time.Millisecond))
 	c.channelStatsInfo.UpdateChannelStats((now.UnixNano() - msg.Timestamp) / int64(time.Millisecond))
+	if t := c.getSLOTracker(); t != nil {
+		t.record(now, time.Duration(now.UnixNano()-msg.Timestamp))
+	}
 	var offset BackendOffset
 	var cnt int64
 	var changed bool
@@ -944,6 +1321,7 @@ func (c *Channel) internalFinishMessage(clientID int64, clientAddr string,
 	if isOldDeferred {
 		atomic.AddInt64(&c.deferredCount, -1)
 		atomic.StoreInt32(&msg.deferredCnt, 0)
+		c.clearBackoffDeferred(msg)
 		if clientAddr != "" {
 			// delayed message should be requeued and then send to client
 			// if some client finish delayed message directly, something may be wrong.
@@ -986,6 +1364,20 @@ func (c *Channel) isTooMuchDeferredInMem(deCnt int64) bool {
 }
 
 func (c *Channel) ShouldRequeueToEnd(clientID int64, clientAddr string, id MessageID,
+	timeout time.Duration, byClient bool) (*Message, bool) {
+	msg, toEnd := c.shouldRequeueToEnd(clientID, clientAddr, id, timeout, byClient)
+	if msg != nil && msg.bodySpilled {
+		// the copy of the spilled message need the body from disk queue
+		err := c.loadMsgCopyBody(msg)
+		if err != nil {
+			nsqLog.LogWarningf("channel %v failed to load spilled message %v: %v", c.GetName(), PrintMessage(msg), err)
+			return nil, false
+		}
+	}
+	return msg, toEnd
+}
+
+func (c *Channel) shouldRequeueToEnd(clientID int64, clientAddr string, id MessageID,
 	timeout time.Duration, byClient bool) (*Message, bool) {
 	if !byClient {
 		return nil, false
@@ -1083,6 +1475,23 @@ func (c *Channel) ShouldRequeueToEnd(clientID int64, clientAddr string, id Messa
 //     and requeue a message
 //
 func (c *Channel) RequeueMessage(clientID int64, clientAddr string, id MessageID, timeout time.Duration, byClient bool) error {
+	return c.requeueMessage(clientID, clientAddr, id, timeout, byClient, false)
+}
+
+// RequeueMessageByBackoff is the same as RequeueMessage by client, except the
+// timeout is computed by the channel req backoff.
+func (c *Channel) RequeueMessageByBackoff(clientID int64, clientAddr string, id MessageID, timeout time.Duration) error {
+	return c.requeueMessage(clientID, clientAddr, id, timeout, true, true)
+}
+
+func (c *Channel) clearBackoffDeferred(msg *Message) {
+	if atomic.CompareAndSwapInt32(&msg.backoffDeferred, 1, 0) {
+		atomic.AddInt64(&c.backoffDeferredCount, -1)
+	}
+}
+
+func (c *Channel) requeueMessage(clientID int64, clientAddr string, id MessageID, timeout time.Duration,
+	byClient bool, byBackoff bool) error {
 	c.inFlightMutex.Lock()
 	defer c.inFlightMutex.Unlock()
 	if timeout == 0 {
@@ -1101,6 +1510,7 @@ func (c *Channel) RequeueMessage(clientID int64, clientAddr string, id MessageID
 			msg.belongedConsumer.RequeuedMessage()
 			msg.belongedConsumer = nil
 		}
+		exportDeliverySpan(c.GetTopicName(), c.GetName(), msg, clientAddr, "REQ")
 		return c.doRequeue(msg, clientAddr)
 	}
 	// change the timeout for inflight
@@ -1139,10 +1549,14 @@ func (c *Channel) RequeueMessage(clientID int64, clientAddr string, id MessageID
 	atomic.AddInt64(&c.deferredCount, 1)
 	msg.pri = newTimeout.UnixNano()
 	atomic.AddInt32(&msg.deferredCnt, 1)
+	if byBackoff && atomic.CompareAndSwapInt32(&msg.backoffDeferred, 0, 1) {
+		atomic.AddInt64(&c.backoffDeferredCount, 1)
+	}
 
 	if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DEBUG {
 		nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "REQ_DEFER", msg.TraceID, msg, clientAddr, 0)
 	}
+	exportDeliverySpan(c.GetTopicName(), c.GetName(), msg, clientAddr, "REQ")
 
 	// defered message do not belong to any client
 	if msg.belongedConsumer != nil {
@@ -1199,6 +1613,28 @@ func (c *Channel) GetClients() map[int64]Consumer {
 	return results
 }
 
+// GetClientsSnapshot returns the clients without holding the channel lock,
+// it is used for stats only.
+func (c *Channel) GetClientsSnapshot() []Consumer {
+	return c.clientsSnapshot.Load().([]Consumer)
+}
+
+func (c *Channel) updateClientsSnapshotNoLock() {
+	clients := make([]Consumer, 0, len(c.clients))
+	for _, client := range c.clients {
+		clients = append(clients, client)
+	}
+	c.clientsSnapshot.Store(clients)
+}
+
+func (c *Channel) GetInFlightCount() int {
+	return int(atomic.LoadInt64(&c.inFlightCnt))
+}
+
+func (c *Channel) GetDeferredCount() int {
+	return int(atomic.LoadInt64(&c.deferredCount))
+}
+
 func (c *Channel) AddClient(clientID int64, client Consumer) error {
 	c.Lock()
 	defer c.Unlock()
@@ -1211,6 +1647,7 @@ func (c *Channel) AddClient(clientID int64, client Consumer) error {
 		return nil
 	}
 	c.clients[clientID] = client
+	c.updateClientsSnapshotNoLock()
 	return nil
 }
 
@@ -1230,6 +1667,7 @@ func (c *Channel) RemoveClient(clientID int64, clientTag string) {
 	}
 	c.clients[clientID] = nil
 	delete(c.clients, clientID)
+	c.updateClientsSnapshotNoLock()
 
 	if len(c.clients) == 0 && c.ephemeral == true {
 		go c.deleter.Do(func() { c.deleteCallback(c) })
@@ -1259,10 +1697,179 @@ func (c *Channel) StartInFlightTimeout(msg *Message, client Consumer, clientAddr
 	if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DETAIL {
 		nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "START", msg.TraceID, msg, clientAddr, now.UnixNano()-msg.Timestamp)
 	}
+	if msg.Attempts == 1 {
+		exportQueueSpan(c.GetTopicName(), c.GetName(), msg, now)
+	}
 
 	return shouldSend, nil
 }
 
+// SpillInFlightMessage releases the body of the in-flight message if there are too many
+// in-flight messages in the channel, the body will be reloaded from the disk queue
+// if the message need to be delivered again. It should be called by the client
+// which the message is just sent to, the message may be requeued and sent to the
+// other client at the same time, so only the message still belonged to the client
+// can be spilled.
+func (c *Channel) SpillInFlightMessage(clientID int64, msg *Message) bool {
+	if c.option.InFlightSpillThreshold <= 0 {
+		return false
+	}
+	// the delayed message is not in the disk queue of the topic
+	if msg.DelayedType != 0 {
+		return false
+	}
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	if int64(len(c.inFlightMessages)) <= c.option.InFlightSpillThreshold {
+		return false
+	}
+	m, ok := c.inFlightMessages[msg.ID]
+	if !ok || m != msg || m.bodySpilled || m.GetClientID() != clientID {
+		return false
+	}
+	c.spillMsgBodyNoLock(m)
+	return true
+}
+
+func (c *Channel) spillMsgBodyNoLock(m *Message) {
+	// the ext bytes share the buffer with the body while decoded from disk
+	if len(m.ExtBytes) > 0 {
+		extBytes := make([]byte, len(m.ExtBytes))
+		copy(extBytes, m.ExtBytes)
+		m.ExtBytes = extBytes
+	}
+	m.Body = nil
+	m.bodySpilled = true
+	atomic.AddUint64(&c.spilledCount, 1)
+}
+
+func (c *Channel) isMsgBodySpilled(msg *Message) bool {
+	c.inFlightMutex.Lock()
+	spilled := msg.bodySpilled
+	c.inFlightMutex.Unlock()
+	return spilled
+}
+
+// read the spilled message body from disk queue, the message is not confirmed
+// so the data will not be cleaned. The snapshot is reused and will be reopened
+// after any read error.
+func (c *Channel) readMsgBodyFromDisk(msg *Message) ([]byte, error) {
+	confirmed, ok := c.GetConfirmed().(*diskQueueEndInfo)
+	if !ok {
+		return nil, ErrInvalidOffset
+	}
+	c.spillSnapMutex.Lock()
+	defer c.spillSnapMutex.Unlock()
+	snap := c.spillSnap
+	if snap == nil {
+		snap = NewDiskQueueSnapshot(getBackendName(c.topicName, c.topicPart),
+			path.Join(c.option.DataPath, c.topicName), c.GetChannelEnd())
+		snap.queueStart = *confirmed
+		snap.readPos = *confirmed
+		c.spillSnap = snap
+	} else {
+		snap.UpdateQueueEnd(c.GetChannelEnd())
+		snap.Lock()
+		snap.queueStart = *confirmed
+		snap.Unlock()
+	}
+	err := snap.ResetSeekTo(msg.Offset)
+	if err == nil {
+		ret := snap.ReadOne()
+		err = ret.Err
+		if err == nil {
+			return decodeSpilledMsgBody(ret.Data, msg, c.IsExt())
+		}
+	}
+	snap.Close()
+	c.spillSnap = nil
+	return nil, err
+}
+
+func (c *Channel) closeSpillSnapshot() {
+	c.spillSnapMutex.Lock()
+	if c.spillSnap != nil {
+		c.spillSnap.Close()
+		c.spillSnap = nil
+	}
+	c.spillSnapMutex.Unlock()
+}
+
+func decodeSpilledMsgBody(data []byte, msg *Message, isExt bool) ([]byte, error) {
+	m, err := DecodeMessage(data, isExt)
+	if err != nil {
+		return nil, err
+	}
+	if m.ID != msg.ID {
+		return nil, fmt.Errorf("message id mismatch at offset %v: %v vs %v", msg.Offset, m.ID, msg.ID)
+	}
+	return m.Body, nil
+}
+
+// PeekMessages reads the messages waiting to be consumed from the confirmed position,
+// the messages already in flight or confirmed out of order may also be included.
+func (c *Channel) PeekMessages(limit int, maxBytes int64) ([]PeekedMessage, error) {
+	confirmed, ok := c.GetConfirmed().(*diskQueueEndInfo)
+	if !ok {
+		return nil, ErrInvalidOffset
+	}
+	snap := NewDiskQueueSnapshot(getBackendName(c.topicName, c.topicPart),
+		path.Join(c.option.DataPath, c.topicName), c.GetChannelEnd())
+	snap.SetQueueStart(confirmed)
+	return peekMessagesFromSnapshot(snap, confirmed.Offset(), limit, maxBytes, c.IsExt())
+}
+
+// reload the body of the spilled message, the message is never skipped while the
+// reload failed since it is not delivered yet, and the failed times is returned.
+func (c *Channel) reloadSpilledMsgBody(msg *Message) (int, error) {
+	body, err := c.readMsgBodyFromDisk(msg)
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	if err != nil {
+		msg.spillReloadErrs++
+		return msg.spillReloadErrs, err
+	}
+	msg.Body = body
+	msg.bodySpilled = false
+	msg.spillReloadErrs = 0
+	return 0, nil
+}
+
+// GetOldestSpilledOffset returns the min offset of the messages whose body is
+// spilled, the data from the offset should not be cleaned since the body will
+// be reloaded from it.
+func (c *Channel) GetOldestSpilledOffset() (BackendOffset, bool) {
+	if atomic.LoadUint64(&c.spilledCount) == 0 {
+		return 0, false
+	}
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	var oldest BackendOffset
+	found := false
+	for _, msgs := range []map[MessageID]*Message{c.inFlightMessages,
+		c.waitingRequeueMsgs, c.waitingRequeueChanMsgs, c.replayMsgs} {
+		for _, m := range msgs {
+			if m.bodySpilled && (!found || m.Offset < oldest) {
+				oldest = m.Offset
+				found = true
+			}
+		}
+	}
+	return oldest, found
+}
+
+// load the body for the copy of the spilled message, the copy is not shared
+// so no lock needed
+func (c *Channel) loadMsgCopyBody(copyMsg *Message) error {
+	body, err := c.readMsgBodyFromDisk(copyMsg)
+	if err != nil {
+		return err
+	}
+	copyMsg.Body = body
+	copyMsg.bodySpilled = false
+	return nil
+}
+
 func (c *Channel) GetInflightNum() int {
 	c.inFlightMutex.Lock()
 	n := len(c.inFlightMessages)
@@ -1351,6 +1958,7 @@ func (c *Channel) pushInFlightMessage(msg *Message) (*Message, error) {
 		return m, ErrMsgAlreadyInFlight
 	}
 	c.inFlightMessages[msg.ID] = msg
+	atomic.AddInt64(&c.inFlightCnt, 1)
 	c.inFlightPQ.Push(msg)
 	if _, ok := c.waitingRequeueChanMsgs[msg.ID]; ok {
 		c.waitingRequeueChanMsgs[msg.ID] = nil
@@ -1375,6 +1983,7 @@ func (c *Channel) popInFlightMessage(clientID int64, id MessageID, force bool) (
 	}
 	c.inFlightMessages[id] = nil
 	delete(c.inFlightMessages, id)
+	atomic.AddInt64(&c.inFlightCnt, -1)
 	if msg.index != -1 {
 		c.inFlightPQ.Remove(msg.index)
 	}
@@ -1394,9 +2003,10 @@ func (c *Channel) DisableConsume(disable bool) {
 		}
 		nsqLog.Logf("channel %v disabled for consume", c.name)
 		for cid, client := range c.clients {
-			client.Exit()
+			client.ExitWithReason(DisconnectServerEvicted)
 			delete(c.clients, cid)
 		}
+		c.updateClientsSnapshotNoLock()
 		needClearConfirm := false
 		if c.IsOrdered() {
 			needClearConfirm = true
@@ -1618,7 +2228,7 @@ LOOP:
 				needClearConfirm := false
 				if atomic.LoadInt32(&c.waitingConfirm) > maxWin {
 					c.inFlightMutex.Lock()
-					inflightCnt := len(c.inFlightMessages)
+					inflightCnt := len(c.inFlightMessages) + len(c.replayMsgs)
 					inflightCnt += len(c.waitingRequeueMsgs)
 					inflightCnt += len(c.waitingRequeueChanMsgs)
 					c.inFlightMutex.Unlock()
@@ -1653,7 +2263,7 @@ LOOP:
 			needReadBackend = false
 
 			c.inFlightMutex.Lock()
-			inflightCnt := len(c.inFlightMessages)
+			inflightCnt := len(c.inFlightMessages) + len(c.replayMsgs)
 			inflightCnt += len(c.waitingRequeueMsgs)
 			inflightCnt += len(c.waitingRequeueChanMsgs)
 			c.inFlightMutex.Unlock()
@@ -1708,6 +2318,25 @@ LOOP:
 				nsqLog.LogDebugf("read message %v from requeue", msg.ID)
 				nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "READ_REQ", msg.TraceID, msg, "0", 0)
 			}
+			if c.isMsgBodySpilled(msg) {
+				var failed int
+				failed, err = c.reloadSpilledMsgBody(msg)
+				if err != nil {
+					if failed%maxSpillReloadLogInterval == 1 {
+						nsqLog.LogErrorf("channel %v failed to reload spilled message %v (%v times): %v",
+							c.GetName(), PrintMessage(msg), failed, err)
+					}
+					// put back to waiting requeue and retry later
+					c.inFlightMutex.Lock()
+					if _, ok := c.waitingRequeueChanMsgs[msg.ID]; ok {
+						delete(c.waitingRequeueChanMsgs, msg.ID)
+						c.waitingRequeueMsgs[msg.ID] = msg
+					}
+					c.inFlightMutex.Unlock()
+					time.Sleep(time.Millisecond * 100)
+					continue
+				}
+			}
 		case data = <-readChan:
 			lastDataNeedRead = false
 			if data.Err != nil {
@@ -1817,6 +2446,16 @@ LOOP:
 			c.CleanWaitingRequeueChan(msg)
 			continue LOOP
 		}
+		if c.skipCompactSuperseded(msg) {
+			c.ConfirmBackendQueue(msg)
+			c.CleanWaitingRequeueChan(msg)
+			continue LOOP
+		}
+		// the live messages will be delivered first while the replay is limited
+		if c.deferReplayIfLimited(msg) {
+			msg = nil
+			continue LOOP
+		}
 
 		atomic.StoreInt32(&c.waitingDeliveryState, 1)
 		//atomic.StoreInt32(&msg.deferredCnt, 0)
@@ -1912,6 +2551,70 @@ func parseTagIfAny(msg *Message) (string, error) {
 	return msgTag, err
 }
 
+type InFlightMessageInfo struct {
+	ID           uint64 `json:"id"`
+	TraceID      uint64 `json:"trace_id"`
+	Offset       int64  `json:"offset"`
+	Attempts     uint16 `json:"attempts"`
+	ClientID     int64  `json:"client_id"`
+	ClientAddr   string `json:"client_addr"`
+	Deferred     bool   `json:"deferred"`
+	DelayedType  int32  `json:"delayed_type"`
+	DeliveryTS   int64  `json:"delivery_ts"`
+	TimeoutTS    int64  `json:"timeout_ts"`
+	InFlightTime string `json:"in_flight_time"`
+}
+
+type InFlightMessageInfoByDelivery []InFlightMessageInfo
+
+func (s InFlightMessageInfoByDelivery) Len() int           { return len(s) }
+func (s InFlightMessageInfoByDelivery) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s InFlightMessageInfoByDelivery) Less(i, j int) bool { return s[i].DeliveryTS < s[j].DeliveryTS }
+
+// GetInFlightMessagesInfo returns the in-flight (including the deferred) messages
+// ordered by the delivery time, so the messages in flight for the longest time
+// will be returned first if limited.
+func (c *Channel) GetInFlightMessagesInfo(limit int) []InFlightMessageInfo {
+	now := time.Now()
+	c.inFlightMutex.Lock()
+	ret := make([]InFlightMessageInfo, 0, len(c.inFlightMessages))
+	for _, msg := range c.inFlightMessages {
+		ret = append(ret, InFlightMessageInfo{
+			ID:           uint64(msg.ID),
+			TraceID:      msg.TraceID,
+			Offset:       int64(msg.Offset),
+			Attempts:     msg.Attempts,
+			ClientID:     msg.GetClientID(),
+			Deferred:     msg.IsDeferred(),
+			DelayedType:  msg.DelayedType,
+			DeliveryTS:   msg.deliveryTS.UnixNano(),
+			TimeoutTS:    msg.pri,
+			InFlightTime: now.Sub(msg.deliveryTS).String(),
+		})
+	}
+	c.inFlightMutex.Unlock()
+	sort.Sort(InFlightMessageInfoByDelivery(ret))
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+	// fill the client address so we can find the client in the channel stats
+	addrs := make(map[int64]string)
+	for i, info := range ret {
+		addr, ok := addrs[info.ClientID]
+		if !ok {
+			c.RLock()
+			client, exist := c.clients[info.ClientID]
+			c.RUnlock()
+			if exist {
+				addr = client.Stats().RemoteAddress
+			}
+			addrs[info.ClientID] = addr
+		}
+		ret[i].ClientAddr = addr
+	}
+	return ret
+}
+
 func (c *Channel) GetChannelDebugStats() string {
 	c.inFlightMutex.Lock()
 	inFlightCount := len(c.inFlightMessages)
@@ -1966,7 +2669,7 @@ func (c *Channel) processInFlightQueue(tnow int64) (bool, bool) {
 		}
 
 		msg, _ := c.inFlightPQ.PeekAndShift(tnow)
-		flightCnt = len(c.inFlightMessages)
+		flightCnt = len(c.inFlightMessages) + len(c.replayMsgs)
 		if msg == nil {
 			if atomic.LoadInt32(&c.waitingConfirm) > 1 || flightCnt > 1 {
 				nsqLog.LogDebugf("channel %v no timeout, inflight %v, waiting confirm: %v, confirmed: %v",
@@ -2002,7 +2705,15 @@ func (c *Channel) processInFlightQueue(tnow int64) (bool, bool) {
 						}
 						if toEnd {
 							copyMsg := blockingMsg.GetCopy()
-							c.nsqdNotify.ReqToEnd(c, copyMsg, time.Duration(copyMsg.pri-time.Now().UnixNano()))
+							var err error
+							if copyMsg.bodySpilled {
+								err = c.loadMsgCopyBody(copyMsg)
+							}
+							if err != nil {
+								nsqLog.LogWarningf("channel %v failed to load spilled message %v: %v", c.GetName(), PrintMessage(copyMsg), err)
+							} else {
+								c.nsqdNotify.ReqToEnd(c, copyMsg, time.Duration(copyMsg.pri-time.Now().UnixNano()))
+							}
 						}
 					}
 				}
@@ -2019,12 +2730,17 @@ func (c *Channel) processInFlightQueue(tnow int64) (bool, bool) {
 		}
 		c.inFlightMessages[msg.ID] = nil
 		delete(c.inFlightMessages, msg.ID)
+		atomic.AddInt64(&c.inFlightCnt, -1)
 		// note: if this message is deferred by client, we treat it as a delay message,
 		// so we consider it is by demanded to delay not timeout of message.
 		if msg.IsDeferred() {
 			atomic.AddInt64(&c.deferredCount, -1)
+			c.clearBackoffDeferred(msg)
 		} else {
 			atomic.AddUint64(&c.timeoutCount, 1)
+			if t := c.getSLOTracker(); t != nil {
+				t.recordTimeout(time.Unix(0, tnow))
+			}
 		}
 		client := msg.belongedConsumer
 		if msg.belongedConsumer != nil {
@@ -2051,9 +2767,16 @@ func (c *Channel) processInFlightQueue(tnow int64) (bool, bool) {
 				nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "TIMEOUT", msgCopy.TraceID, &msgCopy, clientAddr, cost)
 			}
 		}
+		// the deferred message is already exported while requeued by the client
+		if !msgCopy.IsDeferred() && client != nil {
+			exportDeliverySpan(c.GetTopicName(), c.GetName(), &msgCopy, client.String(), "TIMEOUT")
+		}
 	}
 
 exit:
+	if c.requeueDeferredReplay(tnow) > 0 {
+		dirty = true
+	}
 	// try requeue the messages that waiting.
 	stopScan := false
 	c.inFlightMutex.Lock()
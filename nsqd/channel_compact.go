@@ -0,0 +1,224 @@
+package nsqd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path"
+	"sync"
+	"sync/atomic"
+
+	simpleJson "github.com/bitly/go-simplejson"
+	"github.com/youzan/nsq/internal/ext"
+)
+
+const (
+	CompactStateBuilding  = "building"
+	CompactStateSnapshot  = "snapshot"
+	CompactStateFollowing = "following"
+)
+
+// the max keys in the snapshot, the channel will follow the updates without the
+// snapshot if too many keys to avoid using too much memory.
+var maxCompactSnapshotKeys = 1024 * 1024
+
+var errCompactTooManyKeys = errors.New("too many keys in the compact snapshot")
+
+var compactKeyBytes = []byte(`"` + ext.COMPACT_KEY + `"`)
+
+// GetCompactKey returns the key of the message in the compacted topic, the key is
+// given by the json header, such as {"##compact_key":"user-1001"}.
+func GetCompactKey(msg *Message) string {
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return ""
+	}
+	if !bytes.Contains(msg.ExtBytes, compactKeyBytes) {
+		return ""
+	}
+	jsonExt, err := simpleJson.NewJson(msg.ExtBytes)
+	if err != nil {
+		return ""
+	}
+	key, _ := jsonExt.Get(ext.COMPACT_KEY).String()
+	return key
+}
+
+// channelCompact delivers the latest value of each key before the snapshot end first,
+// the old values before the snapshot end will be skipped. After the snapshot is
+// delivered, all the new updates will be delivered as normal. The delivery is held
+// while the snapshot is building so no old value will be delivered.
+type channelCompact struct {
+	sync.Mutex
+	built     bool
+	following bool
+	start     BackendOffset
+	end       BackendOffset
+	latest    map[string]BackendOffset
+	skipped   int64
+	// the *ChannelCompactStats without skipped, replaced while the state changed
+	// so the stats will not wait the lock used by the delivery
+	stats atomic.Value
+}
+
+// updateStatsNoLock should be called with the compact locked after the state changed
+func (cc *channelCompact) updateStatsNoLock() {
+	s := &ChannelCompactStats{
+		State:       CompactStateSnapshot,
+		SnapshotEnd: int64(cc.end),
+		Keys:        len(cc.latest),
+	}
+	if cc.following {
+		s.State = CompactStateFollowing
+	} else if !cc.built {
+		s.State = CompactStateBuilding
+	}
+	cc.stats.Store(s)
+}
+
+type ChannelCompactStats struct {
+	State       string `json:"state"`
+	SnapshotEnd int64  `json:"snapshot_end"`
+	Keys        int    `json:"keys"`
+	Skipped     int64  `json:"skipped"`
+}
+
+func (c *Channel) getCompact() *channelCompact {
+	return c.compact.Load().(*channelCompact)
+}
+
+func (c *Channel) IsCompacted() bool {
+	return c.getCompact() != nil
+}
+
+// SetCompacted enables the channel to bootstrap from the snapshot of the latest
+// value per key, the snapshot will be built again if enabled again.
+func (c *Channel) SetCompacted(enable bool) {
+	if !enable {
+		c.compact.Store((*channelCompact)(nil))
+		return
+	}
+	cc := &channelCompact{}
+	cc.updateStatsNoLock()
+	c.compact.Store(cc)
+}
+
+func (c *Channel) GetCompactStats() *ChannelCompactStats {
+	cc := c.getCompact()
+	if cc == nil {
+		return nil
+	}
+	s := *cc.stats.Load().(*ChannelCompactStats)
+	s.Skipped = atomic.LoadInt64(&cc.skipped)
+	return &s
+}
+
+// skipCompactSuperseded returns true if the message has the newer value of the same
+// key before the snapshot end, the snapshot is built while reading the first message
+// and the delivery is held until built.
+func (c *Channel) skipCompactSuperseded(msg *Message) bool {
+	cc := c.getCompact()
+	if cc == nil || msg.DelayedType == ChannelDelayed {
+		return false
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	if cc.following {
+		return false
+	}
+	if !cc.built || msg.Offset < cc.start {
+		// the reader is reset to the old position, build again to keep the latest
+		c.buildCompactSnapshotNoLock(cc, msg.Offset)
+		if cc.following {
+			return false
+		}
+	}
+	if msg.Offset >= cc.end {
+		cc.following = true
+		cc.latest = nil
+		cc.updateStatsNoLock()
+		nsqLog.Logf("channel %v compact snapshot delivered, following the new updates from %v",
+			c.GetName(), msg.Offset)
+		return false
+	}
+	key := GetCompactKey(msg)
+	if key == "" {
+		return false
+	}
+	if offset, ok := cc.latest[key]; ok && offset != msg.Offset {
+		atomic.AddInt64(&cc.skipped, 1)
+		return true
+	}
+	// the deleted key with the empty value is no need in the snapshot
+	if len(msg.Body) == 0 {
+		atomic.AddInt64(&cc.skipped, 1)
+		return true
+	}
+	return false
+}
+
+// buildCompactSnapshotNoLock should be called with the compact locked, the old
+// snapshot is dropped while building. It is called in the message pump, so the
+// message read will not be delivered until the snapshot is built.
+func (c *Channel) buildCompactSnapshotNoLock(cc *channelCompact, from BackendOffset) {
+	cc.built = false
+	cc.latest = nil
+	cc.updateStatsNoLock()
+	latest, end, err := c.buildCompactSnapshot(from)
+	if err != nil {
+		// deliver all the messages without compacted if failed
+		nsqLog.LogWarningf("channel %v failed to build the compact snapshot from %v: %v",
+			c.GetName(), from, err)
+		cc.following = true
+		cc.updateStatsNoLock()
+		return
+	}
+	cc.built = true
+	cc.start = from
+	cc.end = end
+	cc.latest = latest
+	cc.updateStatsNoLock()
+	nsqLog.Logf("channel %v compact snapshot built from %v to %v, keys: %v",
+		c.GetName(), cc.start, cc.end, len(cc.latest))
+}
+
+// buildCompactSnapshot reads the committed messages from the offset and returns the
+// latest offset of each key and the end of the snapshot.
+func (c *Channel) buildCompactSnapshot(from BackendOffset) (map[string]BackendOffset, BackendOffset, error) {
+	latest := make(map[string]BackendOffset)
+	d, ok := c.backend.(*diskQueueReader)
+	if !ok {
+		return latest, from, nil
+	}
+	end := c.GetChannelEnd()
+	snap := NewDiskQueueSnapshot(getBackendName(c.topicName, c.topicPart),
+		path.Join(c.option.DataPath, c.topicName), end)
+	defer snap.Close()
+	snap.SetQueueStart(d.GetQueueConfirmed())
+	err := snap.SeekTo(from)
+	if err != nil {
+		return nil, 0, err
+	}
+	for {
+		if c.Exiting() {
+			return nil, 0, ErrExiting
+		}
+		data := snap.ReadOne()
+		if data.Err != nil {
+			if data.Err == io.EOF {
+				break
+			}
+			return nil, 0, data.Err
+		}
+		msg, err := decodeMessage(data.Data, c.IsExt())
+		if err != nil {
+			return nil, 0, err
+		}
+		if key := GetCompactKey(msg); key != "" {
+			latest[key] = data.Offset
+			if len(latest) > maxCompactSnapshotKeys {
+				return nil, 0, errCompactTooManyKeys
+			}
+		}
+	}
+	return latest, end.Offset(), nil
+}
@@ -0,0 +1,171 @@
+package nsqd
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OrderedConsumeStats is the progress of the ordered channel, the blocking message
+// is the in-flight message at the confirmed offset which the ordered delivery is
+// waiting for.
+type OrderedConsumeStats struct {
+	ConfirmedOffset int64 `json:"confirmed_offset" pb:"1"`
+	// the blocking message, the id is 0 if the message is not in flight
+	BlockingMsgID   uint64 `json:"blocking_msg_id" pb:"2"`
+	BlockingOffset  int64  `json:"blocking_offset" pb:"3"`
+	BlockingAttempt uint16 `json:"blocking_attempts" pb:"4"`
+	// the unix time of the last advance of the confirmed offset, and the duration
+	// (in milliseconds) blocked since then
+	BlockedSince int64 `json:"blocked_since" pb:"5"`
+	BlockedMs    int64 `json:"blocked_ms" pb:"6"`
+	// the ordered delivery is not advanced in the stuck timeout
+	Stuck      bool  `json:"stuck" pb:"7"`
+	StuckSince int64 `json:"stuck_since,omitempty" pb:"8"`
+}
+
+// OrderedStuckCheck is the result of the stuck check which the state changed
+type OrderedStuckCheck struct {
+	Stuck   bool
+	Changed bool
+	Stats   OrderedConsumeStats
+}
+
+type orderedProgress struct {
+	sync.Mutex
+	confirmed   int64
+	lastAdvance time.Time
+	stuckSince  int64
+	// the *orderedStatsSnapshot of the last check, so the stats never lock the
+	// in-flight messages
+	stats atomic.Value
+}
+
+type orderedStatsSnapshot struct {
+	stats       OrderedConsumeStats
+	lastAdvance time.Time
+}
+
+func (p *orderedProgress) storeStats(stats OrderedConsumeStats) {
+	p.stats.Store(&orderedStatsSnapshot{stats: stats, lastAdvance: p.lastAdvance})
+}
+
+// getBlockingMsg returns the in-flight message with the min offset, the ordered
+// delivery can not advance until it is confirmed.
+func (c *Channel) getBlockingMsg() (MessageID, BackendOffset, uint16, bool) {
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	var blocking *Message
+	for _, m := range c.inFlightMessages {
+		if blocking == nil || m.Offset < blocking.Offset {
+			blocking = m
+		}
+	}
+	if blocking == nil {
+		return 0, 0, 0, false
+	}
+	return blocking.ID, blocking.Offset, blocking.Attempts, true
+}
+
+// hasOrderedBacklog returns false if nothing to deliver, so the ordered channel is
+// not blocked.
+func (c *Channel) hasOrderedBacklog() bool {
+	return c.Depth() > 0 || c.GetInflightNum() > 0
+}
+
+// refreshOrderedProgress updates the last advance time if the confirmed offset
+// changed, should be locked.
+func (c *Channel) refreshOrderedProgress(p *orderedProgress, now time.Time) int64 {
+	confirmed := int64(0)
+	if e := c.GetConfirmed(); e != nil {
+		confirmed = int64(e.Offset())
+	}
+	if p.lastAdvance.IsZero() || confirmed != p.confirmed || !c.hasOrderedBacklog() {
+		p.confirmed = confirmed
+		p.lastAdvance = now
+	}
+	return confirmed
+}
+
+func (c *Channel) buildOrderedStats(p *orderedProgress, now time.Time) OrderedConsumeStats {
+	s := OrderedConsumeStats{
+		ConfirmedOffset: c.refreshOrderedProgress(p, now),
+		BlockedSince:    p.lastAdvance.Unix(),
+		BlockedMs:       int64(now.Sub(p.lastAdvance) / time.Millisecond),
+		Stuck:           p.stuckSince != 0,
+		StuckSince:      p.stuckSince,
+	}
+	if id, offset, attempts, ok := c.getBlockingMsg(); ok {
+		s.BlockingMsgID = uint64(id)
+		s.BlockingOffset = int64(offset)
+		s.BlockingAttempt = attempts
+	}
+	return s
+}
+
+// CheckOrderedStuck marks the ordered channel as stuck if the confirmed offset is
+// not advanced in the timeout while there are messages to deliver. The paused or
+// skipped channel is not stuck since it is stopped by the operator.
+func (c *Channel) CheckOrderedStuck(timeout time.Duration, now time.Time) OrderedStuckCheck {
+	p := &c.orderedProgress
+	p.Lock()
+	defer p.Unlock()
+	if !c.IsOrdered() || timeout <= 0 || c.IsPaused() || c.IsSkipped() {
+		// restart the progress after the channel resumed
+		p.lastAdvance = time.Time{}
+		changed := p.stuckSince != 0
+		p.stuckSince = 0
+		if c.IsOrdered() {
+			p.storeStats(c.buildOrderedStats(p, now))
+		}
+		return OrderedStuckCheck{Changed: changed}
+	}
+	stats := c.buildOrderedStats(p, now)
+	wasStuck := p.stuckSince != 0
+	stuck := now.Sub(p.lastAdvance) >= timeout
+	if stuck && !wasStuck {
+		p.stuckSince = now.Unix()
+	} else if !stuck {
+		p.stuckSince = 0
+	}
+	stats.Stuck = stuck
+	stats.StuckSince = p.stuckSince
+	p.storeStats(stats)
+	return OrderedStuckCheck{Stuck: stuck, Changed: stuck != wasStuck, Stats: stats}
+}
+
+// GetOrderedStats returns nil if the channel is not ordered. The blocking message
+// is the one found by the last stuck check, and the blocked duration is counted
+// to now.
+func (c *Channel) GetOrderedStats() *OrderedConsumeStats {
+	return c.getOrderedStats(time.Now())
+}
+
+func (c *Channel) getOrderedStats(now time.Time) *OrderedConsumeStats {
+	if !c.IsOrdered() {
+		return nil
+	}
+	p := &c.orderedProgress
+	last, ok := p.stats.Load().(*orderedStatsSnapshot)
+	if !ok {
+		// build the first snapshot before the stuck check
+		p.Lock()
+		p.storeStats(c.buildOrderedStats(p, now))
+		p.Unlock()
+		last = p.stats.Load().(*orderedStatsSnapshot)
+	}
+	confirmed := int64(0)
+	if e := c.GetConfirmed(); e != nil {
+		confirmed = int64(e.Offset())
+	}
+	if confirmed != last.stats.ConfirmedOffset || !c.hasOrderedBacklog() {
+		// advanced since the last check, so it is not blocked
+		return &OrderedConsumeStats{
+			ConfirmedOffset: confirmed,
+			BlockedSince:    now.Unix(),
+		}
+	}
+	s := last.stats
+	s.BlockedMs = int64(now.Sub(last.lastAdvance) / time.Millisecond)
+	return &s
+}
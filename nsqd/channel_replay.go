@@ -0,0 +1,229 @@
+package nsqd
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	simpleJson "github.com/bitly/go-simplejson"
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/levellogger"
+)
+
+const (
+	// the delay for the replay message deferred by the rate limit
+	replayDeferDelay = time.Second
+)
+
+// the body of the deferred replay message is released while too many replay messages
+// deferred in memory, and reloaded from the disk queue while requeued
+var maxReplayWaiting = 1000
+
+var ErrInvalidReplayRate = errors.New("invalid replay rate")
+
+var replayKeyBytes = []byte(`"` + ext.REPLAY_KEY + `"`)
+
+// IsReplayMessage returns true if the message is tagged as the replay or backfill
+// traffic by the json header, such as {"##replay":"backfill-20180101"}.
+func IsReplayMessage(msg *Message) bool {
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return false
+	}
+	if !bytes.Contains(msg.ExtBytes, replayKeyBytes) {
+		return false
+	}
+	jsonExt, err := simpleJson.NewJson(msg.ExtBytes)
+	if err != nil {
+		return false
+	}
+	v, exist := jsonExt.CheckGet(ext.REPLAY_KEY)
+	if !exist {
+		return false
+	}
+	if s, err := v.String(); err == nil {
+		return s != "" && s != "false"
+	}
+	b, err := v.Bool()
+	return err == nil && b
+}
+
+// the token bucket allows the burst of one second
+type replayLimiter struct {
+	sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newReplayLimiter(rate int64) *replayLimiter {
+	return &replayLimiter{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (l *replayLimiter) allow(now time.Time) bool {
+	return l.allowN(now, 1)
+}
+
+// allowN takes n tokens, the batch larger than the burst is allowed while the bucket
+// is full and the tokens will be negative until refilled.
+func (l *replayLimiter) allowN(now time.Time, n int64) bool {
+	l.Lock()
+	defer l.Unlock()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	if l.tokens < float64(n) && l.tokens < float64(l.rate) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// takeN takes n tokens even if not enough, so the later calls will be limited
+func (l *replayLimiter) takeN(now time.Time, n int64) {
+	l.Lock()
+	defer l.Unlock()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+}
+
+func (c *Channel) getReplayLimiter() *replayLimiter {
+	return c.replayLimiter.Load().(*replayLimiter)
+}
+
+// GetReplayRate returns the max replay messages delivered per second, 0 means no limit.
+func (c *Channel) GetReplayRate() int64 {
+	l := c.getReplayLimiter()
+	if l == nil {
+		return 0
+	}
+	return l.rate
+}
+
+// SetReplayRate limits the delivery of the replay messages so the live messages
+// will be delivered first while the replay is writing to the topic.
+func (c *Channel) SetReplayRate(rate int64) error {
+	if rate < 0 {
+		return ErrInvalidReplayRate
+	}
+	if rate == 0 {
+		c.replayLimiter.Store((*replayLimiter)(nil))
+		return nil
+	}
+	if c.GetReplayRate() == rate {
+		return nil
+	}
+	c.replayLimiter.Store(newReplayLimiter(rate))
+	return nil
+}
+
+func (c *Channel) GetReplayStats() (int64, int64) {
+	return atomic.LoadInt64(&c.replayDelivered), atomic.LoadInt64(&c.replayDeferred)
+}
+
+// GetReplayWaiting returns the deferred replay messages waiting to retry
+func (c *Channel) GetReplayWaiting() int64 {
+	return atomic.LoadInt64(&c.replayWaiting)
+}
+
+// deferReplayIfLimited returns true if the replay message is deferred since exceeding
+// the replay rate, the deferred message is kept in the replay queue apart from the
+// in-flight messages and will be requeued after the delay to be checked again. The
+// reader is never held by the replay queue so the live messages can go first, the
+// body is spilled instead while the replay queue is full.
+func (c *Channel) deferReplayIfLimited(msg *Message) bool {
+	l := c.getReplayLimiter()
+	if l == nil || c.IsOrdered() || msg.DelayedType == ChannelDelayed {
+		return false
+	}
+	if !IsReplayMessage(msg) {
+		return false
+	}
+	now := time.Now()
+	if l.allow(now) {
+		atomic.AddInt64(&c.replayDelivered, 1)
+		return false
+	}
+
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	if c.IsConsumeDisabled() {
+		return false
+	}
+	if _, ok := c.inFlightMessages[msg.ID]; ok {
+		return false
+	}
+	if _, ok := c.replayMsgs[msg.ID]; ok {
+		return false
+	}
+	msg.belongedConsumer = nil
+	msg.pri = now.Add(replayDeferDelay).UnixNano()
+	c.replayMsgs[msg.ID] = msg
+	atomic.StoreInt64(&c.replayWaiting, int64(len(c.replayMsgs)))
+	c.replayPQ.Push(msg)
+	// the delayed message is not in the disk queue of the topic
+	if len(c.replayMsgs) > maxReplayWaiting && msg.DelayedType == 0 && !msg.bodySpilled {
+		c.spillMsgBodyNoLock(msg)
+	}
+	if _, ok := c.waitingRequeueChanMsgs[msg.ID]; ok {
+		c.waitingRequeueChanMsgs[msg.ID] = nil
+		delete(c.waitingRequeueChanMsgs, msg.ID)
+	}
+	atomic.AddInt64(&c.replayDeferred, 1)
+	if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DETAIL {
+		nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "REPLAY_DEFER", msg.TraceID, msg, "0", 0)
+	}
+	return true
+}
+
+// requeueDeferredReplay requeues the deferred replay messages with the delay elapsed,
+// at most the replay rate each time to avoid requeuing the messages will be deferred
+// again. All the deferred messages are requeued at once if the limit is removed. It
+// returns the count of the requeued messages.
+func (c *Channel) requeueDeferredReplay(tnow int64) int {
+	if c.GetReplayWaiting() == 0 {
+		return 0
+	}
+	cnt := 0
+	rate := c.GetReplayRate()
+	if rate <= 0 {
+		tnow = math.MaxInt64
+	}
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	if c.IsConsumeDisabled() {
+		return 0
+	}
+	for rate <= 0 || int64(cnt) < rate {
+		msg, _ := c.replayPQ.PeekAndShift(tnow)
+		if msg == nil {
+			break
+		}
+		if _, ok := c.replayMsgs[msg.ID]; !ok {
+			continue
+		}
+		delete(c.replayMsgs, msg.ID)
+		atomic.StoreInt64(&c.replayWaiting, int64(len(c.replayMsgs)))
+		// not counted as the requeue by the client
+		select {
+		case c.requeuedMsgChan <- msg:
+			c.waitingRequeueChanMsgs[msg.ID] = msg
+		default:
+			c.waitingRequeueMsgs[msg.ID] = msg
+		}
+		cnt++
+	}
+	return cnt
+}
@@ -0,0 +1,181 @@
+package nsqd
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sloBucketNum     = 60
+	defaultSLOWindow = time.Hour
+)
+
+var ErrInvalidChannelSLO = errors.New("invalid channel slo")
+
+// ChannelSLO defines the target ratio of the messages finished within the
+// latency since published, such as 99.9% finished within 30s, the compliance
+// is computed in the rolling window.
+type ChannelSLO struct {
+	Target  float64       `json:"target"`
+	Latency time.Duration `json:"latency"`
+	Window  time.Duration `json:"window"`
+}
+
+func (s *ChannelSLO) Validate() error {
+	if s.Target <= 0 || s.Target >= 1 {
+		return ErrInvalidChannelSLO
+	}
+	if s.Latency <= 0 {
+		return ErrInvalidChannelSLO
+	}
+	if s.Window == 0 {
+		s.Window = defaultSLOWindow
+	}
+	if s.Window < time.Minute {
+		return ErrInvalidChannelSLO
+	}
+	return nil
+}
+
+type ChannelSLOStats struct {
+	Target  float64 `json:"target"`
+	Latency string  `json:"latency"`
+	Window  string  `json:"window"`
+	// the finished and timed out messages in the window and those finished
+	// within the latency, each timed out delivery is counted as a bad event.
+	Total    int64 `json:"total"`
+	Good     int64 `json:"good"`
+	TimedOut int64 `json:"timed_out"`
+	// the in flight messages published longer than the latency ago in the last
+	// check, they are counted as bad until finished.
+	Stuck      int64   `json:"stuck"`
+	Compliance float64 `json:"compliance"`
+	// the ratio of the error rate to the error budget (1 - target), the budget
+	// will be exhausted in the window if the burn rate is 1.
+	BurnRate             float64 `json:"burn_rate"`
+	ErrorBudgetRemaining float64 `json:"error_budget_remaining"`
+	// breached if the burn rate is over 1 in the last check
+	Breached bool `json:"breached"`
+	// the unix time since the slo breached, 0 if not breached
+	BreachedSince int64 `json:"breached_since,omitempty"`
+}
+
+// ChannelSLOCheck is the result of the slo check, Changed is true if the
+// channel changed between the breached and the normal.
+type ChannelSLOCheck struct {
+	Stats   *ChannelSLOStats
+	Changed bool
+}
+
+type sloBucket struct {
+	start    int64
+	total    int64
+	good     int64
+	timedOut int64
+}
+
+// the rolling counters of the finished messages, the window is split
+// into buckets and the expired bucket will be reused. The counters are atomic
+// so the stats can be read without the lock, the lock is only used to reuse
+// the expired bucket and to update the breached state in the check.
+type channelSLOTracker struct {
+	sync.Mutex
+	slo           ChannelSLO
+	bucketDur     int64
+	buckets       [sloBucketNum]sloBucket
+	stuck         int64
+	breachedSince int64
+}
+
+func newChannelSLOTracker(slo ChannelSLO) *channelSLOTracker {
+	return &channelSLOTracker{
+		slo:       slo,
+		bucketDur: int64(slo.Window) / sloBucketNum,
+	}
+}
+
+// bucket returns the bucket of the time, the expired bucket is reset first
+func (t *channelSLOTracker) bucket(now time.Time) *sloBucket {
+	ts := now.UnixNano()
+	start := ts - ts%t.bucketDur
+	b := &t.buckets[(ts/t.bucketDur)%sloBucketNum]
+	if atomic.LoadInt64(&b.start) != start {
+		t.Lock()
+		if atomic.LoadInt64(&b.start) != start {
+			atomic.StoreInt64(&b.total, 0)
+			atomic.StoreInt64(&b.good, 0)
+			atomic.StoreInt64(&b.timedOut, 0)
+			atomic.StoreInt64(&b.start, start)
+		}
+		t.Unlock()
+	}
+	return b
+}
+
+func (t *channelSLOTracker) record(now time.Time, latency time.Duration) {
+	b := t.bucket(now)
+	atomic.AddInt64(&b.total, 1)
+	if latency <= t.slo.Latency {
+		atomic.AddInt64(&b.good, 1)
+	}
+}
+
+// recordTimeout counts the timed out delivery as a bad event, so the slo will be
+// breached even if the timed out messages are never finished.
+func (t *channelSLOTracker) recordTimeout(now time.Time) {
+	b := t.bucket(now)
+	atomic.AddInt64(&b.total, 1)
+	atomic.AddInt64(&b.timedOut, 1)
+}
+
+func (t *channelSLOTracker) stats(now time.Time) *ChannelSLOStats {
+	breachedSince := atomic.LoadInt64(&t.breachedSince)
+	s := &ChannelSLOStats{
+		Target:        t.slo.Target,
+		Latency:       t.slo.Latency.String(),
+		Window:        t.slo.Window.String(),
+		Stuck:         atomic.LoadInt64(&t.stuck),
+		Compliance:    1,
+		Breached:      breachedSince != 0,
+		BreachedSince: breachedSince,
+	}
+	since := now.UnixNano() - int64(t.slo.Window)
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if atomic.LoadInt64(&b.start) > since {
+			s.Total += atomic.LoadInt64(&b.total)
+			s.Good += atomic.LoadInt64(&b.good)
+			s.TimedOut += atomic.LoadInt64(&b.timedOut)
+		}
+	}
+	if s.Total+s.Stuck > 0 {
+		s.Compliance = float64(s.Good) / float64(s.Total+s.Stuck)
+	}
+	s.BurnRate = (1 - s.Compliance) / (1 - s.Target)
+	s.ErrorBudgetRemaining = 1 - s.BurnRate
+	return s
+}
+
+// check updates the stuck messages and the breached state, the slo is breached
+// if the error budget is burning faster than the window.
+func (t *channelSLOTracker) check(now time.Time, stuck int64) ChannelSLOCheck {
+	t.Lock()
+	defer t.Unlock()
+	atomic.StoreInt64(&t.stuck, stuck)
+	s := t.stats(now)
+	wasBreached := s.Breached
+	breached := checkSLOBreached(wasBreached, s.Total+s.Stuck, s.BurnRate, 1)
+	if breached && !wasBreached {
+		atomic.StoreInt64(&t.breachedSince, now.Unix())
+	} else if !breached && wasBreached {
+		atomic.StoreInt64(&t.breachedSince, 0)
+	}
+	s.Breached = breached
+	s.BreachedSince = atomic.LoadInt64(&t.breachedSince)
+	return ChannelSLOCheck{
+		Stats:   s,
+		Changed: breached != wasBreached,
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"strconv"
 	"testing"
 	"time"
+
+	"github.com/youzan/nsq/internal/ext"
 )
 
 type fakeConsumer struct {
@@ -31,6 +33,8 @@ func (c *fakeConsumer) Stats() ClientStats {
 }
 func (c *fakeConsumer) Exit() {
 }
+func (c *fakeConsumer) ExitWithReason(reason string) {
+}
 func (c *fakeConsumer) Empty() {
 }
 func (c *fakeConsumer) String() string {
@@ -152,6 +156,569 @@ func TestInFlightWorker(t *testing.T) {
 	equal(t, inFlightPQMsgs, 0)
 }
 
+func TestChannelInFlightSpill(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	opts.InFlightSpillThreshold = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_in_flight_spill" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+
+	count := 3
+	for i := 0; i < count; i++ {
+		msg := NewMessage(0, []byte("test"+strconv.Itoa(i)))
+		topic.PutMessage(msg)
+	}
+	topic.flush(true)
+
+	consumer := NewFakeConsumer(1)
+	msgs := make([]*Message, 0, count)
+	for i := 0; i < count; i++ {
+		outputMsg := <-channel.clientMsgChan
+		equal(t, outputMsg.Body, []byte("test"+strconv.Itoa(i)))
+		channel.StartInFlightTimeout(outputMsg, consumer, "", time.Minute)
+		msgs = append(msgs, outputMsg)
+	}
+	// only the client the message belongs to can spill it
+	equal(t, channel.SpillInFlightMessage(consumer.GetID()+1, msgs[0]), false)
+	for _, m := range msgs {
+		equal(t, channel.SpillInFlightMessage(consumer.GetID(), m), true)
+		equal(t, channel.isMsgBodySpilled(m), true)
+	}
+	stats := NewChannelStats(channel, nil, 0)
+	equal(t, stats.InFlightSpilledCount, uint64(count))
+
+	// requeue to end should get the copy with body
+	copyMsg, toEnd := channel.ShouldRequeueToEnd(consumer.GetID(), "", msgs[1].ID, opts.ReqToEndThreshold+time.Second, true)
+	equal(t, toEnd, true)
+	equal(t, copyMsg.Body, []byte("test1"))
+	equal(t, channel.isMsgBodySpilled(msgs[1]), true)
+
+	// the requeued message should be delivered with the body
+	err := channel.RequeueMessage(consumer.GetID(), "", msgs[0].ID, 0, false)
+	equal(t, err, nil)
+	outputMsg := <-channel.clientMsgChan
+	equal(t, outputMsg.ID, msgs[0].ID)
+	equal(t, outputMsg.Body, []byte("test0"))
+	equal(t, channel.isMsgBodySpilled(outputMsg), false)
+
+	// the data of the spilled messages should not be cleaned
+	offset, ok := channel.GetOldestSpilledOffset()
+	equal(t, ok, true)
+	equal(t, offset, msgs[1].Offset)
+
+	// the message failed to reload is kept spilled and retried
+	badMsg := msgs[2].GetCopy()
+	badMsg.Offset = channel.GetChannelEnd().Offset() + 1
+	for i := 1; i <= 10; i++ {
+		failed, err := channel.reloadSpilledMsgBody(badMsg)
+		equal(t, err != nil, true)
+		equal(t, failed, i)
+		equal(t, channel.isMsgBodySpilled(badMsg), true)
+	}
+}
+
+func TestChannelReqBackoff(t *testing.T) {
+	equal(t, computeReqBackoff(0, time.Second, time.Minute), time.Second)
+	equal(t, computeReqBackoff(1, time.Second, time.Minute), time.Second)
+	equal(t, computeReqBackoff(3, time.Second, time.Minute), 4*time.Second)
+	equal(t, computeReqBackoff(7, time.Second, time.Minute), time.Minute)
+	equal(t, computeReqBackoff(1000, time.Second, time.Minute), time.Minute)
+
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_req_backoff" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+
+	consumer := NewFakeConsumer(1)
+	msg := NewMessage(topic.nextMsgID(), []byte("test"))
+	msg.Attempts = 3
+	channel.StartInFlightTimeout(msg, consumer, "", opts.MsgTimeout)
+
+	_, err := channel.GetReqBackoffTimeout(consumer.GetID(), msg.ID)
+	equal(t, err, ErrReqBackoffDisabled)
+
+	channel.SetReqBackoff(time.Second, time.Minute)
+	timeout, err := channel.GetReqBackoffTimeout(consumer.GetID(), msg.ID)
+	equal(t, err, nil)
+	equal(t, timeout, 4*time.Second)
+	_, err = channel.GetReqBackoffTimeout(consumer.GetID(), msg.ID+1)
+	equal(t, err, ErrMsgNotInFlight)
+
+	err = channel.RequeueMessageByBackoff(consumer.GetID(), "", msg.ID, timeout)
+	equal(t, err, nil)
+	stats := NewChannelStats(channel, nil, 0)
+	equal(t, stats.DeferredCount, 1)
+	equal(t, stats.BackoffDeferredCount, int64(1))
+	equal(t, stats.ReqBackoffBase, "1s")
+	equal(t, stats.ReqBackoffMax, "1m0s")
+
+	// the backoff config should be persisted with the channel meta
+	topic.SaveChannelMeta()
+	channel.SetReqBackoff(0, 0)
+	topic.LoadChannelMeta()
+	base, max := channel.GetReqBackoff()
+	equal(t, base, time.Second)
+	equal(t, max, time.Minute)
+
+	channel.initPQ()
+	stats = NewChannelStats(channel, nil, 0)
+	equal(t, stats.BackoffDeferredCount, int64(0))
+}
+
+func TestChannelDeliveryWindow(t *testing.T) {
+	_, err := ParseDeliveryWindow("8:00", "20:00", "")
+	equal(t, err, ErrInvalidDeliveryWindow)
+	_, err = ParseDeliveryWindow("08:00", "08:00", "")
+	equal(t, err, ErrInvalidDeliveryWindow)
+	_, err = ParseDeliveryWindow("08:00", "20:00", "invalid/zone")
+	nequal(t, err, nil)
+
+	w, err := ParseDeliveryWindow("08:00", "20:00", "UTC")
+	equal(t, err, nil)
+	day := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	equal(t, w.Contains(day.Add(7*time.Hour+59*time.Minute)), false)
+	equal(t, w.Contains(day.Add(8*time.Hour)), true)
+	equal(t, w.Contains(day.Add(19*time.Hour+59*time.Minute)), true)
+	equal(t, w.Contains(day.Add(20*time.Hour)), false)
+	// the window should be checked in the timezone of the window
+	equal(t, w.Contains(day.Add(7*time.Hour).In(time.FixedZone("UTC+8", 8*3600))), false)
+
+	// the window crossing the midnight
+	w, err = ParseDeliveryWindow("22:00", "06:00", "UTC")
+	equal(t, err, nil)
+	equal(t, w.Contains(day.Add(23*time.Hour)), true)
+	equal(t, w.Contains(day.Add(5*time.Hour)), true)
+	equal(t, w.Contains(day.Add(12*time.Hour)), false)
+
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_delivery_window" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+	equal(t, channel.IsInDeliveryWindow(time.Now()), true)
+
+	now := time.Now().UTC()
+	start := now.Add(time.Hour).Format("15:04")
+	end := now.Add(2 * time.Hour).Format("15:04")
+	w, err = ParseDeliveryWindow(start, end, "UTC")
+	equal(t, err, nil)
+	channel.SetDeliveryWindow(w)
+	equal(t, channel.IsInDeliveryWindow(now), false)
+	stats := NewChannelStats(channel, nil, 0)
+	equal(t, stats.DeliveryWindow, start+"-"+end+" UTC")
+	equal(t, stats.DeliveryHeld, true)
+
+	// the window should be persisted with the channel meta
+	topic.SaveChannelMeta()
+	channel.SetDeliveryWindow(nil)
+	equal(t, channel.IsInDeliveryWindow(now), true)
+	topic.LoadChannelMeta()
+	equal(t, channel.GetDeliveryWindow().String(), w.String())
+	equal(t, channel.IsInDeliveryWindow(now), false)
+	equal(t, channel.IsInDeliveryWindow(now.Add(time.Hour+time.Minute)), true)
+}
+
+func TestChannelSLO(t *testing.T) {
+	invalids := []ChannelSLO{
+		{Target: 1, Latency: time.Second},
+		{Target: 0.99},
+		{Target: 0.99, Latency: time.Second, Window: time.Second},
+	}
+	for _, slo := range invalids {
+		equal(t, slo.Validate(), ErrInvalidChannelSLO)
+	}
+
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_slo" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+	equal(t, channel.GetSLOStats(time.Now()) == nil, true)
+	err := channel.SetSLO(&ChannelSLO{Target: 0.9, Latency: 30 * time.Second})
+	equal(t, err, nil)
+	equal(t, channel.GetSLO().Window, defaultSLOWindow)
+
+	for i := 0; i < 10; i++ {
+		msg := NewMessage(topic.nextMsgID(), []byte("test"))
+		if i < 2 {
+			// finished too late since published
+			msg.Timestamp = time.Now().Add(-time.Minute).UnixNano()
+		}
+		channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", opts.MsgTimeout)
+		_, _, _, _, err := channel.FinishMessage(0, "", msg.ID)
+		equal(t, err, nil)
+	}
+	stats := NewChannelStats(channel, nil, 0)
+	equal(t, stats.SLO.Total, int64(10))
+	equal(t, stats.SLO.Good, int64(8))
+	equal(t, stats.SLO.Compliance, 0.8)
+	equal(t, stats.SLO.BurnRate > 1.99 && stats.SLO.BurnRate < 2.01, true)
+	equal(t, stats.SLO.ErrorBudgetRemaining < 0, true)
+	// the finished messages out of the window should be ignored
+	equal(t, channel.GetSLOStats(time.Now().Add(2*defaultSLOWindow)).Total, int64(0))
+
+	// the counters should be kept if the slo not changed
+	topic.SaveChannelMeta()
+	topic.LoadChannelMeta()
+	equal(t, channel.GetSLOStats(time.Now()).Total, int64(10))
+	channel.SetSLO(nil)
+	equal(t, channel.GetSLO() == nil, true)
+	topic.LoadChannelMeta()
+	equal(t, channel.GetSLO().Target, 0.9)
+	equal(t, channel.GetSLOStats(time.Now()).Total, int64(0))
+}
+
+func TestChannelSLOStuckAndTimeout(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_slo_stuck" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+	_, ok := channel.CheckSLO(time.Now())
+	equal(t, ok, false)
+	err := channel.SetSLO(&ChannelSLO{Target: 0.9, Latency: 30 * time.Second})
+	equal(t, err, nil)
+
+	// the messages in flight since published long ago are stuck
+	msgs := make([]*Message, 0, sloMinSamples)
+	for i := 0; i < sloMinSamples; i++ {
+		msg := NewMessage(topic.nextMsgID(), []byte("test"))
+		msg.Timestamp = time.Now().Add(-time.Minute).UnixNano()
+		channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", time.Hour)
+		msgs = append(msgs, msg)
+	}
+	r, ok := channel.CheckSLO(time.Now())
+	equal(t, ok, true)
+	equal(t, r.Changed, true)
+	equal(t, r.Stats.Breached, true)
+	equal(t, r.Stats.Stuck, int64(sloMinSamples))
+	equal(t, r.Stats.Compliance, float64(0))
+	equal(t, channel.GetSLOStats(time.Now()).Breached, true)
+
+	for _, msg := range msgs {
+		_, _, _, _, err = channel.FinishMessage(0, "", msg.ID)
+		equal(t, err, nil)
+	}
+	r, _ = channel.CheckSLO(time.Now())
+	equal(t, r.Changed, false)
+	equal(t, r.Stats.Stuck, int64(0))
+	equal(t, r.Stats.Total, int64(sloMinSamples))
+
+	// the timed out delivery is counted as bad
+	msg := NewMessage(topic.nextMsgID(), []byte("test"))
+	channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", time.Millisecond)
+	start := time.Now()
+	for channel.GetSLOStats(time.Now()).TimedOut == 0 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("message timeout not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := channel.GetSLOStats(time.Now())
+	equal(t, stats.TimedOut, int64(1))
+	equal(t, stats.Total, int64(sloMinSamples+1))
+	equal(t, stats.Good, int64(0))
+
+	// resolved after the bad events out of the window
+	r, _ = channel.CheckSLO(time.Now().Add(2 * defaultSLOWindow))
+	equal(t, r.Changed, true)
+	equal(t, r.Stats.Breached, false)
+}
+
+func TestSLOBreachedHysteresis(t *testing.T) {
+	// no samples always resolves
+	equal(t, checkSLOBreached(true, 0, 0, 1), false)
+	// too few samples keeps the state
+	equal(t, checkSLOBreached(false, sloMinSamples-1, 2, 1), false)
+	equal(t, checkSLOBreached(true, sloMinSamples-1, 0, 1), true)
+	equal(t, checkSLOBreached(false, sloMinSamples, 1.01, 1), true)
+	equal(t, checkSLOBreached(false, sloMinSamples, 0.95, 1), false)
+	// resolved only below the threshold by the ratio
+	equal(t, checkSLOBreached(true, sloMinSamples, 0.95, 1), true)
+	equal(t, checkSLOBreached(true, sloMinSamples, 0.85, 1), false)
+}
+
+func TestChannelSLOSyncedByTopicPolicy(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_slo_sync" + strconv.Itoa(int(time.Now().Unix()))
+	leader := nsqd.GetTopic(topicName, 0)
+	replica := nsqd.GetTopic(topicName, 1)
+	leader.GetChannel("channel").SetSLO(&ChannelSLO{Target: 0.99, Latency: time.Second})
+	replicaCh := replica.GetChannel("channel")
+	equal(t, leader.IsDefaultTopicPolicy(), false)
+
+	data, err := leader.GetTopicPolicyData()
+	equal(t, err, nil)
+	err = replica.ApplyTopicPolicyData(data)
+	equal(t, err, nil)
+	equal(t, replicaCh.GetSLO().Target, 0.99)
+	equal(t, replicaCh.GetSLO().Latency, time.Second)
+
+	leader.GetChannel("channel").SetSLO(nil)
+	data, _ = leader.GetTopicPolicyData()
+	err = replica.ApplyTopicPolicyData(data)
+	equal(t, err, nil)
+	equal(t, replicaCh.GetSLO() == nil, true)
+}
+
+func TestChannelPolicySyncedByTopicPolicy(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_policy_sync" + strconv.Itoa(int(time.Now().Unix()))
+	leader := nsqd.GetTopic(topicName, 0)
+	replica := nsqd.GetTopic(topicName, 1)
+	_, err := leader.RegisterChannel("channel")
+	equal(t, err, nil)
+	leader.GetChannel("channel").SetReqBackoff(time.Second, time.Minute)
+	window, _ := ParseDeliveryWindow("09:00", "18:00", "UTC")
+	leader.GetChannel("channel").SetDeliveryWindow(window)
+	leader.GetChannel("channel").SetReplayRate(100)
+	leader.GetChannel("channel").SetCompacted(true)
+	equal(t, leader.IsDefaultTopicPolicy(), false)
+
+	data, err := leader.GetTopicPolicyData()
+	equal(t, err, nil)
+	err = replica.ApplyTopicPolicyData(data)
+	equal(t, err, nil)
+	replicaCh, err := replica.GetExistingChannel("channel")
+	equal(t, err, nil)
+	equal(t, replicaCh.IsRegistered(), true)
+	base, max := replicaCh.GetReqBackoff()
+	equal(t, base, time.Second)
+	equal(t, max, time.Minute)
+	equal(t, replicaCh.GetDeliveryWindow().String(), "09:00-18:00 UTC")
+	equal(t, replicaCh.GetReplayRate(), int64(100))
+	equal(t, replicaCh.IsCompacted(), true)
+
+	leader.GetChannel("channel").SetReqBackoff(0, 0)
+	leader.GetChannel("channel").SetDeliveryWindow(nil)
+	leader.GetChannel("channel").SetReplayRate(0)
+	leader.GetChannel("channel").SetCompacted(false)
+	equal(t, leader.UnregisterChannel("channel"), nil)
+	equal(t, leader.IsDefaultTopicPolicy(), true)
+	data, _ = leader.GetTopicPolicyData()
+	err = replica.ApplyTopicPolicyData(data)
+	equal(t, err, nil)
+	equal(t, replicaCh.IsRegistered(), false)
+	equal(t, replicaCh.IsReqBackoffEnabled(), false)
+	equal(t, replicaCh.GetDeliveryWindow() == nil, true)
+	equal(t, replicaCh.GetReplayRate(), int64(0))
+	equal(t, replicaCh.IsCompacted(), false)
+}
+
+func TestChannelReplayRate(t *testing.T) {
+	replayExt := []byte(`{"##replay":"backfill"}`)
+	equal(t, IsReplayMessage(NewMessageWithExt(0, []byte("test"), ext.JSON_HEADER_EXT_VER, replayExt)), true)
+	equal(t, IsReplayMessage(NewMessageWithExt(0, []byte("test"), ext.JSON_HEADER_EXT_VER, []byte(`{"##replay":""}`))), false)
+	equal(t, IsReplayMessage(NewMessage(0, []byte("test"))), false)
+
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	oldMaxReplayWaiting := maxReplayWaiting
+	maxReplayWaiting = 1
+	defer func() {
+		maxReplayWaiting = oldMaxReplayWaiting
+	}()
+
+	topicName := "test_channel_replay_rate" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicWithExt(topicName, 0)
+	channel := topic.GetChannel("ch")
+	equal(t, channel.SetReplayRate(-1), ErrInvalidReplayRate)
+	equal(t, channel.SetReplayRate(1), nil)
+
+	for i := 0; i < 3; i++ {
+		topic.PutMessage(NewMessageWithExt(0, []byte("replay"), ext.JSON_HEADER_EXT_VER, replayExt))
+	}
+	topic.PutMessage(NewMessageWithExt(0, []byte("live"), ext.JSON_HEADER_EXT_VER, []byte(`{"k":"v"}`)))
+	topic.flush(true)
+
+	// the live message should be delivered before the limited replay messages
+	outputMsg := <-channel.clientMsgChan
+	equal(t, string(outputMsg.Body), "replay")
+	outputMsg = <-channel.clientMsgChan
+	equal(t, string(outputMsg.Body), "live")
+	stats := NewChannelStats(channel, nil, 0)
+	equal(t, stats.ReplayRate, int64(1))
+	equal(t, stats.ReplayDelivered, int64(1))
+	equal(t, stats.ReplayDeferred, int64(2))
+	equal(t, stats.ReplayWaiting, int64(2))
+	// the deferred replay messages are not in flight and retried at the replay rate
+	equal(t, channel.GetInflightNum(), 0)
+	// the reader is not held while too many replay messages deferred, the body is
+	// spilled instead
+	_, spilled := channel.GetOldestSpilledOffset()
+	equal(t, spilled, true)
+	equal(t, channel.requeueDeferredReplay(time.Now().Add(replayDeferDelay).UnixNano()), 1)
+
+	// all the deferred messages are requeued after the limit removed and the spilled
+	// body is reloaded
+	channel.SetReplayRate(0)
+	channel.requeueDeferredReplay(time.Now().UnixNano())
+	for i := 0; i < 2; i++ {
+		outputMsg = <-channel.clientMsgChan
+		equal(t, string(outputMsg.Body), "replay")
+	}
+	equal(t, channel.GetReplayWaiting(), int64(0))
+	channel.SetReplayRate(1)
+
+	// the replay rate should be persisted with the channel meta
+	topic.SaveChannelMeta()
+	channel.SetReplayRate(0)
+	topic.LoadChannelMeta()
+	equal(t, channel.GetReplayRate(), int64(1))
+}
+
+func TestChannelCompactSnapshotThenFollow(t *testing.T) {
+	equal(t, GetCompactKey(NewMessageWithExt(0, []byte("v"), ext.JSON_HEADER_EXT_VER, []byte(`{"##compact_key":"k1"}`))), "k1")
+	equal(t, GetCompactKey(NewMessage(0, []byte("v"))), "")
+
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_compact" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicWithExt(topicName, 0)
+	putKeyed := func(key string, body string) {
+		topic.PutMessage(NewMessageWithExt(0, []byte(body), ext.JSON_HEADER_EXT_VER,
+			[]byte(`{"##compact_key":"`+key+`"}`)))
+	}
+	putKeyed("k1", "k1-v1")
+	putKeyed("k2", "k2-v1")
+	putKeyed("k1", "k1-v2")
+	putKeyed("k3", "k3-v1")
+	topic.PutMessage(NewMessageWithExt(0, []byte("no-key"), ext.JSON_HEADER_EXT_VER, []byte(`{"k":"v"}`)))
+	// the deleted key should not be delivered in the snapshot
+	putKeyed("k3", "")
+	topic.flush(true)
+
+	channel := topic.GetChannel("ch")
+	channel.SetCompacted(true)
+	equal(t, channel.SetConsumeOffset(0, 0, true), nil)
+	// the delivery is held until the snapshot is built, so no old value will be
+	// delivered
+	waitCompactBuilt := func() {
+		for i := 0; i < 100 && channel.GetCompactStats().State == CompactStateBuilding; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	for _, expected := range []string{"k2-v1", "k1-v2", "no-key"} {
+		outputMsg := <-channel.clientMsgChan
+		equal(t, string(outputMsg.Body), expected)
+		channel.ConfirmBackendQueue(outputMsg)
+	}
+	stats := channel.GetCompactStats()
+	equal(t, stats.State, CompactStateSnapshot)
+	equal(t, stats.Keys, 3)
+	equal(t, stats.Skipped, int64(3))
+
+	// the new updates should be delivered after the snapshot
+	putKeyed("k1", "k1-v3")
+	putKeyed("k1", "k1-v4")
+	topic.flush(true)
+	outputMsg := <-channel.clientMsgChan
+	equal(t, string(outputMsg.Body), "k1-v3")
+	channel.ConfirmBackendQueue(outputMsg)
+	outputMsg = <-channel.clientMsgChan
+	equal(t, string(outputMsg.Body), "k1-v4")
+	equal(t, channel.GetCompactStats().State, CompactStateFollowing)
+
+	topic.SaveChannelMeta()
+	channel.SetCompacted(false)
+	topic.LoadChannelMeta()
+	equal(t, channel.IsCompacted(), true)
+
+	// too many keys should follow the updates without the snapshot
+	oldMax := maxCompactSnapshotKeys
+	maxCompactSnapshotKeys = 1
+	defer func() { maxCompactSnapshotKeys = oldMax }()
+	channel.SetCompacted(true)
+	equal(t, channel.SetConsumeOffset(0, 0, true), nil)
+	waitCompactBuilt()
+	equal(t, channel.GetCompactStats().State, CompactStateFollowing)
+}
+
+func TestChannelStatsSnapshot(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_stats_snapshot" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+	channel.AddClient(1, NewFakeConsumer(1))
+	for i := 0; i < 10; i++ {
+		msg := NewMessage(topic.nextMsgID(), []byte("test"))
+		channel.StartInFlightTimeout(msg, NewFakeConsumer(1), "", opts.MsgTimeout)
+	}
+
+	stats := nsqd.GetTopicStats(false, topicName)
+	equal(t, len(stats), 1)
+	equal(t, len(stats[0].Channels), 1)
+	equal(t, stats[0].Channels[0].ClientNum, int64(1))
+	equal(t, len(stats[0].Channels[0].Clients), 1)
+	equal(t, stats[0].Channels[0].InFlightCount, 10)
+
+	channel.RemoveClient(1, "")
+	channel.initPQ()
+	topic.GetChannel("channel2")
+	stats = nsqd.GetStats(false, true)
+	equal(t, len(stats), 1)
+	equal(t, len(stats[0].Channels), 2)
+	equal(t, stats[0].Channels[0].ClientNum, int64(0))
+	equal(t, stats[0].Channels[0].InFlightCount, 0)
+
+	topic.DeleteExistingChannel("channel2")
+	stats = nsqd.GetStats(false, true)
+	equal(t, len(stats[0].Channels), 1)
+}
+
 func TestChannelEmpty(t *testing.T) {
 	opts := NewOptions()
 	opts.SyncEvery = 1
@@ -515,3 +1082,80 @@ func BenchmarkRangeTree(b *testing.B) {
 		//}
 	}
 }
+
+func TestChannelOrderedStuck(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_ordered_stuck" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("ch")
+	equal(t, channel.GetOrderedStats() == nil, true)
+
+	var id MessageID
+	topic.PutMessage(NewMessage(id, []byte("test")))
+	topic.flush(true)
+	channel.SetOrdered(true)
+	equal(t, channel.GetOrderedStats() == nil, false)
+
+	now := time.Now()
+	ret := channel.CheckOrderedStuck(time.Second, now)
+	equal(t, ret.Stuck, false)
+	ret = channel.CheckOrderedStuck(time.Second, now.Add(time.Second*2))
+	equal(t, ret.Stuck, true)
+	equal(t, ret.Changed, true)
+	equal(t, ret.Stats.StuckSince, now.Add(time.Second*2).Unix())
+	ret = channel.CheckOrderedStuck(time.Second, now.Add(time.Second*3))
+	equal(t, ret.Stuck, true)
+	equal(t, ret.Changed, false)
+	equal(t, channel.GetOrderedStats().Stuck, true)
+	// the blocked duration is counted to the time reading the stats
+	equal(t, channel.getOrderedStats(now.Add(time.Second*4)).BlockedMs, ret.Stats.BlockedMs+1000)
+
+	// the paused channel is not stuck, and the progress restarts after resumed
+	channel.Pause()
+	ret = channel.CheckOrderedStuck(time.Second, now.Add(time.Second*4))
+	equal(t, ret.Stuck, false)
+	equal(t, ret.Changed, true)
+	channel.UnPause()
+	ret = channel.CheckOrderedStuck(time.Second, now.Add(time.Second*5))
+	equal(t, ret.Stuck, false)
+	equal(t, ret.Changed, false)
+
+	// disabled by the zero timeout
+	ret = channel.CheckOrderedStuck(0, now.Add(time.Second*10))
+	equal(t, ret.Stuck, false)
+}
+
+func TestChannelDepthHistoryRing(t *testing.T) {
+	h := NewChannelDepthHistory(3)
+	if len(h.Samples(0)) != 0 {
+		t.Fatalf("the empty history should have no samples")
+	}
+	for i := int64(1); i <= 2; i++ {
+		h.Add(DepthSample{Ts: i, Depth: i})
+	}
+	if len(h.samples) != 2 {
+		t.Fatalf("the samples should grow lazily: %v", len(h.samples))
+	}
+	for i := int64(3); i <= 5; i++ {
+		h.Add(DepthSample{Ts: i, Depth: i})
+	}
+	samples := h.Samples(0)
+	if len(samples) != 3 || samples[0].Ts != 3 || samples[2].Ts != 5 {
+		t.Fatalf("unexpected samples after wrapped: %v", samples)
+	}
+	if samples = h.Samples(4); len(samples) != 2 || samples[0].Ts != 4 {
+		t.Fatalf("unexpected samples since 4: %v", samples)
+	}
+	if s, ok := h.DepthAt(4); !ok || s.Depth != 4 {
+		t.Fatalf("unexpected depth at 4: %v, %v", s, ok)
+	}
+	if _, ok := h.DepthAt(2); ok {
+		t.Fatalf("the sample at 2 should be dropped")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"compress/flate"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"sync"
@@ -19,6 +20,12 @@ import (
 const defaultBufferSize = 4 * 1024
 const slowDownThreshold = 5
 
+const (
+	TLSIdentityNone = ""
+	TLSIdentityCN   = "cn"
+	TLSIdentitySAN  = "san"
+)
+
 const (
 	stateInit = iota
 	stateDisconnected
@@ -27,6 +34,23 @@ const (
 	stateClosing
 )
 
+// the reasons why the client connection ended
+const (
+	DisconnectClientCLS     = "client_cls"
+	DisconnectClientClose   = "client_close"
+	DisconnectHeartbeatFail = "heartbeat_failure"
+	DisconnectWriteTimeout  = "write_timeout"
+	DisconnectNetworkError  = "network_error"
+	DisconnectServerEvicted = "server_evicted"
+	DisconnectServerExit    = "server_exit"
+	DisconnectAuthExpired   = "auth_expired"
+	DisconnectAuthError     = "auth_error"
+	DisconnectProtocolError = "protocol_error"
+	DisconnectIdleTimeout   = "idle_timeout"
+	DisconnectMaxLifetime   = "max_lifetime"
+	DisconnectUnknown       = "unknown"
+)
+
 type IdentifyDataV2 struct {
 	ShortID string `json:"short_id"` // TODO: deprecated, remove in 1.0
 	LongID  string `json:"long_id"`  // TODO: deprecated, remove in 1.0
@@ -47,6 +71,13 @@ type IdentifyDataV2 struct {
 	DesiredTag          string        `json:"desired_tag,omitempty"`
 	ExtendSupport       bool          `json:"extend_support"`
 	ExtFilter           ExtFilterData `json:"ext_filter"`
+	// return the error as the json with the code category and retryable
+	StructuredError bool `json:"structured_error"`
+	// tcp options for the connection, use the server default if not set
+	TCPNoDelay           *bool `json:"tcp_no_delay,omitempty"`
+	TCPSendBufferSize    int   `json:"tcp_send_buffer_size"`
+	TCPRecvBufferSize    int   `json:"tcp_recv_buffer_size"`
+	TCPKeepAliveInterval int   `json:"tcp_keepalive_interval"`
 }
 
 type identifyEvent struct {
@@ -65,6 +96,14 @@ type ClientV2 struct {
 	FinishCount   uint64
 	RequeueCount  uint64
 	TimeoutCount  uint64
+	// the heartbeat liveness in nanoseconds, the sent time is 0 if
+	// no heartbeat waiting the response
+	heartbeatSentTime int64
+	heartbeatRTT      int64
+	lastHeartbeatResp int64
+	missedHeartbeats  int64
+	// the unix nano time of the last publish, 0 if never published
+	lastPubTime int64
 
 	// this lock used only for connection writer
 	// do not use it while get/set stats for client, use meta lock instead
@@ -120,6 +159,12 @@ type ClientV2 struct {
 	AuthSecret  string
 	AuthState   *auth.State
 	tlsConfig   *tls.Config
+	tlsIdentity string
+	// the identity and the topics counted in the connection limits, protected by
+	// the lock of the limiter
+	limitIdentity  string
+	limitPubTopics map[string]struct{}
+
 	EnableTrace bool
 
 	PubTimeout         *time.Timer
@@ -129,8 +174,38 @@ type ClientV2 struct {
 
 	desiredTag      string
 	isExtendSupport int32
+	structuredError int32
 	TagMsgChannel   chan *Message
 	extFilter       ExtFilterData
+
+	tcpNoDelay         bool
+	tcpSendBufferSize  int
+	tcpRecvBufferSize  int
+	tcpKeepAlivePeriod time.Duration
+
+	// the reply channels created by this client, will be deleted while the client exit
+	replyChannels []*Channel
+	// the first reason set will be kept since the later ones are usually caused by it
+	disconnectReason string
+	// the copy of the meta used by the stats, so the stats will not wait the meta lock
+	statsMeta atomic.Value
+}
+
+// clientStatsMeta is replaced while any meta in the stats is changed, it should
+// not be modified after stored.
+type clientStatsMeta struct {
+	clientID           string
+	hostname           string
+	userAgent          string
+	identity           string
+	identityURL        string
+	authed             bool
+	desiredTag         string
+	tcpNoDelay         bool
+	tcpSendBufferSize  int
+	tcpRecvBufferSize  int
+	tcpKeepAlivePeriod time.Duration
+	tlsState           *prettyConnectionState
 }
 
 func NewClientV2(id int64, conn net.Conn, opts *Options, tls *tls.Config) *ClientV2 {
@@ -138,10 +213,6 @@ func NewClientV2(id int64, conn net.Conn, opts *Options, tls *tls.Config) *Clien
 	if conn != nil {
 		identifier = conn.RemoteAddr().String()
 	}
-	if tcpC, ok := conn.(*net.TCPConn); ok {
-		tcpC.SetNoDelay(true)
-	}
-
 	c := &ClientV2{
 		ID:      id,
 		ctxOpts: opts,
@@ -179,6 +250,11 @@ func NewClientV2(id int64, conn net.Conn, opts *Options, tls *tls.Config) *Clien
 	}
 	c.LenSlice = c.lenBuf[:]
 	c.remoteAddr = identifier
+	c.updateStatsMetaNoLock()
+	err := c.ApplyListenerTCPOptions(opts.DefaultTCPOptions())
+	if err != nil {
+		nsqLog.LogWarningf("[%s] set tcp options failed: %v", c, err)
+	}
 	return c
 }
 
@@ -196,6 +272,31 @@ func (c *ClientV2) Exit() {
 	nsqLog.Logf("client [%s] force exit", c)
 }
 
+// SetDisconnectReason records why the connection is going to end, only the first
+// reason will be kept.
+func (c *ClientV2) SetDisconnectReason(reason string) {
+	c.metaLock.Lock()
+	if c.disconnectReason == "" {
+		c.disconnectReason = reason
+	}
+	c.metaLock.Unlock()
+}
+
+func (c *ClientV2) GetDisconnectReason() string {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	if c.disconnectReason == "" {
+		return DisconnectUnknown
+	}
+	return c.disconnectReason
+}
+
+// ExitWithReason force closes the connection from the server side
+func (c *ClientV2) ExitWithReason(reason string) {
+	c.SetDisconnectReason(reason)
+	c.Exit()
+}
+
 func (c *ClientV2) FinalClose() {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
@@ -240,6 +341,7 @@ func (c *ClientV2) Identify(data IdentifyDataV2) error {
 	c.ClientID = clientID
 	c.Hostname = hostname
 	c.UserAgent = data.UserAgent
+	c.updateStatsMetaNoLock()
 	c.metaLock.Unlock()
 
 	err := c.SetHeartbeatInterval(data.HeartbeatInterval)
@@ -275,6 +377,14 @@ func (c *ClientV2) Identify(data IdentifyDataV2) error {
 		c.SetExtendSupport()
 	}
 	c.SetExtFilter(data.ExtFilter)
+	if data.StructuredError {
+		atomic.StoreInt32(&c.structuredError, 1)
+	}
+
+	err = c.SetTCPOptions(data.TCPNoDelay, data.TCPSendBufferSize, data.TCPRecvBufferSize, data.TCPKeepAliveInterval)
+	if err != nil {
+		return err
+	}
 
 	c.metaLock.RLock()
 	ie := identifyEvent{
@@ -295,30 +405,45 @@ func (c *ClientV2) Identify(data IdentifyDataV2) error {
 	return nil
 }
 
-func (c *ClientV2) Stats() ClientStats {
-	c.metaLock.RLock()
-	// TODO: deprecated, remove in 1.0
-	name := c.ClientID
-
-	clientID := c.ClientID
-	hostname := c.Hostname
-	userAgent := c.UserAgent
-	var identity string
-	var identityURL string
+// updateStatsMetaNoLock should be called with the meta lock held after the meta changed
+func (c *ClientV2) updateStatsMetaNoLock() {
+	m := &clientStatsMeta{
+		clientID:           c.ClientID,
+		hostname:           c.Hostname,
+		userAgent:          c.UserAgent,
+		identity:           c.tlsIdentity,
+		desiredTag:         c.desiredTag,
+		tcpNoDelay:         c.tcpNoDelay,
+		tcpSendBufferSize:  c.tcpSendBufferSize,
+		tcpRecvBufferSize:  c.tcpRecvBufferSize,
+		tcpKeepAlivePeriod: c.tcpKeepAlivePeriod,
+	}
 	if c.AuthState != nil {
-		identity = c.AuthState.Identity
-		identityURL = c.AuthState.IdentityURL
+		if c.AuthState.Identity != "" {
+			m.identity = c.AuthState.Identity
+		}
+		m.identityURL = c.AuthState.IdentityURL
+		m.authed = len(c.AuthState.Authorizations) != 0
 	}
-	c.metaLock.RUnlock()
+	if old, ok := c.statsMeta.Load().(*clientStatsMeta); ok {
+		m.tlsState = old.tlsState
+	}
+	c.statsMeta.Store(m)
+}
+
+// Stats reads the meta from the copy and the counters by atomic, so it never
+// waits the locks used by the connection.
+func (c *ClientV2) Stats() ClientStats {
+	meta := c.statsMeta.Load().(*clientStatsMeta)
 	stats := ClientStats{
 		// TODO: deprecated, remove in 1.0
-		Name: name,
+		Name: meta.clientID,
 
 		Version:         "V2",
 		RemoteAddress:   c.RemoteAddr().String(),
-		ClientID:        clientID,
-		Hostname:        hostname,
-		UserAgent:       userAgent,
+		ClientID:        meta.clientID,
+		Hostname:        meta.hostname,
+		UserAgent:       meta.userAgent,
 		State:           atomic.LoadInt32(&c.State),
 		ReadyCount:      atomic.LoadInt64(&c.ReadyCount),
 		InFlightCount:   atomic.LoadInt64(&c.InFlightCount),
@@ -331,13 +456,23 @@ func (c *ClientV2) Stats() ClientStats {
 		TLS:             atomic.LoadInt32(&c.TLS) == 1,
 		Deflate:         atomic.LoadInt32(&c.Deflate) == 1,
 		Snappy:          atomic.LoadInt32(&c.Snappy) == 1,
-		Authed:          c.HasAuthorizations(),
-		AuthIdentity:    identity,
-		AuthIdentityURL: identityURL,
-		DesiredTag:      c.GetDesiredTag(),
+		Authed:          meta.authed,
+		AuthIdentity:    meta.identity,
+		AuthIdentityURL: meta.identityURL,
+		DesiredTag:      meta.desiredTag,
+
+		HeartbeatRTT:     int64(c.GetHeartbeatRTT() / time.Microsecond),
+		MissedHeartbeats: c.GetMissedHeartbeats(),
 	}
-	if stats.TLS {
-		p := prettyConnectionState{c.tlsConn.ConnectionState()}
+	if lastResp := atomic.LoadInt64(&c.lastHeartbeatResp); lastResp > 0 {
+		stats.LastHeartbeatTime = time.Unix(0, lastResp).Unix()
+	}
+	stats.TCPNoDelay = meta.tcpNoDelay
+	stats.TCPSendBufferSize = meta.tcpSendBufferSize
+	stats.TCPRecvBufferSize = meta.tcpRecvBufferSize
+	stats.TCPKeepAlivePeriod = KeepAlivePeriodMillis(meta.tcpKeepAlivePeriod)
+	if stats.TLS && meta.tlsState != nil {
+		p := meta.tlsState
 		stats.CipherSuite = p.GetCipherSuite()
 		stats.TLSVersion = p.GetVersion()
 		stats.TLSNegotiatedProtocol = p.NegotiatedProtocol
@@ -402,6 +537,11 @@ func (c *ClientV2) IsReadyForMessages() bool {
 	if c.Channel.IsPaused() {
 		return false
 	}
+	// hold the messages until the delivery window is open again,
+	// the client will check again while heartbeat
+	if !c.Channel.IsInDeliveryWindow(time.Now()) {
+		return false
+	}
 
 	readyCount := atomic.LoadInt64(&c.ReadyCount)
 	inFlightCount := atomic.LoadInt64(&c.InFlightCount)
@@ -521,6 +661,70 @@ func (c *ClientV2) GetHeartbeatInterval() time.Duration {
 	return time.Duration(atomic.LoadInt64(&c.heartbeatInterval))
 }
 
+// HeartbeatSent marks the heartbeat waiting the response, the heartbeat will be
+// counted as missed if the last one is still waiting.
+func (c *ClientV2) HeartbeatSent(now time.Time) bool {
+	if atomic.CompareAndSwapInt64(&c.heartbeatSentTime, 0, now.UnixNano()) {
+		return false
+	}
+	atomic.AddInt64(&c.missedHeartbeats, 1)
+	return true
+}
+
+// HeartbeatWritten restarts the timing of the heartbeat sent at the given time after
+// it is written to the connection, so the time waiting the buffered messages flushed
+// is not counted in the round-trip time. Nothing changed if the heartbeat is already
+// responded or the previous one is still waiting.
+func (c *ClientV2) HeartbeatWritten(sent time.Time, now time.Time) {
+	atomic.CompareAndSwapInt64(&c.heartbeatSentTime, sent.UnixNano(), now.UnixNano())
+}
+
+// HeartbeatResponded updates the round-trip time if any heartbeat is waiting the response.
+func (c *ClientV2) HeartbeatResponded(now time.Time) {
+	sent := atomic.SwapInt64(&c.heartbeatSentTime, 0)
+	if sent == 0 {
+		return
+	}
+	atomic.StoreInt64(&c.heartbeatRTT, now.UnixNano()-sent)
+	atomic.StoreInt64(&c.lastHeartbeatResp, now.UnixNano())
+}
+
+func (c *ClientV2) GetHeartbeatRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.heartbeatRTT))
+}
+
+func (c *ClientV2) GetMissedHeartbeats() int64 {
+	return atomic.LoadInt64(&c.missedHeartbeats)
+}
+
+func (c *ClientV2) SetLastPubTime(ts int64) {
+	atomic.StoreInt64(&c.lastPubTime, ts)
+}
+
+// IsIdleProducer returns true if the client is not consuming and has not published
+// since the timeout, the connect time is used if never published.
+func (c *ClientV2) IsIdleProducer(timeout time.Duration, now time.Time) bool {
+	state := atomic.LoadInt32(&c.State)
+	if state == stateSubscribed || state == stateClosing || c.GetReplyChannelsCount() > 0 {
+		return false
+	}
+	last := c.ConnectTime
+	if ts := atomic.LoadInt64(&c.lastPubTime); ts > 0 {
+		last = time.Unix(0, ts)
+	}
+	return now.Sub(last) >= timeout
+}
+
+// IsHeartbeatStalled returns true if the last heartbeat round-trip time or the time
+// waiting the current heartbeat response is more than the max rtt.
+func (c *ClientV2) IsHeartbeatStalled(maxRTT time.Duration, now time.Time) bool {
+	if c.GetHeartbeatRTT() > maxRTT {
+		return true
+	}
+	sent := atomic.LoadInt64(&c.heartbeatSentTime)
+	return sent > 0 && now.Sub(time.Unix(0, sent)) > maxRTT
+}
+
 func (c *ClientV2) SetHeartbeatInterval(desiredInterval int) error {
 	switch {
 	case desiredInterval == -1:
@@ -570,6 +774,101 @@ func (c *ClientV2) SetOutputBufferSize(desiredSize int) error {
 	return nil
 }
 
+func (c *ClientV2) applyTCPOptions(noDelay bool, sendBufSize int, recvBufSize int, keepAlive time.Duration) error {
+	tcpC, ok := c.Conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	defer c.updateStatsMetaNoLock()
+	err := tcpC.SetNoDelay(noDelay)
+	if err != nil {
+		return err
+	}
+	c.tcpNoDelay = noDelay
+	if sendBufSize > 0 {
+		err = tcpC.SetWriteBuffer(sendBufSize)
+		if err != nil {
+			return err
+		}
+		c.tcpSendBufferSize = sendBufSize
+	}
+	if recvBufSize > 0 {
+		err = tcpC.SetReadBuffer(recvBufSize)
+		if err != nil {
+			return err
+		}
+		c.tcpRecvBufferSize = recvBufSize
+	}
+	// the keepalive is not changed if 0
+	if keepAlive > 0 {
+		err = tcpC.SetKeepAlive(true)
+		if err == nil {
+			err = tcpC.SetKeepAlivePeriod(keepAlive)
+		}
+	} else if keepAlive < 0 {
+		err = tcpC.SetKeepAlive(false)
+	}
+	if err != nil {
+		return err
+	}
+	c.tcpKeepAlivePeriod = keepAlive
+	return nil
+}
+
+// ApplyListenerTCPOptions sets the tcp options of the listener accepted the client,
+// the options can be changed by the client while identifying.
+func (c *ClientV2) ApplyListenerTCPOptions(o TCPOptions) error {
+	return c.applyTCPOptions(o.NoDelay, o.SendBufferSize, o.RecvBufferSize, o.KeepAlivePeriod)
+}
+
+// SetTCPOptions changes the tcp options desired by client, the zero value means
+// the server default will be used, and keepalive will be disabled if the interval is -1.
+func (c *ClientV2) SetTCPOptions(noDelay *bool, sendBufSize int, recvBufSize int, keepAliveInterval int) error {
+	if noDelay == nil && sendBufSize == 0 && recvBufSize == 0 && keepAliveInterval == 0 {
+		return nil
+	}
+	if sendBufSize != 0 && (sendBufSize < defaultBufferSize || sendBufSize > c.ctxOpts.MaxTCPBufferSize) {
+		return fmt.Errorf("tcp send buffer size (%d) is invalid", sendBufSize)
+	}
+	if recvBufSize != 0 && (recvBufSize < defaultBufferSize || recvBufSize > c.ctxOpts.MaxTCPBufferSize) {
+		return fmt.Errorf("tcp receive buffer size (%d) is invalid", recvBufSize)
+	}
+	c.metaLock.RLock()
+	nd := c.tcpNoDelay
+	keepAlive := c.tcpKeepAlivePeriod
+	c.metaLock.RUnlock()
+	if noDelay != nil {
+		nd = *noDelay
+	}
+	switch {
+	case keepAliveInterval == -1:
+		keepAlive = -1
+	case keepAliveInterval == 0:
+		// do nothing (use default)
+	case keepAliveInterval >= 1000:
+		keepAlive = time.Duration(keepAliveInterval) * time.Millisecond
+	default:
+		return fmt.Errorf("tcp keepalive interval (%d) is invalid", keepAliveInterval)
+	}
+	return c.applyTCPOptions(nd, sendBufSize, recvBufSize, keepAlive)
+}
+
+// KeepAlivePeriodMillis returns -1 if the keepalive is disabled, and 0 for the system default
+func KeepAlivePeriodMillis(keepAlive time.Duration) int64 {
+	if keepAlive < 0 {
+		return -1
+	}
+	return int64(keepAlive / time.Millisecond)
+}
+
+func (c *ClientV2) GetTCPOptions() (bool, int, int, time.Duration) {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	return c.tcpNoDelay, c.tcpSendBufferSize, c.tcpRecvBufferSize, c.tcpKeepAlivePeriod
+}
+
 func (c *ClientV2) SetExtFilter(filter ExtFilterData) {
 	c.metaLock.Lock()
 	defer c.metaLock.Unlock()
@@ -619,6 +918,10 @@ func (c *ClientV2) SetExtendSupport() {
 	atomic.StoreInt32(&c.isExtendSupport, 1)
 }
 
+func (c *ClientV2) IsStructuredError() bool {
+	return atomic.LoadInt32(&c.structuredError) != 0
+}
+
 func (c *ClientV2) GetMsgTimeout() time.Duration {
 	return time.Duration(atomic.LoadInt64(&c.msgTimeout))
 }
@@ -637,10 +940,57 @@ func (c *ClientV2) SetMsgTimeout(msgTimeout int) error {
 	return nil
 }
 
+func (c *ClientV2) AddReplyChannel(channel *Channel) {
+	c.metaLock.Lock()
+	c.replyChannels = append(c.replyChannels, channel)
+	c.metaLock.Unlock()
+}
+
+func (c *ClientV2) GetReplyChannelsCount() int {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	return len(c.replyChannels)
+}
+
+// RemoveReplyChannel removes the reply channel expired from the client
+func (c *ClientV2) RemoveReplyChannel(channel *Channel) {
+	c.metaLock.Lock()
+	defer c.metaLock.Unlock()
+	for i, ch := range c.replyChannels {
+		if ch == channel {
+			c.replyChannels = append(c.replyChannels[:i], c.replyChannels[i+1:]...)
+			return
+		}
+	}
+}
+
+// IsReplyChannelOwner returns true if the reply channel is created by this client
+func (c *ClientV2) IsReplyChannelOwner(topicName string, partition int, channelName string) bool {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	for _, ch := range c.replyChannels {
+		if ch.GetName() == channelName && ch.GetTopicName() == topicName && ch.GetTopicPart() == partition {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveReplyChannels returns the reply channels created by this client and
+// clear them from the client.
+func (c *ClientV2) RemoveReplyChannels() []*Channel {
+	c.metaLock.Lock()
+	channels := c.replyChannels
+	c.replyChannels = nil
+	c.metaLock.Unlock()
+	return channels
+}
+
 func (c *ClientV2) UnsetDesiredTag() {
 	c.metaLock.Lock()
 	defer c.metaLock.Unlock()
 	c.desiredTag = ""
+	c.updateStatsMetaNoLock()
 }
 
 func (c *ClientV2) SetDesiredTag(tagStr string) error {
@@ -656,6 +1006,7 @@ func (c *ClientV2) SetDesiredTag(tagStr string) error {
 	defer c.metaLock.Unlock()
 	if tagStr != "" && c.desiredTag != tagStr {
 		c.desiredTag = tagStr
+		c.updateStatsMetaNoLock()
 	}
 	return nil
 }
@@ -681,6 +1032,16 @@ func (c *ClientV2) UpgradeTLS() error {
 		return err
 	}
 	c.tlsConn = tlsConn
+	state := tlsConn.ConnectionState()
+	c.metaLock.Lock()
+	if len(state.PeerCertificates) > 0 {
+		c.tlsIdentity = GetCertIdentity(state.PeerCertificates[0], c.ctxOpts.TLSIdentityMode)
+	}
+	c.updateStatsMetaNoLock()
+	meta := *c.statsMeta.Load().(*clientStatsMeta)
+	meta.tlsState = &prettyConnectionState{state}
+	c.statsMeta.Store(&meta)
+	c.metaLock.Unlock()
 
 	c.Reader = NewBufioReader(c.tlsConn)
 	c.Writer = newBufioWriterSize(c.tlsConn, int(atomic.LoadInt64(&c.outputBufferSize)))
@@ -757,7 +1118,10 @@ func (c *ClientV2) QueryAuthd() error {
 	if err != nil {
 		return err
 	}
+	c.metaLock.Lock()
 	c.AuthState = authState
+	c.updateStatsMetaNoLock()
+	c.metaLock.Unlock()
 	return nil
 }
 
@@ -782,9 +1146,57 @@ func (c *ClientV2) IsAuthorized(topic, channel string) (bool, error) {
 	return false, nil
 }
 
+// GetIdentity returns the identity used to check the acl rules, the identity
+// from auth server is preferred to the identity from the client certificate.
+func (c *ClientV2) GetIdentity() string {
+	if c.AuthState != nil && c.AuthState.Identity != "" {
+		return c.AuthState.Identity
+	}
+	c.metaLock.RLock()
+	identity := c.tlsIdentity
+	c.metaLock.RUnlock()
+	return identity
+}
+
+// IsMutualTLS returns whether the client is connected with TLS and has
+// provided the client certificate.
+func (c *ClientV2) IsMutualTLS() bool {
+	if atomic.LoadInt32(&c.TLS) != 1 {
+		return false
+	}
+	c.writeLock.RLock()
+	tlsConn := c.tlsConn
+	c.writeLock.RUnlock()
+	if tlsConn == nil {
+		return false
+	}
+	return len(tlsConn.ConnectionState().PeerCertificates) > 0
+}
+
 func (c *ClientV2) HasAuthorizations() bool {
 	if c.AuthState != nil {
 		return len(c.AuthState.Authorizations) != 0
 	}
 	return false
 }
+
+// GetCertIdentity maps the client certificate to the identity by the tls identity mode.
+// For the san mode, the first dns name, email or ip address in the subject alternative
+// names will be used.
+func GetCertIdentity(cert *x509.Certificate, mode string) string {
+	switch mode {
+	case TLSIdentityCN:
+		return cert.Subject.CommonName
+	case TLSIdentitySAN:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+		if len(cert.IPAddresses) > 0 {
+			return cert.IPAddresses[0].String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,196 @@
+package nsqd
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrTooManyConnsPerIP       = errors.New("too many connections from the remote ip")
+	ErrTooManyConnsPerIdentity = errors.New("too many connections of the identity")
+	ErrTooManyTopicPublishers  = errors.New("too many publishers of the topic")
+)
+
+// ConnLimitStats is the node level connection limits, the rejected counters are
+// accumulated since the node started.
+type ConnLimitStats struct {
+	// the distinct remote ips and identities connected currently
+	RemoteIPs  int64 `json:"remote_ips" pb:"1"`
+	Identities int64 `json:"identities" pb:"2"`
+	// the max connections of a single remote ip and identity currently
+	MaxIPConns        int64 `json:"max_ip_conns" pb:"3"`
+	MaxIdentityConns  int64 `json:"max_identity_conns" pb:"4"`
+	IPRejected        int64 `json:"ip_rejected" pb:"5"`
+	IdentityRejected  int64 `json:"identity_rejected" pb:"6"`
+	PublisherRejected int64 `json:"publisher_rejected" pb:"7"`
+}
+
+// connLimiter counts the connections by the remote ip and the identity, and the
+// publisher connections by the topic partition. The counters are always kept so
+// the limits can be changed at runtime.
+type connLimiter struct {
+	ipRejected        int64
+	identityRejected  int64
+	publisherRejected int64
+
+	sync.RWMutex
+	ipConns       map[string]int64
+	identityConns map[string]int64
+	// topic full name -> client id of the publishers
+	topicPublishers map[string]map[int64]struct{}
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{
+		ipConns:         make(map[string]int64),
+		identityConns:   make(map[string]int64),
+		topicPublishers: make(map[string]map[int64]struct{}),
+	}
+}
+
+// acquireConnCount increases the count of the key if not over the limit, 0 for no limit
+func acquireConnCount(counts map[string]int64, key string, limit int64) bool {
+	if limit > 0 && counts[key] >= limit {
+		return false
+	}
+	counts[key]++
+	return true
+}
+
+func releaseConnCount(counts map[string]int64, key string) {
+	if cnt := counts[key] - 1; cnt > 0 {
+		counts[key] = cnt
+	} else {
+		delete(counts, key)
+	}
+}
+
+func maxConnCount(counts map[string]int64) int64 {
+	max := int64(0)
+	for _, cnt := range counts {
+		if cnt > max {
+			max = cnt
+		}
+	}
+	return max
+}
+
+// AcquireIPConn should be paired with ReleaseIPConn if no error
+func (n *NSQD) AcquireIPConn(ip string) error {
+	l := n.connLimiter
+	l.Lock()
+	ok := acquireConnCount(l.ipConns, ip, n.GetOpts().MaxConnsPerIP)
+	l.Unlock()
+	if !ok {
+		atomic.AddInt64(&l.ipRejected, 1)
+		return ErrTooManyConnsPerIP
+	}
+	return nil
+}
+
+func (n *NSQD) ReleaseIPConn(ip string) {
+	l := n.connLimiter
+	l.Lock()
+	releaseConnCount(l.ipConns, ip)
+	l.Unlock()
+}
+
+// AcquireClientIdentity counts the connection to the identity of the client, the
+// identity may be changed by the tls and the auth, so the old one is released.
+func (n *NSQD) AcquireClientIdentity(client *ClientV2, identity string) error {
+	if identity == "" {
+		return nil
+	}
+	l := n.connLimiter
+	l.Lock()
+	defer l.Unlock()
+	if client.limitIdentity == identity {
+		return nil
+	}
+	if !acquireConnCount(l.identityConns, identity, n.GetOpts().MaxConnsPerIdentity) {
+		atomic.AddInt64(&l.identityRejected, 1)
+		return ErrTooManyConnsPerIdentity
+	}
+	if client.limitIdentity != "" {
+		releaseConnCount(l.identityConns, client.limitIdentity)
+	}
+	client.limitIdentity = identity
+	return nil
+}
+
+// AddClientTopicPublisher counts the client as the publisher of the topic partition
+// on the first publish.
+func (n *NSQD) AddClientTopicPublisher(client *ClientV2, topicFullName string) error {
+	l := n.connLimiter
+	l.RLock()
+	_, ok := client.limitPubTopics[topicFullName]
+	l.RUnlock()
+	if ok {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := client.limitPubTopics[topicFullName]; ok {
+		return nil
+	}
+	publishers, ok := l.topicPublishers[topicFullName]
+	if !ok {
+		publishers = make(map[int64]struct{})
+		l.topicPublishers[topicFullName] = publishers
+	}
+	if limit := n.GetOpts().MaxTopicPublishers; limit > 0 && int64(len(publishers)) >= limit {
+		atomic.AddInt64(&l.publisherRejected, 1)
+		return ErrTooManyTopicPublishers
+	}
+	publishers[client.ID] = struct{}{}
+	if client.limitPubTopics == nil {
+		client.limitPubTopics = make(map[string]struct{})
+	}
+	client.limitPubTopics[topicFullName] = struct{}{}
+	return nil
+}
+
+// ReleaseClientLimits releases the identity and the publishers of the client, should
+// be called after the client closed.
+func (n *NSQD) ReleaseClientLimits(client *ClientV2) {
+	l := n.connLimiter
+	l.Lock()
+	defer l.Unlock()
+	if client.limitIdentity != "" {
+		releaseConnCount(l.identityConns, client.limitIdentity)
+		client.limitIdentity = ""
+	}
+	for topicFullName := range client.limitPubTopics {
+		publishers := l.topicPublishers[topicFullName]
+		delete(publishers, client.ID)
+		if len(publishers) == 0 {
+			delete(l.topicPublishers, topicFullName)
+		}
+	}
+	client.limitPubTopics = nil
+}
+
+// GetTopicPublishers returns the publisher connections of the topic partition
+func (n *NSQD) GetTopicPublishers(topicFullName string) int {
+	l := n.connLimiter
+	l.RLock()
+	defer l.RUnlock()
+	return len(l.topicPublishers[topicFullName])
+}
+
+func (n *NSQD) GetConnLimitStats() ConnLimitStats {
+	l := n.connLimiter
+	l.RLock()
+	s := ConnLimitStats{
+		RemoteIPs:        int64(len(l.ipConns)),
+		Identities:       int64(len(l.identityConns)),
+		MaxIPConns:       maxConnCount(l.ipConns),
+		MaxIdentityConns: maxConnCount(l.identityConns),
+	}
+	l.RUnlock()
+	s.IPRejected = atomic.LoadInt64(&l.ipRejected)
+	s.IdentityRejected = atomic.LoadInt64(&l.identityRejected)
+	s.PublisherRejected = atomic.LoadInt64(&l.publisherRejected)
+	return s
+}
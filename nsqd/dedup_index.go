@@ -0,0 +1,452 @@
+package nsqd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/youzan/nsq/internal/util"
+)
+
+const (
+	DEDUP_INDEX_FILE_NAME = ".dedup.index.dat"
+
+	dedupIndexMagic   = uint32(0x4e445849)
+	dedupIndexVersion = uint32(1)
+	// 16 bytes for the key and value with the estimated map bucket overhead
+	dedupIndexEntryMemSize  = 40
+	dedupIndexEntryDiskSize = 16
+	// the index file and the log are compacted if the stale entries on the disk
+	// are more than the keys and this
+	dedupIndexMinCompactEntries = 10000
+)
+
+// the interval to remove the expired keys from the memory and compact the disk files
+var DedupIndexExpireInterval = time.Minute
+
+var errInvalidDedupIndexFile = errors.New("invalid dedup index file")
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type DedupIndexStats struct {
+	KeyCount  int   `json:"key_count"`
+	MemBytes  int64 `json:"mem_bytes"`
+	DiskBytes int64 `json:"disk_bytes"`
+}
+
+// DedupIndex keeps the hash of the dedup keys and their expire time, it is
+// persisted so the duplicates inside the dedup window can still be detected
+// after the broker restarted. The changes are appended to the log file while the
+// topic flushing, and the expired keys are removed periodically and compacted
+// with the log into the index file.
+// Only the 64-bit FNV hash of the key is kept, so a different key with the same
+// hash is treated as duplicated. The chance is about n*n/2^65 for n keys in the
+// window (less than one in a million for 5 million keys).
+type DedupIndex struct {
+	sync.Mutex
+	// key hash -> expire unix nano
+	keys     map[uint64]int64
+	fileName string
+	diskSize int64
+	dirty    bool
+	// the changes not flushed to the log, the deleted key has zero expire
+	pending     []byte
+	logFile     *os.File
+	logEntries  int
+	fileEntries int
+	// compact on next flush since the log is broken by the failed write
+	forceCompact bool
+	// the log is written but not synced to the disk
+	logUnsynced bool
+	// the keys of the messages writing, closed after the write finished
+	reserved map[uint64]chan struct{}
+}
+
+func NewDedupIndex(fileName string) *DedupIndex {
+	return &DedupIndex{
+		keys:     make(map[uint64]int64),
+		fileName: fileName,
+		reserved: make(map[uint64]chan struct{}),
+	}
+}
+
+func (self *DedupIndex) logFileName() string {
+	return self.fileName + ".log"
+}
+
+func (self *DedupIndex) appendLogNoLock(h uint64, expire int64) {
+	var buf [dedupIndexEntryDiskSize]byte
+	binary.BigEndian.PutUint64(buf[:8], h)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(expire))
+	self.pending = append(self.pending, buf[:]...)
+	self.dirty = true
+}
+
+func DedupKeyHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// Reserve returns true if the key is already in the index and not expired, otherwise
+// the key is reserved for the message writing and should be added by Set after the
+// write committed, and released by Release anyway. If the key is reserved by the
+// other writing, the channel to wait the writing finished is returned.
+func (self *DedupIndex) Reserve(key []byte, now int64) (bool, chan struct{}) {
+	h := DedupKeyHash(key)
+	self.Lock()
+	defer self.Unlock()
+	if e, ok := self.keys[h]; ok && e > now {
+		return true, nil
+	}
+	if waitChan, ok := self.reserved[h]; ok {
+		return false, waitChan
+	}
+	self.reserved[h] = make(chan struct{})
+	return false, nil
+}
+
+// Release releases the reserved key and wakes up the writing waiting the key
+func (self *DedupIndex) Release(key []byte) {
+	h := DedupKeyHash(key)
+	self.Lock()
+	defer self.Unlock()
+	if waitChan, ok := self.reserved[h]; ok {
+		close(waitChan)
+		delete(self.reserved, h)
+	}
+}
+
+// Set adds the key with the expire time, the later expire time is kept.
+func (self *DedupIndex) Set(key []byte, expire int64) {
+	h := DedupKeyHash(key)
+	self.Lock()
+	defer self.Unlock()
+	if e, ok := self.keys[h]; ok && e >= expire {
+		return
+	}
+	self.keys[h] = expire
+	self.appendLogNoLock(h, expire)
+}
+
+// Expire removes the expired keys from the memory, and compacts the index file
+// and the log if too many stale entries on the disk. It returns the number of the
+// removed keys.
+func (self *DedupIndex) Expire(now int64) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+	cnt := 0
+	for h, e := range self.keys {
+		if e <= now {
+			delete(self.keys, h)
+			cnt++
+		}
+	}
+	if cnt > 0 {
+		self.dirty = true
+	}
+	if self.needCompactNoLock() {
+		// the stale entries may be loaded from the disk without any change
+		self.dirty = true
+		return cnt, self.saveNoLock(now)
+	}
+	return cnt, nil
+}
+
+// the expired, trimmed and overwritten keys on the disk are stale and can be compacted
+func (self *DedupIndex) needCompactNoLock() bool {
+	if self.forceCompact {
+		return true
+	}
+	stale := self.fileEntries + self.logEntries + len(self.pending)/dedupIndexEntryDiskSize - len(self.keys)
+	return stale > len(self.keys) && stale > dedupIndexMinCompactEntries
+}
+
+// TrimOldest removes the keys expiring earliest until at most max keys left, it
+// returns the number of the removed keys.
+func (self *DedupIndex) TrimOldest(max int) int {
+	self.Lock()
+	defer self.Unlock()
+	if len(self.keys) <= max {
+		return 0
+	}
+	expires := make(int64Slice, 0, len(self.keys))
+	for _, e := range self.keys {
+		expires = append(expires, e)
+	}
+	sort.Sort(expires)
+	// keys expiring before the threshold are removed, and the keys at the
+	// threshold are removed until the count is reached
+	threshold := expires[len(expires)-max-1]
+	cnt := 0
+	for h, e := range self.keys {
+		if e < threshold {
+			delete(self.keys, h)
+			self.appendLogNoLock(h, 0)
+			cnt++
+		}
+	}
+	for h, e := range self.keys {
+		if len(self.keys) <= max {
+			break
+		}
+		if e == threshold {
+			delete(self.keys, h)
+			self.appendLogNoLock(h, 0)
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (self *DedupIndex) Len() int {
+	self.Lock()
+	defer self.Unlock()
+	return len(self.keys)
+}
+
+func (self *DedupIndex) GetStats() DedupIndexStats {
+	self.Lock()
+	defer self.Unlock()
+	return DedupIndexStats{
+		KeyCount:  len(self.keys),
+		MemBytes:  int64(len(self.keys)) * dedupIndexEntryMemSize,
+		DiskBytes: self.diskSize,
+	}
+}
+
+// Flush appends the changes since last flush to the log file, and the log will be
+// compacted into the index file if it grows too large. The log is synced to the
+// disk if fsync, so the keys are durable as long as the topic data synced with it.
+func (self *DedupIndex) Flush(now int64, fsync bool) error {
+	self.Lock()
+	defer self.Unlock()
+	if len(self.pending) == 0 {
+		return self.syncLogNoLock(fsync)
+	}
+	if self.needCompactNoLock() {
+		return self.saveNoLock(now)
+	}
+	if self.logFile == nil {
+		f, err := os.OpenFile(self.logFileName(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		self.logFile = f
+	}
+	n, err := self.logFile.Write(self.pending)
+	self.diskSize += int64(n)
+	if err != nil {
+		// the partial entry is ignored while loading, and the next flush will
+		// compact all the keys into the index file
+		self.forceCompact = true
+		return err
+	}
+	self.logEntries += len(self.pending) / dedupIndexEntryDiskSize
+	self.pending = self.pending[:0]
+	self.logUnsynced = true
+	return self.syncLogNoLock(fsync)
+}
+
+func (self *DedupIndex) syncLogNoLock(fsync bool) error {
+	if !fsync || !self.logUnsynced || self.logFile == nil {
+		return nil
+	}
+	err := self.logFile.Sync()
+	if err != nil {
+		return err
+	}
+	self.logUnsynced = false
+	return nil
+}
+
+func (self *DedupIndex) closeLogNoLock() {
+	if self.logFile != nil {
+		self.logFile.Close()
+		self.logFile = nil
+	}
+	self.logEntries = 0
+	self.forceCompact = false
+	self.logUnsynced = false
+	self.pending = self.pending[:0]
+}
+
+// Save writes the unexpired keys to the index file and removes the log, nothing
+// will be written if no key changed since last save.
+func (self *DedupIndex) Save(now int64) error {
+	self.Lock()
+	defer self.Unlock()
+	return self.saveNoLock(now)
+}
+
+func (self *DedupIndex) saveNoLock(now int64) error {
+	if !self.dirty {
+		return nil
+	}
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", self.fileName, rand.Int())
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	for h, e := range self.keys {
+		if e <= now {
+			delete(self.keys, h)
+		}
+	}
+	w := bufio.NewWriter(f)
+	var buf [dedupIndexEntryDiskSize]byte
+	binary.BigEndian.PutUint32(buf[:4], dedupIndexMagic)
+	binary.BigEndian.PutUint32(buf[4:8], dedupIndexVersion)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(len(self.keys)))
+	w.Write(buf[:])
+	for h, e := range self.keys {
+		binary.BigEndian.PutUint64(buf[:8], h)
+		binary.BigEndian.PutUint64(buf[8:16], uint64(e))
+		w.Write(buf[:])
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		os.Remove(tmpFileName)
+		return err
+	}
+	f.Sync()
+	f.Close()
+	err = util.AtomicRename(tmpFileName, self.fileName)
+	if err != nil {
+		return err
+	}
+	// all the changes in the log are in the index file now
+	self.closeLogNoLock()
+	err = os.Remove(self.logFileName())
+	if err != nil && !os.IsNotExist(err) {
+		nsqLog.Infof("remove file %v failed:%v", self.logFileName(), err)
+	}
+	self.fileEntries = len(self.keys)
+	self.diskSize = int64(len(self.keys)+1) * dedupIndexEntryDiskSize
+	self.dirty = false
+	return nil
+}
+
+// Load reads the index file and replays the log, the expired keys will be ignored.
+func (self *DedupIndex) Load(now int64) error {
+	keys := make(map[uint64]int64)
+	diskSize, err := loadDedupIndexFile(self.fileName, keys, now)
+	if err != nil {
+		return err
+	}
+	fileEntries := 0
+	if diskSize > 0 {
+		// exclude the header
+		fileEntries = int(diskSize/dedupIndexEntryDiskSize) - 1
+	}
+	logEntries, err := loadDedupIndexLog(self.logFileName(), keys, now)
+	if err != nil {
+		return err
+	}
+	self.Lock()
+	self.closeLogNoLock()
+	self.keys = keys
+	self.fileEntries = fileEntries
+	self.logEntries = logEntries
+	self.diskSize = diskSize + int64(logEntries)*dedupIndexEntryDiskSize
+	// the log will be compacted on next save
+	self.dirty = logEntries > 0
+	self.Unlock()
+	return nil
+}
+
+func loadDedupIndexFile(fileName string, keys map[uint64]int64, now int64) (int64, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var buf [dedupIndexEntryDiskSize]byte
+	_, err = io.ReadFull(r, buf[:])
+	if err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(buf[:4]) != dedupIndexMagic ||
+		binary.BigEndian.Uint32(buf[4:8]) != dedupIndexVersion {
+		return 0, errInvalidDedupIndexFile
+	}
+	cnt := binary.BigEndian.Uint64(buf[8:16])
+	for i := uint64(0); i < cnt; i++ {
+		_, err = io.ReadFull(r, buf[:])
+		if err != nil {
+			return 0, err
+		}
+		e := int64(binary.BigEndian.Uint64(buf[8:16]))
+		if e <= now {
+			continue
+		}
+		keys[binary.BigEndian.Uint64(buf[:8])] = e
+	}
+	return int64(cnt+1) * dedupIndexEntryDiskSize, nil
+}
+
+// loadDedupIndexLog replays the changes in the log in order, the partial entry
+// at the end written while crashing is ignored.
+func loadDedupIndexLog(fileName string, keys map[uint64]int64, now int64) (int, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var buf [dedupIndexEntryDiskSize]byte
+	cnt := 0
+	for {
+		_, err = io.ReadFull(r, buf[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return cnt, nil
+		}
+		if err != nil {
+			return cnt, err
+		}
+		cnt++
+		h := binary.BigEndian.Uint64(buf[:8])
+		e := int64(binary.BigEndian.Uint64(buf[8:16]))
+		if e <= now {
+			delete(keys, h)
+			continue
+		}
+		keys[h] = e
+	}
+}
+
+func (self *DedupIndex) Remove() {
+	self.Lock()
+	defer self.Unlock()
+	self.closeLogNoLock()
+	self.keys = make(map[uint64]int64)
+	self.fileEntries = 0
+	self.diskSize = 0
+	self.dirty = false
+	for _, fileName := range []string{self.fileName, self.logFileName()} {
+		err := os.Remove(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			nsqLog.Infof("remove file %v failed:%v", fileName, err)
+		}
+	}
+}
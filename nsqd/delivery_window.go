@@ -0,0 +1,84 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidDeliveryWindow = errors.New("invalid delivery window")
+
+// DeliveryWindow limits the time of day the channel messages can be delivered,
+// the messages will be held outside the window. The window will cross the
+// midnight if the start is later than the end (22:00-06:00).
+type DeliveryWindow struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone,omitempty"`
+
+	startMinute int
+	endMinute   int
+	loc         *time.Location
+}
+
+func parseMinuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, ErrInvalidDeliveryWindow
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ParseDeliveryWindow parses the start and end in the format HH:MM, the local
+// timezone of the nsqd will be used if timezone is empty.
+func ParseDeliveryWindow(start string, end string, timezone string) (*DeliveryWindow, error) {
+	w := &DeliveryWindow{
+		Start:    start,
+		End:      end,
+		Timezone: timezone,
+	}
+	var err error
+	w.startMinute, err = parseMinuteOfDay(start)
+	if err != nil {
+		return nil, err
+	}
+	w.endMinute, err = parseMinuteOfDay(end)
+	if err != nil {
+		return nil, err
+	}
+	if w.startMinute == w.endMinute {
+		return nil, ErrInvalidDeliveryWindow
+	}
+	w.loc = time.Local
+	if timezone != "" {
+		w.loc, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Contains returns true if the messages can be delivered at the given time.
+func (w *DeliveryWindow) Contains(now time.Time) bool {
+	now = now.In(w.loc)
+	minute := now.Hour()*60 + now.Minute()
+	if w.startMinute < w.endMinute {
+		return minute >= w.startMinute && minute < w.endMinute
+	}
+	return minute >= w.startMinute || minute < w.endMinute
+}
+
+func (w *DeliveryWindow) equal(o *DeliveryWindow) bool {
+	if w == nil || o == nil {
+		return w == o
+	}
+	return w.Start == o.Start && w.End == o.End && w.Timezone == o.Timezone
+}
+
+func (w *DeliveryWindow) String() string {
+	if w.Timezone == "" {
+		return fmt.Sprintf("%v-%v", w.Start, w.End)
+	}
+	return fmt.Sprintf("%v-%v %v", w.Start, w.End, w.Timezone)
+}
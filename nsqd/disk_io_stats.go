@@ -0,0 +1,68 @@
+package nsqd
+
+import (
+	"sync/atomic"
+)
+
+// DiskIOStats is the accumulated disk io of the topic partition since the partition
+// loaded, so we can tell the write latency is caused by the fsync or the segment
+// rolling or the read contention.
+type DiskIOStats struct {
+	WriteBytes int64 `json:"write_bytes" pb:"1"`
+	// the bytes read from the disk by all the channels of the partition, including
+	// the deleted channels
+	ReadBytes int64 `json:"read_bytes" pb:"2"`
+	Syncs     int64 `json:"syncs" pb:"3"`
+	// <1024us, 2ms, 4ms, 8ms, 16ms, 32ms, 64ms, 128ms, 256ms, 512ms, 1024ms, 2048ms, 4s, 8s, 16s, above
+	SyncLatencyStats []int64 `json:"sync_latency_stats" pb:"4"`
+	SegmentRolls     int64   `json:"segment_rolls" pb:"5"`
+	// the segment files not cleaned currently
+	SegmentFiles int64 `json:"segment_files" pb:"6"`
+}
+
+type diskIOCounters struct {
+	writeBytes   int64
+	segmentRolls int64
+	// the bytes read by the deleted channels
+	deletedReadBytes int64
+}
+
+func (c *diskIOCounters) addWrite(n int) {
+	atomic.AddInt64(&c.writeBytes, int64(n))
+}
+
+func (c *diskIOCounters) addRoll() {
+	atomic.AddInt64(&c.segmentRolls, 1)
+}
+
+func (c *diskIOCounters) getStats() DiskIOStats {
+	return DiskIOStats{
+		WriteBytes:   atomic.LoadInt64(&c.writeBytes),
+		SegmentRolls: atomic.LoadInt64(&c.segmentRolls),
+	}
+}
+
+// getSegmentFiles returns the segment files from the queue start to the write end
+func (d *diskQueueWriter) getSegmentFiles() int64 {
+	d.RLock()
+	n := d.diskWriteEnd.EndOffset.FileNum - d.diskQueueStart.EndOffset.FileNum + 1
+	d.RUnlock()
+	return n
+}
+
+// GetDiskIOStats returns the disk io of the partition, the fsync stats are from the
+// same latency recorder of the slow disk check.
+func (t *Topic) GetDiskIOStats() DiskIOStats {
+	s := t.backend.ioCounters.getStats()
+	s.Syncs, s.SyncLatencyStats = t.backend.latency.getSyncStats()
+	s.SegmentFiles = t.backend.getSegmentFiles()
+	// the read bytes of the deleted channel is moved to the counters while
+	// locked, so the read bytes never decrease
+	t.channelLock.RLock()
+	s.ReadBytes = atomic.LoadInt64(&t.backend.ioCounters.deletedReadBytes)
+	for _, c := range t.channelMap {
+		s.ReadBytes += c.GetDiskReadBytes()
+	}
+	t.channelLock.RUnlock()
+	return s
+}
@@ -0,0 +1,149 @@
+package nsqd
+
+import (
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DiskLatencyStats is the disk write and fsync latency of the topic partition in
+// the last check window of the slow disk.
+type DiskLatencyStats struct {
+	WriteAvgUs    int64 `json:"write_avg_us" pb:"1"`
+	WriteMaxUs    int64 `json:"write_max_us" pb:"2"`
+	Writes        int64 `json:"writes" pb:"3"`
+	SyncAvgUs     int64 `json:"sync_avg_us" pb:"4"`
+	SyncMaxUs     int64 `json:"sync_max_us" pb:"5"`
+	Syncs         int64 `json:"syncs" pb:"6"`
+	DegradedSince int64 `json:"degraded_since,omitempty" pb:"7"`
+}
+
+type latencyWindow struct {
+	sum int64
+	max int64
+	cnt int64
+}
+
+func (w *latencyWindow) add(cost int64) {
+	w.sum += cost
+	w.cnt++
+	if cost > w.max {
+		w.max = cost
+	}
+}
+
+func (w *latencyWindow) avgUs() int64 {
+	if w.cnt == 0 {
+		return 0
+	}
+	return w.sum / w.cnt / int64(time.Microsecond)
+}
+
+type diskLatency struct {
+	sync.Mutex
+	write latencyWindow
+	fsync latencyWindow
+	last  DiskLatencyStats
+	// the fsync count and latency histogram accumulated since loaded
+	syncs       int64
+	syncLatency [16]int64
+}
+
+func (l *diskLatency) updateWrite(cost time.Duration) {
+	l.Lock()
+	l.write.add(int64(cost))
+	l.Unlock()
+}
+
+func (l *diskLatency) updateSync(cost time.Duration) {
+	l.Lock()
+	l.fsync.add(int64(cost))
+	l.Unlock()
+	atomic.AddInt64(&l.syncs, 1)
+	bucket := 0
+	if us := int64(cost / time.Microsecond); us >= 1024 {
+		bucket = int(math.Log2(float64(us/1024))) + 1
+	}
+	if bucket >= len(l.syncLatency) {
+		bucket = len(l.syncLatency) - 1
+	}
+	atomic.AddInt64(&l.syncLatency[bucket], 1)
+}
+
+// getSyncStats returns the accumulated fsync count and latency histogram
+func (l *diskLatency) getSyncStats() (int64, []int64) {
+	hist := make([]int64, len(l.syncLatency))
+	for i := range l.syncLatency {
+		hist[i] = atomic.LoadInt64(&l.syncLatency[i])
+	}
+	return atomic.LoadInt64(&l.syncs), hist
+}
+
+// rotate ends the current window and returns the latency of the window
+func (l *diskLatency) rotate() DiskLatencyStats {
+	l.Lock()
+	defer l.Unlock()
+	l.last = DiskLatencyStats{
+		WriteAvgUs: l.write.avgUs(),
+		WriteMaxUs: l.write.max / int64(time.Microsecond),
+		Writes:     l.write.cnt,
+		SyncAvgUs:  l.fsync.avgUs(),
+		SyncMaxUs:  l.fsync.max / int64(time.Microsecond),
+		Syncs:      l.fsync.cnt,
+	}
+	l.write = latencyWindow{}
+	l.fsync = latencyWindow{}
+	return l.last
+}
+
+func (l *diskLatency) getLast() DiskLatencyStats {
+	l.Lock()
+	defer l.Unlock()
+	return l.last
+}
+
+// latencyWriter measures the latency of the writes to the file under the buffer
+type latencyWriter struct {
+	w  io.Writer
+	l  *diskLatency
+	io *diskIOCounters
+}
+
+func (lw *latencyWriter) Write(p []byte) (int, error) {
+	s := time.Now()
+	n, err := lw.w.Write(p)
+	lw.l.updateWrite(time.Since(s))
+	lw.io.addWrite(n)
+	return n, err
+}
+
+// GetDiskLatencyStats returns the disk latency of the partition in the last window
+func (t *Topic) GetDiskLatencyStats() DiskLatencyStats {
+	s := t.backend.latency.getLast()
+	s.DegradedSince = atomic.LoadInt64(&t.diskDegradedSince)
+	return s
+}
+
+// RotateDiskLatency ends the current latency window, it should be called
+// periodically by the slow disk checker.
+func (t *Topic) RotateDiskLatency() DiskLatencyStats {
+	s := t.backend.latency.rotate()
+	s.DegradedSince = atomic.LoadInt64(&t.diskDegradedSince)
+	return s
+}
+
+// SetDiskDegraded marks the partition as on the degraded disk, the leadership of
+// the partition should be transferred to others.
+func (t *Topic) SetDiskDegraded(degraded bool) {
+	if degraded {
+		atomic.CompareAndSwapInt64(&t.diskDegradedSince, 0, time.Now().Unix())
+	} else {
+		atomic.StoreInt64(&t.diskDegradedSince, 0)
+	}
+}
+
+func (t *Topic) IsDiskDegraded() bool {
+	return atomic.LoadInt64(&t.diskDegradedSince) != 0
+}
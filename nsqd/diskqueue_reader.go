@@ -92,6 +92,10 @@ type diskQueueReader struct {
 	// left message number for read
 	depth     int64
 	depthSize int64
+	// the bytes read from the disk files
+	readBytes int64
+	// the total message count of the queue end, for the stats without lock
+	endMsgCnt int64
 
 	sync.RWMutex
 
@@ -143,7 +147,7 @@ func newDiskQueueReader(readFrom string, metaname string, dataPath string, maxBy
 	// no need to lock here, nothing else could possibly be touching this instance
 	err := d.retrieveMetaData()
 	if err != nil && !os.IsNotExist(err) {
-		nsqLog.LogErrorf("diskqueue(%s) failed to retrieveMetaData %v - %s",
+		diskLog.LogErrorf("diskqueue(%s) failed to retrieveMetaData %v - %s",
 			d.readFrom, d.readerMetaName, err)
 	}
 
@@ -198,8 +202,8 @@ func (d *diskQueueReader) GetQueueCurrentRead() BackendQueueEnd {
 func (d *diskQueueReader) UpdateQueueEnd(e BackendQueueEnd, forceReload bool) (bool, error) {
 	end, ok := e.(*diskQueueEndInfo)
 	if !ok || end == nil {
-		if nsqLog.Level() >= levellogger.LOG_DEBUG {
-			nsqLog.Logf("%v got nil end while update queue end", d.readerMetaName)
+		if diskLog.Level() >= levellogger.LOG_DEBUG {
+			diskLog.Logf("%v got nil end while update queue end", d.readerMetaName)
 		}
 		return false, nil
 	}
@@ -226,7 +230,7 @@ func (d *diskQueueReader) exit(deleted bool) error {
 
 	d.exitFlag = 1
 	close(d.exitChan)
-	nsqLog.Logf("diskqueue(%s) exiting ", d.readerMetaName)
+	diskLog.Logf("diskqueue(%s) exiting ", d.readerMetaName)
 	if d.readFile != nil {
 		d.readFile.Close()
 		d.readFile = nil
@@ -237,13 +241,13 @@ func (d *diskQueueReader) exit(deleted bool) error {
 		err := os.Remove(d.metaDataFileName(false))
 
 		if err != nil && !os.IsNotExist(err) {
-			nsqLog.LogErrorf("diskqueue(%s) failed to remove metadata file - %s", d.readerMetaName, err)
+			diskLog.LogErrorf("diskqueue(%s) failed to remove metadata file - %s", d.readerMetaName, err)
 		}
 		err = os.Remove(d.metaDataFileName(true))
 		if err != nil && !os.IsNotExist(err) {
-			nsqLog.LogErrorf("diskqueue(%s) failed to remove new metadata file - %s", d.readerMetaName, err)
+			diskLog.LogErrorf("diskqueue(%s) failed to remove new metadata file - %s", d.readerMetaName, err)
 		}
-		nsqLog.Logf("diskqueue(%s) remove new metadata file - %v", d.readerMetaName, d.metaDataFileName(true))
+		diskLog.Logf("diskqueue(%s) remove new metadata file - %v", d.readerMetaName, d.metaDataFileName(true))
 	}
 	return nil
 }
@@ -310,7 +314,7 @@ func (d *diskQueueReader) ResetReadToOffset(offset BackendOffset, cnt int64) (Ba
 	d.readBuffer.Reset()
 
 	old := d.confirmedQueueInfo.Offset()
-	nsqLog.Infof("reset from: %v, %v to: %v:%v", d.readQueueInfo, d.confirmedQueueInfo, offset, cnt)
+	diskLog.Infof("reset from: %v, %v to: %v:%v", d.readQueueInfo, d.confirmedQueueInfo, offset, cnt)
 	err := d.internalSkipTo(offset, cnt, offset < old)
 	if err == nil {
 		if old != d.confirmedQueueInfo.Offset() {
@@ -319,7 +323,7 @@ func (d *diskQueueReader) ResetReadToOffset(offset BackendOffset, cnt int64) (Ba
 		}
 	}
 
-	nsqLog.Infof("reset reader to: %v, %v", d.readQueueInfo, d.confirmedQueueInfo)
+	diskLog.Infof("reset reader to: %v, %v", d.readQueueInfo, d.confirmedQueueInfo)
 	e := d.confirmedQueueInfo
 	return &e, err
 }
@@ -428,7 +432,7 @@ func (d *diskQueueReader) TryReadOne() (ReadResult, bool) {
 			dataRead := d.readOne()
 			rerr := dataRead.Err
 			if rerr != nil {
-				nsqLog.LogErrorf("reading from diskqueue(%s) at %d of %s - %s, current end: %v",
+				diskLog.LogErrorf("reading from diskqueue(%s) at %d of %s - %s, current end: %v",
 					d.readerMetaName, d.readQueueInfo, d.fileName(d.readQueueInfo.EndOffset.FileNum), dataRead.Err, d.queueEndInfo)
 				if rerr != ErrReadQueueCountMissing && d.autoSkipError {
 					d.handleReadError()
@@ -437,8 +441,8 @@ func (d *diskQueueReader) TryReadOne() (ReadResult, bool) {
 			}
 			return dataRead, true
 		} else {
-			if nsqLog.Level() >= levellogger.LOG_DETAIL {
-				nsqLog.LogDebugf("reading from diskqueue(%s) no more data at pos: %v, queue end: %v, confirmed: %v",
+			if diskLog.Level() >= levellogger.LOG_DETAIL {
+				diskLog.LogDebugf("reading from diskqueue(%s) no more data at pos: %v, queue end: %v, confirmed: %v",
 					d.readerMetaName, d.readQueueInfo, d.queueEndInfo, d.confirmedQueueInfo)
 			}
 			return ReadResult{}, false
@@ -447,6 +451,7 @@ func (d *diskQueueReader) TryReadOne() (ReadResult, bool) {
 }
 
 func (d *diskQueueReader) updateDepth() {
+	atomic.StoreInt64(&d.endMsgCnt, d.queueEndInfo.TotalMsgCnt())
 	newDepth := int64(0)
 	if d.confirmedQueueInfo.EndOffset.FileNum > d.queueEndInfo.EndOffset.FileNum {
 		atomic.StoreInt64(&d.depth, 0)
@@ -458,7 +463,7 @@ func (d *diskQueueReader) updateDepth() {
 		atomic.StoreInt64(&d.depth, newDepth)
 		if newDepthSize == 0 {
 			if newDepth != 0 {
-				nsqLog.Warningf("the confirmed info conflict with queue end: %v, %v", d.confirmedQueueInfo, d.queueEndInfo)
+				diskLog.Warningf("the confirmed info conflict with queue end: %v, %v", d.confirmedQueueInfo, d.queueEndInfo)
 				d.confirmedQueueInfo = d.queueEndInfo
 			}
 			newDepth = 0
@@ -515,17 +520,17 @@ func stepOffset(dataRoot string, readFrom string, cur diskQueueEndInfo, step Bac
 		step = 0 - step
 		for step > BackendOffset(newOffset.EndOffset.Pos) {
 			virtualCur -= BackendOffset(newOffset.EndOffset.Pos)
-			nsqLog.Logf("step read back to previous file: %v, %v, virtual offset: %v", step, newOffset, virtualCur)
+			diskLog.Logf("step read back to previous file: %v, %v, virtual offset: %v", step, newOffset, virtualCur)
 			step -= BackendOffset(newOffset.EndOffset.Pos)
 			newOffset.EndOffset.FileNum--
 			if newOffset.EndOffset.FileNum < 0 {
-				nsqLog.Logf("reset read acrossed the begin %v, %v", step, newOffset)
+				diskLog.Logf("reset read acrossed the begin %v, %v", step, newOffset)
 				return newOffset.EndOffset, ErrMoveOffsetInvalid
 			}
 			var f os.FileInfo
 			f, err = os.Stat(GetQueueFileName(dataRoot, readFrom, newOffset.EndOffset.FileNum))
 			if err != nil {
-				nsqLog.LogErrorf("stat data file error %v, %v: %v", step, newOffset, err)
+				diskLog.LogErrorf("stat data file error %v, %v: %v", step, newOffset, err)
 				if os.IsNotExist(err) {
 					return newOffset.EndOffset, ErrReadQueueAlreadyCleaned
 				}
@@ -573,15 +578,15 @@ func (d *diskQueueReader) internalConfirm(offset BackendOffset, cnt int64) error
 	if int64(offset) == -1 {
 		d.confirmedQueueInfo = d.readQueueInfo
 		d.updateDepth()
-		nsqLog.LogDebugf("confirmed to end: %v", d.confirmedQueueInfo)
+		diskLog.LogDebugf("confirmed to end: %v", d.confirmedQueueInfo)
 		return nil
 	}
 	if offset <= d.confirmedQueueInfo.Offset() {
-		nsqLog.LogDebugf("already confirmed to : %v", d.confirmedQueueInfo.Offset())
+		diskLog.LogDebugf("already confirmed to : %v", d.confirmedQueueInfo.Offset())
 		return nil
 	}
 	if offset > d.readQueueInfo.Offset() {
-		nsqLog.LogErrorf("confirm exceed read: %v, %v", offset, d.readQueueInfo.Offset())
+		diskLog.LogErrorf("confirm exceed read: %v, %v", offset, d.readQueueInfo.Offset())
 		return ErrConfirmSizeInvalid
 	}
 	if offset == d.readQueueInfo.Offset() {
@@ -589,12 +594,12 @@ func (d *diskQueueReader) internalConfirm(offset BackendOffset, cnt int64) error
 			cnt = d.readQueueInfo.TotalMsgCnt()
 		}
 		if cnt != d.readQueueInfo.TotalMsgCnt() {
-			nsqLog.LogErrorf("confirm read count invalid: %v:%v, %v", offset, cnt, d.readQueueInfo)
+			diskLog.LogErrorf("confirm read count invalid: %v:%v, %v", offset, cnt, d.readQueueInfo)
 			return ErrConfirmCntInvalid
 		}
 	}
 	if cnt == 0 && offset != BackendOffset(0) {
-		nsqLog.LogErrorf("confirm read count invalid: %v:%v, %v", offset, cnt, d.readQueueInfo)
+		diskLog.LogErrorf("confirm read count invalid: %v:%v, %v", offset, cnt, d.readQueueInfo)
 		return ErrConfirmCntInvalid
 	}
 
@@ -602,25 +607,25 @@ func (d *diskQueueReader) internalConfirm(offset BackendOffset, cnt int64) error
 	newConfirm, err := stepOffset(d.dataPath, d.readFrom,
 		d.confirmedQueueInfo, diffVirtual, d.readQueueInfo)
 	if err != nil {
-		nsqLog.LogErrorf("confirmed exceed the read pos: %v, %v", offset, d.readQueueInfo.Offset())
+		diskLog.LogErrorf("confirmed exceed the read pos: %v, %v", offset, d.readQueueInfo.Offset())
 		return ErrConfirmSizeInvalid
 	}
 	if newConfirm.GreatThan(&d.queueEndInfo.EndOffset) || offset > d.queueEndInfo.Offset() {
-		nsqLog.LogErrorf("confirmed exceed the end pos: %v, %v, %v", newConfirm, offset, d.queueEndInfo)
+		diskLog.LogErrorf("confirmed exceed the end pos: %v, %v, %v", newConfirm, offset, d.queueEndInfo)
 		return ErrConfirmSizeInvalid
 	}
 	d.confirmedQueueInfo.EndOffset = newConfirm
 	d.confirmedQueueInfo.virtualEnd = offset
 	atomic.StoreInt64(&d.confirmedQueueInfo.totalMsgCnt, cnt)
 	d.updateDepth()
-	//nsqLog.LogDebugf("confirmed to offset: %v:%v", offset, cnt)
+	//diskLog.LogDebugf("confirmed to offset: %v:%v", offset, cnt)
 	return nil
 }
 
 func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backToConfirmed bool) error {
 	if voffset == d.readQueueInfo.Offset() {
 		if cnt != 0 && d.readQueueInfo.TotalMsgCnt() != cnt {
-			nsqLog.Logf("try sync the message count since the cnt is not matched: %v, %v", cnt, d.readQueueInfo)
+			diskLog.Logf("try sync the message count since the cnt is not matched: %v, %v", cnt, d.readQueueInfo)
 			atomic.StoreInt64(&d.readQueueInfo.totalMsgCnt, cnt)
 		}
 		d.confirmedQueueInfo = d.readQueueInfo
@@ -635,7 +640,7 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 
 	if voffset == d.confirmedQueueInfo.Offset() {
 		if cnt != 0 && d.confirmedQueueInfo.TotalMsgCnt() != cnt {
-			nsqLog.Logf("try sync the message count since the cnt is not matched: %v, %v", cnt, d.confirmedQueueInfo)
+			diskLog.Logf("try sync the message count since the cnt is not matched: %v, %v", cnt, d.confirmedQueueInfo)
 			atomic.StoreInt64(&d.confirmedQueueInfo.totalMsgCnt, cnt)
 		}
 		d.readQueueInfo = d.confirmedQueueInfo
@@ -646,42 +651,42 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 	newPos := d.queueEndInfo.EndOffset
 	var err error
 	if voffset < d.confirmedQueueInfo.Offset() {
-		nsqLog.Logf("skip backward to less than confirmed: %v, %v", voffset, d.confirmedQueueInfo.Offset())
+		diskLog.Logf("skip backward to less than confirmed: %v, %v", voffset, d.confirmedQueueInfo.Offset())
 		if !backToConfirmed {
 			return ErrMoveOffsetInvalid
 		}
 	}
 
 	if voffset > d.queueEndInfo.Offset() || cnt > d.queueEndInfo.TotalMsgCnt() {
-		nsqLog.Logf("internal skip great than end : %v, skipping to : %v:%v", d.queueEndInfo, voffset, cnt)
+		diskLog.Logf("internal skip great than end : %v, skipping to : %v:%v", d.queueEndInfo, voffset, cnt)
 		return ErrMoveOffsetOverflowed
 	} else if voffset == d.queueEndInfo.Offset() {
 		newPos = d.queueEndInfo.EndOffset
 		if cnt == 0 {
 			cnt = d.queueEndInfo.TotalMsgCnt()
 		} else if cnt != d.queueEndInfo.TotalMsgCnt() {
-			nsqLog.LogErrorf("internal skip count invalid: %v:%v, current end: %v", voffset, cnt, d.queueEndInfo)
+			diskLog.LogErrorf("internal skip count invalid: %v:%v, current end: %v", voffset, cnt, d.queueEndInfo)
 			return ErrMoveOffsetInvalid
 		}
 	} else {
 		if cnt == 0 && voffset != BackendOffset(0) {
-			nsqLog.LogErrorf("confirm read count invalid: %v:%v, %v", voffset, cnt, d.readQueueInfo)
+			diskLog.LogErrorf("confirm read count invalid: %v:%v, %v", voffset, cnt, d.readQueueInfo)
 			return ErrMoveOffsetInvalid
 		}
 
 		newPos, err = stepOffset(d.dataPath, d.readFrom, d.readQueueInfo,
 			voffset-d.readQueueInfo.Offset(), d.queueEndInfo)
 		if err != nil {
-			nsqLog.LogErrorf("internal skip error : %v, skipping to : %v", err, voffset)
+			diskLog.LogErrorf("internal skip error : %v, skipping to : %v", err, voffset)
 			if os.IsNotExist(err) {
-				nsqLog.Logf("internal skip because of not exist segment, try skip using the offset meta file")
+				diskLog.Logf("internal skip because of not exist segment, try skip using the offset meta file")
 				newPos = d.readQueueInfo.EndOffset
 				for {
 					if newPos.FileNum == d.queueEndInfo.EndOffset.FileNum {
 						// we reach to the end segment of queue
 						newPos.Pos = int64(voffset - (d.queueEndInfo.Offset() - BackendOffset(d.queueEndInfo.EndOffset.Pos)))
 						if newPos.Pos < 0 {
-							nsqLog.LogErrorf("skip error, current end: %v, skipto: %v, current: %v", d.queueEndInfo, voffset, newPos)
+							diskLog.LogErrorf("skip error, current end: %v, skipto: %v, current: %v", d.queueEndInfo, voffset, newPos)
 						} else {
 							err = nil
 						}
@@ -691,14 +696,14 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 					_, metaStartPos, metaEndPos, innerErr := getQueueFileOffsetMeta(d.fileName(newPos.FileNum))
 					if innerErr != nil {
 						if os.IsNotExist(innerErr) {
-							nsqLog.Logf("check segment offset meta not exist, try next: %v ", newPos)
+							diskLog.Logf("check segment offset meta not exist, try next: %v ", newPos)
 							newPos.FileNum++
 							newPos.Pos = 0
 							continue
 						}
 						break
 					}
-					nsqLog.Logf("check segment: %v offset, %v, %v ", newPos, metaStartPos, metaEndPos)
+					diskLog.Logf("check segment: %v offset, %v, %v ", newPos, metaStartPos, metaEndPos)
 					if voffset >= BackendOffset(metaEndPos) {
 						newPos.FileNum++
 						newPos.Pos = 0
@@ -715,15 +720,15 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 		}
 	}
 
-	if voffset < d.readQueueInfo.Offset() || nsqLog.Level() > levellogger.LOG_DEBUG {
-		nsqLog.Logf("==== diskqueue(%s) read skip from %v to : %v, %v",
+	if voffset < d.readQueueInfo.Offset() || diskLog.Level() > levellogger.LOG_DEBUG {
+		diskLog.Logf("==== diskqueue(%s) read skip from %v to : %v, %v",
 			d.readerMetaName, d.readQueueInfo, voffset, newPos)
 	}
 	d.readQueueInfo.EndOffset = newPos
 	d.readQueueInfo.virtualEnd = voffset
 	atomic.StoreInt64(&d.readQueueInfo.totalMsgCnt, cnt)
 	if d.readQueueInfo.EndOffset.GreatThan(&d.queueEndInfo.EndOffset) {
-		nsqLog.LogWarningf("==== read skip from %v to : %v, %v exceed end: %v", d.readQueueInfo,
+		diskLog.LogWarningf("==== read skip from %v to : %v, %v exceed end: %v", d.readQueueInfo,
 			voffset, newPos, d.queueEndInfo)
 		d.readQueueInfo = d.queueEndInfo
 	}
@@ -734,7 +739,7 @@ func (d *diskQueueReader) internalSkipTo(voffset BackendOffset, cnt int64, backT
 }
 
 func (d *diskQueueReader) skipToNextFile() error {
-	nsqLog.LogWarningf("diskqueue(%s) skip to next from %v, %v",
+	diskLog.LogWarningf("diskqueue(%s) skip to next from %v, %v",
 		d.readerMetaName, d.readQueueInfo, d.confirmedQueueInfo)
 	if d.confirmedQueueInfo.EndOffset.FileNum >= d.queueEndInfo.EndOffset.FileNum {
 		return d.skipToEndofQueue()
@@ -747,7 +752,7 @@ func (d *diskQueueReader) skipToNextFile() error {
 	for {
 		cnt, _, end, err := getQueueFileOffsetMeta(d.fileName(d.confirmedQueueInfo.EndOffset.FileNum))
 		if err != nil {
-			nsqLog.LogErrorf("diskqueue(%s) failed to skip to next %v : %v",
+			diskLog.LogErrorf("diskqueue(%s) failed to skip to next %v : %v",
 				d.readerMetaName, d.confirmedQueueInfo, err)
 			if os.IsNotExist(err) && d.confirmedQueueInfo.EndOffset.FileNum < d.queueEndInfo.EndOffset.FileNum-1 {
 				d.confirmedQueueInfo.EndOffset.FileNum++
@@ -763,12 +768,12 @@ func (d *diskQueueReader) skipToNextFile() error {
 		break
 	}
 	if d.confirmedQueueInfo.EndOffset != d.readQueueInfo.EndOffset {
-		nsqLog.LogErrorf("skip confirm to %v while read at: %v.", d.confirmedQueueInfo, d.readQueueInfo)
+		diskLog.LogErrorf("skip confirm to %v while read at: %v.", d.confirmedQueueInfo, d.readQueueInfo)
 	}
 	d.readQueueInfo = d.confirmedQueueInfo
 	d.updateDepth()
 
-	nsqLog.LogWarningf("diskqueue(%s) skip to next %v",
+	diskLog.LogWarningf("diskqueue(%s) skip to next %v",
 		d.readerMetaName, d.confirmedQueueInfo)
 	return nil
 }
@@ -782,7 +787,7 @@ func (d *diskQueueReader) skipToEndofQueue() error {
 
 	d.readQueueInfo = d.queueEndInfo
 	if d.confirmedQueueInfo.EndOffset != d.readQueueInfo.EndOffset {
-		nsqLog.LogErrorf("skip confirm from %v to %v.", d.confirmedQueueInfo, d.readQueueInfo)
+		diskLog.LogErrorf("skip confirm from %v to %v.", d.confirmedQueueInfo, d.readQueueInfo)
 	}
 	d.confirmedQueueInfo = d.readQueueInfo
 	d.updateDepth()
@@ -799,7 +804,7 @@ func (d *diskQueueReader) ensureReadBuffer(dataNeed int64, currentRead int64, cu
 		}
 		readable := currentFileEnd - currentRead
 		if readable < dataNeed {
-			nsqLog.LogErrorf("DISKQUEUE(%s): buffer error , no readable %v, %v, need: %v, cur end: %v", d.readerMetaName,
+			diskLog.LogErrorf("DISKQUEUE(%s): buffer error , no readable %v, %v, need: %v, cur end: %v", d.readerMetaName,
 				currentRead, currentFileEnd, dataNeed, d.queueEndInfo)
 			return ErrInvalidReadable
 		}
@@ -808,13 +813,14 @@ func (d *diskQueueReader) ensureReadBuffer(dataNeed int64, currentRead int64, cu
 		}
 
 		n, err := io.CopyN(d.readBuffer, d.readFile, bufDataSize-int64(d.readBuffer.Len()))
+		atomic.AddInt64(&d.readBytes, n)
 		if err != nil {
-			nsqLog.LogErrorf("DISKQUEUE(%s): read to buffer error: %v (read), current read: %v, current end:%v, buffer(%v, %v), need: %v, err: %v, end: %v",
+			diskLog.LogErrorf("DISKQUEUE(%s): read to buffer error: %v (read), current read: %v, current end:%v, buffer(%v, %v), need: %v, err: %v, end: %v",
 				d.readerMetaName, n, currentRead, currentFileEnd, d.readBuffer.Len(), bufDataSize,
 				dataNeed, err, d.queueEndInfo)
 			curPos, err := d.readFile.Seek(0, 1)
 			newPos, err := d.readFile.Seek(currentFileEnd, 0)
-			nsqLog.Logf("seek to end : %v, %v, %v", curPos, newPos, err)
+			diskLog.Logf("seek to end : %v, %v, %v", curPos, newPos, err)
 			return err
 		}
 	}
@@ -830,7 +836,7 @@ func (d *diskQueueReader) readOne() ReadResult {
 	result.Offset = BackendOffset(0)
 	if d.readQueueInfo.totalMsgCnt <= 0 && d.readQueueInfo.Offset() > 0 {
 		result.Err = ErrReadQueueCountMissing
-		nsqLog.Warningf("diskqueue(%v) read offset invalid: %v (this may happen while upgrade, wait to fix)", d.readerMetaName, d.readQueueInfo)
+		diskLog.Warningf("diskqueue(%v) read offset invalid: %v (this may happen while upgrade, wait to fix)", d.readerMetaName, d.readQueueInfo)
 		return result
 	}
 
@@ -844,19 +850,19 @@ CheckFileOpen:
 			return result
 		}
 
-		if nsqLog.Level() >= levellogger.LOG_DEBUG {
-			nsqLog.LogDebugf("DISKQUEUE(%s): readOne() opened %s", d.readerMetaName, curFileName)
+		if diskLog.Level() >= levellogger.LOG_DEBUG {
+			diskLog.LogDebugf("DISKQUEUE(%s): readOne() opened %s", d.readerMetaName, curFileName)
 		}
 
 		if d.readQueueInfo.EndOffset.Pos > 0 {
 			_, result.Err = d.readFile.Seek(d.readQueueInfo.EndOffset.Pos, 0)
 			if result.Err != nil {
-				nsqLog.LogWarningf("DISKQUEUE(%s): seek %v error %s", d.readerMetaName, curFileName, result.Err)
+				diskLog.LogWarningf("DISKQUEUE(%s): seek %v error %s", d.readerMetaName, curFileName, result.Err)
 				tmpStat, tmpErr := d.readFile.Stat()
 				if tmpErr != nil {
-					nsqLog.LogWarningf("DISKQUEUE(%s): stat error %s", d.readerMetaName, tmpErr)
+					diskLog.LogWarningf("DISKQUEUE(%s): stat error %s", d.readerMetaName, tmpErr)
 				} else {
-					nsqLog.LogWarningf("DISKQUEUE(%s): stat %v", d.readerMetaName, tmpStat)
+					diskLog.LogWarningf("DISKQUEUE(%s): stat %v", d.readerMetaName, tmpStat)
 				}
 				d.readFile.Close()
 				d.readFile = nil
@@ -872,7 +878,7 @@ CheckFileOpen:
 		if d.readQueueInfo.EndOffset.Pos >= stat.Size() {
 			d.readQueueInfo.EndOffset.FileNum++
 			d.readQueueInfo.EndOffset.Pos = 0
-			nsqLog.Logf("DISKQUEUE(%s): readOne() read end, try next: %v",
+			diskLog.Logf("DISKQUEUE(%s): readOne() read end, try next: %v",
 				d.readerMetaName, d.readQueueInfo.EndOffset.FileNum)
 			d.readFile.Close()
 			d.readFile = nil
@@ -899,7 +905,7 @@ CheckFileOpen:
 			return result
 		}
 	} else {
-		nsqLog.LogWarningf("DISKQUEUE(%s): read %v exceed current end %v", d.readerMetaName,
+		diskLog.LogWarningf("DISKQUEUE(%s): read %v exceed current end %v", d.readerMetaName,
 			d.readQueueInfo, d.queueEndInfo)
 		result.Err = errors.New("exceed end of queue")
 		return result
@@ -907,17 +913,17 @@ CheckFileOpen:
 
 	result.Err = d.ensureReadBuffer(4, d.readQueueInfo.EndOffset.Pos, currentFileEnd)
 	if result.Err != nil {
-		nsqLog.LogWarningf("DISKQUEUE(%s): ensure buffer error, current end %v", d.readerMetaName, currentFileEnd)
+		diskLog.LogWarningf("DISKQUEUE(%s): ensure buffer error, current end %v", d.readerMetaName, currentFileEnd)
 		return result
 	}
 	result.Err = binary.Read(d.readBuffer, binary.BigEndian, &msgSize)
 	if result.Err != nil {
-		nsqLog.LogWarningf("DISKQUEUE(%s): read %v error %v", d.readerMetaName, d.readQueueInfo, result.Err)
+		diskLog.LogWarningf("DISKQUEUE(%s): read %v error %v", d.readerMetaName, d.readQueueInfo, result.Err)
 		tmpStat, tmpErr := d.readFile.Stat()
 		if tmpErr != nil {
-			nsqLog.LogWarningf("DISKQUEUE(%s): stat error %s", d.readerMetaName, tmpErr)
+			diskLog.LogWarningf("DISKQUEUE(%s): stat error %s", d.readerMetaName, tmpErr)
 		} else {
-			nsqLog.LogWarningf("DISKQUEUE(%s): stat %v", d.readerMetaName, tmpStat)
+			diskLog.LogWarningf("DISKQUEUE(%s): stat %v", d.readerMetaName, tmpStat)
 		}
 
 		return result
@@ -934,17 +940,17 @@ CheckFileOpen:
 
 	result.Err = d.ensureReadBuffer(int64(msgSize), d.readQueueInfo.EndOffset.Pos+4, currentFileEnd)
 	if result.Err != nil {
-		nsqLog.LogWarningf("DISKQUEUE(%s): ensure buffer error, current read end %v", d.readerMetaName, currentFileEnd)
+		diskLog.LogWarningf("DISKQUEUE(%s): ensure buffer error, current read end %v", d.readerMetaName, currentFileEnd)
 		return result
 	}
 	_, result.Err = io.ReadFull(d.readBuffer, result.Data)
 	if result.Err != nil {
-		nsqLog.LogWarningf("DISKQUEUE(%s): read %v error %v", d.readerMetaName, d.readQueueInfo, result.Err)
+		diskLog.LogWarningf("DISKQUEUE(%s): read %v error %v", d.readerMetaName, d.readQueueInfo, result.Err)
 		tmpStat, tmpErr := d.readFile.Stat()
 		if tmpErr != nil {
-			nsqLog.LogWarningf("DISKQUEUE(%s): stat error %s", d.readerMetaName, tmpErr)
+			diskLog.LogWarningf("DISKQUEUE(%s): stat error %s", d.readerMetaName, tmpErr)
 		} else {
-			nsqLog.LogWarningf("DISKQUEUE(%s): stat %v", d.readerMetaName, tmpStat)
+			diskLog.LogWarningf("DISKQUEUE(%s): stat %v", d.readerMetaName, tmpStat)
 		}
 
 		return result
@@ -964,13 +970,13 @@ CheckFileOpen:
 	d.readQueueInfo.virtualEnd += BackendOffset(totalBytes)
 	if d.readQueueInfo.virtualEnd == d.queueEndInfo.virtualEnd {
 		if d.readQueueInfo.totalMsgCnt != 0 && d.readQueueInfo.totalMsgCnt != d.queueEndInfo.totalMsgCnt {
-			nsqLog.LogWarningf("message read count not match with end: %v, %v", d.readQueueInfo, d.queueEndInfo)
+			diskLog.LogWarningf("message read count not match with end: %v, %v", d.readQueueInfo, d.queueEndInfo)
 		}
 		d.readQueueInfo.totalMsgCnt = d.queueEndInfo.totalMsgCnt
 	}
 
-	if nsqLog.Level() >= levellogger.LOG_DETAIL {
-		nsqLog.LogDebugf("=== read move forward: from %v (cnt:%v) to %v", oldPos, oldCnt,
+	if diskLog.Level() >= levellogger.LOG_DETAIL {
+		diskLog.LogDebugf("=== read move forward: from %v (cnt:%v) to %v", oldPos, oldCnt,
 			d.readQueueInfo)
 	}
 	// TODO: each data file should embed the maxBytesPerFile
@@ -982,7 +988,7 @@ CheckFileOpen:
 	}
 	if (d.readQueueInfo.EndOffset.Pos > d.maxBytesPerFile) && !isEnd {
 		// this can happen if the maxbytesperfile configure is changed.
-		nsqLog.LogDebugf("should be end since next position is larger than maxfile size. %v", d.readQueueInfo)
+		diskLog.LogDebugf("should be end since next position is larger than maxfile size. %v", d.readQueueInfo)
 	}
 	if isEnd {
 		if d.readFile != nil {
@@ -997,16 +1003,16 @@ CheckFileOpen:
 		if err == nil {
 			// we compare the meta file to check if any wrong on the count of message
 			if metaEnd != int64(d.readQueueInfo.Offset()) {
-				nsqLog.Warningf("the reader offset is not equal with the meta. %v", d.readQueueInfo, metaEnd)
+				diskLog.Warningf("the reader offset is not equal with the meta. %v", d.readQueueInfo, metaEnd)
 			} else {
 				if fixCnt != d.readQueueInfo.TotalMsgCnt() {
-					nsqLog.Warningf("the reader offset is not equal with the meta. %v", d.readQueueInfo, fixCnt)
+					diskLog.Warningf("the reader offset is not equal with the meta. %v", d.readQueueInfo, fixCnt)
 				}
 			}
 		}
 	}
 	if d.readQueueInfo.EndOffset.GreatThan(&d.queueEndInfo.EndOffset) {
-		nsqLog.LogWarningf("read exceed end: %v, %v", d.readQueueInfo, d.queueEndInfo)
+		diskLog.LogWarningf("read exceed end: %v, %v", d.readQueueInfo, d.queueEndInfo)
 	}
 	return result
 }
@@ -1039,11 +1045,11 @@ func (d *diskQueueReader) retrieveMetaData() error {
 			&d.confirmedQueueInfo.EndOffset.FileNum, &d.confirmedQueueInfo.EndOffset.Pos, &d.confirmedQueueInfo.virtualEnd,
 			&d.queueEndInfo.EndOffset.FileNum, &d.queueEndInfo.EndOffset.Pos, &d.queueEndInfo.virtualEnd)
 		if errV2 != nil {
-			nsqLog.Infof("fscanf new meta file err : %v", errV2)
+			diskLog.Infof("fscanf new meta file err : %v", errV2)
 			return errV2
 		}
 	} else {
-		nsqLog.Infof("new meta file err : %v", errV2)
+		diskLog.Infof("new meta file err : %v", errV2)
 
 		fileName := d.metaDataFileName(false)
 		f, err = os.OpenFile(fileName, os.O_RDONLY, 0644)
@@ -1066,14 +1072,14 @@ func (d *diskQueueReader) retrieveMetaData() error {
 		d.persistMetaData()
 	}
 	if d.confirmedQueueInfo.TotalMsgCnt() == 0 && d.confirmedQueueInfo.Offset() != BackendOffset(0) {
-		nsqLog.Warningf("reader (%v) count is missing, need fix: %v", d.readerMetaName, d.confirmedQueueInfo)
+		diskLog.Warningf("reader (%v) count is missing, need fix: %v", d.readerMetaName, d.confirmedQueueInfo)
 		// the message count info for confirmed will be handled by coordinator.
 		if d.confirmedQueueInfo.Offset() == d.queueEndInfo.Offset() {
 			d.confirmedQueueInfo.totalMsgCnt = d.queueEndInfo.totalMsgCnt
 		}
 	} else if d.confirmedQueueInfo.Offset() == d.queueEndInfo.Offset() &&
 		d.confirmedQueueInfo.TotalMsgCnt() != d.queueEndInfo.TotalMsgCnt() {
-		nsqLog.Warningf("the reader (%v) meta count is not matched with end: %v, %v",
+		diskLog.Warningf("the reader (%v) meta count is not matched with end: %v, %v",
 			d.readerMetaName, d.confirmedQueueInfo, d.queueEndInfo)
 		d.confirmedQueueInfo = d.queueEndInfo
 	}
@@ -1140,7 +1146,7 @@ func (d *diskQueueReader) checkTailCorruption() {
 
 	// we reach file end, the readQueueInfo.EndOffset should be exactly at the end of file.
 	if d.readQueueInfo.EndOffset != d.queueEndInfo.EndOffset {
-		nsqLog.LogErrorf(
+		diskLog.LogErrorf(
 			"diskqueue(%s) read to end at readQueueInfo.EndOffset != endPos (%v > %v), corruption, skipping to end ...",
 			d.readerMetaName, d.readQueueInfo, d.queueEndInfo)
 		d.skipToEndofQueue()
@@ -1154,7 +1160,7 @@ func (d *diskQueueReader) handleReadError() {
 	if err != nil {
 		return
 	}
-	nsqLog.LogWarningf("diskqueue(%s) skip error to next %v",
+	diskLog.LogWarningf("diskqueue(%s) skip error to next %v",
 		d.readerMetaName, d.readQueueInfo)
 	// significant state change, schedule a sync on the next iteration
 	d.needSync = true
@@ -1168,7 +1174,7 @@ func (d *diskQueueReader) internalUpdateEnd(endPos *diskQueueEndInfo, forceReloa
 		return false, nil
 	}
 	if forceReload {
-		nsqLog.Logf("read force reload at end %v ", endPos)
+		diskLog.Logf("read force reload at end %v ", endPos)
 	}
 
 	if endPos.Offset() == d.queueEndInfo.Offset() && endPos.TotalMsgCnt() == d.queueEndInfo.TotalMsgCnt() {
@@ -1176,7 +1182,7 @@ func (d *diskQueueReader) internalUpdateEnd(endPos *diskQueueEndInfo, forceReloa
 	}
 	d.needSync = true
 	if d.readQueueInfo.EndOffset.GreatThan(&endPos.EndOffset) || d.readQueueInfo.Offset() > endPos.Offset() {
-		nsqLog.LogWarningf("new end old than the read end: %v, %v, %v", d.readQueueInfo.EndOffset,
+		diskLog.LogWarningf("new end old than the read end: %v, %v, %v", d.readQueueInfo.EndOffset,
 			endPos, d.queueEndInfo)
 		if !forceReload {
 			// if rollback or reset, should set the force reload flag
@@ -1196,11 +1202,11 @@ func (d *diskQueueReader) internalUpdateEnd(endPos *diskQueueEndInfo, forceReloa
 	oldPos := d.queueEndInfo
 	d.queueEndInfo = *endPos
 	d.updateDepth()
-	if nsqLog.Level() >= levellogger.LOG_DETAIL {
-		nsqLog.LogDebugf("read end %v updated to : %v, current confirmed: %v ", oldPos, endPos, d.confirmedQueueInfo)
+	if diskLog.Level() >= levellogger.LOG_DETAIL {
+		diskLog.LogDebugf("read end %v updated to : %v, current confirmed: %v ", oldPos, endPos, d.confirmedQueueInfo)
 	}
 	if forceReload {
-		nsqLog.LogDebugf("read force reload at end %v ", endPos)
+		diskLog.LogDebugf("read force reload at end %v ", endPos)
 		if d.readFile != nil {
 			d.readFile.Close()
 			d.readFile = nil
@@ -41,7 +41,7 @@ func getQueueFileOffsetMeta(dataFileName string) (int64, int64, int64, error) {
 		&cnt,
 		&startPos, &endPos)
 	if err != nil {
-		nsqLog.LogErrorf("failed to read offset meta (%v): %v", fName, err)
+		diskLog.LogErrorf("failed to read offset meta (%v): %v", fName, err)
 		return 0, 0, 0, err
 	}
 	return cnt, startPos, endPos, nil
@@ -56,6 +56,7 @@ type diskQueueWriter struct {
 	diskReadEnd  diskQueueEndInfo
 	// the start of the queue , will be set to the cleaned offset
 	diskQueueStart diskQueueEndInfo
+	ioCounters     diskIOCounters
 	sync.RWMutex
 
 	// instantiation time metadata
@@ -69,6 +70,9 @@ type diskQueueWriter struct {
 
 	writeFile    *os.File
 	bufferWriter *bufio.Writer
+	// called before the segment is cleaned, the segment will not be cleaned if failed
+	segmentArchiver func(fileName string, seg ArchivedSegment) error
+	latency         diskLatency
 }
 
 type extraMeta struct {
@@ -108,11 +112,11 @@ func newDiskQueueWriter(name string, dataPath string, maxBytesPerFile int64,
 	// no need to lock here, nothing else could possibly be touching this instance
 	err := d.retrieveMetaData()
 	if err != nil && !os.IsNotExist(err) {
-		nsqLog.LogErrorf("diskqueue(%s) failed to retrieveMetaData - %s", d.name, err)
+		diskLog.LogErrorf("diskqueue(%s) failed to retrieveMetaData - %s", d.name, err)
 	}
 	err = d.initQueueReadStart()
 	if err != nil && !os.IsNotExist(err) {
-		nsqLog.LogErrorf("diskqueue(%s) failed to init queue start- %s", d.name, err)
+		diskLog.LogErrorf("diskqueue(%s) failed to init queue start- %s", d.name, err)
 		return &d, err
 	}
 
@@ -181,7 +185,7 @@ func (d *diskQueueWriter) RollbackWriteV2(offset BackendOffset, diffCnt uint64)
 
 	if offset < d.diskQueueStart.virtualEnd ||
 		d.diskWriteEnd.TotalMsgCnt()-int64(diffCnt) < d.diskQueueStart.TotalMsgCnt() {
-		nsqLog.Logf("rollback write to %v:%v invalid, less than queue start %v", offset, diffCnt, d.diskQueueStart)
+		diskLog.Logf("rollback write to %v:%v invalid, less than queue start %v", offset, diffCnt, d.diskQueueStart)
 		return d.diskWriteEnd, ErrInvalidOffset
 	}
 
@@ -193,10 +197,10 @@ func (d *diskQueueWriter) RollbackWriteV2(offset BackendOffset, diffCnt uint64)
 		return d.diskWriteEnd, ErrInvalidOffset
 	}
 	if offset < d.diskWriteEnd.Offset()-BackendOffset(d.diskWriteEnd.EndOffset.Pos) {
-		nsqLog.Logf("rollback write position can not across file %v, %v, %v", offset, d.diskWriteEnd.Offset(), d.diskWriteEnd.EndOffset.Pos)
+		diskLog.Logf("rollback write position can not across file %v, %v, %v", offset, d.diskWriteEnd.Offset(), d.diskWriteEnd.EndOffset.Pos)
 		return d.diskWriteEnd, ErrInvalidOffset
 	}
-	nsqLog.Logf("rollback from %v-%v, %v to %v, roll cnt: %v", d.diskWriteEnd.EndOffset.FileNum, d.diskWriteEnd.EndOffset.Pos, d.diskWriteEnd.Offset(), offset, diffCnt)
+	diskLog.Logf("rollback from %v-%v, %v to %v, roll cnt: %v", d.diskWriteEnd.EndOffset.FileNum, d.diskWriteEnd.EndOffset.Pos, d.diskWriteEnd.Offset(), offset, diffCnt)
 	d.diskWriteEnd.EndOffset.Pos -= int64(d.diskWriteEnd.Offset() - offset)
 	d.diskWriteEnd.virtualEnd = offset
 	atomic.AddInt64(&d.diskWriteEnd.totalMsgCnt, -1*int64(diffCnt))
@@ -205,7 +209,7 @@ func (d *diskQueueWriter) RollbackWriteV2(offset BackendOffset, diffCnt uint64)
 		d.diskReadEnd.Offset() > d.diskWriteEnd.Offset() {
 		d.diskReadEnd = d.diskWriteEnd
 	}
-	nsqLog.Logf("after rollback : %v, %v, read end: %v", d.diskWriteEnd.EndOffset.Pos, d.diskWriteEnd.TotalMsgCnt(), d.diskReadEnd)
+	diskLog.Logf("after rollback : %v, %v, read end: %v", d.diskWriteEnd.EndOffset.Pos, d.diskWriteEnd.TotalMsgCnt(), d.diskReadEnd)
 	d.truncateDiskQueueToWriteEnd()
 	return d.diskWriteEnd, nil
 }
@@ -223,7 +227,7 @@ func (d *diskQueueWriter) ResetWriteEnd(offset BackendOffset, totalCnt int64) er
 func (d *diskQueueWriter) ResetWriteWithQueueStart(queueStart BackendQueueEnd) error {
 	d.Lock()
 	defer d.Unlock()
-	nsqLog.Warningf("DISKQUEUE %v reset the queue start from %v:%v to new queue start: %v", d.name,
+	diskLog.Warningf("DISKQUEUE %v reset the queue start from %v:%v to new queue start: %v", d.name,
 		d.diskQueueStart, d.diskWriteEnd, queueStart)
 	d.cleanOldData()
 
@@ -232,7 +236,7 @@ func (d *diskQueueWriter) ResetWriteWithQueueStart(queueStart BackendQueueEnd) e
 	d.diskQueueStart.totalMsgCnt = queueStart.TotalMsgCnt()
 	d.diskWriteEnd = d.diskQueueStart
 	d.diskReadEnd = d.diskWriteEnd
-	nsqLog.Warningf("DISKQUEUE %v new queue start : %v:%v", d.name,
+	diskLog.Warningf("DISKQUEUE %v new queue start : %v:%v", d.name,
 		d.diskQueueStart, d.diskWriteEnd)
 	d.saveExtraMeta()
 	return nil
@@ -265,7 +269,7 @@ func (d *diskQueueWriter) prepareCleanByRetention(cleanEndInfo BackendQueueOffse
 			return nil, 0, 0, nil
 		}
 		if maxCleanOffset != BackendOffset(0) && cleanOffset > maxCleanOffset {
-			nsqLog.LogWarningf("disk %v clean position %v exceed the max allowed clean end: %v", d.name, cleanOffset, maxCleanOffset)
+			diskLog.LogWarningf("disk %v clean position %v exceed the max allowed clean end: %v", d.name, cleanOffset, maxCleanOffset)
 			return nil, 0, 0, nil
 		}
 	} else {
@@ -284,11 +288,11 @@ func (d *diskQueueWriter) prepareCleanByRetention(cleanEndInfo BackendQueueOffse
 		}
 		cnt, _, endPos, err := getQueueFileOffsetMeta(d.fileName(cleanFileNum - 1))
 		if err != nil {
-			nsqLog.Logf("disk %v failed to get queue offset meta: %v", d.fileName(cleanFileNum), err)
+			diskLog.Logf("disk %v failed to get queue offset meta: %v", d.fileName(cleanFileNum), err)
 			return &newStart, 0, 0, err
 		}
 		if maxCleanOffset != BackendOffset(0) && BackendOffset(endPos) > maxCleanOffset {
-			nsqLog.LogWarningf("disk %v clean position %v exceed the max allowed clean end: %v", d.name, endPos, maxCleanOffset)
+			diskLog.LogWarningf("disk %v clean position %v exceed the max allowed clean end: %v", d.name, endPos, maxCleanOffset)
 			return &newStart, 0, 0, errors.New("clean exceed the max allowed")
 		}
 		newStart.EndOffset.FileNum = cleanFileNum
@@ -299,7 +303,7 @@ func (d *diskQueueWriter) prepareCleanByRetention(cleanEndInfo BackendQueueOffse
 		for {
 			cnt, _, endPos, err := getQueueFileOffsetMeta(d.fileName(newStart.EndOffset.FileNum))
 			if err != nil {
-				nsqLog.LogWarningf("disk %v failed to get queue offset meta: %v", newStart, err)
+				diskLog.LogWarningf("disk %v failed to get queue offset meta: %v", newStart, err)
 				return &newStart, 0, 0, err
 			}
 			if BackendOffset(endPos) < cleanOffset {
@@ -321,7 +325,7 @@ func (d *diskQueueWriter) prepareCleanByRetention(cleanEndInfo BackendQueueOffse
 		return &newStart, 0, 0, nil
 	}
 
-	nsqLog.Infof("DISKQUEUE %v clean queue from %v, %v to new start : %v", d.name,
+	diskLog.Infof("DISKQUEUE %v clean queue from %v, %v to new start : %v", d.name,
 		d.diskQueueStart, d.diskWriteEnd, newStart)
 
 	cleanStartFileNum := d.diskQueueStart.EndOffset.FileNum - MAX_QUEUE_OFFSET_META_DATA_KEEP - 1
@@ -333,8 +337,62 @@ func (d *diskQueueWriter) prepareCleanByRetention(cleanEndInfo BackendQueueOffse
 	return &newStart, cleanStartFileNum, cleanFileNum, nil
 }
 
+func (d *diskQueueWriter) SetSegmentArchiver(f func(fileName string, seg ArchivedSegment) error) {
+	d.Lock()
+	d.segmentArchiver = f
+	d.Unlock()
+}
+
+// archiveBeforeClean archives all the segments which will be cleaned, the archive
+// is done without lock since the segments to be cleaned will not be changed.
+func (d *diskQueueWriter) archiveBeforeClean(cleanEndInfo BackendQueueOffset, maxCleanOffset BackendOffset) error {
+	d.RLock()
+	archiver := d.segmentArchiver
+	queueStart := d.diskQueueStart
+	d.RUnlock()
+	if archiver == nil {
+		return nil
+	}
+	planned, _, _, err := d.prepareCleanByRetention(cleanEndInfo, true, maxCleanOffset)
+	if err != nil || planned == nil {
+		return err
+	}
+	cleanFileNum := planned.(*diskQueueEndInfo).EndOffset.FileNum
+	for i := queueStart.EndOffset.FileNum; i < cleanFileNum; i++ {
+		seg := ArchivedSegment{FileNum: i}
+		if i == queueStart.EndOffset.FileNum {
+			seg.StartPos = queueStart.EndOffset.Pos
+			seg.StartOffset = int64(queueStart.Offset())
+			seg.StartCnt = queueStart.TotalMsgCnt()
+		} else {
+			seg.StartCnt, _, seg.StartOffset, err = getQueueFileOffsetMeta(d.fileName(i - 1))
+			if err != nil {
+				return err
+			}
+		}
+		seg.EndCnt, _, seg.EndOffset, err = getQueueFileOffsetMeta(d.fileName(i))
+		if err != nil {
+			return err
+		}
+		if seg.EndOffset <= seg.StartOffset {
+			continue
+		}
+		err = archiver(d.fileName(i), seg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffset,
 	noRealClean bool, maxCleanOffset BackendOffset) (BackendQueueEnd, error) {
+	if !noRealClean {
+		err := d.archiveBeforeClean(cleanEndInfo, maxCleanOffset)
+		if err != nil {
+			return nil, err
+		}
+	}
 	newStart, cleanStartFileNum, cleanFileNum, err := d.prepareCleanByRetention(cleanEndInfo, noRealClean, maxCleanOffset)
 	if err != nil {
 		return nil, err
@@ -345,11 +403,11 @@ func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffse
 		innerErr := os.Remove(fn)
 		if innerErr != nil {
 			if !os.IsNotExist(innerErr) {
-				nsqLog.LogErrorf("diskqueue(%s) failed to remove data file %v - %s", d.name, fn, innerErr)
+				diskLog.LogErrorf("diskqueue(%s) failed to remove data file %v - %s", d.name, fn, innerErr)
 				continue
 			}
 		} else {
-			nsqLog.Logf("DISKQUEUE(%s): removed data file: %v", d.name, fn)
+			diskLog.Logf("DISKQUEUE(%s): removed data file: %v", d.name, fn)
 		}
 
 		//remove queue meta file
@@ -358,10 +416,10 @@ func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffse
 			innerErr = os.Remove(fn)
 			if innerErr != nil {
 				if !os.IsNotExist(innerErr) {
-					nsqLog.LogErrorf("diskqueue(%s) failed to remove offset meta data file %v - %s", d.name, fn, innerErr)
+					diskLog.LogErrorf("diskqueue(%s) failed to remove offset meta data file %v - %s", d.name, fn, innerErr)
 				}
 			} else {
-				nsqLog.Debugf("DISKQUEUE(%s): removed offset meta data file: %v", d.name, fn)
+				diskLog.Debugf("DISKQUEUE(%s): removed offset meta data file: %v", d.name, fn)
 			}
 		}
 	}
@@ -374,7 +432,7 @@ func (d *diskQueueWriter) closeCurrentFile() {
 		d.bufferWriter.Flush()
 	}
 	if d.diskReadEnd.EndOffset.GreatThan(&d.diskWriteEnd.EndOffset) {
-		nsqLog.LogWarningf("DISKQUEUE(%s): old read is greater: %v, %v", d.name,
+		diskLog.LogWarningf("DISKQUEUE(%s): old read is greater: %v, %v", d.name,
 			d.diskReadEnd, d.diskWriteEnd)
 	}
 	d.diskReadEnd = d.diskWriteEnd
@@ -393,7 +451,7 @@ func (d *diskQueueWriter) truncateDiskQueueToWriteEnd() {
 		curFileName := d.fileName(d.diskWriteEnd.EndOffset.FileNum)
 		tmpFile, err := os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
-			nsqLog.LogErrorf("open write queue failed: %v", err)
+			diskLog.LogErrorf("open write queue failed: %v", err)
 		} else {
 			tmpFile.Truncate(d.diskWriteEnd.EndOffset.Pos)
 			tmpFile.Close()
@@ -407,9 +465,9 @@ func (d *diskQueueWriter) truncateDiskQueueToWriteEnd() {
 			if os.IsNotExist(err) {
 				return
 			}
-			nsqLog.LogErrorf("truncate and remove the write file %v failed: %v", fileName, err)
+			diskLog.LogErrorf("truncate and remove the write file %v failed: %v", fileName, err)
 		}
-		nsqLog.LogWarningf("truncate queue and remove the write file %v ", fileName)
+		diskLog.LogWarningf("truncate queue and remove the write file %v ", fileName)
 		cleanNum++
 	}
 }
@@ -418,7 +476,7 @@ func (d *diskQueueWriter) ResetWriteEndV2(offset BackendOffset, totalCnt int64)
 	d.Lock()
 	defer d.Unlock()
 	if offset < d.diskQueueStart.virtualEnd || totalCnt < d.diskQueueStart.TotalMsgCnt() {
-		nsqLog.Logf("reset write end to %v:%v invalid, less than queue start %v", offset, totalCnt, d.diskQueueStart)
+		diskLog.Logf("reset write end to %v:%v invalid, less than queue start %v", offset, totalCnt, d.diskQueueStart)
 		return d.diskWriteEnd, ErrInvalidOffset
 	}
 	if offset > d.diskWriteEnd.Offset() {
@@ -427,7 +485,7 @@ func (d *diskQueueWriter) ResetWriteEndV2(offset BackendOffset, totalCnt int64)
 	if d.needSync {
 		d.sync()
 	}
-	nsqLog.Logf("reset write end from %v to %v, reset to totalCnt: %v", d.diskWriteEnd.Offset(), offset, totalCnt)
+	diskLog.Logf("reset write end from %v to %v, reset to totalCnt: %v", d.diskWriteEnd.Offset(), offset, totalCnt)
 	if offset == 0 {
 		d.closeCurrentFile()
 		d.diskWriteEnd = d.diskQueueStart
@@ -439,16 +497,16 @@ func (d *diskQueueWriter) ResetWriteEndV2(offset BackendOffset, totalCnt int64)
 	newWriteFileNum := d.diskWriteEnd.EndOffset.FileNum
 	newWritePos := d.diskWriteEnd.EndOffset.Pos
 	for offset < newEnd-BackendOffset(newWritePos) {
-		nsqLog.Logf("reset write acrossing file %v, %v, %v, %v", offset, newEnd, newWritePos, newWriteFileNum)
+		diskLog.Logf("reset write acrossing file %v, %v, %v, %v", offset, newEnd, newWritePos, newWriteFileNum)
 		newEnd -= BackendOffset(newWritePos)
 		newWriteFileNum--
 		if newWriteFileNum < 0 {
-			nsqLog.Logf("reset write acrossed the begin %v, %v, %v", offset, newEnd, newWriteFileNum)
+			diskLog.Logf("reset write acrossed the begin %v, %v, %v", offset, newEnd, newWriteFileNum)
 			return d.diskWriteEnd, ErrInvalidOffset
 		}
 		f, err := os.Stat(d.fileName(newWriteFileNum))
 		if err != nil {
-			nsqLog.LogErrorf("stat data file error %v, %v", offset, newWriteFileNum)
+			diskLog.LogErrorf("stat data file error %v, %v", offset, newWriteFileNum)
 			return d.diskWriteEnd, err
 		}
 		newWritePos = f.Size()
@@ -460,7 +518,7 @@ func (d *diskQueueWriter) ResetWriteEndV2(offset BackendOffset, totalCnt int64)
 	atomic.StoreInt64(&d.diskWriteEnd.totalMsgCnt, int64(totalCnt))
 	d.diskReadEnd = d.diskWriteEnd
 	d.closeCurrentFile()
-	nsqLog.Logf("reset write end result : %v", d.diskWriteEnd)
+	diskLog.Logf("reset write end result : %v", d.diskWriteEnd)
 	d.truncateDiskQueueToWriteEnd()
 
 	return d.diskWriteEnd, nil
@@ -479,7 +537,7 @@ func (d *diskQueueWriter) RemoveTo(destPath string) error {
 	d.Lock()
 	defer d.Unlock()
 	d.exitFlag = 1
-	nsqLog.Logf("DISKQUEUE(%s): removing to %v", d.name, destPath)
+	diskLog.Logf("DISKQUEUE(%s): removing to %v", d.name, destPath)
 	d.sync()
 	d.closeCurrentFile()
 	d.saveFileOffsetMeta()
@@ -487,25 +545,25 @@ func (d *diskQueueWriter) RemoveTo(destPath string) error {
 		fn := d.fileName(i)
 		destFile := GetQueueFileName(destPath, d.name, i)
 		innerErr := util.AtomicRename(fn, destFile)
-		nsqLog.Logf("DISKQUEUE(%s): renamed data file %v to %v", d.name, fn, destFile)
+		diskLog.Logf("DISKQUEUE(%s): renamed data file %v to %v", d.name, fn, destFile)
 		if innerErr != nil && !os.IsNotExist(innerErr) {
-			nsqLog.LogErrorf("diskqueue(%s) failed to remove data file - %s", d.name, innerErr)
+			diskLog.LogErrorf("diskqueue(%s) failed to remove data file - %s", d.name, innerErr)
 		}
 		fName := d.fileName(i) + ".offsetmeta.dat"
 		innerErr = util.AtomicRename(fName, destFile+".offsetmeta.dat")
-		nsqLog.Logf("DISKQUEUE(%s): rename offset meta file %v ", d.name, fName)
+		diskLog.Logf("DISKQUEUE(%s): rename offset meta file %v ", d.name, fName)
 		if innerErr != nil && !os.IsNotExist(innerErr) {
-			nsqLog.LogErrorf("diskqueue(%s) failed to remove offset meta file %v - %s", d.name, fName, innerErr)
+			diskLog.LogErrorf("diskqueue(%s) failed to remove offset meta file %v - %s", d.name, fName, innerErr)
 		}
 	}
 	d.diskWriteEnd.EndOffset.FileNum++
 	d.diskWriteEnd.EndOffset.Pos = 0
 	d.diskReadEnd = d.diskWriteEnd
 	destFile := fmt.Sprintf(path.Join(destPath, "%s.diskqueue.meta.writer.dat"), d.name)
-	nsqLog.Logf("DISKQUEUE(%s): rename meta file to %v", d.name, destFile)
+	diskLog.Logf("DISKQUEUE(%s): rename meta file to %v", d.name, destFile)
 	innerErr := util.AtomicRename(d.metaDataFileName(), destFile)
 	if innerErr != nil && !os.IsNotExist(innerErr) {
-		nsqLog.LogErrorf("diskqueue(%s) failed to remove metadata file - %s", d.name, innerErr)
+		diskLog.LogErrorf("diskqueue(%s) failed to remove metadata file - %s", d.name, innerErr)
 		return innerErr
 	}
 	destFile = fmt.Sprintf(path.Join(destPath, "%s.diskqueue.meta.extra.dat"), d.name)
@@ -520,9 +578,9 @@ func (d *diskQueueWriter) exit(deleted bool) error {
 	d.exitFlag = 1
 
 	if deleted {
-		nsqLog.Logf("DISKQUEUE(%s): deleting", d.name)
+		diskLog.Logf("DISKQUEUE(%s): deleting", d.name)
 	} else {
-		nsqLog.Logf("DISKQUEUE(%s): closing", d.name)
+		diskLog.Logf("DISKQUEUE(%s): closing", d.name)
 	}
 
 	d.sync()
@@ -542,7 +600,7 @@ func (d *diskQueueWriter) Empty() error {
 		return errors.New("exiting")
 	}
 
-	nsqLog.Logf("DISKQUEUE(%s): emptying", d.name)
+	diskLog.Logf("DISKQUEUE(%s): emptying", d.name)
 	return d.deleteAllFiles(false)
 }
 
@@ -550,10 +608,10 @@ func (d *diskQueueWriter) deleteAllFiles(deleted bool) error {
 	d.cleanOldData()
 
 	if deleted {
-		nsqLog.Logf("DISKQUEUE(%s): deleting meta file", d.name)
+		diskLog.Logf("DISKQUEUE(%s): deleting meta file", d.name)
 		innerErr := os.Remove(d.metaDataFileName())
 		if innerErr != nil && !os.IsNotExist(innerErr) {
-			nsqLog.LogErrorf("diskqueue(%s) failed to remove metadata file - %s", d.name, innerErr)
+			diskLog.LogErrorf("diskqueue(%s) failed to remove metadata file - %s", d.name, innerErr)
 			return innerErr
 		}
 		cleanStartFileNum := d.diskQueueStart.EndOffset.FileNum - MAX_QUEUE_OFFSET_META_DATA_KEEP - 1
@@ -564,9 +622,9 @@ func (d *diskQueueWriter) deleteAllFiles(deleted bool) error {
 		for i := cleanStartFileNum; i <= d.diskWriteEnd.EndOffset.FileNum; i++ {
 			fName := d.fileName(i) + ".offsetmeta.dat"
 			innerErr := os.Remove(fName)
-			nsqLog.Logf("DISKQUEUE(%s): removed offset meta file: %v", d.name, fName)
+			diskLog.Logf("DISKQUEUE(%s): removed offset meta file: %v", d.name, fName)
 			if innerErr != nil && !os.IsNotExist(innerErr) {
-				nsqLog.LogErrorf("diskqueue(%s) failed to remove offset meta file %v - %s", d.name, fName, innerErr)
+				diskLog.LogErrorf("diskqueue(%s) failed to remove offset meta file %v - %s", d.name, fName, innerErr)
 			}
 		}
 	}
@@ -586,9 +644,9 @@ func (d *diskQueueWriter) cleanOldData() error {
 	for i := cleanStartFileNum; i <= d.diskWriteEnd.EndOffset.FileNum; i++ {
 		fn := d.fileName(i)
 		innerErr := os.Remove(fn)
-		nsqLog.Logf("DISKQUEUE(%s): removed data file: %v", d.name, fn)
+		diskLog.Logf("DISKQUEUE(%s): removed data file: %v", d.name, fn)
 		if innerErr != nil && !os.IsNotExist(innerErr) {
-			nsqLog.LogErrorf("diskqueue(%s) failed to remove data file - %s", d.name, innerErr)
+			diskLog.LogErrorf("diskqueue(%s) failed to remove data file - %s", d.name, innerErr)
 		}
 	}
 
@@ -604,7 +662,7 @@ func (d *diskQueueWriter) saveFileOffsetMeta() {
 	fName := d.fileName(d.diskWriteEnd.EndOffset.FileNum) + ".offsetmeta.dat"
 	f, err := os.OpenFile(fName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		nsqLog.LogErrorf("diskqueue(%s) failed to save data offset meta: %v", d.name, err)
+		diskLog.LogErrorf("diskqueue(%s) failed to save data offset meta: %v", d.name, err)
 		return
 	}
 	_, err = fmt.Fprintf(f, "%d\n%d,%d\n",
@@ -612,7 +670,7 @@ func (d *diskQueueWriter) saveFileOffsetMeta() {
 		d.diskWriteEnd.Offset()-BackendOffset(d.diskWriteEnd.EndOffset.Pos), d.diskWriteEnd.Offset())
 	if err != nil {
 		f.Close()
-		nsqLog.LogErrorf("diskqueue(%s) failed to save data offset meta: %v", d.name, err)
+		diskLog.LogErrorf("diskqueue(%s) failed to save data offset meta: %v", d.name, err)
 		return
 	}
 	f.Sync()
@@ -660,7 +718,7 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 			return 0, 0, nil, err
 		}
 
-		nsqLog.Logf("DISKQUEUE(%s): writeOne() opened %s", d.name, curFileName)
+		diskLog.Logf("DISKQUEUE(%s): writeOne() opened %s", d.name, curFileName)
 
 		if d.diskWriteEnd.EndOffset.Pos > 0 {
 			_, err = d.writeFile.Seek(d.diskWriteEnd.EndOffset.Pos, 0)
@@ -670,10 +728,11 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 				return 0, 0, nil, err
 			}
 		}
+		lw := &latencyWriter{w: d.writeFile, l: &d.latency, io: &d.ioCounters}
 		if d.bufferWriter == nil {
-			d.bufferWriter = bufio.NewWriterSize(d.writeFile, writeBufSize)
+			d.bufferWriter = bufio.NewWriterSize(lw, writeBufSize)
 		} else {
-			d.bufferWriter.Reset(d.writeFile)
+			d.bufferWriter.Reset(lw)
 		}
 	}
 
@@ -690,7 +749,7 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 				d.writeFile.Close()
 				d.writeFile = nil
 			}
-			nsqLog.Logf("DISKQUEUE(%s): writeOne() faled %s", d.name, err)
+			diskLog.Logf("DISKQUEUE(%s): writeOne() faled %s", d.name, err)
 			return 0, 0, nil, err
 		}
 	}
@@ -701,7 +760,7 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 			d.writeFile.Close()
 			d.writeFile = nil
 		}
-		nsqLog.Logf("DISKQUEUE(%s): writeOne() faled %s", d.name, err)
+		diskLog.Logf("DISKQUEUE(%s): writeOne() faled %s", d.name, err)
 		return 0, 0, nil, err
 	}
 
@@ -722,7 +781,7 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 		// sync every time we start writing to a new file
 		err = d.sync()
 		if err != nil {
-			nsqLog.LogErrorf("diskqueue(%s) failed to sync - %s", d.name, err)
+			diskLog.LogErrorf("diskqueue(%s) failed to sync - %s", d.name, err)
 		}
 
 		if d.writeFile != nil {
@@ -730,11 +789,12 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 			d.writeFile = nil
 		}
 		d.saveFileOffsetMeta()
-		nsqLog.LogDebugf("DISKQUEUE(%s): new file write, last file: %v", d.name, d.diskWriteEnd)
+		diskLog.LogDebugf("DISKQUEUE(%s): new file write, last file: %v", d.name, d.diskWriteEnd)
 
 		d.diskWriteEnd.EndOffset.FileNum++
 		d.diskWriteEnd.EndOffset.Pos = 0
 		d.diskReadEnd = d.diskWriteEnd
+		d.ioCounters.addRoll()
 	}
 
 	return writeOffset, int32(totalBytes), &d.diskWriteEnd, err
@@ -753,7 +813,7 @@ func (d *diskQueueWriter) Flush() error {
 	}
 	cost := time.Now().Sub(s)
 	if cost > time.Second {
-		nsqLog.Logf("disk writer(%s): flush cost: %v", d.name, cost)
+		diskLog.Logf("disk writer(%s): flush cost: %v", d.name, cost)
 	}
 
 	return nil
@@ -766,7 +826,7 @@ func (d *diskQueueWriter) FlushBuffer() bool {
 		hasData = true
 		d.bufferWriter.Flush()
 		if d.diskReadEnd.EndOffset.GreatThan(&d.diskWriteEnd.EndOffset) {
-			nsqLog.LogWarningf("DISKQUEUE(%s): old read is greater: %v, %v", d.name,
+			diskLog.LogWarningf("DISKQUEUE(%s): old read is greater: %v, %v", d.name,
 				d.diskReadEnd, d.diskWriteEnd)
 		}
 		d.diskReadEnd = d.diskWriteEnd
@@ -781,7 +841,9 @@ func (d *diskQueueWriter) sync() error {
 		d.bufferWriter.Flush()
 	}
 	if d.writeFile != nil {
+		s := time.Now()
 		err := d.writeFile.Sync()
+		d.latency.updateSync(time.Since(s))
 		if err != nil {
 			d.writeFile.Close()
 			d.writeFile = nil
@@ -790,7 +852,7 @@ func (d *diskQueueWriter) sync() error {
 	}
 
 	if d.diskReadEnd.EndOffset.GreatThan(&d.diskWriteEnd.EndOffset) {
-		nsqLog.LogWarningf("DISKQUEUE(%s): old read is greater: %v, %v", d.name,
+		diskLog.LogWarningf("DISKQUEUE(%s): old read is greater: %v, %v", d.name,
 			d.diskReadEnd, d.diskWriteEnd)
 	}
 
@@ -809,7 +871,7 @@ func (d *diskQueueWriter) initQueueReadStart() error {
 	// first try read from meta file
 	err := d.loadExtraMeta()
 	if err != nil {
-		nsqLog.Infof("failed to load extra meta from file: %v", err)
+		diskLog.Infof("failed to load extra meta from file: %v", err)
 	} else {
 		return nil
 	}
@@ -829,7 +891,7 @@ func (d *diskQueueWriter) initQueueReadStart() error {
 				readStart.EndOffset.FileNum++
 				readStart.EndOffset.Pos = 0
 				if readStart.EndOffset.FileNum > d.diskWriteEnd.EndOffset.FileNum {
-					nsqLog.Errorf("topic %v no data file found to end: %v, reset read start to end", d.name, d.diskWriteEnd)
+					diskLog.Errorf("topic %v no data file found to end: %v, reset read start to end", d.name, d.diskWriteEnd)
 					d.diskQueueStart = d.diskWriteEnd
 					return ErrNeedFixQueueStart
 				}
@@ -843,7 +905,7 @@ func (d *diskQueueWriter) initQueueReadStart() error {
 					readStart.EndOffset.FileNum++
 					readStart.EndOffset.Pos = 0
 					if readStart.EndOffset.FileNum > d.diskWriteEnd.EndOffset.FileNum {
-						nsqLog.Errorf("topic %v no data meta file found to end: %v, reset read start to end", d.name, d.diskWriteEnd)
+						diskLog.Errorf("topic %v no data meta file found to end: %v, reset read start to end", d.name, d.diskWriteEnd)
 						d.diskQueueStart = d.diskWriteEnd
 						return ErrNeedFixQueueStart
 					}
@@ -859,7 +921,7 @@ func (d *diskQueueWriter) initQueueReadStart() error {
 	}
 	if !needFix {
 		if readStart.EndOffset.FileNum != 0 {
-			nsqLog.Warningf("topic : %v not start as 0 but no fix : %v", d.name, readStart)
+			diskLog.Warningf("topic : %v not start as 0 but no fix : %v", d.name, readStart)
 		}
 		d.diskQueueStart = readStart
 	} else {
@@ -870,7 +932,7 @@ func (d *diskQueueWriter) initQueueReadStart() error {
 		readStart.virtualEnd = BackendOffset(endPos)
 		readStart.totalMsgCnt = cnt
 		d.diskQueueStart = readStart
-		nsqLog.Logf("%v init the disk queue start: %v", d.name, d.diskQueueStart)
+		diskLog.Logf("%v init the disk queue start: %v", d.name, d.diskQueueStart)
 	}
 	return nil
 }
@@ -889,7 +951,7 @@ func (d *diskQueueWriter) loadExtraMeta() error {
 	d.diskQueueStart.EndOffset = tmp.SegOffset
 	d.diskQueueStart.virtualEnd = tmp.VirtualOffset
 	d.diskQueueStart.totalMsgCnt = tmp.TotalMsgCnt
-	nsqLog.Infof("topic : %v load extra meta: %v", d.name, tmp)
+	diskLog.Infof("topic : %v load extra meta: %v", d.name, tmp)
 	return nil
 }
 
@@ -6,6 +6,14 @@ import (
 
 var nsqLog = levellogger.NewLevelLogger(levellogger.LOG_INFO, &levellogger.SimpleLogger{})
 
+// the subsystem loggers use the nsqd logger level unless changed for the subsystem
+var diskLog = nsqLog.Subsystem("diskqueue")
+var statsLog = nsqLog.Subsystem("stats")
+
+func init() {
+	levellogger.RegisterSubsystem("nsqd", nsqLog)
+}
+
 func SetLogger(log levellogger.Logger) {
 	nsqLog.Logger = log
 }
@@ -56,6 +56,12 @@ type Message struct {
 	pri              int64
 	index            int
 	deferredCnt      int32
+	// 1 if deferred with the timeout computed by the channel req backoff
+	backoffDeferred int32
+	// the body is released while in flight and should be reloaded from disk queue
+	bodySpilled bool
+	// the failed times of reloading the spilled body
+	spillReloadErrs int
 	//for backend queue
 	Offset        BackendOffset
 	RawMoveSize   BackendOffset
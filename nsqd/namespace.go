@@ -0,0 +1,312 @@
+package nsqd
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	namespaceSeparator = "."
+	// the disk usage of the namespace is computed at most once in the interval
+	namespaceUsageRefreshInterval = 5 * time.Second
+)
+
+var (
+	ErrInvalidNamespaceQuota    = errors.New("invalid namespace quota")
+	ErrNamespaceTopicsExceeded  = errors.New("namespace topic count exceeded the quota")
+	ErrNamespaceDiskExceeded    = errors.New("namespace disk usage exceeded the quota")
+	ErrNamespacePubRateExceeded = errors.New("namespace publish rate exceeded the quota")
+)
+
+// GetTopicNamespace returns the namespace of the topic which is the prefix before
+// the first dot, such as tenantA for tenantA.orders. Empty if no namespace.
+func GetTopicNamespace(topic string) string {
+	i := strings.Index(topic, namespaceSeparator)
+	if i <= 0 {
+		return ""
+	}
+	return topic[:i]
+}
+
+// NamespaceQuota limits the usage of all the topics in the namespace on this node,
+// the zero value means no limit.
+type NamespaceQuota struct {
+	MaxTopics    int   `json:"max_topics" pb:"1"`
+	MaxDiskBytes int64 `json:"max_disk_bytes" pb:"2"`
+	// the max published messages per second
+	MaxPubRate int64 `json:"max_pub_rate" pb:"3"`
+}
+
+func (q *NamespaceQuota) Validate() error {
+	if q.MaxTopics < 0 || q.MaxDiskBytes < 0 || q.MaxPubRate < 0 {
+		return ErrInvalidNamespaceQuota
+	}
+	return nil
+}
+
+func (q *NamespaceQuota) IsEmpty() bool {
+	return q.MaxTopics == 0 && q.MaxDiskBytes == 0 && q.MaxPubRate == 0
+}
+
+// NamespaceStats is the rollup of the topic stats in the namespace
+type NamespaceStats struct {
+	Namespace     string          `json:"namespace" pb:"1"`
+	Topics        int             `json:"topics" pb:"2"`
+	Partitions    int             `json:"partitions" pb:"3"`
+	Channels      int             `json:"channels" pb:"4"`
+	Depth         int64           `json:"depth" pb:"5"`
+	BackendDepth  int64           `json:"backend_depth" pb:"6"`
+	MessageCount  uint64          `json:"message_count" pb:"7"`
+	HourlyPubSize int64           `json:"hourly_pubsize" pb:"8"`
+	DiskBytes     int64           `json:"disk_bytes" pb:"9"`
+	Quota         *NamespaceQuota `json:"quota,omitempty" pb:"10"`
+	// the publish rejected by the quota
+	PubRejected int64 `json:"pub_rejected" pb:"11"`
+	// the quotas exceeded currently: topics, disk
+	OverQuota []string `json:"over_quota,omitempty" pb:"12"`
+}
+
+type namespaceState struct {
+	quota       NamespaceQuota
+	limiter     *replayLimiter
+	pubRejected int64
+}
+
+// namespaceQuotas keeps the quotas and the cached disk usage of the namespaces
+type namespaceQuotas struct {
+	sync.Mutex
+	states      map[string]*namespaceState
+	diskUsage   map[string]int64
+	lastRefresh time.Time
+}
+
+func newNamespaceQuotas() *namespaceQuotas {
+	return &namespaceQuotas{
+		states:    make(map[string]*namespaceState),
+		diskUsage: make(map[string]int64),
+	}
+}
+
+func (q *namespaceQuotas) getState(ns string) *namespaceState {
+	q.Lock()
+	defer q.Unlock()
+	return q.states[ns]
+}
+
+func (q *namespaceQuotas) setQuota(ns string, quota NamespaceQuota) {
+	q.Lock()
+	defer q.Unlock()
+	if quota.IsEmpty() {
+		delete(q.states, ns)
+		return
+	}
+	st, ok := q.states[ns]
+	if !ok {
+		st = &namespaceState{}
+		q.states[ns] = st
+	}
+	if st.limiter == nil || st.quota.MaxPubRate != quota.MaxPubRate {
+		st.limiter = nil
+		if quota.MaxPubRate > 0 {
+			st.limiter = newReplayLimiter(quota.MaxPubRate)
+		}
+	}
+	st.quota = quota
+}
+
+func (q *namespaceQuotas) getQuotas() map[string]NamespaceQuota {
+	q.Lock()
+	defer q.Unlock()
+	quotas := make(map[string]NamespaceQuota, len(q.states))
+	for ns, st := range q.states {
+		quotas[ns] = st.quota
+	}
+	return quotas
+}
+
+func (n *NSQD) namespaceTopicCount(ns string) int {
+	n.RLock()
+	defer n.RUnlock()
+	return n.namespaceTopicCountNoLock(ns)
+}
+
+func (n *NSQD) namespaceTopicCountNoLock(ns string) int {
+	cnt := 0
+	for name, topics := range n.topicMap {
+		if len(topics) > 0 && GetTopicNamespace(name) == ns {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// getNamespaceDiskUsage returns the disk usage of the namespace, it is refreshed
+// for all the namespaces if expired.
+func (n *NSQD) getNamespaceDiskUsage(ns string, now time.Time) int64 {
+	q := n.nsQuotas
+	q.Lock()
+	if now.Sub(q.lastRefresh) < namespaceUsageRefreshInterval {
+		usage := q.diskUsage[ns]
+		q.Unlock()
+		return usage
+	}
+	q.lastRefresh = now
+	q.Unlock()
+
+	diskUsage := make(map[string]int64)
+	for _, t := range n.getTopicsSnapshot() {
+		if topicNS := GetTopicNamespace(t.GetTopicName()); topicNS != "" {
+			diskUsage[topicNS] += t.TotalDataSize() - t.GetQueueReadStart()
+		}
+	}
+	q.Lock()
+	q.diskUsage = diskUsage
+	q.Unlock()
+	return diskUsage[ns]
+}
+
+// SetNamespaceQuota changes the quota of the namespace, the empty quota removes it.
+func (n *NSQD) SetNamespaceQuota(ns string, quota NamespaceQuota) error {
+	if ns == "" || strings.Contains(ns, namespaceSeparator) {
+		return ErrInvalidNamespaceQuota
+	}
+	if err := quota.Validate(); err != nil {
+		return err
+	}
+	n.nsQuotas.setQuota(ns, quota)
+	nsqLog.Logf("namespace %v quota changed to %+v", ns, quota)
+	n.NotifyPersistMetadata()
+	return nil
+}
+
+func (n *NSQD) GetNamespaceQuotas() map[string]NamespaceQuota {
+	return n.nsQuotas.getQuotas()
+}
+
+// CheckNamespaceTopicQuota returns error if the new topic exceeds the topic count
+// limit of the namespace.
+func (n *NSQD) CheckNamespaceTopicQuota(topic string) error {
+	n.RLock()
+	defer n.RUnlock()
+	return n.checkNamespaceTopicQuotaNoLock(topic)
+}
+
+// checkNamespaceTopicQuotaNoLock should be called with the topic map locked, it is
+// only checked at the entry points creating the new topic by the client, the topic
+// created by the cluster or loaded from the metadata is never limited.
+func (n *NSQD) checkNamespaceTopicQuotaNoLock(topic string) error {
+	ns := GetTopicNamespace(topic)
+	if ns == "" {
+		return nil
+	}
+	st := n.nsQuotas.getState(ns)
+	if st == nil || st.quota.MaxTopics <= 0 {
+		return nil
+	}
+	// the new partition of the existing topic is not limited
+	if len(n.topicMap[topic]) > 0 {
+		return nil
+	}
+	if n.namespaceTopicCountNoLock(ns) >= st.quota.MaxTopics {
+		return ErrNamespaceTopicsExceeded
+	}
+	return nil
+}
+
+// CheckNamespacePubQuota returns error if publishing the messages to the topic
+// exceeds the disk usage or the publish rate limit of the namespace.
+func (n *NSQD) CheckNamespacePubQuota(topic string, msgNum int) error {
+	ns := GetTopicNamespace(topic)
+	if ns == "" {
+		return nil
+	}
+	st := n.nsQuotas.getState(ns)
+	if st == nil {
+		return nil
+	}
+	now := time.Now()
+	var err error
+	if st.quota.MaxDiskBytes > 0 && n.getNamespaceDiskUsage(ns, now) >= st.quota.MaxDiskBytes {
+		err = ErrNamespaceDiskExceeded
+	} else if st.limiter != nil && !st.limiter.allowN(now, int64(msgNum)) {
+		err = ErrNamespacePubRateExceeded
+	}
+	if err != nil {
+		atomic.AddInt64(&st.pubRejected, 1)
+	}
+	return err
+}
+
+// AddNamespacePubCount counts the messages published to the topic in the publish
+// rate of the namespace without checking the quota, it is used for the messages
+// following the checked ones in the same request.
+func (n *NSQD) AddNamespacePubCount(topic string, msgNum int) {
+	ns := GetTopicNamespace(topic)
+	if ns == "" {
+		return
+	}
+	st := n.nsQuotas.getState(ns)
+	if st == nil || st.limiter == nil {
+		return
+	}
+	st.limiter.takeN(time.Now(), int64(msgNum))
+}
+
+// GetNamespaceStats rolls up the topic stats by the namespace, the topics without
+// namespace are ignored.
+func GetNamespaceStats(topics []TopicStats) []NamespaceStats {
+	rollups := make(map[string]*NamespaceStats)
+	topicNames := make(map[string]map[string]bool)
+	for _, t := range topics {
+		ns := GetTopicNamespace(t.TopicName)
+		if ns == "" {
+			continue
+		}
+		s, ok := rollups[ns]
+		if !ok {
+			s = &NamespaceStats{Namespace: ns}
+			rollups[ns] = s
+			topicNames[ns] = make(map[string]bool)
+		}
+		topicNames[ns][t.TopicName] = true
+		s.Partitions++
+		s.Channels += len(t.Channels)
+		s.Depth += t.Depth
+		s.BackendDepth += t.BackendDepth
+		s.MessageCount += t.MessageCount
+		s.HourlyPubSize += t.HourlyPubSize
+		s.DiskBytes += t.BackendDepth - t.BackendStart
+	}
+	nsList := make([]string, 0, len(rollups))
+	for ns, s := range rollups {
+		s.Topics = len(topicNames[ns])
+		nsList = append(nsList, ns)
+	}
+	sort.Strings(nsList)
+	ret := make([]NamespaceStats, 0, len(nsList))
+	for _, ns := range nsList {
+		ret = append(ret, *rollups[ns])
+	}
+	return ret
+}
+
+// FillNamespaceQuotaStats adds the quota and the usage against the quota
+func (n *NSQD) FillNamespaceQuotaStats(s *NamespaceStats) {
+	st := n.nsQuotas.getState(s.Namespace)
+	if st == nil {
+		return
+	}
+	quota := st.quota
+	s.Quota = &quota
+	s.PubRejected = atomic.LoadInt64(&st.pubRejected)
+	if quota.MaxTopics > 0 && n.namespaceTopicCount(s.Namespace) > quota.MaxTopics {
+		s.OverQuota = append(s.OverQuota, "topics")
+	}
+	if quota.MaxDiskBytes > 0 && s.DiskBytes >= quota.MaxDiskBytes {
+		s.OverQuota = append(s.OverQuota, "disk")
+	}
+}
@@ -31,6 +31,19 @@ const (
 	TLSRequired
 )
 
+// require the mutual tls only for pub or sub, the other side can be plaintext
+const (
+	MTLSRequiredNone   = ""
+	MTLSRequiredForPub = "pub"
+	MTLSRequiredForSub = "sub"
+)
+
+// the key used to aggregate the client pub stats
+const (
+	PubStatsKeyRemote   = "remote"
+	PubStatsKeyIdentity = "identity"
+)
+
 type errStore struct {
 	err error
 }
@@ -48,6 +61,15 @@ const (
 	FLUSH_DISTANCE = 4
 )
 
+// SelfTestTopic is the hidden topic used by the loopback self test, it is local on
+// each node, never registered to the lookup or replicated, and not persisted in the
+// metadata.
+const SelfTestTopic = "_nsqd_selftest"
+
+func IsHiddenTopic(name string) bool {
+	return name == SelfTestTopic
+}
+
 type INsqdNotify interface {
 	NotifyDeleteTopic(*Topic)
 	NotifyStateChanged(v interface{}, needPersist bool)
@@ -85,6 +107,14 @@ type NSQD struct {
 	persistNotifyCh  chan struct{}
 	persistClosed    chan struct{}
 	persistWaitGroup util.WaitGroupWrapper
+
+	acl           atomic.Value
+	aclDenied     *aclDeniedStats
+	protocolStats *protocolStats
+	nsQuotas      *namespaceQuotas
+	connLimiter   *connLimiter
+	// copy of all the topics for reading stats without lock
+	topicsSnapshot atomic.Value
 }
 
 func New(opts *Options) *NSQD {
@@ -112,6 +142,10 @@ func New(opts *Options) *NSQD {
 		scanTriggerChan:      make(chan *Channel, 1),
 		persistNotifyCh:      make(chan struct{}, 2),
 		persistClosed:        make(chan struct{}),
+		aclDenied:            newACLDeniedStats(),
+		protocolStats:        newProtocolStats(),
+		nsQuotas:             newNamespaceQuotas(),
+		connLimiter:          newConnLimiter(),
 	}
 	n.SwapOpts(opts)
 
@@ -158,6 +192,53 @@ func New(opts *Options) *NSQD {
 		opts.TLSRequired = TLSRequired
 	}
 
+	switch opts.TLSIdentityMode {
+	case TLSIdentityNone, TLSIdentityCN, TLSIdentitySAN:
+	default:
+		nsqLog.LogErrorf("FATAL: --tls-identity-mode must be one of 'cn' or 'san'")
+		os.Exit(1)
+	}
+	switch opts.MTLSRequiredFor {
+	case MTLSRequiredNone, MTLSRequiredForPub, MTLSRequiredForSub:
+	default:
+		nsqLog.LogErrorf("FATAL: --mtls-required-for must be one of 'pub' or 'sub'")
+		os.Exit(1)
+	}
+	if opts.PubStatsAggregateKey != PubStatsKeyRemote && opts.PubStatsAggregateKey != PubStatsKeyIdentity {
+		nsqLog.LogErrorf("FATAL: --pub-stats-aggregate-key must be one of 'remote' or 'identity'")
+		os.Exit(1)
+	}
+	if opts.MaxPubClientStats <= 0 {
+		nsqLog.LogErrorf("FATAL: --max-pub-client-stats must be positive")
+		os.Exit(1)
+	}
+	if opts.DepthHistoryInterval < 0 ||
+		(opts.DepthHistoryInterval > 0 && opts.DepthHistoryRetention < opts.DepthHistoryInterval) {
+		nsqLog.LogErrorf("FATAL: --depth-history-retention must not be less than --depth-history-interval")
+		os.Exit(1)
+	}
+	if opts.TCPSendBufferSize < 0 || opts.TCPRecvBufferSize < 0 ||
+		opts.TCPSendBufferSize > opts.MaxTCPBufferSize || opts.TCPRecvBufferSize > opts.MaxTCPBufferSize {
+		nsqLog.LogErrorf("FATAL: --tcp-send-buffer-size and --tcp-recv-buffer-size must be between 0 and --max-tcp-buffer-size")
+		os.Exit(1)
+	}
+	for _, l := range opts.TCPListeners {
+		if _, err := ParseTCPListener(l, opts); err != nil {
+			nsqLog.LogErrorf("FATAL: --tcp-listener %v", err)
+			os.Exit(1)
+		}
+	}
+	if opts.InFlightSpillThreshold < 0 {
+		nsqLog.LogErrorf("FATAL: --inflight-spill-threshold must not be negative")
+		os.Exit(1)
+	}
+
+	err = n.loadACL(opts.ACLFile)
+	if err != nil {
+		nsqLog.LogErrorf("FATAL: failed to load acl file %v: %v", opts.ACLFile, err)
+		os.Exit(1)
+	}
+
 	return n
 }
 
@@ -257,6 +338,67 @@ func (n *NSQD) GetTopicMapCopy() map[string]map[int]*Topic {
 func (n *NSQD) Start() {
 	n.waitGroup.Wrap(func() { n.queueScanLoop() })
 	n.persistWaitGroup.Wrap(func() { n.persistLoop() })
+	if n.GetOpts().DepthHistoryInterval > 0 {
+		n.waitGroup.Wrap(func() { n.depthHistoryLoop() })
+	}
+	if n.GetOpts().PubClientStatsGCInterval > 0 {
+		n.waitGroup.Wrap(func() { n.pubStatsGCLoop() })
+	}
+	n.waitGroup.Wrap(func() { n.dedupIndexExpireLoop() })
+}
+
+// remove the expired dedup keys periodically, so the memory and the disk used by the
+// keys out of the dedup window can be reclaimed.
+func (n *NSQD) dedupIndexExpireLoop() {
+	ticker := time.NewTicker(DedupIndexExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, t := range n.getTopicsSnapshot() {
+				err := t.ExpireDedupIndex(now)
+				if err != nil && err != ErrExiting {
+					nsqLog.LogWarningf("topic %v failed to expire dedup index: %v", t.GetFullName(), err)
+				}
+			}
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
+// remove the expired client pub stats periodically, the stats for the clients
+// with random ports (behind load balancer) may never be updated again.
+func (n *NSQD) pubStatsGCLoop() {
+	ticker := time.NewTicker(n.GetOpts().PubClientStatsGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, t := range n.getTopicsSnapshot() {
+				t.GetDetailStats().GCPubClientStats(now)
+			}
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
+// sample the depth of all the channels periodically, so we can
+// get the depth at some time in the past.
+func (n *NSQD) depthHistoryLoop() {
+	ticker := time.NewTicker(n.GetOpts().DepthHistoryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, c := range n.channels() {
+				c.SampleDepthHistory(now)
+			}
+		case <-n.exitChan:
+			return
+		}
+	}
 }
 
 func (n *NSQD) LoadMetadata(disabled int32) {
@@ -277,6 +419,17 @@ func (n *NSQD) LoadMetadata(disabled int32) {
 		return
 	}
 
+	if quotasJs, ok := js.CheckGet("namespace_quotas"); ok {
+		quotasData, _ := quotasJs.Encode()
+		var quotas map[string]NamespaceQuota
+		if err := json.Unmarshal(quotasData, &quotas); err != nil {
+			nsqLog.LogErrorf("failed to parse namespace quotas metadata - %s", err)
+		}
+		for ns, quota := range quotas {
+			n.nsQuotas.setQuota(ns, quota)
+		}
+	}
+
 	topics, err := js.Get("topics").Array()
 	if err != nil {
 		nsqLog.LogErrorf("failed to parse metadata - %s", err)
@@ -375,7 +528,7 @@ func (n *NSQD) persistMetadata(currentTopicMap map[string]map[int]*Topic) error
 	topics := []interface{}{}
 	for _, topicParts := range currentTopicMap {
 		for _, topic := range topicParts {
-			if topic.ephemeral {
+			if topic.ephemeral || IsHiddenTopic(topic.GetTopicName()) {
 				continue
 			}
 			topicData := make(map[string]interface{})
@@ -395,6 +548,7 @@ func (n *NSQD) persistMetadata(currentTopicMap map[string]map[int]*Topic) error
 	js["version"] = version.Binary
 	js["enabled_delayedqueue"] = atomic.LoadInt32(&EnableDelayedQueue)
 	js["topics"] = topics
+	js["namespace_quotas"] = n.nsQuotas.getQuotas()
 
 	data, err := json.Marshal(&js)
 	if err != nil {
@@ -524,7 +678,8 @@ func (n *NSQD) internalGetTopic(topicName string, part int, ext bool, disabled i
 			n.Unlock()
 			return t
 		}
-	} else {
+	}
+	if !ok {
 		topics = make(map[int]*Topic)
 		n.topicMap[topicName] = topics
 	}
@@ -543,6 +698,7 @@ func (n *NSQD) internalGetTopic(topicName string, part int, ext bool, disabled i
 		nsqLog.Errorf("TOPIC(%s): create failed", topicName)
 	} else {
 		topics[part] = t
+		n.updateTopicsSnapshotNoLock()
 		nsqLog.Logf("TOPIC(%s): created", t.GetFullName())
 
 	}
@@ -583,6 +739,24 @@ func (n *NSQD) deleteTopic(topicName string, part int) {
 	if len(topics) == 0 {
 		delete(n.topicMap, topicName)
 	}
+	n.updateTopicsSnapshotNoLock()
+}
+
+func (n *NSQD) updateTopicsSnapshotNoLock() {
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, topicParts := range n.topicMap {
+		for _, t := range topicParts {
+			topics = append(topics, t)
+		}
+	}
+	n.topicsSnapshot.Store(topics)
+}
+
+// getTopicsSnapshot returns all the topics without holding the nsqd lock,
+// it is used for stats only.
+func (n *NSQD) getTopicsSnapshot() []*Topic {
+	topics, _ := n.topicsSnapshot.Load().([]*Topic)
+	return topics
 }
 
 // this just close the topic and remove from map, but keep the data for later.
@@ -677,6 +851,9 @@ func (n *NSQD) DeleteExistingTopic(topicName string, part int) error {
 	topic.Delete()
 
 	n.deleteTopic(topicName, part)
+	if len(n.GetTopicPartitions(topicName)) == 0 {
+		n.aclDenied.remove(topicName)
+	}
 	return nil
 }
 
@@ -692,6 +869,7 @@ func (n *NSQD) CleanClientPubStats(remote string, protocol string) {
 func (n *NSQD) flushAll(all bool, flushCnt int) {
 	match := flushCnt % FLUSH_DISTANCE
 	tmpMap := n.GetTopicMapCopy()
+	now := time.Now()
 	for _, topics := range tmpMap {
 		for _, t := range topics {
 			if !all && t.IsWriteDisabled() {
@@ -700,7 +878,9 @@ func (n *NSQD) flushAll(all bool, flushCnt int) {
 			if !all && (((t.GetTopicPart() + 1) % FLUSH_DISTANCE) != match) {
 				continue
 			}
-			t.ForceFlush()
+			// only the topic disk sync is delayed by the sync timeout of the
+			// partition, the channels and the delayed queue are always flushed.
+			t.flushAllData(!t.IsFlushDue(now))
 		}
 	}
 }
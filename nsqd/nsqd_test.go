@@ -456,3 +456,87 @@ func TestLoadTopicChannel(t *testing.T) {
 		t.Errorf("should closed this channel after reload")
 	}
 }
+
+func TestCheckACL(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	equal(t, err, nil)
+	defer os.RemoveAll(tmpDir)
+	opts.DataPath = tmpDir
+	aclFile := path.Join(tmpDir, "acl.json")
+	err = ioutil.WriteFile(aclFile, []byte(`{"default": "deny", "rules": [
+		{"identity": "^producer$", "topic": "^orders", "operations": ["PUB"], "action": "allow"},
+		{"identity": "^consumer$", "topic": "^orders_secret$", "operations": ["*"], "action": "deny"},
+		{"identity": "^consumer$", "topic": "^orders", "operations": ["SUB", "CHANNEL_CREATE"], "action": "allow"}
+	]}`), 0644)
+	equal(t, err, nil)
+	opts.ACLFile = aclFile
+	_, _, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+	nsqd.GetTopic("orders", 0)
+
+	equal(t, nsqd.CheckACL("producer", "orders", "PUB"), true)
+	equal(t, nsqd.CheckACL("producer", "orders", "SUB"), false)
+	equal(t, nsqd.CheckACL("consumer", "orders", "SUB"), true)
+	equal(t, nsqd.CheckACL("consumer", "orders", "CHANNEL_CREATE"), true)
+	equal(t, nsqd.CheckACL("consumer", "orders", "CHANNEL_DELETE"), false)
+	equal(t, nsqd.CheckACL("consumer", "orders_secret", "SUB"), false)
+	equal(t, nsqd.CheckACL("", "orders", "PUB"), false)
+
+	equal(t, nsqd.GetACLDeniedStats("orders"), map[string]int64{"SUB": 1, "CHANNEL_DELETE": 1, "PUB": 1})
+	// the topic not on this node is only counted in total
+	equal(t, len(nsqd.GetACLDeniedStats("orders_secret")), 0)
+	equal(t, nsqd.GetACLDeniedTotalStats()["SUB"], int64(2))
+
+	nsqd.DeleteExistingTopic("orders", 0)
+	equal(t, len(nsqd.GetACLDeniedStats("orders")), 0)
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	equal(t, GetTopicNamespace("tenantA.orders"), "tenantA")
+	equal(t, GetTopicNamespace("orders"), "")
+	equal(t, GetTopicNamespace(".orders"), "")
+
+	equal(t, nsqd.SetNamespaceQuota("tenantA", NamespaceQuota{MaxTopics: -1}), ErrInvalidNamespaceQuota)
+	equal(t, nsqd.SetNamespaceQuota("tenantA.orders", NamespaceQuota{MaxTopics: 1}), ErrInvalidNamespaceQuota)
+	err := nsqd.SetNamespaceQuota("tenantA", NamespaceQuota{MaxTopics: 1, MaxPubRate: 10})
+	equal(t, err, nil)
+
+	equal(t, nsqd.CheckNamespaceTopicQuota("tenantA.orders"), nil)
+	topic := nsqd.GetTopic("tenantA.orders", 0)
+	topic.GetChannel("ch")
+	// the existing topic is allowed to add partition
+	equal(t, nsqd.CheckNamespaceTopicQuota("tenantA.orders"), nil)
+	equal(t, nsqd.CheckNamespaceTopicQuota("tenantA.users"), ErrNamespaceTopicsExceeded)
+	equal(t, nsqd.CheckNamespaceTopicQuota("tenantB.users"), nil)
+	equal(t, nsqd.GetTopic("tenantA.orders", 1) != nil, true)
+
+	equal(t, nsqd.CheckNamespacePubQuota("tenantA.orders", 10), nil)
+	equal(t, nsqd.CheckNamespacePubQuota("tenantA.orders", 1), ErrNamespacePubRateExceeded)
+	equal(t, nsqd.CheckNamespacePubQuota("orders", 100), nil)
+
+	nsqd.GetTopic("tenantB.users", 0)
+	stats := GetNamespaceStats(nsqd.GetStats(false, true))
+	equal(t, len(stats), 2)
+	equal(t, stats[0].Namespace, "tenantA")
+	equal(t, stats[0].Topics, 1)
+	equal(t, stats[0].Channels, 1)
+	nsqd.FillNamespaceQuotaStats(&stats[0])
+	equal(t, stats[0].Quota.MaxPubRate, int64(10))
+	equal(t, stats[0].PubRejected, int64(1))
+
+	// the quotas are persisted in the metadata
+	nsqd.Exit()
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	nsqd.LoadMetadata(0)
+	equal(t, nsqd.GetNamespaceQuotas(), map[string]NamespaceQuota{"tenantA": {MaxTopics: 1, MaxPubRate: 10}})
+	equal(t, nsqd.SetNamespaceQuota("tenantA", NamespaceQuota{}), nil)
+	equal(t, len(nsqd.GetNamespaceQuotas()), 0)
+}
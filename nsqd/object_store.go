@@ -0,0 +1,262 @@
+package nsqd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Endpoint = "https://s3.amazonaws.com"
+	defaultS3Region   = "us-east-1"
+	s3SignAlgorithm   = "AWS4-HMAC-SHA256"
+)
+
+var (
+	ErrArchiveStoreNotConfigured = errors.New("archive store is not configured")
+	ErrArchiveObjectNotFound     = errors.New("archive object not found")
+)
+
+// ObjectStore is the cold storage for the archived queue segments.
+type ObjectStore interface {
+	Put(key string, r io.ReadSeeker, size int64) error
+	// the caller should close the returned reader
+	Get(key string) (io.ReadCloser, error)
+	String() string
+}
+
+// NewObjectStore creates the store by the archive options, the store can be
+// the local (or mounted) directory as file:///data/archive, or the S3 compatible
+// bucket with optional key prefix as s3://bucket/prefix.
+func NewObjectStore(opts *Options) (ObjectStore, error) {
+	if opts.ArchiveStore == "" {
+		return nil, ErrArchiveStoreNotConfigured
+	}
+	u, err := url.Parse(opts.ArchiveStore)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "", "file":
+		dir := u.Path
+		if u.Scheme == "" {
+			dir = opts.ArchiveStore
+		}
+		if dir == "" {
+			return nil, fmt.Errorf("invalid archive store: %v", opts.ArchiveStore)
+		}
+		return &fileObjectStore{dir: dir}, nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing bucket in archive store: %v", opts.ArchiveStore)
+		}
+		s := &s3ObjectStore{
+			endpoint:  strings.TrimRight(opts.ArchiveS3Endpoint, "/"),
+			region:    opts.ArchiveS3Region,
+			bucket:    u.Host,
+			prefix:    strings.Trim(u.Path, "/"),
+			accessKey: opts.ArchiveS3AccessKey,
+			secretKey: opts.ArchiveS3SecretKey,
+			client:    &http.Client{Timeout: 10 * time.Minute},
+		}
+		if s.endpoint == "" {
+			s.endpoint = defaultS3Endpoint
+		}
+		if !strings.Contains(s.endpoint, "://") {
+			s.endpoint = "https://" + s.endpoint
+		}
+		if s.region == "" {
+			s.region = defaultS3Region
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unsupported archive store: %v", opts.ArchiveStore)
+}
+
+type fileObjectStore struct {
+	dir string
+}
+
+func (s *fileObjectStore) String() string {
+	return "file://" + s.dir
+}
+
+func (s *fileObjectStore) Put(key string, r io.ReadSeeker, size int64) error {
+	fileName := filepath.Join(s.dir, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err != nil {
+		return err
+	}
+	tmpFileName := fileName + ".tmp"
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+func (s *fileObjectStore) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil, ErrArchiveObjectNotFound
+	}
+	return f, err
+}
+
+// s3ObjectStore accesses the S3 compatible service with the path style url and
+// the signature version 4.
+type s3ObjectStore struct {
+	endpoint  string
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (s *s3ObjectStore) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.prefix)
+}
+
+func (s *s3ObjectStore) objectPath(key string) string {
+	return "/" + path.Join(s.bucket, s.prefix, key)
+}
+
+func (s *s3ObjectStore) Put(key string, r io.ReadSeeker, size int64) error {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	_, err = r.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", s.endpoint+s3EscapePath(s.objectPath(key)), ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	s.sign(req, hex.EncodeToString(h.Sum(nil)), time.Now())
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		return fmt.Errorf("put object %v failed: %v %s", key, rsp.Status, body)
+	}
+	return nil
+}
+
+func (s *s3ObjectStore) Get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", s.endpoint+s3EscapePath(s.objectPath(key)), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, hex.EncodeToString(sha256Sum(nil)), time.Now())
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+		rsp.Body.Close()
+		if rsp.StatusCode == http.StatusNotFound {
+			return nil, ErrArchiveObjectNotFound
+		}
+		return nil, fmt.Errorf("get object %v failed: %v %s", key, rsp.Status, body)
+	}
+	return rsp.Body, nil
+}
+
+// sign adds the authorization header of the signature version 4, the request
+// is sent anonymously if no access key.
+func (s *s3ObjectStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.accessKey == "" {
+		return
+	}
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{day, s.region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		s3SignAlgorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(sha256Sum([]byte(canonicalRequest))),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignAlgorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Sum(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath encodes the path as required by the signature, all the bytes
+// except the unreserved characters and the slash are percent encoded.
+func s3EscapePath(p string) string {
+	var buf []byte
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			buf = append(buf, c)
+		} else {
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(buf)
+}
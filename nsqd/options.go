@@ -32,6 +32,8 @@ type Options struct {
 	BroadcastInterface         string        `flag:"broadcast-interface"`
 	NSQLookupdTCPAddresses     []string      `flag:"lookupd-tcp-address" cfg:"nsqlookupd_tcp_addresses"`
 	AuthHTTPAddresses          []string      `flag:"auth-http-address" cfg:"auth_http_addresses"`
+	ACLFile                    string        `flag:"acl-file"`
+	SelfTestAuthSecret         string        `flag:"selftest-auth-secret"`
 	LookupPingInterval         time.Duration `flag:"lookup-ping-interval" arg:"5s"`
 
 	// diskqueue options
@@ -56,12 +58,63 @@ type Options struct {
 	MaxConfirmWin     int64         `flag:"max-confirm-win"`
 	ClientTimeout     time.Duration
 	ReqToEndThreshold time.Duration `flag:"req-to-end-threshold"`
+	// the in-flight message body will be released from memory and reloaded from disk
+	// while needed if the in-flight count of the channel is more than this, 0 to disable
+	InFlightSpillThreshold int64 `flag:"inflight-spill-threshold"`
+	// the max (and default) duration before the reply channel created by client expired
+	MaxReplyChannelTTL time.Duration `flag:"max-reply-channel-ttl"`
+	// close the client connection if the heartbeat round-trip time exceeds this, 0 to disable
+	MaxHeartbeatRTT time.Duration `flag:"max-heartbeat-rtt"`
+	// close the connection not consuming if no publish in the timeout, 0 to disable
+	ProducerIdleTimeout time.Duration `flag:"producer-idle-timeout"`
+	// close the connection after the lifetime (with up to 10% jitter), so the clients will
+	// reconnect to rebalance and auth again, 0 to disable
+	MaxConnLifetime time.Duration `flag:"max-conn-lifetime"`
+	// the max concurrent tcp connections from a single remote ip and of a single auth
+	// (or tls) identity, 0 for no limit
+	MaxConnsPerIP       int64 `flag:"max-conns-per-ip"`
+	MaxConnsPerIdentity int64 `flag:"max-conns-per-identity"`
+	// the max tcp connections publishing to a single topic partition, 0 for no limit
+	MaxTopicPublishers int64 `flag:"max-topic-publishers"`
+	// the ordered channel is marked as stuck if the confirmed offset is not advanced
+	// in this duration while there are messages to deliver, 0 to disable
+	OrderedStuckTimeout time.Duration `flag:"ordered-stuck-timeout"`
+	// the http mpub body is written in batches of this size while reading, instead of
+	// buffering the whole body. The mpub is not atomic if the body is larger than the
+	// batch, 0 to disable the batch and validate the whole body before written
+	MaxHTTPMPubBatchSize int64 `flag:"max-http-mpub-batch-size"`
+	// the partition is degraded if the average fsync or write latency exceeds the
+	// threshold for a while, 0 to disable the check
+	SlowDiskSyncThreshold  time.Duration `flag:"slow-disk-sync-threshold"`
+	SlowDiskWriteThreshold time.Duration `flag:"slow-disk-write-threshold"`
+	// transfer the leadership of the degraded partition to the other isr node
+	SlowDiskAutoTransfer bool `flag:"slow-disk-auto-transfer"`
+	// the url the alert events (slow disk, write latency slo, channel slo) posted to
+	AlertWebhook string `flag:"alert-webhook"`
+	// the url the tcp client connection events posted to, empty to disable
+	ConnEventWebhook string `flag:"conn-event-webhook"`
+	// the publish is rejected with the retry after while the max unconsumed messages or
+	// bytes of the channels exceeds the high watermark, 0 to disable
+	PubBackpressureDepth      int64         `flag:"pub-backpressure-depth"`
+	PubBackpressureBytes      int64         `flag:"pub-backpressure-bytes"`
+	PubBackpressureRetryAfter time.Duration `flag:"pub-backpressure-retry-after"`
 
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
 	MaxRdyCount            int64         `flag:"max-rdy-count"`
 	MaxOutputBufferSize    int64         `flag:"max-output-buffer-size"`
 	MaxOutputBufferTimeout time.Duration `flag:"max-output-buffer-timeout"`
+	MaxTCPBufferSize       int           `flag:"max-tcp-buffer-size"`
+
+	// tcp options for the client connections of the default listener, 0 for the
+	// system default buffer size and keepalive, the keepalive is disabled if the
+	// period is negative
+	TCPNoDelay         bool          `flag:"tcp-no-delay"`
+	TCPSendBufferSize  int           `flag:"tcp-send-buffer-size"`
+	TCPRecvBufferSize  int           `flag:"tcp-recv-buffer-size"`
+	TCPKeepAlivePeriod time.Duration `flag:"tcp-keepalive-period"`
+	// the extra tcp listeners with the own tcp options, see ParseTCPListener
+	TCPListeners []string `flag:"tcp-listener" cfg:"tcp_listeners"`
 
 	// statsd integration
 	StatsdAddress  string        `flag:"statsd-address"`
@@ -70,6 +123,16 @@ type Options struct {
 	StatsdInterval time.Duration `flag:"statsd-interval" arg:"60s"`
 	StatsdMemStats bool          `flag:"statsd-mem-stats"`
 
+	// client pub stats
+	PubStatsAggregateKey     string        `flag:"pub-stats-aggregate-key"`
+	MaxPubClientStats        int           `flag:"max-pub-client-stats"`
+	PubClientStatsTTL        time.Duration `flag:"pub-client-stats-ttl"`
+	PubClientStatsGCInterval time.Duration `flag:"pub-client-stats-gc-interval"`
+
+	// channel depth history, 0 interval to disable
+	DepthHistoryInterval  time.Duration `flag:"depth-history-interval"`
+	DepthHistoryRetention time.Duration `flag:"depth-history-retention"`
+
 	// e2e message latency
 	E2EProcessingLatencyWindowTime  time.Duration `flag:"e2e-processing-latency-window-time"`
 	E2EProcessingLatencyPercentiles []float64     `flag:"e2e-processing-latency-percentile" cfg:"e2e_processing_latency_percentiles"`
@@ -81,6 +144,8 @@ type Options struct {
 	TLSRootCAFile       string `flag:"tls-root-ca-file"`
 	TLSRequired         int    `flag:"tls-required"`
 	TLSMinVersion       uint16 `flag:"tls-min-version"`
+	TLSIdentityMode     string `flag:"tls-identity-mode"`
+	MTLSRequiredFor     string `flag:"mtls-required-for"`
 
 	// compression
 	DeflateEnabled  bool `flag:"deflate"`
@@ -90,11 +155,26 @@ type Options struct {
 	LogLevel     int32  `flag:"log-level" cfg:"log_level"`
 	LogDir       string `flag:"log-dir" cfg:"log_dir"`
 	Logger       levellogger.Logger
+	LogFormat    string `flag:"log-format" cfg:"log_format"`
+	LogSinks     string `flag:"log-sinks" cfg:"log_sinks"`
 	RemoteTracer string `flag:"remote-tracer"`
+	// export the spans of the messages carrying the W3C traceparent in the json
+	// header to the OTLP/HTTP collector (http://host:4318), disabled if empty
+	OTLPEndpoint    string `flag:"otlp-endpoint"`
+	OTLPServiceName string `flag:"otlp-service-name"`
+
+	// the cold storage for the consumed segments of the archived topics, can be
+	// the directory as file:///path or the S3 compatible bucket as s3://bucket/prefix
+	ArchiveStore       string `flag:"archive-store"`
+	ArchiveS3Endpoint  string `flag:"archive-s3-endpoint"`
+	ArchiveS3Region    string `flag:"archive-s3-region"`
+	ArchiveS3AccessKey string `flag:"archive-s3-access-key"`
+	ArchiveS3SecretKey string `flag:"archive-s3-secret-key"`
 
 	RetentionDays         int32 `flag:"retention-days" cfg:"retention_days"`
 	RetentionSizePerDay         int64 `flag:"retention-size-per-day" cfg:"retention_size_per_day"`
 	StartAsFixMode        bool  `flag:"start-as-fix-mode"`
+	ReadOnlyRecovery      bool  `flag:"read-only-recovery" cfg:"read_only_recovery"`
 	AllowExtCompatible    bool  `flag:"allow-ext-compatible" cfg:"allow_ext_compatible"`
 	AllowSubExtCompatible bool  `flag:"allow-sub-ext-compatible" cfg:"allow_sub_ext_compatible"`
 }
@@ -122,6 +202,7 @@ func NewOptions() *Options {
 
 		NSQLookupdTCPAddresses: make([]string, 0),
 		AuthHTTPAddresses:      make([]string, 0),
+		TCPListeners:           make([]string, 0),
 		LookupPingInterval:     5 * time.Second,
 
 		MemQueueSize:    10000,
@@ -135,25 +216,45 @@ func NewOptions() *Options {
 		QueueScanWorkerPoolMax:   4,
 		QueueScanDirtyPercent:    0.25,
 
-		MsgTimeout:        60 * time.Second,
-		MaxMsgTimeout:     15 * time.Minute,
-		MaxMsgSize:        1024 * 1024,
-		MaxBodySize:       5 * 1024 * 1024,
-		MaxReqTimeout:     3 * 24 * time.Hour,
-		ClientTimeout:     60 * time.Second,
-		ReqToEndThreshold: 15 * time.Minute,
+		MsgTimeout:         60 * time.Second,
+		MaxMsgTimeout:      15 * time.Minute,
+		MaxMsgSize:         1024 * 1024,
+		MaxBodySize:        5 * 1024 * 1024,
+		MaxReqTimeout:      3 * 24 * time.Hour,
+		ClientTimeout:      60 * time.Second,
+		ReqToEndThreshold:  15 * time.Minute,
+		MaxReplyChannelTTL: 30 * time.Minute,
+
+		OrderedStuckTimeout: 5 * time.Minute,
+
+
+		SlowDiskSyncThreshold:  time.Second,
+		SlowDiskWriteThreshold: 500 * time.Millisecond,
+		SlowDiskAutoTransfer:   false,
+
+		PubBackpressureRetryAfter: time.Second,
 
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
 		MaxOutputBufferSize:    64 * 1024,
 		MaxOutputBufferTimeout: 1 * time.Second,
 		MaxConfirmWin:          500,
+		MaxTCPBufferSize:       16 * 1024 * 1024,
+
+		TCPNoDelay: true,
 
 		StatsdPrefix:   "nsq.%s",
 		StatsdProtocol: "udp",
 		StatsdInterval: 60 * time.Second,
 		StatsdMemStats: true,
 
+		PubStatsAggregateKey:     PubStatsKeyRemote,
+		MaxPubClientStats:        1000,
+		PubClientStatsTTL:        time.Hour,
+		PubClientStatsGCInterval: time.Minute,
+
+		DepthHistoryRetention: 24 * time.Hour,
+
 		E2EProcessingLatencyWindowTime: time.Duration(10 * time.Minute),
 
 		DeflateEnabled:  true,
@@ -166,6 +267,10 @@ func NewOptions() *Options {
 		LogDir:   "",
 		Logger:   &levellogger.GLogger{},
 
+		LogFormat: levellogger.FormatText,
+
+		OTLPServiceName: "nsqd",
+
 		RetentionDays: int32(DEFAULT_RETENTION_DAYS),
 	}
 
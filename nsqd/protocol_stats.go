@@ -0,0 +1,124 @@
+package nsqd
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolHTTP = "http"
+)
+
+type ProtocolStats struct {
+	Protocol         string `json:"protocol" pb:"1"`
+	Connections      int64  `json:"connections" pb:"2"`
+	TotalConnections int64  `json:"total_connections" pb:"3"`
+	PubCount         int64  `json:"pub_count" pb:"4"`
+	PubBytes         int64  `json:"pub_bytes" pb:"5"`
+	ErrorCount       int64  `json:"error_count" pb:"6"`
+	// the connections closed by the server for the idle timeout or the max lifetime
+	IdleClosed     int64 `json:"idle_closed" pb:"7"`
+	LifetimeClosed int64 `json:"lifetime_closed" pb:"8"`
+}
+
+type protocolCounters struct {
+	connections      int64
+	totalConnections int64
+	pubCount         int64
+	pubBytes         int64
+	errorCount       int64
+	idleClosed       int64
+	lifetimeClosed   int64
+}
+
+// protocolStats holds the node level counters split by the ingress protocol,
+// new protocols will be added on the first update.
+type protocolStats struct {
+	sync.Mutex
+	counters map[string]*protocolCounters
+}
+
+func newProtocolStats() *protocolStats {
+	return &protocolStats{
+		counters: map[string]*protocolCounters{
+			ProtocolTCP:  &protocolCounters{},
+			ProtocolHTTP: &protocolCounters{},
+		},
+	}
+}
+
+func (self *protocolStats) get(proto string) *protocolCounters {
+	self.Lock()
+	c, ok := self.counters[proto]
+	if !ok {
+		c = &protocolCounters{}
+		self.counters[proto] = c
+	}
+	self.Unlock()
+	return c
+}
+
+func (self *protocolStats) getAll() []ProtocolStats {
+	self.Lock()
+	defer self.Unlock()
+	ret := make([]ProtocolStats, 0, len(self.counters))
+	for proto, c := range self.counters {
+		ret = append(ret, ProtocolStats{
+			Protocol:         proto,
+			Connections:      atomic.LoadInt64(&c.connections),
+			TotalConnections: atomic.LoadInt64(&c.totalConnections),
+			PubCount:         atomic.LoadInt64(&c.pubCount),
+			PubBytes:         atomic.LoadInt64(&c.pubBytes),
+			ErrorCount:       atomic.LoadInt64(&c.errorCount),
+			IdleClosed:       atomic.LoadInt64(&c.idleClosed),
+			LifetimeClosed:   atomic.LoadInt64(&c.lifetimeClosed),
+		})
+	}
+	sort.Sort(ProtocolStatsByName(ret))
+	return ret
+}
+
+type ProtocolStatsByName []ProtocolStats
+
+func (s ProtocolStatsByName) Len() int           { return len(s) }
+func (s ProtocolStatsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s ProtocolStatsByName) Less(i, j int) bool { return s[i].Protocol < s[j].Protocol }
+
+// ProtocolConnOpened should be paired with ProtocolConnClosed, for the http protocol
+// each request is counted as a connection.
+func (n *NSQD) ProtocolConnOpened(proto string) {
+	c := n.protocolStats.get(proto)
+	atomic.AddInt64(&c.connections, 1)
+	atomic.AddInt64(&c.totalConnections, 1)
+}
+
+func (n *NSQD) ProtocolConnClosed(proto string) {
+	atomic.AddInt64(&n.protocolStats.get(proto).connections, -1)
+}
+
+func (n *NSQD) UpdateProtocolPubStats(proto string, msgCnt int64, bytes int64) {
+	c := n.protocolStats.get(proto)
+	atomic.AddInt64(&c.pubCount, msgCnt)
+	atomic.AddInt64(&c.pubBytes, bytes)
+}
+
+func (n *NSQD) IncrProtocolErrorStats(proto string) {
+	atomic.AddInt64(&n.protocolStats.get(proto).errorCount, 1)
+}
+
+// IncrProtocolForcedCloseStats counts the connection closed by the server for the reason
+func (n *NSQD) IncrProtocolForcedCloseStats(proto string, reason string) {
+	c := n.protocolStats.get(proto)
+	switch reason {
+	case DisconnectIdleTimeout:
+		atomic.AddInt64(&c.idleClosed, 1)
+	case DisconnectMaxLifetime:
+		atomic.AddInt64(&c.lifetimeClosed, 1)
+	}
+}
+
+func (n *NSQD) GetProtocolStats() []ProtocolStats {
+	return n.protocolStats.getAll()
+}
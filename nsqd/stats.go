@@ -1,6 +1,7 @@
 package nsqd
 
 import (
+	"container/list"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -17,25 +18,55 @@ import (
 	"github.com/youzan/nsq/internal/util"
 )
 
+// StatsSchemaVersion is the version of the stats schema, the pb tags of the stats
+// are the field numbers of the protobuf schema. The field number should never be
+// changed or reused after the field removed, and the version should be increased
+// while the schema changed.
+const StatsSchemaVersion = 1
+
 type TopicStats struct {
-	TopicName            string           `json:"topic_name"`
-	TopicFullName        string           `json:"topic_full_name"`
-	TopicPartition       string           `json:"topic_partition"`
-	Channels             []ChannelStats   `json:"channels"`
-	Depth                int64            `json:"depth"`
-	BackendDepth         int64            `json:"backend_depth"`
-	BackendStart         int64            `json:"backend_start"`
-	MessageCount         uint64           `json:"message_count"`
-	IsLeader             bool             `json:"is_leader"`
-	HourlyPubSize        int64            `json:"hourly_pubsize"`
-	Clients              []ClientPubStats `json:"client_pub_stats"`
-	MsgSizeStats         []int64          `json:"msg_size_stats"`
-	MsgWriteLatencyStats []int64          `json:"msg_write_latency_stats"`
-	IsMultiOrdered       bool             `json:"is_multi_ordered"`
-	IsExt                bool             `json:"is_ext"`
-	StatsdName           string           `json:"statsd_name"`
+	TopicName            string           `json:"topic_name" pb:"1"`
+	TopicFullName        string           `json:"topic_full_name" pb:"2"`
+	TopicPartition       string           `json:"topic_partition" pb:"3"`
+	Channels             []ChannelStats   `json:"channels" pb:"4"`
+	Depth                int64            `json:"depth" pb:"5"`
+	BackendDepth         int64            `json:"backend_depth" pb:"6"`
+	BackendStart         int64            `json:"backend_start" pb:"7"`
+	MessageCount         uint64           `json:"message_count" pb:"8"`
+	IsLeader             bool             `json:"is_leader" pb:"9"`
+	HourlyPubSize        int64            `json:"hourly_pubsize" pb:"10"`
+	Clients              []ClientPubStats `json:"client_pub_stats" pb:"11"`
+	MsgSizeStats         []int64          `json:"msg_size_stats" pb:"12"`
+	MsgWriteLatencyStats []int64          `json:"msg_write_latency_stats" pb:"13"`
+	IsMultiOrdered       bool             `json:"is_multi_ordered" pb:"14"`
+	IsExt                bool             `json:"is_ext" pb:"15"`
+	StatsdName           string           `json:"statsd_name" pb:"16"`
+	ACLDenied            map[string]int64 `json:"acl_denied,omitempty" pb:"17"`
+	DedupIndex           *DedupIndexStats `json:"dedup_index,omitempty"`
+	PubStatsEvicted      int64            `json:"client_pub_stats_evicted" pb:"18"`
+	PubStatsExpired      int64            `json:"client_pub_stats_expired" pb:"19"`
+	PubStatsMax          int              `json:"client_pub_stats_max" pb:"20"`
+	PubStatsTTL          string           `json:"client_pub_stats_ttl" pb:"21"`
+	PartitionNum         int              `json:"partition_num" pb:"22"`
+	Replicator           int              `json:"replicator" pb:"23"`
+	SyncEvery            int64            `json:"sync_every" pb:"24"`
+	RetentionDay         int32            `json:"retention_day" pb:"25"`
 
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
+
+	Mirror  *TopicMirrorStats  `json:"mirror,omitempty"`
+	Archive *TopicArchiveStats `json:"archive,omitempty"`
+	Dedup   *TopicDedupStats   `json:"dedup,omitempty"`
+
+	DiskLatency DiskLatencyStats `json:"disk_latency" pb:"26"`
+	// the write latency slo, degraded if the slo breached
+	WriteLatencySLO *TopicLatencySLOStats `json:"write_latency_slo,omitempty"`
+	// the backpressure state of the publish, nil if no watermark
+	PubBackpressure *PubBackpressureStats `json:"pub_backpressure,omitempty" pb:"27"`
+	// the accumulated disk io and fsync latency of the partition
+	DiskIO DiskIOStats `json:"disk_io" pb:"28"`
+	// the config overridden at runtime, nil if no override
+	RuntimeConf *TopicRuntimeConf `json:"runtime_conf,omitempty" pb:"29"`
 }
 
 func NewTopicStats(t *Topic, channels []ChannelStats, filterClients bool) TopicStats {
@@ -47,6 +78,13 @@ func NewTopicStats(t *Topic, channels []ChannelStats, filterClients bool) TopicS
 	if !filterClients {
 		clients = t.detailStats.GetPubClientStats()
 	}
+	evicted, expired := t.detailStats.GetPubStatsEvicted()
+	pubStatsMax, pubStatsTTL := t.GetPubStatsPolicy()
+	var dedupStats *DedupIndexStats
+	if ds := t.dedupIndex.GetStats(); ds.KeyCount > 0 || ds.DiskBytes > 0 {
+		dedupStats = &ds
+	}
+	dyConf := t.GetDynamicInfo()
 	return TopicStats{
 		TopicName:            t.GetTopicName(),
 		TopicFullName:        t.GetFullName(),
@@ -63,42 +101,91 @@ func NewTopicStats(t *Topic, channels []ChannelStats, filterClients bool) TopicS
 		IsMultiOrdered:       t.IsOrdered(),
 		IsExt:                t.IsExt(),
 		StatsdName:           statsdName,
+		DedupIndex:           dedupStats,
+		PubStatsEvicted:      evicted,
+		PubStatsExpired:      expired,
+		PubStatsMax:          pubStatsMax,
+		PubStatsTTL:          pubStatsTTL.String(),
+		PartitionNum:         dyConf.PartitionNum,
+		Replicator:           dyConf.Replica,
+		SyncEvery:            dyConf.SyncEvery,
+		RetentionDay:         dyConf.RetentionDay,
+		Mirror:               t.GetMirrorStats(),
+		Archive:              t.GetArchiveStats(),
+		Dedup:                t.GetDedupStats(),
+		DiskLatency:          t.GetDiskLatencyStats(),
+		WriteLatencySLO:      t.GetWriteLatencySLOStats(),
+		PubBackpressure:      t.GetPubBackpressureStats(),
+		DiskIO:               t.GetDiskIOStats(),
+		RuntimeConf:          t.GetRuntimeConf(),
 
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().Result(),
 	}
 }
 
 type ChannelStats struct {
-	ChannelName string `json:"channel_name"`
+	ChannelName string `json:"channel_name" pb:"1"`
 	// message size need to consume
-	Depth          int64  `json:"depth"`
-	DepthSize      int64  `json:"depth_size"`
-	DepthTimestamp string `json:"depth_ts"`
-	BackendDepth   int64  `json:"backend_depth"`
+	Depth          int64  `json:"depth" pb:"2"`
+	DepthSize      int64  `json:"depth_size" pb:"3"`
+	DepthTimestamp string `json:"depth_ts" pb:"4"`
+	BackendDepth   int64  `json:"backend_depth" pb:"5"`
 	// total size sub past hour on this channel
-	HourlySubSize int64         `json:"hourly_subsize"`
-	InFlightCount int           `json:"in_flight_count"`
-	DeferredCount int           `json:"deferred_count"`
-	MessageCount  uint64        `json:"message_count"`
-	RequeueCount  uint64        `json:"requeue_count"`
-	TimeoutCount  uint64        `json:"timeout_count"`
-	Clients       []ClientStats `json:"clients"`
-	ClientNum     int64         `json:"client_num"`
-	Paused        bool          `json:"paused"`
-	Skipped       bool          `json:"skipped"`
-
-	DelayedQueueCount  uint64 `json:"delayed_queue_count"`
-	DelayedQueueRecent string `json:"delayed_queue_recent"`
+	HourlySubSize int64         `json:"hourly_subsize" pb:"6"`
+	InFlightCount int           `json:"in_flight_count" pb:"7"`
+	DeferredCount int           `json:"deferred_count" pb:"8"`
+	MessageCount  uint64        `json:"message_count" pb:"9"`
+	RequeueCount  uint64        `json:"requeue_count" pb:"10"`
+	TimeoutCount  uint64        `json:"timeout_count" pb:"11"`
+	Clients       []ClientStats `json:"clients" pb:"12"`
+	ClientNum     int64         `json:"client_num" pb:"13"`
+	Paused        bool          `json:"paused" pb:"14"`
+	Skipped       bool          `json:"skipped" pb:"15"`
+	Ephemeral     bool          `json:"ephemeral" pb:"16"`
+	Registered    bool          `json:"registered" pb:"17"`
+
+	// the server side req backoff config, empty if disabled
+	ReqBackoffBase       string `json:"req_backoff_base,omitempty" pb:"18"`
+	ReqBackoffMax        string `json:"req_backoff_max,omitempty" pb:"19"`
+	BackoffDeferredCount int64  `json:"backoff_deferred_count" pb:"20"`
+	// the delivery window and whether the delivery is held outside the window
+	DeliveryWindow string `json:"delivery_window,omitempty" pb:"21"`
+	DeliveryHeld   bool   `json:"delivery_held" pb:"22"`
+
+	// the count of the closed client connections by the disconnect reason
+	DisconnectReasons map[string]int64 `json:"disconnect_reasons,omitempty" pb:"23"`
+	// the rolling compliance of the channel slo
+	SLO *ChannelSLOStats `json:"slo,omitempty"`
+	// the replay messages delivered and deferred by the replay rate, and the
+	// deferred replay messages waiting to retry currently
+	ReplayRate      int64 `json:"replay_rate" pb:"24"`
+	ReplayDelivered int64 `json:"replay_delivered" pb:"25"`
+	ReplayDeferred  int64 `json:"replay_deferred" pb:"26"`
+	ReplayWaiting   int64 `json:"replay_waiting" pb:"35"`
+	// the snapshot state of the compacted channel
+	Compact *ChannelCompactStats `json:"compact,omitempty"`
+	// the unix time the paused channel will be resumed and the reason of the pause
+	PausedUntil  int64  `json:"paused_until,omitempty" pb:"27"`
+	PausedReason string `json:"paused_reason,omitempty" pb:"28"`
+
+	DelayedQueueCount  uint64 `json:"delayed_queue_count" pb:"29"`
+	DelayedQueueRecent string `json:"delayed_queue_recent" pb:"30"`
+	// the total count of the in-flight messages released the body from memory
+	InFlightSpilledCount uint64 `json:"inflight_spilled_count" pb:"31"`
 
 	E2eProcessingLatency    *quantile.Result `json:"e2e_processing_latency"`
-	MsgConsumeLatencyStats  []int64          `json:"msg_consume_latency_stats"`
-	MsgDeliveryLatencyStats []int64          `json:"msg_delivery_latency_stats"`
+	MsgConsumeLatencyStats  []int64          `json:"msg_consume_latency_stats" pb:"32"`
+	MsgDeliveryLatencyStats []int64          `json:"msg_delivery_latency_stats" pb:"33"`
+
+	// the blocking message and the stuck flag of the ordered channel, nil if not ordered
+	Ordered *OrderedConsumeStats `json:"ordered,omitempty" pb:"34"`
 }
 
+// NewChannelStats reads the counters and the snapshots of the channel without
+// the delivery locks, so the stats will not block the consumers. The delayed
+// counts are read from the read transaction of the delayed queue.
 func NewChannelStats(c *Channel, clients []ClientStats, clientNum int) ChannelStats {
-	c.inFlightMutex.Lock()
-	inflightCnt := len(c.inFlightMessages)
-	c.inFlightMutex.Unlock()
+	inflightCnt := c.GetInFlightCount()
 	recentList, _, chCntList := c.GetDelayedQueueConsumedState()
 	var recentTs int64
 	if len(recentList) > 0 {
@@ -115,6 +202,17 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientNum int) ChannelSt
 	if len(chCntList) > 0 {
 		dqCnt, _ = chCntList[c.GetName()]
 	}
+	var backoffBase, backoffMax string
+	if base, max := c.GetReqBackoff(); base > 0 {
+		backoffBase = base.String()
+		backoffMax = max.String()
+	}
+	var deliveryWindow string
+	if w := c.GetDeliveryWindow(); w != nil {
+		deliveryWindow = w.String()
+	}
+	replayDelivered, replayDeferred := c.GetReplayStats()
+	pausedUntil, pausedReason := c.getPausedMeta()
 	return ChannelStats{
 		ChannelName:    c.name,
 		Depth:          c.Depth(),
@@ -125,7 +223,7 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientNum int) ChannelSt
 		InFlightCount: inflightCnt,
 		// this is total message count need consume.
 		// may diff with topic total size since some is in buffer.
-		MessageCount:       uint64(c.backend.GetQueueReadEnd().TotalMsgCnt()),
+		MessageCount:       c.GetQueueEndMsgCnt(),
 		RequeueCount:       atomic.LoadUint64(&c.requeueCount),
 		DeferredCount:      int(atomic.LoadInt64(&c.deferredCount)),
 		TimeoutCount:       atomic.LoadUint64(&c.timeoutCount),
@@ -133,55 +231,93 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientNum int) ChannelSt
 		ClientNum:          int64(clientNum),
 		Paused:             c.IsPaused(),
 		Skipped:            c.IsSkipped(),
+		Ephemeral:          c.IsEphemeral(),
+		Registered:         c.IsRegistered(),
+		ReqBackoffBase:     backoffBase,
+		ReqBackoffMax:      backoffMax,
 		DelayedQueueCount:  dqCnt,
 		DelayedQueueRecent: time.Unix(0, recentTs).String(),
 
+		InFlightSpilledCount: atomic.LoadUint64(&c.spilledCount),
+		BackoffDeferredCount: atomic.LoadInt64(&c.backoffDeferredCount),
+		DeliveryWindow:       deliveryWindow,
+		DeliveryHeld:         !c.IsInDeliveryWindow(time.Now()),
+		DisconnectReasons:    c.GetDisconnectReasons(),
+		SLO:                  c.GetSLOStats(time.Now()),
+		ReplayRate:           c.GetReplayRate(),
+		ReplayDelivered:      replayDelivered,
+		ReplayDeferred:       replayDeferred,
+		ReplayWaiting:        c.GetReplayWaiting(),
+		Compact:              c.GetCompactStats(),
+		PausedUntil:          pausedUntil,
+		PausedReason:         pausedReason,
+
 		E2eProcessingLatency:    c.e2eProcessingLatencyStream.Result(),
 		MsgConsumeLatencyStats:  c.channelStatsInfo.GetChannelLatencyStats(),
 		MsgDeliveryLatencyStats: c.channelStatsInfo.GetDeliveryLatencyStats(),
+		Ordered:                 c.GetOrderedStats(),
 	}
 }
 
 type ClientPubStats struct {
-	RemoteAddress string `json:"remote_address"`
-	UserAgent     string `json:"user_agent"`
-	Protocol      string `json:"protocol"`
-	PubCount      int64  `json:"pub_count"`
-	ErrCount      int64  `json:"err_count"`
-	LastPubTs     int64  `json:"last_pub_ts"`
+	RemoteAddress string `json:"remote_address" pb:"1"`
+	UserAgent     string `json:"user_agent" pb:"2"`
+	Identity      string `json:"identity,omitempty" pb:"3"`
+	Protocol      string `json:"protocol" pb:"4"`
+	PubCount      int64  `json:"pub_count" pb:"5"`
+	ErrCount      int64  `json:"err_count" pb:"6"`
+	LastPubTs     int64  `json:"last_pub_ts" pb:"7"`
+}
+
+type pubStatsEntry struct {
+	key      string
+	updateTs int64
+	stats    ClientPubStats
 }
 
 type ClientStats struct {
 	// TODO: deprecated, remove in 1.0
-	Name string `json:"name"`
-
-	ClientID        string `json:"client_id"`
-	Hostname        string `json:"hostname"`
-	Version         string `json:"version"`
-	RemoteAddress   string `json:"remote_address"`
-	State           int32  `json:"state"`
-	ReadyCount      int64  `json:"ready_count"`
-	InFlightCount   int64  `json:"in_flight_count"`
-	MessageCount    uint64 `json:"message_count"`
-	FinishCount     uint64 `json:"finish_count"`
-	RequeueCount    uint64 `json:"requeue_count"`
-	TimeoutCount    int64  `json:"timeout_count"`
-	DeferredCount   int64  `json:"deferred_count"`
-	ConnectTime     int64  `json:"connect_ts"`
-	SampleRate      int32  `json:"sample_rate"`
-	Deflate         bool   `json:"deflate"`
-	Snappy          bool   `json:"snappy"`
-	UserAgent       string `json:"user_agent"`
-	Authed          bool   `json:"authed,omitempty"`
-	AuthIdentity    string `json:"auth_identity,omitempty"`
-	AuthIdentityURL string `json:"auth_identity_url,omitempty"`
-	DesiredTag      string `json:"desired_tag"`
-
-	TLS                           bool   `json:"tls"`
-	CipherSuite                   string `json:"tls_cipher_suite"`
-	TLSVersion                    string `json:"tls_version"`
-	TLSNegotiatedProtocol         string `json:"tls_negotiated_protocol"`
-	TLSNegotiatedProtocolIsMutual bool   `json:"tls_negotiated_protocol_is_mutual"`
+	Name string `json:"name" pb:"1"`
+
+	ClientID        string `json:"client_id" pb:"2"`
+	Hostname        string `json:"hostname" pb:"3"`
+	Version         string `json:"version" pb:"4"`
+	RemoteAddress   string `json:"remote_address" pb:"5"`
+	State           int32  `json:"state" pb:"6"`
+	ReadyCount      int64  `json:"ready_count" pb:"7"`
+	InFlightCount   int64  `json:"in_flight_count" pb:"8"`
+	MessageCount    uint64 `json:"message_count" pb:"9"`
+	FinishCount     uint64 `json:"finish_count" pb:"10"`
+	RequeueCount    uint64 `json:"requeue_count" pb:"11"`
+	TimeoutCount    int64  `json:"timeout_count" pb:"12"`
+	DeferredCount   int64  `json:"deferred_count" pb:"13"`
+	ConnectTime     int64  `json:"connect_ts" pb:"14"`
+	SampleRate      int32  `json:"sample_rate" pb:"15"`
+	Deflate         bool   `json:"deflate" pb:"16"`
+	Snappy          bool   `json:"snappy" pb:"17"`
+	UserAgent       string `json:"user_agent" pb:"18"`
+	Authed          bool   `json:"authed,omitempty" pb:"19"`
+	AuthIdentity    string `json:"auth_identity,omitempty" pb:"20"`
+	AuthIdentityURL string `json:"auth_identity_url,omitempty" pb:"21"`
+	DesiredTag      string `json:"desired_tag" pb:"22"`
+
+	// the round-trip time (in microseconds) of the last responded heartbeat and
+	// the count of the heartbeats not responded before the next heartbeat
+	HeartbeatRTT      int64 `json:"heartbeat_rtt_us" pb:"23"`
+	MissedHeartbeats  int64 `json:"missed_heartbeats" pb:"24"`
+	LastHeartbeatTime int64 `json:"last_heartbeat_ts" pb:"25"`
+
+	// the tcp options applied to the connection, the buffer size is 0 if using the system default
+	TCPNoDelay         bool  `json:"tcp_no_delay" pb:"26"`
+	TCPSendBufferSize  int   `json:"tcp_send_buffer_size" pb:"27"`
+	TCPRecvBufferSize  int   `json:"tcp_recv_buffer_size" pb:"28"`
+	TCPKeepAlivePeriod int64 `json:"tcp_keepalive_period" pb:"29"`
+
+	TLS                           bool   `json:"tls" pb:"30"`
+	CipherSuite                   string `json:"tls_cipher_suite" pb:"31"`
+	TLSVersion                    string `json:"tls_version" pb:"32"`
+	TLSNegotiatedProtocol         string `json:"tls_negotiated_protocol" pb:"33"`
+	TLSNegotiatedProtocolIsMutual bool   `json:"tls_negotiated_protocol_is_mutual" pb:"34"`
 }
 
 type Topics []*Topic
@@ -210,17 +346,17 @@ type ChannelsByName struct {
 func (c ChannelsByName) Less(i, j int) bool { return c.Channels[i].name < c.Channels[j].name }
 
 func (n *NSQD) GetStats(leaderOnly bool, filterClients bool) []TopicStats {
-	n.RLock()
-	realTopics := make([]*Topic, 0, len(n.topicMap))
-	for _, topicParts := range n.topicMap {
-		for _, t := range topicParts {
-			if leaderOnly && t.IsWriteDisabled() {
-				continue
-			}
-			realTopics = append(realTopics, t)
+	allTopics := n.getTopicsSnapshot()
+	realTopics := make([]*Topic, 0, len(allTopics))
+	for _, t := range allTopics {
+		if leaderOnly && t.IsWriteDisabled() {
+			continue
 		}
+		if IsHiddenTopic(t.GetTopicName()) {
+			continue
+		}
+		realTopics = append(realTopics, t)
 	}
-	n.RUnlock()
 
 	return n.getTopicStats(realTopics, filterClients)
 }
@@ -229,49 +365,40 @@ func (n *NSQD) getTopicStats(realTopics []*Topic, filterClients bool) []TopicSta
 	sort.Sort(TopicsByName{realTopics})
 	topics := make([]TopicStats, 0, len(realTopics))
 	for _, t := range realTopics {
-		t.channelLock.RLock()
-		realChannels := make([]*Channel, 0, len(t.channelMap))
-		for _, c := range t.channelMap {
-			realChannels = append(realChannels, c)
-		}
-		t.channelLock.RUnlock()
+		// the snapshot should not be modified, so we sort the copy
+		realChannels := append([]*Channel(nil), t.GetChannelsSnapshot()...)
 		sort.Sort(ChannelsByName{realChannels})
 		channels := make([]ChannelStats, 0, len(realChannels))
 		for _, c := range realChannels {
 			var clients []ClientStats
-			c.RLock()
-			clientNum := len(c.clients)
-			if filterClients {
-				clients = nil
-			} else {
-				clients = make([]ClientStats, 0, len(c.clients))
-				for _, client := range c.clients {
+			chClients := c.GetClientsSnapshot()
+			clientNum := len(chClients)
+			if !filterClients {
+				clients = make([]ClientStats, 0, len(chClients))
+				for _, client := range chClients {
 					clients = append(clients, client.Stats())
 				}
 			}
-			c.RUnlock()
 			channels = append(channels, NewChannelStats(c, clients, clientNum))
 		}
-		topics = append(topics, NewTopicStats(t, channels, filterClients))
+		ts := NewTopicStats(t, channels, filterClients)
+		ts.ACLDenied = n.GetACLDeniedStats(t.GetTopicName())
+		topics = append(topics, ts)
 	}
 	return topics
 }
 
 func (n *NSQD) GetTopicStatsWithFilter(leaderOnly bool, topic string, filterClients bool) []TopicStats {
-	n.RLock()
-	realTopics := make([]*Topic, 0, len(n.topicMap))
-	for name, topicParts := range n.topicMap {
-		if name != topic {
+	realTopics := make([]*Topic, 0)
+	for _, t := range n.getTopicsSnapshot() {
+		if t.GetTopicName() != topic {
 			continue
 		}
-		for _, t := range topicParts {
-			if leaderOnly && t.IsWriteDisabled() {
-				continue
-			}
-			realTopics = append(realTopics, t)
+		if leaderOnly && t.IsWriteDisabled() {
+			continue
 		}
+		realTopics = append(realTopics, t)
 	}
-	n.RUnlock()
 	return n.getTopicStats(realTopics, filterClients)
 }
 
@@ -279,12 +406,85 @@ func (n *NSQD) GetTopicStats(leaderOnly bool, topic string) []TopicStats {
 	return n.GetTopicStatsWithFilter(leaderOnly, topic, false)
 }
 
+// ChannelScalingSignal is the compact channel metrics used by the consumer autoscaling
+type ChannelScalingSignal struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Channel   string `json:"channel"`
+	Depth     int64  `json:"depth"`
+	// the depth change per second in the trend window, 0 if the depth history is disabled
+	DepthTrend float64 `json:"depth_trend"`
+	// the age in seconds of the next message waiting to be delivered, 0 if no depth
+	OldestMsgAge int64 `json:"oldest_msg_age"`
+	Consumers    int   `json:"consumers"`
+}
+
+func NewChannelScalingSignal(c *Channel, now time.Time, trendWindow time.Duration) ChannelScalingSignal {
+	signal := ChannelScalingSignal{
+		Topic:     c.GetTopicName(),
+		Partition: c.GetTopicPart(),
+		Channel:   c.GetName(),
+		Depth:     c.Depth(),
+		Consumers: len(c.GetClientsSnapshot()),
+	}
+	sample, ok := c.GetDepthAt(now.Add(-1 * trendWindow).Unix())
+	if !ok {
+		// the history is not long enough, use the oldest sample
+		if samples := c.GetDepthHistory(0); len(samples) > 0 {
+			sample, ok = samples[0], true
+		}
+	}
+	if ok && sample.Ts < now.Unix() {
+		signal.DepthTrend = float64(signal.Depth-sample.Depth) / float64(now.Unix()-sample.Ts)
+	}
+	if ts := c.DepthTimestamp(); signal.Depth > 0 && ts > 0 && now.UnixNano() > ts {
+		signal.OldestMsgAge = int64(now.Sub(time.Unix(0, ts)) / time.Second)
+	}
+	return signal
+}
+
+// GetScalingSignals returns the scaling signals of the leader channels, filtered by the
+// topic and channel if not empty.
+func (n *NSQD) GetScalingSignals(topic string, channel string, trendWindow time.Duration) []ChannelScalingSignal {
+	now := time.Now()
+	realTopics := make([]*Topic, 0)
+	for _, t := range n.getTopicsSnapshot() {
+		if topic != "" && t.GetTopicName() != topic {
+			continue
+		}
+		if t.IsWriteDisabled() {
+			continue
+		}
+		realTopics = append(realTopics, t)
+	}
+	sort.Sort(TopicsByName{realTopics})
+	signals := make([]ChannelScalingSignal, 0, len(realTopics))
+	for _, t := range realTopics {
+		realChannels := append([]*Channel(nil), t.GetChannelsSnapshot()...)
+		sort.Sort(ChannelsByName{realChannels})
+		for _, c := range realChannels {
+			if channel != "" && c.GetName() != channel {
+				continue
+			}
+			signals = append(signals, NewChannelScalingSignal(c, now, trendWindow))
+		}
+	}
+	return signals
+}
+
 type DetailStatsInfo struct {
 	sync.Mutex
 	historyStatsInfo *TopicHistoryStatsInfo
 	msgStats         *TopicMsgStatsInfo
 	writeErrCnt      int64
-	clientPubStats   map[string]*ClientPubStats
+	// the client pub stats in lru list, the front is the most recently updated
+	clientPubStats  map[string]*list.Element
+	pubStatsLRU     *list.List
+	pubStatsByIdent bool
+	maxPubStats     int
+	pubStatsTTL     time.Duration
+	pubStatsEvicted int64
+	pubStatsExpired int64
 }
 
 func NewDetailStatsInfo(initPubSize int64, historyPath string) *DetailStatsInfo {
@@ -292,12 +492,28 @@ func NewDetailStatsInfo(initPubSize int64, historyPath string) *DetailStatsInfo
 		historyStatsInfo: &TopicHistoryStatsInfo{lastHour: int32(time.Now().Hour()),
 			lastPubSize: initPubSize},
 		msgStats:       &TopicMsgStatsInfo{},
-		clientPubStats: make(map[string]*ClientPubStats),
+		clientPubStats: make(map[string]*list.Element),
+		pubStatsLRU:    list.New(),
+		maxPubStats:    1000,
+		pubStatsTTL:    time.Hour,
 	}
 	d.LoadHistory(historyPath)
 	return d
 }
 
+func (self *DetailStatsInfo) SetPubStatsOptions(aggregateKey string, maxNum int, ttl time.Duration) {
+	self.Lock()
+	defer self.Unlock()
+	self.pubStatsByIdent = aggregateKey == PubStatsKeyIdentity
+	if maxNum > 0 {
+		self.maxPubStats = maxNum
+	}
+	self.pubStatsTTL = ttl
+	// the limit may be decreased, so we evict the stats over the limit now
+	self.evictPubStatsNoLock(self.maxPubStats)
+	self.expirePubStatsNoLock(time.Now().UnixNano())
+}
+
 type TopicMsgStatsInfo struct {
 	// <100bytes, <1KB, 2KB, 4KB, 8KB, 16KB, 32KB, 64KB, 128KB, 256KB, 512KB, 1MB, 2MB, 4MB
 	MsgSizeStats [16]int64
@@ -311,6 +527,73 @@ type ChannelStatsInfo struct {
 	MsgDeliveryLatencyStats [12]int64
 }
 
+type DepthSample struct {
+	Ts        int64 `json:"ts"`
+	Depth     int64 `json:"depth"`
+	DepthSize int64 `json:"depth_size"`
+}
+
+// ChannelDepthHistory keeps the recent depth samples of the channel in a ring buffer,
+// the buffer grows while sampling until the max size, so the channels created
+// recently will not allocate the whole retention.
+type ChannelDepthHistory struct {
+	sync.Mutex
+	samples []DepthSample
+	maxSize int
+	next    int
+}
+
+func NewChannelDepthHistory(size int) *ChannelDepthHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &ChannelDepthHistory{
+		maxSize: size,
+	}
+}
+
+func (self *ChannelDepthHistory) Add(s DepthSample) {
+	self.Lock()
+	if len(self.samples) < self.maxSize {
+		self.samples = append(self.samples, s)
+	} else {
+		self.samples[self.next] = s
+		self.next++
+		if self.next >= len(self.samples) {
+			self.next = 0
+		}
+	}
+	self.Unlock()
+}
+
+// Samples returns the samples since the given time in order
+func (self *ChannelDepthHistory) Samples(since int64) []DepthSample {
+	self.Lock()
+	defer self.Unlock()
+	var ordered []DepthSample
+	ordered = append(ordered, self.samples[self.next:]...)
+	ordered = append(ordered, self.samples[:self.next]...)
+	ret := make([]DepthSample, 0, len(ordered))
+	for _, s := range ordered {
+		if s.Ts >= since {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// DepthAt returns the latest sample not after the given time, return false if
+// the time is earlier than all the samples.
+func (self *ChannelDepthHistory) DepthAt(ts int64) (DepthSample, bool) {
+	samples := self.Samples(0)
+	for i := len(samples) - 1; i >= 0; i-- {
+		if samples[i].Ts <= ts {
+			return samples[i], true
+		}
+	}
+	return DepthSample{}, false
+}
+
 type TopicHistoryStatsInfo struct {
 	lastHour      int32
 	lastPubSize   int64
@@ -444,63 +727,120 @@ func (self *DetailStatsInfo) UpdateTopicMsgStats(msgSize int64, latency int64) {
 	}
 }
 
-func (self *DetailStatsInfo) UpdatePubClientStats(remote string, agent string, protocol string, count int64, hasErr bool) {
-	self.Lock()
-	defer self.Unlock()
-	s, ok := self.clientPubStats[remote]
-	if !ok {
-		// too much clients pub to this topic
-		// we just ignore stats
-		if len(self.clientPubStats) > 1000 {
-			scanStart := time.Now()
-			scanCnt := 0
-			cleanCnt := 0
-			for _, s := range self.clientPubStats {
-				scanCnt++
-				if time.Since(scanStart) > time.Millisecond*200 {
-					break
-				}
-				if time.Now().Unix()-s.LastPubTs > 60*60 {
-					delete(self.clientPubStats, s.RemoteAddress)
-					cleanCnt++
-				}
-			}
-			nsqLog.Logf("clean pub stats cost %v, scan: %v, clean:%v, left: %v", time.Since(scanStart),
-				scanCnt, cleanCnt, len(self.clientPubStats))
+func (self *DetailStatsInfo) removePubStatsElemNoLock(e *list.Element) {
+	entry := self.pubStatsLRU.Remove(e).(*pubStatsEntry)
+	delete(self.clientPubStats, entry.key)
+}
+
+// remove the stats not updated in ttl from the back of the lru list
+func (self *DetailStatsInfo) expirePubStatsNoLock(now int64) {
+	if self.pubStatsTTL <= 0 {
+		return
+	}
+	for {
+		e := self.pubStatsLRU.Back()
+		if e == nil {
+			return
+		}
+		if now-e.Value.(*pubStatsEntry).updateTs <= int64(self.pubStatsTTL) {
 			return
 		}
-		s = &ClientPubStats{
-			RemoteAddress: remote,
-			UserAgent:     agent,
-			Protocol:      protocol,
+		self.removePubStatsElemNoLock(e)
+		self.pubStatsExpired++
+	}
+}
+
+// remove the least recently updated stats until the stats number is not more than the limit
+func (self *DetailStatsInfo) evictPubStatsNoLock(limit int) {
+	for len(self.clientPubStats) > limit && self.pubStatsLRU.Len() > 0 {
+		self.removePubStatsElemNoLock(self.pubStatsLRU.Back())
+		self.pubStatsEvicted++
+		if self.pubStatsEvicted%1000 == 1 {
+			statsLog.InfoKV("client pub stats evicted since too much clients",
+				"clients", len(self.clientPubStats), "total_evicted", self.pubStatsEvicted)
+		}
+	}
+}
+
+// GCPubClientStats removes the expired client pub stats, so the stale stats
+// will not be kept in memory if no new client or nobody query the stats.
+func (self *DetailStatsInfo) GCPubClientStats(now time.Time) {
+	self.Lock()
+	self.expirePubStatsNoLock(now.UnixNano())
+	self.Unlock()
+}
+
+// UpdatePubClientStats aggregates the pub stats by the remote address or by the user agent and
+// the identity, the least recently updated stats will be evicted if too much clients.
+func (self *DetailStatsInfo) UpdatePubClientStats(remote string, agent string, identity string, protocol string, count int64, hasErr bool) {
+	now := time.Now()
+	self.Lock()
+	defer self.Unlock()
+	key := remote
+	if self.pubStatsByIdent {
+		key = protocol + ":" + agent + ":" + identity
+	}
+	var entry *pubStatsEntry
+	e, ok := self.clientPubStats[key]
+	if ok {
+		entry = e.Value.(*pubStatsEntry)
+		self.pubStatsLRU.MoveToFront(e)
+	} else {
+		self.expirePubStatsNoLock(now.UnixNano())
+		self.evictPubStatsNoLock(self.maxPubStats - 1)
+		entry = &pubStatsEntry{
+			key: key,
+			stats: ClientPubStats{
+				UserAgent: agent,
+				Identity:  identity,
+				Protocol:  protocol,
+			},
 		}
-		self.clientPubStats[remote] = s
+		self.clientPubStats[key] = self.pubStatsLRU.PushFront(entry)
 	}
+	entry.updateTs = now.UnixNano()
+	// the latest remote address for the aggregated stats
+	entry.stats.RemoteAddress = remote
 
 	if hasErr {
-		s.ErrCount++
+		entry.stats.ErrCount++
 	} else {
-		s.PubCount += count
-		s.LastPubTs = time.Now().Unix()
+		entry.stats.PubCount += count
+		entry.stats.LastPubTs = now.Unix()
 	}
 }
 
+// RemovePubStats removes the stats for the closed client, the stats aggregated by identity
+// is shared by the clients so it will be kept until expired or evicted.
 func (self *DetailStatsInfo) RemovePubStats(remote string, protocol string) {
 	self.Lock()
-	delete(self.clientPubStats, remote)
+	if !self.pubStatsByIdent {
+		if e, ok := self.clientPubStats[remote]; ok {
+			self.removePubStatsElemNoLock(e)
+		}
+	}
 	self.Unlock()
 }
 
 func (self *DetailStatsInfo) GetPubClientStats() []ClientPubStats {
 	self.Lock()
+	self.expirePubStatsNoLock(time.Now().UnixNano())
 	stats := make([]ClientPubStats, 0, len(self.clientPubStats))
-	for _, s := range self.clientPubStats {
-		stats = append(stats, *s)
+	for e := self.pubStatsLRU.Front(); e != nil; e = e.Next() {
+		stats = append(stats, e.Value.(*pubStatsEntry).stats)
 	}
 	self.Unlock()
 	return stats
 }
 
+// GetPubStatsEvicted returns the count of the client pub stats evicted by the size limit
+// and expired by the ttl.
+func (self *DetailStatsInfo) GetPubStatsEvicted() (int64, int64) {
+	self.Lock()
+	defer self.Unlock()
+	return self.pubStatsEvicted, self.pubStatsExpired
+}
+
 func (self *DetailStatsInfo) GetHourlyStats() [24]int64 {
 	return self.historyStatsInfo.HourlyPubSize
 }
@@ -520,7 +860,7 @@ func (self *DetailStatsInfo) GetMsgWriteLatencyStats() []int64 {
 
 func (self *DetailStatsInfo) UpdateHistory(historyList [24]int64) {
 	if len(historyList) != len(self.historyStatsInfo.HourlyPubSize) {
-		nsqLog.LogErrorf("failed to update history stats with wrong list size: %v", len(historyList))
+		statsLog.LogErrorf("failed to update history stats with wrong list size: %v", len(historyList))
 		return
 	}
 	copy(self.historyStatsInfo.HourlyPubSize[:], historyList[:])
@@ -530,14 +870,14 @@ func (self *DetailStatsInfo) LoadHistory(fileName string) error {
 	data, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			nsqLog.LogErrorf("failed to read history stats from %s - %s", fileName, err)
+			statsLog.LogErrorf("failed to read history stats from %s - %s", fileName, err)
 		}
 		return err
 	}
 	var historyStat TopicHistoryStatsInfo
 	err = json.Unmarshal(data, &historyStat)
 	if err != nil {
-		nsqLog.Warningf("load history stats failed: %v", err)
+		statsLog.Warningf("load history stats failed: %v", err)
 		return err
 	}
 	self.historyStatsInfo.HourlyPubSize = historyStat.HourlyPubSize
@@ -545,22 +885,22 @@ func (self *DetailStatsInfo) LoadHistory(fileName string) error {
 }
 
 func (self *DetailStatsInfo) SaveHistory(fileName string) error {
-	nsqLog.LogDebugf("persisting history stats to %s", fileName)
+	statsLog.LogDebugf("persisting history stats to %s", fileName)
 	data, err := json.Marshal(self.historyStatsInfo)
 	if err != nil {
-		nsqLog.LogWarningf("failed to save history stats: %v", err)
+		statsLog.LogWarningf("failed to save history stats: %v", err)
 		return err
 	}
 	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
 	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		nsqLog.LogWarningf("failed to save history stats: %v", err)
+		statsLog.LogWarningf("failed to save history stats: %v", err)
 		return err
 	}
 	_, err = f.Write(data)
 	if err != nil {
 		f.Close()
-		nsqLog.LogWarningf("failed to save history stats: %v", err)
+		statsLog.LogWarningf("failed to save history stats: %v", err)
 		return err
 	}
 	f.Sync()
@@ -568,7 +908,7 @@ func (self *DetailStatsInfo) SaveHistory(fileName string) error {
 
 	err = util.AtomicRename(tmpFileName, fileName)
 	if err != nil {
-		nsqLog.LogWarningf("failed to save history stats: %v", err)
+		statsLog.LogWarningf("failed to save history stats: %v", err)
 	}
 	return err
 }
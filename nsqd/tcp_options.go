@@ -0,0 +1,76 @@
+package nsqd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TCPOptions is the socket options for the client connections accepted by the
+// listener, the zero buffer size and keepalive period means the system default
+// and the keepalive is disabled if the period is negative.
+type TCPOptions struct {
+	NoDelay         bool
+	SendBufferSize  int
+	RecvBufferSize  int
+	KeepAlivePeriod time.Duration
+}
+
+// TCPListenerConf is the extra tcp listener with the own tcp options
+type TCPListenerConf struct {
+	Address string
+	TCPOptions
+}
+
+func (o *Options) DefaultTCPOptions() TCPOptions {
+	return TCPOptions{
+		NoDelay:         o.TCPNoDelay,
+		SendBufferSize:  o.TCPSendBufferSize,
+		RecvBufferSize:  o.TCPRecvBufferSize,
+		KeepAlivePeriod: o.TCPKeepAlivePeriod,
+	}
+}
+
+// ParseTCPListener parses the listener such as
+// "0.0.0.0:4250,tcp_no_delay=false,tcp_send_buffer_size=4194304,tcp_keepalive_period=30s",
+// the options not given are the same as the default listener.
+func ParseTCPListener(s string, opts *Options) (*TCPListenerConf, error) {
+	parts := strings.Split(s, ",")
+	conf := &TCPListenerConf{
+		Address:    strings.TrimSpace(parts[0]),
+		TCPOptions: opts.DefaultTCPOptions(),
+	}
+	if conf.Address == "" {
+		return nil, fmt.Errorf("tcp listener %v has no address", s)
+	}
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid tcp listener option %v", p)
+		}
+		var err error
+		switch kv[0] {
+		case "tcp_no_delay":
+			conf.NoDelay, err = strconv.ParseBool(kv[1])
+		case "tcp_send_buffer_size":
+			conf.SendBufferSize, err = strconv.Atoi(kv[1])
+			if err == nil && (conf.SendBufferSize < 0 || conf.SendBufferSize > opts.MaxTCPBufferSize) {
+				err = fmt.Errorf("should be between 0 and %v", opts.MaxTCPBufferSize)
+			}
+		case "tcp_recv_buffer_size":
+			conf.RecvBufferSize, err = strconv.Atoi(kv[1])
+			if err == nil && (conf.RecvBufferSize < 0 || conf.RecvBufferSize > opts.MaxTCPBufferSize) {
+				err = fmt.Errorf("should be between 0 and %v", opts.MaxTCPBufferSize)
+			}
+		case "tcp_keepalive_period":
+			conf.KeepAlivePeriod, err = time.ParseDuration(kv[1])
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid tcp listener option %v: %v", p, err)
+		}
+	}
+	return conf, nil
+}
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
+	"reflect"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -24,6 +26,7 @@ import (
 const (
 	MAX_TOPIC_PARTITION    = 1023
 	HISTORY_STAT_FILE_NAME = ".stat.history.dat"
+	TOPIC_POLICY_FILE_NAME = ".topic.policy.dat"
 	pubQueue               = 500
 )
 
@@ -67,6 +70,9 @@ type TopicDynamicConf struct {
 	SyncEvery    int64
 	OrderedMulti bool
 	Ext          bool
+	// the replication meta configured in cluster, only used for stats
+	PartitionNum int
+	Replica      int
 }
 
 type PubInfo struct {
@@ -80,9 +86,59 @@ type PubInfo struct {
 type PubInfoChan chan *PubInfo
 
 type ChannelMetaInfo struct {
-	Name    string `json:"name"`
-	Paused  bool   `json:"paused"`
-	Skipped bool   `json:"skipped"`
+	Name       string `json:"name"`
+	Paused     bool   `json:"paused"`
+	Skipped    bool   `json:"skipped"`
+	Registered bool   `json:"registered,omitempty"`
+	// the server side backoff for REQ without timeout
+	ReqBackoffBase time.Duration `json:"req_backoff_base,omitempty"`
+	ReqBackoffMax  time.Duration `json:"req_backoff_max,omitempty"`
+	// the time of day the messages can be delivered
+	DeliveryWindow *DeliveryWindow `json:"delivery_window,omitempty"`
+	// the target of the finished messages within the latency
+	SLO *ChannelSLO `json:"slo,omitempty"`
+	// the max replay messages delivered per second
+	ReplayRate int64 `json:"replay_rate,omitempty"`
+	// deliver the latest value per key first then follow the new updates
+	Compacted bool `json:"compacted,omitempty"`
+	// the unix time to resume the paused channel and the reason of the pause
+	PausedUntil  int64  `json:"paused_until,omitempty"`
+	PausedReason string `json:"paused_reason,omitempty"`
+}
+
+// the local policy for the topic partition which is not in the cluster meta
+type topicPolicy struct {
+	DisableChannelAutoCreate bool `json:"disable_channel_auto_create"`
+	// the client pub stats retention, use the default in options if 0
+	MaxPubClientStats int           `json:"max_pub_client_stats,omitempty"`
+	PubClientStatsTTL time.Duration `json:"pub_client_stats_ttl,omitempty"`
+	// the remote mirror and the position shipped
+	Mirror       *TopicMirrorConf `json:"mirror,omitempty"`
+	MirrorOffset int64            `json:"mirror_offset,omitempty"`
+	MirrorCnt    int64            `json:"mirror_cnt,omitempty"`
+	// upload the consumed segments to the archive store before cleaned
+	Archive bool `json:"archive,omitempty"`
+	// the dedup of the publish by the message key
+	Dedup *TopicDedupConf `json:"dedup,omitempty"`
+	// the alert threshold of the write latency percentile
+	WriteLatencySLO *TopicLatencySLO `json:"write_latency_slo,omitempty"`
+	// the config overridden at runtime
+	RuntimeConf *TopicRuntimeConf `json:"runtime_conf,omitempty"`
+	// the channel slo is saved in the channel meta, it is only here to be synced
+	// to the replicas and ignored while loading.
+	ChannelSLOs map[string]*ChannelSLO `json:"channel_slos,omitempty"`
+	// the same as the channel slo, only the channels not in default are here
+	Channels map[string]*channelPolicy `json:"channels,omitempty"`
+}
+
+// channelPolicy is the channel settings changed by the api on the leader
+type channelPolicy struct {
+	Registered     bool            `json:"registered,omitempty"`
+	ReqBackoffBase time.Duration   `json:"req_backoff_base,omitempty"`
+	ReqBackoffMax  time.Duration   `json:"req_backoff_max,omitempty"`
+	DeliveryWindow *DeliveryWindow `json:"delivery_window,omitempty"`
+	ReplayRate     int64           `json:"replay_rate,omitempty"`
+	Compacted      bool            `json:"compacted,omitempty"`
 }
 
 type Topic struct {
@@ -116,6 +172,7 @@ type Topic struct {
 	magicCode       int64
 	committedOffset atomic.Value
 	detailStats     *DetailStatsInfo
+	dedupIndex      *DedupIndex
 	needFixData     int32
 	pubWaitingChan  PubInfoChan
 	quitChan        chan struct{}
@@ -125,6 +182,31 @@ type Topic struct {
 	delayedQueue atomic.Value
 	isExt        int32
 	saveMutex    sync.Mutex
+	// copy of the channels for reading stats without lock
+	channelsSnapshot atomic.Value
+	// the channel should be registered before subscribe if disabled
+	channelAutoCreateDisabled int32
+	maxPubClientStats         int64
+	pubClientStatsTTL         int64
+	replyChannelSeq           int64
+	// the mirror to the remote cluster
+	mirror atomic.Value
+	// the archive of the consumed segments
+	archive atomic.Value
+	// the dedup of the publish by the message key
+	dedupConf     atomic.Value
+	dedupHits     int64
+	dedupRejected int64
+	dedupDropped  int64
+	// the unix time since the disk of the partition degraded, 0 if not
+	diskDegradedSince int64
+	// the write latency slo tracker
+	latencySLO atomic.Value
+	// the publish backpressure by the backlog watermark
+	pubBackpressure pubBackpressure
+	// the config overridden at runtime
+	runtimeConf  atomic.Value
+	lastSyncTime int64
 }
 
 func (t *Topic) setExt() {
@@ -166,6 +248,7 @@ func NewTopicWithExt(topicName string, part int, ext bool, opt *Options,
 		quitChan:       make(chan struct{}),
 		pubLoopFunc:    loopFunc,
 	}
+	t.channelsSnapshot.Store(make([]*Channel, 0))
 	if ext {
 		t.setExt()
 	}
@@ -210,6 +293,12 @@ func NewTopicWithExt(topicName string, part int, ext bool, opt *Options,
 		return nil
 	}
 	t.detailStats = NewDetailStatsInfo(t.TotalDataSize(), t.getHistoryStatsFileName())
+	t.applyPubStatsPolicy()
+	t.dedupIndex = NewDedupIndex(t.getDedupIndexFileName())
+	err = t.dedupIndex.Load(time.Now().UnixNano())
+	if err != nil {
+		nsqLog.LogWarningf("topic %v failed to load dedup index: %v", t.fullName, err)
+	}
 	t.nsqdNotify.NotifyStateChanged(t, true)
 	nsqLog.LogDebugf("new topic created: %v", t.tname)
 
@@ -220,6 +309,10 @@ func NewTopicWithExt(topicName string, part int, ext bool, opt *Options,
 			t.pubLoopFunc(t)
 		}()
 	}
+	err = t.loadTopicPolicy()
+	if err != nil {
+		nsqLog.LogWarningf("topic %v failed to load policy: %v", t.fullName, err)
+	}
 	t.LoadChannelMeta()
 	return t
 }
@@ -354,6 +447,7 @@ func (t *Topic) MarkAsRemoved() (string, error) {
 		delete(t.channelMap, channel.name)
 		channel.Delete()
 	}
+	t.updateChannelsSnapshotNoLock()
 	t.channelLock.Unlock()
 	// we should move our partition only
 	renamePath := t.dataPath + "-removed-" + strconv.Itoa(int(time.Now().Unix()))
@@ -365,7 +459,10 @@ func (t *Topic) MarkAsRemoved() (string, error) {
 	}
 	util.AtomicRename(t.getMagicCodeFileName(), path.Join(renamePath, "magic"+strconv.Itoa(t.partition)))
 	t.removeHistoryStat()
+	t.dedupIndex.Remove()
 	t.RemoveChannelMeta()
+	t.removeTopicPolicy()
+	t.removeArchiveIndex()
 	t.removeMagicCode()
 	if t.GetDelayedQueue() != nil {
 		t.GetDelayedQueue().Delete()
@@ -431,11 +528,28 @@ func (t *Topic) LoadChannelMeta() error {
 
 		if ch.Paused {
 			channel.Pause()
+			var until time.Time
+			if ch.PausedUntil > 0 {
+				until = time.Unix(ch.PausedUntil, 0)
+			}
+			channel.SetPauseInfo(until, ch.PausedReason)
 		}
 
 		if ch.Skipped {
 			channel.Skip()
 		}
+		channel.SetRegistered(ch.Registered)
+		channel.SetReqBackoff(ch.ReqBackoffBase, ch.ReqBackoffMax)
+		if err := channel.SetDeliveryWindow(ch.DeliveryWindow); err != nil {
+			nsqLog.LogWarningf("topic %v channel %v delivery window %v invalid: %v",
+				t.GetFullName(), ch.Name, ch.DeliveryWindow, err)
+		}
+		if err := channel.SetSLO(ch.SLO); err != nil {
+			nsqLog.LogWarningf("topic %v channel %v slo %v invalid: %v",
+				t.GetFullName(), ch.Name, ch.SLO, err)
+		}
+		channel.SetReplayRate(ch.ReplayRate)
+		channel.SetCompacted(ch.Compacted)
 	}
 	return nil
 }
@@ -447,10 +561,17 @@ func (t *Topic) GetChannelMeta() []ChannelMetaInfo {
 		channel.RLock()
 		if !channel.ephemeral {
 			meta := ChannelMetaInfo{
-				Name:    channel.name,
-				Paused:  channel.IsPaused(),
-				Skipped: channel.IsSkipped(),
+				Name:       channel.name,
+				Paused:     channel.IsPaused(),
+				Skipped:    channel.IsSkipped(),
+				Registered: channel.IsRegistered(),
 			}
+			meta.ReqBackoffBase, meta.ReqBackoffMax = channel.GetReqBackoff()
+			meta.DeliveryWindow = channel.GetDeliveryWindow()
+			meta.SLO = channel.GetSLO()
+			meta.ReplayRate = channel.GetReplayRate()
+			meta.Compacted = channel.IsCompacted()
+			meta.PausedUntil, meta.PausedReason = channel.getPausedMeta()
 			channels = append(channels, meta)
 		}
 		channel.RUnlock()
@@ -467,10 +588,17 @@ func (t *Topic) SaveChannelMeta() error {
 		channel.RLock()
 		if !channel.ephemeral {
 			meta := &ChannelMetaInfo{
-				Name:    channel.name,
-				Paused:  channel.IsPaused(),
-				Skipped: channel.IsSkipped(),
+				Name:       channel.name,
+				Paused:     channel.IsPaused(),
+				Skipped:    channel.IsSkipped(),
+				Registered: channel.IsRegistered(),
 			}
+			meta.ReqBackoffBase, meta.ReqBackoffMax = channel.GetReqBackoff()
+			meta.DeliveryWindow = channel.GetDeliveryWindow()
+			meta.SLO = channel.GetSLO()
+			meta.ReplayRate = channel.GetReplayRate()
+			meta.Compacted = channel.IsCompacted()
+			meta.PausedUntil, meta.PausedReason = channel.getPausedMeta()
 			channels = append(channels, meta)
 		}
 		channel.RUnlock()
@@ -509,6 +637,269 @@ func (t *Topic) RemoveChannelMeta() {
 	}
 }
 
+func (t *Topic) getTopicPolicyFileName() string {
+	return path.Join(t.dataPath, t.fullName+TOPIC_POLICY_FILE_NAME)
+}
+
+// IsChannelAutoCreateDisabled returns true if the channel should be registered
+// before the consumer can subscribe to it.
+func (t *Topic) IsChannelAutoCreateDisabled() bool {
+	return atomic.LoadInt32(&t.channelAutoCreateDisabled) == 1
+}
+
+func (t *Topic) SetChannelAutoCreateDisabled(disabled bool) error {
+	if disabled {
+		atomic.StoreInt32(&t.channelAutoCreateDisabled, 1)
+	} else {
+		atomic.StoreInt32(&t.channelAutoCreateDisabled, 0)
+	}
+	nsqLog.Logf("topic %v channel auto create disabled: %v", t.fullName, disabled)
+	return t.saveTopicPolicy()
+}
+
+// RegisterChannel creates the channel if not exist and marks it as registered,
+// so the consumer can subscribe even if the channel auto creation is disabled.
+func (t *Topic) RegisterChannel(channelName string) (*Channel, error) {
+	channel := t.GetChannel(channelName)
+	channel.SetRegistered(true)
+	return channel, t.SaveChannelMeta()
+}
+
+func (t *Topic) UnregisterChannel(channelName string) error {
+	channel, err := t.GetExistingChannel(channelName)
+	if err != nil {
+		return err
+	}
+	channel.SetRegistered(false)
+	return t.SaveChannelMeta()
+}
+
+// CreateReplyChannel creates a new ephemeral channel for the client to receive the reply,
+// the channel will be deleted after the ttl even if it is still in use, and the
+// onExpired will be called after deleted.
+func (t *Topic) CreateReplyChannel(clientID int64, ttl time.Duration, onExpired func(*Channel)) *Channel {
+	channelName := fmt.Sprintf("%s%d.%d#ephemeral", protocol.ReplyChannelPrefix, clientID,
+		atomic.AddInt64(&t.replyChannelSeq, 1))
+	channel := t.GetChannel(channelName)
+	time.AfterFunc(ttl, func() {
+		if channel.Exiting() {
+			return
+		}
+		nsqLog.Logf("topic %v reply channel %v expired after %v", t.GetFullName(), channelName, ttl)
+		channel.DeleteAsync()
+		if onExpired != nil {
+			onExpired(channel)
+		}
+	})
+	return channel
+}
+
+// GetPubStatsPolicy returns the max client pub stats and the ttl of the stats
+// since last updated for this topic.
+func (t *Topic) GetPubStatsPolicy() (int, time.Duration) {
+	maxNum := int(atomic.LoadInt64(&t.maxPubClientStats))
+	if maxNum <= 0 {
+		maxNum = t.option.MaxPubClientStats
+	}
+	ttl := time.Duration(atomic.LoadInt64(&t.pubClientStatsTTL))
+	if ttl <= 0 {
+		ttl = t.option.PubClientStatsTTL
+	}
+	return maxNum, ttl
+}
+
+// SetPubStatsPolicy changes the client pub stats retention for this topic,
+// the default in options will be used if 0 is given.
+func (t *Topic) SetPubStatsPolicy(maxNum int, ttl time.Duration) error {
+	atomic.StoreInt64(&t.maxPubClientStats, int64(maxNum))
+	atomic.StoreInt64(&t.pubClientStatsTTL, int64(ttl))
+	t.applyPubStatsPolicy()
+	nsqLog.Logf("topic %v client pub stats policy changed to max %v, ttl %v", t.fullName, maxNum, ttl)
+	return t.saveTopicPolicy()
+}
+
+func (t *Topic) applyPubStatsPolicy() {
+	maxNum, ttl := t.GetPubStatsPolicy()
+	t.detailStats.SetPubStatsOptions(t.option.PubStatsAggregateKey, maxNum, ttl)
+}
+
+func (t *Topic) loadTopicPolicy() error {
+	data, err := ioutil.ReadFile(t.getTopicPolicyFileName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var policy topicPolicy
+	err = json.Unmarshal(data, &policy)
+	if err != nil {
+		return err
+	}
+	if policy.DisableChannelAutoCreate {
+		atomic.StoreInt32(&t.channelAutoCreateDisabled, 1)
+	}
+	atomic.StoreInt64(&t.maxPubClientStats, int64(policy.MaxPubClientStats))
+	atomic.StoreInt64(&t.pubClientStatsTTL, int64(policy.PubClientStatsTTL))
+	t.applyPubStatsPolicy()
+	t.loadMirrorPolicy(&policy)
+	t.loadArchivePolicy(&policy)
+	t.dedupConf.Store(policy.Dedup)
+	t.setWriteLatencySLO(policy.WriteLatencySLO)
+	t.setRuntimeConf(policy.RuntimeConf)
+	return nil
+}
+
+func (t *Topic) getTopicPolicy() topicPolicy {
+	policy := topicPolicy{
+		DisableChannelAutoCreate: t.IsChannelAutoCreateDisabled(),
+		MaxPubClientStats:        int(atomic.LoadInt64(&t.maxPubClientStats)),
+		PubClientStatsTTL:        time.Duration(atomic.LoadInt64(&t.pubClientStatsTTL)),
+	}
+	t.fillMirrorPolicy(&policy)
+	policy.Archive = t.IsArchiveEnabled()
+	policy.Dedup = t.GetDedupConf()
+	policy.WriteLatencySLO = t.GetWriteLatencySLO()
+	policy.RuntimeConf = t.GetRuntimeConf()
+	for name, ch := range t.GetChannelMapCopy() {
+		if slo := ch.GetSLO(); slo != nil {
+			if policy.ChannelSLOs == nil {
+				policy.ChannelSLOs = make(map[string]*ChannelSLO)
+			}
+			policy.ChannelSLOs[name] = slo
+		}
+		if ch.IsEphemeral() {
+			continue
+		}
+		if cp := ch.getPolicy(); cp != (channelPolicy{}) {
+			if policy.Channels == nil {
+				policy.Channels = make(map[string]*channelPolicy)
+			}
+			policy.Channels[name] = &cp
+		}
+	}
+	return policy
+}
+
+// IsDefaultTopicPolicy returns true if nothing changed in the topic policy
+func (t *Topic) IsDefaultTopicPolicy() bool {
+	return reflect.DeepEqual(t.getTopicPolicy(), topicPolicy{})
+}
+
+// GetTopicPolicyData returns the encoded policy of the topic partition, it should
+// be synced from the leader to the replicas so the policy is kept after failover.
+func (t *Topic) GetTopicPolicyData() ([]byte, error) {
+	return json.Marshal(t.getTopicPolicy())
+}
+
+// ApplyTopicPolicyData replaces the local policy by the one synced from the leader.
+func (t *Topic) ApplyTopicPolicyData(data []byte) error {
+	var policy topicPolicy
+	err := json.Unmarshal(data, &policy)
+	if err != nil {
+		return err
+	}
+	if policy.DisableChannelAutoCreate {
+		atomic.StoreInt32(&t.channelAutoCreateDisabled, 1)
+	} else {
+		atomic.StoreInt32(&t.channelAutoCreateDisabled, 0)
+	}
+	atomic.StoreInt64(&t.maxPubClientStats, int64(policy.MaxPubClientStats))
+	atomic.StoreInt64(&t.pubClientStatsTTL, int64(policy.PubClientStatsTTL))
+	t.applyPubStatsPolicy()
+	t.syncMirrorPolicy(&policy)
+	t.syncArchivePolicy(&policy)
+	t.dedupConf.Store(policy.Dedup)
+	if old := t.GetWriteLatencySLO(); !reflect.DeepEqual(old, policy.WriteLatencySLO) {
+		t.setWriteLatencySLO(policy.WriteLatencySLO)
+	}
+	t.setRuntimeConf(policy.RuntimeConf)
+	t.applyChannelPolicies(policy.Channels)
+	t.applyChannelSLOs(policy.ChannelSLOs)
+	return t.saveTopicPolicy()
+}
+
+// applyChannelPolicies replaces the settings of the channels by those synced from
+// the leader, the channel missing on this replica will be created.
+func (t *Topic) applyChannelPolicies(policies map[string]*channelPolicy) {
+	changed := false
+	for name := range policies {
+		if _, err := t.GetExistingChannel(name); err != nil {
+			t.GetChannel(name)
+			changed = true
+		}
+	}
+	for name, ch := range t.GetChannelMapCopy() {
+		if ch.IsEphemeral() {
+			continue
+		}
+		cp := policies[name]
+		if cp == nil {
+			cp = &channelPolicy{}
+		}
+		if ch.applyPolicy(cp) {
+			changed = true
+		}
+	}
+	if changed {
+		if err := t.SaveChannelMeta(); err != nil {
+			nsqLog.LogWarningf("topic %v failed to save channel meta: %v", t.GetFullName(), err)
+		}
+	}
+}
+
+// applyChannelSLOs replaces the slo of the channels by those synced from the leader
+func (t *Topic) applyChannelSLOs(slos map[string]*ChannelSLO) {
+	changed := false
+	for name, ch := range t.GetChannelMapCopy() {
+		slo := slos[name]
+		if reflect.DeepEqual(ch.GetSLO(), slo) {
+			continue
+		}
+		if err := ch.SetSLO(slo); err != nil {
+			nsqLog.LogWarningf("topic %v channel %v slo %v invalid: %v", t.GetFullName(), name, slo, err)
+			continue
+		}
+		changed = true
+	}
+	if changed {
+		if err := t.SaveChannelMeta(); err != nil {
+			nsqLog.LogWarningf("topic %v failed to save channel meta: %v", t.GetFullName(), err)
+		}
+	}
+}
+
+func (t *Topic) saveTopicPolicy() error {
+	fileName := t.getTopicPolicyFileName()
+	d, err := json.Marshal(t.getTopicPolicy())
+	if err != nil {
+		return err
+	}
+	t.saveMutex.Lock()
+	defer t.saveMutex.Unlock()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(d)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Sync()
+	f.Close()
+	return util.AtomicRename(tmpFileName, fileName)
+}
+
+func (t *Topic) removeTopicPolicy() {
+	fileName := t.getTopicPolicyFileName()
+	err := os.Remove(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		nsqLog.Infof("remove file %v failed:%v", fileName, err)
+	}
+}
+
 func (t *Topic) getHistoryStatsFileName() string {
 	return path.Join(t.dataPath, t.fullName+HISTORY_STAT_FILE_NAME)
 }
@@ -530,6 +921,30 @@ func (t *Topic) LoadHistoryStats() error {
 	return t.detailStats.LoadHistory(t.getHistoryStatsFileName())
 }
 
+func (t *Topic) getDedupIndexFileName() string {
+	return path.Join(t.dataPath, t.fullName+DEDUP_INDEX_FILE_NAME)
+}
+
+func (t *Topic) GetDedupIndex() *DedupIndex {
+	return t.dedupIndex
+}
+
+func (t *Topic) SaveDedupIndex() error {
+	if t.Exiting() {
+		return ErrExiting
+	}
+	return t.dedupIndex.Save(time.Now().UnixNano())
+}
+
+// ExpireDedupIndex removes the expired dedup keys and compacts the index on the disk if needed
+func (t *Topic) ExpireDedupIndex(now time.Time) error {
+	if t.Exiting() {
+		return ErrExiting
+	}
+	_, err := t.dedupIndex.Expire(now.UnixNano())
+	return err
+}
+
 func (t *Topic) GetCommitted() BackendQueueEnd {
 	l := t.committedOffset.Load()
 	if l == nil {
@@ -548,8 +963,9 @@ func (t *Topic) UpdateCommittedOffset(offset BackendQueueEnd) {
 		nsqLog.LogDebugf("committed is rollbacked: %v, %v", cur, offset)
 	}
 	t.committedOffset.Store(offset)
-	syncEvery := atomic.LoadInt64(&t.dynamicConf.SyncEvery)
-	if syncEvery == 1 ||
+	syncEvery := t.getSyncEvery()
+	syncTimeout, _ := t.isSyncTimeout(time.Now())
+	if syncEvery == 1 || syncTimeout ||
 		offset.TotalMsgCnt()-atomic.LoadInt64(&t.lastSyncCnt) >= syncEvery {
 		if !t.IsWriteDisabled() {
 			t.flush(true)
@@ -571,6 +987,57 @@ func (t *Topic) GetDiskQueueSnapshot() *DiskQueueSnapshot {
 	return d
 }
 
+// PeekedMessage is the message read from the disk queue without consuming
+type PeekedMessage struct {
+	*Message
+	Offset    BackendOffset
+	RawSize   int32
+	Truncated bool
+}
+
+// read at most limit messages from the snapshot without changing any consume position,
+// the body will be truncated and the read stopped while the total body size exceeds maxBytes.
+func peekMessagesFromSnapshot(snap *DiskQueueSnapshot, start BackendOffset, limit int, maxBytes int64, isExt bool) ([]PeekedMessage, error) {
+	defer snap.Close()
+	err := snap.SeekTo(start)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]PeekedMessage, 0, limit)
+	var totalBytes int64
+	for len(ret) < limit && totalBytes < maxBytes {
+		data := snap.ReadOne()
+		if data.Err != nil {
+			if data.Err == io.EOF {
+				break
+			}
+			return ret, data.Err
+		}
+		msg, err := DecodeMessage(data.Data, isExt)
+		if err != nil {
+			return ret, err
+		}
+		pm := PeekedMessage{Message: msg, Offset: data.Offset, RawSize: int32(data.MovedSize)}
+		if totalBytes+int64(len(msg.Body)) > maxBytes {
+			msg.Body = msg.Body[:maxBytes-totalBytes]
+			pm.Truncated = true
+		}
+		totalBytes += int64(len(msg.Body))
+		ret = append(ret, pm)
+	}
+	return ret, nil
+}
+
+// PeekMessages reads the messages from the committed topic data begin at the start offset,
+// a negative start means reading from the oldest data not cleaned.
+func (t *Topic) PeekMessages(start BackendOffset, limit int, maxBytes int64) ([]PeekedMessage, error) {
+	snap := t.GetDiskQueueSnapshot()
+	if start < 0 {
+		start = snap.GetQueueReadStart().Offset()
+	}
+	return peekMessagesFromSnapshot(snap, start, limit, maxBytes, t.IsExt())
+}
+
 func (t *Topic) BufferPoolGet(capacity int) *bytes.Buffer {
 	b := t.bp.Get().(*bytes.Buffer)
 	b.Reset()
@@ -633,6 +1100,8 @@ func (t *Topic) SetDynamicInfo(dynamicConf TopicDynamicConf, idGen MsgIDGenerato
 	if dynamicConf.Ext {
 		t.setExt()
 	}
+	t.dynamicConf.PartitionNum = dynamicConf.PartitionNum
+	t.dynamicConf.Replica = dynamicConf.Replica
 	nsqLog.Logf("topic dynamic configure changed to %v", dynamicConf)
 	t.channelLock.RLock()
 	for _, ch := range t.channelMap {
@@ -653,6 +1122,14 @@ func (t *Topic) nextMsgID() MessageID {
 	return MessageID(id)
 }
 
+// NextMsgID allocates a new message id from the id generator of the topic
+func (t *Topic) NextMsgID() MessageID {
+	t.Lock()
+	id := t.nextMsgID()
+	t.Unlock()
+	return id
+}
+
 func (t *Topic) GetFullName() string {
 	return t.fullName
 }
@@ -728,6 +1205,7 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 			channel.DisableConsume(true)
 		}
 		t.channelMap[channelName] = channel
+		t.updateChannelsSnapshotNoLock()
 		nsqLog.Logf("TOPIC(%s): new channel(%s), end: %v", t.GetFullName(),
 			channel.name, channel.GetChannelEnd())
 		return channel, true
@@ -735,6 +1213,20 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 	return channel, false
 }
 
+// GetChannelsSnapshot returns the channels without holding the channel lock,
+// it is used for stats only.
+func (t *Topic) GetChannelsSnapshot() []*Channel {
+	return t.channelsSnapshot.Load().([]*Channel)
+}
+
+func (t *Topic) updateChannelsSnapshotNoLock() {
+	channels := make([]*Channel, 0, len(t.channelMap))
+	for _, c := range t.channelMap {
+		channels = append(channels, c)
+	}
+	t.channelsSnapshot.Store(channels)
+}
+
 func (t *Topic) GetExistingChannel(channelName string) (*Channel, error) {
 	t.channelLock.RLock()
 	channel, ok := t.channelMap[channelName]
@@ -754,6 +1246,8 @@ func (t *Topic) CloseExistingChannel(channelName string, deleteData bool) error
 	}
 	t.channelMap[channelName] = nil
 	delete(t.channelMap, channelName)
+	t.updateChannelsSnapshotNoLock()
+	atomic.AddInt64(&t.backend.ioCounters.deletedReadBytes, channel.GetDiskReadBytes())
 	// not defered so that we can continue while the channel async closes
 	numChannels := len(t.channelMap)
 	t.channelLock.Unlock()
@@ -911,6 +1405,7 @@ func (t *Topic) PutRawDataOnReplica(rawData []byte, offset BackendOffset, checkS
 	if atomic.LoadInt32(&t.dynamicConf.AutoCommit) == 1 {
 		t.UpdateCommittedOffset(&dend)
 	}
+	t.addReplicaDedupKey(rawData, msgNum)
 
 	return &dend, nil
 }
@@ -928,6 +1423,7 @@ func (t *Topic) PutMessageOnReplica(m *Message, offset BackendOffset, checkSize
 	if err != nil {
 		return nil, err
 	}
+	t.addReplicaMsgDedupKey(m)
 	return &dend, nil
 }
 
@@ -1026,6 +1522,7 @@ func (t *Topic) put(m *Message, trace bool, checkSize int64) (MessageID, Backend
 		if m.TraceID != 0 || atomic.LoadInt32(&t.EnableTrace) == 1 || nsqLog.Level() >= levellogger.LOG_DETAIL {
 			nsqMsgTracer.TracePub(t.GetTopicName(), t.GetTopicPart(), "PUB", m.TraceID, m, offset, dend.TotalMsgCnt())
 		}
+		exportPubSpan(t.GetTopicName(), t.GetTopicPart(), m, offset)
 	}
 	// TODO: handle delayed type for dpub and transaction message
 	// should remove from delayed queue after written on disk file
@@ -1114,6 +1611,9 @@ func (t *Topic) exit(deleted bool) error {
 	// pub loop may be blocked by cluster write which may hold the write lock for coordinator,
 	// we need avoid wait close/delete topic in coordinator.
 	t.wg.Wait()
+	if a := t.getArchive(); a != nil {
+		a.stop()
+	}
 
 	t.Lock()
 	defer t.Unlock()
@@ -1124,6 +1624,7 @@ func (t *Topic) exit(deleted bool) error {
 			delete(t.channelMap, channel.name)
 			channel.Delete()
 		}
+		t.updateChannelsSnapshotNoLock()
 		t.channelLock.Unlock()
 
 		if t.GetDelayedQueue() != nil {
@@ -1132,7 +1633,9 @@ func (t *Topic) exit(deleted bool) error {
 		// empty the queue (deletes the backend files, too)
 		t.Empty()
 		t.removeHistoryStat()
+		t.dedupIndex.Remove()
 		t.RemoveChannelMeta()
+		t.removeTopicPolicy()
 		t.removeMagicCode()
 		return t.backend.Delete()
 	}
@@ -1141,6 +1644,10 @@ func (t *Topic) exit(deleted bool) error {
 	t.flush(true)
 	nsqLog.Logf("[TRACE_DATA] exiting topic end: %v, cnt: %v", t.TotalDataSize(), t.TotalMessageCnt())
 	t.SaveChannelMeta()
+	err := t.dedupIndex.Save(time.Now().UnixNano())
+	if err != nil {
+		nsqLog.LogWarningf("topic %v failed to save dedup index: %v", t.fullName, err)
+	}
 	t.channelLock.RLock()
 	// close all the channels
 	for _, channel := range t.channelMap {
@@ -1209,6 +1716,12 @@ func (t *Topic) Empty() error {
 }
 
 func (t *Topic) ForceFlush() {
+	t.flushAllData(false)
+}
+
+// flushAllData flushes the topic and the channels, the topic data is only flushed
+// to the buffer without the disk sync if skipTopicSync.
+func (t *Topic) flushAllData(skipTopicSync bool) {
 	if nsqLog.Level() >= levellogger.LOG_DETAIL {
 		e := t.backend.GetQueueReadEnd()
 		curCommit := t.GetCommitted()
@@ -1216,7 +1729,17 @@ func (t *Topic) ForceFlush() {
 	}
 
 	s := time.Now()
-	t.flush(true)
+	if err := t.dedupIndex.Flush(s.UnixNano(), !skipTopicSync); err != nil {
+		nsqLog.LogWarningf("topic %v failed to flush dedup index: %v", t.GetFullName(), err)
+	}
+	if skipTopicSync {
+		if t.GetDelayedQueue() != nil {
+			t.GetDelayedQueue().ForceFlush()
+		}
+		t.ForceFlushForChannels()
+	} else {
+		t.flush(true)
+	}
 	cost := time.Now().Sub(s)
 	if cost > time.Second {
 		nsqLog.LogWarningf("topic(%s): flush cost: %v", t.GetFullName(), cost)
@@ -1246,6 +1769,7 @@ func (t *Topic) flush(notifyChan bool) error {
 		return nil
 	}
 	atomic.StoreInt64(&t.lastSyncCnt, t.backend.GetQueueWriteEnd().TotalMsgCnt())
+	atomic.StoreInt64(&t.lastSyncTime, time.Now().UnixNano())
 	err := t.backend.Flush()
 	if err != nil {
 		nsqLog.LogErrorf("failed flush: %v", err)
@@ -1270,13 +1794,7 @@ func (t *Topic) PrintCurrentStats() {
 
 func (t *Topic) AggregateChannelE2eProcessingLatency() *quantile.Quantile {
 	var latencyStream *quantile.Quantile
-	t.channelLock.RLock()
-	realChannels := make([]*Channel, 0, len(t.channelMap))
-	for _, c := range t.channelMap {
-		realChannels = append(realChannels, c)
-	}
-	t.channelLock.RUnlock()
-	for _, c := range realChannels {
+	for _, c := range t.GetChannelsSnapshot() {
 		if c.e2eProcessingLatencyStream == nil {
 			continue
 		}
@@ -1318,6 +1836,14 @@ func (t *Topic) TryCleanOldData(retentionSize int64, noRealClean bool, maxCleanO
 	if oldestPos.Offset() < maxCleanOffset || maxCleanOffset == BackendOffset(0) {
 		maxCleanOffset = oldestPos.Offset()
 	}
+	// the body of the spilled in-flight message is reloaded from the data
+	t.channelLock.RLock()
+	for _, ch := range t.channelMap {
+		if offset, ok := ch.GetOldestSpilledOffset(); ok && offset < maxCleanOffset {
+			maxCleanOffset = offset
+		}
+	}
+	t.channelLock.RUnlock()
 	snapReader := NewDiskQueueSnapshot(getBackendName(t.tname, t.partition), t.dataPath, oldestPos)
 	snapReader.SetQueueStart(cleanStart)
 	err := snapReader.SeekTo(cleanStart.Offset())
@@ -1332,7 +1858,7 @@ func (t *Topic) TryCleanOldData(retentionSize int64, noRealClean bool, maxCleanO
 	}
 	var cleanEndInfo BackendQueueOffset
 	t.Lock()
-	retentionDay := atomic.LoadInt32(&t.dynamicConf.RetentionDay)
+	retentionDay := t.getRetentionDay()
 	if retentionDay == 0 {
 		retentionDay = int32(DEFAULT_RETENTION_DAYS)
 	}
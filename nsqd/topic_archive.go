@@ -0,0 +1,567 @@
+package nsqd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/youzan/nsq/internal/util"
+)
+
+// the interval to check the archive index uploaded by the leader on the replica
+const archiveIndexSyncInterval = time.Minute
+
+var (
+	ErrArchiveUploading   = errors.New("archive segment is uploading")
+	ErrArchiveNotUploaded = errors.New("archive segment is not uploaded by the leader")
+)
+
+// ArchivedSegment is the consumed disk queue segment uploaded to the archive store
+// before it is cleaned, the data before the start pos in the segment is invalid.
+type ArchivedSegment struct {
+	FileNum     int64  `json:"file_num"`
+	StartPos    int64  `json:"start_pos"`
+	StartOffset int64  `json:"start_offset"`
+	StartCnt    int64  `json:"start_cnt"`
+	EndOffset   int64  `json:"end_offset"`
+	EndCnt      int64  `json:"end_cnt"`
+	Size        int64  `json:"size"`
+	Key         string `json:"key"`
+	ArchivedAt  int64  `json:"archived_at"`
+	// the compression of the uploaded segment, empty if not compressed
+	Compression string `json:"compression,omitempty"`
+}
+
+type TopicArchiveStats struct {
+	Store         string `json:"store"`
+	Segments      int    `json:"segments"`
+	ArchivedBytes int64  `json:"archived_bytes"`
+	StartOffset   int64  `json:"start_offset"`
+	EndOffset     int64  `json:"end_offset"`
+	Errors        int64  `json:"errors"`
+	LastError     string `json:"last_error,omitempty"`
+}
+
+type topicArchive struct {
+	sync.Mutex
+	store    ObjectStore
+	storeErr error
+	segments []ArchivedSegment
+	errors   int64
+	lastErr  string
+	// the segment is uploaded by the worker in background, the cleaning of
+	// the segment is blocked until it is uploaded
+	uploading     bool
+	uploadChan    chan archiveTask
+	exitChan      chan struct{}
+	exitOnce      sync.Once
+	lastIndexSync time.Time
+}
+
+type archiveTask struct {
+	fileName string
+	seg      ArchivedSegment
+}
+
+type archivedSegmentsByOffset []ArchivedSegment
+
+func (s archivedSegmentsByOffset) Len() int {
+	return len(s)
+}
+func (s archivedSegmentsByOffset) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s archivedSegmentsByOffset) Less(i, j int) bool {
+	return s[i].StartOffset < s[j].StartOffset
+}
+
+// newTopicArchive starts the upload worker of the topic, stop should be called
+// after the archive is disabled.
+func (t *Topic) newTopicArchive(store ObjectStore, storeErr error) *topicArchive {
+	a := &topicArchive{
+		store:      store,
+		storeErr:   storeErr,
+		uploadChan: make(chan archiveTask, 1),
+		exitChan:   make(chan struct{}),
+	}
+	go t.archiveUploadLoop(a)
+	return a
+}
+
+func (a *topicArchive) stop() {
+	a.exitOnce.Do(func() {
+		close(a.exitChan)
+	})
+}
+
+func (a *topicArchive) isArchivedNoLock(seg ArchivedSegment) bool {
+	for _, s := range a.segments {
+		if s.FileNum == seg.FileNum && s.StartOffset == seg.StartOffset {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *topicArchive) isArchived(seg ArchivedSegment) bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.isArchivedNoLock(seg)
+}
+
+func (a *topicArchive) setError(err error) {
+	atomic.AddInt64(&a.errors, 1)
+	a.Lock()
+	a.lastErr = err.Error()
+	a.Unlock()
+}
+
+func (t *Topic) getArchiveIndexFileName() string {
+	return path.Join(t.dataPath, getBackendName(t.tname, t.partition)+".archive.dat")
+}
+
+func (t *Topic) getArchive() *topicArchive {
+	a, _ := t.archive.Load().(*topicArchive)
+	return a
+}
+
+func (t *Topic) IsArchiveEnabled() bool {
+	return t.getArchive() != nil
+}
+
+// EnableArchive uploads the consumed segments to the archive store before they
+// are cleaned, the segments will not be cleaned if failed to upload.
+func (t *Topic) EnableArchive() error {
+	if t.IsArchiveEnabled() {
+		return nil
+	}
+	store, err := NewObjectStore(t.option)
+	if err != nil {
+		return err
+	}
+	a := t.newTopicArchive(store, nil)
+	err = t.loadArchiveIndex(a)
+	if err != nil && !os.IsNotExist(err) {
+		a.stop()
+		return err
+	}
+	t.archive.Store(a)
+	t.backend.SetSegmentArchiver(t.archiveSegment)
+	nsqLog.Logf("topic %v archive enabled to %v", t.GetFullName(), store)
+	return t.saveTopicPolicy()
+}
+
+// DisableArchive stops archiving the segments, the archived segments are kept
+// in the store and can still be restored after enabled again.
+func (t *Topic) DisableArchive() error {
+	t.stopArchive()
+	nsqLog.Logf("topic %v archive disabled", t.GetFullName())
+	return t.saveTopicPolicy()
+}
+
+func (t *Topic) stopArchive() {
+	t.backend.SetSegmentArchiver(nil)
+	if a := t.getArchive(); a != nil {
+		a.stop()
+	}
+	t.archive.Store((*topicArchive)(nil))
+}
+
+func (t *Topic) GetArchivedSegments() []ArchivedSegment {
+	a := t.getArchive()
+	if a == nil {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	segs := make([]ArchivedSegment, len(a.segments))
+	copy(segs, a.segments)
+	return segs
+}
+
+func (t *Topic) GetArchiveStats() *TopicArchiveStats {
+	a := t.getArchive()
+	if a == nil {
+		return nil
+	}
+	s := &TopicArchiveStats{
+		Errors: atomic.LoadInt64(&a.errors),
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.store != nil {
+		s.Store = a.store.String()
+	}
+	s.Segments = len(a.segments)
+	s.LastError = a.lastErr
+	for i, seg := range a.segments {
+		if i == 0 {
+			s.StartOffset = seg.StartOffset
+		}
+		s.ArchivedBytes += seg.EndOffset - seg.StartOffset
+		s.EndOffset = seg.EndOffset
+	}
+	return s
+}
+
+// archiveSegment is called by the disk queue before the segment is cleaned, the
+// segment already archived will be ignored. The segment not archived is queued to
+// the upload worker and the cleaning will be retried after it is uploaded. Only
+// the leader uploads, the replica cleans the segment after it is found in the
+// index uploaded by the leader.
+func (t *Topic) archiveSegment(fileName string, seg ArchivedSegment) error {
+	a := t.getArchive()
+	if a == nil {
+		return nil
+	}
+	if a.isArchived(seg) {
+		return nil
+	}
+	if a.store == nil {
+		a.setError(a.storeErr)
+		return a.storeErr
+	}
+	if t.IsWriteDisabled() {
+		a.Lock()
+		needSync := time.Since(a.lastIndexSync) >= archiveIndexSyncInterval
+		if needSync {
+			a.lastIndexSync = time.Now()
+		}
+		a.Unlock()
+		if needSync {
+			if err := t.mergeArchiveIndexFromStore(a); err != nil {
+				nsqLog.LogWarningf("topic %v failed to sync archive index: %v", t.GetFullName(), err)
+			}
+			if a.isArchived(seg) {
+				return nil
+			}
+		}
+		return ErrArchiveNotUploaded
+	}
+	a.Lock()
+	defer a.Unlock()
+	if !a.uploading {
+		select {
+		case a.uploadChan <- archiveTask{fileName: fileName, seg: seg}:
+			a.uploading = true
+		default:
+		}
+	}
+	return ErrArchiveUploading
+}
+
+func (t *Topic) archiveUploadLoop(a *topicArchive) {
+	for {
+		select {
+		case task := <-a.uploadChan:
+			err := t.doArchiveSegment(a, task.fileName, task.seg)
+			if err != nil {
+				a.setError(err)
+				nsqLog.LogWarningf("topic %v failed to archive segment %v: %v", t.GetFullName(), task.fileName, err)
+			}
+			a.Lock()
+			a.uploading = false
+			a.Unlock()
+		case <-a.exitChan:
+			return
+		}
+	}
+}
+
+func (t *Topic) doArchiveSegment(a *topicArchive, fileName string, seg ArchivedSegment) error {
+	// the segments archived by the old leader should be kept in the index
+	err := t.mergeArchiveIndexFromStore(a)
+	if err != nil {
+		return err
+	}
+	if a.isArchived(seg) {
+		return nil
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	seg.Size = stat.Size()
+	seg.Key = fmt.Sprintf("%s/%d/%020d-%020d.dat", t.GetTopicName(), t.GetTopicPart(),
+		seg.StartOffset, seg.EndOffset)
+	var r io.ReadSeeker = f
+	size := seg.Size
+	if compression := t.getArchiveCompression(); compression == TopicCompressionSnappy {
+		cf, err := compressArchiveSegment(f, fileName)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			cf.Close()
+			os.Remove(cf.Name())
+		}()
+		size, err = cf.Seek(0, 1)
+		if err != nil {
+			return err
+		}
+		_, err = cf.Seek(0, 0)
+		if err != nil {
+			return err
+		}
+		r = cf
+		seg.Compression = compression
+		seg.Key += ".sz"
+	}
+	err = a.store.Put(seg.Key, r, size)
+	if err != nil {
+		return err
+	}
+	seg.ArchivedAt = time.Now().Unix()
+	a.Lock()
+	a.segments = append(a.segments, seg)
+	a.Unlock()
+	nsqLog.Logf("topic %v archived segment %v to %v", t.GetFullName(), fileName, seg.Key)
+	return t.saveArchiveIndex(a)
+}
+
+// compressArchiveSegment compresses the segment to the temp file by the snappy
+// framing format, the caller should remove the temp file.
+func compressArchiveSegment(src io.Reader, fileName string) (*os.File, error) {
+	tmpFileName := fmt.Sprintf("%s.%d.sz.tmp", fileName, rand.Int())
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(snappy.NewWriter(f))
+	_, err = io.Copy(bw, src)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpFileName)
+		return nil, err
+	}
+	return f, nil
+}
+
+func (t *Topic) getArchiveIndexKey() string {
+	return fmt.Sprintf("%s/%d/index.json", t.GetTopicName(), t.GetTopicPart())
+}
+
+// mergeArchiveIndexFromStore merges the index uploaded by the other nodes
+func (t *Topic) mergeArchiveIndexFromStore(a *topicArchive) error {
+	r, err := a.store.Get(t.getArchiveIndexKey())
+	if err == ErrArchiveObjectNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	var segs []ArchivedSegment
+	err = json.Unmarshal(data, &segs)
+	if err != nil {
+		return err
+	}
+	merged := false
+	a.Lock()
+	for _, s := range segs {
+		if !a.isArchivedNoLock(s) {
+			a.segments = append(a.segments, s)
+			merged = true
+		}
+	}
+	if merged {
+		sort.Sort(archivedSegmentsByOffset(a.segments))
+	}
+	a.Unlock()
+	if !merged {
+		return nil
+	}
+	_, err = t.writeArchiveIndexFile(a)
+	return err
+}
+
+func (t *Topic) loadArchiveIndex(a *topicArchive) error {
+	data, err := ioutil.ReadFile(t.getArchiveIndexFileName())
+	if err != nil {
+		return err
+	}
+	var segs []ArchivedSegment
+	err = json.Unmarshal(data, &segs)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	a.segments = segs
+	a.Unlock()
+	return nil
+}
+
+// the index is also uploaded to the store so the archived segments can be found
+// even if the local data is lost.
+func (t *Topic) saveArchiveIndex(a *topicArchive) error {
+	fileName, err := t.writeArchiveIndexFile(a)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return a.store.Put(t.getArchiveIndexKey(), f, stat.Size())
+}
+
+func (t *Topic) writeArchiveIndexFile(a *topicArchive) (string, error) {
+	a.Lock()
+	data, err := json.Marshal(a.segments)
+	a.Unlock()
+	if err != nil {
+		return "", err
+	}
+	fileName := t.getArchiveIndexFileName()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpFileName)
+		return "", err
+	}
+	return fileName, util.AtomicRename(tmpFileName, fileName)
+}
+
+// ReadArchivedMessages reads the messages in [start, end) of the virtual offset
+// from the archived segments, the end 0 means all the archived.
+func (t *Topic) ReadArchivedMessages(start BackendOffset, end BackendOffset, fn func(*Message, BackendOffset) error) error {
+	a := t.getArchive()
+	if a == nil {
+		return ErrArchiveStoreNotConfigured
+	}
+	if a.store == nil {
+		return a.storeErr
+	}
+	for _, seg := range t.GetArchivedSegments() {
+		if BackendOffset(seg.EndOffset) <= start {
+			continue
+		}
+		if end > 0 && BackendOffset(seg.StartOffset) >= end {
+			break
+		}
+		err := t.readArchivedSegment(a.store, seg, start, end, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Topic) readArchivedSegment(store ObjectStore, seg ArchivedSegment,
+	start BackendOffset, end BackendOffset, fn func(*Message, BackendOffset) error) error {
+	r, err := store.Get(seg.Key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	br := bufio.NewReader(r)
+	if seg.Compression == TopicCompressionSnappy {
+		br = bufio.NewReader(snappy.NewReader(r))
+	}
+	if seg.StartPos > 0 {
+		_, err = io.CopyN(ioutil.Discard, br, seg.StartPos)
+		if err != nil {
+			return err
+		}
+	}
+	offset := BackendOffset(seg.StartOffset)
+	var msgSize int32
+	for offset < BackendOffset(seg.EndOffset) {
+		if end > 0 && offset >= end {
+			return nil
+		}
+		err = binary.Read(br, binary.BigEndian, &msgSize)
+		if err != nil {
+			return err
+		}
+		if msgSize < minValidMsgLength || msgSize > int32(t.option.MaxMsgSize)+minValidMsgLength {
+			return fmt.Errorf("invalid message size %v at %v in archived %v", msgSize, offset, seg.Key)
+		}
+		buf := make([]byte, msgSize)
+		_, err = io.ReadFull(br, buf)
+		if err != nil {
+			return err
+		}
+		if offset >= start {
+			msg, err := decodeMessage(buf, t.IsExt())
+			if err != nil {
+				return err
+			}
+			err = fn(msg, offset)
+			if err != nil {
+				return err
+			}
+		}
+		offset += BackendOffset(4 + msgSize)
+	}
+	return nil
+}
+
+func (t *Topic) loadArchivePolicy(policy *topicPolicy) {
+	if !policy.Archive {
+		return
+	}
+	store, storeErr := NewObjectStore(t.option)
+	if storeErr != nil {
+		// keep the segments not cleaned until the store is fixed
+		nsqLog.LogErrorf("topic %v archive store invalid: %v", t.GetFullName(), storeErr)
+	}
+	a := t.newTopicArchive(store, storeErr)
+	err := t.loadArchiveIndex(a)
+	if err != nil && !os.IsNotExist(err) {
+		nsqLog.LogWarningf("topic %v failed to load archive index: %v", t.GetFullName(), err)
+	}
+	t.archive.Store(a)
+	t.backend.SetSegmentArchiver(t.archiveSegment)
+}
+
+func (t *Topic) syncArchivePolicy(policy *topicPolicy) {
+	if policy.Archive == t.IsArchiveEnabled() {
+		return
+	}
+	if policy.Archive {
+		t.loadArchivePolicy(policy)
+	} else {
+		t.stopArchive()
+	}
+}
+
+func (t *Topic) removeArchiveIndex() {
+	os.Remove(t.getArchiveIndexFileName())
+}
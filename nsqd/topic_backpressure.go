@@ -0,0 +1,135 @@
+package nsqd
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// the backlog is computed at most once in the interval for the publish
+	pubBackpressureCheckInterval = 100 * time.Millisecond
+	// the backpressure is released while the backlog is below the ratio of the high
+	// watermark, so the producer will not flap around the watermark
+	pubBackpressureLowRatio = 0.9
+)
+
+var ErrPubBackpressure = errors.New("topic backlog exceeded the high watermark")
+
+// PubBackpressureStats is the watermark state of the topic partition, the backlog
+// is the max unconsumed messages and bytes of the channels.
+type PubBackpressureStats struct {
+	Active bool `json:"active" pb:"1"`
+	// the unix time since the backpressure started, 0 if not active
+	Since        int64 `json:"since,omitempty" pb:"2"`
+	HighDepth    int64 `json:"high_depth" pb:"3"`
+	HighBytes    int64 `json:"high_bytes" pb:"4"`
+	BacklogDepth int64 `json:"backlog_depth" pb:"5"`
+	BacklogBytes int64 `json:"backlog_bytes" pb:"6"`
+	// the publish rejected by the backpressure
+	Rejected int64 `json:"rejected" pb:"7"`
+}
+
+type pubBackpressure struct {
+	sync.Mutex
+	active       bool
+	since        int64
+	lastCheck    time.Time
+	highDepth    int64
+	highBytes    int64
+	backlogDepth int64
+	backlogBytes int64
+	rejected     int64
+}
+
+func isOverWatermark(v int64, high int64, ratio float64) bool {
+	return high > 0 && float64(v) >= float64(high)*ratio
+}
+
+// getChannelBacklog returns the max depth and depth size of the channels, the
+// skipped channel is ignored since the messages will not be consumed.
+func (t *Topic) getChannelBacklog() (int64, int64) {
+	var depth, bytes int64
+	for _, c := range t.GetChannelMapCopy() {
+		if c.IsSkipped() {
+			continue
+		}
+		if d := c.Depth(); d > depth {
+			depth = d
+		}
+		if s := c.DepthSize(); s > bytes {
+			bytes = s
+		}
+	}
+	return depth, bytes
+}
+
+// refresh updates the backlog and the watermark state, should be locked
+func (bp *pubBackpressure) refresh(t *Topic, now time.Time) {
+	bp.lastCheck = now
+	bp.backlogDepth, bp.backlogBytes = t.getChannelBacklog()
+	if !bp.active {
+		if isOverWatermark(bp.backlogDepth, bp.highDepth, 1) ||
+			isOverWatermark(bp.backlogBytes, bp.highBytes, 1) {
+			bp.active = true
+			bp.since = now.Unix()
+			nsqLog.LogWarningf("topic %v publish backpressure started, backlog depth %v, bytes %v",
+				t.GetFullName(), bp.backlogDepth, bp.backlogBytes)
+		}
+		return
+	}
+	if !isOverWatermark(bp.backlogDepth, bp.highDepth, pubBackpressureLowRatio) &&
+		!isOverWatermark(bp.backlogBytes, bp.highBytes, pubBackpressureLowRatio) {
+		bp.active = false
+		bp.since = 0
+		nsqLog.Logf("topic %v publish backpressure released, backlog depth %v, bytes %v",
+			t.GetFullName(), bp.backlogDepth, bp.backlogBytes)
+	}
+}
+
+// CheckPubBackpressure returns true if the publish should be rejected since the
+// backlog of the topic partition exceeded the high watermark of the depth or the
+// bytes, the zero watermark means no limit.
+func (t *Topic) CheckPubBackpressure(highDepth int64, highBytes int64, now time.Time) bool {
+	bp := &t.pubBackpressure
+	bp.Lock()
+	defer bp.Unlock()
+	if highDepth <= 0 && highBytes <= 0 {
+		bp.highDepth, bp.highBytes = 0, 0
+		bp.active = false
+		bp.since = 0
+		return false
+	}
+	if highDepth != bp.highDepth || highBytes != bp.highBytes ||
+		now.Sub(bp.lastCheck) >= pubBackpressureCheckInterval {
+		bp.highDepth, bp.highBytes = highDepth, highBytes
+		bp.refresh(t, now)
+	}
+	if bp.active {
+		bp.rejected++
+	}
+	return bp.active
+}
+
+// GetPubBackpressureStats returns nil if the watermark is not set
+func (t *Topic) GetPubBackpressureStats() *PubBackpressureStats {
+	bp := &t.pubBackpressure
+	bp.Lock()
+	defer bp.Unlock()
+	if bp.highDepth <= 0 && bp.highBytes <= 0 {
+		return nil
+	}
+	// the state is refreshed here for the topic without publish
+	if now := time.Now(); now.Sub(bp.lastCheck) >= pubBackpressureCheckInterval {
+		bp.refresh(t, now)
+	}
+	return &PubBackpressureStats{
+		Active:       bp.active,
+		Since:        bp.since,
+		HighDepth:    bp.highDepth,
+		HighBytes:    bp.highBytes,
+		BacklogDepth: bp.backlogDepth,
+		BacklogBytes: bp.backlogBytes,
+		Rejected:     bp.rejected,
+	}
+}
@@ -0,0 +1,195 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	simpleJson "github.com/bitly/go-simplejson"
+	"github.com/youzan/nsq/internal/ext"
+)
+
+const (
+	// the duplicated message is rejected with the error
+	DedupModeReject = "reject"
+	// the duplicated message is accepted but not written
+	DedupModeDrop = "drop"
+
+	MaxDedupWindow = time.Hour * 24 * 7
+)
+
+var (
+	ErrDuplicateMessage   = errors.New("duplicate message in the dedup window")
+	ErrInvalidDedupConfig = errors.New("invalid dedup config")
+)
+
+// TopicDedupConf is the dedup of the publish on the topic partition, the message
+// with the same dedup key within the window (or within the latest max keys if
+// limited) is treated as duplicated. Only the 64-bit hash of the key is indexed,
+// so the message may be treated as duplicated by the hash collision, see DedupIndex.
+type TopicDedupConf struct {
+	Mode    string        `json:"mode"`
+	Window  time.Duration `json:"window"`
+	MaxKeys int           `json:"max_keys,omitempty"`
+}
+
+type TopicDedupStats struct {
+	Mode     string `json:"mode"`
+	Window   string `json:"window"`
+	MaxKeys  int    `json:"max_keys,omitempty"`
+	Hits     int64  `json:"hits"`
+	Rejected int64  `json:"rejected"`
+	Dropped  int64  `json:"dropped"`
+}
+
+func (conf *TopicDedupConf) Validate() error {
+	if conf.Mode != DedupModeReject && conf.Mode != DedupModeDrop {
+		return ErrInvalidDedupConfig
+	}
+	if conf.Window <= 0 || conf.Window > MaxDedupWindow || conf.MaxKeys < 0 {
+		return ErrInvalidDedupConfig
+	}
+	return nil
+}
+
+var dedupKeyBytes = []byte(`"` + ext.DEDUP_KEY + `"`)
+
+// GetDedupKeyFromJsonHeader returns the dedup key given by the producer in the json
+// header, such as {"##dedup_key":"order-1001-paid"}.
+func GetDedupKeyFromJsonHeader(header []byte) []byte {
+	if !bytes.Contains(header, dedupKeyBytes) {
+		return nil
+	}
+	jsonExt, err := simpleJson.NewJson(header)
+	if err != nil {
+		return nil
+	}
+	key, _ := jsonExt.Get(ext.DEDUP_KEY).String()
+	return []byte(key)
+}
+
+func (t *Topic) GetDedupConf() *TopicDedupConf {
+	c, _ := t.dedupConf.Load().(*TopicDedupConf)
+	return c
+}
+
+// SetDedupConf enables the dedup of the publish on this partition, the nil conf
+// disables the dedup. The dedup keys in the index are kept while changing.
+func (t *Topic) SetDedupConf(conf *TopicDedupConf) error {
+	if conf != nil {
+		if err := conf.Validate(); err != nil {
+			return err
+		}
+	}
+	t.dedupConf.Store(conf)
+	nsqLog.Logf("topic %v dedup changed to %v", t.GetFullName(), conf)
+	return t.saveTopicPolicy()
+}
+
+// CheckDedupKey checks and reserves the dedup key before the message is written, it
+// returns true if the duplicated message should be dropped, or ErrDuplicateMessage if
+// rejected. The message with the same key writing at the same time will wait until
+// the writing finished. The key should be committed after the message written, or
+// forgotten if failed. Only the single message publish carries the dedup key, the
+// batch publish (MPUB and the HTTP /mpub) is never deduplicated.
+func (t *Topic) CheckDedupKey(key []byte) (bool, error) {
+	conf := t.GetDedupConf()
+	if conf == nil || len(key) == 0 {
+		return false, nil
+	}
+	for {
+		dup, waitChan := t.dedupIndex.Reserve(key, time.Now().UnixNano())
+		if waitChan == nil {
+			if !dup {
+				return false, nil
+			}
+			break
+		}
+		select {
+		case <-waitChan:
+		case <-t.quitChan:
+			return false, ErrExiting
+		}
+	}
+	atomic.AddInt64(&t.dedupHits, 1)
+	if conf.Mode == DedupModeDrop {
+		atomic.AddInt64(&t.dedupDropped, 1)
+		return true, nil
+	}
+	atomic.AddInt64(&t.dedupRejected, 1)
+	return false, ErrDuplicateMessage
+}
+
+// CommitDedupKey records the key reserved by CheckDedupKey after the message written
+func (t *Topic) CommitDedupKey(key []byte) {
+	if len(key) == 0 {
+		return
+	}
+	if conf := t.GetDedupConf(); conf != nil {
+		t.addDedupKey(conf, key, time.Now().UnixNano())
+	}
+	t.dedupIndex.Release(key)
+}
+
+// ForgetDedupKey releases the key reserved so the producer can retry the failed message
+func (t *Topic) ForgetDedupKey(key []byte) {
+	if len(key) == 0 {
+		return
+	}
+	t.dedupIndex.Release(key)
+}
+
+func (t *Topic) addDedupKey(conf *TopicDedupConf, key []byte, ts int64) {
+	t.dedupIndex.Set(key, ts+int64(conf.Window))
+	// trim in batch to avoid sorting the keys for each message
+	if conf.MaxKeys > 0 && t.dedupIndex.Len() > conf.MaxKeys+conf.MaxKeys/10 {
+		t.dedupIndex.TrimOldest(conf.MaxKeys)
+	}
+}
+
+// addReplicaDedupKey records the dedup key of the single message replicated from the
+// leader, so the duplicates can still be detected after the leader changed.
+func (t *Topic) addReplicaDedupKey(data []byte, msgNum int32) {
+	conf := t.GetDedupConf()
+	if conf == nil || msgNum != 1 || !t.IsExt() || len(data) < 4 {
+		return
+	}
+	size := int(binary.BigEndian.Uint32(data[:4]))
+	if size > len(data)-4 {
+		return
+	}
+	msg, err := DecodeMessage(data[4:4+size], true)
+	if err != nil {
+		return
+	}
+	t.addReplicaMsgDedupKey(msg)
+}
+
+func (t *Topic) addReplicaMsgDedupKey(msg *Message) {
+	conf := t.GetDedupConf()
+	if conf == nil || msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return
+	}
+	key := GetDedupKeyFromJsonHeader(msg.ExtBytes)
+	if len(key) == 0 || msg.Timestamp+int64(conf.Window) <= time.Now().UnixNano() {
+		return
+	}
+	t.addDedupKey(conf, key, msg.Timestamp)
+}
+
+func (t *Topic) GetDedupStats() *TopicDedupStats {
+	conf := t.GetDedupConf()
+	if conf == nil {
+		return nil
+	}
+	return &TopicDedupStats{
+		Mode:     conf.Mode,
+		Window:   conf.Window.String(),
+		MaxKeys:  conf.MaxKeys,
+		Hits:     atomic.LoadInt64(&t.dedupHits),
+		Rejected: atomic.LoadInt64(&t.dedupRejected),
+		Dropped:  atomic.LoadInt64(&t.dedupDropped),
+	}
+}
@@ -0,0 +1,246 @@
+package nsqd
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLatencySLOWindow = time.Minute
+	maxLatencySLOWindow     = time.Hour
+	// the slo state is kept if the samples in the window are too few, and the
+	// breach is resolved only if recovered below the threshold by the ratio, so
+	// the alert will not flap around the threshold.
+	sloMinSamples   = 20
+	sloResolveRatio = 0.9
+)
+
+// checkSLOBreached returns the new state by the value compared to the threshold
+// with the hysteresis, no samples always resolves the breach.
+func checkSLOBreached(wasBreached bool, samples int64, value float64, threshold float64) bool {
+	if samples == 0 {
+		return false
+	}
+	if samples < sloMinSamples {
+		return wasBreached
+	}
+	if wasBreached {
+		return value > threshold*sloResolveRatio
+	}
+	return value > threshold
+}
+
+var ErrInvalidLatencySLO = errors.New("invalid write latency slo")
+
+// TopicLatencySLO defines the threshold of the write latency percentile on the
+// topic partition, such as the p99 write latency should be within 100ms over
+// 1 minute. The percentile is estimated from the write latency buckets.
+type TopicLatencySLO struct {
+	Percentile float64       `json:"percentile"`
+	Latency    time.Duration `json:"latency"`
+	Window     time.Duration `json:"window"`
+}
+
+func (s *TopicLatencySLO) Validate() error {
+	if s.Percentile <= 0 || s.Percentile >= 1 {
+		return ErrInvalidLatencySLO
+	}
+	if s.Latency <= 0 {
+		return ErrInvalidLatencySLO
+	}
+	if s.Window == 0 {
+		s.Window = defaultLatencySLOWindow
+	}
+	if s.Window < time.Second*10 || s.Window > maxLatencySLOWindow {
+		return ErrInvalidLatencySLO
+	}
+	return nil
+}
+
+type TopicLatencySLOStats struct {
+	Percentile float64 `json:"percentile"`
+	Latency    string  `json:"latency"`
+	Window     string  `json:"window"`
+	// the estimated percentile of the write latency in the last checked window
+	Current   string `json:"current"`
+	CurrentUs int64  `json:"current_us"`
+	Writes    int64  `json:"writes"`
+	Degraded  bool   `json:"degraded"`
+	// the unix time since the slo breached, 0 if not degraded
+	DegradedSince int64 `json:"degraded_since,omitempty"`
+}
+
+// the upper bound of each write latency bucket in microseconds, the last bucket
+// has no upper bound so the lower bound is used.
+func writeLatencyBucketBound(i int, num int) (int64, int64) {
+	if i == 0 {
+		return 0, 1024
+	}
+	lower := int64(1024) << uint(i-1)
+	if i == num-1 {
+		return lower, lower
+	}
+	return lower, lower * 2
+}
+
+// WriteLatencyPercentile estimates the percentile of the write latency from the
+// bucket counts, the latency is interpolated linearly in the bucket.
+func WriteLatencyPercentile(buckets []int64, percentile float64) (time.Duration, int64) {
+	var total int64
+	for _, cnt := range buckets {
+		total += cnt
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	rank := percentile * float64(total)
+	var cum int64
+	for i, cnt := range buckets {
+		if cnt <= 0 {
+			continue
+		}
+		if float64(cum+cnt) >= rank {
+			lower, upper := writeLatencyBucketBound(i, len(buckets))
+			us := float64(lower) + float64(upper-lower)*(rank-float64(cum))/float64(cnt)
+			return time.Duration(us) * time.Microsecond, total
+		}
+		cum += cnt
+	}
+	lower, _ := writeLatencyBucketBound(len(buckets)-1, len(buckets))
+	return time.Duration(lower) * time.Microsecond, total
+}
+
+type latencySample struct {
+	ts      int64
+	buckets []int64
+}
+
+// topicLatencySLOTracker keeps the samples of the write latency buckets within the
+// window, the percentile is computed from the difference of the samples.
+type topicLatencySLOTracker struct {
+	sync.Mutex
+	slo           TopicLatencySLO
+	samples       []latencySample
+	current       time.Duration
+	writes        int64
+	degradedSince int64
+}
+
+// TopicLatencySLOCheck is the result of the slo check, Changed is true if the
+// topic changed between the degraded and the normal.
+type TopicLatencySLOCheck struct {
+	SLO      TopicLatencySLO
+	Current  time.Duration
+	Writes   int64
+	Degraded bool
+	Changed  bool
+}
+
+func (t *topicLatencySLOTracker) check(now time.Time, buckets []int64) TopicLatencySLOCheck {
+	t.Lock()
+	defer t.Unlock()
+	ts := now.UnixNano()
+	t.samples = append(t.samples, latencySample{ts: ts, buckets: buckets})
+	// keep the latest sample not newer than the window start as the base
+	since := ts - int64(t.slo.Window)
+	i := 0
+	for i+1 < len(t.samples) && t.samples[i+1].ts <= since {
+		i++
+	}
+	t.samples = t.samples[i:]
+	base := t.samples[0].buckets
+	diff := make([]int64, len(buckets))
+	for j := range buckets {
+		diff[j] = buckets[j] - base[j]
+	}
+	t.current, t.writes = WriteLatencyPercentile(diff, t.slo.Percentile)
+	wasDegraded := t.degradedSince != 0
+	breached := checkSLOBreached(wasDegraded, t.writes, float64(t.current), float64(t.slo.Latency))
+	if breached && !wasDegraded {
+		t.degradedSince = now.Unix()
+	} else if !breached && wasDegraded {
+		t.degradedSince = 0
+	}
+	return TopicLatencySLOCheck{
+		SLO:      t.slo,
+		Current:  t.current,
+		Writes:   t.writes,
+		Degraded: breached,
+		Changed:  breached != wasDegraded,
+	}
+}
+
+func (t *topicLatencySLOTracker) stats() *TopicLatencySLOStats {
+	t.Lock()
+	defer t.Unlock()
+	return &TopicLatencySLOStats{
+		Percentile:    t.slo.Percentile,
+		Latency:       t.slo.Latency.String(),
+		Window:        t.slo.Window.String(),
+		Current:       t.current.String(),
+		CurrentUs:     int64(t.current / time.Microsecond),
+		Writes:        t.writes,
+		Degraded:      t.degradedSince != 0,
+		DegradedSince: t.degradedSince,
+	}
+}
+
+func (t *Topic) getLatencySLOTracker() *topicLatencySLOTracker {
+	tracker, _ := t.latencySLO.Load().(*topicLatencySLOTracker)
+	return tracker
+}
+
+func (t *Topic) GetWriteLatencySLO() *TopicLatencySLO {
+	tracker := t.getLatencySLOTracker()
+	if tracker == nil {
+		return nil
+	}
+	slo := tracker.slo
+	return &slo
+}
+
+func (t *Topic) setWriteLatencySLO(slo *TopicLatencySLO) {
+	if slo == nil {
+		t.latencySLO.Store((*topicLatencySLOTracker)(nil))
+		return
+	}
+	t.latencySLO.Store(&topicLatencySLOTracker{slo: *slo})
+}
+
+// SetWriteLatencySLO starts checking the write latency slo, nil will remove the slo.
+// The samples will be kept if the slo is not changed.
+func (t *Topic) SetWriteLatencySLO(slo *TopicLatencySLO) error {
+	if slo != nil {
+		newSLO := *slo
+		if err := newSLO.Validate(); err != nil {
+			return err
+		}
+		if old := t.getLatencySLOTracker(); old != nil && old.slo == newSLO {
+			return nil
+		}
+		slo = &newSLO
+	}
+	t.setWriteLatencySLO(slo)
+	nsqLog.Logf("topic %v write latency slo changed to %v", t.GetFullName(), slo)
+	return t.saveTopicPolicy()
+}
+
+// CheckWriteLatencySLO samples the write latency buckets and checks the slo in the
+// window, it should be called periodically. The second return is false if no slo.
+func (t *Topic) CheckWriteLatencySLO(now time.Time) (TopicLatencySLOCheck, bool) {
+	tracker := t.getLatencySLOTracker()
+	if tracker == nil {
+		return TopicLatencySLOCheck{}, false
+	}
+	return tracker.check(now, t.detailStats.GetMsgWriteLatencyStats()), true
+}
+
+// GetWriteLatencySLOStats returns the last checked slo, nil if no slo defined
+func (t *Topic) GetWriteLatencySLOStats() *TopicLatencySLOStats {
+	tracker := t.getLatencySLOTracker()
+	if tracker == nil {
+		return nil
+	}
+	return tracker.stats()
+}
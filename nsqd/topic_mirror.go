@@ -0,0 +1,220 @@
+package nsqd
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrInvalidTopicMirror = errors.New("invalid topic mirror config")
+
+// TopicMirrorConf configures the topic to replicate the messages to the topic on
+// the remote cluster asynchronously, the remote nsqd is discovered from the remote
+// lookupd if the lookupd addresses are given, otherwise the nsqd addresses are used.
+type TopicMirrorConf struct {
+	RemoteTopic  string   `json:"remote_topic"`
+	NSQDAddrs    []string `json:"nsqd_http_addrs,omitempty"`
+	LookupdAddrs []string `json:"lookupd_http_addrs,omitempty"`
+}
+
+func (c *TopicMirrorConf) Validate(topicName string) error {
+	if len(c.NSQDAddrs) == 0 && len(c.LookupdAddrs) == 0 {
+		return ErrInvalidTopicMirror
+	}
+	if c.RemoteTopic == "" {
+		c.RemoteTopic = topicName
+	}
+	return nil
+}
+
+type TopicMirrorStats struct {
+	RemoteTopic    string `json:"remote_topic"`
+	Remote         string `json:"remote,omitempty"`
+	MirroredOffset int64  `json:"mirrored_offset"`
+	// the bytes and messages committed in local but not shipped to remote
+	LagBytes     int64  `json:"lag_bytes"`
+	LagMsgs      int64  `json:"lag_msgs"`
+	ShippedMsgs  int64  `json:"shipped_msgs"`
+	ShippedBytes int64  `json:"shipped_bytes"`
+	Errors       int64  `json:"errors"`
+	LastError    string `json:"last_error,omitempty"`
+	LastShipped  int64  `json:"last_shipped,omitempty"`
+}
+
+// the mirror position is the virtual offset and the total message count of the
+// local queue which has been shipped to the remote.
+type topicMirror struct {
+	sync.Mutex
+	conf         TopicMirrorConf
+	offset       BackendOffset
+	cnt          int64
+	remote       string
+	shippedMsgs  int64
+	shippedBytes int64
+	errors       int64
+	lastErr      string
+	lastShipped  int64
+}
+
+// GetMirrorConf returns nil if the topic is not mirrored
+func (t *Topic) GetMirrorConf() *TopicMirrorConf {
+	m, _ := t.mirror.Load().(*topicMirror)
+	if m == nil {
+		return nil
+	}
+	conf := m.conf
+	return &conf
+}
+
+// SetMirror starts mirroring the topic from the oldest data not cleaned or from the
+// latest committed, the nil config stops the mirror.
+func (t *Topic) SetMirror(conf *TopicMirrorConf, fromOldest bool) error {
+	if conf == nil {
+		t.mirror.Store((*topicMirror)(nil))
+		nsqLog.Logf("topic %v mirror removed", t.GetFullName())
+		return t.saveTopicPolicy()
+	}
+	if err := conf.Validate(t.GetTopicName()); err != nil {
+		return err
+	}
+	m := &topicMirror{conf: *conf}
+	var start BackendQueueEnd
+	if fromOldest {
+		start = t.backend.GetQueueReadStart()
+	} else {
+		start = t.GetCommitted()
+		if start == nil {
+			start = t.backend.GetQueueReadEnd()
+		}
+	}
+	m.offset = start.Offset()
+	m.cnt = start.TotalMsgCnt()
+	t.mirror.Store(m)
+	nsqLog.Logf("topic %v mirror to %v from offset %v", t.GetFullName(), conf, m.offset)
+	return t.saveTopicPolicy()
+}
+
+// GetMirrorPosition returns the virtual offset and message count shipped to remote
+func (t *Topic) GetMirrorPosition() (BackendOffset, int64) {
+	m, _ := t.mirror.Load().(*topicMirror)
+	if m == nil {
+		return 0, 0
+	}
+	m.Lock()
+	defer m.Unlock()
+	return m.offset, m.cnt
+}
+
+// UpdateMirrorPosition is called after the messages shipped to the remote
+func (t *Topic) UpdateMirrorPosition(offset BackendOffset, cnt int64, msgs int64, bytes int64, remote string) {
+	m, _ := t.mirror.Load().(*topicMirror)
+	if m == nil {
+		return
+	}
+	m.Lock()
+	m.offset = offset
+	m.cnt = cnt
+	m.remote = remote
+	m.lastShipped = time.Now().Unix()
+	m.Unlock()
+	atomic.AddInt64(&m.shippedMsgs, msgs)
+	atomic.AddInt64(&m.shippedBytes, bytes)
+}
+
+func (t *Topic) IncrMirrorError(err error) {
+	m, _ := t.mirror.Load().(*topicMirror)
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.errors, 1)
+	m.Lock()
+	m.lastErr = err.Error()
+	m.Unlock()
+}
+
+// SaveMirrorPosition persists the shipped position so the mirror can continue
+// after restart, the messages shipped after last saved will be shipped again.
+func (t *Topic) SaveMirrorPosition() error {
+	if t.GetMirrorConf() == nil {
+		return nil
+	}
+	return t.saveTopicPolicy()
+}
+
+func (t *Topic) GetMirrorStats() *TopicMirrorStats {
+	m, _ := t.mirror.Load().(*topicMirror)
+	if m == nil {
+		return nil
+	}
+	s := &TopicMirrorStats{
+		RemoteTopic:  m.conf.RemoteTopic,
+		ShippedMsgs:  atomic.LoadInt64(&m.shippedMsgs),
+		ShippedBytes: atomic.LoadInt64(&m.shippedBytes),
+		Errors:       atomic.LoadInt64(&m.errors),
+	}
+	m.Lock()
+	s.Remote = m.remote
+	s.MirroredOffset = int64(m.offset)
+	s.LastError = m.lastErr
+	s.LastShipped = m.lastShipped
+	cnt := m.cnt
+	m.Unlock()
+	if e := t.GetCommitted(); e != nil {
+		s.LagBytes = int64(e.Offset()) - s.MirroredOffset
+		s.LagMsgs = e.TotalMsgCnt() - cnt
+	}
+	if s.LagBytes < 0 {
+		s.LagBytes = 0
+	}
+	if s.LagMsgs < 0 {
+		s.LagMsgs = 0
+	}
+	return s
+}
+
+func (t *Topic) loadMirrorPolicy(policy *topicPolicy) {
+	if policy.Mirror == nil {
+		return
+	}
+	m := &topicMirror{
+		conf:   *policy.Mirror,
+		offset: BackendOffset(policy.MirrorOffset),
+		cnt:    policy.MirrorCnt,
+	}
+	t.mirror.Store(m)
+}
+
+// syncMirrorPolicy updates the mirror synced from the leader, the shipped stats
+// will be kept if the mirror config is not changed.
+func (t *Topic) syncMirrorPolicy(policy *topicPolicy) {
+	if policy.Mirror == nil {
+		t.mirror.Store((*topicMirror)(nil))
+		return
+	}
+	m, _ := t.mirror.Load().(*topicMirror)
+	if m == nil || !reflect.DeepEqual(m.conf, *policy.Mirror) {
+		t.loadMirrorPolicy(policy)
+		return
+	}
+	m.Lock()
+	if BackendOffset(policy.MirrorOffset) > m.offset {
+		m.offset = BackendOffset(policy.MirrorOffset)
+		m.cnt = policy.MirrorCnt
+	}
+	m.Unlock()
+}
+
+func (t *Topic) fillMirrorPolicy(policy *topicPolicy) {
+	m, _ := t.mirror.Load().(*topicMirror)
+	if m == nil {
+		return
+	}
+	conf := m.conf
+	policy.Mirror = &conf
+	m.Lock()
+	policy.MirrorOffset = int64(m.offset)
+	policy.MirrorCnt = m.cnt
+	m.Unlock()
+}
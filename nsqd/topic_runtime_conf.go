@@ -0,0 +1,130 @@
+package nsqd
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the archived segments are compressed by the snappy framing format
+	TopicCompressionSnappy = "snappy"
+
+	MaxTopicRetentionDay = 365
+)
+
+var ErrInvalidTopicRuntimeConf = errors.New("invalid topic runtime config")
+
+// TopicRuntimeConf overrides the process-wide options (or the cluster meta) of the
+// topic partition at runtime, the zero value of the field means no override.
+type TopicRuntimeConf struct {
+	SyncEvery int64 `json:"sync_every,omitempty" pb:"1"`
+	// the partition is synced if not synced in the timeout, it is checked while
+	// writing and in the flush loop of the --sync-timeout
+	SyncTimeout  time.Duration `json:"sync_timeout,omitempty" pb:"2"`
+	RetentionDay int32         `json:"retention_day,omitempty" pb:"3"`
+	// only less than the --max-msg-size, since the disk queue is limited by it
+	MaxMsgSize int64 `json:"max_msg_size,omitempty" pb:"4"`
+	// the compression of the segments uploaded to the archive store, empty for none.
+	// the local disk queue is never compressed.
+	Compression string `json:"compression,omitempty" pb:"5"`
+}
+
+func (conf *TopicRuntimeConf) IsEmpty() bool {
+	return *conf == TopicRuntimeConf{}
+}
+
+func (conf *TopicRuntimeConf) Validate(opts *Options) error {
+	if conf.SyncEvery < 0 || conf.SyncTimeout < 0 || conf.MaxMsgSize < 0 {
+		return ErrInvalidTopicRuntimeConf
+	}
+	if conf.RetentionDay < 0 || conf.RetentionDay > MaxTopicRetentionDay {
+		return ErrInvalidTopicRuntimeConf
+	}
+	if conf.MaxMsgSize > opts.MaxMsgSize {
+		return ErrInvalidTopicRuntimeConf
+	}
+	if conf.Compression != "" && conf.Compression != TopicCompressionSnappy {
+		return ErrInvalidTopicRuntimeConf
+	}
+	return nil
+}
+
+// GetRuntimeConf returns nil if no override
+func (t *Topic) GetRuntimeConf() *TopicRuntimeConf {
+	c, _ := t.runtimeConf.Load().(*TopicRuntimeConf)
+	return c
+}
+
+func (t *Topic) setRuntimeConf(conf *TopicRuntimeConf) {
+	if conf != nil && conf.IsEmpty() {
+		conf = nil
+	}
+	t.runtimeConf.Store(conf)
+}
+
+// SetRuntimeConf changes the config of the partition without restart, it is
+// persisted in the topic policy. The nil or empty conf removes all the overrides.
+func (t *Topic) SetRuntimeConf(conf *TopicRuntimeConf) error {
+	if conf != nil {
+		newConf := *conf
+		if err := newConf.Validate(t.option); err != nil {
+			return err
+		}
+		conf = &newConf
+	}
+	t.setRuntimeConf(conf)
+	nsqLog.Logf("topic %v runtime config changed to %+v", t.GetFullName(), t.GetRuntimeConf())
+	return t.saveTopicPolicy()
+}
+
+func (t *Topic) getSyncEvery() int64 {
+	if conf := t.GetRuntimeConf(); conf != nil && conf.SyncEvery > 0 {
+		return conf.SyncEvery
+	}
+	return atomic.LoadInt64(&t.dynamicConf.SyncEvery)
+}
+
+func (t *Topic) getRetentionDay() int32 {
+	if conf := t.GetRuntimeConf(); conf != nil && conf.RetentionDay > 0 {
+		return conf.RetentionDay
+	}
+	return atomic.LoadInt32(&t.dynamicConf.RetentionDay)
+}
+
+// GetMaxMsgSize returns the max message size of the topic, the default is the
+// --max-msg-size.
+func (t *Topic) GetMaxMsgSize(defaultSize int64) int64 {
+	if conf := t.GetRuntimeConf(); conf != nil && conf.MaxMsgSize > 0 && conf.MaxMsgSize < defaultSize {
+		return conf.MaxMsgSize
+	}
+	return defaultSize
+}
+
+// getArchiveCompression returns the compression of the segments uploaded by the
+// archive, it has no effect if the archive is not enabled.
+func (t *Topic) getArchiveCompression() string {
+	if conf := t.GetRuntimeConf(); conf != nil {
+		return conf.Compression
+	}
+	return ""
+}
+
+// isSyncTimeout returns true if the partition is not synced in the sync timeout,
+// the second return is false if the sync timeout is not overridden.
+func (t *Topic) isSyncTimeout(now time.Time) (bool, bool) {
+	conf := t.GetRuntimeConf()
+	if conf == nil || conf.SyncTimeout <= 0 {
+		return false, false
+	}
+	last := atomic.LoadInt64(&t.lastSyncTime)
+	return now.UnixNano()-last >= int64(conf.SyncTimeout), true
+}
+
+// IsFlushDue returns false if the sync timeout of the partition is longer than the
+// flush loop interval and not elapsed since last sync, only the disk sync of the
+// topic data is skipped in the flush loop.
+func (t *Topic) IsFlushDue(now time.Time) bool {
+	timeout, ok := t.isSyncTimeout(now)
+	return !ok || timeout
+}
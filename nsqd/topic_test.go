@@ -1,16 +1,21 @@
 package nsqd
 
 import (
+	"bytes"
 	"errors"
+	"io/ioutil"
 	"os"
 	//"runtime"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/absolute8511/glog"
+	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/internal/test"
 )
 
@@ -60,6 +65,298 @@ func TestGetChannel(t *testing.T) {
 	test.Equal(t, channel2, topic.channelMap["ch2"])
 }
 
+func isDedupKeyIndexed(index *DedupIndex, key []byte, now int64) bool {
+	index.Lock()
+	defer index.Unlock()
+	e, ok := index.keys[DedupKeyHash(key)]
+	return ok && e > now
+}
+
+func TestTopicDedupIndexPersist(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test", 0)
+	index := topic.GetDedupIndex()
+	now := time.Now().UnixNano()
+	index.Set([]byte("key1"), now+int64(time.Hour))
+	index.Set([]byte("key2"), now+int64(time.Millisecond))
+	index.Set([]byte("key1"), now+int64(time.Minute))
+	test.Equal(t, 2, index.GetStats().KeyCount)
+	test.Equal(t, int64(0), index.GetStats().DiskBytes)
+
+	time.Sleep(time.Millisecond * 2)
+	err := topic.SaveDedupIndex()
+	test.Nil(t, err)
+	stats := index.GetStats()
+	test.Equal(t, 1, stats.KeyCount)
+	test.NotEqual(t, int64(0), stats.MemBytes)
+	test.NotEqual(t, int64(0), stats.DiskBytes)
+
+	// reload as the broker restarted
+	reloaded := NewDedupIndex(topic.getDedupIndexFileName())
+	err = reloaded.Load(time.Now().UnixNano())
+	test.Nil(t, err)
+	test.Equal(t, 1, reloaded.Len())
+	test.Equal(t, true, isDedupKeyIndexed(reloaded, []byte("key1"), time.Now().UnixNano()))
+	test.Equal(t, false, isDedupKeyIndexed(reloaded, []byte("key2"), time.Now().UnixNano()))
+	test.Equal(t, stats.DiskBytes, reloaded.GetStats().DiskBytes)
+}
+
+func TestTopicDedupIndexFlushLog(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test", 0)
+	index := topic.GetDedupIndex()
+	now := time.Now().UnixNano()
+	index.Set([]byte("key1"), now+int64(time.Minute))
+	index.Set([]byte("key2"), now+int64(time.Hour))
+	err := topic.SaveDedupIndex()
+	test.Nil(t, err)
+	// the changes after the save are appended to the log while flushing
+	index.Set([]byte("key3"), now+int64(time.Hour))
+	test.Equal(t, 1, index.TrimOldest(2))
+	topic.ForceFlush()
+	test.Equal(t, int64(5*dedupIndexEntryDiskSize), index.GetStats().DiskBytes)
+	// the log is synced together with the topic data
+	test.Equal(t, false, index.logUnsynced)
+
+	// reload as the broker crashed without the save
+	reloaded := NewDedupIndex(topic.getDedupIndexFileName())
+	err = reloaded.Load(time.Now().UnixNano())
+	test.Nil(t, err)
+	test.Equal(t, 2, reloaded.Len())
+	test.Equal(t, false, isDedupKeyIndexed(reloaded, []byte("key1"), time.Now().UnixNano()))
+	test.Equal(t, true, isDedupKeyIndexed(reloaded, []byte("key2"), time.Now().UnixNano()))
+	test.Equal(t, true, isDedupKeyIndexed(reloaded, []byte("key3"), time.Now().UnixNano()))
+
+	// the log is compacted into the index file by the save
+	err = reloaded.Save(time.Now().UnixNano())
+	test.Nil(t, err)
+	_, err = os.Stat(reloaded.logFileName())
+	test.Equal(t, true, os.IsNotExist(err))
+	test.Equal(t, int64(3*dedupIndexEntryDiskSize), reloaded.GetStats().DiskBytes)
+}
+
+func TestTopicDedupIndexExpireCompact(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test", 0)
+	index := topic.GetDedupIndex()
+	now := time.Now().UnixNano()
+	cnt := dedupIndexMinCompactEntries + 10
+	for i := 0; i < cnt; i++ {
+		index.Set([]byte(strconv.Itoa(i)), now+int64(time.Millisecond))
+	}
+	index.Set([]byte("key1"), now+int64(time.Hour))
+	topic.ForceFlush()
+	test.Equal(t, int64((cnt+1)*dedupIndexEntryDiskSize), index.GetStats().DiskBytes)
+
+	// nothing to compact before the keys expired
+	removed, err := index.Expire(now)
+	test.Nil(t, err)
+	test.Equal(t, 0, removed)
+	_, err = os.Stat(index.logFileName())
+	test.Nil(t, err)
+
+	// the expired keys are removed and the log is compacted without any new key
+	removed, err = index.Expire(now + int64(time.Second))
+	test.Nil(t, err)
+	test.Equal(t, cnt, removed)
+	test.Equal(t, 1, index.Len())
+	_, err = os.Stat(index.logFileName())
+	test.Equal(t, true, os.IsNotExist(err))
+	test.Equal(t, int64(2*dedupIndexEntryDiskSize), index.GetStats().DiskBytes)
+	test.Equal(t, true, isDedupKeyIndexed(index, []byte("key1"), now+int64(time.Second)))
+}
+
+func TestTopicDedupPublishMode(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test", 0)
+	// no dedup without the mode configured
+	dropped, err := topic.CheckDedupKey([]byte("key1"))
+	test.Nil(t, err)
+	test.Equal(t, false, dropped)
+	test.Equal(t, 0, topic.GetDedupIndex().Len())
+	test.Equal(t, (*TopicDedupStats)(nil), topic.GetDedupStats())
+
+	err = topic.SetDedupConf(&TopicDedupConf{Mode: "unknown", Window: time.Hour})
+	test.Equal(t, ErrInvalidDedupConfig, err)
+	err = topic.SetDedupConf(&TopicDedupConf{Mode: DedupModeReject, Window: time.Hour})
+	test.Nil(t, err)
+	_, err = topic.CheckDedupKey([]byte("key1"))
+	test.Nil(t, err)
+	topic.CommitDedupKey([]byte("key1"))
+	_, err = topic.CheckDedupKey([]byte("key1"))
+	test.Equal(t, ErrDuplicateMessage, err)
+	// the same key writing at the same time waits the writing finished, and the
+	// failed message can be retried
+	_, err = topic.CheckDedupKey([]byte("key2"))
+	test.Nil(t, err)
+	done := make(chan error, 1)
+	go func() {
+		_, err := topic.CheckDedupKey([]byte("key2"))
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("the same key should wait the writing finished")
+	case <-time.After(time.Millisecond * 100):
+	}
+	topic.ForgetDedupKey([]byte("key2"))
+	test.Nil(t, <-done)
+	topic.CommitDedupKey([]byte("key2"))
+	_, err = topic.CheckDedupKey([]byte("key2"))
+	test.Equal(t, ErrDuplicateMessage, err)
+
+	err = topic.SetDedupConf(&TopicDedupConf{Mode: DedupModeDrop, Window: time.Hour, MaxKeys: 10})
+	test.Nil(t, err)
+	dropped, err = topic.CheckDedupKey([]byte("key1"))
+	test.Nil(t, err)
+	test.Equal(t, true, dropped)
+	for i := 0; i < 20; i++ {
+		dropped, err = topic.CheckDedupKey([]byte(strconv.Itoa(i)))
+		test.Nil(t, err)
+		test.Equal(t, false, dropped)
+		topic.CommitDedupKey([]byte(strconv.Itoa(i)))
+	}
+	test.Equal(t, true, topic.GetDedupIndex().Len() <= 11)
+	// the oldest keys are trimmed by the max keys
+	dropped, _ = topic.CheckDedupKey([]byte("key1"))
+	test.Equal(t, false, dropped)
+
+	stats := topic.GetDedupStats()
+	test.Equal(t, DedupModeDrop, stats.Mode)
+	test.Equal(t, int64(3), stats.Hits)
+	test.Equal(t, int64(2), stats.Rejected)
+	test.Equal(t, int64(1), stats.Dropped)
+
+	// the dedup conf is kept in the local policy
+	err = topic.loadTopicPolicy()
+	test.Nil(t, err)
+	test.Equal(t, 10, topic.GetDedupConf().MaxKeys)
+	err = topic.SetDedupConf(nil)
+	test.Nil(t, err)
+	test.Equal(t, (*TopicDedupStats)(nil), topic.GetDedupStats())
+}
+
+func TestTopicDedupKeyReplicated(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicWithExt("test_dedup_replica", 0)
+	err := topic.SetDedupConf(&TopicDedupConf{Mode: DedupModeReject, Window: time.Hour})
+	test.Nil(t, err)
+	msg := NewMessageWithExt(0, []byte("v"), ext.JSON_HEADER_EXT_VER, []byte(`{"##dedup_key":"key1"}`))
+	_, err = topic.PutMessageOnReplica(msg, topic.backend.GetQueueWriteEnd().Offset(), 0)
+	test.Nil(t, err)
+	// the replica can detect the duplicates after it becomes the leader
+	_, err = topic.CheckDedupKey([]byte("key1"))
+	test.Equal(t, ErrDuplicateMessage, err)
+}
+
+func TestTopicClientPubStatsLRU(t *testing.T) {
+	stats := NewDetailStatsInfo(0, path.Join(os.TempDir(), "not-exist-history-stats"))
+	stats.SetPubStatsOptions(PubStatsKeyRemote, 2, time.Hour)
+	stats.UpdatePubClientStats("127.0.0.1:1", "agent", "", "tcp", 1, false)
+	stats.UpdatePubClientStats("127.0.0.1:2", "agent", "", "tcp", 1, false)
+	// make the first one recently used
+	stats.UpdatePubClientStats("127.0.0.1:1", "agent", "", "tcp", 1, false)
+	stats.UpdatePubClientStats("127.0.0.1:3", "agent", "", "tcp", 1, true)
+	pubStats := stats.GetPubClientStats()
+	test.Equal(t, 2, len(pubStats))
+	test.Equal(t, "127.0.0.1:3", pubStats[0].RemoteAddress)
+	test.Equal(t, int64(1), pubStats[0].ErrCount)
+	test.Equal(t, "127.0.0.1:1", pubStats[1].RemoteAddress)
+	test.Equal(t, int64(2), pubStats[1].PubCount)
+	evicted, expired := stats.GetPubStatsEvicted()
+	test.Equal(t, int64(1), evicted)
+	test.Equal(t, int64(0), expired)
+	stats.RemovePubStats("127.0.0.1:3", "tcp")
+	test.Equal(t, 1, len(stats.GetPubClientStats()))
+
+	// aggregate by the user agent and identity
+	stats = NewDetailStatsInfo(0, path.Join(os.TempDir(), "not-exist-history-stats"))
+	stats.SetPubStatsOptions(PubStatsKeyIdentity, 10, time.Millisecond*10)
+	stats.UpdatePubClientStats("127.0.0.1:1", "agent", "user1", "tcp", 1, false)
+	stats.UpdatePubClientStats("127.0.0.1:2", "agent", "user1", "tcp", 2, false)
+	stats.UpdatePubClientStats("127.0.0.1:3", "agent", "user2", "tcp", 1, false)
+	stats.RemovePubStats("127.0.0.1:1", "tcp")
+	pubStats = stats.GetPubClientStats()
+	test.Equal(t, 2, len(pubStats))
+	test.Equal(t, "user1", pubStats[1].Identity)
+	test.Equal(t, int64(3), pubStats[1].PubCount)
+	time.Sleep(time.Millisecond * 20)
+	test.Equal(t, 0, len(stats.GetPubClientStats()))
+	_, expired = stats.GetPubStatsEvicted()
+	test.Equal(t, int64(2), expired)
+}
+
+func TestTopicPubStatsPolicy(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test", 0)
+	maxNum, ttl := topic.GetPubStatsPolicy()
+	test.Equal(t, opts.MaxPubClientStats, maxNum)
+	test.Equal(t, opts.PubClientStatsTTL, ttl)
+
+	stats := topic.GetDetailStats()
+	for i := 0; i < 5; i++ {
+		stats.UpdatePubClientStats("127.0.0.1:"+strconv.Itoa(i), "agent", "", "tcp", 1, false)
+	}
+	// decrease the limit should evict the stats over the limit
+	err := topic.SetPubStatsPolicy(2, time.Millisecond*10)
+	test.Nil(t, err)
+	pubStats := stats.GetPubClientStats()
+	test.Equal(t, 2, len(pubStats))
+	test.Equal(t, "127.0.0.1:4", pubStats[0].RemoteAddress)
+	evicted, _ := stats.GetPubStatsEvicted()
+	test.Equal(t, int64(3), evicted)
+
+	time.Sleep(time.Millisecond * 20)
+	stats.GCPubClientStats(time.Now())
+	_, expired := stats.GetPubStatsEvicted()
+	test.Equal(t, int64(2), expired)
+
+	// the policy should be loaded after restart
+	topic.SetPubStatsPolicy(10, time.Minute)
+	atomic.StoreInt64(&topic.maxPubClientStats, 0)
+	atomic.StoreInt64(&topic.pubClientStatsTTL, 0)
+	test.Nil(t, topic.loadTopicPolicy())
+	maxNum, ttl = topic.GetPubStatsPolicy()
+	test.Equal(t, 10, maxNum)
+	test.Equal(t, time.Minute, ttl)
+
+	// reset to default
+	topic.SetPubStatsPolicy(0, 0)
+	maxNum, ttl = topic.GetPubStatsPolicy()
+	test.Equal(t, opts.MaxPubClientStats, maxNum)
+	test.Equal(t, opts.PubClientStatsTTL, ttl)
+}
+
 type errorBackendQueue struct{}
 
 func (d *errorBackendQueue) Put([]byte) (BackendOffset, int32, int64, error) {
@@ -364,6 +661,93 @@ func TestTopicCleanOldDataByRetentionSize(t *testing.T) {
 	}
 }
 
+func TestTopicArchiveBeforeClean(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024 * 1024
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test", 0)
+	topic.dynamicConf.AutoCommit = 1
+	topic.dynamicConf.SyncEvery = 10
+	test.Equal(t, ErrArchiveStoreNotConfigured, topic.EnableArchive())
+
+	// the invalid store should keep the segments not cleaned
+	storeFile := path.Join(opts.DataPath, "archive-file")
+	ioutil.WriteFile(storeFile, []byte("not dir"), 0644)
+	opts.ArchiveStore = "file://" + storeFile
+	test.Nil(t, topic.EnableArchive())
+	test.Equal(t, true, topic.IsArchiveEnabled())
+
+	msgNum := 5000
+	channel := topic.GetChannel("ch")
+	test.NotNil(t, channel)
+	for i := 0; i <= msgNum; i++ {
+		msg := NewMessage(0, []byte(strconv.Itoa(i)+string(make([]byte, 1000))))
+		topic.PutMessage(msg)
+	}
+	topic.ForceFlush()
+	fileNum := topic.backend.diskWriteEnd.EndOffset.FileNum
+	test.Equal(t, true, fileNum >= 4)
+	for i := 0; i < msgNum; i++ {
+		msg := <-channel.clientMsgChan
+		channel.ConfirmBackendQueue(msg)
+	}
+	// the segment is uploaded in background and the clean should wait it
+	_, err := topic.TryCleanOldData(1, false, 0)
+	test.Equal(t, ErrArchiveUploading, err)
+	for i := 0; i < 100 && topic.GetArchiveStats().Errors == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	test.Equal(t, int64(1), topic.GetArchiveStats().Errors)
+	_, err = topic.TryCleanOldData(1, false, 0)
+	test.NotNil(t, err)
+	test.Equal(t, int64(0), topic.backend.GetQueueReadStart().(*diskQueueEndInfo).EndOffset.FileNum)
+
+	// the replica should not upload and wait the segments archived by the leader
+	opts.ArchiveStore = "file://" + path.Join(opts.DataPath, "archive")
+	test.Nil(t, topic.DisableArchive())
+	test.Nil(t, topic.EnableArchive())
+	atomic.StoreInt32(&topic.writeDisabled, 1)
+	_, err = topic.TryCleanOldData(1, false, 0)
+	test.Equal(t, ErrArchiveNotUploaded, err)
+	atomic.StoreInt32(&topic.writeDisabled, 0)
+	for i := 0; i < 100; i++ {
+		_, err = topic.TryCleanOldData(1, false, 0)
+		if err != ErrArchiveUploading {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	test.Nil(t, err)
+	cleanStart := topic.backend.GetQueueReadStart()
+	test.Equal(t, fileNum-1, cleanStart.(*diskQueueEndInfo).EndOffset.FileNum)
+	segs := topic.GetArchivedSegments()
+	test.Equal(t, int(fileNum-1), len(segs))
+	test.Equal(t, int64(0), segs[0].StartOffset)
+	test.Equal(t, int64(cleanStart.Offset()), segs[len(segs)-1].EndOffset)
+	test.Equal(t, cleanStart.TotalMsgCnt(), segs[len(segs)-1].EndCnt)
+
+	// read the archived after the local segments cleaned
+	var readCnt int64
+	err = topic.ReadArchivedMessages(0, 0, func(msg *Message, offset BackendOffset) error {
+		test.Equal(t, strconv.Itoa(int(readCnt)), string(bytes.TrimRight(msg.Body, "\x00")))
+		readCnt++
+		return nil
+	})
+	test.Nil(t, err)
+	test.Equal(t, cleanStart.TotalMsgCnt(), readCnt)
+
+	// the archive should be reloaded after restart
+	topic.getArchive().stop()
+	topic.archive.Store((*topicArchive)(nil))
+	test.Nil(t, topic.loadTopicPolicy())
+	test.Equal(t, len(segs), len(topic.GetArchivedSegments()))
+	test.Equal(t, true, topic.IsArchiveEnabled())
+}
+
 func TestTopicCleanOldDataByRetentionDay(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -621,6 +1005,180 @@ func TestTopicResetWithQueueStart(t *testing.T) {
 	}
 }
 
+func TestTopicPubBackpressure(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_pub_backpressure", 0)
+	channel := topic.GetChannel("ch")
+	now := time.Now()
+	equal(t, topic.CheckPubBackpressure(0, 0, now), false)
+	equal(t, topic.GetPubBackpressureStats() == nil, true)
+	equal(t, topic.CheckPubBackpressure(10, 0, now), false)
+
+	msgs := make([]*Message, 0, 10)
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, NewMessage(0, []byte(strconv.Itoa(i))))
+	}
+	topic.PutMessages(msgs)
+	topic.flush(true)
+	equal(t, channel.Depth(), int64(10))
+	// the backlog is cached in the check interval
+	equal(t, topic.CheckPubBackpressure(10, 0, now), false)
+	now = now.Add(pubBackpressureCheckInterval)
+	equal(t, topic.CheckPubBackpressure(10, 0, now), true)
+	stats := topic.GetPubBackpressureStats()
+	equal(t, stats.Active, true)
+	equal(t, stats.BacklogDepth, int64(10))
+	equal(t, stats.Rejected, int64(1))
+	// the watermark changed will be checked at once
+	equal(t, topic.CheckPubBackpressure(20, 0, now), false)
+	equal(t, topic.CheckPubBackpressure(0, 1, now), true)
+
+	// the skipped channel is not the backlog
+	channel.Skip()
+	now = now.Add(pubBackpressureCheckInterval)
+	equal(t, topic.CheckPubBackpressure(0, 1, now), false)
+	equal(t, topic.GetPubBackpressureStats().Active, false)
+}
+
+func TestTopicRuntimeConf(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024 * 1024
+	opts.ArchiveStore = ""
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_runtime_conf", 0)
+	topic.dynamicConf.SyncEvery = 10
+	topic.dynamicConf.RetentionDay = 3
+	test.Equal(t, true, topic.GetRuntimeConf() == nil)
+	test.Equal(t, int64(10), topic.getSyncEvery())
+	test.Equal(t, opts.MaxMsgSize, topic.GetMaxMsgSize(opts.MaxMsgSize))
+	test.Equal(t, true, topic.IsFlushDue(time.Now()))
+
+	test.Equal(t, ErrInvalidTopicRuntimeConf, topic.SetRuntimeConf(&TopicRuntimeConf{MaxMsgSize: opts.MaxMsgSize + 1}))
+	test.Equal(t, ErrInvalidTopicRuntimeConf, topic.SetRuntimeConf(&TopicRuntimeConf{Compression: "gzip"}))
+	test.Equal(t, ErrInvalidTopicRuntimeConf, topic.SetRuntimeConf(&TopicRuntimeConf{SyncEvery: -1}))
+
+	conf := &TopicRuntimeConf{
+		SyncEvery:    1000,
+		SyncTimeout:  time.Hour,
+		RetentionDay: 7,
+		MaxMsgSize:   1024,
+		Compression:  TopicCompressionSnappy,
+	}
+	test.Nil(t, topic.SetRuntimeConf(conf))
+	test.Equal(t, int64(1000), topic.getSyncEvery())
+	test.Equal(t, int32(7), topic.getRetentionDay())
+	test.Equal(t, int64(1024), topic.GetMaxMsgSize(opts.MaxMsgSize))
+	// the cluster meta changed will not override the runtime config
+	topic.SetDynamicInfo(TopicDynamicConf{SyncEvery: 1, AutoCommit: 1}, nil)
+	test.Equal(t, int64(1000), topic.getSyncEvery())
+	atomic.StoreInt64(&topic.lastSyncTime, time.Now().UnixNano())
+	test.Equal(t, false, topic.IsFlushDue(time.Now()))
+	test.Equal(t, true, topic.IsFlushDue(time.Now().Add(time.Hour)))
+	// only the topic disk sync is skipped before the sync timeout
+	atomic.StoreInt32(&topic.needFlush, 1)
+	topic.flushAllData(true)
+	test.Equal(t, int32(1), atomic.LoadInt32(&topic.needFlush))
+	topic.flushAllData(false)
+	test.Equal(t, int32(0), atomic.LoadInt32(&topic.needFlush))
+
+	// reload from the topic policy
+	topic.setRuntimeConf(nil)
+	test.Nil(t, topic.loadTopicPolicy())
+	test.Equal(t, *conf, *topic.GetRuntimeConf())
+	test.Equal(t, *conf, *NewTopicStats(topic, nil, true).RuntimeConf)
+
+	// the archived segments are compressed
+	test.Nil(t, topic.SetRuntimeConf(&TopicRuntimeConf{SyncEvery: 1000, Compression: TopicCompressionSnappy}))
+	opts.ArchiveStore = "file://" + path.Join(opts.DataPath, "archive")
+	test.Nil(t, topic.EnableArchive())
+	channel := topic.GetChannel("ch")
+	msgNum := 3000
+	for i := 0; i <= msgNum; i++ {
+		topic.PutMessage(NewMessage(0, []byte(strconv.Itoa(i)+string(make([]byte, 1000)))))
+	}
+	topic.ForceFlush()
+	for i := 0; i < msgNum; i++ {
+		msg := <-channel.clientMsgChan
+		channel.ConfirmBackendQueue(msg)
+	}
+	_, err := topic.TryCleanOldData(1, false, 0)
+	test.Nil(t, err)
+	segs := topic.GetArchivedSegments()
+	test.Equal(t, true, len(segs) > 0)
+	test.Equal(t, TopicCompressionSnappy, segs[0].Compression)
+	test.Equal(t, true, strings.HasSuffix(segs[0].Key, ".sz"))
+	var readCnt int64
+	err = topic.ReadArchivedMessages(0, 0, func(msg *Message, offset BackendOffset) error {
+		test.Equal(t, strconv.Itoa(int(readCnt)), string(bytes.TrimRight(msg.Body, "\x00")))
+		readCnt++
+		return nil
+	})
+	test.Nil(t, err)
+	test.Equal(t, segs[len(segs)-1].EndCnt, readCnt)
+}
+
+func TestTopicDiskIOStats(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxBytesPerFile = 1024
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_disk_io_stats", 0)
+	topic.GetChannel("ch")
+	stats := topic.GetDiskIOStats()
+	equal(t, stats.WriteBytes, int64(0))
+	equal(t, stats.SegmentFiles, int64(1))
+	equal(t, len(stats.SyncLatencyStats), 16)
+
+	msgs := make([]*Message, 0, 10)
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, NewMessage(0, make([]byte, 200)))
+	}
+	topic.PutMessages(msgs)
+	topic.flush(true)
+
+	stats = topic.GetDiskIOStats()
+	if stats.WriteBytes <= 2000 {
+		t.Errorf("write bytes should be more than the messages: %v", stats.WriteBytes)
+	}
+	if stats.SegmentRolls < 1 || stats.SegmentFiles != stats.SegmentRolls+1 {
+		t.Errorf("unexpected segment stats: %+v", stats)
+	}
+	var syncs int64
+	for _, cnt := range stats.SyncLatencyStats {
+		syncs += cnt
+	}
+	equal(t, syncs, stats.Syncs)
+	if stats.Syncs < stats.SegmentRolls {
+		t.Errorf("the segment roll should sync: %+v", stats)
+	}
+
+	// the channel will read the messages from the disk
+	for i := 0; i < 20 && topic.GetDiskIOStats().ReadBytes == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	readBytes := topic.GetDiskIOStats().ReadBytes
+	if readBytes == 0 {
+		t.Errorf("the read bytes should be increased after the channel read")
+	}
+	// the read bytes of the deleted channel is still counted
+	topic.DeleteExistingChannel("ch")
+	if rb := topic.GetDiskIOStats().ReadBytes; rb < readBytes {
+		t.Errorf("the read bytes should not decrease after the channel deleted: %v, %v", rb, readBytes)
+	}
+}
+
 func benchmarkTopicPut(b *testing.B, size int) {
 	b.StopTimer()
 	topicName := "bench_topic_put" + strconv.Itoa(b.N)
@@ -2,10 +2,14 @@ package nsqd
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
+	"github.com/tidwall/gjson"
+	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/internal/flume_log"
 	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/internal/otlptrace"
 )
 
 const (
@@ -154,6 +158,104 @@ func (self *RemoteMsgTracer) TraceSub(topic string, channel string, state string
 	}
 }
 
+// the exporter for the spans of the messages carrying the W3C traceparent,
+// nil if disabled
+var otlpExporter *otlptrace.Exporter
+
+// SetOTLPExporter starts exporting the spans to the OTLP/HTTP collector,
+// should be called before the nsqd started.
+func SetOTLPExporter(endpoint string, serviceName string) {
+	if endpoint == "" {
+		return
+	}
+	e := otlptrace.NewExporter(endpoint, serviceName, func(err error) {
+		nsqLog.LogWarningf("failed to export spans: %v", err)
+	})
+	e.Start()
+	otlpExporter = e
+}
+
+// StopOTLPExporter flushes the spans not exported and stops the exporter
+func StopOTLPExporter() {
+	if otlpExporter != nil {
+		otlpExporter.Stop()
+	}
+}
+
+func getMsgTraceParent(msg *Message) (otlptrace.TraceParent, bool) {
+	var tp otlptrace.TraceParent
+	if otlpExporter == nil || msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return tp, false
+	}
+	v := gjson.GetBytes(msg.ExtBytes, otlptrace.TraceParentKey)
+	if v.Type != gjson.String {
+		return tp, false
+	}
+	tp, err := otlptrace.ParseTraceParent(v.String())
+	if err != nil || !tp.IsSampled() {
+		return tp, false
+	}
+	return tp, true
+}
+
+// exportMsgSpan exports the span as the child of the producer span in the traceparent
+// of the message, ignored if the message is not traced.
+func exportMsgSpan(msg *Message, name string, kind int, start time.Time, end time.Time,
+	attrs map[string]interface{}, errStr string) {
+	tp, ok := getMsgTraceParent(msg)
+	if !ok {
+		return
+	}
+	attrs["messaging.system"] = "nsq"
+	attrs["messaging.message.id"] = strconv.FormatUint(uint64(msg.ID), 10)
+	otlpExporter.Export(&otlptrace.Span{
+		TraceID:      tp.TraceID,
+		SpanID:       otlptrace.NewSpanID(),
+		ParentSpanID: tp.ParentID,
+		Name:         name,
+		Kind:         kind,
+		Start:        start,
+		End:          end,
+		Attributes:   attrs,
+		Err:          errStr,
+	})
+}
+
+func exportPubSpan(topic string, part int, msg *Message, offset BackendOffset) {
+	exportMsgSpan(msg, topic+" publish", otlptrace.SpanKindServer, time.Unix(0, msg.Timestamp), time.Now(),
+		map[string]interface{}{
+			"messaging.destination.name":         topic,
+			"messaging.destination.partition.id": strconv.Itoa(part),
+			"messaging.nsq.offset":               int64(offset),
+		}, "")
+}
+
+// exportQueueSpan exports the time the message waiting in the channel before the first delivery
+func exportQueueSpan(topic string, channel string, msg *Message, deliveryTS time.Time) {
+	exportMsgSpan(msg, topic+" queue", otlptrace.SpanKindInternal, time.Unix(0, msg.Timestamp), deliveryTS,
+		map[string]interface{}{
+			"messaging.destination.name":              topic,
+			"messaging.destination.subscription.name": channel,
+		}, "")
+}
+
+// exportDeliverySpan exports the time from the delivery to the client response,
+// the result will be FIN, REQ or TIMEOUT.
+func exportDeliverySpan(topic string, channel string, msg *Message, clientAddr string, result string) {
+	errStr := ""
+	if result == "TIMEOUT" {
+		errStr = "message timeout"
+	}
+	exportMsgSpan(msg, topic+" deliver", otlptrace.SpanKindProducer, msg.deliveryTS, time.Now(),
+		map[string]interface{}{
+			"messaging.destination.name":              topic,
+			"messaging.destination.subscription.name": channel,
+			"messaging.nsq.attempts":                  int64(msg.Attempts),
+			"messaging.nsq.result":                    result,
+			"net.peer.name":                           clientAddr,
+		}, errStr)
+}
+
 func init() {
 	nsqMsgTracer = &LogMsgTracer{}
 }
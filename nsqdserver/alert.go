@@ -0,0 +1,146 @@
+package nsqdserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	alertWebhookQueue = 1000
+	maxAlertEvents    = 100
+)
+
+// AlertWebhookStats is the events posted to the webhook, failed or dropped since
+// the queue is full
+type AlertWebhookStats struct {
+	WebhookSent    int64 `json:"webhook_sent"`
+	WebhookFailed  int64 `json:"webhook_failed"`
+	WebhookDropped int64 `json:"webhook_dropped"`
+}
+
+// alertNotifier keeps the recent alert events and posts them to the webhook one
+// by one in background, so the check loop will never be blocked by the slow
+// webhook. It is shared by the slow disk and the slo checks.
+type alertNotifier struct {
+	sync.Mutex
+	webhookSent    int64
+	webhookFailed  int64
+	webhookDropped int64
+
+	name string
+	// returns the webhook url of the event, empty to disable
+	webhook   func(e interface{}) string
+	events    []interface{}
+	client    *http.Client
+	eventChan chan interface{}
+	exitChan  chan struct{}
+	wg        sync.WaitGroup
+}
+
+func newAlertNotifier(name string, webhook func(e interface{}) string) *alertNotifier {
+	return &alertNotifier{
+		name:      name,
+		webhook:   webhook,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		eventChan: make(chan interface{}, alertWebhookQueue),
+		exitChan:  make(chan struct{}),
+	}
+}
+
+func (n *alertNotifier) start() {
+	n.wg.Add(1)
+	go n.webhookLoop()
+}
+
+func (n *alertNotifier) stop() {
+	close(n.exitChan)
+	n.wg.Wait()
+}
+
+// notify records the event and queues it to the webhook
+func (n *alertNotifier) notify(e interface{}) {
+	n.Lock()
+	n.events = append(n.events, e)
+	if len(n.events) > maxAlertEvents {
+		n.events = n.events[len(n.events)-maxAlertEvents:]
+	}
+	n.Unlock()
+	if n.webhook(e) == "" {
+		return
+	}
+	select {
+	case n.eventChan <- e:
+	default:
+		atomic.AddInt64(&n.webhookDropped, 1)
+	}
+}
+
+func (n *alertNotifier) webhookLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case e := <-n.eventChan:
+			err := n.post(n.webhook(e), e)
+			if err != nil {
+				atomic.AddInt64(&n.webhookFailed, 1)
+				nsqd.NsqLogger().LogWarningf("post %v event %+v failed: %v", n.name, e, err)
+				continue
+			}
+			atomic.AddInt64(&n.webhookSent, 1)
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
+func (n *alertNotifier) post(url string, e interface{}) error {
+	if url == "" {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	rsp, err := n.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %v response: %v", url, rsp.Status)
+	}
+	return nil
+}
+
+// recentEvents returns the copy of the recent events, the oldest first
+func (n *alertNotifier) recentEvents() []interface{} {
+	n.Lock()
+	defer n.Unlock()
+	events := make([]interface{}, len(n.events))
+	copy(events, n.events)
+	return events
+}
+
+func (n *alertNotifier) getWebhookStats() AlertWebhookStats {
+	return AlertWebhookStats{
+		WebhookSent:    atomic.LoadInt64(&n.webhookSent),
+		WebhookFailed:  atomic.LoadInt64(&n.webhookFailed),
+		WebhookDropped: atomic.LoadInt64(&n.webhookDropped),
+	}
+}
+
+// getAlertNode returns the node id in the alert events
+func (c *context) getAlertNode() string {
+	node := c.GetDistributedID()
+	if node == "" {
+		node = c.getOpts().BroadcastAddress
+	}
+	return node
+}
@@ -0,0 +1,220 @@
+package nsqdserver
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	simpleJson "github.com/bitly/go-simplejson"
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	archiveRestoreBatch = 100
+	// the default replay tag of the restored messages, so the channel replay
+	// rate limit can be applied
+	defaultArchiveReplayTag = "archive"
+)
+
+var (
+	errRestoreNotLeader = errors.New("not leader for the restore target topic")
+	errRestoreRunning   = errors.New("a restore is already running for the topic")
+	errRestoreNotFound  = errors.New("restore not found")
+)
+
+// ArchiveRestoreResult is the status of the restore running in background, the
+// state is the same as the re-drive job.
+type ArchiveRestoreResult struct {
+	Topic       string `json:"topic"`
+	Partition   int    `json:"partition"`
+	State       string `json:"state"`
+	Error       string `json:"error,omitempty"`
+	Restored    int64  `json:"restored"`
+	StartOffset int64  `json:"start_offset"`
+	// the next offset to restore from if the restore is interrupted
+	EndOffset int64 `json:"end_offset"`
+	StartTime int64 `json:"start_time"`
+	EndTime   int64 `json:"end_time,omitempty"`
+}
+
+type archiveRestoreJob struct {
+	sync.Mutex
+	result   ArchiveRestoreResult
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+func (j *archiveRestoreJob) stop() {
+	j.stopOnce.Do(func() {
+		close(j.stopChan)
+	})
+}
+
+func (j *archiveRestoreJob) Status() ArchiveRestoreResult {
+	j.Lock()
+	defer j.Unlock()
+	return j.result
+}
+
+func (j *archiveRestoreJob) finish(err error) {
+	j.Lock()
+	defer j.Unlock()
+	j.result.EndTime = time.Now().Unix()
+	if err == nil {
+		j.result.State = redriveStateDone
+	} else if err == errRedriveStopped {
+		j.result.State = redriveStateStopped
+		j.result.Error = err.Error()
+	} else {
+		j.result.State = redriveStateFailed
+		j.result.Error = err.Error()
+	}
+}
+
+// archiveRestoreManager keeps the last restore of each source topic partition,
+// only one restore can be running for the same source.
+type archiveRestoreManager struct {
+	sync.Mutex
+	ctx  *context
+	jobs map[string]*archiveRestoreJob
+}
+
+func newArchiveRestoreManager(ctx *context) *archiveRestoreManager {
+	return &archiveRestoreManager{
+		ctx:  ctx,
+		jobs: make(map[string]*archiveRestoreJob),
+	}
+}
+
+func (m *archiveRestoreManager) start(source *nsqd.Topic, target *nsqd.Topic,
+	start nsqd.BackendOffset, end nsqd.BackendOffset, replayTag string) (*archiveRestoreJob, error) {
+	m.Lock()
+	if j, ok := m.jobs[source.GetFullName()]; ok && j.Status().State == redriveStateRunning {
+		m.Unlock()
+		return nil, errRestoreRunning
+	}
+	job := &archiveRestoreJob{
+		result: ArchiveRestoreResult{
+			Topic:       target.GetTopicName(),
+			Partition:   target.GetTopicPart(),
+			State:       redriveStateRunning,
+			StartOffset: int64(start),
+			EndOffset:   int64(start),
+			StartTime:   time.Now().Unix(),
+		},
+		stopChan: make(chan struct{}),
+	}
+	m.jobs[source.GetFullName()] = job
+	m.Unlock()
+
+	go func() {
+		err := m.ctx.restoreArchived(job, source, target, start, end, replayTag)
+		job.finish(err)
+		st := job.Status()
+		if err != nil {
+			nsqd.NsqLogger().LogErrorf("topic %v restore archive failed at %v: %v", source.GetFullName(), st.EndOffset, err)
+		} else {
+			nsqd.NsqLogger().Logf("topic %v restored %v archived messages to %v", source.GetFullName(), st.Restored, target.GetFullName())
+		}
+	}()
+	return job, nil
+}
+
+func (m *archiveRestoreManager) getStatus(sourceFullName string) (ArchiveRestoreResult, error) {
+	m.Lock()
+	job, ok := m.jobs[sourceFullName]
+	m.Unlock()
+	if !ok {
+		return ArchiveRestoreResult{}, errRestoreNotFound
+	}
+	return job.Status(), nil
+}
+
+func (m *archiveRestoreManager) stopAll() {
+	m.Lock()
+	for _, j := range m.jobs {
+		j.stop()
+	}
+	m.Unlock()
+}
+
+// newRestoredMessage copies the archived message to the target topic, the json header
+// of the message is tagged with the replay key if the target is the ext topic.
+func newRestoredMessage(target *nsqd.Topic, msg *nsqd.Message, replayTag string) *nsqd.Message {
+	if !target.IsExt() {
+		return nsqd.NewMessage(0, msg.Body)
+	}
+	extVer := msg.ExtVer
+	extBytes := msg.ExtBytes
+	if replayTag != "" && (extVer == ext.NO_EXT_VER || extVer == ext.JSON_HEADER_EXT_VER) {
+		jsonExt := simpleJson.New()
+		if extVer == ext.JSON_HEADER_EXT_VER && len(extBytes) > 0 {
+			if j, err := simpleJson.NewJson(extBytes); err == nil {
+				jsonExt = j
+			}
+		}
+		jsonExt.Set(ext.REPLAY_KEY, replayTag)
+		if b, err := jsonExt.MarshalJSON(); err == nil {
+			extVer = ext.JSON_HEADER_EXT_VER
+			extBytes = b
+		}
+	}
+	newMsg := nsqd.NewMessageWithExt(0, msg.Body, extVer, extBytes)
+	newMsg.TraceID = msg.TraceID
+	return newMsg
+}
+
+// restoreArchived re-publishes the archived messages in [start, end) of the source
+// topic to the target topic in batch, the target should be the leader on this node.
+// The end offset of the job is updated after each batch so the restore can be
+// resumed from it.
+func (c *context) restoreArchived(job *archiveRestoreJob, source *nsqd.Topic, target *nsqd.Topic,
+	start nsqd.BackendOffset, end nsqd.BackendOffset, replayTag string) error {
+	batch := make([]*nsqd.Message, 0, archiveRestoreBatch)
+	var nextOffset nsqd.BackendOffset
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if !c.checkForMasterWrite(target.GetTopicName(), target.GetTopicPart()) {
+			return errRestoreNotLeader
+		}
+		_, _, _, err := c.PutMessages(target, batch)
+		if err != nil {
+			return err
+		}
+		job.Lock()
+		job.result.Restored += int64(len(batch))
+		job.result.EndOffset = int64(nextOffset)
+		job.Unlock()
+		batch = batch[:0]
+		return nil
+	}
+	err := source.ReadArchivedMessages(start, end, func(msg *nsqd.Message, offset nsqd.BackendOffset) error {
+		select {
+		case <-job.stopChan:
+			return errRedriveStopped
+		default:
+		}
+		if len(batch) >= archiveRestoreBatch {
+			nextOffset = offset
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, newRestoredMessage(target, msg, replayTag))
+		return nil
+	})
+	if err == nil {
+		segs := source.GetArchivedSegments()
+		if len(segs) > 0 {
+			nextOffset = nsqd.BackendOffset(segs[len(segs)-1].EndOffset)
+		}
+		if end > 0 && end < nextOffset {
+			nextOffset = end
+		}
+		err = flush()
+	}
+	return err
+}
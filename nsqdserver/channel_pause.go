@@ -0,0 +1,59 @@
+package nsqdserver
+
+import (
+	"time"
+
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	channelPauseCheckInterval = time.Second
+	maxChannelPauseReasonLen  = 1024
+)
+
+func (n *NsqdServer) channelPauseLoop() {
+	ticker := time.NewTicker(channelPauseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			n.ctx.resumeExpiredChannels(now)
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
+// resumeExpiredChannels resumes the channels paused with the duration expired, only the
+// leader resumes the channel and the pause state is synced to the replicas.
+func (c *context) resumeExpiredChannels(now time.Time) int {
+	resumed := 0
+	for _, topicParts := range c.nsqd.GetTopicMapCopy() {
+		for _, t := range topicParts {
+			if !c.checkForMasterWrite(t.GetTopicName(), t.GetTopicPart()) {
+				continue
+			}
+			changed := false
+			for _, ch := range t.GetChannelMapCopy() {
+				if !ch.IsPauseExpired(now) {
+					continue
+				}
+				until, reason := ch.GetPauseInfo()
+				err := c.UpdateChannelState(ch, 0, -1)
+				if err != nil {
+					nsqd.NsqLogger().LogWarningf("topic %v channel %v failed to resume after paused until %v: %v",
+						t.GetFullName(), ch.GetName(), until, err)
+					continue
+				}
+				nsqd.NsqLogger().Logf("topic %v channel %v resumed automatically after paused until %v for %v",
+					t.GetFullName(), ch.GetName(), until, reason)
+				changed = true
+				resumed++
+			}
+			if changed {
+				t.SaveChannelMeta()
+			}
+		}
+	}
+	return resumed
+}
@@ -0,0 +1,29 @@
+package nsqdserver
+
+import (
+	"time"
+
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	connDeadlineCheckInterval = time.Second
+	// the max lifetime is extended randomly up to the ratio for each connection
+	maxConnLifetimeJitter = 0.1
+)
+
+// checkConnDeadline returns the disconnect reason if the connection should be closed
+// for the max lifetime or the producer idle timeout.
+func (p *protocolV2) checkConnDeadline(client *nsqd.ClientV2, now time.Time, jitter float64) string {
+	opts := p.ctx.getOpts()
+	if opts.MaxConnLifetime > 0 {
+		lifetime := opts.MaxConnLifetime + time.Duration(float64(opts.MaxConnLifetime)*jitter)
+		if now.Sub(client.ConnectTime) >= lifetime {
+			return nsqd.DisconnectMaxLifetime
+		}
+	}
+	if opts.ProducerIdleTimeout > 0 && client.IsIdleProducer(opts.ProducerIdleTimeout, now) {
+		return nsqd.DisconnectIdleTimeout
+	}
+	return ""
+}
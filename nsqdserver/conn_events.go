@@ -0,0 +1,106 @@
+package nsqdserver
+
+import (
+	"time"
+
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	ConnEventConnected    = "connected"
+	ConnEventDisconnected = "disconnected"
+)
+
+// ConnEvent is the event of the tcp client connection, the disconnected event
+// has the reason why the connection ended.
+type ConnEvent struct {
+	Time       int64  `json:"time"`
+	Type       string `json:"type"`
+	Node       string `json:"node"`
+	ID         int64  `json:"id"`
+	RemoteAddr string `json:"remote_address"`
+	ClientID   string `json:"client_id,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	Identity   string `json:"identity,omitempty"`
+	Topic      string `json:"topic,omitempty"`
+	Channel    string `json:"channel,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+}
+
+type ConnEventsStatus struct {
+	Events []ConnEvent `json:"events"`
+	AlertWebhookStats
+}
+
+// connEventManager keeps the recent connection events and posts them to the
+// connection event webhook if set.
+type connEventManager struct {
+	ctx      *context
+	notifier *alertNotifier
+}
+
+func newConnEventManager(ctx *context) *connEventManager {
+	return &connEventManager{
+		ctx: ctx,
+		notifier: newAlertNotifier("connection", func(e interface{}) string {
+			return ctx.getOpts().ConnEventWebhook
+		}),
+	}
+}
+
+func (m *connEventManager) start() {
+	m.notifier.start()
+}
+
+func (m *connEventManager) stop() {
+	m.notifier.stop()
+}
+
+func (m *connEventManager) newEvent(client *nsqd.ClientV2, eventType string) ConnEvent {
+	return ConnEvent{
+		Time:       time.Now().UnixNano(),
+		Type:       eventType,
+		Node:       m.ctx.getAlertNode(),
+		ID:         client.ID,
+		RemoteAddr: client.String(),
+	}
+}
+
+// connected and disconnected are ignored if the manager is not created, such as
+// the protocol is used without the server.
+func (m *connEventManager) connected(client *nsqd.ClientV2) {
+	if m == nil {
+		return
+	}
+	m.notifier.notify(m.newEvent(client, ConnEventConnected))
+}
+
+func (m *connEventManager) disconnected(client *nsqd.ClientV2, reason string) {
+	if m == nil {
+		return
+	}
+	e := m.newEvent(client, ConnEventDisconnected)
+	e.ClientID = client.ClientID
+	e.UserAgent = client.UserAgent
+	e.Identity = client.GetIdentity()
+	if client.Channel != nil {
+		e.Topic = client.Channel.GetTopicName()
+		e.Channel = client.Channel.GetName()
+	}
+	e.Reason = reason
+	e.DurationMs = int64(time.Since(client.ConnectTime) / time.Millisecond)
+	m.notifier.notify(e)
+}
+
+func (m *connEventManager) getStatus() *ConnEventsStatus {
+	events := m.notifier.recentEvents()
+	s := &ConnEventsStatus{
+		Events: make([]ConnEvent, 0, len(events)),
+	}
+	for _, e := range events {
+		s.Events = append(s.Events, e.(ConnEvent))
+	}
+	s.AlertWebhookStats = m.notifier.getWebhookStats()
+	return s
+}
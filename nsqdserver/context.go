@@ -17,6 +17,8 @@ const (
 	FailedOnNotWritable = consistence.ErrFailedOnNotWritable
 )
 
+var ErrReadOnlyRecovery = errors.New("nsqd is in read only recovery mode")
+
 type context struct {
 	clientIDSequence int64
 	nsqd             *nsqd.NSQD
@@ -25,6 +27,14 @@ type context struct {
 	httpAddr         *net.TCPAddr
 	tcpAddr          *net.TCPAddr
 	reverseProxyPort string
+	redriveMgr       *redriveManager
+	restoreMgr       *archiveRestoreManager
+	drainMgr         *drainManager
+	mirrorMgr        *mirrorManager
+	slowDiskMgr      *slowDiskManager
+	latencySLOMgr    *latencySLOManager
+	connEventMgr     *connEventManager
+	selfTester       *selfTester
 }
 
 func (c *context) getOpts() *nsqd.Options {
@@ -35,6 +45,22 @@ func (c *context) isAuthEnabled() bool {
 	return c.nsqd.IsAuthEnabled()
 }
 
+func (c *context) checkACL(identity string, topicName string, op string) bool {
+	return c.nsqd.CheckACL(identity, topicName, op)
+}
+
+func (c *context) getACLDeniedStats() map[string]int64 {
+	return c.nsqd.GetACLDeniedTotalStats()
+}
+
+func (c *context) getProtocolStats() []nsqd.ProtocolStats {
+	return c.nsqd.GetProtocolStats()
+}
+
+func (c *context) getConnLimitStats() nsqd.ConnLimitStats {
+	return c.nsqd.GetConnLimitStats()
+}
+
 func (c *context) nextClientID() int64 {
 	return atomic.AddInt64(&c.clientIDSequence, 1)
 }
@@ -79,6 +105,31 @@ func (c *context) getStats(leaderOnly bool, selectedTopic string, filterClients
 	return c.nsqd.GetStats(leaderOnly, filterClients)
 }
 
+// getNamespaceStats rolls up the topic stats by the namespace with the quota, the
+// namespace with the quota but no topic is included. Only the given namespace is
+// returned if not empty.
+func (c *context) getNamespaceStats(stats []nsqd.TopicStats, namespace string) []nsqd.NamespaceStats {
+	rollups := nsqd.GetNamespaceStats(stats)
+	existed := make(map[string]bool, len(rollups))
+	for _, r := range rollups {
+		existed[r.Namespace] = true
+	}
+	for ns := range c.nsqd.GetNamespaceQuotas() {
+		if !existed[ns] {
+			rollups = append(rollups, nsqd.NamespaceStats{Namespace: ns})
+		}
+	}
+	ret := make([]nsqd.NamespaceStats, 0, len(rollups))
+	for _, r := range rollups {
+		if namespace != "" && r.Namespace != namespace {
+			continue
+		}
+		c.nsqd.FillNamespaceQuotaStats(&r)
+		ret = append(ret, r)
+	}
+	return ret
+}
+
 func (c *context) GetTlsConfig() *tls.Config {
 	return c.tlsConfig
 }
@@ -125,15 +176,59 @@ func (c *context) GetDistributedID() string {
 	return c.nsqdCoord.GetMyID()
 }
 
-func (c *context) checkForMasterWrite(topic string, part int) bool {
+// isLocalTopic returns true if the topic is written and consumed locally without the
+// cluster coordinator, which is the standalone mode or the hidden topic.
+func (c *context) isLocalTopic(topic string) bool {
+	return c.nsqdCoord == nil || nsqd.IsHiddenTopic(topic)
+}
+
+// checkPubBackpressure returns the retry after if the publish to the topic should be
+// rejected by the backlog watermark.
+func (c *context) checkPubBackpressure(topic *nsqd.Topic) (time.Duration, bool) {
+	opts := c.getOpts()
+	if !topic.CheckPubBackpressure(opts.PubBackpressureDepth, opts.PubBackpressureBytes, time.Now()) {
+		return 0, false
+	}
+	return opts.PubBackpressureRetryAfter, true
+}
+
+// checkClusterFeature returns the error if the new feature should not be enabled
+// before all the nodes in cluster are upgraded.
+func (c *context) checkClusterFeature(name string) error {
 	if c.nsqdCoord == nil {
+		return nil
+	}
+	return c.nsqdCoord.CheckClusterFeature(name)
+}
+
+func (c *context) checkForMasterWrite(topic string, part int) bool {
+	if c.isLocalTopic(topic) {
 		return true
 	}
 	return c.nsqdCoord.IsMineLeaderForTopic(topic, part)
 }
 
+// isReadOnly returns true if nsqd is started in read only recovery mode, in which
+// the existing data can be consumed but any write to the topic is rejected.
+func (c *context) isReadOnly() bool {
+	return c.getOpts().ReadOnlyRecovery
+}
+
+// isDraining returns true if the node is draining for decommissioning, no new client
+// connection is accepted and no new message is delivered.
+func (c *context) isDraining() bool {
+	return c.drainMgr != nil && c.drainMgr.isDraining()
+}
+
+func (c *context) isDrained() bool {
+	return c.drainMgr != nil && c.drainMgr.isDrained()
+}
+
 func (c *context) PutMessageObj(topic *nsqd.Topic,
 	msg *nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
+	if c.isReadOnly() {
+		return 0, 0, 0, nil, ErrReadOnlyRecovery
+	}
 	if c.nsqdCoord == nil {
 		if msg.DelayedType >= nsqd.MinDelayedType {
 			topic.Lock()
@@ -168,14 +263,20 @@ func (c *context) PutMessage(topic *nsqd.Topic,
 	}
 	msg.TraceID = traceID
 
-	if c.nsqdCoord == nil {
+	if c.isReadOnly() {
+		return 0, 0, 0, nil, ErrReadOnlyRecovery
+	}
+	if c.isLocalTopic(topic.GetTopicName()) {
 		return topic.PutMessage(msg)
 	}
 	return c.nsqdCoord.PutMessageToCluster(topic, msg)
 }
 
 func (c *context) PutMessages(topic *nsqd.Topic, msgs []*nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
-	if c.nsqdCoord == nil {
+	if c.isReadOnly() {
+		return 0, 0, 0, ErrReadOnlyRecovery
+	}
+	if c.isLocalTopic(topic.GetTopicName()) {
 		id, offset, rawSize, _, _, err := topic.PutMessages(msgs)
 		return id, offset, rawSize, err
 	}
@@ -183,7 +284,7 @@ func (c *context) PutMessages(topic *nsqd.Topic, msgs []*nsqd.Message) (nsqd.Mes
 }
 
 func (c *context) FinishMessageForce(ch *nsqd.Channel, msgID nsqd.MessageID) error {
-	if c.nsqdCoord == nil {
+	if c.isLocalTopic(ch.GetTopicName()) {
 		_, _, _, _, err := ch.FinishMessageForce(0, "", msgID, true)
 		if err == nil {
 			ch.ContinueConsumeForOrder()
@@ -194,7 +295,7 @@ func (c *context) FinishMessageForce(ch *nsqd.Channel, msgID nsqd.MessageID) err
 }
 
 func (c *context) FinishMessage(ch *nsqd.Channel, clientID int64, clientAddr string, msgID nsqd.MessageID) error {
-	if c.nsqdCoord == nil {
+	if c.isLocalTopic(ch.GetTopicName()) {
 		_, _, _, _, err := ch.FinishMessage(clientID, clientAddr, msgID)
 		if err == nil {
 			ch.ContinueConsumeForOrder()
@@ -205,6 +306,9 @@ func (c *context) FinishMessage(ch *nsqd.Channel, clientID int64, clientAddr str
 }
 
 func (c *context) DeleteExistingChannel(topic *nsqd.Topic, channelName string) error {
+	if c.isReadOnly() {
+		return ErrReadOnlyRecovery
+	}
 	if c.nsqdCoord == nil {
 		err := topic.DeleteExistingChannel(channelName)
 		if err == nil {
@@ -216,11 +320,24 @@ func (c *context) DeleteExistingChannel(topic *nsqd.Topic, channelName string) e
 }
 
 func (c *context) UpdateChannelState(ch *nsqd.Channel, paused int, skipped int) error {
+	return c.updateChannelState(ch, paused, skipped, time.Time{}, "")
+}
+
+// PauseChannel pauses the channel with the time to resume automatically and the reason,
+// the zero time means paused until resumed manually.
+func (c *context) PauseChannel(ch *nsqd.Channel, until time.Time, reason string) error {
+	return c.updateChannelState(ch, 1, -1, until, reason)
+}
+
+func (c *context) updateChannelState(ch *nsqd.Channel, paused int, skipped int, pausedUntil time.Time, pausedReason string) error {
 	var err error
 	if c.nsqdCoord == nil {
 		switch paused {
 		case 1:
 			err = ch.Pause()
+			if err == nil {
+				ch.SetPauseInfo(pausedUntil, pausedReason)
+			}
 		case 0:
 			err = ch.UnPause()
 		}
@@ -233,7 +350,7 @@ func (c *context) UpdateChannelState(ch *nsqd.Channel, paused int, skipped int)
 		}
 
 	} else {
-		err = c.nsqdCoord.UpdateChannelStateToCluster(ch, paused, skipped)
+		err = c.nsqdCoord.UpdateChannelStateToCluster(ch, paused, skipped, pausedUntil, pausedReason)
 	}
 	if err != nil {
 		nsqd.NsqLogger().Logf("failed to update channel(%v) state pause: %v, skip: %v, topic %v, err: %v", ch.GetName(), paused, skipped, ch.GetTopicName(), err)
@@ -243,6 +360,9 @@ func (c *context) UpdateChannelState(ch *nsqd.Channel, paused int, skipped int)
 }
 
 func (c *context) EmptyChannelDelayedQueue(ch *nsqd.Channel) error {
+	if c.isReadOnly() {
+		return ErrReadOnlyRecovery
+	}
 	if c.nsqdCoord == nil {
 		if ch.GetDelayedQueue() != nil {
 			err := ch.GetDelayedQueue().EmptyDelayedChannel(ch.GetName())
@@ -262,6 +382,9 @@ func (c *context) EmptyChannelDelayedQueue(ch *nsqd.Channel) error {
 }
 
 func (c *context) SetChannelOffset(ch *nsqd.Channel, startFrom *ConsumeOffset, force bool) (int64, int64, error) {
+	if c.isReadOnly() {
+		return 0, 0, ErrReadOnlyRecovery
+	}
 	var l *consistence.CommitLogData
 	var queueOffset int64
 	cnt := int64(0)
@@ -329,6 +452,23 @@ func (c *context) SetChannelOffset(ch *nsqd.Channel, startFrom *ConsumeOffset, f
 	return queueOffset, cnt, nil
 }
 
+// SetChannelOffsetToOldest resets the channel to consume from the oldest data not cleaned
+func (c *context) SetChannelOffsetToOldest(topic *nsqd.Topic, ch *nsqd.Channel) (int64, int64, error) {
+	if c.isReadOnly() {
+		return 0, 0, ErrReadOnlyRecovery
+	}
+	snap := topic.GetDiskQueueSnapshot()
+	start := snap.GetQueueReadStart()
+	snap.Close()
+	var err error
+	if c.nsqdCoord == nil {
+		err = ch.SetConsumeOffset(start.Offset(), start.TotalMsgCnt(), true)
+	} else {
+		err = c.nsqdCoord.SetChannelConsumeOffsetToCluster(ch, int64(start.Offset()), start.TotalMsgCnt(), true)
+	}
+	return int64(start.Offset()), start.TotalMsgCnt(), err
+}
+
 func (c *context) internalPubLoop(topic *nsqd.Topic) {
 	messages := make([]*nsqd.Message, 0, 100)
 	pubInfoList := make([]*nsqd.PubInfo, 0, 100)
@@ -455,9 +595,21 @@ func (c *context) internalRequeueToEnd(ch *nsqd.Channel,
 	return err
 }
 
+// GreedyCleanTopicOldData cleans the consumed data beyond the retention, the data
+// is never cleaned in read only recovery mode since it is being verified.
 func (c *context) GreedyCleanTopicOldData(topic *nsqd.Topic) error {
+	if c.isReadOnly() {
+		return ErrReadOnlyRecovery
+	}
 	if c.nsqdCoord != nil {
 		return c.nsqdCoord.GreedyCleanTopicOldData(topic)
 	}
 	return nil
 }
+
+func (c *context) TransferTopicLeader(topic *nsqd.Topic, newLeader string, timeout time.Duration) error {
+	if c.nsqdCoord == nil {
+		return errors.New("leader transfer is only supported in cluster mode")
+	}
+	return c.nsqdCoord.TransferTopicLeader(topic.GetTopicName(), topic.GetTopicPart(), newLeader, timeout)
+}
@@ -0,0 +1,341 @@
+package nsqdserver
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	drainStateNone = "none"
+	// transferring the topic leaders to the other nodes
+	drainStateTransferring = "transferring"
+	// waiting the in-flight messages finished
+	drainStateDraining = "draining"
+	// flushing the data and leaving the cluster
+	drainStateLeaving = "leaving"
+	drainStateDrained = "drained"
+
+	defaultDrainTimeout = 5 * time.Minute
+	// the timeout to wait each topic leader transferred
+	drainTransferTimeout = 10 * time.Second
+)
+
+var (
+	errDrainStarted    = errors.New("drain already started")
+	errDrainNotStarted = errors.New("drain not started")
+	errDrainLeft       = errors.New("the node already left the cluster")
+	errDrainTimeout    = errors.New("drain timeout")
+)
+
+type TopicDrainStatus struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	InFlight  int64  `json:"in_flight"`
+	Depth     int64  `json:"depth"`
+	// whether the topic leader is still on this node
+	Leader        bool   `json:"leader"`
+	TransferError string `json:"transfer_error,omitempty"`
+}
+
+type DrainStatus struct {
+	State     string             `json:"state"`
+	StartTime int64              `json:"start_time,omitempty"`
+	EndTime   int64              `json:"end_time,omitempty"`
+	Error     string             `json:"error,omitempty"`
+	TimedOut  bool               `json:"timed_out"`
+	Clients   int64              `json:"clients"`
+	InFlight  int64              `json:"in_flight"`
+	Depth     int64              `json:"depth"`
+	Topics    []TopicDrainStatus `json:"topics"`
+}
+
+// drainManager prepares the node for decommissioning: no new topic leadership is
+// accepted and the topic leaders will be transferred to the other nodes one by one
+// first, then no new client connections and publishes are accepted, no new messages
+// are delivered, the node leaves the cluster after the in-flight messages finished.
+// The drain can be canceled to serve again before leaving the cluster.
+type drainManager struct {
+	sync.Mutex
+	ctx          *context
+	draining     int32
+	leftCluster  bool
+	state        string
+	startTime    time.Time
+	endTime      time.Time
+	err          error
+	timedOut     bool
+	transferErrs map[string]string
+	cancelChan   chan struct{}
+	exitChan     chan struct{}
+	exitOnce     sync.Once
+	wg           sync.WaitGroup
+}
+
+func newDrainManager(ctx *context) *drainManager {
+	return &drainManager{
+		ctx:      ctx,
+		state:    drainStateNone,
+		exitChan: make(chan struct{}),
+	}
+}
+
+func (m *drainManager) isDraining() bool {
+	return atomic.LoadInt32(&m.draining) == 1
+}
+
+func (m *drainManager) start(timeout time.Duration) error {
+	m.Lock()
+	if m.state != drainStateNone {
+		m.Unlock()
+		return errDrainStarted
+	}
+	m.state = drainStateTransferring
+	m.startTime = time.Now()
+	m.endTime = time.Time{}
+	m.err = nil
+	m.timedOut = false
+	m.transferErrs = make(map[string]string)
+	m.cancelChan = make(chan struct{})
+	cancelChan := m.cancelChan
+	m.Unlock()
+
+	if m.ctx.nsqdCoord != nil {
+		m.ctx.nsqdCoord.SetDraining(true)
+	}
+	nsqd.NsqLogger().Logf("start draining the node, timeout: %v", timeout)
+	m.wg.Add(1)
+	go m.run(timeout, cancelChan)
+	return nil
+}
+
+// cancel stops the drain and the node will serve again, the topic leaders already
+// transferred will not be moved back. The node left the cluster can not be canceled.
+func (m *drainManager) cancel() error {
+	m.Lock()
+	if m.leftCluster {
+		m.Unlock()
+		return errDrainLeft
+	}
+	if m.state == drainStateNone || m.cancelChan == nil {
+		m.Unlock()
+		return errDrainNotStarted
+	}
+	close(m.cancelChan)
+	m.cancelChan = nil
+	m.Unlock()
+	m.wg.Wait()
+
+	if m.ctx.nsqdCoord != nil {
+		m.ctx.nsqdCoord.SetDraining(false)
+	}
+	atomic.StoreInt32(&m.draining, 0)
+	m.setState(drainStateNone, nil)
+	// register to the lookup again
+	m.ctx.nsqd.TriggerOptsNotification()
+	nsqd.NsqLogger().Logf("the drain is canceled")
+	return nil
+}
+
+func (m *drainManager) stop() {
+	m.exitOnce.Do(func() {
+		close(m.exitChan)
+	})
+	m.wg.Wait()
+}
+
+func (m *drainManager) setState(state string, err error) {
+	m.Lock()
+	m.state = state
+	if err != nil {
+		m.err = err
+	}
+	if state == drainStateDrained {
+		m.endTime = time.Now()
+	}
+	m.Unlock()
+}
+
+func (m *drainManager) setTimedOut() {
+	m.Lock()
+	m.timedOut = true
+	m.Unlock()
+}
+
+func (m *drainManager) run(timeout time.Duration, cancelChan chan struct{}) {
+	defer m.wg.Done()
+	deadline := time.Now().Add(timeout)
+	var err error
+	// transfer the leaders before halting, so the clients can publish and consume
+	// on the new leaders while this node is draining.
+	nsqd.NsqLogger().Logf("draining the node, transferring the topic leaders")
+transferLoop:
+	for _, topicParts := range m.ctx.nsqd.GetTopicMapCopy() {
+		for _, t := range topicParts {
+			select {
+			case <-cancelChan:
+				return
+			case <-m.exitChan:
+				return
+			default:
+			}
+			if !time.Now().Before(deadline) {
+				// the remaining leaders will be released while leaving the cluster
+				nsqd.NsqLogger().LogWarningf("drain timeout while transferring the topic leaders")
+				m.setTimedOut()
+				if err == nil {
+					err = errors.New("timeout while transferring the topic leaders")
+				}
+				break transferLoop
+			}
+			if transferErr := m.transferLeader(t, deadline); transferErr != nil {
+				nsqd.NsqLogger().LogWarningf("drain topic %v failed to transfer leader: %v", t.GetFullName(), transferErr)
+				m.Lock()
+				m.transferErrs[t.GetFullName()] = transferErr.Error()
+				m.Unlock()
+				if err == nil {
+					err = errors.New("failed to transfer some topic leaders")
+				}
+			}
+		}
+	}
+
+	atomic.StoreInt32(&m.draining, 1)
+	m.setState(drainStateDraining, err)
+	nsqd.NsqLogger().Logf("draining the topic leaders transferred, waiting the in-flight messages finished")
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		s := m.collectStatus()
+		if s.InFlight == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			// continue leaving since the node is going to be killed anyway
+			timeoutErr := fmt.Errorf("timeout while %v messages in flight", s.InFlight)
+			nsqd.NsqLogger().LogWarningf("drain %v", timeoutErr)
+			m.setTimedOut()
+			if err == nil {
+				err = timeoutErr
+			}
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-cancelChan:
+			return
+		case <-m.exitChan:
+			return
+		}
+	}
+
+	m.Lock()
+	select {
+	case <-cancelChan:
+		m.Unlock()
+		return
+	default:
+	}
+	m.leftCluster = m.ctx.nsqdCoord != nil
+	m.Unlock()
+	m.setState(drainStateLeaving, err)
+	nsqd.NsqLogger().Logf("draining in-flight finished, flushing and leaving the cluster")
+	for _, topicParts := range m.ctx.nsqd.GetTopicMapCopy() {
+		for _, t := range topicParts {
+			t.ForceFlush()
+		}
+	}
+	if m.ctx.nsqdCoord != nil {
+		// leave the isr of all the topics and unregister from the lookup, the
+		// leaders failed to transfer will be released here.
+		m.ctx.nsqdCoord.LeaveCluster()
+	}
+	// the lookup loop will remove all the lookup peers while drained
+	m.setState(drainStateDrained, err)
+	m.ctx.nsqd.TriggerOptsNotification()
+	nsqd.NsqLogger().Logf("the node is drained")
+}
+
+// transferLeader moves the topic leader on this node to the other node in isr, the
+// node keeps as the replica of the topic. Each transfer waits at most drainTransferTimeout
+// and never exceeds the drain deadline.
+func (m *drainManager) transferLeader(t *nsqd.Topic, deadline time.Time) error {
+	if m.ctx.nsqdCoord == nil || !m.ctx.checkForMasterWrite(t.GetTopicName(), t.GetTopicPart()) {
+		return nil
+	}
+	isr, err := m.ctx.nsqdCoord.GetTopicISR(t.GetTopicName(), t.GetTopicPart())
+	if err != nil {
+		return err
+	}
+	err = errNoOtherISR
+	for _, node := range isr {
+		if node == m.ctx.nsqdCoord.GetMyID() {
+			continue
+		}
+		timeout := deadline.Sub(time.Now())
+		if timeout <= 0 {
+			return errDrainTimeout
+		}
+		if timeout > drainTransferTimeout {
+			timeout = drainTransferTimeout
+		}
+		err = m.ctx.TransferTopicLeader(t, node, timeout)
+		if err == nil {
+			nsqd.NsqLogger().Logf("drain topic %v leader transferred to %v", t.GetFullName(), node)
+			return nil
+		}
+	}
+	return err
+}
+
+func (m *drainManager) isDrained() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.state == drainStateDrained
+}
+
+// collectStatus returns the remaining in-flight and depth for each topic
+func (m *drainManager) collectStatus() *DrainStatus {
+	s := &DrainStatus{}
+	m.Lock()
+	s.State = m.state
+	if !m.startTime.IsZero() {
+		s.StartTime = m.startTime.Unix()
+	}
+	if !m.endTime.IsZero() {
+		s.EndTime = m.endTime.Unix()
+	}
+	if m.err != nil {
+		s.Error = m.err.Error()
+	}
+	s.TimedOut = m.timedOut
+	transferErrs := m.transferErrs
+	m.Unlock()
+
+	s.Topics = make([]TopicDrainStatus, 0)
+	for _, topicParts := range m.ctx.nsqd.GetTopicMapCopy() {
+		for _, t := range topicParts {
+			ts := TopicDrainStatus{
+				Topic:     t.GetTopicName(),
+				Partition: t.GetTopicPart(),
+				Leader:    m.ctx.checkForMasterWrite(t.GetTopicName(), t.GetTopicPart()),
+			}
+			m.Lock()
+			ts.TransferError = transferErrs[t.GetFullName()]
+			m.Unlock()
+			for _, ch := range t.GetChannelMapCopy() {
+				ts.InFlight += int64(ch.GetInFlightCount())
+				ts.Depth += ch.Depth()
+				s.Clients += int64(ch.GetClientsCount())
+			}
+			s.InFlight += ts.InFlight
+			s.Depth += ts.Depth
+			s.Topics = append(s.Topics, ts)
+		}
+	}
+	return s
+}
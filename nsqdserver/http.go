@@ -2,6 +2,7 @@ package nsqdserver
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -20,11 +21,13 @@ import (
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/youzan/nsq/consistence"
+	"github.com/youzan/nsq/internal/auth"
 	"github.com/youzan/nsq/internal/clusterinfo"
 	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/internal/http_api"
 	"github.com/youzan/nsq/internal/levellogger"
 	"github.com/youzan/nsq/internal/protocol"
+	"github.com/youzan/nsq/internal/protoenc"
 	"github.com/youzan/nsq/internal/version"
 	"github.com/youzan/nsq/nsqd"
 )
@@ -54,8 +57,19 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	}
 
 	router.Handle("GET", "/ping", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
+	router.Handle("GET", "/selftest", http_api.Decorate(s.doSelfTest, log, http_api.V1))
+	router.Handle("GET", "/error_codes", http_api.Decorate(s.doErrorCodes, log, http_api.V1))
 	router.Handle("POST", "/loglevel/set", http_api.Decorate(s.doSetLogLevel, log, http_api.V1))
+	router.Handle("GET", "/loglevel", http_api.Decorate(s.doGetLogLevel, log, http_api.V1))
 	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, log, http_api.NegotiateVersion))
+	router.Handle("POST", "/drain", http_api.Decorate(s.doStartDrain, log, http_api.V1))
+	router.Handle("GET", "/drain/status", http_api.Decorate(s.doDrainStatus, log, http_api.V1))
+	router.Handle("POST", "/drain/cancel", http_api.Decorate(s.doCancelDrain, log, http_api.V1))
+	router.Handle("GET", "/disk/slow", http_api.Decorate(s.doSlowDiskStatus, log, http_api.V1))
+	router.Handle("GET", "/topic/slo/alerts", http_api.Decorate(s.doLatencySLOAlerts, log, http_api.V1))
+	router.Handle("GET", "/conn/events", http_api.Decorate(s.doConnEvents, log, http_api.V1))
+	router.Handle("GET", "/namespaces", http_api.Decorate(s.doListNamespaces, log, http_api.V1))
+	router.Handle("POST", "/namespace/quota", http_api.Decorate(s.doSetNamespaceQuota, log, http_api.V1))
 
 	// v1 negotiate
 	router.Handle("POST", "/pub", http_api.Decorate(s.doPUB, http_api.NegotiateVersion))
@@ -63,10 +77,13 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	router.Handle("POST", "/pubtrace", http_api.Decorate(s.doPUBTrace, http_api.V1))
 	router.Handle("POST", "/mpub", http_api.Decorate(s.doMPUB, http_api.NegotiateVersion))
 	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, log, http_api.NegotiateVersion))
+	router.Handle("GET", "/stats/schema", http_api.Decorate(s.doStatsSchema, log, http_api.V1))
+	router.Handle("GET", "/scaling/signals", http_api.Decorate(s.doScalingSignals, log, http_api.V1))
 	router.Handle("GET", "/coordinator/stats", http_api.Decorate(s.doCoordStats, log, http_api.V1))
 	router.Handle("GET", "/message/stats", http_api.Decorate(s.doMessageStats, log, http_api.V1))
 	router.Handle("GET", "/message/get", http_api.Decorate(s.doMessageGet, log, http_api.V1))
 	router.Handle("POST", "/message/finish", http_api.Decorate(s.doMessageFinish, log, http_api.V1))
+	router.Handle("GET", "/message/peek", http_api.Decorate(s.doMessagePeek, log, http_api.V1))
 	router.Handle("GET", "/message/historystats", http_api.Decorate(s.doMessageHistoryStats, log, http_api.V1))
 	router.Handle("POST", "/message/trace/enable", http_api.Decorate(s.enableMessageTrace, log, http_api.V1))
 	router.Handle("POST", "/message/trace/disable", http_api.Decorate(s.disableMessageTrace, log, http_api.V1))
@@ -75,18 +92,46 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	router.Handle("POST", "/channel/skip", http_api.Decorate(s.doSkipChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/unskip", http_api.Decorate(s.doSkipChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/register", http_api.Decorate(s.doRegisterChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/unregister", http_api.Decorate(s.doRegisterChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/reqbackoff", http_api.Decorate(s.doSetReqBackoff, log, http_api.V1))
+	router.Handle("POST", "/channel/deliverywindow", http_api.Decorate(s.doSetDeliveryWindow, log, http_api.V1))
+	router.Handle("POST", "/channel/slo", http_api.Decorate(s.doSetChannelSLO, log, http_api.V1))
+	router.Handle("POST", "/channel/replay/rate", http_api.Decorate(s.doSetChannelReplayRate, log, http_api.V1))
+	router.Handle("POST", "/channel/compact", http_api.Decorate(s.doSetChannelCompact, log, http_api.V1))
 	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/empty", http_api.Decorate(s.doEmptyChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/finishmemdelayed", http_api.Decorate(s.doFinishMemDelayed, log, http_api.V1))
 	router.Handle("POST", "/channel/emptydelayed", http_api.Decorate(s.doEmptyChannelDelayed, log, http_api.V1))
 	router.Handle("POST", "/channel/setoffset", http_api.Decorate(s.doSetChannelOffset, log, http_api.V1))
 	router.Handle("POST", "/channel/setorder", http_api.Decorate(s.doSetChannelOrder, log, http_api.V1))
+	router.Handle("POST", "/channel/redrive", http_api.Decorate(s.doRedriveChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/redrive/stop", http_api.Decorate(s.doStopRedriveChannel, log, http_api.V1))
+	router.Handle("GET", "/channel/redrive/status", http_api.Decorate(s.doRedriveStatus, log, http_api.V1))
+	router.Handle("GET", "/channel/depth/history", http_api.Decorate(s.doChannelDepthHistory, log, http_api.V1))
+	router.Handle("GET", "/channel/inflight", http_api.Decorate(s.doChannelInFlight, log, http_api.V1))
 	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/delayqueue/enable", http_api.Decorate(s.doEnableDelayedQueue, log, http_api.V1))
 	router.Handle("GET", "/delayqueue/backupto", http_api.Decorate(s.doDelayedQueueBackupTo, log, http_api.V1Stream))
 
+	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
+	router.Handle("POST", "/topic/channel/autocreate/enable", http_api.Decorate(s.doChannelAutoCreate, log, http_api.V1))
+	router.Handle("POST", "/topic/channel/autocreate/disable", http_api.Decorate(s.doChannelAutoCreate, log, http_api.V1))
+	router.Handle("POST", "/topic/pubstats/policy", http_api.Decorate(s.doSetPubStatsPolicy, log, http_api.V1))
+	router.Handle("POST", "/topic/mirror", http_api.Decorate(s.doSetTopicMirror, log, http_api.V1))
+	router.Handle("POST", "/topic/mirror/remove", http_api.Decorate(s.doRemoveTopicMirror, log, http_api.V1))
+	router.Handle("POST", "/topic/archive/enable", http_api.Decorate(s.doEnableTopicArchive, log, http_api.V1))
+	router.Handle("POST", "/topic/archive/disable", http_api.Decorate(s.doDisableTopicArchive, log, http_api.V1))
+	router.Handle("GET", "/topic/archive/list", http_api.Decorate(s.doListTopicArchive, log, http_api.V1))
+	router.Handle("POST", "/topic/archive/restore", http_api.Decorate(s.doRestoreTopicArchive, log, http_api.V1))
+	router.Handle("GET", "/topic/archive/restore/status", http_api.Decorate(s.doRestoreTopicArchiveStatus, log, http_api.V1))
+	router.Handle("POST", "/topic/dedup", http_api.Decorate(s.doSetTopicDedup, log, http_api.V1))
+	router.Handle("POST", "/topic/slo", http_api.Decorate(s.doSetTopicLatencySLO, log, http_api.V1))
+	router.Handle("GET", "/topic/config", http_api.Decorate(s.doGetTopicRuntimeConf, log, http_api.V1))
+	router.Handle("POST", "/topic/config", http_api.Decorate(s.doSetTopicRuntimeConf, log, http_api.V1))
 	router.Handle("POST", "/topic/greedyclean", http_api.Decorate(s.doGreedyCleanTopic, log, http_api.V1))
+	router.Handle("POST", "/topic/leader/transfer", http_api.Decorate(s.doTransferTopicLeader, log, http_api.V1))
 	//router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, http_api.DeprecatedAPI, log, http_api.V1))
 
 	// debug
@@ -114,13 +159,32 @@ func setBlockRateHandler(w http.ResponseWriter, req *http.Request, ps httprouter
 	return nil, nil
 }
 
+// statusRecorder keeps the response status so the failed requests can be
+// counted in the protocol stats.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
 func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.ctx.nsqd.ProtocolConnOpened(nsqd.ProtocolHTTP)
+	defer s.ctx.nsqd.ProtocolConnClosed(nsqd.ProtocolHTTP)
 	if !s.tlsEnabled && s.tlsRequired {
+		s.ctx.nsqd.IncrProtocolErrorStats(nsqd.ProtocolHTTP)
 		resp := fmt.Sprintf(`{"message": "TLS_REQUIRED"}`)
 		http_api.Respond(w, 403, "", resp)
 		return
 	}
-	s.router.ServeHTTP(w, req)
+	rw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.router.ServeHTTP(rw, req)
+	if rw.status >= 400 {
+		s.ctx.nsqd.IncrProtocolErrorStats(nsqd.ProtocolHTTP)
+	}
 }
 
 func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -131,24 +195,183 @@ func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request, ps ht
 	return health, nil
 }
 
+// doErrorCodes lists the error codes returned by the tcp protocol and the http api,
+// so the client can decide whether to retry by the category.
+func (s *httpServer) doErrorCodes(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return struct {
+		ErrorCodes []protocol.ErrorCode `json:"error_codes"`
+	}{protocol.ErrorCodes()}, nil
+}
+
+// doSelfTest publishes and consumes a message through the hidden topic on this node,
+// such as /selftest?timeout=5s, the error is returned if the loopback failed.
+func (s *httpServer) doSelfTest(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	timeout := defaultSelfTestTimeout
+	if timeoutStr := reqParams.Get("timeout"); timeoutStr != "" {
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil || timeout <= 0 || timeout > maxSelfTestTimeout {
+			return nil, http_api.Err{400, "INVALID_ARG_TIMEOUT"}
+		}
+	}
+	r := s.ctx.selfTester.run(timeout)
+	if !r.Success {
+		return nil, http_api.Err{500, "SELFTEST_FAILED: " + r.Error}
+	}
+	return r, nil
+}
+
 func (s *httpServer) doSetLogLevel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
 		return nil, http_api.Err{400, "INVALID_REQUEST"}
 	}
+	format := reqParams.Get("format")
+	if format != "" {
+		err = levellogger.SetLogFormat(format)
+		if err != nil {
+			return nil, http_api.Err{400, "BAD_LOG_FORMAT"}
+		}
+		nsqd.NsqLogger().Logf("log format set to : %v", format)
+	}
 	levelStr := reqParams.Get("loglevel")
 	if levelStr == "" {
+		if format != "" {
+			return nil, nil
+		}
 		return nil, http_api.Err{400, "MISSING_ARG_LEVEL"}
 	}
 	level, err := strconv.Atoi(levelStr)
 	if err != nil {
 		return nil, http_api.Err{400, "BAD_LEVEL_STRING"}
 	}
+	// only change the level of the subsystem (protocol, diskqueue, coordinator, stats),
+	// the level -1 will reset the subsystem to use the nsqd log level
+	subsystem := reqParams.Get("subsystem")
+	if subsystem != "" {
+		err = levellogger.SetSubsystemLevel(subsystem, int32(level))
+		if err == levellogger.ErrUnknownSubsystem {
+			return nil, http_api.Err{404, "SUBSYSTEM_NOT_FOUND"}
+		} else if err != nil {
+			return nil, http_api.Err{400, "BAD_LEVEL_STRING"}
+		}
+		return nil, nil
+	}
 	nsqd.NsqLogger().SetLevel(int32(level))
 	consistence.SetCoordLogLevel(int32(level))
 	return nil, nil
 }
 
+func (s *httpServer) doGetLogLevel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return struct {
+		Format     string           `json:"format"`
+		Level      int32            `json:"level"`
+		Subsystems map[string]int32 `json:"subsystems"`
+	}{
+		Format:     levellogger.GetLogFormat(),
+		Level:      nsqd.NsqLogger().Level(),
+		Subsystems: levellogger.GetSubsystemLevels(),
+	}, nil
+}
+
+// doStartDrain starts draining the node for decommissioning, the node is safe to be
+// killed after the drain state is drained.
+func (s *httpServer) doStartDrain(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	timeout := defaultDrainTimeout
+	if timeoutStr := reqParams.Get("timeout"); timeoutStr != "" {
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil || timeout <= 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_TIMEOUT"}
+		}
+	}
+	err = s.ctx.drainMgr.start(timeout)
+	if err != nil {
+		return nil, http_api.Err{400, "DRAIN_ALREADY_STARTED"}
+	}
+	nsqd.NsqLogger().Logf("drain started from %v", req.RemoteAddr)
+	return s.ctx.drainMgr.collectStatus(), nil
+}
+
+func (s *httpServer) doDrainStatus(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.ctx.drainMgr.collectStatus(), nil
+}
+
+func (s *httpServer) doCancelDrain(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	err := s.ctx.drainMgr.cancel()
+	if err == errDrainLeft {
+		return nil, http_api.Err{400, "DRAIN_LEFT_CLUSTER"}
+	} else if err != nil {
+		return nil, http_api.Err{400, "DRAIN_NOT_STARTED"}
+	}
+	nsqd.NsqLogger().Logf("drain canceled from %v", req.RemoteAddr)
+	return s.ctx.drainMgr.collectStatus(), nil
+}
+
+func (s *httpServer) doSlowDiskStatus(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.ctx.slowDiskMgr.getStatus(), nil
+}
+
+func (s *httpServer) doLatencySLOAlerts(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.ctx.latencySLOMgr.getStatus(), nil
+}
+
+func (s *httpServer) doConnEvents(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.ctx.connEventMgr.getStatus(), nil
+}
+
+// doListNamespaces returns the stats rollup and the quota of each namespace on this node
+func (s *httpServer) doListNamespaces(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return struct {
+		Namespaces []nsqd.NamespaceStats `json:"namespaces"`
+	}{s.ctx.getNamespaceStats(s.ctx.getStats(false, "", true), "")}, nil
+}
+
+// doSetNamespaceQuota changes the quota of the namespace on this node, such as
+// /namespace/quota?namespace=xx&max_topics=10&max_disk_bytes=10737418240&max_pub_rate=1000,
+// the missing limit means no limit and all missing removes the quota.
+func (s *httpServer) doSetNamespaceQuota(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	ns := reqParams.Get("namespace")
+	if ns == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_NAMESPACE"}
+	}
+	var quota nsqd.NamespaceQuota
+	if v := reqParams.Get("max_topics"); v != "" {
+		quota.MaxTopics, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_MAX_TOPICS"}
+		}
+	}
+	if v := reqParams.Get("max_disk_bytes"); v != "" {
+		quota.MaxDiskBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_MAX_DISK_BYTES"}
+		}
+	}
+	if v := reqParams.Get("max_pub_rate"); v != "" {
+		quota.MaxPubRate, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_MAX_PUB_RATE"}
+		}
+	}
+	err = s.ctx.nsqd.SetNamespaceQuota(ns, quota)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_QUOTA"}
+	}
+	nsqd.NsqLogger().Logf("namespace %v quota changed to %+v from %v", ns, quota, req.RemoteAddr)
+	return nil, nil
+}
+
 func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -204,6 +427,44 @@ func (s *httpServer) getExistingTopicChannelFromQuery(req *http.Request) (url.Va
 	return reqParams, topic, channelName, err
 }
 
+// getRequestIdentity returns the identity of the http request for acl, the
+// identity is mapped from the client certificate if any.
+func (s *httpServer) getRequestIdentity(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return nsqd.GetCertIdentity(req.TLS.PeerCertificates[0], s.ctx.getOpts().TLSIdentityMode)
+	}
+	return ""
+}
+
+func (s *httpServer) enforcePubMTLSPolicy(req *http.Request) error {
+	if s.ctx.getOpts().MTLSRequiredFor == nsqd.MTLSRequiredForPub {
+		if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+			return http_api.Err{403, "MTLS_REQUIRED"}
+		}
+	}
+	return nil
+}
+
+func (s *httpServer) checkACL(req *http.Request, op string, topicName string) error {
+	if !s.ctx.checkACL(s.getRequestIdentity(req), topicName, op) {
+		return http_api.Err{403, "ACL_DENIED"}
+	}
+	return nil
+}
+
+// checkClusterFeature rejects enabling the new feature until all the nodes in
+// cluster support it.
+func (s *httpServer) checkClusterFeature(name string) error {
+	err := s.ctx.checkClusterFeature(name)
+	if err == consistence.ErrClusterFeatureDisabled {
+		return http_api.Err{400, "CLUSTER_FEATURE_DISABLED"}
+	} else if err != nil {
+		nsqd.NsqLogger().LogWarningf("check cluster feature %v failed: %v", name, err)
+		return http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	return nil
+}
+
 //TODO: will be refactored for further extension
 func getTag(reqParams url.Values) string {
 	return reqParams.Get("tag")
@@ -238,11 +499,54 @@ func (s *httpServer) getExistingTopicFromQuery(req *http.Request) (url.Values, *
 	return reqParams, topic, nil
 }
 
+// getPubTopicFromQuery is the same as getExistingTopicFromQuery except that
+// the partition can be chosen by hashing the routing key.
+func (s *httpServer) getPubTopicFromQuery(req *http.Request) (url.Values, *nsqd.Topic, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failed to parse request params - %s", err)
+		return nil, nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	routingKey := reqParams.Get("routing_key")
+	if routingKey == "" {
+		return s.getExistingTopicFromQuery(req)
+	}
+	if reqParams.Get("partition") != "" {
+		return nil, nil, http_api.Err{400, "PARTITION_ROUTING_KEY_CONFLICT"}
+	}
+	topicName, err := http_api.GetTopicArg(reqParams)
+	if err != nil {
+		return nil, nil, http_api.Err{400, err.Error()}
+	}
+	topicPart, _ := s.ctx.getRoutingPartition(topicName, routingKey)
+	if topicPart < 0 {
+		return nil, nil, http_api.Err{404, E_TOPIC_NOT_EXIST}
+	}
+	topic, err := s.ctx.getExistingTopic(topicName, topicPart)
+	if err != nil || topic.GetTopicPart() != topicPart {
+		// the routed partition is not on this node, the producer should
+		// publish to the leader of the partition
+		nsqd.NsqLogger().LogDebugf("routed partition %v-%v not found for key %v",
+			topicName, topicPart, routingKey)
+		return nil, nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	return reqParams, topic, nil
+}
+
+// the detail response is returned if the partition is routed by key or
+// required by the producer, since the old producer may only expect OK.
+func needPubDetailRsp(reqParams url.Values) bool {
+	return reqParams.Get("routing_key") != "" || reqParams.Get("format") == "json"
+}
+
 func (s *httpServer) doGreedyCleanTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, localTopic, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
+	if s.ctx.isReadOnly() {
+		return nil, http_api.Err{403, E_READ_ONLY}
+	}
 	err = s.ctx.GreedyCleanTopicOldData(localTopic)
 	if err != nil {
 		return nil, http_api.Err{500, err.Error()}
@@ -250,6 +554,101 @@ func (s *httpServer) doGreedyCleanTopic(w http.ResponseWriter, req *http.Request
 	return nil, nil
 }
 
+// doCreateTopic creates the topic in cluster by forwarding the request to the
+// nsqlookupd leader, and returns the partition placement of the new topic.
+func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName := reqParams.Get("topic")
+	if topicName == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC"}
+	}
+	pnum, err := strconv.Atoi(reqParams.Get("partition_num"))
+	if err != nil || pnum <= 0 {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_PARTITION_NUM"}
+	}
+	replicator, err := strconv.Atoi(reqParams.Get("replicator"))
+	if err != nil || replicator <= 0 {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_REPLICATOR"}
+	}
+	if syncStr := reqParams.Get("syncdisk"); syncStr != "" {
+		syncEvery, err := strconv.Atoi(syncStr)
+		if err != nil || syncEvery < 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_SYNC_DISK"}
+		}
+	}
+	if s.ctx.nsqdCoord == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	if err := s.ctx.nsqd.CheckNamespaceTopicQuota(topicName); err != nil {
+		return nil, http_api.NewDetailErr(429, "NAMESPACE_QUOTA_EXCEEDED: "+err.Error(),
+			map[string]string{"namespace": nsqd.GetTopicNamespace(topicName)})
+	}
+	lookupLeader := s.ctx.nsqdCoord.GetCurrentLookupd()
+	if lookupLeader.GetID() == "" {
+		return nil, http_api.Err{500, "MISSING_LOOKUP_LEADER"}
+	}
+
+	endpoint := fmt.Sprintf("http://%s/topic/create?%s",
+		net.JoinHostPort(lookupLeader.NodeIP, lookupLeader.HttpPort), reqParams.Encode())
+	nsqd.NsqLogger().Logf("creating topic %v with partition %v replicator %v from %v",
+		topicName, pnum, replicator, req.RemoteAddr)
+	var ret interface{}
+	code, err := http_api.NewClient(nil).POSTV1WithResult(endpoint, &ret)
+	if err != nil {
+		nsqd.NsqLogger().Logf("create topic %v by lookup %v failed: %v", topicName, endpoint, err)
+		if code <= 0 {
+			code = 500
+		}
+		return nil, http_api.Err{code, err.Error()}
+	}
+	return ret, nil
+}
+
+// doTransferTopicLeader transfers the topic partition leader on this node to another
+// replica in isr, the write will be disabled until the new leader is ready.
+func (s *httpServer) doTransferTopicLeader(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, localTopic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	newLeader := reqParams.Get("node")
+	if newLeader == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_NODE"}
+	}
+	timeout := 30 * time.Second
+	if timeoutStr := reqParams.Get("timeout"); timeoutStr != "" {
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil || timeout <= 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_TIMEOUT"}
+		}
+	}
+	err = s.ctx.TransferTopicLeader(localTopic, newLeader, timeout)
+	if err != nil {
+		nsqd.NsqLogger().Logf("transfer topic %v leader to %v failed: %v", localTopic.GetFullName(), newLeader, err)
+		return nil, http_api.Err{500, err.Error()}
+	}
+	nsqd.NsqLogger().Logf("topic %v leader transferred to %v", localTopic.GetFullName(), newLeader)
+	return struct {
+		Leader string `json:"leader"`
+	}{newLeader}, nil
+}
+
+// pubBackpressureHTTPErr sets the Retry-After header for the publish rejected by
+// the backpressure.
+func pubBackpressureHTTPErr(w http.ResponseWriter, topic *nsqd.Topic, retryAfter time.Duration) error {
+	secs := int64((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	details := topicErrDetails(topic.GetTopicName(), topic.GetTopicPart())
+	details["retry_after_ms"] = strconv.FormatInt(int64(retryAfter/time.Millisecond), 10)
+	return http_api.NewDetailErr(429, "PUB_BACKPRESSURE", details)
+}
+
 func (s *httpServer) doPUBTrace(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	return s.internalPUB(w, req, ps, true, false)
 }
@@ -269,14 +668,33 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 	} else if req.ContentLength <= 0 {
 		return nil, http_api.Err{406, "MSG_EMPTY"}
 	}
+	if s.ctx.isReadOnly() {
+		return nil, http_api.Err{403, E_READ_ONLY}
+	}
+	if s.ctx.isDraining() {
+		return nil, http_api.Err{503, "E_DRAINING"}
+	}
 
 	// add 1 so that it's greater than our max when we test for it
 	// (LimitReader returns a "fake" EOF)
-	params, topic, err := s.getExistingTopicFromQuery(req)
+	params, topic, err := s.getPubTopicFromQuery(req)
 	if err != nil {
 		nsqd.NsqLogger().Logf("get topic err: %v", err)
+		if req.URL.Query().Get("routing_key") != "" {
+			// the errors of the routing key are returned as is
+			return nil, err
+		}
 		return nil, http_api.Err{404, E_TOPIC_NOT_EXIST}
 	}
+	if err = s.enforcePubMTLSPolicy(req); err != nil {
+		return nil, err
+	}
+	if err = s.checkACL(req, auth.ACLOpPub, topic.GetTopicName()); err != nil {
+		return nil, err
+	}
+	if req.ContentLength > topic.GetMaxMsgSize(s.ctx.getOpts().MaxMsgSize) {
+		return nil, http_api.Err{413, "MSG_TOO_BIG"}
+	}
 
 	readMax := req.ContentLength + 1
 	b := topic.BufferPoolGet(int(req.ContentLength))
@@ -372,6 +790,38 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 		} else {
 			extContent = ext.NewNoExt()
 		}
+		// the reason why the message is moved to the dead-letter topic, the re-drive
+		// can filter the messages by the reason
+		if reason := params.Get("dlq_reason"); reason != "" {
+			if jsonHeaderExt == nil {
+				jsonHeaderExt = make(map[string]interface{})
+			}
+			jsonHeaderExt[ext.DLQ_REASON_KEY] = reason
+			jsonHeaderExtBytes, err := json.Marshal(&jsonHeaderExt)
+			if err != nil {
+				return nil, http_api.Err{400, ext.E_INVALID_JSON_HEADER}
+			}
+			jhe := ext.NewJsonHeaderExt()
+			jhe.SetJsonHeaderBytes(jsonHeaderExtBytes)
+			extContent = jhe
+		}
+		// the dedup key is carried in the json header so the replicas can record it,
+		// the dedup key in the json header is preferred
+		if key := params.Get("dedup_key"); key != "" {
+			if _, ok := jsonHeaderExt[ext.DEDUP_KEY]; !ok {
+				if jsonHeaderExt == nil {
+					jsonHeaderExt = make(map[string]interface{})
+				}
+				jsonHeaderExt[ext.DEDUP_KEY] = key
+				jsonHeaderExtBytes, err := json.Marshal(&jsonHeaderExt)
+				if err != nil {
+					return nil, http_api.Err{400, ext.E_INVALID_JSON_HEADER}
+				}
+				jhe := ext.NewJsonHeaderExt()
+				jhe.SetJsonHeaderBytes(jsonHeaderExtBytes)
+				extContent = jhe
+			}
+		}
 		if !isExt && extContent.ExtVersion() != ext.NO_EXT_VER {
 			canIgnoreExt := true
 			if jsonHeaderExt != nil {
@@ -392,19 +842,48 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 				return nil, http_api.Err{400, ext.E_EXT_NOT_SUPPORT}
 			}
 		}
-		if needTraceRsp || atomic.LoadInt32(&topic.EnableTrace) == 1 {
+		needDetailRsp := needPubDetailRsp(params)
+		if needTraceRsp || needDetailRsp || atomic.LoadInt32(&topic.EnableTrace) == 1 {
 			asyncAction = false
 		}
+		// the replicas record the dedup key from the json header, so the message without
+		// the json header (the ext ignored for the non-ext topic) is not deduplicated
+		var dedupKey []byte
+		if extContent.ExtVersion() == ext.JSON_HEADER_EXT_VER {
+			if k, ok := jsonHeaderExt[ext.DEDUP_KEY].(string); ok {
+				dedupKey = []byte(k)
+			}
+		}
+		if retryAfter, ok := s.ctx.checkPubBackpressure(topic); ok {
+			return nil, pubBackpressureHTTPErr(w, topic, retryAfter)
+		}
+		if err = s.ctx.nsqd.CheckNamespacePubQuota(topic.GetTopicName(), 1); err != nil {
+			nsqd.NsqLogger().Logf("topic %v publish rejected: %v", topic.GetFullName(), err)
+			return nil, http_api.NewDetailErr(429, "NAMESPACE_QUOTA_EXCEEDED: "+err.Error(),
+				map[string]string{"namespace": nsqd.GetTopicNamespace(topic.GetTopicName())})
+		}
+		var dropped bool
+		dropped, err = topic.CheckDedupKey(dedupKey)
+		if err != nil {
+			return nil, http_api.Err{409, "E_DUP_MSG"}
+		}
 
 		id := nsqd.MessageID(0)
 		offset := nsqd.BackendOffset(0)
 		rawSize := int32(0)
-		if asyncAction {
-			err = internalPubAsync(nil, b, topic, extContent)
-		} else {
-			id, offset, rawSize, _, err = s.ctx.PutMessage(topic, body, extContent, traceID)
+		// the duplicated message to drop is accepted without written
+		if !dropped {
+			if asyncAction {
+				err = internalPubAsync(nil, b, topic, extContent)
+			} else {
+				id, offset, rawSize, _, err = s.ctx.PutMessage(topic, body, extContent, traceID)
+			}
+			if err == nil {
+				topic.CommitDedupKey(dedupKey)
+			}
 		}
 		if err != nil {
+			topic.ForgetDedupKey(dedupKey)
 			nsqd.NsqLogger().LogErrorf("topic %v put message failed: %v", topic.GetFullName(), err)
 			if clusterErr, ok := err.(*consistence.CommonCoordErr); ok {
 				if !clusterErr.IsLocalErr() {
@@ -417,6 +896,7 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 		if traceID != 0 || atomic.LoadInt32(&topic.EnableTrace) == 1 || nsqd.NsqLogger().Level() >= levellogger.LOG_DETAIL {
 			nsqd.GetMsgTracer().TracePubClient(topic.GetTopicName(), topic.GetTopicPart(), traceID, id, offset, req.RemoteAddr)
 		}
+		s.ctx.nsqd.UpdateProtocolPubStats(nsqd.ProtocolHTTP, 1, int64(len(body)))
 		cost := time.Now().UnixNano() - startPub
 		topic.GetDetailStats().UpdateTopicMsgStats(int64(len(body)), cost/1000)
 		if needTraceRsp {
@@ -427,6 +907,16 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 				QueueOffset uint64 `json:"queue_offset"`
 				DataRawSize uint32 `json:"rawsize"`
 			}{"OK", uint64(id), traceIDStr, uint64(offset), uint32(rawSize)}, nil
+		} else if needDetailRsp {
+			return &PubResponse{
+				Status:      "OK",
+				Topic:       topic.GetTopicName(),
+				Partition:   topic.GetTopicPart(),
+				ID:          uint64(id),
+				QueueOffset: uint64(offset),
+				DataRawSize: uint32(rawSize),
+				Count:       1,
+			}, nil
 		} else {
 			return "OK", nil
 		}
@@ -443,125 +933,840 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 	if req.ContentLength > s.ctx.getOpts().MaxBodySize {
 		return nil, http_api.Err{413, "BODY_TOO_BIG"}
 	}
+	if s.ctx.isReadOnly() {
+		return nil, http_api.Err{403, E_READ_ONLY}
+	}
+	if s.ctx.isDraining() {
+		return nil, http_api.Err{503, "E_DRAINING"}
+	}
 
-	reqParams, topic, err := s.getExistingTopicFromQuery(req)
+	reqParams, topic, err := s.getPubTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
+	if err = s.enforcePubMTLSPolicy(req); err != nil {
+		return nil, err
+	}
+	if err = s.checkACL(req, auth.ACLOpPub, topic.GetTopicName()); err != nil {
+		return nil, err
+	}
 
-	var msgs []*nsqd.Message
-	var buffers []*bytes.Buffer
-	var exit bool
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		//should we forward to master of topic?
+		nsqd.NsqLogger().LogDebugf("should put to master: %v, from %v",
+			topic.GetFullName(), req.RemoteAddr)
+		topic.DisableForSlave()
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+
+	// the backpressure and the namespace quota are checked only before the first
+	// batch, so the request will not be rejected after some batches written.
+	if retryAfter, ok := s.ctx.checkPubBackpressure(topic); ok {
+		return nil, pubBackpressureHTTPErr(w, topic, retryAfter)
+	}
+	_, isBinary := reqParams["binary"]
+	mr := newHTTPMPubReader(topic, req.Body, isBinary,
+		topic.GetMaxMsgSize(s.ctx.getOpts().MaxMsgSize), s.ctx.getOpts().MaxBodySize)
+	defer mr.close()
+	batchSize := s.ctx.getOpts().MaxHTTPMPubBatchSize
+	if batchSize <= 0 {
+		batchSize = s.ctx.getOpts().MaxBodySize
+	}
 
-	_, ok := reqParams["binary"]
-	if ok {
-		tmp := make([]byte, 4)
-		msgs, buffers, err = readMPUB(req.Body, tmp, topic,
-			s.ctx.getOpts().MaxMsgSize, s.ctx.getOpts().MaxBodySize, false)
-		defer func() {
-			for _, b := range buffers {
+	// the messages are written in batch while reading the body, and the buffers
+	// of the written batch are reused for the next batch.
+	msgs := make([]*nsqd.Message, 0, 16)
+	buffers := make([]*bytes.Buffer, 0, 16)
+	releaseBuffers := func() {
+		for _, b := range buffers {
+			topic.BufferPoolPut(b)
+		}
+		buffers = buffers[:0]
+		msgs = msgs[:0]
+	}
+	defer releaseBuffers()
+
+	var id nsqd.MessageID
+	var offset nsqd.BackendOffset
+	var rawSize int32
+	var written int
+	var bodySize int64
+	var batchBytes int64
+	flush := func() error {
+		if len(msgs) == 0 {
+			return nil
+		}
+		if written == 0 {
+			if err := s.ctx.nsqd.CheckNamespacePubQuota(topic.GetTopicName(), len(msgs)); err != nil {
+				nsqd.NsqLogger().Logf("topic %v publish rejected: %v", topic.GetFullName(), err)
+				return http_api.NewDetailErr(429, "NAMESPACE_QUOTA_EXCEEDED: "+err.Error(),
+					map[string]string{"namespace": nsqd.GetTopicNamespace(topic.GetTopicName())})
+			}
+		} else {
+			s.ctx.nsqd.AddNamespacePubCount(topic.GetTopicName(), len(msgs))
+		}
+		batchID, batchOffset, batchRawSize, err := s.ctx.PutMessages(topic, msgs)
+		//s.ctx.setHealth(err)
+		if err != nil {
+			nsqd.NsqLogger().LogErrorf("topic %v put message failed: %v", topic.GetFullName(), err)
+			if clusterErr, ok := err.(*consistence.CommonCoordErr); ok {
+				if !clusterErr.IsLocalErr() {
+					return http_api.Err{400, FailedOnNotWritable}
+				}
+			}
+			return http_api.Err{503, err.Error()}
+		}
+		if written == 0 {
+			id = batchID
+			offset = batchOffset
+		}
+		rawSize += batchRawSize
+		written += len(msgs)
+		bodySize += messagesBodySize(msgs)
+		batchBytes = 0
+		releaseBuffers()
+		return nil
+	}
+	for {
+		b, err := mr.next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil && batchBytes+int64(b.Len()) > batchSize {
+			err = flush()
+		}
+		if err != nil {
+			if b != nil {
 				topic.BufferPoolPut(b)
 			}
-		}()
+			if written > 0 {
+				w.Header().Set(httpMPubWrittenHeader, strconv.Itoa(written))
+			}
+			return nil, err
+		}
+		buffers = append(buffers, b)
+		msgs = append(msgs, nsqd.NewMessage(0, b.Bytes()))
+		batchBytes += int64(b.Len())
+		topic.GetDetailStats().UpdateTopicMsgStats(int64(b.Len()), 0)
+	}
+	if err = flush(); err != nil {
+		if written > 0 {
+			w.Header().Set(httpMPubWrittenHeader, strconv.Itoa(written))
+		}
+		return nil, err
+	}
+	if written == 0 {
+		return nil, http_api.Err{406, "MSG_EMPTY"}
+	}
 
-		if err != nil {
-			return nil, http_api.Err{413, err.(*protocol.FatalClientErr).Code[2:]}
+	s.ctx.nsqd.UpdateProtocolPubStats(nsqd.ProtocolHTTP, int64(written), bodySize)
+	cost := time.Now().UnixNano() - startPub
+	topic.GetDetailStats().UpdateTopicMsgStats(0, cost/1000/int64(written))
+	if needPubDetailRsp(reqParams) {
+		return &PubResponse{
+			Status:      "OK",
+			Topic:       topic.GetTopicName(),
+			Partition:   topic.GetTopicPart(),
+			ID:          uint64(id),
+			QueueOffset: uint64(offset),
+			DataRawSize: uint32(rawSize),
+			Count:       written,
+		}, nil
+	}
+	return "OK", nil
+}
+
+func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, topicPart, err := http_api.GetTopicPartitionArgs(reqParams)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+
+	if topicPart == -1 {
+		topicPart = s.ctx.getDefaultPartition(topicName)
+	}
+	err = s.ctx.deleteExistingTopic(topicName, topicPart)
+	if err != nil {
+		return nil, http_api.Err{404, E_TOPIC_NOT_EXIST}
+	}
+
+	return nil, nil
+}
+
+func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if s.ctx.isReadOnly() {
+		return nil, http_api.Err{403, E_READ_ONLY}
+	}
+	if err = s.checkACL(req, auth.ACLOpChannelCreate, topic.GetTopicName()); err != nil {
+		return nil, err
+	}
+	topic.GetChannel(channelName)
+	return nil, nil
+}
+
+func (s *httpServer) doRegisterChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if s.ctx.isReadOnly() {
+		return nil, http_api.Err{403, E_READ_ONLY}
+	}
+	if err = s.checkACL(req, auth.ACLOpChannelCreate, topic.GetTopicName()); err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	if strings.Contains(req.URL.Path, "unregister") {
+		if _, err = topic.GetExistingChannel(channelName); err != nil {
+			return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
 		}
+		err = topic.UnregisterChannel(channelName)
 	} else {
-		// add 1 so that it's greater than our max when we test for it
-		// (LimitReader returns a "fake" EOF)
-		readMax := s.ctx.getOpts().MaxBodySize + 1
-		rdr := nsqd.NewBufioReader(io.LimitReader(req.Body, readMax))
-		defer nsqd.PutBufioReader(rdr)
-		total := 0
-		for !exit {
-			var block []byte
-			block, err = rdr.ReadBytes('\n')
+		_, err = topic.RegisterChannel(channelName)
+	}
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	nsqd.NsqLogger().Logf("topic %v channel %v %s from %v", topic.GetFullName(), channelName, req.URL.Path, req.RemoteAddr)
+	s.ctx.syncTopicPolicy(topic)
+	return nil, nil
+}
+
+// doSetPubStatsPolicy changes the client pub stats retention for the topic,
+// the default in options will be used if the param is empty or 0.
+func (s *httpServer) doSetPubStatsPolicy(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	maxEntries := 0
+	if str := reqParams.Get("max_entries"); str != "" {
+		maxEntries, err = strconv.Atoi(str)
+		if err != nil || maxEntries < 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_MAX_ENTRIES"}
+		}
+	}
+	var maxIdle time.Duration
+	if str := reqParams.Get("max_idle"); str != "" {
+		maxIdle, err = time.ParseDuration(str)
+		if err != nil || maxIdle < 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_MAX_IDLE"}
+		}
+	}
+	err = topic.SetPubStatsPolicy(maxEntries, maxIdle)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	maxEntries, maxIdle = topic.GetPubStatsPolicy()
+	return struct {
+		MaxEntries int    `json:"max_entries"`
+		MaxIdle    string `json:"max_idle"`
+	}{maxEntries, maxIdle.String()}, nil
+}
+
+func splitAddrs(str string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(str, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// doSetTopicMirror replicates the topic partition to the topic on the remote cluster,
+// the mirror will be running while the partition leader is on this node.
+func (s *httpServer) doSetTopicMirror(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	conf := &nsqd.TopicMirrorConf{
+		RemoteTopic:  reqParams.Get("remote_topic"),
+		NSQDAddrs:    splitAddrs(reqParams.Get("nsqd_http_addrs")),
+		LookupdAddrs: splitAddrs(reqParams.Get("lookupd_http_addrs")),
+	}
+	fromOldest := false
+	switch reqParams.Get("from") {
+	case "", "latest":
+	case "oldest":
+		fromOldest = true
+	default:
+		return nil, http_api.Err{400, "INVALID_ARG_FROM"}
+	}
+	err = topic.SetMirror(conf, fromOldest)
+	if err == nsqd.ErrInvalidTopicMirror {
+		return nil, http_api.Err{400, "MISSING_ARG_MIRROR_ADDRS"}
+	} else if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	s.ctx.syncTopicPolicy(topic)
+	return topic.GetMirrorStats(), nil
+}
+
+func (s *httpServer) doRemoveTopicMirror(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	err = topic.SetMirror(nil, false)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	s.ctx.syncTopicPolicy(topic)
+	return nil, nil
+}
+
+func (s *httpServer) doEnableTopicArchive(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	if err := s.checkClusterFeature(consistence.FeatureTopicArchive); err != nil {
+		return nil, err
+	}
+	err = topic.EnableArchive()
+	if err == nsqd.ErrArchiveStoreNotConfigured {
+		return nil, http_api.Err{400, "ARCHIVE_STORE_NOT_CONFIGURED"}
+	} else if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	s.ctx.syncTopicPolicy(topic)
+	return topic.GetArchiveStats(), nil
+}
+
+func (s *httpServer) doDisableTopicArchive(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	err = topic.DisableArchive()
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	s.ctx.syncTopicPolicy(topic)
+	return nil, nil
+}
+
+func (s *httpServer) doSetTopicDedup(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	// empty mode to disable the dedup
+	var conf *nsqd.TopicDedupConf
+	if mode := reqParams.Get("mode"); mode != "" {
+		conf = &nsqd.TopicDedupConf{Mode: mode}
+		conf.Window, err = time.ParseDuration(reqParams.Get("window"))
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_DEDUP_WINDOW"}
+		}
+		if maxKeysStr := reqParams.Get("max_keys"); maxKeysStr != "" {
+			conf.MaxKeys, err = strconv.Atoi(maxKeysStr)
+			if err != nil {
+				return nil, http_api.Err{400, "INVALID_ARG_DEDUP_MAX_KEYS"}
+			}
+		}
+		if err := s.checkClusterFeature(consistence.FeatureDedupIndex); err != nil {
+			return nil, err
+		}
+	}
+	err = topic.SetDedupConf(conf)
+	if err == nsqd.ErrInvalidDedupConfig {
+		return nil, http_api.Err{400, "INVALID_DEDUP_CONFIG"}
+	} else if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	s.ctx.syncTopicPolicy(topic)
+	return topic.GetDedupStats(), nil
+}
+
+// doSetTopicLatencySLO sets the threshold of the write latency percentile on the
+// partition, the slo will be removed if the latency is empty.
+func (s *httpServer) doSetTopicLatencySLO(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	var slo *nsqd.TopicLatencySLO
+	if latencyStr := reqParams.Get("latency"); latencyStr != "" {
+		slo = &nsqd.TopicLatencySLO{Percentile: 0.99}
+		slo.Latency, err = time.ParseDuration(latencyStr)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_LATENCY"}
+		}
+		if percentileStr := reqParams.Get("percentile"); percentileStr != "" {
+			slo.Percentile, err = strconv.ParseFloat(percentileStr, 64)
+			if err != nil {
+				return nil, http_api.Err{400, "INVALID_ARG_PERCENTILE"}
+			}
+		}
+		if windowStr := reqParams.Get("window"); windowStr != "" {
+			slo.Window, err = time.ParseDuration(windowStr)
+			if err != nil {
+				return nil, http_api.Err{400, "INVALID_ARG_WINDOW"}
+			}
+		}
+	}
+	err = topic.SetWriteLatencySLO(slo)
+	if err == nsqd.ErrInvalidLatencySLO {
+		return nil, http_api.Err{400, "INVALID_SLO"}
+	} else if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	nsqd.NsqLogger().Logf("topic %v write latency slo changed to %v from %v",
+		topic.GetFullName(), topic.GetWriteLatencySLO(), req.RemoteAddr)
+	s.ctx.syncTopicPolicy(topic)
+	return struct {
+		SLO *nsqd.TopicLatencySLOStats `json:"slo"`
+	}{topic.GetWriteLatencySLOStats()}, nil
+}
+
+func (s *httpServer) doGetTopicRuntimeConf(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	conf := topic.GetRuntimeConf()
+	if conf == nil {
+		conf = &nsqd.TopicRuntimeConf{}
+	}
+	return conf, nil
+}
+
+// doSetTopicRuntimeConf changes the config given in the params on the partition,
+// the zero value removes the override and the reset removes all the overrides.
+func (s *httpServer) doSetTopicRuntimeConf(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	var conf nsqd.TopicRuntimeConf
+	if old := topic.GetRuntimeConf(); old != nil {
+		conf = *old
+	}
+	if reset, _ := strconv.ParseBool(reqParams.Get("reset")); reset {
+		conf = nsqd.TopicRuntimeConf{}
+	}
+	if _, ok := reqParams["sync_every"]; ok {
+		conf.SyncEvery, err = strconv.ParseInt(reqParams.Get("sync_every"), 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_SYNC_EVERY"}
+		}
+	}
+	if _, ok := reqParams["sync_timeout"]; ok {
+		conf.SyncTimeout, err = time.ParseDuration(reqParams.Get("sync_timeout"))
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_SYNC_TIMEOUT"}
+		}
+	}
+	if _, ok := reqParams["retention_day"]; ok {
+		retentionDay, err := strconv.ParseInt(reqParams.Get("retention_day"), 10, 32)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_RETENTION_DAY"}
+		}
+		conf.RetentionDay = int32(retentionDay)
+	}
+	if _, ok := reqParams["max_msg_size"]; ok {
+		conf.MaxMsgSize, err = strconv.ParseInt(reqParams.Get("max_msg_size"), 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_MAX_MSG_SIZE"}
+		}
+	}
+	if _, ok := reqParams["compression"]; ok {
+		conf.Compression = reqParams.Get("compression")
+		// the compression only applies to the archive upload
+		if conf.Compression != "" && !topic.IsArchiveEnabled() {
+			return nil, http_api.Err{400, "ARCHIVE_NOT_ENABLED"}
+		}
+	}
+	err = topic.SetRuntimeConf(&conf)
+	if err == nsqd.ErrInvalidTopicRuntimeConf {
+		return nil, http_api.Err{400, "INVALID_TOPIC_CONFIG"}
+	} else if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	nsqd.NsqLogger().Logf("topic %v runtime config changed to %+v from %v",
+		topic.GetFullName(), conf, req.RemoteAddr)
+	s.ctx.syncTopicPolicy(topic)
+	return conf, nil
+}
+
+func (s *httpServer) doListTopicArchive(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !topic.IsArchiveEnabled() {
+		return nil, http_api.Err{400, "ARCHIVE_NOT_ENABLED"}
+	}
+	return struct {
+		Stats    *nsqd.TopicArchiveStats `json:"stats"`
+		Segments []nsqd.ArchivedSegment  `json:"segments"`
+	}{topic.GetArchiveStats(), topic.GetArchivedSegments()}, nil
+}
+
+// doRestoreTopicArchive re-publishes the archived messages in the offset range
+// [start, end) to the topic or the target topic for replay. The restore runs in
+// background and the status can be queried by /topic/archive/restore/status.
+func (s *httpServer) doRestoreTopicArchive(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !topic.IsArchiveEnabled() {
+		return nil, http_api.Err{400, "ARCHIVE_NOT_ENABLED"}
+	}
+	var start, end int64
+	if str := reqParams.Get("start"); str != "" {
+		start, err = strconv.ParseInt(str, 10, 64)
+		if err != nil || start < 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_START"}
+		}
+	}
+	if str := reqParams.Get("end"); str != "" {
+		end, err = strconv.ParseInt(str, 10, 64)
+		if err != nil || end < 0 || (end > 0 && end <= start) {
+			return nil, http_api.Err{400, "INVALID_ARG_END"}
+		}
+	}
+	target := topic
+	if targetName := reqParams.Get("target_topic"); targetName != "" {
+		targetPart := topic.GetTopicPart()
+		if str := reqParams.Get("target_partition"); str != "" {
+			targetPart, err = strconv.Atoi(str)
+			if err != nil {
+				return nil, http_api.Err{400, "INVALID_ARG_TARGET_PARTITION"}
+			}
+		}
+		target, err = s.ctx.getExistingTopic(targetName, targetPart)
+		if err != nil {
+			return nil, http_api.Err{404, E_TOPIC_NOT_EXIST}
+		}
+	}
+	if !s.ctx.checkForMasterWrite(target.GetTopicName(), target.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	replayTag := defaultArchiveReplayTag
+	if _, ok := reqParams["replay_tag"]; ok {
+		replayTag = reqParams.Get("replay_tag")
+	}
+	job, err := s.ctx.restoreMgr.start(topic, target, nsqd.BackendOffset(start), nsqd.BackendOffset(end), replayTag)
+	if err == errRestoreRunning {
+		return nil, http_api.Err{400, "RESTORE_RUNNING"}
+	} else if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	nsqd.NsqLogger().Logf("topic %v start restore archived from %v to %v", topic.GetFullName(), start, target.GetFullName())
+	return job.Status(), nil
+}
+
+// doRestoreTopicArchiveStatus returns the last restore of the topic, the end offset
+// is the offset to resume from if the restore failed.
+func (s *httpServer) doRestoreTopicArchiveStatus(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.ctx.restoreMgr.getStatus(topic.GetFullName())
+	if err != nil {
+		return nil, http_api.Err{404, "RESTORE_NOT_FOUND"}
+	}
+	return st, nil
+}
+
+// doSetReqBackoff changes the backoff used for REQ without timeout on the channel,
+// the backoff will be disabled if the base is empty or 0.
+func (s *httpServer) doSetReqBackoff(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	var base, max time.Duration
+	if str := reqParams.Get("base"); str != "" {
+		base, err = time.ParseDuration(str)
+		if err != nil || base < 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_BASE"}
+		}
+	}
+	max = s.ctx.getOpts().MaxReqTimeout
+	if str := reqParams.Get("max"); str != "" {
+		max, err = time.ParseDuration(str)
+		if err != nil || max < base || max > s.ctx.getOpts().MaxReqTimeout {
+			return nil, http_api.Err{400, "INVALID_ARG_MAX"}
+		}
+	}
+	if base > max {
+		return nil, http_api.Err{400, "INVALID_ARG_BASE"}
+	}
+	if base == 0 {
+		max = 0
+	}
+	channel.SetReqBackoff(base, max)
+	err = topic.SaveChannelMeta()
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	nsqd.NsqLogger().Logf("topic %v channel %v req backoff changed to %v-%v from %v",
+		topic.GetFullName(), channelName, base, max, req.RemoteAddr)
+	s.ctx.syncTopicPolicy(topic)
+	return struct {
+		Base string `json:"base"`
+		Max  string `json:"max"`
+	}{base.String(), max.String()}, nil
+}
+
+// doSetDeliveryWindow limits the time of day the channel messages can be delivered,
+// the limit will be removed if the start is empty.
+func (s *httpServer) doSetDeliveryWindow(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	var window *nsqd.DeliveryWindow
+	if start := reqParams.Get("start"); start != "" {
+		window, err = nsqd.ParseDeliveryWindow(start, reqParams.Get("end"), reqParams.Get("timezone"))
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_WINDOW"}
+		}
+	}
+	channel.SetDeliveryWindow(window)
+	err = topic.SaveChannelMeta()
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	nsqd.NsqLogger().Logf("topic %v channel %v delivery window changed to %v from %v",
+		topic.GetFullName(), channelName, window, req.RemoteAddr)
+	s.ctx.syncTopicPolicy(topic)
+	return struct {
+		DeliveryWindow *nsqd.DeliveryWindow `json:"delivery_window"`
+		DeliveryHeld   bool                 `json:"delivery_held"`
+	}{window, !channel.IsInDeliveryWindow(time.Now())}, nil
+}
+
+// doSetChannelSLO sets the slo as the target ratio of the messages finished within
+// the latency since published, the slo will be removed if the target is empty.
+func (s *httpServer) doSetChannelSLO(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	var slo *nsqd.ChannelSLO
+	if targetStr := reqParams.Get("target"); targetStr != "" {
+		slo = &nsqd.ChannelSLO{}
+		slo.Target, err = strconv.ParseFloat(targetStr, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_TARGET"}
+		}
+		slo.Latency, err = time.ParseDuration(reqParams.Get("latency"))
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_LATENCY"}
+		}
+		if windowStr := reqParams.Get("window"); windowStr != "" {
+			slo.Window, err = time.ParseDuration(windowStr)
 			if err != nil {
-				if err != io.EOF {
-					return nil, http_api.Err{500, "INTERNAL_ERROR"}
-				}
-				exit = true
-			}
-			total += len(block)
-			if int64(total) == readMax {
-				return nil, http_api.Err{413, "BODY_TOO_BIG"}
-			}
-
-			if len(block) > 0 && block[len(block)-1] == '\n' {
-				block = block[:len(block)-1]
-			}
-
-			// silently discard 0 length messages
-			// this maintains the behavior pre 0.2.22
-			if len(block) == 0 {
-				continue
+				return nil, http_api.Err{400, "INVALID_ARG_WINDOW"}
 			}
-
-			if int64(len(block)) > s.ctx.getOpts().MaxMsgSize {
-				return nil, http_api.Err{413, "MSG_TOO_BIG"}
-			}
-
-			msg := nsqd.NewMessage(0, block)
-			msgs = append(msgs, msg)
-			topic.GetDetailStats().UpdateTopicMsgStats(int64(len(block)), 0)
 		}
 	}
+	err = channel.SetSLO(slo)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_SLO"}
+	}
+	err = topic.SaveChannelMeta()
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	nsqd.NsqLogger().Logf("topic %v channel %v slo changed to %v from %v",
+		topic.GetFullName(), channelName, channel.GetSLO(), req.RemoteAddr)
+	s.ctx.syncTopicPolicy(topic)
+	return struct {
+		SLO *nsqd.ChannelSLOStats `json:"slo"`
+	}{channel.GetSLOStats(time.Now())}, nil
+}
 
-	if s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
-		_, _, _, err := s.ctx.PutMessages(topic, msgs)
-		//s.ctx.setHealth(err)
-		if err != nil {
-			nsqd.NsqLogger().LogErrorf("topic %v put message failed: %v", topic.GetFullName(), err)
-			if clusterErr, ok := err.(*consistence.CommonCoordErr); ok {
-				if !clusterErr.IsLocalErr() {
-					return nil, http_api.Err{400, FailedOnNotWritable}
-				}
-			}
-			return nil, http_api.Err{503, err.Error()}
-		}
-	} else {
-		//should we forward to master of topic?
-		nsqd.NsqLogger().LogDebugf("should put to master: %v, from %v",
-			topic.GetFullName(), req.RemoteAddr)
-		topic.DisableForSlave()
+// doSetChannelReplayRate limits the replay messages delivered per second for the
+// channel, so the live messages will be delivered first during the backfill.
+func (s *httpServer) doSetChannelReplayRate(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
 		return nil, http_api.Err{400, FailedOnNotLeader}
 	}
-
-	cost := time.Now().UnixNano() - startPub
-	topic.GetDetailStats().UpdateTopicMsgStats(0, cost/1000/int64(len(msgs)))
-	return "OK", nil
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	rate, err := strconv.ParseInt(reqParams.Get("rate"), 10, 64)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_RATE"}
+	}
+	err = channel.SetReplayRate(rate)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_RATE"}
+	}
+	err = topic.SaveChannelMeta()
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	nsqd.NsqLogger().Logf("topic %v channel %v replay rate changed to %v from %v",
+		topic.GetFullName(), channelName, rate, req.RemoteAddr)
+	s.ctx.syncTopicPolicy(topic)
+	return nil, nil
 }
 
-func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+// doSetChannelCompact enables the channel to deliver the latest value per key first
+// and then follow the new updates, the channel can bootstrap from the oldest data.
+func (s *httpServer) doSetChannelCompact(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
 	if err != nil {
-		nsqd.NsqLogger().LogErrorf("failed to parse request params - %s", err)
-		return nil, http_api.Err{400, "INVALID_REQUEST"}
+		return nil, err
 	}
-
-	topicName, topicPart, err := http_api.GetTopicPartitionArgs(reqParams)
+	channel, err := topic.GetExistingChannel(channelName)
 	if err != nil {
-		return nil, http_api.Err{400, err.Error()}
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
 	}
-
-	if topicPart == -1 {
-		topicPart = s.ctx.getDefaultPartition(topicName)
+	enable := true
+	if str := reqParams.Get("enable"); str != "" {
+		enable, err = strconv.ParseBool(str)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_ENABLE"}
+		}
 	}
-	err = s.ctx.deleteExistingTopic(topicName, topicPart)
+	fromOldest := false
+	switch reqParams.Get("from") {
+	case "":
+	case "oldest":
+		fromOldest = true
+	default:
+		return nil, http_api.Err{400, "INVALID_ARG_FROM"}
+	}
+	if enable && !topic.IsExt() {
+		return nil, http_api.Err{400, "TOPIC_NOT_EXT"}
+	}
+	if channel.IsOrdered() {
+		return nil, http_api.Err{400, "CHANNEL_ORDERED"}
+	}
+	if enable && !channel.IsCompacted() {
+		if err := s.checkClusterFeature(consistence.FeatureChannelCompact); err != nil {
+			return nil, err
+		}
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	// the snapshot will be built again if the reader is reset to the old position
+	channel.SetCompacted(enable)
+	if fromOldest {
+		queueOffset, cnt, err := s.ctx.SetChannelOffsetToOldest(topic, channel)
+		if err != nil {
+			return nil, http_api.Err{500, err.Error()}
+		}
+		nsqd.NsqLogger().Logf("topic %v channel %v reset to oldest %v:%v for compact", topic.GetFullName(),
+			channelName, queueOffset, cnt)
+	}
+	err = topic.SaveChannelMeta()
 	if err != nil {
-		return nil, http_api.Err{404, E_TOPIC_NOT_EXIST}
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
 	}
-
+	nsqd.NsqLogger().Logf("topic %v channel %v compact changed to %v from %v",
+		topic.GetFullName(), channelName, enable, req.RemoteAddr)
+	s.ctx.syncTopicPolicy(topic)
 	return nil, nil
 }
 
-func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+func (s *httpServer) doChannelAutoCreate(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
-	topic.GetChannel(channelName)
+	if err = s.checkACL(req, auth.ACLOpChannelCreate, topic.GetTopicName()); err != nil {
+		return nil, err
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+	disabled := strings.HasSuffix(req.URL.Path, "disable")
+	err = topic.SetChannelAutoCreateDisabled(disabled)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	nsqd.NsqLogger().Logf("topic %v channel auto create disabled: %v from %v",
+		topic.GetFullName(), disabled, req.RemoteAddr)
+	s.ctx.syncTopicPolicy(topic)
 	return nil, nil
 }
 
@@ -575,6 +1780,9 @@ func (s *httpServer) doEmptyChannel(w http.ResponseWriter, req *http.Request, ps
 	if err != nil {
 		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
 	}
+	if s.ctx.isReadOnly() {
+		return nil, http_api.Err{403, E_READ_ONLY}
+	}
 
 	if s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
 		var startFrom ConsumeOffset
@@ -645,6 +1853,205 @@ func (s *httpServer) doSetChannelOrder(w http.ResponseWriter, req *http.Request,
 	return nil, nil
 }
 
+func (s *httpServer) doRedriveChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.checkACL(req, auth.ACLOpPub, topic.GetTopicName()); err != nil {
+		return nil, err
+	}
+
+	param := redriveParam{
+		Topic:      topic.GetTopicName(),
+		Partition:  topic.GetTopicPart(),
+		Channel:    channelName,
+		DLQTopic:   reqParams.Get("dlq_topic"),
+		DLQChannel: reqParams.Get("dlq_channel"),
+		Reason:     reqParams.Get("reason"),
+		Rate:       100,
+	}
+	if !protocol.IsValidTopicName(param.DLQTopic) {
+		return nil, http_api.Err{400, "INVALID_DLQ_TOPIC"}
+	}
+	param.DLQPartition = -1
+	if str := reqParams.Get("dlq_partition"); str != "" {
+		param.DLQPartition, err = strconv.Atoi(str)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_DLQ_PARTITION"}
+		}
+	}
+	if param.DLQPartition == -1 {
+		param.DLQPartition = s.ctx.getDefaultPartition(param.DLQTopic)
+	}
+	if str := reqParams.Get("rate"); str != "" {
+		param.Rate, err = strconv.Atoi(str)
+		if err != nil || param.Rate <= 0 || param.Rate > maxRedriveRate {
+			return nil, http_api.Err{400, "INVALID_RATE"}
+		}
+	}
+	if str := reqParams.Get("start_ts"); str != "" {
+		param.StartTs, err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_START_TS"}
+		}
+	}
+	if str := reqParams.Get("end_ts"); str != "" {
+		param.EndTs, err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_END_TS"}
+		}
+	}
+
+	dlqTopic, err := s.ctx.getExistingTopic(param.DLQTopic, param.DLQPartition)
+	if err != nil {
+		nsqd.NsqLogger().Logf("dead-letter topic not found - %s-%v, %v", param.DLQTopic, param.DLQPartition, err)
+		return nil, http_api.Err{404, E_TOPIC_NOT_EXIST}
+	}
+	if !s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		nsqd.NsqLogger().LogDebugf("should request to master: %v, from %v",
+			topic.GetFullName(), req.RemoteAddr)
+		return nil, http_api.Err{400, FailedOnNotLeader}
+	}
+
+	job, err := s.ctx.redriveMgr.start(dlqTopic, topic, param)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	nsqd.NsqLogger().Logf("re-drive job %v started for channel %v-%v by client: %v",
+		job.id, topic.GetFullName(), channelName, req.RemoteAddr)
+	return job.Status(), nil
+}
+
+func (s *httpServer) doStopRedriveChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	id, err := strconv.ParseInt(req.FormValue("id"), 10, 64)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ID"}
+	}
+	err = s.ctx.redriveMgr.stop(id)
+	if err != nil {
+		return nil, http_api.Err{404, err.Error()}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doRedriveStatus(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	idStr := req.FormValue("id")
+	if idStr == "" {
+		return struct {
+			Jobs []RedriveStatus `json:"jobs"`
+		}{s.ctx.redriveMgr.getAllStatus()}, nil
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ID"}
+	}
+	st, err := s.ctx.redriveMgr.getStatus(id)
+	if err != nil {
+		return nil, http_api.Err{404, err.Error()}
+	}
+	return st, nil
+}
+
+// doChannelInFlight returns the in-flight and deferred messages of the channel,
+// the oldest delivered messages will be returned first.
+func (s *httpServer) doChannelInFlight(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	limit := 100
+	if limitStr := reqParams.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_LIMIT"}
+		}
+	}
+	msgs := channel.GetInFlightMessagesInfo(limit)
+	return struct {
+		Topic         string                     `json:"topic"`
+		Partition     int                        `json:"partition"`
+		Channel       string                     `json:"channel"`
+		InFlightCount int                        `json:"in_flight_count"`
+		DeferredCount int                        `json:"deferred_count"`
+		Messages      []nsqd.InFlightMessageInfo `json:"messages"`
+	}{topic.GetTopicName(), topic.GetTopicPart(), channelName, channel.GetInFlightCount(), channel.GetDeferredCount(), msgs}, nil
+}
+
+// get the channel depth at some time in the past, the time can be given by the
+// duration ago or the unix timestamp in seconds.
+func (s *httpServer) doChannelDepthHistory(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	if !channel.IsDepthHistoryEnabled() {
+		return nil, http_api.Err{400, "DEPTH_HISTORY_DISABLED"}
+	}
+	now := time.Now()
+	ts := now.Unix()
+	if agoStr := reqParams.Get("ago"); agoStr != "" {
+		ago, err := time.ParseDuration(agoStr)
+		if err != nil || ago < 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_AGO"}
+		}
+		ts = now.Add(-1 * ago).Unix()
+	} else if tsStr := reqParams.Get("ts"); tsStr != "" {
+		ts, err = strconv.ParseInt(tsStr, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_TS"}
+		}
+	} else {
+		return nil, http_api.Err{400, "MISSING_ARG_AGO_OR_TS"}
+	}
+	withSamples := reqParams.Get("samples") == "true"
+	sample, ok := channel.GetDepthAt(ts)
+	if !ok && withSamples {
+		// the history is not long enough, return all the samples we have
+		if samples := channel.GetDepthHistory(0); len(samples) > 0 {
+			sample, ok = samples[0], true
+		}
+	}
+	if !ok {
+		return nil, http_api.Err{404, "DEPTH_HISTORY_NOT_FOUND"}
+	}
+	curDepth := channel.Depth()
+	ret := struct {
+		Topic        string             `json:"topic"`
+		Partition    int                `json:"partition"`
+		Channel      string             `json:"channel"`
+		Ts           int64              `json:"ts"`
+		SampleTs     int64              `json:"sample_ts"`
+		Depth        int64              `json:"depth"`
+		DepthSize    int64              `json:"depth_size"`
+		CurrentDepth int64              `json:"current_depth"`
+		DepthChange  int64              `json:"depth_change"`
+		Samples      []nsqd.DepthSample `json:"samples,omitempty"`
+	}{
+		Topic:        topic.GetTopicName(),
+		Partition:    topic.GetTopicPart(),
+		Channel:      channelName,
+		Ts:           ts,
+		SampleTs:     sample.Ts,
+		Depth:        sample.Depth,
+		DepthSize:    sample.DepthSize,
+		CurrentDepth: curDepth,
+		DepthChange:  curDepth - sample.Depth,
+	}
+	if withSamples {
+		ret.Samples = channel.GetDepthHistory(sample.Ts)
+	}
+	return ret, nil
+}
+
 func (s *httpServer) doSetChannelOffset(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
 	if err != nil {
@@ -655,6 +2062,9 @@ func (s *httpServer) doSetChannelOffset(w http.ResponseWriter, req *http.Request
 	if err != nil {
 		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
 	}
+	if s.ctx.isReadOnly() {
+		return nil, http_api.Err{403, E_READ_ONLY}
+	}
 	readMax := req.ContentLength + 1
 	body := make([]byte, req.ContentLength)
 	n, err := io.ReadFull(io.LimitReader(req.Body, readMax), body)
@@ -699,6 +2109,12 @@ func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request, p
 	if err != nil {
 		return nil, err
 	}
+	if s.ctx.isReadOnly() {
+		return nil, http_api.Err{403, E_READ_ONLY}
+	}
+	if err = s.checkACL(req, auth.ACLOpChannelDelete, topic.GetTopicName()); err != nil {
+		return nil, err
+	}
 
 	if s.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
 		clusterErr := s.ctx.DeleteExistingChannel(topic, channelName)
@@ -764,8 +2180,10 @@ func (s *httpServer) doSkipChannel(w http.ResponseWriter, req *http.Request, ps
 	return nil, nil
 }
 
+// doPauseChannel pauses the channel with the optional duration to resume automatically
+// and the reason, such as /channel/pause?topic=xx&channel=xx&duration=1h&reason=xx
 func (s *httpServer) doPauseChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
@@ -779,7 +2197,23 @@ func (s *httpServer) doPauseChannel(w http.ResponseWriter, req *http.Request, ps
 	if strings.Contains(req.URL.Path, "unpause") {
 		err = s.ctx.UpdateChannelState(channel, 0, -1)
 	} else {
-		err = s.ctx.UpdateChannelState(channel, 1, -1)
+		var until time.Time
+		if durationStr := reqParams.Get("duration"); durationStr != "" {
+			duration, err := time.ParseDuration(durationStr)
+			if err != nil || duration <= 0 {
+				return nil, http_api.Err{400, "INVALID_ARG_DURATION"}
+			}
+			until = time.Now().Add(duration)
+		}
+		reason := reqParams.Get("reason")
+		if len(reason) > maxChannelPauseReasonLen {
+			return nil, http_api.Err{400, "INVALID_ARG_REASON"}
+		}
+		err = s.ctx.PauseChannel(channel, until, reason)
+		if err == nil {
+			nsqd.NsqLogger().Logf("topic %v channel %v paused until %v for %v from %v",
+				topic.GetFullName(), channel.GetName(), until, reason, req.RemoteAddr)
+		}
 	}
 	if err != nil {
 		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
@@ -1006,6 +2440,114 @@ func (s *httpServer) doMessageStats(w http.ResponseWriter, req *http.Request, ps
 	return statStr, nil
 }
 
+const (
+	defaultPeekLimit    = 10
+	maxPeekLimit        = 100
+	defaultPeekMaxBytes = 1024 * 1024
+	maxPeekMaxBytes     = 10 * 1024 * 1024
+)
+
+// doMessagePeek reads the messages from the topic data or the channel pending queue
+// without changing any consume state.
+func (s *httpServer) doMessagePeek(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	limit := defaultPeekLimit
+	if limitStr := reqParams.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_LIMIT"}
+		}
+		if limit > maxPeekLimit {
+			limit = maxPeekLimit
+		}
+	}
+	maxBytes := int64(defaultPeekMaxBytes)
+	if maxBytesStr := reqParams.Get("max_bytes"); maxBytesStr != "" {
+		maxBytes, err = strconv.ParseInt(maxBytesStr, 10, 64)
+		if err != nil || maxBytes <= 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_MAX_BYTES"}
+		}
+		if maxBytes > maxPeekMaxBytes {
+			maxBytes = maxPeekMaxBytes
+		}
+	}
+	encoding := reqParams.Get("encoding")
+	if encoding == "" {
+		encoding = "text"
+	}
+	if encoding != "text" && encoding != "base64" {
+		return nil, http_api.Err{400, "INVALID_ARG_ENCODING"}
+	}
+
+	channelName := reqParams.Get("channel")
+	var msgs []nsqd.PeekedMessage
+	if channelName != "" {
+		channel, chErr := topic.GetExistingChannel(channelName)
+		if chErr != nil {
+			return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+		}
+		msgs, err = channel.PeekMessages(limit, maxBytes)
+	} else {
+		start := nsqd.BackendOffset(-1)
+		if offsetStr := reqParams.Get("offset"); offsetStr != "" {
+			offset, convErr := strconv.ParseInt(offsetStr, 10, 64)
+			if convErr != nil || offset < 0 {
+				return nil, http_api.Err{400, "INVALID_ARG_OFFSET"}
+			}
+			start = nsqd.BackendOffset(offset)
+		}
+		msgs, err = topic.PeekMessages(start, limit, maxBytes)
+	}
+	if err != nil && len(msgs) == 0 {
+		nsqd.NsqLogger().Logf("failed to peek messages from topic %v channel %v: %v",
+			topic.GetFullName(), channelName, err)
+		return nil, http_api.Err{500, err.Error()}
+	}
+
+	type peekedMessage struct {
+		ID        nsqd.MessageID     `json:"id"`
+		TraceID   uint64             `json:"trace_id"`
+		Timestamp int64              `json:"timestamp"`
+		Attempts  uint16             `json:"attempts"`
+		Offset    nsqd.BackendOffset `json:"offset"`
+		RawSize   int32              `json:"raw_size"`
+		ExtJson   string             `json:"ext_json,omitempty"`
+		Body      string             `json:"body"`
+		Truncated bool               `json:"truncated"`
+	}
+	retMsgs := make([]peekedMessage, 0, len(msgs))
+	for _, m := range msgs {
+		pm := peekedMessage{
+			ID:        m.ID,
+			TraceID:   m.TraceID,
+			Timestamp: m.Timestamp,
+			Attempts:  m.Attempts,
+			Offset:    m.Offset,
+			RawSize:   m.RawSize,
+			Truncated: m.Truncated,
+		}
+		if m.ExtVer == ext.JSON_HEADER_EXT_VER {
+			pm.ExtJson = string(m.ExtBytes)
+		}
+		if encoding == "base64" {
+			pm.Body = base64.StdEncoding.EncodeToString(m.Body)
+		} else {
+			pm.Body = string(m.Body)
+		}
+		retMsgs = append(retMsgs, pm)
+	}
+	return struct {
+		Topic     string          `json:"topic"`
+		Partition int             `json:"partition"`
+		Channel   string          `json:"channel,omitempty"`
+		Encoding  string          `json:"encoding"`
+		Messages  []peekedMessage `json:"messages"`
+	}{topic.GetTopicName(), topic.GetTopicPart(), channelName, encoding, retMsgs}, nil
+}
+
 func (s *httpServer) doMessageFinish(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, t, chName, err := s.getExistingTopicChannelFromQuery(req)
 	if err != nil {
@@ -1068,6 +2610,28 @@ func (s *httpServer) doFinishMemDelayed(w http.ResponseWriter, req *http.Request
 	return nil, nil
 }
 
+// doScalingSignals returns the compact channel metrics for the consumer autoscaling,
+// only the leader partitions on this node are returned.
+func (s *httpServer) doScalingSignals(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName := reqParams.Get("topic")
+	channelName := reqParams.Get("channel")
+	window := 5 * time.Minute
+	if windowStr := reqParams.Get("window"); windowStr != "" {
+		window, err = time.ParseDuration(windowStr)
+		if err != nil || window <= 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_WINDOW"}
+		}
+	}
+	return struct {
+		Signals []nsqd.ChannelScalingSignal `json:"signals"`
+	}{s.ctx.nsqd.GetScalingSignals(topicName, channelName, window)}, nil
+}
+
 func (s *httpServer) doCoordStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	if s.ctx.nsqdCoord != nil {
 		reqParams, err := url.ParseQuery(req.URL.RawQuery)
@@ -1101,12 +2665,14 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 	topicName := reqParams.Get("topic")
 	topicPart := reqParams.Get("partition")
 	channelName := reqParams.Get("channel")
+	namespace := reqParams.Get("namespace")
 	leaderOnlyStr := reqParams.Get("leaderOnly")
 	needClients := reqParams.Get("needClients")
 	var leaderOnly bool
 	leaderOnly, _ = strconv.ParseBool(leaderOnlyStr)
 
 	jsonFormat := formatString == "json"
+	protobufFormat := formatString == "protobuf"
 	filterClients := len(needClients) == 0
 
 	stats := s.ctx.getStats(leaderOnly, topicName, filterClients)
@@ -1141,17 +2707,55 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 		}
 		stats = filteredStats
 	}
+	var nsStats *nsqd.NamespaceStats
+	if len(namespace) > 0 {
+		filteredStats := make([]nsqd.TopicStats, 0, len(stats))
+		for _, topicStats := range stats {
+			if nsqd.GetTopicNamespace(topicStats.TopicName) == namespace {
+				filteredStats = append(filteredStats, topicStats)
+			}
+		}
+		stats = filteredStats
+		nsStats = &nsqd.NamespaceStats{Namespace: namespace}
+		if rollups := s.ctx.getNamespaceStats(stats, namespace); len(rollups) > 0 {
+			nsStats = &rollups[0]
+		}
+	}
 
-	if !jsonFormat {
-		return s.printStats(stats, health, startTime, uptime), nil
+	if !jsonFormat && !protobufFormat {
+		data := s.printStats(stats, health, startTime, uptime)
+		if nsStats != nil {
+			data = append(data, []byte(fmt.Sprintf("\nnamespace %v: topics: %v partitions: %v depth: %v disk: %v pub_rejected: %v over_quota: %v\n",
+				nsStats.Namespace, nsStats.Topics, nsStats.Partitions, nsStats.Depth, nsStats.DiskBytes,
+				nsStats.PubRejected, nsStats.OverQuota))...)
+		}
+		return data, nil
 	}
 
-	return struct {
-		Version   string            `json:"version"`
-		Health    string            `json:"health"`
-		StartTime int64             `json:"start_time"`
-		Topics    []nsqd.TopicStats `json:"topics"`
-	}{version.Binary, health, startTime.Unix(), stats}, nil
+	resp := &StatsResponse{nsqd.StatsSchemaVersion, version.Binary, health, startTime.Unix(), stats,
+		s.ctx.getACLDeniedStats(), s.ctx.getProtocolStats(), nsStats, s.ctx.getConnLimitStats()}
+	if protobufFormat {
+		data, err := protoenc.Marshal(resp)
+		if err != nil {
+			nsqd.NsqLogger().LogErrorf("failed to encode stats - %s", err)
+			return nil, http_api.Err{500, "INTERNAL_ERROR"}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set(statsSchemaVersionHeader, strconv.Itoa(nsqd.StatsSchemaVersion))
+		return data, nil
+	}
+	return resp, nil
+}
+
+func (s *httpServer) doStatsSchema(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	schema, err := protoenc.Schema(statsSchemaPackage, &StatsResponse{})
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failed to generate stats schema - %s", err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set(statsSchemaVersionHeader, strconv.Itoa(nsqd.StatsSchemaVersion))
+	return fmt.Sprintf("// stats schema version %v\n%v", nsqd.StatsSchemaVersion, schema), nil
 }
 
 func (s *httpServer) printStats(stats []nsqd.TopicStats, health string, startTime time.Time, uptime time.Duration) []byte {
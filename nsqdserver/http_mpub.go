@@ -0,0 +1,136 @@
+package nsqdserver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/youzan/nsq/internal/http_api"
+	"github.com/youzan/nsq/nsqd"
+)
+
+// the header of the mpub response with the count of the messages written before
+// the failed batch, since the large body is written in multiple batches.
+const httpMPubWrittenHeader = "X-Nsq-Mpub-Written"
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// httpMPubReader parses the messages of the mpub body one by one while reading, so
+// the chunked body can be handled and the whole body is not needed in memory. The
+// body of each message is in the buffer from the topic buffer pool.
+type httpMPubReader struct {
+	topic      *nsqd.Topic
+	body       *countingReader
+	r          *bufio.Reader
+	binary     bool
+	maxMsgSize int64
+	maxBody    int64
+	// the messages left in the binary body, -1 before the count is read
+	left int32
+	tmp  []byte
+}
+
+func newHTTPMPubReader(topic *nsqd.Topic, body io.Reader, binary bool, maxMsgSize int64, maxBody int64) *httpMPubReader {
+	// add 1 so that it's greater than our max when we test for it
+	// (LimitReader returns a "fake" EOF)
+	cr := &countingReader{r: io.LimitReader(body, maxBody+1)}
+	return &httpMPubReader{
+		topic:      topic,
+		body:       cr,
+		r:          nsqd.NewBufioReader(cr),
+		binary:     binary,
+		maxMsgSize: maxMsgSize,
+		maxBody:    maxBody,
+		left:       -1,
+		tmp:        make([]byte, 4),
+	}
+}
+
+func (mr *httpMPubReader) close() {
+	nsqd.PutBufioReader(mr.r)
+}
+
+// next returns the buffer of the next message body, and io.EOF after the last. The
+// caller should put the buffer back to the topic buffer pool.
+func (mr *httpMPubReader) next() (*bytes.Buffer, error) {
+	var b *bytes.Buffer
+	var err error
+	if mr.binary {
+		b, err = mr.nextBinary()
+	} else {
+		b, err = mr.nextLine()
+	}
+	if mr.body.n > mr.maxBody {
+		if b != nil {
+			mr.topic.BufferPoolPut(b)
+		}
+		return nil, http_api.Err{413, "BODY_TOO_BIG"}
+	}
+	return b, err
+}
+
+func (mr *httpMPubReader) nextBinary() (*bytes.Buffer, error) {
+	if mr.left < 0 {
+		numMessages, err := readLen(mr.r, mr.tmp)
+		// 4 == total num, 5 == length + min 1
+		if err != nil || numMessages <= 0 || int64(numMessages) > (mr.maxBody-4)/5 {
+			return nil, http_api.Err{413, "BAD_BODY"}
+		}
+		mr.left = numMessages
+	}
+	if mr.left == 0 {
+		return nil, io.EOF
+	}
+	messageSize, err := readLen(mr.r, mr.tmp)
+	if err != nil || messageSize <= 0 || int64(messageSize) > mr.maxMsgSize {
+		return nil, http_api.Err{413, "BAD_MESSAGE"}
+	}
+	b := mr.topic.BufferPoolGet(int(messageSize))
+	_, err = io.CopyN(b, mr.r, int64(messageSize))
+	if err != nil {
+		mr.topic.BufferPoolPut(b)
+		return nil, http_api.Err{413, "BAD_MESSAGE"}
+	}
+	mr.left--
+	return b, nil
+}
+
+func (mr *httpMPubReader) nextLine() (*bytes.Buffer, error) {
+	b := mr.topic.BufferPoolGet(0)
+	for {
+		line, err := mr.r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			mr.topic.BufferPoolPut(b)
+			return nil, http_api.Err{500, "INTERNAL_ERROR"}
+		}
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			line = line[:len(line)-1]
+		}
+		if int64(b.Len()+len(line)) > mr.maxMsgSize {
+			mr.topic.BufferPoolPut(b)
+			return nil, http_api.Err{413, "MSG_TOO_BIG"}
+		}
+		b.Write(line)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		// silently discard 0 length messages
+		// this maintains the behavior pre 0.2.22
+		if b.Len() > 0 {
+			return b, nil
+		}
+		if err == io.EOF {
+			mr.topic.BufferPoolPut(b)
+			return nil, io.EOF
+		}
+	}
+}
@@ -3,11 +3,14 @@ package nsqdserver
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"runtime"
 	"strconv"
@@ -18,8 +21,13 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/spaolacci/murmur3"
 	"github.com/youzan/go-nsq"
+	"github.com/youzan/nsq/consistence"
 	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/http_api"
+	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/internal/protocol"
 	"github.com/youzan/nsq/internal/test"
 	"github.com/youzan/nsq/internal/version"
 	"github.com/youzan/nsq/nsqd"
@@ -400,6 +408,67 @@ func TestHTTPpubpartition(t *testing.T) {
 	time.Sleep(5 * time.Millisecond)
 }
 
+func TestHTTPpubRoutingKey(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.LogLevel = 2
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	// the same as the murmur3 used by the producer
+	test.Equal(t, uint32(0x248bfa47), murmur3.Sum32([]byte("hello")))
+
+	topicName := "test_http_pub_routing" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName, 0)
+	nsqd.GetTopic(topicName, 1)
+
+	var pubRsp PubResponse
+	for _, key := range []string{"key1", "key2", "key3", "key4"} {
+		expectedPart := int(murmur3.Sum32([]byte(key)) % 2)
+		url := fmt.Sprintf("http://%s/pub?topic=%s&routing_key=%s", httpAddr, topicName, key)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBuffer([]byte("test message")))
+		test.Equal(t, err, nil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		test.Equal(t, resp.StatusCode, 200)
+		err = json.Unmarshal(body, &pubRsp)
+		test.Nil(t, err)
+		test.Equal(t, "OK", pubRsp.Status)
+		test.Equal(t, expectedPart, pubRsp.Partition)
+		test.NotEqual(t, uint64(0), pubRsp.ID)
+
+		url = fmt.Sprintf("http://%s/mpub?topic=%s&routing_key=%s", httpAddr, topicName, key)
+		resp, err = http.Post(url, "application/octet-stream", bytes.NewBuffer([]byte("msg1\nmsg2\n")))
+		test.Equal(t, err, nil)
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		test.Equal(t, resp.StatusCode, 200)
+		err = json.Unmarshal(body, &pubRsp)
+		test.Nil(t, err)
+		test.Equal(t, expectedPart, pubRsp.Partition)
+		test.Equal(t, 2, pubRsp.Count)
+	}
+
+	// explicit partition returns the detail only if required
+	url := fmt.Sprintf("http://%s/pub?topic=%s&partition=1&format=json", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBuffer([]byte("test message")))
+	test.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	err = json.Unmarshal(body, &pubRsp)
+	test.Nil(t, err)
+	test.Equal(t, 1, pubRsp.Partition)
+
+	url = fmt.Sprintf("http://%s/pub?topic=%s&partition=1&routing_key=key1", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBuffer([]byte("test message")))
+	test.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, resp.StatusCode, 400)
+	test.Equal(t, string(body), `{"message":"PARTITION_ROUTING_KEY_CONFLICT"}`)
+}
+
 func TestHTTPpubtrace(t *testing.T) {
 	opts := nsqd.NewOptions()
 	opts.LogLevel = 2
@@ -470,6 +539,90 @@ func TestHTTPpubEmpty(t *testing.T) {
 
 }
 
+func TestHTTPpubReadOnlyRecovery(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.ReadOnlyRecovery = true
+	tcpAddr, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_pub_read_only" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+	// the existing data should be consumed in read only mode
+	_, _, _, _, err := topic.PutMessage(nsqd.NewMessage(0, []byte("test message")))
+	test.Nil(t, err)
+	topic.ForceFlush()
+
+	// the channels can not be changed
+	for _, path := range []string{"/channel/create?topic=%s&channel=ch2", "/channel/delete?topic=%s&channel=ch",
+		"/channel/empty?topic=%s&channel=ch", "/channel/setoffset?topic=%s&channel=ch", "/topic/greedyclean?topic=%s"} {
+		url := fmt.Sprintf("http://%s"+path, httpAddr, topicName)
+		resp, err := http.Post(url, "application/json", bytes.NewBufferString(`{"timestamp":0}`))
+		test.Equal(t, err, nil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		test.Equal(t, 403, resp.StatusCode)
+		test.Equal(t, strings.Contains(string(body), E_READ_ONLY), true)
+	}
+	_, err = topic.GetExistingChannel("ch2")
+	test.NotNil(t, err)
+	_, err = topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+
+	buf := bytes.NewBuffer([]byte("test message"))
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", buf)
+	test.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.NotEqual(t, resp.StatusCode, 200)
+	test.Equal(t, strings.Contains(string(body), E_READ_ONLY), true)
+
+	buf = bytes.NewBuffer([]byte("test message 1\ntest message 2"))
+	url = fmt.Sprintf("http://%s/mpub?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", buf)
+	test.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.NotEqual(t, resp.StatusCode, 200)
+	test.Equal(t, strings.Contains(string(body), E_READ_ONLY), true)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Equal(t, err, nil)
+	msgOut := recvNextMsgAndCheck(t, conn, len("test message"), 0, true)
+	test.NotNil(t, msgOut)
+	test.Equal(t, uint64(1), topic.TotalMessageCnt())
+
+	// the new channel can not be created by the subscribe
+	subConn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer subConn.Close()
+	identify(t, subConn, nil, frameTypeResponse)
+	_, err = nsq.Subscribe(topicName, "ch2").WriteTo(subConn)
+	test.Equal(t, err, nil)
+	subResp, err := nsq.ReadResponse(subConn)
+	test.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(subResp)
+	test.Equal(t, err, nil)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, strings.HasPrefix(string(data), E_READ_ONLY), true)
+
+	pubConn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer pubConn.Close()
+	identify(t, pubConn, nil, frameTypeResponse)
+	_, err = nsq.Publish(topicName, []byte("test message")).WriteTo(pubConn)
+	test.Equal(t, err, nil)
+	readValidate(t, pubConn, frameTypeError, "E_READ_ONLY nsqd is in read only recovery mode")
+}
+
 func TestHTTPmpub(t *testing.T) {
 	opts := nsqd.NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -498,6 +651,47 @@ func TestHTTPmpub(t *testing.T) {
 
 }
 
+func TestHTTPDedupOnlySinglePub(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd1, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_dedup" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd1.GetTopicIgnPart(topicName)
+	// the dedup key is carried in the json header
+	topic.SetDynamicInfo(nsqd.TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, Ext: true}, nil)
+	url := fmt.Sprintf("http://%s/topic/dedup?topic=%s&partition=0&mode=reject&window=1h", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, nsqd.DedupModeReject, topic.GetDedupConf().Mode)
+
+	url = fmt.Sprintf("http://%s/pub?topic=%s&dedup_key=order-1", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	test.Equal(t, 409, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, uint64(1), topic.TotalMessageCnt())
+
+	// the batch publish is not deduplicated
+	url = fmt.Sprintf("http://%s/mpub?topic=%s&dedup_key=order-1", httpAddr, topicName)
+	for i := 0; i < 2; i++ {
+		resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message\ntest message"))
+		test.Nil(t, err)
+		test.Equal(t, 200, resp.StatusCode)
+		resp.Body.Close()
+	}
+	test.Equal(t, uint64(5), topic.TotalMessageCnt())
+	test.Equal(t, int64(1), topic.GetDedupStats().Rejected)
+}
+
 func TestHTTPmpubEmpty(t *testing.T) {
 	opts := nsqd.NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -528,160 +722,1301 @@ func TestHTTPmpubEmpty(t *testing.T) {
 
 }
 
-func TestHTTPmpubBinary(t *testing.T) {
+func TestHTTPmpubBinary(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_mpub_bin" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopicIgnPart(topicName)
+
+	mpub := make([][]byte, 5)
+	for i := range mpub {
+		mpub[i] = make([]byte, 100)
+	}
+	cmd, _ := nsq.MultiPublish(topicName, mpub)
+	buf := bytes.NewBuffer(cmd.Body)
+
+	url := fmt.Sprintf("http://%s/mpub?topic=%s&binary=true", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", buf)
+	test.Equal(t, err, nil)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	test.Equal(t, string(body), "OK")
+
+	time.Sleep(5 * time.Millisecond)
+
+}
+
+func TestHTTPmpubChunkedInBatches(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxHTTPMPubBatchSize = 100
+	opts.MaxBodySize = 1000
+	_, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_mpub_chunked" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+
+	msgs := make([][]byte, 20)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("test message %v with some padding", i))
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		for _, m := range msgs {
+			pw.Write(m)
+			pw.Write([]byte("\n"))
+		}
+		pw.Close()
+	}()
+	// the body without the content length is sent with chunked transfer encoding
+	url := fmt.Sprintf("http://%s/mpub?topic=%s&format=json", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", pr)
+	test.Equal(t, err, nil)
+	defer resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	var pubRsp PubResponse
+	err = json.NewDecoder(resp.Body).Decode(&pubRsp)
+	test.Nil(t, err)
+	test.Equal(t, len(msgs), pubRsp.Count)
+	test.Equal(t, uint64(len(msgs)), topic.TotalMessageCnt())
+
+	// the chunked body is still limited by the max body size
+	body := bytes.Repeat([]byte("0123456789\n"), int(opts.MaxBodySize/11)+1)
+	resp2, err := http.Post(url, "application/octet-stream", ioutil.NopCloser(bytes.NewReader(body)))
+	test.Equal(t, err, nil)
+	defer resp2.Body.Close()
+	test.Equal(t, 413, resp2.StatusCode)
+	test.NotEqual(t, "", resp2.Header.Get(httpMPubWrittenHeader))
+}
+
+func TestHTTPmpubQuotaCheckedBeforeFirstBatch(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxHTTPMPubBatchSize = 100
+	_, httpAddr, nsqd1, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	err := nsqd1.SetNamespaceQuota("tenantmpub", nsqd.NamespaceQuota{MaxPubRate: 5})
+	test.Nil(t, err)
+	topicName := "tenantmpub.test_http_mpub_quota" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd1.GetTopicIgnPart(topicName)
+
+	body := bytes.Repeat([]byte("test message with some padding\n"), 20)
+	url := fmt.Sprintf("http://%s/mpub?topic=%s", httpAddr, topicName)
+	// the later batches are not rejected after the first batch written
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(body))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, uint64(20), topic.TotalMessageCnt())
+
+	// the messages of the last request are counted in the publish rate
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewReader(body))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 429, resp.StatusCode)
+	test.Equal(t, "", resp.Header.Get(httpMPubWrittenHeader))
+	test.Equal(t, uint64(20), topic.TotalMessageCnt())
+}
+
+func TestHTTPmpubAtomicWithoutBatch(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxMsgSize = 100
+	_, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+	test.Equal(t, int64(0), opts.MaxHTTPMPubBatchSize)
+
+	topicName := "test_http_mpub_atomic" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+
+	// nothing should be written if the last message is invalid
+	body := bytes.Repeat([]byte("test message\n"), 100)
+	body = append(body, bytes.Repeat([]byte("a"), int(opts.MaxMsgSize)+1)...)
+	url := fmt.Sprintf("http://%s/mpub?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(body))
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 413, resp.StatusCode)
+	test.Equal(t, "", resp.Header.Get(httpMPubWrittenHeader))
+	test.Equal(t, uint64(0), topic.TotalMessageCnt())
+
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewReader(nil))
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 406, resp.StatusCode)
+}
+
+func TestHTTPSlowDiskStatus(t *testing.T) {
+	eventChan := make(chan SlowDiskEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e SlowDiskEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		eventChan <- e
+	}))
+	defer webhook.Close()
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	test.Equal(t, false, opts.SlowDiskAutoTransfer)
+	opts.AlertWebhook = webhook.URL
+	// any write is slow
+	opts.SlowDiskSyncThreshold = time.Nanosecond
+	_, httpAddr, nsqd1, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_slow_disk" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd1.GetTopicIgnPart(topicName)
+	for i := 0; i < slowDiskDegradeWindows; i++ {
+		test.Equal(t, false, topic.IsDiskDegraded())
+		_, _, _, _, err := topic.PutMessage(nsqd.NewMessage(0, []byte("test message")))
+		test.Nil(t, err)
+		topic.ForceFlush()
+		nsqdServer.ctx.slowDiskMgr.check()
+	}
+	test.Equal(t, true, topic.IsDiskDegraded())
+	latency := topic.GetDiskLatencyStats()
+	test.NotEqual(t, int64(0), latency.Syncs)
+	test.NotEqual(t, int64(0), latency.DegradedSince)
+
+	url := fmt.Sprintf("http://%s/disk/slow", httpAddr)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	var status SlowDiskStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(status.Degraded))
+	test.Equal(t, topicName, status.Degraded[0].Topic)
+	test.Equal(t, 1, len(status.Events))
+	test.Equal(t, SlowDiskEventDegraded, status.Events[0].Type)
+	select {
+	case e := <-eventChan:
+		test.Equal(t, AlertKindSlowDisk, e.Kind)
+		test.Equal(t, SlowDiskEventDegraded, e.Type)
+		test.Equal(t, topicName, e.Topic)
+	case <-time.After(time.Second * 5):
+		t.Fatal("webhook event timeout")
+	}
+
+	// recovered if the disk is not slow any more
+	newOpts := *opts
+	newOpts.SlowDiskSyncThreshold = time.Hour
+	newOpts.SlowDiskWriteThreshold = time.Hour
+	nsqd1.SwapOpts(&newOpts)
+	for i := 0; i < slowDiskRecoverWindows; i++ {
+		test.Equal(t, true, topic.IsDiskDegraded())
+		_, _, _, _, err := topic.PutMessage(nsqd.NewMessage(0, []byte("test message")))
+		test.Nil(t, err)
+		topic.ForceFlush()
+		nsqdServer.ctx.slowDiskMgr.check()
+	}
+	test.Equal(t, false, topic.IsDiskDegraded())
+	test.Equal(t, SlowDiskEventRecovered, nsqdServer.ctx.slowDiskMgr.getStatus().Events[1].Type)
+}
+
+func TestHTTPTopicWriteLatencySLO(t *testing.T) {
+	eventChan := make(chan LatencySLOEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e LatencySLOEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		eventChan <- e
+	}))
+	defer webhook.Close()
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.AlertWebhook = webhook.URL
+	_, httpAddr, nsqd1, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_write_latency_slo" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd1.GetTopicIgnPart(topicName)
+	url := fmt.Sprintf("http://%s/topic/slo?topic=%s&partition=0&percentile=0.99&latency=100ms&window=10s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, 100*time.Millisecond, topic.GetWriteLatencySLO().Latency)
+
+	now := time.Now()
+	nsqdServer.ctx.latencySLOMgr.check(now)
+	// the p99 breached with 2 of 100 writes slow
+	for i := 0; i < 98; i++ {
+		topic.GetDetailStats().UpdateTopicMsgStats(10, 500)
+	}
+	topic.GetDetailStats().UpdateTopicMsgStats(10, 300000)
+	topic.GetDetailStats().UpdateTopicMsgStats(10, 300000)
+	now = now.Add(10 * time.Second)
+	nsqdServer.ctx.latencySLOMgr.check(now)
+	slo := topic.GetWriteLatencySLOStats()
+	test.Equal(t, true, slo.Degraded)
+	test.Equal(t, int64(100), slo.Writes)
+	test.Equal(t, true, slo.CurrentUs > 100000)
+
+	select {
+	case e := <-eventChan:
+		test.Equal(t, LatencySLOEventFiring, e.Type)
+		test.Equal(t, topicName, e.Topic)
+	case <-time.After(time.Second * 5):
+		t.Fatal("webhook event timeout")
+	}
+	resp, err = http.Get(fmt.Sprintf("http://%s/topic/slo/alerts", httpAddr))
+	test.Nil(t, err)
+	var status LatencySLOStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, 1, len(status.Degraded))
+	test.Equal(t, 1, len(status.Events))
+
+	// the slow writes are out of the window
+	for i := 0; i < 100; i++ {
+		topic.GetDetailStats().UpdateTopicMsgStats(10, 500)
+	}
+	now = now.Add(10 * time.Second)
+	nsqdServer.ctx.latencySLOMgr.check(now)
+	test.Equal(t, false, topic.GetWriteLatencySLOStats().Degraded)
+	select {
+	case e := <-eventChan:
+		test.Equal(t, LatencySLOEventResolved, e.Type)
+	case <-time.After(time.Second * 5):
+		t.Fatal("webhook event timeout")
+	}
+}
+
+func TestHTTPSelfTest(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd1, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/selftest?timeout=invalid", httpAddr))
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err = http.Get(fmt.Sprintf("http://%s/selftest?timeout=5s", httpAddr))
+		test.Nil(t, err)
+		test.Equal(t, 200, resp.StatusCode)
+		var r SelfTestResult
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		resp.Body.Close()
+		test.Nil(t, err)
+		test.Equal(t, true, r.Success)
+		test.Equal(t, true, r.E2ELatencyUs > 0)
+		test.Equal(t, true, r.E2ELatencyUs >= r.PubLatencyUs)
+	}
+	topic, err := nsqd1.GetExistingTopic(nsqd.SelfTestTopic, 0)
+	test.Nil(t, err)
+	ch, err := topic.GetExistingChannel(selfTestChannel)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), ch.Depth())
+	// the hidden topic is not in the stats
+	for _, ts := range nsqd1.GetStats(false, true) {
+		test.NotEqual(t, nsqd.SelfTestTopic, ts.TopicName)
+	}
+}
+
+func TestHTTPChannelSLOAlert(t *testing.T) {
+	eventChan := make(chan ChannelSLOEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e ChannelSLOEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		eventChan <- e
+	}))
+	defer webhook.Close()
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.AlertWebhook = webhook.URL
+	tcpAddr, httpAddr, nsqd1, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_channel_slo_alert" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd1.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+	url := fmt.Sprintf("http://%s/channel/slo?topic=%s&partition=0&channel=ch&target=0.9&latency=30s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	// the messages published long ago are stuck in flight without finished
+	msgNum := 20
+	for i := 0; i < msgNum; i++ {
+		msg := nsqd.NewMessage(0, []byte("test"))
+		msg.Timestamp = time.Now().Add(-time.Minute).UnixNano()
+		_, _, _, _, err = topic.PutMessage(msg)
+		test.Nil(t, err)
+	}
+	topic.ForceFlush()
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(msgNum).WriteTo(conn)
+	test.Nil(t, err)
+	for i := 0; i < msgNum; i++ {
+		recvNextMsgAndCheck(t, conn, len("test"), 0, false)
+	}
+	nsqdServer.ctx.latencySLOMgr.check(time.Now())
+	select {
+	case e := <-eventChan:
+		test.Equal(t, AlertKindChannelSLO, e.Kind)
+		test.Equal(t, LatencySLOEventFiring, e.Type)
+		test.Equal(t, topicName, e.Topic)
+		test.Equal(t, "ch", e.Channel)
+		test.Equal(t, int64(msgNum), e.Stuck)
+	case <-time.After(time.Second * 5):
+		t.Fatal("webhook event timeout")
+	}
+	resp, err = http.Get(fmt.Sprintf("http://%s/topic/slo/alerts", httpAddr))
+	test.Nil(t, err)
+	var status LatencySLOStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, 1, len(status.BreachedChannels))
+	test.Equal(t, 1, len(status.ChannelEvents))
+	test.Equal(t, 0, len(status.Events))
+}
+
+func TestHTTPSelfTestTLSAuth(t *testing.T) {
+	authSecret := "selftestsecret"
+	var authSecrets []string
+	var authLock sync.Mutex
+	authd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		authLock.Lock()
+		authSecrets = append(authSecrets, r.Form.Get("secret"))
+		authLock.Unlock()
+		fmt.Fprintf(w, `{"ttl":10, "authorizations":
+			[{"topic":"%s", "channels":[".*"], "permissions":["subscribe","publish"]}]}`, nsqd.SelfTestTopic)
+	}))
+	defer authd.Close()
+	addr, err := url.Parse(authd.URL)
+	test.Nil(t, err)
+
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.TLSCert = "./test/certs/server.pem"
+	opts.TLSKey = "./test/certs/server.key"
+	opts.TLSRequired = TLSRequiredExceptHTTP
+	opts.AuthHTTPAddresses = []string{addr.Host}
+	_, httpAddr, nsqd1, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	// no secret to auth
+	resp, err := http.Get(fmt.Sprintf("http://%s/selftest?timeout=5s", httpAddr))
+	test.Nil(t, err)
+	test.Equal(t, 500, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, true, strings.Contains(string(body), errSelfTestAuth.Error()))
+
+	newOpts := *opts
+	newOpts.SelfTestAuthSecret = authSecret
+	nsqd1.SwapOpts(&newOpts)
+	resp, err = http.Get(fmt.Sprintf("http://%s/selftest?timeout=5s", httpAddr))
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	var r SelfTestResult
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, true, r.Success)
+	authLock.Lock()
+	test.Equal(t, true, len(authSecrets) > 0)
+	for _, s := range authSecrets {
+		test.Equal(t, authSecret, s)
+	}
+	authLock.Unlock()
+}
+
+func TestSelfTestTopicLocalInClusterMode(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd1, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	// the coordinator is never used for the hidden topic, so the empty one is enough
+	ctx := &context{nsqd: nsqd1, nsqdCoord: &consistence.NsqdCoordinator{}}
+	test.Equal(t, false, ctx.isLocalTopic("normal_topic"))
+	test.Equal(t, true, ctx.isLocalTopic(nsqd.SelfTestTopic))
+	test.Equal(t, true, ctx.checkForMasterWrite(nsqd.SelfTestTopic, 0))
+
+	topic := nsqd1.GetTopic(nsqd.SelfTestTopic, 0)
+	topic.GetChannel(selfTestChannel)
+	_, _, _, _, err := ctx.PutMessage(topic, []byte("selftest"), nil, 0)
+	test.Nil(t, err)
+	test.Equal(t, uint64(1), topic.TotalMessageCnt())
+	_, _, _, err = ctx.PutMessages(topic, []*nsqd.Message{nsqd.NewMessage(0, []byte("selftest"))})
+	test.Nil(t, err)
+	test.Equal(t, uint64(2), topic.TotalMessageCnt())
+}
+
+func TestHTTPStructuredError(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd1, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_structured_error" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd1.GetTopicIgnPart(topicName)
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer([]byte("")))
+	req.Header.Set("Accept", "application/vnd.nsq; version=1.0")
+	resp, err := http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 406, resp.StatusCode)
+	test.Equal(t, `{"message":"MSG_EMPTY"}`, string(body))
+	test.Equal(t, "MSG_EMPTY", resp.Header.Get(http_api.ErrorCodeHeader))
+	test.Equal(t, protocol.ErrCategoryInvalid, resp.Header.Get(http_api.ErrorCategoryHeader))
+	test.Equal(t, "false", resp.Header.Get(http_api.ErrorRetryableHeader))
+
+	req, _ = http.NewRequest("POST", url, bytes.NewBuffer([]byte("")))
+	req.Header.Set("Accept", "application/vnd.nsq; version=1.0")
+	req.Header.Set(http_api.StructuredErrorHeader, "true")
+	resp, err = http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	var se protocol.StructuredErr
+	err = json.NewDecoder(resp.Body).Decode(&se)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, 406, resp.StatusCode)
+	test.Equal(t, "MSG_EMPTY", se.Code)
+	test.Equal(t, protocol.ErrCategoryInvalid, se.Category)
+	test.Equal(t, false, se.Retryable)
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/error_codes", httpAddr))
+	test.Nil(t, err)
+	var codes struct {
+		ErrorCodes []protocol.ErrorCode `json:"error_codes"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&codes)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, len(protocol.ErrorCodes()), len(codes.ErrorCodes))
+}
+
+func TestHTTPFinish(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.LogLevel = 2
+	opts.Logger = newTestLogger(t)
+	if testing.Verbose() {
+		opts.LogLevel = 4
+		nsqd.SetLogger(opts.Logger)
+	}
+
+	//opts.Logger = &levellogger.SimpleLogger{}
+	tcpAddr, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_finish" + strconv.Itoa(int(time.Now().Unix()))
+	_ = nsqd.GetTopicIgnPart(topicName)
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	buf := bytes.NewBuffer([]byte("test message"))
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", buf)
+	test.Equal(t, err, nil)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	test.Equal(t, string(body), "OK")
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Equal(t, err, nil)
+	// sleep to allow the RDY state to take effect
+	time.Sleep(50 * time.Millisecond)
+
+	for {
+		resp, _ := nsq.ReadResponse(conn)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.NotEqual(t, frameTypeError, frameType)
+		if frameType == frameTypeResponse {
+			t.Logf("got response data: %v", string(data))
+			continue
+		}
+		msgOut, err := nsq.DecodeMessage(data)
+		test.Equal(t, []byte("test message"), msgOut.Body)
+
+		url := fmt.Sprintf("http://%s/message/finish?topic=%s&partition=0&channel=%s&msgid=%d", httpAddr,
+			topicName, "ch", nsq.GetNewMessageID(msgOut.ID[:]))
+		ret, err := http.Post(url, "", nil)
+		test.Equal(t, err, nil)
+		test.Equal(t, 200, ret.StatusCode)
+		ioutil.ReadAll(ret.Body)
+		ret.Body.Close()
+		break
+	}
+	conn.Close()
+}
+
+func TestHTTPFinishMemDelayed(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.LogLevel = 2
+	opts.Logger = newTestLogger(t)
+	if testing.Verbose() {
+		opts.LogLevel = 4
+		nsqd.SetLogger(opts.Logger)
+	}
+
+	//opts.Logger = &levellogger.SimpleLogger{}
+	tcpAddr, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_finish" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	buf := bytes.NewBuffer([]byte("test message"))
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", buf)
+	test.Equal(t, err, nil)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	test.Equal(t, string(body), "OK")
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Equal(t, err, nil)
+	// sleep to allow the RDY state to take effect
+	time.Sleep(50 * time.Millisecond)
+	ch, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+
+	for {
+		resp, _ := nsq.ReadResponse(conn)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.NotEqual(t, frameTypeError, frameType)
+		if frameType == frameTypeResponse {
+			t.Logf("got response data: %v", string(data))
+			continue
+		}
+		msgOut, err := nsq.DecodeMessage(data)
+		test.Equal(t, []byte("test message"), msgOut.Body)
+		nsq.Requeue(msgOut.ID, time.Second*10).WriteTo(conn)
+		time.Sleep(time.Second)
+		delayedMsgs := ch.GetMemDelayedMsgs()
+		test.Equal(t, 1, len(delayedMsgs))
+
+		url := fmt.Sprintf("http://%s/channel/finishmemdelayed?topic=%s&partition=0&channel=%s", httpAddr,
+			topicName, "ch")
+		ret, err := http.Post(url, "", nil)
+		test.Equal(t, err, nil)
+		test.Equal(t, 200, ret.StatusCode)
+		ioutil.ReadAll(ret.Body)
+		ret.Body.Close()
+		break
+	}
+	delayedMsgs := ch.GetMemDelayedMsgs()
+	test.Equal(t, 0, len(delayedMsgs))
+	conn.Close()
+}
+
+func TestHTTPRedriveChannel(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.LogLevel = 2
+	opts.Logger = newTestLogger(t)
+	tcpAddr, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_redrive" + strconv.Itoa(int(time.Now().Unix()))
+	dlqTopicName := topicName + "_dlq"
+	_ = nsqd.GetTopicIgnPart(topicName)
+	_ = nsqd.GetTopicIgnPart(dlqTopicName)
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	for i := 0; i < 3; i++ {
+		buf := bytes.NewBuffer([]byte("test message"))
+		url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, dlqTopicName)
+		resp, err := http.Post(url, "application/octet-stream", buf)
+		test.Equal(t, err, nil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		test.Equal(t, string(body), "OK")
+	}
+
+	url := fmt.Sprintf("http://%s/channel/redrive?topic=%s&channel=ch&dlq_topic=%s&rate=1000",
+		httpAddr, topicName, dlqTopicName)
+	resp, err := http.Post(url, "", nil)
+	test.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	var st RedriveStatus
+	err = json.Unmarshal(body, &st)
+	test.Nil(t, err)
+
+	start := time.Now()
+	for st.State == redriveStateRunning {
+		if time.Since(start) > time.Second*10 {
+			t.Fatalf("re-drive job not done: %v", st)
+		}
+		time.Sleep(time.Millisecond * 100)
+		resp, err := http.Get(fmt.Sprintf("http://%s/channel/redrive/status?id=%v", httpAddr, st.ID))
+		test.Equal(t, err, nil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		err = json.Unmarshal(body, &st)
+		test.Nil(t, err)
+	}
+	test.Equal(t, redriveStateDone, st.State)
+	test.Equal(t, int64(3), st.Scanned)
+	test.Equal(t, int64(3), st.Redriven)
+
+	_, err = nsq.Ready(3).WriteTo(conn)
+	test.Equal(t, err, nil)
+	recvCnt := 0
+	for recvCnt < 3 {
+		resp, _ := nsq.ReadResponse(conn)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.NotEqual(t, frameTypeError, frameType)
+		if frameType == frameTypeResponse {
+			continue
+		}
+		msgOut, err := nsq.DecodeMessage(data)
+		test.Nil(t, err)
+		test.Equal(t, []byte("test message"), msgOut.Body)
+		_, err = nsq.Finish(msgOut.ID).WriteTo(conn)
+		test.Nil(t, err)
+		recvCnt++
+	}
+
+	// the rate too large should be rejected
+	resp, err = http.Post(fmt.Sprintf("http://%s/channel/redrive?topic=%s&channel=ch&dlq_topic=%s&rate=2000000000",
+		httpAddr, topicName, dlqTopicName), "", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	// the re-driven messages should not be re-driven again
+	resp, err = http.Post(url, "", nil)
+	test.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	err = json.Unmarshal(body, &st)
+	test.Nil(t, err)
+	for st.State == redriveStateRunning {
+		time.Sleep(time.Millisecond * 100)
+		resp, err := http.Get(fmt.Sprintf("http://%s/channel/redrive/status?id=%v", httpAddr, st.ID))
+		test.Equal(t, err, nil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		err = json.Unmarshal(body, &st)
+		test.Nil(t, err)
+	}
+	test.Equal(t, redriveStateDone, st.State)
+	test.Equal(t, int64(0), st.Scanned)
+	test.Equal(t, int64(0), st.Redriven)
+}
+
+func TestHTTPChannelDepthHistory(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.SyncEvery = 1
+	opts.DepthHistoryInterval = 100 * time.Millisecond
+	_, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_depth_history" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+
+	for i := 0; i < 2; i++ {
+		buf := bytes.NewBuffer([]byte("test message"))
+		url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+		resp, err := http.Post(url, "application/octet-stream", buf)
+		test.Equal(t, err, nil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		test.Equal(t, string(body), "OK")
+	}
+	time.Sleep(opts.DepthHistoryInterval * 3)
+
+	url := fmt.Sprintf("http://%s/channel/depth/history?topic=%s&channel=ch&ago=0s&samples=true", httpAddr, topicName)
+	resp, err := http.Get(url)
+	test.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	var ret struct {
+		Depth        int64 `json:"depth"`
+		CurrentDepth int64 `json:"current_depth"`
+		DepthChange  int64 `json:"depth_change"`
+		Samples      []struct {
+			Depth int64 `json:"depth"`
+		} `json:"samples"`
+	}
+	err = json.Unmarshal(body, &ret)
+	test.Nil(t, err)
+	test.Equal(t, int64(2), ret.Depth)
+	test.Equal(t, int64(2), ret.CurrentDepth)
+	test.Equal(t, int64(0), ret.DepthChange)
+	test.Equal(t, true, len(ret.Samples) > 0)
+
+	// no history for the time before started
+	url = fmt.Sprintf("http://%s/channel/depth/history?topic=%s&channel=ch&ago=1h", httpAddr, topicName)
+	resp, err = http.Get(url)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
+
+	url = fmt.Sprintf("http://%s/channel/depth/history?topic=%s&channel=ch", httpAddr, topicName)
+	resp, err = http.Get(url)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestHTTPChannelInFlight(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.SyncEvery = 1
+	tcpAddr, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_inflight" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+	for i := 0; i < 2; i++ {
+		_, _, _, _, err := topic.PutMessage(nsqd.NewMessage(0, []byte("test message")))
+		test.Nil(t, err)
+	}
+	topic.ForceFlush()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(2).WriteTo(conn)
+	test.Equal(t, err, nil)
+	msg1 := recvNextMsgAndCheck(t, conn, len("test message"), 0, false)
+	test.NotNil(t, msg1)
+	msg2 := recvNextMsgAndCheck(t, conn, len("test message"), 0, false)
+	test.NotNil(t, msg2)
+
+	url := fmt.Sprintf("http://%s/channel/inflight?topic=%s&channel=ch&limit=1", httpAddr, topicName)
+	resp, err := http.Get(url)
+	test.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	var ret struct {
+		InFlightCount int                        `json:"in_flight_count"`
+		Messages      []nsqd.InFlightMessageInfo `json:"messages"`
+	}
+	err = json.Unmarshal(body, &ret)
+	test.Nil(t, err)
+	test.Equal(t, 2, ret.InFlightCount)
+	test.Equal(t, 1, len(ret.Messages))
+	test.Equal(t, uint64(nsq.GetNewMessageID(msg1.ID[:])), ret.Messages[0].ID)
+	test.Equal(t, uint16(1), ret.Messages[0].Attempts)
+	test.Equal(t, true, ret.Messages[0].ClientID > 0)
+	test.Equal(t, conn.LocalAddr().String(), ret.Messages[0].ClientAddr)
+	test.Equal(t, false, ret.Messages[0].Deferred)
+
+	url = fmt.Sprintf("http://%s/channel/inflight?topic=%s&channel=ch&limit=-1", httpAddr, topicName)
+	resp, err = http.Get(url)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestHTTPScalingSignals(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.SyncEvery = 1
+	opts.DepthHistoryInterval = time.Minute
+	_, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_scaling" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("ch")
+	topic.GetChannel("ch2")
+	channel.SampleDepthHistory(time.Now().Add(-time.Minute))
+	for i := 0; i < 3; i++ {
+		_, _, _, _, err := topic.PutMessage(nsqd.NewMessage(0, []byte("test message")))
+		test.Nil(t, err)
+	}
+	topic.ForceFlush()
+
+	url := fmt.Sprintf("http://%s/scaling/signals?topic=%s&channel=ch", httpAddr, topicName)
+	resp, err := http.Get(url)
+	test.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	var ret struct {
+		Signals []nsqd.ChannelScalingSignal `json:"signals"`
+	}
+	err = json.Unmarshal(body, &ret)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(ret.Signals))
+	test.Equal(t, topicName, ret.Signals[0].Topic)
+	test.Equal(t, "ch", ret.Signals[0].Channel)
+	test.Equal(t, int64(3), ret.Signals[0].Depth)
+	test.Equal(t, 0, ret.Signals[0].Consumers)
+	test.Equal(t, true, ret.Signals[0].DepthTrend > 0)
+	test.Equal(t, true, ret.Signals[0].OldestMsgAge >= 0)
+
+	url = fmt.Sprintf("http://%s/scaling/signals?topic=%s", httpAddr, topicName)
+	resp, err = http.Get(url)
+	test.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	err = json.Unmarshal(body, &ret)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(ret.Signals))
+	test.Equal(t, "ch2", ret.Signals[1].Channel)
+
+	url = fmt.Sprintf("http://%s/scaling/signals?window=invalid", httpAddr)
+	resp, err = http.Get(url)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestHTTPDrain(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_drain" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+	for i := 0; i < 2; i++ {
+		_, _, _, _, err := topic.PutMessage(nsqd.NewMessage(0, []byte("test message")))
+		test.Nil(t, err)
+	}
+	topic.ForceFlush()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Equal(t, err, nil)
+	msg := recvNextMsgAndCheckClientMsg(t, conn, 0, 0, false)
+
+	var status DrainStatus
+	resp, err := http.Post(fmt.Sprintf("http://%s/drain?timeout=10s", httpAddr), "application/json", nil)
+	test.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	err = json.Unmarshal(body, &status)
+	test.Nil(t, err)
+	// the leaders are transferred before draining
+	start := time.Now()
+	for status.State == drainStateTransferring && time.Since(start) < 5*time.Second {
+		time.Sleep(100 * time.Millisecond)
+		resp, err = http.Get(fmt.Sprintf("http://%s/drain/status", httpAddr))
+		test.Equal(t, err, nil)
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		err = json.Unmarshal(body, &status)
+		test.Nil(t, err)
+	}
+	test.Equal(t, drainStateDraining, status.State)
+	test.Equal(t, int64(1), status.InFlight)
+	test.Equal(t, int64(2), status.Depth)
+
+	// drain again is not allowed
+	resp, err = http.Post(fmt.Sprintf("http://%s/drain", httpAddr), "application/json", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	// the new connection should be rejected
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn2.Close()
+	readValidate(t, conn2, frameTypeError, "E_DRAINING")
+
+	// the publish on the existing connection and http should be rejected
+	_, err = nsq.Publish(topicName, []byte("test message")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_DRAINING the node is draining")
+	resp, err = http.Post(fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName), "application/octet-stream",
+		bytes.NewBufferString("test message"))
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 503, resp.StatusCode)
+
+	_, err = nsq.Finish(msg.ID).WriteTo(conn)
+	test.Nil(t, err)
+	start = time.Now()
+	for time.Since(start) < 5*time.Second {
+		resp, err = http.Get(fmt.Sprintf("http://%s/drain/status", httpAddr))
+		test.Equal(t, err, nil)
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		err = json.Unmarshal(body, &status)
+		test.Nil(t, err)
+		if status.State == drainStateDrained {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	test.Equal(t, drainStateDrained, status.State)
+	test.Equal(t, int64(0), status.InFlight)
+	// no more message should be delivered while draining
+	test.Equal(t, int64(1), status.Depth)
+	test.Equal(t, "", status.Error)
+	test.Equal(t, false, status.TimedOut)
+
+	// the node should serve again after canceled
+	resp, err = http.Post(fmt.Sprintf("http://%s/drain/cancel", httpAddr), "application/json", nil)
+	test.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	err = json.Unmarshal(body, &status)
+	test.Nil(t, err)
+	test.Equal(t, drainStateNone, status.State)
+	conn3, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn3.Close()
+	identify(t, conn3, nil, frameTypeResponse)
+	resp, err = http.Post(fmt.Sprintf("http://%s/drain/cancel", httpAddr), "application/json", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestHTTPTopicMirror(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	remoteOpts := nsqd.NewOptions()
+	remoteOpts.Logger = newTestLogger(t)
+	_, remoteHTTPAddr, remoteNsqd, remoteServer := mustStartNSQD(remoteOpts)
+	defer os.RemoveAll(remoteOpts.DataPath)
+	defer remoteServer.Exit()
+
+	topicName := "test_http_mirror" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopic(topicName, 0)
+	remoteTopic := remoteNsqd.GetTopic(topicName+"_dr", 0)
+	_, _, _, _, err := topic.PutMessage(nsqd.NewMessage(0, []byte("before mirror")))
+	test.Nil(t, err)
+	topic.ForceFlush()
+
+	// missing the remote addresses
+	resp, err := http.Post(fmt.Sprintf("http://%s/topic/mirror?topic=%s&partition=0", httpAddr, topicName), "application/json", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	resp, err = http.Post(fmt.Sprintf("http://%s/topic/mirror?topic=%s&partition=0&remote_topic=%s&nsqd_http_addrs=%s&from=oldest",
+		httpAddr, topicName, remoteTopic.GetTopicName(), remoteHTTPAddr), "application/json", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	for i := 0; i < 10; i++ {
+		_, _, _, _, err := topic.PutMessage(nsqd.NewMessage(0, []byte("test message")))
+		test.Nil(t, err)
+	}
+	topic.ForceFlush()
+
+	var stats *nsqd.TopicMirrorStats
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		stats = topic.GetMirrorStats()
+		if stats.ShippedMsgs == 11 {
+			break
+		}
+	}
+	test.Equal(t, int64(11), stats.ShippedMsgs)
+	test.Equal(t, int64(0), stats.LagMsgs)
+	test.Equal(t, int64(0), stats.LagBytes)
+	test.Equal(t, remoteHTTPAddr.String(), stats.Remote)
+	remoteTopic.ForceFlush()
+	test.Equal(t, uint64(11), remoteTopic.TotalMessageCnt())
+
+	// the mirror stats should be in the topic stats
+	topicStats := nsqdNs.GetTopicStats(true, topicName)
+	test.Equal(t, 1, len(topicStats))
+	test.NotNil(t, topicStats[0].Mirror)
+
+	resp, err = http.Post(fmt.Sprintf("http://%s/topic/mirror/remove?topic=%s&partition=0", httpAddr, topicName), "application/json", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Nil(t, topic.GetMirrorConf())
+}
+
+func TestHTTPTopicMirrorExt(t *testing.T) {
 	opts := nsqd.NewOptions()
 	opts.Logger = newTestLogger(t)
-	_, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	_, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
 	defer os.RemoveAll(opts.DataPath)
 	defer nsqdServer.Exit()
 
-	topicName := "test_http_mpub_bin" + strconv.Itoa(int(time.Now().Unix()))
-	nsqd.GetTopicIgnPart(topicName)
+	remoteOpts := nsqd.NewOptions()
+	remoteOpts.Logger = newTestLogger(t)
+	_, remoteHTTPAddr, remoteNsqd, remoteServer := mustStartNSQD(remoteOpts)
+	defer os.RemoveAll(remoteOpts.DataPath)
+	defer remoteServer.Exit()
 
-	mpub := make([][]byte, 5)
-	for i := range mpub {
-		mpub[i] = make([]byte, 100)
+	topicDynConf := nsqd.TopicDynamicConf{
+		AutoCommit: 1,
+		SyncEvery:  1,
+		Ext:        true,
 	}
-	cmd, _ := nsq.MultiPublish(topicName, mpub)
-	buf := bytes.NewBuffer(cmd.Body)
+	topicName := "test_http_mirror_ext" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopic(topicName, 0)
+	topic.SetDynamicInfo(topicDynConf, nil)
+	remoteTopic := remoteNsqd.GetTopic(topicName+"_dr", 0)
+	remoteTopic.SetDynamicInfo(topicDynConf, nil)
 
-	url := fmt.Sprintf("http://%s/mpub?topic=%s&binary=true", httpAddr, topicName)
-	resp, err := http.Post(url, "application/octet-stream", buf)
+	resp, err := http.Post(fmt.Sprintf("http://%s/topic/mirror?topic=%s&partition=0&remote_topic=%s&nsqd_http_addrs=%s",
+		httpAddr, topicName, remoteTopic.GetTopicName(), remoteHTTPAddr), "application/json", nil)
 	test.Equal(t, err, nil)
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	test.Equal(t, string(body), "OK")
-
-	time.Sleep(5 * time.Millisecond)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
 
+	// the header value with the special chars in the query should be kept
+	header := `{"key1":"50% off+more&a=b"}`
+	_, _, _, _, err = topic.PutMessage(nsqd.NewMessageWithExt(0, []byte("json ext"), ext.JSON_HEADER_EXT_VER, []byte(header)))
+	test.Nil(t, err)
+	_, _, _, _, err = topic.PutMessage(nsqd.NewMessageWithExt(0, []byte("tag ext"), ext.TAG_EXT_VER, []byte("tag1")))
+	test.Nil(t, err)
+	_, _, _, _, err = topic.PutMessage(nsqd.NewMessage(0, []byte("no ext")))
+	test.Nil(t, err)
+	topic.ForceFlush()
+
+	var stats *nsqd.TopicMirrorStats
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		stats = topic.GetMirrorStats()
+		if stats.ShippedMsgs == 3 {
+			break
+		}
+	}
+	test.Equal(t, int64(3), stats.ShippedMsgs)
+	test.Equal(t, int64(0), stats.Errors)
+	remoteTopic.ForceFlush()
+	test.Equal(t, uint64(3), remoteTopic.TotalMessageCnt())
+
+	snap := remoteTopic.GetDiskQueueSnapshot()
+	defer snap.Close()
+	test.Nil(t, snap.SeekTo(0))
+	var msgs []*nsqd.Message
+	for i := 0; i < 3; i++ {
+		data := snap.ReadOne()
+		test.Nil(t, data.Err)
+		msg, err := nsqd.DecodeMessage(data.Data, true)
+		test.Nil(t, err)
+		msgs = append(msgs, msg)
+	}
+	test.Equal(t, "json ext", string(msgs[0].Body))
+	test.Equal(t, ext.JSON_HEADER_EXT_VER, msgs[0].ExtVer)
+	var jsonHeader map[string]interface{}
+	test.Nil(t, json.Unmarshal(msgs[0].ExtBytes, &jsonHeader))
+	test.Equal(t, "50% off+more&a=b", jsonHeader["key1"])
+
+	test.Equal(t, "tag ext", string(msgs[1].Body))
+	jsonHeader = nil
+	test.Nil(t, json.Unmarshal(msgs[1].ExtBytes, &jsonHeader))
+	test.Equal(t, "tag1", jsonHeader[ext.CLIENT_DISPATCH_TAG_KEY])
+
+	test.Equal(t, "no ext", string(msgs[2].Body))
 }
 
-func TestHTTPFinish(t *testing.T) {
+func TestHTTPLogLevel(t *testing.T) {
 	opts := nsqd.NewOptions()
-	opts.LogLevel = 2
 	opts.Logger = newTestLogger(t)
-	if testing.Verbose() {
-		opts.LogLevel = 4
-		nsqd.SetLogger(opts.Logger)
-	}
-
-	//opts.Logger = &levellogger.SimpleLogger{}
-	tcpAddr, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	_, httpAddr, _, nsqdServer := mustStartNSQD(opts)
 	defer os.RemoveAll(opts.DataPath)
 	defer nsqdServer.Exit()
+	defer levellogger.SetSubsystemLevel("protocol", levellogger.LOG_INHERIT)
+	defer levellogger.SetLogFormat(levellogger.FormatText)
 
-	topicName := "test_http_finish" + strconv.Itoa(int(time.Now().Unix()))
-	_ = nsqd.GetTopicIgnPart(topicName)
-	conn, err := mustConnectNSQD(tcpAddr)
+	url := fmt.Sprintf("http://%s/loglevel/set?subsystem=protocol&loglevel=%v&format=json", httpAddr, levellogger.LOG_DEBUG)
+	resp, err := http.Post(url, "application/json", nil)
 	test.Equal(t, err, nil)
-	identify(t, conn, nil, frameTypeResponse)
-	sub(t, conn, topicName, "ch")
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
 
-	buf := bytes.NewBuffer([]byte("test message"))
-	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
-	resp, err := http.Post(url, "application/octet-stream", buf)
+	resp, err = http.Get(fmt.Sprintf("http://%s/loglevel", httpAddr))
 	test.Equal(t, err, nil)
-	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
-	test.Equal(t, string(body), "OK")
-
-	time.Sleep(5 * time.Millisecond)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	var ret struct {
+		Format     string           `json:"format"`
+		Level      int32            `json:"level"`
+		Subsystems map[string]int32 `json:"subsystems"`
+	}
+	err = json.Unmarshal(body, &ret)
+	test.Nil(t, err)
+	test.Equal(t, levellogger.FormatJSON, ret.Format)
+	test.Equal(t, levellogger.LOG_DEBUG, ret.Subsystems["protocol"])
+	test.Equal(t, ret.Level, ret.Subsystems["diskqueue"])
 
-	_, err = nsq.Ready(1).WriteTo(conn)
+	url = fmt.Sprintf("http://%s/loglevel/set?subsystem=not_exist&loglevel=1", httpAddr)
+	resp, err = http.Post(url, "application/json", nil)
 	test.Equal(t, err, nil)
-	// sleep to allow the RDY state to take effect
-	time.Sleep(50 * time.Millisecond)
-
-	for {
-		resp, _ := nsq.ReadResponse(conn)
-		frameType, data, err := nsq.UnpackResponse(resp)
-		test.Nil(t, err)
-		test.NotEqual(t, frameTypeError, frameType)
-		if frameType == frameTypeResponse {
-			t.Logf("got response data: %v", string(data))
-			continue
-		}
-		msgOut, err := nsq.DecodeMessage(data)
-		test.Equal(t, []byte("test message"), msgOut.Body)
-
-		url := fmt.Sprintf("http://%s/message/finish?topic=%s&partition=0&channel=%s&msgid=%d", httpAddr,
-			topicName, "ch", nsq.GetNewMessageID(msgOut.ID[:]))
-		ret, err := http.Post(url, "", nil)
-		test.Equal(t, err, nil)
-		test.Equal(t, 200, ret.StatusCode)
-		ioutil.ReadAll(ret.Body)
-		ret.Body.Close()
-		break
-	}
-	conn.Close()
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
 }
 
-func TestHTTPFinishMemDelayed(t *testing.T) {
+func TestHTTPTopicConfigCompressionWithoutArchive(t *testing.T) {
 	opts := nsqd.NewOptions()
-	opts.LogLevel = 2
 	opts.Logger = newTestLogger(t)
-	if testing.Verbose() {
-		opts.LogLevel = 4
-		nsqd.SetLogger(opts.Logger)
-	}
-
-	//opts.Logger = &levellogger.SimpleLogger{}
-	tcpAddr, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	_, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
 	defer os.RemoveAll(opts.DataPath)
 	defer nsqdServer.Exit()
 
-	topicName := "test_http_finish" + strconv.Itoa(int(time.Now().Unix()))
-	topic := nsqd.GetTopicIgnPart(topicName)
-	conn, err := mustConnectNSQD(tcpAddr)
+	topicName := "test_http_topic_config" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopic(topicName, 0)
+	// the compression has no effect without the archive
+	url := fmt.Sprintf("http://%s/topic/config?topic=%s&partition=0&compression=snappy", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
 	test.Equal(t, err, nil)
-	identify(t, conn, nil, frameTypeResponse)
-	sub(t, conn, topicName, "ch")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, true, strings.Contains(string(body), "ARCHIVE_NOT_ENABLED"))
+	test.Equal(t, (*nsqd.TopicRuntimeConf)(nil), topic.GetRuntimeConf())
 
-	buf := bytes.NewBuffer([]byte("test message"))
-	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
-	resp, err := http.Post(url, "application/octet-stream", buf)
+	url = fmt.Sprintf("http://%s/topic/config?topic=%s&partition=0&compression=", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
 	test.Equal(t, err, nil)
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	test.Equal(t, string(body), "OK")
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+}
 
-	time.Sleep(5 * time.Millisecond)
+func TestHTTPMessagePeek(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.SyncEvery = 1
+	_, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
 
-	_, err = nsq.Ready(1).WriteTo(conn)
+	topicName := "test_http_peek" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 3; i++ {
+		_, _, _, _, err := topic.PutMessage(nsqd.NewMessage(0, []byte("msg"+strconv.Itoa(i))))
+		test.Nil(t, err)
+	}
+	topic.ForceFlush()
+	depth := channel.Depth()
+
+	type peekResp struct {
+		Encoding string `json:"encoding"`
+		Messages []struct {
+			ID        uint64 `json:"id"`
+			Offset    int64  `json:"offset"`
+			Body      string `json:"body"`
+			Truncated bool   `json:"truncated"`
+		} `json:"messages"`
+	}
+	url := fmt.Sprintf("http://%s/message/peek?topic=%s&limit=2", httpAddr, topicName)
+	resp, err := http.Get(url)
 	test.Equal(t, err, nil)
-	// sleep to allow the RDY state to take effect
-	time.Sleep(50 * time.Millisecond)
-	ch, err := topic.GetExistingChannel("ch")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	var ret peekResp
+	err = json.Unmarshal(body, &ret)
 	test.Nil(t, err)
+	test.Equal(t, "text", ret.Encoding)
+	test.Equal(t, 2, len(ret.Messages))
+	test.Equal(t, "msg0", ret.Messages[0].Body)
+	test.Equal(t, "msg1", ret.Messages[1].Body)
 
-	for {
-		resp, _ := nsq.ReadResponse(conn)
-		frameType, data, err := nsq.UnpackResponse(resp)
-		test.Nil(t, err)
-		test.NotEqual(t, frameTypeError, frameType)
-		if frameType == frameTypeResponse {
-			t.Logf("got response data: %v", string(data))
-			continue
-		}
-		msgOut, err := nsq.DecodeMessage(data)
-		test.Equal(t, []byte("test message"), msgOut.Body)
-		nsq.Requeue(msgOut.ID, time.Second*10).WriteTo(conn)
-		time.Sleep(time.Second)
-		delayedMsgs := ch.GetMemDelayedMsgs()
-		test.Equal(t, 1, len(delayedMsgs))
+	// peek from the offset of the second message
+	url = fmt.Sprintf("http://%s/message/peek?topic=%s&offset=%d", httpAddr, topicName, ret.Messages[1].Offset)
+	resp, err = http.Get(url)
+	test.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	ret = peekResp{}
+	err = json.Unmarshal(body, &ret)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(ret.Messages))
+	test.Equal(t, "msg1", ret.Messages[0].Body)
+	test.Equal(t, "msg2", ret.Messages[1].Body)
 
-		url := fmt.Sprintf("http://%s/channel/finishmemdelayed?topic=%s&partition=0&channel=%s", httpAddr,
-			topicName, "ch")
-		ret, err := http.Post(url, "", nil)
-		test.Equal(t, err, nil)
-		test.Equal(t, 200, ret.StatusCode)
-		ioutil.ReadAll(ret.Body)
-		ret.Body.Close()
-		break
-	}
-	delayedMsgs := ch.GetMemDelayedMsgs()
-	test.Equal(t, 0, len(delayedMsgs))
-	conn.Close()
+	// peek the channel with the size limit
+	url = fmt.Sprintf("http://%s/message/peek?topic=%s&channel=ch&max_bytes=6&encoding=base64", httpAddr, topicName)
+	resp, err = http.Get(url)
+	test.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	ret = peekResp{}
+	err = json.Unmarshal(body, &ret)
+	test.Nil(t, err)
+	test.Equal(t, "base64", ret.Encoding)
+	test.Equal(t, 2, len(ret.Messages))
+	test.Equal(t, base64.StdEncoding.EncodeToString([]byte("msg0")), ret.Messages[0].Body)
+	test.Equal(t, false, ret.Messages[0].Truncated)
+	test.Equal(t, base64.StdEncoding.EncodeToString([]byte("ms")), ret.Messages[1].Body)
+	test.Equal(t, true, ret.Messages[1].Truncated)
+	// peek should not consume the channel
+	test.Equal(t, depth, channel.Depth())
+
+	url = fmt.Sprintf("http://%s/message/peek?topic=%s&channel=notexist", httpAddr, topicName)
+	resp, err = http.Get(url)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
 }
 
 func TestHTTPSRequire(t *testing.T) {
@@ -888,6 +2223,109 @@ func TestHTTPV1TopicChannel(t *testing.T) {
 	test.NotNil(t, err)
 }
 
+func TestHTTPChannelPauseWithDuration(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd1, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_channel_pause_duration" + strconv.Itoa(int(time.Now().Unix()))
+	channelName := "ch"
+	topic := nsqd1.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel(channelName)
+
+	url := fmt.Sprintf("http://%s/channel/pause?topic=%s&channel=%s&duration=invalid", httpAddr, topicName, channelName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, false, channel.IsPaused())
+
+	url = fmt.Sprintf("http://%s/channel/pause?topic=%s&channel=%s&duration=1h&reason=downstream_maintain", httpAddr, topicName, channelName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, true, channel.IsPaused())
+
+	stats := nsqd.NewChannelStats(channel, nil, 0)
+	test.Equal(t, "downstream_maintain", stats.PausedReason)
+	test.Equal(t, true, stats.PausedUntil >= time.Now().Add(time.Hour-time.Minute).Unix())
+	test.Equal(t, 0, nsqdServer.ctx.resumeExpiredChannels(time.Now()))
+	test.Equal(t, true, channel.IsPaused())
+
+	test.Equal(t, 1, nsqdServer.ctx.resumeExpiredChannels(time.Now().Add(2*time.Hour)))
+	test.Equal(t, false, channel.IsPaused())
+	until, reason := channel.GetPauseInfo()
+	test.Equal(t, true, until.IsZero())
+	test.Equal(t, "", reason)
+
+	// pause without the duration will not be resumed automatically
+	url = fmt.Sprintf("http://%s/channel/pause?topic=%s&channel=%s", httpAddr, topicName, channelName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, 0, nsqdServer.ctx.resumeExpiredChannels(time.Now().Add(2*time.Hour)))
+	test.Equal(t, true, channel.IsPaused())
+}
+
+func TestHTTPChannelRegisterWithAutoCreateDisabled(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_channel_register" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+
+	url := fmt.Sprintf("http://%s/topic/channel/autocreate/disable?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, resp.StatusCode, 200)
+	test.Equal(t, topic.IsChannelAutoCreateDisabled(), true)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	identify(t, conn, nil, frameTypeResponse)
+	subFail(t, conn, topicName, "ch_typo")
+	conn.Close()
+	_, err = topic.GetExistingChannel("ch_typo")
+	test.NotNil(t, err)
+
+	url = fmt.Sprintf("http://%s/channel/register?topic=%s&channel=%s", httpAddr, topicName, "ch")
+	resp, err = http.Post(url, "application/json", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, resp.StatusCode, 200)
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	stats := nsqdNs.GetTopicStatsWithFilter(false, topicName, true)
+	test.Equal(t, 1, len(stats))
+	test.Equal(t, 1, len(stats[0].Channels))
+	test.Equal(t, true, stats[0].Channels[0].Registered)
+	test.Equal(t, false, stats[0].Channels[0].Ephemeral)
+
+	ch, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, []nsqd.ChannelMetaInfo{{Name: "ch", Registered: true}}, topic.GetChannelMeta())
+
+	url = fmt.Sprintf("http://%s/channel/unregister?topic=%s&channel=%s", httpAddr, topicName, "ch")
+	resp, err = http.Post(url, "application/json", nil)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, resp.StatusCode, 200)
+	test.Equal(t, false, ch.IsRegistered())
+}
+
 func BenchmarkHTTPpub(b *testing.B) {
 	var wg sync.WaitGroup
 	b.StopTimer()
@@ -940,7 +2378,12 @@ func TestHTTPgetStatusJSON(t *testing.T) {
 	defer nsqdServer.Exit()
 
 	testTime = nsqd.GetStartTime()
-	expectedJSON := fmt.Sprintf(`{"status_code":200,"status_txt":"OK","data":{"version":"%v","health":"OK","start_time":%v,"topics":[]}}`, version.Binary, testTime.Unix())
+	// the stats request itself is counted in the http protocol stats
+	expectedJSON := fmt.Sprintf(`{"status_code":200,"status_txt":"OK","data":{"schema_version":1,"version":"%v","health":"OK","start_time":%v,"topics":[],`+
+		`"protocols":[{"protocol":"http","connections":1,"total_connections":1,"pub_count":0,"pub_bytes":0,"error_count":0,"idle_closed":0,"lifetime_closed":0},`+
+		`{"protocol":"tcp","connections":0,"total_connections":0,"pub_count":0,"pub_bytes":0,"error_count":0,"idle_closed":0,"lifetime_closed":0}],`+
+		`"conn_limits":{"remote_ips":0,"identities":0,"max_ip_conns":0,"max_identity_conns":0,"ip_rejected":0,"identity_rejected":0,"publisher_rejected":0}}}`,
+		version.Binary, testTime.Unix())
 
 	url := fmt.Sprintf("http://%s/stats?format=json", httpAddr)
 	resp, err := http.Get(url)
@@ -967,6 +2410,37 @@ func TestHTTPgetStatusText(t *testing.T) {
 	test.NotNil(t, body)
 }
 
+func TestHTTPgetStatusProtobuf(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqd1, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+	nsqd1.GetTopicIgnPart("test_stats_protobuf").GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/stats?format=protobuf", httpAddr)
+	resp, err := http.Get(url)
+	test.Equal(t, err, nil)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	test.Equal(t, resp.StatusCode, 200)
+	test.Equal(t, resp.Header.Get("Content-Type"), "application/x-protobuf")
+	test.Equal(t, resp.Header.Get("X-NSQ-Stats-Schema-Version"), strconv.Itoa(nsqd.StatsSchemaVersion))
+	// the schema version is the first field
+	test.Equal(t, body[:2], []byte{0x08, byte(nsqd.StatsSchemaVersion)})
+	test.Equal(t, bytes.Contains(body, []byte("test_stats_protobuf")), true)
+
+	url = fmt.Sprintf("http://%s/stats/schema", httpAddr)
+	resp, err = http.Get(url)
+	test.Equal(t, err, nil)
+	defer resp.Body.Close()
+	body, _ = ioutil.ReadAll(resp.Body)
+	test.Equal(t, resp.StatusCode, 200)
+	test.Equal(t, strings.Contains(string(body), "message StatsResponse {"), true)
+	test.Equal(t, strings.Contains(string(body), "repeated TopicStats topics = 5;"), true)
+	test.Equal(t, strings.Contains(string(body), "repeated ClientStats clients = "), true)
+}
+
 func TestHTTPconfig(t *testing.T) {
 	lopts := nsqlookupd.NewOptions()
 	lopts.Logger = newTestLogger(t)
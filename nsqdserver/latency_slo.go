@@ -0,0 +1,245 @@
+package nsqdserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	latencySLOCheckInterval = 10 * time.Second
+
+	AlertKindWriteLatencySLO = "write_latency_slo"
+	AlertKindChannelSLO      = "channel_slo"
+	LatencySLOEventFiring    = "firing"
+	LatencySLOEventResolved  = "resolved"
+)
+
+type LatencySLOEvent struct {
+	Time       int64   `json:"time"`
+	Kind       string  `json:"kind"`
+	Type       string  `json:"type"`
+	Node       string  `json:"node"`
+	Topic      string  `json:"topic"`
+	Partition  int     `json:"partition"`
+	Percentile float64 `json:"percentile"`
+	Latency    string  `json:"latency"`
+	Window     string  `json:"window"`
+	Current    string  `json:"current"`
+	CurrentUs  int64   `json:"current_us"`
+	Writes     int64   `json:"writes"`
+}
+
+type ChannelSLOEvent struct {
+	Time       int64   `json:"time"`
+	Kind       string  `json:"kind"`
+	Type       string  `json:"type"`
+	Node       string  `json:"node"`
+	Topic      string  `json:"topic"`
+	Partition  int     `json:"partition"`
+	Channel    string  `json:"channel"`
+	Target     float64 `json:"target"`
+	Latency    string  `json:"latency"`
+	Window     string  `json:"window"`
+	Compliance float64 `json:"compliance"`
+	BurnRate   float64 `json:"burn_rate"`
+	Total      int64   `json:"total"`
+	TimedOut   int64   `json:"timed_out"`
+	Stuck      int64   `json:"stuck"`
+}
+
+type LatencySLOPartition struct {
+	Topic     string                     `json:"topic"`
+	Partition int                        `json:"partition"`
+	SLO       *nsqd.TopicLatencySLOStats `json:"slo"`
+}
+
+type ChannelSLOChannel struct {
+	Topic     string                `json:"topic"`
+	Partition int                   `json:"partition"`
+	Channel   string                `json:"channel"`
+	SLO       *nsqd.ChannelSLOStats `json:"slo"`
+}
+
+type LatencySLOStatus struct {
+	Degraded         []LatencySLOPartition `json:"degraded"`
+	Events           []LatencySLOEvent     `json:"events"`
+	BreachedChannels []ChannelSLOChannel   `json:"breached_channels"`
+	ChannelEvents    []ChannelSLOEvent     `json:"channel_events"`
+	AlertWebhookStats
+}
+
+// latencySLOManager checks the write latency slo of each partition and the slo of
+// the channels on the leader periodically, the alert event is emitted to the
+// webhook while the slo breached or resolved.
+type latencySLOManager struct {
+	ctx      *context
+	notifier *alertNotifier
+	exitChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newLatencySLOManager(ctx *context) *latencySLOManager {
+	return &latencySLOManager{
+		ctx: ctx,
+		notifier: newAlertNotifier("slo", func(e interface{}) string {
+			return ctx.getOpts().AlertWebhook
+		}),
+		exitChan: make(chan struct{}),
+	}
+}
+
+func (m *latencySLOManager) start() {
+	m.notifier.start()
+	m.wg.Add(1)
+	go m.loop()
+}
+
+func (m *latencySLOManager) stop() {
+	close(m.exitChan)
+	m.wg.Wait()
+	m.notifier.stop()
+}
+
+func (m *latencySLOManager) loop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(latencySLOCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.check(time.Now())
+		case <-m.exitChan:
+			return
+		}
+	}
+}
+
+func (m *latencySLOManager) check(now time.Time) {
+	for _, topicParts := range m.ctx.nsqd.GetTopicMapCopy() {
+		for _, t := range topicParts {
+			r, ok := t.CheckWriteLatencySLO(now)
+			if !ok || !r.Changed {
+				continue
+			}
+			eventType := LatencySLOEventResolved
+			if r.Degraded {
+				eventType = LatencySLOEventFiring
+			}
+			m.addEvent(t, eventType, now, r)
+		}
+	}
+	m.checkChannels(now)
+}
+
+// checkChannels checks the channel slo on the leader only, since the messages
+// are consumed on the leader.
+func (m *latencySLOManager) checkChannels(now time.Time) {
+	for _, topicParts := range m.ctx.nsqd.GetTopicMapCopy() {
+		for _, t := range topicParts {
+			if !m.ctx.checkForMasterWrite(t.GetTopicName(), t.GetTopicPart()) {
+				continue
+			}
+			for _, ch := range t.GetChannelMapCopy() {
+				r, ok := ch.CheckSLO(now)
+				if !ok || !r.Changed {
+					continue
+				}
+				eventType := LatencySLOEventResolved
+				if r.Stats.Breached {
+					eventType = LatencySLOEventFiring
+				}
+				m.addChannelEvent(t, ch, eventType, now, r.Stats)
+			}
+		}
+	}
+}
+
+func (m *latencySLOManager) addChannelEvent(t *nsqd.Topic, ch *nsqd.Channel, eventType string, now time.Time, s *nsqd.ChannelSLOStats) {
+	e := ChannelSLOEvent{
+		Time:       now.Unix(),
+		Kind:       AlertKindChannelSLO,
+		Type:       eventType,
+		Node:       m.ctx.getAlertNode(),
+		Topic:      t.GetTopicName(),
+		Partition:  t.GetTopicPart(),
+		Channel:    ch.GetName(),
+		Target:     s.Target,
+		Latency:    s.Latency,
+		Window:     s.Window,
+		Compliance: s.Compliance,
+		BurnRate:   s.BurnRate,
+		Total:      s.Total,
+		TimedOut:   s.TimedOut,
+		Stuck:      s.Stuck,
+	}
+	nsqd.NsqLogger().LogWarningf("channel slo %v on topic %v channel %v: compliance %v, burn rate %v, timed out %v, stuck %v",
+		eventType, t.GetFullName(), ch.GetName(), s.Compliance, s.BurnRate, s.TimedOut, s.Stuck)
+	m.notifier.notify(e)
+}
+
+func (m *latencySLOManager) addEvent(t *nsqd.Topic, eventType string, now time.Time, r nsqd.TopicLatencySLOCheck) {
+	e := LatencySLOEvent{
+		Time:       now.Unix(),
+		Kind:       AlertKindWriteLatencySLO,
+		Type:       eventType,
+		Node:       m.ctx.getAlertNode(),
+		Topic:      t.GetTopicName(),
+		Partition:  t.GetTopicPart(),
+		Percentile: r.SLO.Percentile,
+		Latency:    r.SLO.Latency.String(),
+		Window:     r.SLO.Window.String(),
+		Current:    r.Current.String(),
+		CurrentUs:  int64(r.Current / time.Microsecond),
+		Writes:     r.Writes,
+	}
+	nsqd.NsqLogger().LogWarningf("write latency slo %v on topic %v: p%v %v over %v, threshold %v",
+		eventType, t.GetFullName(), r.SLO.Percentile*100, e.Current, e.Window, e.Latency)
+	m.notifier.notify(e)
+}
+
+func (m *latencySLOManager) getStatus() *LatencySLOStatus {
+	s := &LatencySLOStatus{
+		Degraded:          make([]LatencySLOPartition, 0),
+		Events:            make([]LatencySLOEvent, 0),
+		BreachedChannels:  make([]ChannelSLOChannel, 0),
+		ChannelEvents:     make([]ChannelSLOEvent, 0),
+		AlertWebhookStats: m.notifier.getWebhookStats(),
+	}
+	now := time.Now()
+	for _, topicParts := range m.ctx.nsqd.GetTopicMapCopy() {
+		for _, t := range topicParts {
+			for _, ch := range t.GetChannelMapCopy() {
+				chSLO := ch.GetSLOStats(now)
+				if chSLO == nil || !chSLO.Breached {
+					continue
+				}
+				s.BreachedChannels = append(s.BreachedChannels, ChannelSLOChannel{
+					Topic:     t.GetTopicName(),
+					Partition: t.GetTopicPart(),
+					Channel:   ch.GetName(),
+					SLO:       chSLO,
+				})
+			}
+			slo := t.GetWriteLatencySLOStats()
+			if slo == nil || !slo.Degraded {
+				continue
+			}
+			s.Degraded = append(s.Degraded, LatencySLOPartition{
+				Topic:     t.GetTopicName(),
+				Partition: t.GetTopicPart(),
+				SLO:       slo,
+			})
+		}
+	}
+	for _, e := range m.notifier.recentEvents() {
+		switch e := e.(type) {
+		case LatencySLOEvent:
+			s.Events = append(s.Events, e)
+		case ChannelSLOEvent:
+			s.ChannelEvents = append(s.ChannelEvents, e)
+		}
+	}
+	return s
+}
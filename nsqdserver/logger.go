@@ -0,0 +1,8 @@
+package nsqdserver
+
+import (
+	"github.com/youzan/nsq/nsqd"
+)
+
+// the logger for the client protocol which can be changed separately from the nsqd logger
+var protocolLog = nsqd.NsqLogger().Subsystem("protocol")
@@ -10,6 +10,7 @@ import (
 
 	"github.com/youzan/go-nsq"
 	"github.com/youzan/nsq/internal/clusterinfo"
+	"github.com/youzan/nsq/internal/protocol"
 	"github.com/youzan/nsq/internal/version"
 	"github.com/youzan/nsq/nsqd"
 )
@@ -109,8 +110,12 @@ func (n *NsqdServer) lookupLoop(pingInterval time.Duration, metaNotifyChan chan
 	for {
 		if changed {
 			allHosts = allHosts[:0]
-			allHosts = append(allHosts, n.ctx.getOpts().NSQLookupdTCPAddresses...)
-			allHosts = append(allHosts, discoveryAddrs...)
+			// no register to lookup in read only mode or after drained, so the clients
+			// will not be routed to this node unless connected directly
+			if !n.ctx.isReadOnly() && !n.ctx.isDrained() {
+				allHosts = append(allHosts, n.ctx.getOpts().NSQLookupdTCPAddresses...)
+				allHosts = append(allHosts, discoveryAddrs...)
+			}
 			nsqd.NsqLogger().Logf("all lookup hosts: %v", allHosts)
 
 			var tmpPeers []*clusterinfo.LookupPeer
@@ -170,6 +175,13 @@ func (n *NsqdServer) lookupLoop(pingInterval time.Duration, metaNotifyChan chan
 				// knowing the partition
 				branch = "channel"
 				channel := val.(*nsqd.Channel)
+				// the reply channel is only used by the connection created it
+				if protocol.IsReplyChannel(channel.GetName()) {
+					continue
+				}
+				if nsqd.IsHiddenTopic(channel.GetTopicName()) {
+					continue
+				}
 				if channel.Exiting() == true || channel.IsConsumeDisabled() {
 					cmd = nsq.UnRegister(channel.GetTopicName(),
 						strconv.Itoa(channel.GetTopicPart()), channel.GetName())
@@ -181,6 +193,9 @@ func (n *NsqdServer) lookupLoop(pingInterval time.Duration, metaNotifyChan chan
 				// notify all nsqlookupds that a new topic exists, or that it's removed
 				branch = "topic"
 				topic := val.(*nsqd.Topic)
+				if nsqd.IsHiddenTopic(topic.GetTopicName()) {
+					continue
+				}
 				if topic.Exiting() == true || topic.IsWriteDisabled() {
 					cmd = nsq.UnRegister(topic.GetTopicName(),
 						strconv.Itoa(topic.GetTopicPart()), "")
@@ -227,7 +242,7 @@ func (n *NsqdServer) lookupLoop(pingInterval time.Duration, metaNotifyChan chan
 			topicMap := n.ctx.nsqd.GetTopicMapCopy()
 			for _, topicParts := range topicMap {
 				for _, topic := range topicParts {
-					if topic.IsWriteDisabled() {
+					if topic.IsWriteDisabled() || nsqd.IsHiddenTopic(topic.GetTopicName()) {
 						continue
 					}
 					channelMap := topic.GetChannelMapCopy()
@@ -235,6 +250,9 @@ func (n *NsqdServer) lookupLoop(pingInterval time.Duration, metaNotifyChan chan
 						nsq.Register(topic.GetTopicName(),
 							strconv.Itoa(topic.GetTopicPart()), ""))
 					for _, channel := range channelMap {
+						if protocol.IsReplyChannel(channel.GetName()) {
+							continue
+						}
 						commands = append(commands,
 							nsq.Register(channel.GetTopicName(),
 								strconv.Itoa(channel.GetTopicPart()), channel.GetName()))
@@ -0,0 +1,367 @@
+package nsqdserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/http_api"
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	mirrorBatchSize      = 200
+	mirrorBatchBytes     = 1024 * 1024
+	mirrorCheckInterval  = time.Second
+	mirrorIdleInterval   = 200 * time.Millisecond
+	mirrorRetryInterval  = time.Second
+	mirrorSaveInterval   = time.Second
+	mirrorSyncInterval   = 10 * time.Second
+	mirrorLookupInterval = time.Minute
+)
+
+var errMirrorNoRemote = errors.New("no remote nsqd for the mirror topic")
+var errMirrorDataCleaned = errors.New("the data is cleaned before mirrored")
+var errMirrorExtNotSupported = errors.New("the message ext version can not be mirrored")
+
+type mirrorRemote struct {
+	conf      string
+	addr      string
+	partition int
+	updated   time.Time
+}
+
+type mirrorWorker struct {
+	topic    *nsqd.Topic
+	remote   mirrorRemote
+	stopChan chan struct{}
+}
+
+// mirrorManager ships the messages of the mirrored topic partitions to the remote
+// cluster, only the leader partition will be mirrored.
+type mirrorManager struct {
+	sync.Mutex
+	ctx      *context
+	client   *http_api.Client
+	workers  map[string]*mirrorWorker
+	exitChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newMirrorManager(ctx *context) *mirrorManager {
+	return &mirrorManager{
+		ctx:      ctx,
+		client:   http_api.NewClient(nil),
+		workers:  make(map[string]*mirrorWorker),
+		exitChan: make(chan struct{}),
+	}
+}
+
+func (m *mirrorManager) start() {
+	m.wg.Add(1)
+	go m.loop()
+}
+
+func (m *mirrorManager) stop() {
+	close(m.exitChan)
+	m.wg.Wait()
+}
+
+// loop starts the worker if the topic partition is mirrored and leader on this node,
+// and stops the worker if not.
+func (m *mirrorManager) loop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(mirrorCheckInterval)
+	defer ticker.Stop()
+	for {
+		m.checkWorkers()
+		select {
+		case <-ticker.C:
+		case <-m.exitChan:
+			m.Lock()
+			for name, w := range m.workers {
+				close(w.stopChan)
+				delete(m.workers, name)
+			}
+			m.Unlock()
+			return
+		}
+	}
+}
+
+func (m *mirrorManager) checkWorkers() {
+	needMirror := make(map[string]*nsqd.Topic)
+	if !m.ctx.isReadOnly() && !m.ctx.isDrained() {
+		for _, topicParts := range m.ctx.nsqd.GetTopicMapCopy() {
+			for _, t := range topicParts {
+				if t.GetMirrorConf() == nil || t.Exiting() {
+					continue
+				}
+				if !m.ctx.checkForMasterWrite(t.GetTopicName(), t.GetTopicPart()) {
+					continue
+				}
+				needMirror[t.GetFullName()] = t
+			}
+		}
+	}
+	m.Lock()
+	defer m.Unlock()
+	for name, w := range m.workers {
+		if t, ok := needMirror[name]; !ok || t != w.topic {
+			nsqd.NsqLogger().Logf("topic %v mirror stopped", name)
+			close(w.stopChan)
+			delete(m.workers, name)
+		}
+	}
+	for name, t := range needMirror {
+		if _, ok := m.workers[name]; ok {
+			continue
+		}
+		w := &mirrorWorker{
+			topic:    t,
+			stopChan: make(chan struct{}),
+		}
+		m.workers[name] = w
+		nsqd.NsqLogger().Logf("topic %v mirror started: %v", name, t.GetMirrorConf())
+		m.wg.Add(1)
+		go m.run(w)
+	}
+}
+
+func (m *mirrorManager) run(w *mirrorWorker) {
+	defer m.wg.Done()
+	defer m.ctx.syncTopicPolicy(w.topic)
+	defer w.topic.SaveMirrorPosition()
+	lastSaved := time.Now()
+	lastSynced := time.Now()
+	for {
+		wait := time.Duration(0)
+		shipped, err := m.shipOnce(w)
+		if err != nil {
+			nsqd.NsqLogger().LogWarningf("topic %v mirror to %v failed: %v",
+				w.topic.GetFullName(), w.remote.addr, err)
+			w.topic.IncrMirrorError(err)
+			// resolve the remote again since the leader may be changed
+			w.remote = mirrorRemote{}
+			wait = mirrorRetryInterval
+		} else if shipped == 0 {
+			wait = mirrorIdleInterval
+		}
+		if time.Since(lastSaved) >= mirrorSaveInterval {
+			if err := w.topic.SaveMirrorPosition(); err != nil {
+				nsqd.NsqLogger().LogWarningf("topic %v save mirror position failed: %v",
+					w.topic.GetFullName(), err)
+			}
+			lastSaved = time.Now()
+		}
+		// the position is synced to the replicas so the new leader can continue
+		// the mirror from it after failover
+		if time.Since(lastSynced) >= mirrorSyncInterval {
+			m.ctx.syncTopicPolicy(w.topic)
+			lastSynced = time.Now()
+		}
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-w.stopChan:
+				return
+			}
+		} else {
+			select {
+			case <-w.stopChan:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// shipOnce reads a batch of the committed messages from the mirrored position
+// and publishes them to the remote, the position will be updated if succeed.
+func (m *mirrorManager) shipOnce(w *mirrorWorker) (int, error) {
+	t := w.topic
+	conf := t.GetMirrorConf()
+	if conf == nil {
+		return 0, nil
+	}
+	offset, cnt := t.GetMirrorPosition()
+	snap := t.GetDiskQueueSnapshot()
+	defer snap.Close()
+	start := snap.GetQueueReadStart()
+	if offset < start.Offset() {
+		nsqd.NsqLogger().LogWarningf("topic %v mirror position %v is cleaned, skip to %v",
+			t.GetFullName(), offset, start.Offset())
+		t.IncrMirrorError(errMirrorDataCleaned)
+		offset = start.Offset()
+		cnt = start.TotalMsgCnt()
+		t.UpdateMirrorPosition(offset, cnt, 0, 0, w.remote.addr)
+	}
+	if err := snap.SeekTo(offset); err != nil {
+		return 0, err
+	}
+
+	var msgs []*nsqd.Message
+	var extMsg *nsqd.Message
+	var batchBytes int64
+	endOffset := offset
+	endCnt := cnt
+	for len(msgs) < mirrorBatchSize && batchBytes < mirrorBatchBytes {
+		data := snap.ReadOne()
+		if data.Err != nil {
+			if data.Err == io.EOF {
+				break
+			}
+			return 0, data.Err
+		}
+		msg, err := nsqd.DecodeMessage(data.Data, t.IsExt())
+		if err != nil {
+			return 0, err
+		}
+		if msg.ExtVer != ext.NO_EXT_VER {
+			// the message with ext is published alone to keep the ext
+			if len(msgs) == 0 {
+				extMsg = msg
+				endOffset = data.Offset + data.MovedSize
+				endCnt++
+			}
+			break
+		}
+		msgs = append(msgs, msg)
+		batchBytes += int64(len(msg.Body))
+		endOffset = data.Offset + data.MovedSize
+		endCnt++
+	}
+	if len(msgs) == 0 && extMsg == nil {
+		return 0, nil
+	}
+
+	if err := m.resolveRemote(w, conf); err != nil {
+		return 0, err
+	}
+	var err error
+	if extMsg != nil {
+		msgs = []*nsqd.Message{extMsg}
+		batchBytes = int64(len(extMsg.Body))
+		err = m.pubExt(w, conf, extMsg)
+	} else {
+		err = m.mpub(w, conf, msgs)
+	}
+	if err != nil {
+		return 0, err
+	}
+	t.UpdateMirrorPosition(endOffset, endCnt, int64(len(msgs)), batchBytes, w.remote.addr)
+	return len(msgs), nil
+}
+
+func (m *mirrorManager) remoteEndpoint(w *mirrorWorker, conf *nsqd.TopicMirrorConf, path string) string {
+	endpoint := fmt.Sprintf("http://%s%s?topic=%s", w.remote.addr, path, url.QueryEscape(conf.RemoteTopic))
+	if w.remote.partition >= 0 {
+		endpoint += "&partition=" + strconv.Itoa(w.remote.partition)
+	}
+	return endpoint
+}
+
+func (m *mirrorManager) mpub(w *mirrorWorker, conf *nsqd.TopicMirrorConf, msgs []*nsqd.Message) error {
+	var body bytes.Buffer
+	tmp := make([]byte, 4)
+	binary.BigEndian.PutUint32(tmp, uint32(len(msgs)))
+	body.Write(tmp)
+	for _, msg := range msgs {
+		binary.BigEndian.PutUint32(tmp, uint32(len(msg.Body)))
+		body.Write(tmp)
+		body.Write(msg.Body)
+	}
+	endpoint := m.remoteEndpoint(w, conf, "/mpub") + "&binary=true"
+	_, err := m.client.POSTV1WithContent(endpoint, body.String())
+	return err
+}
+
+// mirrorExtHeader returns the json header to publish the message with ext, the
+// tag ext is converted to the dispatch tag in the json header.
+func mirrorExtHeader(msg *nsqd.Message) ([]byte, error) {
+	switch msg.ExtVer {
+	case ext.JSON_HEADER_EXT_VER:
+		return msg.ExtBytes, nil
+	case ext.TAG_EXT_VER:
+		return json.Marshal(map[string]string{ext.CLIENT_DISPATCH_TAG_KEY: string(msg.ExtBytes)})
+	}
+	return nil, errMirrorExtNotSupported
+}
+
+func (m *mirrorManager) pubExt(w *mirrorWorker, conf *nsqd.TopicMirrorConf, msg *nsqd.Message) error {
+	header, err := mirrorExtHeader(msg)
+	if err != nil {
+		return err
+	}
+	// the ext param is unescaped again by /pub_ext after parsed from the query
+	endpoint := m.remoteEndpoint(w, conf, "/pub_ext") + "&ext=" + url.QueryEscape(url.QueryEscape(string(header)))
+	_, err = m.client.POSTV1WithContent(endpoint, string(msg.Body))
+	return err
+}
+
+// resolveRemote chooses the remote nsqd for the topic partition, the local partition
+// is mapped to the remote partition with the same id if the remote has less partitions.
+func (m *mirrorManager) resolveRemote(w *mirrorWorker, conf *nsqd.TopicMirrorConf) error {
+	confStr := fmt.Sprint(*conf)
+	if w.remote.addr != "" && w.remote.conf == confStr &&
+		time.Since(w.remote.updated) < mirrorLookupInterval {
+		return nil
+	}
+	part := w.topic.GetTopicPart()
+	if len(conf.LookupdAddrs) == 0 {
+		w.remote = mirrorRemote{
+			conf:      confStr,
+			addr:      conf.NSQDAddrs[part%len(conf.NSQDAddrs)],
+			partition: -1,
+			updated:   time.Now(),
+		}
+		return nil
+	}
+	var lastErr error
+	for _, lookupd := range conf.LookupdAddrs {
+		var resp struct {
+			Partitions map[string]struct {
+				BroadcastAddress string `json:"broadcast_address"`
+				HTTPPort         int    `json:"http_port"`
+			} `json:"partitions"`
+		}
+		endpoint := fmt.Sprintf("http://%s/lookup?topic=%s&access=w", lookupd, url.QueryEscape(conf.RemoteTopic))
+		_, err := m.client.GETV1(endpoint, &resp)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		pids := make([]int, 0, len(resp.Partitions))
+		for pidStr := range resp.Partitions {
+			pid, err := strconv.Atoi(pidStr)
+			if err == nil {
+				pids = append(pids, pid)
+			}
+		}
+		if len(pids) == 0 {
+			lastErr = errMirrorNoRemote
+			continue
+		}
+		sort.Ints(pids)
+		pid := pids[part%len(pids)]
+		p := resp.Partitions[strconv.Itoa(pid)]
+		w.remote = mirrorRemote{
+			conf:      confStr,
+			addr:      net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.HTTPPort)),
+			partition: pid,
+			updated:   time.Now(),
+		}
+		return nil
+	}
+	return lastErr
+}
@@ -24,6 +24,7 @@ type NsqdServer struct {
 	lookupPeers   atomic.Value
 	waitGroup     util.WaitGroupWrapper
 	tcpListener   net.Listener
+	extraTCPLns   []net.Listener
 	httpListener  net.Listener
 	httpsListener net.Listener
 	exitChan      chan int
@@ -54,7 +55,12 @@ func buildTLSConfig(opts *nsqd.Options) (*tls.Config, error) {
 	case "require-verify":
 		tlsClientAuthPolicy = tls.RequireAndVerifyClientCert
 	default:
-		tlsClientAuthPolicy = tls.NoClientCert
+		if opts.TLSIdentityMode != "" || opts.MTLSRequiredFor != "" {
+			// the client certificate is needed to get identity or check mutual tls
+			tlsClientAuthPolicy = tls.VerifyClientCertIfGiven
+		} else {
+			tlsClientAuthPolicy = tls.NoClientCert
+		}
 	}
 
 	tlsConfig = &tls.Config{
@@ -96,6 +102,12 @@ func NewNsqdServer(opts *nsqd.Options) (*nsqd.NSQD, *NsqdServer) {
 	_, tcpPort, _ := net.SplitHostPort(opts.TCPAddress)
 	_, httpPort, _ := net.SplitHostPort(opts.HTTPAddress)
 	rpcport := opts.RPCPort
+	if opts.ReadOnlyRecovery {
+		// the data on this node may be broken, so we should not join the cluster
+		// to avoid becoming leader or syncing the suspect data to other replicas.
+		nsqd.NsqLogger().LogWarningf("starting in read only recovery mode, publish and leadership will be disabled")
+		rpcport = ""
+	}
 	if rpcport != "" {
 		ip = opts.BroadcastAddress
 		consistence.SetCoordLogger(opts.Logger, opts.LogLevel)
@@ -112,6 +124,14 @@ func NewNsqdServer(opts *nsqd.Options) (*nsqd.NSQD, *NsqdServer) {
 		ctx.nsqdCoord = nil
 	}
 
+	ctx.redriveMgr = newRedriveManager(ctx)
+	ctx.restoreMgr = newArchiveRestoreManager(ctx)
+	ctx.drainMgr = newDrainManager(ctx)
+	ctx.mirrorMgr = newMirrorManager(ctx)
+	ctx.slowDiskMgr = newSlowDiskManager(ctx)
+	ctx.latencySLOMgr = newLatencySLOManager(ctx)
+	ctx.connEventMgr = newConnEventManager(ctx)
+	ctx.selfTester = newSelfTester(ctx)
 	s.ctx = ctx
 
 	s.exitChan = make(chan int)
@@ -125,6 +145,10 @@ func NewNsqdServer(opts *nsqd.Options) (*nsqd.NSQD, *NsqdServer) {
 		nsqd.NsqLogger().LogErrorf("FATAL: cannot require TLS client connections without TLS key and cert")
 		os.Exit(1)
 	}
+	if tlsConfig == nil && opts.MTLSRequiredFor != "" {
+		nsqd.NsqLogger().LogErrorf("FATAL: cannot require mutual TLS client connections without TLS key and cert")
+		os.Exit(1)
+	}
 	s.ctx.tlsConfig = tlsConfig
 	s.ctx.nsqd.SetPubLoop(s.ctx.internalPubLoop)
 	s.ctx.nsqd.SetReqToEndCB(s.ctx.internalRequeueToEnd)
@@ -144,6 +168,16 @@ func (s *NsqdServer) Exit() {
 	if s.tcpListener != nil {
 		s.tcpListener.Close()
 	}
+	for _, l := range s.extraTCPLns {
+		l.Close()
+	}
+	s.ctx.redriveMgr.stopAll()
+	s.ctx.restoreMgr.stopAll()
+	s.ctx.drainMgr.stop()
+	s.ctx.mirrorMgr.stop()
+	s.ctx.slowDiskMgr.stop()
+	s.ctx.latencySLOMgr.stop()
+	s.ctx.connEventMgr.stop()
 	if s.ctx.nsqdCoord != nil {
 		s.ctx.nsqdCoord.Stop()
 	}
@@ -191,6 +225,28 @@ func (s *NsqdServer) Main() {
 		protocol.TCPServer(s.tcpListener, tcpServer)
 		nsqd.NsqLogger().Logf("TCP: closing %s", s.tcpListener.Addr())
 	})
+	// the extra listeners only accept the clients with the own tcp options,
+	// they are not registered to the lookup.
+	for _, l := range opts.TCPListeners {
+		conf, err := nsqd.ParseTCPListener(l, opts)
+		if err != nil {
+			nsqd.NsqLogger().LogErrorf("FATAL: tcp listener (%s) invalid - %s", l, err)
+			os.Exit(1)
+		}
+		ln, err := net.Listen("tcp", conf.Address)
+		if err != nil {
+			nsqd.NsqLogger().LogErrorf("FATAL: listen (%s) failed - %s", conf.Address, err)
+			os.Exit(1)
+		}
+		s.extraTCPLns = append(s.extraTCPLns, ln)
+		nsqd.NsqLogger().Logf("TCP: listening on %s with options %+v", ln.Addr(), conf.TCPOptions)
+		extraServer := *tcpServer
+		extraServer.tcpOpts = &conf.TCPOptions
+		s.waitGroup.Wrap(func() {
+			protocol.TCPServer(ln, &extraServer)
+			nsqd.NsqLogger().Logf("TCP: closing %s", ln.Addr())
+		})
+	}
 
 	if s.ctx.GetTlsConfig() != nil && opts.HTTPSAddress != "" {
 		httpsListener, err = tls.Listen("tcp", opts.HTTPSAddress, s.ctx.GetTlsConfig())
@@ -219,11 +275,19 @@ func (s *NsqdServer) Main() {
 	})
 
 	s.ctx.nsqd.Start()
+	s.ctx.mirrorMgr.start()
+	s.ctx.slowDiskMgr.start()
+	s.ctx.latencySLOMgr.start()
+	s.ctx.connEventMgr.start()
 
 	s.waitGroup.Wrap(func() {
 		s.lookupLoop(opts.LookupPingInterval, s.ctx.nsqd.MetaNotifyChan, s.ctx.nsqd.OptsNotificationChan, s.exitChan)
 	})
 
+	s.waitGroup.Wrap(s.channelPauseLoop)
+	s.waitGroup.Wrap(s.orderedStuckLoop)
+	s.waitGroup.Wrap(s.topicPolicySyncLoop)
+
 	if opts.StatsdAddress != "" {
 		s.waitGroup.Wrap(s.statsdLoop)
 	}
@@ -0,0 +1,52 @@
+package nsqdserver
+
+import (
+	"time"
+
+	"github.com/youzan/nsq/nsqd"
+)
+
+const orderedStuckCheckInterval = 10 * time.Second
+
+func (n *NsqdServer) orderedStuckLoop() {
+	ticker := time.NewTicker(orderedStuckCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			n.ctx.checkOrderedStuck(now)
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
+// checkOrderedStuck checks the ordered delivery of all the channels and returns
+// the number of the stuck channels, a single poison message may block the ordered
+// channel forever so we log the blocking message while the channel is stuck.
+func (c *context) checkOrderedStuck(now time.Time) int {
+	timeout := c.getOpts().OrderedStuckTimeout
+	stuck := 0
+	for _, topicParts := range c.nsqd.GetTopicMapCopy() {
+		for _, t := range topicParts {
+			for _, ch := range t.GetChannelMapCopy() {
+				r := ch.CheckOrderedStuck(timeout, now)
+				if r.Stuck {
+					stuck++
+				}
+				if !r.Changed {
+					continue
+				}
+				if r.Stuck {
+					nsqd.NsqLogger().LogWarningf("topic %v ordered channel %v stuck, not advanced for %vms from offset %v, blocking message %v at %v, attempts %v",
+						t.GetFullName(), ch.GetName(), r.Stats.BlockedMs, r.Stats.ConfirmedOffset,
+						r.Stats.BlockingMsgID, r.Stats.BlockingOffset, r.Stats.BlockingAttempt)
+				} else {
+					nsqd.NsqLogger().Logf("topic %v ordered channel %v recovered from stuck",
+						t.GetFullName(), ch.GetName())
+				}
+			}
+		}
+	}
+	return stuck
+}
@@ -0,0 +1,39 @@
+package nsqdserver
+
+import (
+	"github.com/spaolacci/murmur3"
+)
+
+// PubResponse is returned for the http pub with routing key, the id is the
+// first message id in the batch for mpub.
+type PubResponse struct {
+	Status      string `json:"status"`
+	Topic       string `json:"topic"`
+	Partition   int    `json:"partition"`
+	ID          uint64 `json:"id"`
+	QueueOffset uint64 `json:"queue_offset"`
+	DataRawSize uint32 `json:"rawsize"`
+	Count       int    `json:"count"`
+}
+
+// getRoutingPartition returns the partition for the routing key, the
+// partition number is from the topic meta in cluster, or the max local
+// partition if not in cluster. The key is hashed by murmur3 (seed 0) the same
+// as the go-nsq producer for the ordered publish, so the http and tcp producers
+// will route the same key to the same partition.
+func (c *context) getRoutingPartition(topicName string, routingKey string) (int, int) {
+	partNum := 0
+	for pid, t := range c.getPartitions(topicName) {
+		num := t.GetDynamicInfo().PartitionNum
+		if num > partNum {
+			partNum = num
+		}
+		if c.nsqdCoord == nil && pid+1 > partNum {
+			partNum = pid + 1
+		}
+	}
+	if partNum <= 0 {
+		return -1, 0
+	}
+	return int(murmur3.Sum32([]byte(routingKey)) % uint32(partNum)), partNum
+}
@@ -18,6 +18,7 @@ import (
 
 	simpleJson "github.com/bitly/go-simplejson"
 	"github.com/youzan/nsq/consistence"
+	"github.com/youzan/nsq/internal/auth"
 	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/internal/levellogger"
 	"github.com/youzan/nsq/internal/protocol"
@@ -26,12 +27,21 @@ import (
 )
 
 const (
-	E_INVALID         = "E_INVALID"
-	E_TOPIC_NOT_EXIST = "E_TOPIC_NOT_EXIST"
+	E_INVALID             = "E_INVALID"
+	E_TOPIC_NOT_EXIST     = "E_TOPIC_NOT_EXIST"
+	E_CHANNEL_NOT_EXIST   = "E_CHANNEL_NOT_EXIST"
+	E_READ_ONLY           = "E_READ_ONLY"
+	E_NAMESPACE_QUOTA     = "E_NAMESPACE_QUOTA"
+	E_PUB_BACKPRESSURE    = "E_PUB_BACKPRESSURE"
+	E_TOO_MANY_CONNS      = "E_TOO_MANY_CONNS"
+	E_TOO_MANY_PUBLISHERS = "E_TOO_MANY_PUBLISHERS"
 )
 
 const maxTimeout = time.Hour
 
+// the max reply channels can be created by one connection
+const maxReplyChannelsPerClient = 64
+
 const (
 	frameTypeResponse int32 = 0
 	frameTypeError    int32 = 1
@@ -67,6 +77,8 @@ var (
 
 type protocolV2 struct {
 	ctx *context
+	// the tcp options of the extra listener, nil for the default listener
+	tcpOpts *nsqd.TCPOptions
 }
 
 type ConsumeOffset struct {
@@ -128,6 +140,11 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 	clientID := p.ctx.nextClientID()
 	client := nsqd.NewClientV2(clientID, conn, p.ctx.getOpts(), p.ctx.GetTlsConfig())
 	client.SetWriteDeadline(zeroTime)
+	if p.tcpOpts != nil {
+		if err := client.ApplyListenerTCPOptions(*p.tcpOpts); err != nil {
+			nsqd.NsqLogger().Logf("client %v failed to apply the listener tcp options: %v", client, err)
+		}
+	}
 
 	// synchronize the startup of messagePump in order
 	// to guarantee that it gets a chance to initialize
@@ -138,6 +155,7 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 	msgPumpStoppedChan := make(chan bool)
 	go p.messagePump(client, messagePumpStartedChan, msgPumpStoppedChan)
 	<-messagePumpStartedChan
+	p.ctx.connEventMgr.connected(client)
 
 	for {
 		if client.GetHeartbeatInterval() > 0 {
@@ -152,19 +170,23 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 		if err != nil {
 			if err == io.EOF {
 				err = nil
+				client.SetDisconnectReason(nsqd.DisconnectClientClose)
 			} else {
 				err = fmt.Errorf("failed to read command - %s", err)
 				if strings.Contains(err.Error(), "timeout") {
+					// no heartbeat response from client in time,
 					// force close conn to wake up conn.write if timeout since
 					// the connection may be dead.
-					client.Exit()
+					client.ExitWithReason(nsqd.DisconnectHeartbeatFail)
+				} else {
+					client.SetDisconnectReason(nsqd.DisconnectNetworkError)
 				}
 			}
 			break
 		}
 
-		if nsqd.NsqLogger().Level() > levellogger.LOG_DETAIL {
-			nsqd.NsqLogger().Logf("PROTOCOL(V2) got client command: %v ", line)
+		if protocolLog.Level() > levellogger.LOG_DETAIL {
+			protocolLog.Logf("PROTOCOL(V2) got client command: %v ", line)
 		}
 		// handle the compatible for message id.
 		// Since the new message id is id+traceid. we can not
@@ -184,7 +206,7 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 					nr := 0
 					nr, err = io.ReadFull(client.Reader, left)
 					if err != nil {
-						nsqd.NsqLogger().LogErrorf("read param err:%v", err)
+						protocolLog.LogErrorf("read param err:%v", err)
 					}
 					line = append(line, left[:nr]...)
 					tmpLine = tmpLine[:len(line)]
@@ -195,7 +217,7 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 					tmpLine = append(tmpLine, extra...)
 					line = append(line[:0], tmpLine...)
 					if extraErr != nil {
-						nsqd.NsqLogger().LogErrorf("read param err:%v", extraErr)
+						protocolLog.LogErrorf("read param err:%v", extraErr)
 					}
 				}
 				params = append(params, line[:3])
@@ -221,7 +243,7 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 						nr := 0
 						nr, err = io.ReadFull(client.Reader, left)
 						if err != nil {
-							nsqd.NsqLogger().Logf("TOUCH param err:%v", err)
+							protocolLog.Logf("TOUCH param err:%v", err)
 						}
 						line = append(line, left[:nr]...)
 					}
@@ -234,8 +256,8 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 				}
 			}
 		}
-		if p.ctx.getOpts().Verbose || nsqd.NsqLogger().Level() > levellogger.LOG_DETAIL {
-			nsqd.NsqLogger().Logf("PROTOCOL(V2) got client command: %v ", line)
+		if p.ctx.getOpts().Verbose || protocolLog.Level() > levellogger.LOG_DETAIL {
+			protocolLog.Logf("PROTOCOL(V2) got client command: %v ", line)
 		}
 		if !isSpecial {
 			// trim the '\n'
@@ -247,37 +269,46 @@ func (p *protocolV2) IOLoop(conn net.Conn) error {
 			params = bytes.Split(line, separatorBytes)
 		}
 
-		if p.ctx.getOpts().Verbose || nsqd.NsqLogger().Level() > levellogger.LOG_DETAIL {
-			nsqd.NsqLogger().Logf("PROTOCOL(V2): [%s] %v, %v", client, string(params[0]), params)
+		if p.ctx.getOpts().Verbose || protocolLog.Level() > levellogger.LOG_DETAIL {
+			protocolLog.Logf("PROTOCOL(V2): [%s] %v, %v", client, string(params[0]), params)
 		}
 
 		var response []byte
 		response, err = p.Exec(client, params)
+		if err != nil {
+			p.ctx.nsqd.IncrProtocolErrorStats(nsqd.ProtocolTCP)
+		}
 		err = handleRequestReponseForClient(client, response, err)
 		if err != nil {
-			nsqd.NsqLogger().Logf("PROTOCOL(V2) handle client command: %v failed", line)
+			protocolLog.Logf("PROTOCOL(V2) handle client command: %v failed", line)
 			break
 		}
 	}
 
-	if err != nil {
-		nsqd.NsqLogger().Logf("PROTOCOL(V2): client [%s] exiting ioloop with error: %v", client, err)
-	}
-	if nsqd.NsqLogger().Level() >= levellogger.LOG_DEBUG {
-		nsqd.NsqLogger().LogDebugf("PROTOCOL(V2): client [%s] exiting ioloop", client)
+	reason := client.GetDisconnectReason()
+	protocolLog.InfoKV("client connection closed", "client", client.String(), "client_id", client.ClientID,
+		"reason", reason, "error", err, "duration", time.Since(client.ConnectTime).String())
+	if protocolLog.Level() >= levellogger.LOG_DEBUG {
+		protocolLog.LogDebugf("PROTOCOL(V2): client [%s] exiting ioloop", client)
 	}
 	close(client.ExitChan)
 	p.ctx.nsqd.CleanClientPubStats(client.String(), "tcp")
+	p.ctx.nsqd.ReleaseClientLimits(client)
 	<-msgPumpStoppedChan
 
-	if nsqd.NsqLogger().Level() >= levellogger.LOG_DEBUG {
-		nsqd.NsqLogger().Logf("msg pump stopped client %v", client)
+	if protocolLog.Level() >= levellogger.LOG_DEBUG {
+		protocolLog.Logf("msg pump stopped client %v", client)
 	}
 
+	p.ctx.connEventMgr.disconnected(client, reason)
 	if client.Channel != nil {
+		client.Channel.IncrDisconnectReason(reason)
 		client.Channel.RequeueClientMessages(client.ID, client.String())
 		client.Channel.RemoveClient(client.ID, client.GetDesiredTag())
 	}
+	for _, ch := range client.RemoveReplyChannels() {
+		ch.DeleteAsync()
+	}
 	client.FinalClose()
 
 	return err
@@ -287,6 +318,20 @@ func shouldHandleAsync(client *nsqd.ClientV2, params [][]byte) bool {
 	return bytes.Equal(params[0], []byte("PUB"))
 }
 
+// pubBackpressureErr is the soft error for the producer to retry after the duration,
+// the connection is not closed.
+func pubBackpressureErr(topic *nsqd.Topic, retryAfter time.Duration) error {
+	details := topicErrDetails(topic.GetTopicName(), topic.GetTopicPart())
+	details["retry_after_ms"] = strconv.FormatInt(int64(retryAfter/time.Millisecond), 10)
+	return protocol.NewClientErr(nsqd.ErrPubBackpressure, E_PUB_BACKPRESSURE,
+		fmt.Sprintf("%v, retry after %v", nsqd.ErrPubBackpressure, retryAfter)).WithDetails(details)
+}
+
+// topicErrDetails is the details of the structured error about the topic partition
+func topicErrDetails(topic string, partition int) map[string]string {
+	return map[string]string{"topic": topic, "partition": strconv.Itoa(partition)}
+}
+
 func handleRequestReponseForClient(client *nsqd.ClientV2, response []byte, err error) error {
 	if err != nil {
 		ctx := ""
@@ -297,17 +342,23 @@ func handleRequestReponseForClient(client *nsqd.ClientV2, response []byte, err e
 			}
 		}
 
-		nsqd.NsqLogger().LogDebugf("Error response for [%s] - %s - %s",
+		protocolLog.LogDebugf("Error response for [%s] - %s - %s",
 			client, err, ctx)
 
-		sendErr := Send(client, frameTypeError, []byte(err.Error()))
+		errBody := []byte(err.Error())
+		if client.IsStructuredError() {
+			errBody = protocol.ToStructuredErr(err).JSON()
+		}
+		sendErr := Send(client, frameTypeError, errBody)
 		if sendErr != nil {
-			nsqd.NsqLogger().LogErrorf("Send response error: [%s] - %s%s", client, sendErr, ctx)
+			protocolLog.LogErrorf("Send response error: [%s] - %s%s", client, sendErr, ctx)
+			client.SetDisconnectReason(writeErrDisconnectReason(sendErr))
 			return err
 		}
 
 		// errors of type FatalClientErr should forceably close the connection
 		if _, ok := err.(*protocol.FatalClientErr); ok {
+			client.SetDisconnectReason(nsqd.DisconnectProtocolError)
 			return err
 		}
 		return nil
@@ -316,6 +367,7 @@ func handleRequestReponseForClient(client *nsqd.ClientV2, response []byte, err e
 	if response != nil {
 		sendErr := Send(client, frameTypeResponse, response)
 		if sendErr != nil {
+			client.SetDisconnectReason(writeErrDisconnectReason(sendErr))
 			err = fmt.Errorf("failed to send response - %s", sendErr)
 		}
 	}
@@ -323,6 +375,14 @@ func handleRequestReponseForClient(client *nsqd.ClientV2, response []byte, err e
 	return err
 }
 
+// writeErrDisconnectReason returns the disconnect reason for the failed write to client
+func writeErrDisconnectReason(err error) string {
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return nsqd.DisconnectWriteTimeout
+	}
+	return nsqd.DisconnectNetworkError
+}
+
 func SendMessage(client *nsqd.ClientV2, msg *nsqd.Message, writeExt bool, buf *bytes.Buffer, needFlush bool) error {
 	buf.Reset()
 	_, err := msg.WriteToClient(buf, writeExt, client.EnableTrace)
@@ -403,6 +463,8 @@ func (p *protocolV2) Exec(client *nsqd.ClientV2, params [][]byte) ([]byte, error
 		return p.CLS(client, params)
 	case bytes.Equal(params[0], []byte("AUTH")):
 		return p.AUTH(client, params)
+	case bytes.Equal(params[0], []byte("REPLY_CHANNEL")):
+		return p.REPLYCHANNEL(client, params)
 	case bytes.Equal(params[0], []byte("INTERNAL_CREATE_TOPIC")):
 		return p.internalCreateTopic(client, params)
 	}
@@ -429,6 +491,14 @@ func (p *protocolV2) messagePump(client *nsqd.ClientV2, startedChan chan bool,
 	heartbeatFailedCnt := 0
 	msgTimeout := client.GetMsgTimeout()
 	lastActiveTime := time.Now()
+	// the ticker is only for the connection with the idle timeout or the max lifetime
+	var connCheckTicker *time.Ticker
+	var connCheckChan <-chan time.Time
+	if opts := p.ctx.getOpts(); opts.ProducerIdleTimeout > 0 || opts.MaxConnLifetime > 0 {
+		connCheckTicker = time.NewTicker(connDeadlineCheckInterval)
+		connCheckChan = connCheckTicker.C
+	}
+	lifetimeJitter := rand.Float64() * maxConnLifetimeJitter
 	var extFilter nsqd.IExtFilter
 	inverseFilter := false
 	// v2 opportunistically buffers data to clients to reduce write system calls
@@ -446,7 +516,8 @@ func (p *protocolV2) messagePump(client *nsqd.ClientV2, startedChan chan bool,
 	close(startedChan)
 
 	for {
-		if subChannel == nil || !client.IsReadyForMessages() {
+		// no new message delivered while draining the node
+		if subChannel == nil || !client.IsReadyForMessages() || p.ctx.isDraining() {
 			// the client is not ready to receive messages...
 			clientMsgChan = nil
 			flusherChan = nil
@@ -455,6 +526,7 @@ func (p *protocolV2) messagePump(client *nsqd.ClientV2, startedChan chan bool,
 			err = client.Flush()
 			client.UnlockWrite()
 			if err != nil {
+				client.SetDisconnectReason(writeErrDisconnectReason(err))
 				goto exit
 			}
 			flushed = true
@@ -487,13 +559,14 @@ func (p *protocolV2) messagePump(client *nsqd.ClientV2, startedChan chan bool,
 			err = client.Flush()
 			client.UnlockWrite()
 			if err != nil {
+				client.SetDisconnectReason(writeErrDisconnectReason(err))
 				goto exit
 			}
 			flushed = true
 		case <-client.ReadyStateChan:
 		case subChannel = <-subEventChan:
 			// you can't SUB anymore
-			nsqd.NsqLogger().Logf("client %v sub to topic %v channel: %v", client,
+			protocolLog.Logf("client %v sub to topic %v channel: %v", client,
 				subChannel.GetTopicName(),
 				subChannel.GetName())
 			subEventChan = nil
@@ -523,9 +596,9 @@ func (p *protocolV2) messagePump(client *nsqd.ClientV2, startedChan chan bool,
 			if identifyData.ExtFilter.Type != 0 {
 				extFilter, err = nsqd.NewExtFilter(identifyData.ExtFilter)
 				if err != nil {
-					nsqd.NsqLogger().Infof("channel filter %v init failed: %v", identifyData.ExtFilter, err)
+					protocolLog.Infof("channel filter %v init failed: %v", identifyData.ExtFilter, err)
 				} else {
-					nsqd.NsqLogger().Infof("channel filter %v init for client: %v ", identifyData.ExtFilter, client.String())
+					protocolLog.Infof("channel filter %v init for client: %v ", identifyData.ExtFilter, client.String())
 					inverseFilter = identifyData.ExtFilter.Inverse
 				}
 			}
@@ -548,20 +621,41 @@ func (p *protocolV2) messagePump(client *nsqd.ClientV2, startedChan chan bool,
 				time.Since(lastActiveTime) > (msgTimeout*10+client.GetHeartbeatInterval()) &&
 				!subChannel.IsOrdered() && subChannel.Depth() > 10 &&
 				subChannel.GetInflightNum() <= 0 && !subChannel.IsPaused() {
-				nsqd.NsqLogger().Warningf("client %s not active since %v, current : %v, %v, %v", client, lastActiveTime,
+				protocolLog.Warningf("client %s not active since %v, current : %v, %v, %v", client, lastActiveTime,
 					subChannel.Depth(), subChannel.DepthTimestamp(), subChannel.GetChannelDebugStats())
+				client.SetDisconnectReason(nsqd.DisconnectServerEvicted)
+				goto exit
+			}
+			now := time.Now()
+			if maxRTT := p.ctx.getOpts().MaxHeartbeatRTT; maxRTT > 0 && client.IsHeartbeatStalled(maxRTT, now) {
+				protocolLog.Warningf("PROTOCOL(V2): [%s] heartbeat stalled, rtt: %v, missed: %v",
+					client, client.GetHeartbeatRTT(), client.GetMissedHeartbeats())
+				client.SetDisconnectReason(nsqd.DisconnectHeartbeatFail)
 				goto exit
 			}
+			if client.HeartbeatSent(now) {
+				protocolLog.LogDebugf("PROTOCOL(V2): [%s] missed heartbeat response, total missed: %v",
+					client, client.GetMissedHeartbeats())
+			}
 			err = Send(client, frameTypeResponse, heartbeatBytes)
-			nsqd.NsqLogger().LogDebugf("PROTOCOL(V2): [%s] send heartbeat", client)
+			protocolLog.LogDebugf("PROTOCOL(V2): [%s] send heartbeat", client)
 			if err != nil {
 				heartbeatFailedCnt++
-				nsqd.NsqLogger().LogWarningf("PROTOCOL(V2): [%s] send heartbeat failed %v times, %v", client, heartbeatFailedCnt, err)
+				protocolLog.LogWarningf("PROTOCOL(V2): [%s] send heartbeat failed %v times, %v", client, heartbeatFailedCnt, err)
 				if heartbeatFailedCnt > 2 {
+					client.SetDisconnectReason(nsqd.DisconnectHeartbeatFail)
 					goto exit
 				}
 			} else {
 				heartbeatFailedCnt = 0
+				client.HeartbeatWritten(now, time.Now())
+			}
+		case now := <-connCheckChan:
+			if reason := p.checkConnDeadline(client, now, lifetimeJitter); reason != "" {
+				protocolLog.Logf("PROTOCOL(V2): [%s] closed by %v, connected at %v", client, reason, client.ConnectTime)
+				p.ctx.nsqd.IncrProtocolForcedCloseStats(nsqd.ProtocolTCP, reason)
+				client.ExitWithReason(reason)
+				goto exit
 			}
 		case msg, ok := <-clientMsgChan:
 			if !ok {
@@ -617,24 +711,31 @@ func (p *protocolV2) messagePump(client *nsqd.ClientV2, startedChan chan bool,
 				// while the topic upgraded to the ext, we should close all the old client
 				// which not support the ext.
 				err = errors.New("client should reconnect with extend support since the topic is upgraded to ext")
+				client.SetDisconnectReason(nsqd.DisconnectServerEvicted)
 				goto exit
 			}
 			err = SendMessage(client, msg, extSupport && subChannel.IsExt(), &buf, subChannel.IsOrdered())
 			if err != nil {
+				client.SetDisconnectReason(writeErrDisconnectReason(err))
 				goto exit
 			}
+			// the body is not needed until redelivery, so release it if too many in flight
+			subChannel.SpillInFlightMessage(client.ID, msg)
 			flushed = false
 		}
 	}
 
 exit:
-	if nsqd.NsqLogger().Level() > levellogger.LOG_DEBUG {
-		nsqd.NsqLogger().LogDebugf("PROTOCOL(V2): [%s] exiting messagePump", client)
+	if protocolLog.Level() > levellogger.LOG_DEBUG {
+		protocolLog.LogDebugf("PROTOCOL(V2): [%s] exiting messagePump", client)
 	}
 	heartbeatTicker.Stop()
 	outputBufferTicker.Stop()
+	if connCheckTicker != nil {
+		connCheckTicker.Stop()
+	}
 	if err != nil {
-		nsqd.NsqLogger().Logf("PROTOCOL(V2): [%s] messagePump error - %s", client, err)
+		protocolLog.Logf("PROTOCOL(V2): [%s] messagePump error - %s", client, err)
 	}
 	close(stoppedChan)
 }
@@ -644,7 +745,7 @@ func (p *protocolV2) IDENTIFY(client *nsqd.ClientV2, params [][]byte) ([]byte, e
 
 	state := atomic.LoadInt32(&client.State)
 	if state != stateInit {
-		nsqd.NsqLogger().LogWarningf("[%s] command in wrong state: %v", client, state)
+		protocolLog.LogWarningf("[%s] command in wrong state: %v", client, state)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "cannot IDENTIFY in current state")
 	}
 
@@ -676,7 +777,7 @@ func (p *protocolV2) IDENTIFY(client *nsqd.ClientV2, params [][]byte) ([]byte, e
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to decode JSON body")
 	}
 
-	nsqd.NsqLogger().LogDebugf("PROTOCOL(V2): [%s] %+v", client, identifyData)
+	protocolLog.LogDebugf("PROTOCOL(V2): [%s] %+v", client, identifyData)
 
 	err = client.Identify(identifyData)
 	if err != nil {
@@ -703,6 +804,7 @@ func (p *protocolV2) IDENTIFY(client *nsqd.ClientV2, params [][]byte) ([]byte, e
 		return nil, protocol.NewFatalClientErr(nil, "E_IDENTIFY_FAILED", "cannot enable both deflate and snappy compression")
 	}
 
+	tcpNoDelay, tcpSendBufSize, tcpRecvBufSize, tcpKeepAlive := client.GetTCPOptions()
 	resp, err := json.Marshal(struct {
 		MaxRdyCount         int64  `json:"max_rdy_count"`
 		Version             string `json:"version"`
@@ -718,6 +820,11 @@ func (p *protocolV2) IDENTIFY(client *nsqd.ClientV2, params [][]byte) ([]byte, e
 		OutputBufferSize    int    `json:"output_buffer_size"`
 		OutputBufferTimeout int64  `json:"output_buffer_timeout"`
 		DesiredTag          string `json:"desired_tag,omitempty"`
+		TCPNoDelay          bool   `json:"tcp_no_delay"`
+		TCPSendBufferSize   int    `json:"tcp_send_buffer_size"`
+		TCPRecvBufferSize   int    `json:"tcp_recv_buffer_size"`
+		TCPKeepAlivePeriod  int64  `json:"tcp_keepalive_period"`
+		StructuredError     bool   `json:"structured_error"`
 	}{
 		MaxRdyCount:         p.ctx.getOpts().MaxRdyCount,
 		Version:             version.Binary,
@@ -733,6 +840,11 @@ func (p *protocolV2) IDENTIFY(client *nsqd.ClientV2, params [][]byte) ([]byte, e
 		OutputBufferSize:    int(client.GetOutputBufferSize()),
 		OutputBufferTimeout: int64(client.GetOutputBufferTimeout() / time.Millisecond),
 		DesiredTag:          client.GetDesiredTag(),
+		TCPNoDelay:          tcpNoDelay,
+		TCPSendBufferSize:   tcpSendBufSize,
+		TCPRecvBufferSize:   tcpRecvBufSize,
+		TCPKeepAlivePeriod:  nsqd.KeepAlivePeriodMillis(tcpKeepAlive),
+		StructuredError:     client.IsStructuredError(),
 	})
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -744,7 +856,7 @@ func (p *protocolV2) IDENTIFY(client *nsqd.ClientV2, params [][]byte) ([]byte, e
 	}
 
 	if tlsv1 {
-		nsqd.NsqLogger().Logf("PROTOCOL(V2): [%s] upgrading connection to TLS", client)
+		protocolLog.Logf("PROTOCOL(V2): [%s] upgrading connection to TLS", client)
 		err = client.UpgradeTLS()
 		if err != nil {
 			return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -754,10 +866,14 @@ func (p *protocolV2) IDENTIFY(client *nsqd.ClientV2, params [][]byte) ([]byte, e
 		if err != nil {
 			return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
 		}
+		// the tls identity is known after the upgrade
+		if err = p.checkIdentityLimit(client); err != nil {
+			return nil, err
+		}
 	}
 
 	if snappy {
-		nsqd.NsqLogger().Logf("PROTOCOL(V2): [%s] upgrading connection to snappy", client)
+		protocolLog.Logf("PROTOCOL(V2): [%s] upgrading connection to snappy", client)
 		err = client.UpgradeSnappy()
 		if err != nil {
 			return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -770,7 +886,7 @@ func (p *protocolV2) IDENTIFY(client *nsqd.ClientV2, params [][]byte) ([]byte, e
 	}
 
 	if deflate {
-		nsqd.NsqLogger().Logf("PROTOCOL(V2): [%s] upgrading connection to deflate (level %d)", client, deflateLevel)
+		protocolLog.Logf("PROTOCOL(V2): [%s] upgrading connection to deflate (level %d)", client, deflateLevel)
 		err = client.UpgradeDeflate(deflateLevel)
 		if err != nil {
 			return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -788,7 +904,7 @@ func (p *protocolV2) IDENTIFY(client *nsqd.ClientV2, params [][]byte) ([]byte, e
 func (p *protocolV2) AUTH(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
 	if state != stateInit {
-		nsqd.NsqLogger().LogWarningf("[%s] command in wrong state: %v", client, state)
+		protocolLog.LogWarningf("[%s] command in wrong state: %v", client, state)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "cannot AUTH in current state")
 	}
 
@@ -827,7 +943,7 @@ func (p *protocolV2) AUTH(client *nsqd.ClientV2, params [][]byte) ([]byte, error
 
 	if err = client.Auth(string(body)); err != nil {
 		// we don't want to leak errors contacting the auth server to untrusted clients
-		nsqd.NsqLogger().Logf("PROTOCOL(V2): [%s] Auth Failed %s", client, err)
+		protocolLog.Logf("PROTOCOL(V2): [%s] Auth Failed %s", client, err)
 		return nil, protocol.NewFatalClientErr(err, "E_AUTH_FAILED", "AUTH failed")
 	}
 
@@ -835,6 +951,10 @@ func (p *protocolV2) AUTH(client *nsqd.ClientV2, params [][]byte) ([]byte, error
 		return nil, protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED", "AUTH No authorizations found")
 	}
 
+	if err = p.checkIdentityLimit(client); err != nil {
+		return nil, err
+	}
+
 	var resp []byte
 	resp, err = json.Marshal(struct {
 		Identity        string `json:"identity"`
@@ -866,17 +986,47 @@ func (p *protocolV2) CheckAuth(client *nsqd.ClientV2, cmd, topicName, channelNam
 			return protocol.NewFatalClientErr(nil, "E_AUTH_FIRST",
 				fmt.Sprintf("AUTH required before %s", cmd))
 		}
+		expired := client.AuthState.IsExpired()
 		ok, err := client.IsAuthorized(topicName, channelName)
 		if err != nil {
 			// we don't want to leak errors contacting the auth server to untrusted clients
-			nsqd.NsqLogger().Logf("PROTOCOL(V2): [%s] Auth Failed %s", client, err)
+			protocolLog.Logf("PROTOCOL(V2): [%s] Auth Failed %s", client, err)
+			client.SetDisconnectReason(nsqd.DisconnectAuthError)
 			return protocol.NewFatalClientErr(nil, "E_AUTH_FAILED", "AUTH failed")
 		}
 		if !ok {
+			if expired {
+				// the refreshed authorizations no longer allow the client
+				client.SetDisconnectReason(nsqd.DisconnectAuthExpired)
+			}
 			return protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
 				fmt.Sprintf("AUTH failed for %s on %q %q", cmd, topicName, channelName))
 		}
 	}
+	switch cmd {
+	case "PUB":
+		return p.checkACL(client, auth.ACLOpPub, topicName)
+	case "SUB":
+		return p.checkACL(client, auth.ACLOpSub, topicName)
+	}
+	return nil
+}
+
+// checkIdentityLimit rejects the connection if too many connections of the identity
+func (p *protocolV2) checkIdentityLimit(client *nsqd.ClientV2) error {
+	identity := client.GetIdentity()
+	if err := p.ctx.nsqd.AcquireClientIdentity(client, identity); err != nil {
+		protocolLog.Logf("PROTOCOL(V2): [%s] rejected for identity %v: %v", client, identity, err)
+		return protocol.NewFatalClientErr(err, E_TOO_MANY_CONNS, err.Error())
+	}
+	return nil
+}
+
+func (p *protocolV2) checkACL(client *nsqd.ClientV2, op string, topicName string) error {
+	if !p.ctx.checkACL(client.GetIdentity(), topicName, op) {
+		return protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+			fmt.Sprintf("ACL denied for %s on %q", op, topicName))
+	}
 	return nil
 }
 
@@ -907,7 +1057,7 @@ func (p *protocolV2) internalSUB(client *nsqd.ClientV2, params [][]byte, enableT
 
 	state := atomic.LoadInt32(&client.State)
 	if state != stateInit {
-		nsqd.NsqLogger().LogWarningf("[%s] command in wrong state: %v", client, state)
+		protocolLog.LogWarningf("[%s] command in wrong state: %v", client, state)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "cannot SUB in current state")
 	}
 
@@ -952,39 +1102,65 @@ func (p *protocolV2) internalSUB(client *nsqd.ClientV2, params [][]byte, enableT
 
 	topic, err := p.ctx.getExistingTopic(topicName, partition)
 	if err != nil {
-		nsqd.NsqLogger().Logf("sub to not existing topic: %v, err:%v", topicName, err.Error())
-		return nil, protocol.NewFatalClientErr(nil, E_TOPIC_NOT_EXIST, "")
+		protocolLog.Logf("sub to not existing topic: %v, err:%v", topicName, err.Error())
+		return nil, protocol.NewFatalClientErr(nil, E_TOPIC_NOT_EXIST, "").WithDetails(topicErrDetails(topicName, partition))
 	}
 	if topic.IsOrdered() && !ordered {
 		return nil, protocol.NewFatalClientErr(nil, "E_SUB_ORDER_IS_MUST", "this topic is configured only allow ordered sub")
 	}
 	if topic.IsExt() {
 		if !p.ctx.getOpts().AllowSubExtCompatible && !client.ExtendSupport() {
-			nsqd.NsqLogger().Logf("sub failed on extend topic: %v-%v, %v", topicName, channelName, client.String())
+			protocolLog.Logf("sub failed on extend topic: %v-%v, %v", topicName, channelName, client.String())
 			return nil, protocol.NewFatalClientErr(nil, "E_SUB_EXTEND_NEED", "this topic is extended and should identify as extend support.")
 		}
 	} else {
 		if client.ExtendSupport() {
-			nsqd.NsqLogger().Logf("sub failed on non-extend topic: %v-%v, %v", topicName, channelName, client.String())
+			protocolLog.Logf("sub failed on non-extend topic: %v-%v, %v", topicName, channelName, client.String())
 			return nil, protocol.NewFatalClientErr(nil, "E_SUB_EXTEND_FORBIDDON", "this topic is not extended and should not identify as extend support.")
 		}
 	}
 	if !p.ctx.checkForMasterWrite(topicName, partition) {
-		nsqd.NsqLogger().Logf("sub failed on not leader: %v-%v, remote is : %v", topicName, partition, client.String())
+		protocolLog.Logf("sub failed on not leader: %v-%v, remote is : %v", topicName, partition, client.String())
 		// we need disable topic here to trigger a notify, maybe we failed to notify lookup last time.
 		topic.DisableForSlave()
-		return nil, protocol.NewFatalClientErr(nil, FailedOnNotLeader, "")
+		return nil, protocol.NewFatalClientErr(nil, FailedOnNotLeader, "").WithDetails(topicErrDetails(topicName, partition))
+	}
+	// the reply channel can only be subscribed by the client created it
+	if protocol.IsReplyChannel(channelName) && !client.IsReplyChannelOwner(topic.GetTopicName(), topic.GetTopicPart(), channelName) {
+		if _, err := topic.GetExistingChannel(channelName); err == nil {
+			return nil, protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+				fmt.Sprintf("reply channel %v is not created by the connection", channelName))
+		}
+	}
+	if _, err := topic.GetExistingChannel(channelName); err != nil {
+		if protocol.IsReplyChannel(channelName) {
+			return nil, protocol.NewFatalClientErr(nil, E_CHANNEL_NOT_EXIST,
+				fmt.Sprintf("reply channel %v should be created by REPLY_CHANNEL", channelName))
+		}
+		if p.ctx.isReadOnly() && !protocol.IsEphemeral(channelName) {
+			return nil, protocol.NewFatalClientErr(nil, E_READ_ONLY,
+				fmt.Sprintf("channel %v can not be created in read only recovery mode", channelName))
+		}
+		// the ephemeral channel will not keep the backlog, so it is always allowed
+		if topic.IsChannelAutoCreateDisabled() && !protocol.IsEphemeral(channelName) {
+			protocolLog.Logf("sub to not registered channel: %v-%v, remote is : %v", topic.GetFullName(), channelName, client.String())
+			return nil, protocol.NewFatalClientErr(nil, E_CHANNEL_NOT_EXIST,
+				fmt.Sprintf("channel %v should be registered before subscribe", channelName))
+		}
+		if err = p.checkACL(client, auth.ACLOpChannelCreate, topicName); err != nil {
+			return nil, err
+		}
 	}
 	channel := topic.GetChannel(channelName)
 	// client with tag is subscribe to topic not support tag, remove client's tag and treat it like untaged consumer
 	if !topic.IsExt() && client.GetDesiredTag() != "" {
-		nsqd.NsqLogger().Logf("[%v] IDENTIFY before subscribe has a tag %v to topic %v not support tag. Remove client's tag.", client, client.GetDesiredTag(), topicName)
+		protocolLog.Logf("[%v] IDENTIFY before subscribe has a tag %v to topic %v not support tag. Remove client's tag.", client, client.GetDesiredTag(), topicName)
 		client.UnsetDesiredTag()
 	}
 
 	err = channel.AddClient(client.ID, client)
 	if err != nil {
-		nsqd.NsqLogger().Logf("sub failed to add client: %v, %v", client, err)
+		protocolLog.Logf("sub failed to add client: %v, %v", client, err)
 		return nil, protocol.NewFatalClientErr(nil, FailedOnNotWritable, "")
 	}
 
@@ -995,11 +1171,11 @@ func (p *protocolV2) internalSUB(client *nsqd.ClientV2, params [][]byte, enableT
 	atomic.StoreInt32(&client.State, stateSubscribed)
 	client.Channel = channel
 	if enableTrace {
-		nsqd.NsqLogger().Logf("sub channel %v with trace enabled, remote is : %v", channelName, client.String())
+		protocolLog.Logf("sub channel %v with trace enabled, remote is : %v", channelName, client.String())
 	}
 	if ordered {
 		if atomic.LoadInt32(&client.SampleRate) != 0 {
-			nsqd.NsqLogger().Errorf("%v", ErrOrderChannelOnSampleRate)
+			protocolLog.Errorf("%v", ErrOrderChannelOnSampleRate)
 			return nil, protocol.NewFatalClientErr(nil, E_INVALID, ErrOrderChannelOnSampleRate.Error())
 		}
 		channel.SetOrdered(true)
@@ -1008,13 +1184,13 @@ func (p *protocolV2) internalSUB(client *nsqd.ClientV2, params [][]byte, enableT
 	if startFrom != nil {
 		cnt := channel.GetClientsCount()
 		if cnt > 1 {
-			nsqd.NsqLogger().LogDebugf("the consume offset: %v can only be set by the first client: %v", startFrom, cnt)
+			protocolLog.LogDebugf("the consume offset: %v can only be set by the first client: %v", startFrom, cnt)
 		} else {
 			queueOffset, cnt, err := p.ctx.SetChannelOffset(channel, startFrom, false)
 			if err != nil {
 				return nil, protocol.NewFatalClientErr(nil, E_INVALID, err.Error())
 			}
-			nsqd.NsqLogger().Logf("set the channel offset: %v (actual set : %v:%v), by client:%v, %v",
+			protocolLog.Logf("set the channel offset: %v (actual set : %v:%v), by client:%v, %v",
 				startFrom, queueOffset, cnt, client.String(), client.UserAgent)
 		}
 	}
@@ -1030,14 +1206,14 @@ func (p *protocolV2) RDY(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 
 	if state == stateClosing {
 		// just ignore ready changes on a closing channel
-		nsqd.NsqLogger().Logf(
+		protocolLog.Logf(
 			"PROTOCOL(V2): [%s] ignoring RDY after CLS in state ClientStateV2Closing",
 			client)
 		return nil, nil
 	}
 
 	if state != stateSubscribed {
-		nsqd.NsqLogger().LogWarningf("[%s] command in wrong state: %v", client, state)
+		protocolLog.LogWarningf("[%s] command in wrong state: %v", client, state)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "cannot RDY in current state")
 	}
 
@@ -1066,18 +1242,18 @@ func (p *protocolV2) RDY(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 func (p *protocolV2) FIN(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
 	if state != stateSubscribed && state != stateClosing {
-		nsqd.NsqLogger().LogWarningf("[%s] command in wrong state: %v", client, state)
+		protocolLog.LogWarningf("[%s] command in wrong state: %v", client, state)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "cannot FIN in current state")
 	}
 
 	if len(params) < 2 {
-		nsqd.NsqLogger().LogDebugf("FIN error params: %v", params)
+		protocolLog.LogDebugf("FIN error params: %v", params)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "FIN insufficient number of params")
 	}
 
 	id, err := getFullMessageID(params[1])
 	if err != nil {
-		nsqd.NsqLogger().LogDebugf("FIN error: %v, %v", params[1], err)
+		protocolLog.LogDebugf("FIN error: %v, %v", params[1], err)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, err.Error())
 	}
 	msgID := nsqd.GetMessageIDFromFullMsgID(*id)
@@ -1086,19 +1262,19 @@ func (p *protocolV2) FIN(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 	}
 
 	if client.Channel == nil {
-		nsqd.NsqLogger().LogDebugf("FIN error no channel: %v", msgID)
+		protocolLog.LogDebugf("FIN error no channel: %v", msgID)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "No channel")
 	}
 
 	if !p.ctx.checkForMasterWrite(client.Channel.GetTopicName(), client.Channel.GetTopicPart()) {
-		nsqd.NsqLogger().Logf("topic %v fin message failed for not leader", client.Channel.GetTopicName())
+		protocolLog.Logf("topic %v fin message failed for not leader", client.Channel.GetTopicName())
 		return nil, protocol.NewFatalClientErr(nil, FailedOnNotLeader, "")
 	}
 
 	err = p.ctx.FinishMessage(client.Channel, client.ID, client.String(), msgID)
 	if err != nil {
 		client.IncrSubError(int64(1))
-		nsqd.NsqLogger().LogDebugf("FIN error : %v, err: %v, channel: %v, topic: %v", msgID,
+		protocolLog.LogDebugf("FIN error : %v, err: %v, channel: %v, topic: %v", msgID,
 			err, client.Channel.GetName(), client.Channel.GetTopicName())
 		if clusterErr, ok := err.(*consistence.CommonCoordErr); ok {
 			if !clusterErr.IsLocalErr() {
@@ -1116,7 +1292,7 @@ func (p *protocolV2) requeueToEnd(client *nsqd.ClientV2, oldMsg *nsqd.Message,
 	timeoutDuration time.Duration) error {
 	err := p.ctx.internalRequeueToEnd(client.Channel, oldMsg, timeoutDuration)
 	if err != nil {
-		nsqd.NsqLogger().LogWarningf("[%s] req channel %v(%v) failed: %v", client,
+		protocolLog.LogWarningf("[%s] req channel %v(%v) failed: %v", client,
 			client.Channel.GetName(), client.Channel.GetTopicName(), err)
 		return err
 	}
@@ -1126,11 +1302,13 @@ func (p *protocolV2) requeueToEnd(client *nsqd.ClientV2, oldMsg *nsqd.Message,
 func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
 	if state != stateSubscribed && state != stateClosing {
-		nsqd.NsqLogger().LogWarningf("[%s] command in wrong state: %v", client, state)
+		protocolLog.LogWarningf("[%s] command in wrong state: %v", client, state)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "cannot REQ in current state")
 	}
 
-	if len(params) < 3 {
+	// the timeout can be omitted if the req backoff is enabled for the channel,
+	// and the timeout will be computed by the message attempts on server.
+	if len(params) < 2 || (len(params) < 3 && (client.Channel == nil || !client.Channel.IsReqBackoffEnabled())) {
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "REQ insufficient number of params")
 	}
 
@@ -1139,12 +1317,27 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, err.Error())
 	}
 
-	timeoutMs, err := protocol.ByteToBase10(params[2])
-	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, E_INVALID,
-			fmt.Sprintf("REQ could not parse timeout %s, %s", params[1], params[2]))
+	byBackoff := false
+	var timeoutDuration time.Duration
+	if len(params) < 3 || len(params[2]) == 0 {
+		if client.Channel == nil {
+			return nil, protocol.NewFatalClientErr(nil, E_INVALID, "No channel")
+		}
+		timeoutDuration, err = client.Channel.GetReqBackoffTimeout(client.ID, nsqd.GetMessageIDFromFullMsgID(*id))
+		if err != nil {
+			client.IncrSubError(int64(1))
+			return nil, protocol.NewClientErr(err, "E_REQ_FAILED",
+				fmt.Sprintf("REQ %v failed %s", *id, err.Error()))
+		}
+		byBackoff = true
+	} else {
+		timeoutMs, err := protocol.ByteToBase10(params[2])
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, E_INVALID,
+				fmt.Sprintf("REQ could not parse timeout %s, %s", params[1], params[2]))
+		}
+		timeoutDuration = time.Duration(timeoutMs) * time.Millisecond
 	}
-	timeoutDuration := time.Duration(timeoutMs) * time.Millisecond
 
 	maxReqTimeout := p.ctx.getOpts().MaxReqTimeout
 	clampedTimeout := timeoutDuration
@@ -1155,7 +1348,7 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 		clampedTimeout = maxReqTimeout
 	}
 	if clampedTimeout != timeoutDuration {
-		nsqd.NsqLogger().Logf("[%s] REQ timeout %d out of range 0-%d. Setting to %d",
+		protocolLog.Logf("[%s] REQ timeout %d out of range 0-%d. Setting to %d",
 			client, timeoutDuration, maxReqTimeout, clampedTimeout)
 		timeoutDuration = clampedTimeout
 	}
@@ -1179,7 +1372,7 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 		toEnd = false
 		// for ordered topic, disable defer since it may block the consume
 		if timeoutDuration > 0 {
-			nsqd.NsqLogger().Logf("ignore delay for ordered topic: %v, %v, %v, %v",
+			protocolLog.Logf("ignore delay for ordered topic: %v, %v, %v, %v",
 				client, client.Channel.GetTopicName(), client.Channel.GetName(), timeoutDuration)
 			return nil, nil
 		}
@@ -1194,12 +1387,16 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 		}
 	}
 	if !toEnd || err != nil {
-		err = client.Channel.RequeueMessage(client.ID, client.String(), msgID, timeoutDuration, true)
+		if byBackoff {
+			err = client.Channel.RequeueMessageByBackoff(client.ID, client.String(), msgID, timeoutDuration)
+		} else {
+			err = client.Channel.RequeueMessage(client.ID, client.String(), msgID, timeoutDuration, true)
+		}
 	}
 	if err != nil {
 		client.IncrSubError(int64(1))
 
-		nsqd.NsqLogger().LogWarningf("client %v req failed %v for topic: %v, %v, %v, %v",
+		protocolLog.LogWarningf("client %v req failed %v for topic: %v, %v, %v, %v",
 			client, err.Error(), client.Channel.GetTopicName(), client.Channel.GetName(), msgID, timeoutDuration)
 		return nil, protocol.NewClientErr(err, "E_REQ_FAILED",
 			fmt.Sprintf("REQ %v failed %s", *id, err.Error()))
@@ -1208,19 +1405,85 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 	return nil, nil
 }
 
+// REPLYCHANNEL creates a temporary channel to receive the reply for request/reply,
+// the channel name will be returned and it will be deleted while this connection closed
+// or expired after the ttl.
+//
+// REPLY_CHANNEL <topic> [<partition> [<ttl_ms>]]\n
+func (p *protocolV2) REPLYCHANNEL(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
+	if len(params) < 2 {
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "REPLY_CHANNEL insufficient number of parameters")
+	}
+	topicName := string(params[1])
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("REPLY_CHANNEL topic name %q is not valid", topicName))
+	}
+	partition := -1
+	var err error
+	if len(params) >= 3 {
+		partition, err = strconv.Atoi(string(params[2]))
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_PARTITION",
+				fmt.Sprintf("topic partition is not valid: %v", err))
+		}
+	}
+	maxTTL := p.ctx.getOpts().MaxReplyChannelTTL
+	ttl := maxTTL
+	if len(params) >= 4 {
+		ttlMs, err := protocol.ByteToBase10(params[3])
+		if err != nil || ttlMs <= 0 {
+			return nil, protocol.NewFatalClientErr(nil, E_INVALID,
+				fmt.Sprintf("REPLY_CHANNEL ttl is not valid: %s", params[3]))
+		}
+		if time.Duration(ttlMs)*time.Millisecond < maxTTL {
+			ttl = time.Duration(ttlMs) * time.Millisecond
+		}
+	}
+	if err = p.CheckAuth(client, "SUB", topicName, ""); err != nil {
+		return nil, err
+	}
+	if partition == -1 {
+		partition = p.ctx.getDefaultPartition(topicName)
+	}
+	topic, err := p.ctx.getExistingTopic(topicName, partition)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(nil, E_TOPIC_NOT_EXIST, "").WithDetails(topicErrDetails(topicName, partition))
+	}
+	if !p.ctx.checkForMasterWrite(topicName, partition) {
+		topic.DisableForSlave()
+		return nil, protocol.NewFatalClientErr(nil, FailedOnNotLeader, "").WithDetails(topicErrDetails(topicName, partition))
+	}
+	if err = p.checkACL(client, auth.ACLOpChannelCreate, topicName); err != nil {
+		return nil, err
+	}
+	if client.GetReplyChannelsCount() >= maxReplyChannelsPerClient {
+		return nil, protocol.NewClientErr(nil, "E_TOO_MANY_REPLY_CHANNELS",
+			fmt.Sprintf("the connection can create at most %v reply channels", maxReplyChannelsPerClient))
+	}
+	channel := topic.CreateReplyChannel(client.ID, ttl, client.RemoveReplyChannel)
+	client.AddReplyChannel(channel)
+	protocolLog.Logf("client %v created reply channel %v on topic %v, ttl: %v",
+		client, channel.GetName(), topic.GetFullName(), ttl)
+	return []byte(channel.GetName()), nil
+}
+
 func (p *protocolV2) CLS(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
 	if state != stateSubscribed {
-		nsqd.NsqLogger().LogWarningf("[%s] command in wrong state: %v", client, state)
+		protocolLog.LogWarningf("[%s] command in wrong state: %v", client, state)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "cannot CLS in current state")
 	}
 
 	client.StartClose()
+	client.SetDisconnectReason(nsqd.DisconnectClientCLS)
 
 	return []byte("CLOSE_WAIT"), nil
 }
 
 func (p *protocolV2) NOP(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
+	// the client will response the heartbeat with NOP
+	client.HeartbeatResponded(time.Now())
 	return nil, nil
 }
 
@@ -1263,6 +1526,10 @@ func (p *protocolV2) internalCreateTopic(client *nsqd.ClientV2, params [][]byte)
 		return nil, protocol.NewClientErr(err, "E_CREATE_TOPIC_FAILED",
 			fmt.Sprintf("CREATE_TOPIC is not allowed here while cluster feature enabled."))
 	}
+	if err = p.ctx.nsqd.CheckNamespaceTopicQuota(topicName); err != nil {
+		return nil, protocol.NewClientErr(err, E_NAMESPACE_QUOTA, err.Error()).WithDetails(
+			map[string]string{"namespace": nsqd.GetTopicNamespace(topicName)})
+	}
 
 	topic := p.ctx.getTopic(topicName, partition, ext)
 	if topic == nil {
@@ -1279,6 +1546,9 @@ func (p *protocolV2) preparePub(client *nsqd.ClientV2, params [][]byte, maxBody
 	if len(params) < 2 {
 		return 0, nil, protocol.NewFatalClientErr(nil, E_INVALID, "insufficient number of parameters")
 	}
+	if p.ctx.isReadOnly() {
+		return 0, nil, protocol.NewFatalClientErr(nil, E_READ_ONLY, "nsqd is in read only recovery mode")
+	}
 
 	topicName := string(params[1])
 	partition := -1
@@ -1306,7 +1576,7 @@ func (p *protocolV2) preparePub(client *nsqd.ClientV2, params [][]byte, maxBody
 	}
 
 	if int64(bodyLen) > maxBody {
-		nsqd.NsqLogger().Logf("topic: %v message body too large %v vs %v ", topicName, bodyLen, maxBody)
+		protocolLog.Logf("topic: %v message body too large %v vs %v ", topicName, bodyLen, maxBody)
 		if isMpub {
 			return bodyLen, nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
 				fmt.Sprintf("body too big %d > %d", bodyLen, maxBody))
@@ -1318,18 +1588,27 @@ func (p *protocolV2) preparePub(client *nsqd.ClientV2, params [][]byte, maxBody
 
 	topic, err := p.ctx.getExistingTopic(topicName, partition)
 	if err != nil {
-		nsqd.NsqLogger().Logf("not existing topic: %v-%v, err:%v", topicName, partition, err.Error())
-		return bodyLen, nil, protocol.NewFatalClientErr(nil, E_TOPIC_NOT_EXIST, "")
+		protocolLog.Logf("not existing topic: %v-%v, err:%v", topicName, partition, err.Error())
+		return bodyLen, nil, protocol.NewFatalClientErr(nil, E_TOPIC_NOT_EXIST, "").WithDetails(topicErrDetails(topicName, partition))
 	}
 
 	if origPart == -1 && topic.IsOrdered() {
 		return 0, nil, protocol.NewFatalClientErr(nil, "E_BAD_PARTITION",
 			fmt.Sprintf("topic partition is not valid for multi partition: %v", origPart))
 	}
+	if maxMsgSize := topic.GetMaxMsgSize(maxBody); !isMpub && int64(bodyLen) > maxMsgSize {
+		return bodyLen, nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("message too big %d > %d", bodyLen, maxMsgSize))
+	}
 
 	if err := p.CheckAuth(client, "PUB", topicName, ""); err != nil {
 		return bodyLen, nil, err
 	}
+	if err := p.ctx.nsqd.AddClientTopicPublisher(client, topic.GetFullName()); err != nil {
+		protocolLog.Logf("PROTOCOL(V2): [%s] rejected to publish %v: %v", client, topic.GetFullName(), err)
+		return bodyLen, nil, protocol.NewFatalClientErr(err, E_TOO_MANY_PUBLISHERS, err.Error()).WithDetails(
+			topicErrDetails(topicName, partition))
+	}
 	// mpub
 	return bodyLen, topic, nil
 }
@@ -1370,8 +1649,8 @@ func getTracedReponse(id nsqd.MessageID, traceID uint64, offset nsqd.BackendOffs
 	pos += 8
 	binary.BigEndian.PutUint32(buf[pos:pos+4], uint32(rawSize))
 
-	if nsqd.NsqLogger().Level() >= levellogger.LOG_DEBUG {
-		nsqd.NsqLogger().Logf("pub traced %v (%v, %v) response : %v", id, offset, rawSize, buf)
+	if protocolLog.Level() >= levellogger.LOG_DEBUG {
+		protocolLog.Logf("pub traced %v (%v, %v) response : %v", id, offset, rawSize, buf)
 	}
 	return buf, nil
 }
@@ -1397,10 +1676,10 @@ func internalPubAsync(clientTimer *time.Timer, msgBody *bytes.Buffer, topic *nsq
 		select {
 		case topic.GetWaitChan() <- info:
 		case <-topic.QuitChan():
-			nsqd.NsqLogger().Infof("topic %v put messages failed at exiting", topic.GetFullName())
+			protocolLog.Infof("topic %v put messages failed at exiting", topic.GetFullName())
 			return nsqd.ErrExiting
 		case <-clientTimer.C:
-			nsqd.NsqLogger().Infof("topic %v put messages timeout ", topic.GetFullName())
+			protocolLog.Infof("topic %v put messages timeout ", topic.GetFullName())
 			return ErrPubToWaitTimeout
 		}
 	}
@@ -1421,6 +1700,7 @@ pub ext or pub trace or pub, if pubExt is true, traceEnable is ignored.
 */
 func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]byte, pubExt bool, traceEnable bool) ([]byte, error) {
 	startPub := time.Now().UnixNano()
+	client.SetLastPubTime(startPub)
 	bodyLen, topic, err := p.preparePub(client, params, p.ctx.getOpts().MaxMsgSize, false)
 	if err != nil {
 		return nil, err
@@ -1443,7 +1723,7 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 	topicName := topic.GetTopicName()
 	_, err = io.CopyN(messageBodyBuffer, client.Reader, int64(bodyLen))
 	if err != nil {
-		nsqd.NsqLogger().Logf("topic: %v message body read error %v ", topicName, err.Error())
+		protocolLog.Logf("topic: %v message body read error %v ", topicName, err.Error())
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "failed to read message body")
 	}
 	messageBody := messageBodyBuffer.Bytes()[:bodyLen]
@@ -1455,6 +1735,7 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 	var realBody []byte
 	var extContent ext.IExtContent
 	var jsonHeader *simpleJson.Json
+	var dedupKey []byte
 	extContent = ext.NewNoExt()
 	if traceEnable && !pubExt {
 		traceID = binary.BigEndian.Uint64(messageBody[:nsqd.MsgTraceIDLength])
@@ -1488,6 +1769,9 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 			}
 			needTraceRsp = true
 		}
+		if k, err := jsonHeader.Get(ext.DEDUP_KEY).String(); err == nil {
+			dedupKey = []byte(k)
+		}
 
 		jhe := ext.NewJsonHeaderExt()
 		jhe.SetJsonHeaderBytes(extJsonBytes)
@@ -1509,20 +1793,52 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 					// for future, if any internal header can not be ignored, we should check here
 					if !strings.HasPrefix(k, "##") {
 						canIgnoreExt = false
-						nsqd.NsqLogger().Debugf("custom ext content can not be ignored in topic: %v, %v", topicName, k)
+						protocolLog.Debugf("custom ext content can not be ignored in topic: %v, %v", topicName, k)
 						break
 					}
 				}
 			}
 			if p.ctx.getOpts().AllowExtCompatible && canIgnoreExt {
 				extContent = ext.NewNoExt()
-				nsqd.NsqLogger().Debugf("ext content ignored in topic: %v", topicName)
+				// the replicas record the dedup key from the json header, so the message
+				// without the json header is not deduplicated
+				dedupKey = nil
+				protocolLog.Debugf("ext content ignored in topic: %v", topicName)
 			} else {
-				nsqd.NsqLogger().Infof("ext content not supported in topic: %v", topicName)
+				protocolLog.Infof("ext content not supported in topic: %v", topicName)
 				return nil, protocol.NewClientErr(nil, ext.E_EXT_NOT_SUPPORT,
 					fmt.Sprintf("ext content not supported in topic %v", topicName))
 			}
 		}
+		// the publish on the existing connections is rejected while draining
+		if p.ctx.isDraining() {
+			return nil, protocol.NewClientErr(nil, "E_DRAINING", "the node is draining").WithDetails(topicErrDetails(topicName, partition))
+		}
+		// the backpressure is checked first to avoid counting the rejected publish
+		// in the namespace pub rate
+		if retryAfter, ok := p.ctx.checkPubBackpressure(topic); ok {
+			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, client.GetIdentity(), "tcp", 1, true)
+			return nil, pubBackpressureErr(topic, retryAfter)
+		}
+		if err = p.ctx.nsqd.CheckNamespacePubQuota(topicName, 1); err != nil {
+			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, client.GetIdentity(), "tcp", 1, true)
+			return nil, protocol.NewClientErr(err, E_NAMESPACE_QUOTA, err.Error()).WithDetails(
+				map[string]string{"namespace": nsqd.GetTopicNamespace(topicName)})
+		}
+		var dropped bool
+		dropped, err = topic.CheckDedupKey(dedupKey)
+		if err != nil {
+			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, client.GetIdentity(), "tcp", 1, true)
+			return nil, protocol.NewClientErr(err, "E_DUP_MSG", err.Error())
+		}
+		if dropped {
+			// the duplicated message is accepted without written
+			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, client.GetIdentity(), "tcp", 1, false)
+			if needTraceRsp {
+				return getTracedReponse(0, traceID, 0, 0)
+			}
+			return okBytes, nil
+		}
 		id := nsqd.MessageID(0)
 		offset := nsqd.BackendOffset(0)
 		rawSize := int32(0)
@@ -1533,8 +1849,9 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 		}
 		//p.ctx.setHealth(err)
 		if err != nil {
-			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", 1, true)
-			nsqd.NsqLogger().LogErrorf("topic %v put message failed: %v", topic.GetFullName(), err)
+			topic.ForgetDedupKey(dedupKey)
+			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, client.GetIdentity(), "tcp", 1, true)
+			protocolLog.LogErrorf("topic %v put message failed: %v", topic.GetFullName(), err)
 			if clusterErr, ok := err.(*consistence.CommonCoordErr); ok {
 				if !clusterErr.IsLocalErr() {
 					return nil, protocol.NewClientErr(err, FailedOnNotWritable, "")
@@ -1542,11 +1859,13 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 			}
 			return nil, protocol.NewClientErr(err, "E_PUB_FAILED", err.Error())
 		}
-		topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", 1, false)
+		topic.CommitDedupKey(dedupKey)
+		topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, client.GetIdentity(), "tcp", 1, false)
+		p.ctx.nsqd.UpdateProtocolPubStats(nsqd.ProtocolTCP, 1, int64(len(realBody)))
 		cost := time.Now().UnixNano() - startPub
 		topic.GetDetailStats().UpdateTopicMsgStats(int64(len(realBody)), cost/1000)
 
-		if traceID != 0 || atomic.LoadInt32(&topic.EnableTrace) == 1 || nsqd.NsqLogger().Level() >= levellogger.LOG_DETAIL {
+		if traceID != 0 || atomic.LoadInt32(&topic.EnableTrace) == 1 || protocolLog.Level() >= levellogger.LOG_DETAIL {
 			nsqd.GetMsgTracer().TracePubClient(topic.GetTopicName(), topic.GetTopicPart(), traceID, id, offset, client.String())
 		}
 		if needTraceRsp {
@@ -1554,24 +1873,25 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 		}
 		return okBytes, nil
 	} else {
-		topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", 1, true)
+		topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, client.GetIdentity(), "tcp", 1, true)
 		//forward to master of topic
-		nsqd.NsqLogger().LogDebugf("should put to master: %v, from %v",
+		protocolLog.LogDebugf("should put to master: %v, from %v",
 			topic.GetFullName(), client.String())
 		topic.DisableForSlave()
-		return nil, protocol.NewClientErr(err, FailedOnNotLeader, "")
+		return nil, protocol.NewClientErr(err, FailedOnNotLeader, "").WithDetails(topicErrDetails(topic.GetTopicName(), topic.GetTopicPart()))
 	}
 }
 
 func (p *protocolV2) internalMPUBAndTrace(client *nsqd.ClientV2, params [][]byte, traceEnable bool) ([]byte, error) {
 	startPub := time.Now().UnixNano()
+	client.SetLastPubTime(startPub)
 	_, topic, preErr := p.preparePub(client, params, p.ctx.getOpts().MaxBodySize, true)
 	if preErr != nil {
 		return nil, preErr
 	}
 
 	messages, buffers, preErr := readMPUB(client.Reader, client.LenSlice, topic,
-		p.ctx.getOpts().MaxMsgSize, p.ctx.getOpts().MaxBodySize, traceEnable)
+		topic.GetMaxMsgSize(p.ctx.getOpts().MaxMsgSize), p.ctx.getOpts().MaxBodySize, traceEnable)
 
 	defer func() {
 		for _, b := range buffers {
@@ -1585,11 +1905,25 @@ func (p *protocolV2) internalMPUBAndTrace(client *nsqd.ClientV2, params [][]byte
 	topicName := topic.GetTopicName()
 	partition := topic.GetTopicPart()
 	if p.ctx.checkForMasterWrite(topicName, partition) {
+		if p.ctx.isDraining() {
+			return nil, protocol.NewClientErr(nil, "E_DRAINING", "the node is draining").WithDetails(topicErrDetails(topicName, partition))
+		}
+		// the messages in MPUB have no json header, so the dedup key is never
+		// checked for the batch publish even if the dedup is enabled.
+		if retryAfter, ok := p.ctx.checkPubBackpressure(topic); ok {
+			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, client.GetIdentity(), "tcp", int64(len(messages)), true)
+			return nil, pubBackpressureErr(topic, retryAfter)
+		}
+		if err := p.ctx.nsqd.CheckNamespacePubQuota(topicName, len(messages)); err != nil {
+			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, client.GetIdentity(), "tcp", int64(len(messages)), true)
+			return nil, protocol.NewClientErr(err, E_NAMESPACE_QUOTA, err.Error()).WithDetails(
+				map[string]string{"namespace": nsqd.GetTopicNamespace(topicName)})
+		}
 		id, offset, rawSize, err := p.ctx.PutMessages(topic, messages)
 		//p.ctx.setHealth(err)
 		if err != nil {
-			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", int64(len(messages)), true)
-			nsqd.NsqLogger().LogErrorf("topic %v put message failed: %v", topic.GetFullName(), err)
+			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, client.GetIdentity(), "tcp", int64(len(messages)), true)
+			protocolLog.LogErrorf("topic %v put message failed: %v", topic.GetFullName(), err)
 
 			if clusterErr, ok := err.(*consistence.CommonCoordErr); ok {
 				if !clusterErr.IsLocalErr() {
@@ -1598,7 +1932,8 @@ func (p *protocolV2) internalMPUBAndTrace(client *nsqd.ClientV2, params [][]byte
 			}
 			return nil, protocol.NewFatalClientErr(err, "E_MPUB_FAILED", err.Error())
 		}
-		topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", int64(len(messages)), false)
+		topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, client.GetIdentity(), "tcp", int64(len(messages)), false)
+		p.ctx.nsqd.UpdateProtocolPubStats(nsqd.ProtocolTCP, int64(len(messages)), messagesBodySize(messages))
 		cost := time.Now().UnixNano() - startPub
 		topic.GetDetailStats().BatchUpdateTopicLatencyStats(cost/int64(time.Microsecond), int64(len(messages)))
 		if !traceEnable {
@@ -1606,19 +1941,19 @@ func (p *protocolV2) internalMPUBAndTrace(client *nsqd.ClientV2, params [][]byte
 		}
 		return getTracedReponse(id, 0, offset, rawSize)
 	} else {
-		topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", int64(len(messages)), true)
+		topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, client.GetIdentity(), "tcp", int64(len(messages)), true)
 		//forward to master of topic
-		nsqd.NsqLogger().LogDebugf("should put to master: %v, from %v",
+		protocolLog.LogDebugf("should put to master: %v, from %v",
 			topic.GetFullName(), client.String())
 		topic.DisableForSlave()
-		return nil, protocol.NewClientErr(preErr, FailedOnNotLeader, "")
+		return nil, protocol.NewClientErr(preErr, FailedOnNotLeader, "").WithDetails(topicErrDetails(topicName, partition))
 	}
 }
 
 func (p *protocolV2) TOUCH(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
 	if state != stateSubscribed && state != stateClosing {
-		nsqd.NsqLogger().LogWarningf("[%s] command in wrong state: %v", client, state)
+		protocolLog.LogWarningf("[%s] command in wrong state: %v", client, state)
 		return nil, protocol.NewFatalClientErr(nil, E_INVALID, "cannot TOUCH in current state")
 	}
 
@@ -1645,6 +1980,14 @@ func (p *protocolV2) TOUCH(client *nsqd.ClientV2, params [][]byte) ([]byte, erro
 	return nil, nil
 }
 
+func messagesBodySize(msgs []*nsqd.Message) int64 {
+	size := int64(0)
+	for _, m := range msgs {
+		size += int64(len(m.Body))
+	}
+	return size
+}
+
 func readMPUB(r io.Reader, tmp []byte, topic *nsqd.Topic, maxMessageSize int64,
 	maxBodySize int64, traceEnable bool) ([]*nsqd.Message, []*bytes.Buffer, error) {
 	numMessages, err := readLen(r, tmp)
@@ -1731,5 +2074,32 @@ func enforceTLSPolicy(client *nsqd.ClientV2, p *protocolV2, command []byte) erro
 		return protocol.NewFatalClientErr(nil, E_INVALID,
 			fmt.Sprintf("cannot %s in current state (TLS required)", command))
 	}
+	mtlsRequired := false
+	switch p.ctx.getOpts().MTLSRequiredFor {
+	case nsqd.MTLSRequiredForPub:
+		mtlsRequired = isPubCommand(command)
+	case nsqd.MTLSRequiredForSub:
+		mtlsRequired = isSubCommand(command)
+	}
+	if mtlsRequired && !client.IsMutualTLS() {
+		return protocol.NewFatalClientErr(nil, E_INVALID,
+			fmt.Sprintf("cannot %s in current state (mutual TLS required)", command))
+	}
 	return nil
 }
+
+func isPubCommand(command []byte) bool {
+	switch string(command) {
+	case "PUB", "PUB_TRACE", "PUB_EXT", "MPUB", "MPUB_TRACE":
+		return true
+	}
+	return false
+}
+
+func isSubCommand(command []byte) bool {
+	switch string(command) {
+	case "SUB", "SUB_ADVANCED", "SUB_ORDERED":
+		return true
+	}
+	return false
+}
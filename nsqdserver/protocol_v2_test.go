@@ -564,6 +564,254 @@ func TestMaxHeartbeatIntervalInvalid(t *testing.T) {
 	test.Equal(t, string(data), "E_BAD_BODY IDENTIFY heartbeat interval (300001) is invalid")
 }
 
+func TestHeartbeatRTT(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxHeartbeatRTT = 500 * time.Millisecond
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_heartbeat_rtt" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopicIgnPart(topicName).GetChannel("ch")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"heartbeat_interval": 1000,
+	}, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	readValidate(t, conn, frameTypeResponse, string(heartbeatBytes))
+	_, err = nsq.Nop().WriteTo(conn)
+	test.Equal(t, err, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	tstats := nsqd.GetTopicStats(true, topicName)
+	clientStats := tstats[0].Channels[0].Clients[0]
+	test.Equal(t, true, clientStats.HeartbeatRTT > 0)
+	test.Equal(t, true, clientStats.HeartbeatRTT < int64(opts.MaxHeartbeatRTT/time.Microsecond))
+	test.Equal(t, int64(0), clientStats.MissedHeartbeats)
+	test.Equal(t, true, clientStats.LastHeartbeatTime > 0)
+
+	// the connection should be closed if the heartbeat not responded in time
+	readValidate(t, conn, frameTypeResponse, string(heartbeatBytes))
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, err = nsq.ReadResponse(conn)
+	test.NotNil(t, err)
+	test.Equal(t, true, time.Since(start) < time.Second*2)
+}
+
+func TestHeartbeatRTTAfterWritten(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	c := nsqdNs.NewClientV2(0, nil, opts, nil)
+	sent := time.Now()
+	test.Equal(t, false, c.HeartbeatSent(sent))
+	// the time waiting the buffered messages flushed is not counted
+	written := sent.Add(time.Second)
+	c.HeartbeatWritten(sent, written)
+	c.HeartbeatResponded(written.Add(time.Millisecond))
+	test.Equal(t, time.Millisecond, c.GetHeartbeatRTT())
+
+	// the response arrived before the heartbeat marked as written
+	sent = written.Add(time.Second)
+	test.Equal(t, false, c.HeartbeatSent(sent))
+	c.HeartbeatResponded(sent.Add(time.Millisecond * 2))
+	c.HeartbeatWritten(sent, sent.Add(time.Millisecond))
+	test.Equal(t, time.Millisecond*2, c.GetHeartbeatRTT())
+	test.Equal(t, false, c.IsHeartbeatStalled(time.Second, sent.Add(time.Second*3)))
+}
+
+func TestConnIdleTimeoutAndMaxLifetime(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.ProducerIdleTimeout = 2 * time.Second
+	opts.MaxConnLifetime = 5 * time.Second
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_conn_deadline" + strconv.Itoa(int(time.Now().Unix()))
+	ch := nsqd.GetTopicIgnPart(topicName).GetChannel("ch")
+
+	start := time.Now()
+	producer, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer producer.Close()
+	identify(t, producer, nil, frameTypeResponse)
+	consumer, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer consumer.Close()
+	identify(t, consumer, nil, frameTypeResponse)
+	sub(t, consumer, topicName, "ch")
+
+	time.Sleep(time.Second)
+	_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(producer)
+	test.Equal(t, err, nil)
+	readValidate(t, producer, frameTypeResponse, "OK")
+	// the idle time is from the last publish
+	producer.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = nsq.ReadResponse(producer)
+	test.NotNil(t, err)
+	test.Equal(t, true, time.Since(start) >= time.Second*3)
+
+	// the consumer is not idle, but closed for the max lifetime
+	consumer.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for {
+		_, err = nsq.ReadResponse(consumer)
+		if err != nil {
+			break
+		}
+	}
+	test.Equal(t, true, time.Since(start) >= opts.MaxConnLifetime)
+	time.Sleep(100 * time.Millisecond)
+
+	test.Equal(t, int64(1), ch.GetDisconnectReasons()[nsqdNs.DisconnectMaxLifetime])
+	for _, s := range nsqd.GetProtocolStats() {
+		if s.Protocol == nsqdNs.ProtocolTCP {
+			test.Equal(t, int64(1), s.IdleClosed)
+			test.Equal(t, int64(1), s.LifetimeClosed)
+		}
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.MaxConnsPerIP = 2
+	opts.MaxTopicPublishers = 1
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_conn_limits" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+
+	conn1, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn1.Close()
+	identify(t, conn1, nil, frameTypeResponse)
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn2.Close()
+	identify(t, conn2, nil, frameTypeResponse)
+
+	conn3, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn3.Close()
+	readValidate(t, conn3, frameTypeError, "E_TOO_MANY_CONNS "+nsqdNs.ErrTooManyConnsPerIP.Error())
+
+	_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(conn1)
+	test.Equal(t, err, nil)
+	readValidate(t, conn1, frameTypeResponse, "OK")
+	test.Equal(t, 1, nsqd.GetTopicPublishers(topic.GetFullName()))
+	_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(conn2)
+	test.Equal(t, err, nil)
+	readValidate(t, conn2, frameTypeError, "E_TOO_MANY_PUBLISHERS "+nsqdNs.ErrTooManyTopicPublishers.Error())
+
+	// the publisher and the ip connection are released after closed
+	conn1.Close()
+	time.Sleep(100 * time.Millisecond)
+	test.Equal(t, 0, nsqd.GetTopicPublishers(topic.GetFullName()))
+	conn4, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn4.Close()
+	identify(t, conn4, nil, frameTypeResponse)
+	_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(conn4)
+	test.Equal(t, err, nil)
+	readValidate(t, conn4, frameTypeResponse, "OK")
+
+	// the connection is limited before sending the protocol magic
+	conn5, err := net.DialTimeout("tcp", tcpAddr.String(), time.Second)
+	test.Equal(t, err, nil)
+	defer conn5.Close()
+	readValidate(t, conn5, frameTypeError, "E_TOO_MANY_CONNS "+nsqdNs.ErrTooManyConnsPerIP.Error())
+
+	stats := nsqd.GetConnLimitStats()
+	test.Equal(t, int64(2), stats.IPRejected)
+	test.Equal(t, int64(1), stats.PublisherRejected)
+	test.Equal(t, int64(1), stats.MaxIPConns)
+}
+
+func TestClientDisconnectReason(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_disconnect_reason" + strconv.Itoa(int(time.Now().Unix()))
+	ch := nsqd.GetTopicIgnPart(topicName).GetChannel("ch")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = conn.Write([]byte("CLS\n"))
+	test.Equal(t, err, nil)
+	readValidate(t, conn, frameTypeResponse, "CLOSE_WAIT")
+	conn.Close()
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	conn.Close()
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	// identify again is not allowed
+	_, err = conn.Write([]byte("IDENTIFY\n"))
+	test.Equal(t, err, nil)
+	readValidate(t, conn, frameTypeError, "E_INVALID cannot IDENTIFY in current state")
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	reasons := ch.GetDisconnectReasons()
+	test.Equal(t, int64(1), reasons[nsqdNs.DisconnectClientCLS])
+	test.Equal(t, int64(1), reasons[nsqdNs.DisconnectClientClose])
+	test.Equal(t, int64(1), reasons[nsqdNs.DisconnectProtocolError])
+
+	tstats := nsqd.GetTopicStats(true, topicName)
+	test.Equal(t, reasons, tstats[0].Channels[0].DisconnectReasons)
+
+	// the reasons are also in the connection events
+	connected := 0
+	eventReasons := make(map[string]int64)
+	for _, e := range nsqdServer.ctx.connEventMgr.getStatus().Events {
+		if e.Type == ConnEventConnected {
+			connected++
+			continue
+		}
+		test.Equal(t, topicName, e.Topic)
+		test.Equal(t, "ch", e.Channel)
+		eventReasons[e.Reason]++
+	}
+	test.Equal(t, 3, connected)
+	test.Equal(t, reasons, eventReasons)
+
+	// the clients are closed by server while the channel is closing
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	time.Sleep(100 * time.Millisecond)
+	var client nsqdNs.Consumer
+	for _, c := range ch.GetClients() {
+		client = c
+	}
+	test.NotNil(t, client)
+	ch.Close()
+	time.Sleep(100 * time.Millisecond)
+	test.Equal(t, nsqdNs.DisconnectServerExit, client.(*nsqdNs.ClientV2).GetDisconnectReason())
+}
+
 func TestSkipping(t *testing.T) {
 	topicName := "test_skip_v2" + strconv.Itoa(int(time.Now().Unix()))
 	opts := nsqdNs.NewOptions()
@@ -911,6 +1159,39 @@ func TestConsumeJsonHeaderMessageTag(t *testing.T) {
 	time.Sleep(1 * time.Second)
 }
 
+func TestPubDedupKeyWithJsonHeaderIgnored(t *testing.T) {
+	topicName := "test_dedup_json_header_ignore" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.AllowExtCompatible = true
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+	topic := nsqd.GetTopicIgnPart(topicName)
+	topic.SetDynamicInfo(nsqdNs.TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, Ext: false}, nil)
+	err := topic.SetDedupConf(&nsqdNs.TopicDedupConf{Mode: nsqdNs.DedupModeReject, Window: time.Hour})
+	test.Nil(t, err)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	identify(t, conn, nil, frameTypeResponse)
+	// the dedup key can not be replicated without the json header, so it is not
+	// deduplicated on the leader either
+	for i := 0; i < 2; i++ {
+		cmd, _ := nsq.PublishWithJsonExt(topicName, "0", make([]byte, 5), []byte(`{"##dedup_key":"order-1"}`))
+		cmd.WriteTo(conn)
+		resp, _ := nsq.ReadResponse(conn)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		test.Equal(t, frameTypeResponse, frameType)
+		test.Equal(t, []byte("OK"), data[:2])
+	}
+	test.Equal(t, uint64(2), topic.TotalMessageCnt())
+	test.Equal(t, 0, topic.GetDedupIndex().Len())
+	test.Equal(t, int64(0), topic.GetDedupStats().Hits)
+	conn.Close()
+}
+
 func TestPubJsonHeaderIgnored(t *testing.T) {
 	topicName := "test_json_header_ignore" + strconv.Itoa(int(time.Now().Unix()))
 
@@ -2266,6 +2547,90 @@ func TestEmptyCommand(t *testing.T) {
 	// if we didn't panic here we're good, see issue #120
 }
 
+func TestReplyChannel(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_reply_channel" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	identify(t, conn, nil, frameTypeResponse)
+
+	// the reply channel can not be subscribed before created
+	_, err = nsq.Subscribe(topicName, "_reply.1.1#ephemeral").WriteTo(conn)
+	test.Equal(t, err, nil)
+	readValidate(t, conn, frameTypeError, "E_CHANNEL_NOT_EXIST reply channel _reply.1.1#ephemeral should be created by REPLY_CHANNEL")
+	conn.Close()
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	identify(t, conn, nil, frameTypeResponse)
+	cmd := &nsq.Command{Name: []byte("REPLY_CHANNEL"), Params: [][]byte{[]byte(topicName), []byte("0")}}
+	_, err = cmd.WriteTo(conn)
+	test.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	test.Equal(t, err, nil)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	test.Equal(t, frameType, frameTypeResponse)
+	replyName := string(data)
+	test.Equal(t, protocol.IsReplyChannel(replyName), true)
+	_, err = topic.GetExistingChannel(replyName)
+	test.Equal(t, err, nil)
+	sub(t, conn, topicName, replyName)
+
+	// the reply channel can not be subscribed by the other connection
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	identify(t, conn2, nil, frameTypeResponse)
+	_, err = nsq.Subscribe(topicName, replyName).WriteTo(conn2)
+	test.Equal(t, err, nil)
+	readValidate(t, conn2, frameTypeError, fmt.Sprintf("E_UNAUTHORIZED reply channel %v is not created by the connection", replyName))
+	conn2.Close()
+
+	// the reply channel should be removed after the connection closed
+	conn.Close()
+	time.Sleep(time.Second)
+	_, err = topic.GetExistingChannel(replyName)
+	test.NotNil(t, err)
+
+	// the reply channel should be removed after expired
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	cmd = &nsq.Command{Name: []byte("REPLY_CHANNEL"), Params: [][]byte{[]byte(topicName), []byte("0"), []byte("100")}}
+	_, err = cmd.WriteTo(conn)
+	test.Equal(t, err, nil)
+	resp, err = nsq.ReadResponse(conn)
+	test.Equal(t, err, nil)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	test.Equal(t, frameType, frameTypeResponse)
+	replyName = string(data)
+	_, err = topic.GetExistingChannel(replyName)
+	test.Equal(t, err, nil)
+	time.Sleep(time.Second)
+	_, err = topic.GetExistingChannel(replyName)
+	test.NotNil(t, err)
+
+	// the expired reply channels should not be counted in the limit
+	for i := 0; i < maxReplyChannelsPerClient+1; i++ {
+		_, err = cmd.WriteTo(conn)
+		test.Equal(t, err, nil)
+		resp, err = nsq.ReadResponse(conn)
+		test.Equal(t, err, nil)
+		frameType, data, _ = nsq.UnpackResponse(resp)
+		test.Equal(t, frameType, frameTypeResponse)
+		if i == maxReplyChannelsPerClient-1 {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
 func TestTcpPUBTRACE(t *testing.T) {
 	opts := nsqdNs.NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -4159,6 +4524,102 @@ func TestOutputBufferingValidity(t *testing.T) {
 	test.Equal(t, string(data), "E_BAD_BODY IDENTIFY output buffer timeout (1001) is invalid")
 }
 
+func TestClientTCPOptions(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.LogLevel = 1
+	opts.TCPKeepAlivePeriod = 30 * time.Second
+	opts.MaxTCPBufferSize = 1024 * 1024
+	tcpAddr, _, _, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+
+	type tcpResp struct {
+		TCPNoDelay         bool  `json:"tcp_no_delay"`
+		TCPSendBufferSize  int   `json:"tcp_send_buffer_size"`
+		TCPRecvBufferSize  int   `json:"tcp_recv_buffer_size"`
+		TCPKeepAlivePeriod int64 `json:"tcp_keepalive_period"`
+	}
+	data := identify(t, conn, nil, frameTypeResponse)
+	var r tcpResp
+	err = json.Unmarshal(data, &r)
+	test.Equal(t, err, nil)
+	test.Equal(t, r.TCPNoDelay, true)
+	test.Equal(t, r.TCPSendBufferSize, 0)
+	test.Equal(t, r.TCPKeepAlivePeriod, int64(30000))
+
+	data = identify(t, conn, map[string]interface{}{
+		"tcp_no_delay":           false,
+		"tcp_send_buffer_size":   256 * 1024,
+		"tcp_recv_buffer_size":   128 * 1024,
+		"tcp_keepalive_interval": -1,
+	}, frameTypeResponse)
+	r = tcpResp{}
+	err = json.Unmarshal(data, &r)
+	test.Equal(t, err, nil)
+	test.Equal(t, r.TCPNoDelay, false)
+	test.Equal(t, r.TCPSendBufferSize, 256*1024)
+	test.Equal(t, r.TCPRecvBufferSize, 128*1024)
+	test.Equal(t, r.TCPKeepAlivePeriod, int64(-1))
+
+	data = identify(t, conn, map[string]interface{}{
+		"tcp_send_buffer_size": 1024*1024 + 1,
+	}, frameTypeError)
+	test.Equal(t, string(data), fmt.Sprintf("E_BAD_BODY IDENTIFY tcp send buffer size (%d) is invalid", 1024*1024+1))
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+
+	data = identify(t, conn, map[string]interface{}{
+		"tcp_keepalive_interval": 10,
+	}, frameTypeError)
+	test.Equal(t, string(data), "E_BAD_BODY IDENTIFY tcp keepalive interval (10) is invalid")
+}
+
+func TestClientTCPOptionsPerListener(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.LogLevel = 1
+	opts.TCPListeners = []string{"127.0.0.1:0,tcp_no_delay=false,tcp_keepalive_period=20s"}
+	tcpAddr, _, _, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	type tcpResp struct {
+		TCPNoDelay         bool  `json:"tcp_no_delay"`
+		TCPKeepAlivePeriod int64 `json:"tcp_keepalive_period"`
+	}
+	// the keepalive is left as the system default for 0 period
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	data := identify(t, conn, nil, frameTypeResponse)
+	var r tcpResp
+	err = json.Unmarshal(data, &r)
+	test.Equal(t, err, nil)
+	test.Equal(t, r.TCPNoDelay, true)
+	test.Equal(t, r.TCPKeepAlivePeriod, int64(0))
+
+	test.Equal(t, len(nsqdServer.extraTCPLns), 1)
+	conn2, err := mustConnectNSQD(nsqdServer.extraTCPLns[0].Addr().(*net.TCPAddr))
+	test.Equal(t, err, nil)
+	defer conn2.Close()
+	data = identify(t, conn2, nil, frameTypeResponse)
+	r = tcpResp{}
+	err = json.Unmarshal(data, &r)
+	test.Equal(t, err, nil)
+	test.Equal(t, r.TCPNoDelay, false)
+	test.Equal(t, r.TCPKeepAlivePeriod, int64(20000))
+
+	_, err = nsqdNs.ParseTCPListener("127.0.0.1:0,tcp_unknown=1", opts)
+	test.NotNil(t, err)
+}
+
 func TestTLS(t *testing.T) {
 	opts := nsqdNs.NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -4402,6 +4863,72 @@ func TestTLSAuthRequireVerify(t *testing.T) {
 	test.Equal(t, data, []byte("OK"))
 }
 
+func TestMTLSRequiredForPub(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.LogLevel = 1
+	opts.TLSCert = "./test/certs/server.pem"
+	opts.TLSKey = "./test/certs/server.key"
+	opts.TLSRootCAFile = "./test/certs/ca.pem"
+	opts.TLSIdentityMode = nsqdNs.TLSIdentityCN
+	opts.MTLSRequiredFor = nsqdNs.MTLSRequiredForPub
+
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_mtls_pub" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopicIgnPart(topicName).GetChannel("ch")
+
+	// plaintext sub is allowed
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	// plaintext pub is not allowed
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	cmd := nsq.Publish(topicName, make([]byte, 5))
+	cmd.WriteTo(conn)
+	resp, _ := nsq.ReadResponse(conn)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	t.Logf("frameType: %d, data: %s", frameType, data)
+	test.Equal(t, frameType, frameTypeError)
+
+	// pub with client cert
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{
+		"tls_v1": true,
+	}, frameTypeResponse)
+	cert, err := tls.LoadX509KeyPair("./test/certs/client.pem", "./test/certs/client.key")
+	test.Equal(t, err, nil)
+	tlsConfig := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	err = tlsConn.Handshake()
+	test.Equal(t, err, nil)
+	readValidate(t, tlsConn, frameTypeResponse, "OK")
+
+	cmd = nsq.Publish(topicName, make([]byte, 5))
+	cmd.WriteTo(tlsConn)
+	readValidate(t, tlsConn, frameTypeResponse, "OK")
+
+	sub(t, tlsConn, topicName, "ch2")
+	ch, err := nsqd.GetTopicIgnPart(topicName).GetExistingChannel("ch2")
+	test.Nil(t, err)
+	for _, c := range ch.GetClients() {
+		test.Equal(t, "client.com", c.Stats().AuthIdentity)
+	}
+}
+
 func TestDeflate(t *testing.T) {
 	opts := nsqdNs.NewOptions()
 	opts.Logger = newTestLogger(t)
@@ -5563,8 +6090,8 @@ func BenchmarkProtocolV2Exec(b *testing.B) {
 	_, _, nsqd, nsqdServer := mustStartNSQD(opts)
 	defer os.RemoveAll(opts.DataPath)
 	defer nsqdServer.Exit()
-	ctx := &context{0, nsqd, nil, nil, nil, nil, ""}
-	p := &protocolV2{ctx}
+	ctx := &context{nsqd: nsqd}
+	p := &protocolV2{ctx: ctx}
 	c := nsqdNs.NewClientV2(0, nil, ctx.getOpts(), nil)
 	params := [][]byte{[]byte("NOP")}
 	b.StartTimer()
@@ -0,0 +1,394 @@
+package nsqdserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	simpleJson "github.com/bitly/go-simplejson"
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	redriveStateRunning = "running"
+	redriveStateDone    = "done"
+	redriveStateStopped = "stopped"
+	redriveStateFailed  = "failed"
+
+	maxRedriveJobsKept = 100
+	// the ticker interval should be larger than 0
+	maxRedriveRate = 100000
+)
+
+var errRedriveStopped = errors.New("redrive job stopped")
+
+// redriveParam describes how to re-drive the messages from the dead-letter topic
+// to the original channel.
+type redriveParam struct {
+	DLQTopic     string `json:"dlq_topic"`
+	DLQPartition int    `json:"dlq_partition"`
+	DLQChannel   string `json:"dlq_channel"`
+	Topic        string `json:"topic"`
+	Partition    int    `json:"partition"`
+	Channel      string `json:"channel"`
+	// max messages re-driven per second
+	Rate int `json:"rate"`
+	// the time range of the messages in the dead-letter topic in unix nanoseconds
+	StartTs int64  `json:"start_ts"`
+	EndTs   int64  `json:"end_ts"`
+	Reason  string `json:"reason"`
+}
+
+// the progress of the same re-drive is kept, so the messages will not be re-driven
+// twice while running again.
+func (p redriveParam) checkpointKey() string {
+	return fmt.Sprintf("%s-%d:%s:%s-%d:%s:%d:%d:%s", p.DLQTopic, p.DLQPartition, p.DLQChannel,
+		p.Topic, p.Partition, p.Channel, p.StartTs, p.EndTs, p.Reason)
+}
+
+func (p redriveParam) hasFilter() bool {
+	return p.StartTs > 0 || p.EndTs > 0 || p.Reason != ""
+}
+
+type RedriveStatus struct {
+	ID        int64        `json:"id"`
+	Param     redriveParam `json:"param"`
+	State     string       `json:"state"`
+	Error     string       `json:"error,omitempty"`
+	Scanned   int64        `json:"scanned"`
+	Redriven  int64        `json:"redriven"`
+	Skipped   int64        `json:"skipped"`
+	StartTime int64        `json:"start_time"`
+	EndTime   int64        `json:"end_time,omitempty"`
+}
+
+type redriveJob struct {
+	sync.Mutex
+	id        int64
+	param     redriveParam
+	state     string
+	err       error
+	scanned   int64
+	redriven  int64
+	skipped   int64
+	startTime time.Time
+	endTime   time.Time
+	stopChan  chan struct{}
+	stopOnce  sync.Once
+	// the next offset and count in the dead-letter topic after the processed
+	nextOffset nsqd.BackendOffset
+	nextCnt    int64
+}
+
+func (j *redriveJob) stop() {
+	j.stopOnce.Do(func() {
+		close(j.stopChan)
+	})
+}
+
+func (j *redriveJob) finish(err error) {
+	j.Lock()
+	defer j.Unlock()
+	j.endTime = time.Now()
+	j.err = err
+	if err == nil {
+		j.state = redriveStateDone
+	} else if err == errRedriveStopped {
+		j.state = redriveStateStopped
+	} else {
+		j.state = redriveStateFailed
+	}
+}
+
+func (j *redriveJob) Status() RedriveStatus {
+	j.Lock()
+	defer j.Unlock()
+	s := RedriveStatus{
+		ID:        j.id,
+		Param:     j.param,
+		State:     j.state,
+		Scanned:   atomic.LoadInt64(&j.scanned),
+		Redriven:  atomic.LoadInt64(&j.redriven),
+		Skipped:   atomic.LoadInt64(&j.skipped),
+		StartTime: j.startTime.Unix(),
+	}
+	if j.err != nil {
+		s.Error = j.err.Error()
+	}
+	if !j.endTime.IsZero() {
+		s.EndTime = j.endTime.Unix()
+	}
+	return s
+}
+
+type redriveManager struct {
+	sync.Mutex
+	ctx         *context
+	nextID      int64
+	jobs        map[int64]*redriveJob
+	checkpoints map[string]redriveCheckpoint
+}
+
+type redriveCheckpoint struct {
+	offset nsqd.BackendOffset
+	cnt    int64
+}
+
+func newRedriveManager(ctx *context) *redriveManager {
+	return &redriveManager{
+		ctx:         ctx,
+		jobs:        make(map[int64]*redriveJob),
+		checkpoints: make(map[string]redriveCheckpoint),
+	}
+}
+
+func (m *redriveManager) start(dlqTopic *nsqd.Topic, topic *nsqd.Topic, param redriveParam) (*redriveJob, error) {
+	if topic.IsOrdered() {
+		return nil, errors.New("ordered topic can not be re-driven")
+	}
+	if dlqTopic.GetFullName() == topic.GetFullName() {
+		return nil, errors.New("dead-letter topic should not be the same as the original topic")
+	}
+	if _, err := topic.GetExistingChannel(param.Channel); err != nil {
+		return nil, err
+	}
+	if param.Rate <= 0 || param.Rate > maxRedriveRate {
+		return nil, fmt.Errorf("re-drive rate should be in (0, %v]", maxRedriveRate)
+	}
+	m.Lock()
+	for _, j := range m.jobs {
+		st := j.Status()
+		if st.State == redriveStateRunning && st.Param.Topic == param.Topic &&
+			st.Param.Partition == param.Partition && st.Param.Channel == param.Channel {
+			m.Unlock()
+			return nil, errors.New("a re-drive job is already running for the channel")
+		}
+	}
+	m.nextID++
+	job := &redriveJob{
+		id:        m.nextID,
+		param:     param,
+		state:     redriveStateRunning,
+		startTime: time.Now(),
+		stopChan:  make(chan struct{}),
+	}
+	m.jobs[job.id] = job
+	m.cleanOldJobsNoLock()
+	m.Unlock()
+
+	nsqd.NsqLogger().Logf("start re-drive job %v: %v", job.id, param)
+	go func() {
+		err := m.run(job, dlqTopic, topic)
+		m.saveProgress(job, dlqTopic)
+		job.finish(err)
+		st := job.Status()
+		nsqd.NsqLogger().Logf("re-drive job %v finished: %v", job.id, st)
+	}()
+	return job, nil
+}
+
+func (m *redriveManager) cleanOldJobsNoLock() {
+	if len(m.jobs) <= maxRedriveJobsKept {
+		return
+	}
+	for id, j := range m.jobs {
+		if j.Status().State == redriveStateRunning {
+			continue
+		}
+		delete(m.jobs, id)
+		if len(m.jobs) <= maxRedriveJobsKept {
+			return
+		}
+	}
+}
+
+func (m *redriveManager) stop(id int64) error {
+	m.Lock()
+	job, ok := m.jobs[id]
+	m.Unlock()
+	if !ok {
+		return errors.New("re-drive job not found")
+	}
+	job.stop()
+	return nil
+}
+
+func (m *redriveManager) getStatus(id int64) (RedriveStatus, error) {
+	m.Lock()
+	job, ok := m.jobs[id]
+	m.Unlock()
+	if !ok {
+		return RedriveStatus{}, errors.New("re-drive job not found")
+	}
+	return job.Status(), nil
+}
+
+func (m *redriveManager) getAllStatus() []RedriveStatus {
+	m.Lock()
+	defer m.Unlock()
+	ret := make([]RedriveStatus, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		ret = append(ret, j.Status())
+	}
+	return ret
+}
+
+func (m *redriveManager) stopAll() {
+	m.Lock()
+	for _, j := range m.jobs {
+		j.stop()
+	}
+	m.Unlock()
+}
+
+func isRedriveReasonMatch(msg *nsqd.Message, reason string) bool {
+	if reason == "" {
+		return true
+	}
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return false
+	}
+	jsonExt, err := simpleJson.NewJson(msg.ExtBytes)
+	if err != nil {
+		return false
+	}
+	r, err := jsonExt.Get(ext.DLQ_REASON_KEY).String()
+	if err != nil {
+		return false
+	}
+	return r == reason
+}
+
+// saveProgress marks the messages processed by the job, the dead-letter channel
+// is moved to the processed if all the messages are re-driven without filter.
+func (m *redriveManager) saveProgress(job *redriveJob, dlqTopic *nsqd.Topic) {
+	job.Lock()
+	next := job.nextOffset
+	nextCnt := job.nextCnt
+	job.Unlock()
+	if next == 0 {
+		return
+	}
+	m.Lock()
+	key := job.param.checkpointKey()
+	if next > m.checkpoints[key].offset {
+		m.checkpoints[key] = redriveCheckpoint{offset: next, cnt: nextCnt}
+	}
+	m.Unlock()
+	if job.param.DLQChannel == "" || job.param.hasFilter() {
+		return
+	}
+	dlqCh, err := dlqTopic.GetExistingChannel(job.param.DLQChannel)
+	if err != nil || dlqCh.GetConfirmed().Offset() >= next {
+		return
+	}
+	if m.ctx.nsqdCoord == nil {
+		err = dlqCh.SetConsumeOffset(next, nextCnt, true)
+	} else {
+		err = m.ctx.nsqdCoord.SetChannelConsumeOffsetToCluster(dlqCh, int64(next), nextCnt, true)
+	}
+	if err != nil {
+		nsqd.NsqLogger().LogWarningf("re-drive job %v failed to move the dead-letter channel to %v: %v", job.id, next, err)
+	}
+}
+
+func (m *redriveManager) run(job *redriveJob, dlqTopic *nsqd.Topic, topic *nsqd.Topic) error {
+	param := job.param
+	snap := dlqTopic.GetDiskQueueSnapshot()
+	defer snap.Close()
+	start := snap.GetQueueReadStart()
+	if param.DLQChannel != "" {
+		// only the messages not consumed by the dead-letter channel will be re-driven
+		dlqCh, err := dlqTopic.GetExistingChannel(param.DLQChannel)
+		if err != nil {
+			return err
+		}
+		start = dlqCh.GetConfirmed()
+	}
+	job.Lock()
+	job.nextCnt = start.TotalMsgCnt()
+	job.Unlock()
+	seekTo := start.Offset()
+	m.Lock()
+	if checkpoint, ok := m.checkpoints[param.checkpointKey()]; ok && checkpoint.offset > seekTo {
+		seekTo = checkpoint.offset
+		job.Lock()
+		job.nextCnt = checkpoint.cnt
+		job.Unlock()
+	}
+	m.Unlock()
+	err := snap.SeekTo(seekTo)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(param.Rate))
+	defer ticker.Stop()
+	for {
+		ret := snap.ReadOne()
+		if ret.Err != nil {
+			if ret.Err == io.EOF {
+				return nil
+			}
+			return ret.Err
+		}
+		atomic.AddInt64(&job.scanned, 1)
+		msg, err := nsqd.DecodeMessage(ret.Data, dlqTopic.IsExt())
+		if err != nil {
+			nsqd.NsqLogger().LogErrorf("re-drive job %v failed to decode message at %v: %v", job.id, ret.Offset, err)
+			atomic.AddInt64(&job.skipped, 1)
+			job.setProcessed(ret)
+			continue
+		}
+		if (param.StartTs > 0 && msg.Timestamp < param.StartTs) ||
+			(param.EndTs > 0 && msg.Timestamp > param.EndTs) ||
+			!isRedriveReasonMatch(msg, param.Reason) {
+			atomic.AddInt64(&job.skipped, 1)
+			job.setProcessed(ret)
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-job.stopChan:
+			return errRedriveStopped
+		}
+		err = m.redriveMessage(topic, param.Channel, msg)
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&job.redriven, 1)
+		job.setProcessed(ret)
+	}
+}
+
+func (j *redriveJob) setProcessed(ret nsqd.ReadResult) {
+	j.Lock()
+	j.nextOffset = ret.Offset + ret.MovedSize
+	j.nextCnt++
+	j.Unlock()
+}
+
+// redriveMessage put the message to the delayed queue of the original channel, so the message
+// will be delivered to the original channel only.
+func (m *redriveManager) redriveMessage(topic *nsqd.Topic, channelName string, msg *nsqd.Message) error {
+	if !m.ctx.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return errors.New("not leader for the original topic")
+	}
+	var newMsg *nsqd.Message
+	if topic.IsExt() {
+		newMsg = nsqd.NewMessageWithExt(0, msg.Body, msg.ExtVer, msg.ExtBytes)
+	} else {
+		newMsg = nsqd.NewMessage(0, msg.Body)
+	}
+	newMsg.TraceID = msg.TraceID
+	newMsg.DelayedType = nsqd.ChannelDelayed
+	newMsg.DelayedTs = time.Now().UnixNano()
+	newMsg.DelayedOrigID = topic.NextMsgID()
+	newMsg.DelayedChannel = channelName
+	_, _, _, _, err := m.ctx.PutMessageObj(topic, newMsg)
+	return err
+}
@@ -0,0 +1,274 @@
+package nsqdserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/youzan/go-nsq"
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	selfTestChannel        = "selftest"
+	defaultSelfTestTimeout = 5 * time.Second
+	maxSelfTestTimeout     = time.Minute
+)
+
+var (
+	errSelfTestTopic = errors.New("failed to create the self test topic")
+	errSelfTestAuth  = errors.New("auth is enabled but no self test auth secret")
+	closeWaitBytes   = []byte("CLOSE_WAIT")
+)
+
+// SelfTestResult is the result of the loopback publish and consume, the latency
+// is zero if the step is not finished.
+type SelfTestResult struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	// the time from the publish sent to the response received
+	PubLatency   string `json:"pub_latency"`
+	PubLatencyUs int64  `json:"pub_latency_us"`
+	// the time from the publish sent to the message received by the consumer
+	E2ELatency   string `json:"e2e_latency"`
+	E2ELatencyUs int64  `json:"e2e_latency_us"`
+	// the total time including the connect, identify and subscribe
+	Total   string `json:"total"`
+	TotalUs int64  `json:"total_us"`
+}
+
+// selfTester publishes a message to the hidden topic and consumes it through the tcp
+// protocol of this node like the client library, so it verifies the node is actually
+// functional rather than just listening.
+type selfTester struct {
+	sync.Mutex
+	ctx *context
+	seq int64
+}
+
+func newSelfTester(ctx *context) *selfTester {
+	return &selfTester{
+		ctx: ctx,
+	}
+}
+
+// run tests once at a time, so the concurrent tests will not consume the message of
+// each other.
+func (st *selfTester) run(timeout time.Duration) *SelfTestResult {
+	st.Lock()
+	defer st.Unlock()
+	st.seq++
+	start := time.Now()
+	r := &SelfTestResult{}
+	err := st.loopback(start, timeout, r)
+	total := time.Since(start)
+	r.Total = total.String()
+	r.TotalUs = int64(total / time.Microsecond)
+	if err != nil {
+		r.Error = err.Error()
+		nsqd.NsqLogger().LogWarningf("self test failed after %v: %v", total, err)
+		return r
+	}
+	r.Success = true
+	return r
+}
+
+func (st *selfTester) dial(deadline time.Time) (net.Conn, error) {
+	addr := *st.ctx.realTCPAddr()
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+	conn, err := net.DialTimeout("tcp", addr.String(), deadline.Sub(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+	_, err = conn.Write(nsq.MagicV2)
+	if err == nil {
+		conn, err = st.identify(conn)
+	}
+	if err == nil {
+		err = st.auth(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// needTLS returns true if the tcp commands are rejected without tls
+func (st *selfTester) needTLS() bool {
+	opts := st.ctx.getOpts()
+	return st.ctx.GetTlsConfig() != nil &&
+		(opts.TLSRequired != TLSNotRequired || opts.MTLSRequiredFor != "")
+}
+
+// identify returns the connection upgraded to tls if needed
+func (st *selfTester) identify(conn net.Conn) (net.Conn, error) {
+	hostname, _ := os.Hostname()
+	ci := make(map[string]interface{})
+	ci["client_id"] = "nsqd_selftest"
+	ci["hostname"] = hostname
+	ci["user_agent"] = "nsqd_selftest"
+	useTLS := st.needTLS()
+	if useTLS {
+		ci["feature_negotiation"] = true
+		ci["tls_v1"] = true
+	}
+	cmd, err := nsq.Identify(ci)
+	if err != nil {
+		return conn, err
+	}
+	if !useTLS {
+		return conn, st.command(conn, cmd, "IDENTIFY", okBytes)
+	}
+	// the negotiated features are responded before the tls handshake
+	if err = st.command(conn, cmd, "IDENTIFY", nil); err != nil {
+		return conn, err
+	}
+	// the node connects to itself, so the server certificate is not verified and the
+	// node certificate is used as the client certificate for the mutual tls
+	tlsConn := tls.Client(conn, &tls.Config{
+		Certificates:       st.ctx.GetTlsConfig().Certificates,
+		InsecureSkipVerify: true,
+	})
+	if err = tlsConn.Handshake(); err != nil {
+		return conn, fmt.Errorf("tls handshake failed: %v", err)
+	}
+	frameType, data, err := readSelfTestFrame(tlsConn)
+	if err != nil {
+		return tlsConn, fmt.Errorf("IDENTIFY failed: %v", err)
+	}
+	if frameType != frameTypeResponse || string(data) != string(okBytes) {
+		return tlsConn, fmt.Errorf("IDENTIFY failed: %s", data)
+	}
+	return tlsConn, nil
+}
+
+// auth sends the configured secret if the auth is enabled on this node, the auth
+// server should allow the secret to publish and subscribe the self test topic.
+func (st *selfTester) auth(conn net.Conn) error {
+	if !st.ctx.isAuthEnabled() {
+		return nil
+	}
+	secret := st.ctx.getOpts().SelfTestAuthSecret
+	if secret == "" {
+		return errSelfTestAuth
+	}
+	cmd, err := nsq.Auth(secret)
+	if err != nil {
+		return err
+	}
+	return st.command(conn, cmd, "AUTH", nil)
+}
+
+// command sends the command and waits for the expected response, any response is
+// accepted if the expected is nil
+func (st *selfTester) command(conn net.Conn, cmd *nsq.Command, name string, expected []byte) error {
+	_, err := cmd.WriteTo(conn)
+	if err != nil {
+		return err
+	}
+	for {
+		frameType, data, err := readSelfTestFrame(conn)
+		if err != nil {
+			return fmt.Errorf("%v failed: %v", name, err)
+		}
+		if frameType == frameTypeResponse && string(data) == string(heartbeatBytes) {
+			continue
+		}
+		if frameType != frameTypeResponse || (expected != nil && string(data) != string(expected)) {
+			return fmt.Errorf("%v failed: %s", name, data)
+		}
+		return nil
+	}
+}
+
+func readSelfTestFrame(conn net.Conn) (int32, []byte, error) {
+	resp, err := nsq.ReadResponse(conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	frameType, data, err := nsq.UnpackResponse(resp)
+	if err != nil {
+		return 0, nil, err
+	}
+	if frameType == frameTypeError {
+		return frameType, data, fmt.Errorf("%s", data)
+	}
+	return frameType, data, nil
+}
+
+func (st *selfTester) loopback(start time.Time, timeout time.Duration, r *SelfTestResult) error {
+	topic := st.ctx.nsqd.GetTopic(nsqd.SelfTestTopic, 0)
+	if topic == nil {
+		return errSelfTestTopic
+	}
+	topic.GetChannel(selfTestChannel)
+	deadline := start.Add(timeout)
+
+	consumer, err := st.dial(deadline)
+	if err != nil {
+		return fmt.Errorf("consumer connect failed: %v", err)
+	}
+	defer consumer.Close()
+	sub := &nsq.Command{Name: []byte("SUB"),
+		Params: [][]byte{[]byte(nsqd.SelfTestTopic), []byte(selfTestChannel), []byte("0")}}
+	if err = st.command(consumer, sub, "SUB", okBytes); err != nil {
+		return err
+	}
+	if _, err = nsq.Ready(1).WriteTo(consumer); err != nil {
+		return err
+	}
+
+	producer, err := st.dial(deadline)
+	if err != nil {
+		return fmt.Errorf("producer connect failed: %v", err)
+	}
+	defer producer.Close()
+	body := []byte(fmt.Sprintf("selftest-%d-%d", start.UnixNano(), st.seq))
+	pubStart := time.Now()
+	if err = st.command(producer, nsq.PublishWithPart(nsqd.SelfTestTopic, "0", body), "PUB", okBytes); err != nil {
+		return err
+	}
+	pubLatency := time.Since(pubStart)
+	r.PubLatency = pubLatency.String()
+	r.PubLatencyUs = int64(pubLatency / time.Microsecond)
+
+	for {
+		frameType, data, err := readSelfTestFrame(consumer)
+		if err != nil {
+			return fmt.Errorf("consume failed: %v", err)
+		}
+		if frameType == frameTypeResponse {
+			if string(data) == string(heartbeatBytes) {
+				nsq.Nop().WriteTo(consumer)
+			}
+			continue
+		}
+		msg, err := nsq.DecodeMessage(data)
+		if err != nil {
+			return fmt.Errorf("decode message failed: %v", err)
+		}
+		matched := string(msg.Body) == string(body)
+		if matched {
+			e2eLatency := time.Since(pubStart)
+			r.E2ELatency = e2eLatency.String()
+			r.E2ELatencyUs = int64(e2eLatency / time.Microsecond)
+		}
+		// the message left by the previous failed test is finished and ignored
+		if _, err = nsq.Finish(msg.ID).WriteTo(consumer); err != nil {
+			return err
+		}
+		if matched {
+			break
+		}
+	}
+	// the commands are handled in order, so the finish is done while close responded
+	return st.command(consumer, nsq.StartClose(), "CLS", closeWaitBytes)
+}
@@ -0,0 +1,254 @@
+package nsqdserver
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	slowDiskCheckInterval = 5 * time.Second
+	// the partition is degraded after slow in the continuous windows, and recovered
+	// after not slow in more windows to avoid flapping
+	slowDiskDegradeWindows  = 3
+	slowDiskRecoverWindows  = 12
+	slowDiskTransferRetry   = time.Minute
+	slowDiskTransferTimeout = 10 * time.Second
+
+	AlertKindSlowDisk           = "slow_disk"
+	SlowDiskEventDegraded       = "degraded"
+	SlowDiskEventRecovered      = "recovered"
+	SlowDiskEventTransferred    = "leader_transferred"
+	SlowDiskEventTransferFailed = "leader_transfer_failed"
+)
+
+var errNoOtherISR = errors.New("no other isr node for the leader")
+
+type SlowDiskEvent struct {
+	Time      int64                 `json:"time"`
+	Kind      string                `json:"kind"`
+	Type      string                `json:"type"`
+	Node      string                `json:"node"`
+	Topic     string                `json:"topic"`
+	Partition int                   `json:"partition"`
+	Detail    string                `json:"detail,omitempty"`
+	Latency   nsqd.DiskLatencyStats `json:"latency"`
+}
+
+type SlowDiskPartition struct {
+	Topic     string                `json:"topic"`
+	Partition int                   `json:"partition"`
+	IsLeader  bool                  `json:"is_leader"`
+	Latency   nsqd.DiskLatencyStats `json:"latency"`
+}
+
+type SlowDiskStatus struct {
+	Degraded []SlowDiskPartition `json:"degraded"`
+	Events   []SlowDiskEvent     `json:"events"`
+	AlertWebhookStats
+}
+
+type slowDiskState struct {
+	slowWindows  int
+	okWindows    int
+	lastTransfer time.Time
+	transferring bool
+}
+
+// slowDiskManager checks the disk write and fsync latency of each partition, the
+// partition is marked degraded if the latency exceeds the thresholds for a while,
+// and the leadership of the degraded partition is transferred to the other isr.
+type slowDiskManager struct {
+	sync.Mutex
+	ctx      *context
+	states   map[string]*slowDiskState
+	notifier *alertNotifier
+	exitChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newSlowDiskManager(ctx *context) *slowDiskManager {
+	return &slowDiskManager{
+		ctx:    ctx,
+		states: make(map[string]*slowDiskState),
+		notifier: newAlertNotifier("slow disk", func(e interface{}) string {
+			return ctx.getOpts().AlertWebhook
+		}),
+		exitChan: make(chan struct{}),
+	}
+}
+
+func (m *slowDiskManager) start() {
+	m.notifier.start()
+	m.wg.Add(1)
+	go m.loop()
+}
+
+func (m *slowDiskManager) stop() {
+	close(m.exitChan)
+	m.wg.Wait()
+	m.notifier.stop()
+}
+
+func (m *slowDiskManager) loop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(slowDiskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.check()
+		case <-m.exitChan:
+			return
+		}
+	}
+}
+
+func (m *slowDiskManager) addEvent(t *nsqd.Topic, eventType string, detail string, latency nsqd.DiskLatencyStats) {
+	e := SlowDiskEvent{
+		Time:      time.Now().Unix(),
+		Kind:      AlertKindSlowDisk,
+		Type:      eventType,
+		Node:      m.ctx.getAlertNode(),
+		Topic:     t.GetTopicName(),
+		Partition: t.GetTopicPart(),
+		Detail:    detail,
+		Latency:   latency,
+	}
+	nsqd.NsqLogger().LogWarningf("slow disk event %v on topic %v: %v, latency: %+v",
+		eventType, t.GetFullName(), detail, latency)
+	m.notifier.notify(e)
+}
+
+func (m *slowDiskManager) isSlow(s nsqd.DiskLatencyStats) bool {
+	opts := m.ctx.getOpts()
+	if opts.SlowDiskSyncThreshold > 0 && s.Syncs > 0 &&
+		s.SyncAvgUs >= int64(opts.SlowDiskSyncThreshold/time.Microsecond) {
+		return true
+	}
+	if opts.SlowDiskWriteThreshold > 0 && s.Writes > 0 &&
+		s.WriteAvgUs >= int64(opts.SlowDiskWriteThreshold/time.Microsecond) {
+		return true
+	}
+	return false
+}
+
+// check ends the latency window of each partition and updates the degraded state
+func (m *slowDiskManager) check() {
+	seen := make(map[string]bool)
+	for _, topicParts := range m.ctx.nsqd.GetTopicMapCopy() {
+		for _, t := range topicParts {
+			latency := t.RotateDiskLatency()
+			name := t.GetFullName()
+			seen[name] = true
+			m.Lock()
+			st, ok := m.states[name]
+			if !ok {
+				st = &slowDiskState{}
+				m.states[name] = st
+			}
+			if m.isSlow(latency) {
+				st.slowWindows++
+				st.okWindows = 0
+			} else if latency.Syncs > 0 || latency.Writes > 0 {
+				st.okWindows++
+				st.slowWindows = 0
+			}
+			degrade := !t.IsDiskDegraded() && st.slowWindows >= slowDiskDegradeWindows
+			recovered := t.IsDiskDegraded() && st.okWindows >= slowDiskRecoverWindows
+			needTransfer := false
+			if t.IsDiskDegraded() || degrade {
+				needTransfer = m.ctx.getOpts().SlowDiskAutoTransfer && !st.transferring &&
+					time.Since(st.lastTransfer) >= slowDiskTransferRetry
+			}
+			m.Unlock()
+
+			if degrade {
+				t.SetDiskDegraded(true)
+				m.addEvent(t, SlowDiskEventDegraded, "", latency)
+			} else if recovered {
+				t.SetDiskDegraded(false)
+				m.addEvent(t, SlowDiskEventRecovered, "", latency)
+				continue
+			}
+			if needTransfer && m.ctx.nsqdCoord != nil &&
+				m.ctx.checkForMasterWrite(t.GetTopicName(), t.GetTopicPart()) {
+				m.Lock()
+				st.transferring = true
+				st.lastTransfer = time.Now()
+				m.Unlock()
+				// the transfer may take a while, so the check of the other
+				// partitions is not delayed
+				m.wg.Add(1)
+				go func(t *nsqd.Topic, st *slowDiskState, latency nsqd.DiskLatencyStats) {
+					defer m.wg.Done()
+					m.transferLeader(t, latency)
+					m.Lock()
+					st.transferring = false
+					m.Unlock()
+				}(t, st, latency)
+			}
+		}
+	}
+	m.Lock()
+	for name := range m.states {
+		if !seen[name] {
+			delete(m.states, name)
+		}
+	}
+	m.Unlock()
+}
+
+// transferLeader moves the leadership of the degraded partition to the other node in
+// isr, the nodes are tried one by one until transferred.
+func (m *slowDiskManager) transferLeader(t *nsqd.Topic, latency nsqd.DiskLatencyStats) {
+	isr, err := m.ctx.nsqdCoord.GetTopicISR(t.GetTopicName(), t.GetTopicPart())
+	if err == nil {
+		err = errNoOtherISR
+		for _, node := range isr {
+			if node == m.ctx.nsqdCoord.GetMyID() {
+				continue
+			}
+			select {
+			case <-m.exitChan:
+				return
+			default:
+			}
+			err = m.ctx.TransferTopicLeader(t, node, slowDiskTransferTimeout)
+			if err == nil {
+				m.addEvent(t, SlowDiskEventTransferred, node, latency)
+				return
+			}
+			nsqd.NsqLogger().LogWarningf("topic %v failed to transfer leader to %v: %v", t.GetFullName(), node, err)
+		}
+	}
+	m.addEvent(t, SlowDiskEventTransferFailed, err.Error(), latency)
+}
+
+func (m *slowDiskManager) getStatus() *SlowDiskStatus {
+	s := &SlowDiskStatus{
+		Degraded: make([]SlowDiskPartition, 0),
+	}
+	for _, topicParts := range m.ctx.nsqd.GetTopicMapCopy() {
+		for _, t := range topicParts {
+			if !t.IsDiskDegraded() {
+				continue
+			}
+			s.Degraded = append(s.Degraded, SlowDiskPartition{
+				Topic:     t.GetTopicName(),
+				Partition: t.GetTopicPart(),
+				IsLeader:  m.ctx.checkForMasterWrite(t.GetTopicName(), t.GetTopicPart()),
+				Latency:   t.GetDiskLatencyStats(),
+			})
+		}
+	}
+	events := m.notifier.recentEvents()
+	s.Events = make([]SlowDiskEvent, 0, len(events))
+	for _, e := range events {
+		s.Events = append(s.Events, e.(SlowDiskEvent))
+	}
+	s.AlertWebhookStats = m.notifier.getWebhookStats()
+	return s
+}
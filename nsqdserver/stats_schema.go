@@ -0,0 +1,25 @@
+package nsqdserver
+
+import (
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	statsSchemaPackage       = "nsqstats"
+	statsSchemaVersionHeader = "X-NSQ-Stats-Schema-Version"
+)
+
+// StatsResponse is the response of the /stats api in the json or protobuf format,
+// the protobuf schema is generated from the pb tags and can be fetched from the
+// /stats/schema api.
+type StatsResponse struct {
+	SchemaVersion int                  `json:"schema_version" pb:"1"`
+	Version       string               `json:"version" pb:"2"`
+	Health        string               `json:"health" pb:"3"`
+	StartTime     int64                `json:"start_time" pb:"4"`
+	Topics        []nsqd.TopicStats    `json:"topics" pb:"5"`
+	ACLDenied     map[string]int64     `json:"acl_denied,omitempty" pb:"6"`
+	Protocols     []nsqd.ProtocolStats `json:"protocols" pb:"7"`
+	Namespace     *nsqd.NamespaceStats `json:"namespace,omitempty" pb:"8"`
+	ConnLimits    nsqd.ConnLimitStats  `json:"conn_limits" pb:"9"`
+}
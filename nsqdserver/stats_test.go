@@ -1,9 +1,11 @@
 package nsqdserver
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"strconv"
 	"testing"
@@ -67,6 +69,51 @@ func TestStats(t *testing.T) {
 	test.Equal(t, stats[0].Channels[0].ClientNum, int64(1))
 }
 
+func TestProtocolStats(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, httpAddr, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_protocol_stats" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopicIgnPart(topicName)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+	test.Equal(t, err, nil)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	buf := bytes.NewBuffer([]byte("test message 1\ntest message 2"))
+	url := fmt.Sprintf("http://%s/mpub?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", buf)
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.Equal(t, resp.StatusCode, 200)
+	url = fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, "not_exist_topic")
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBuffer([]byte("test")))
+	test.Equal(t, err, nil)
+	resp.Body.Close()
+	test.NotEqual(t, resp.StatusCode, 200)
+
+	stats := nsqd.GetProtocolStats()
+	t.Logf("protocol stats: %+v", stats)
+	test.Equal(t, len(stats), 2)
+	test.Equal(t, stats[0].Protocol, nsqdNs.ProtocolHTTP)
+	test.Equal(t, stats[0].TotalConnections, int64(2))
+	test.Equal(t, stats[0].PubCount, int64(2))
+	test.Equal(t, stats[0].PubBytes, int64(len("test message 1")+len("test message 2")))
+	test.Equal(t, stats[0].ErrorCount, int64(1))
+	test.Equal(t, stats[1].Protocol, nsqdNs.ProtocolTCP)
+	test.Equal(t, stats[1].Connections, int64(1))
+	test.Equal(t, stats[1].PubCount, int64(1))
+	test.Equal(t, stats[1].PubBytes, int64(len("test body")))
+	test.Equal(t, stats[1].ErrorCount, int64(0))
+}
+
 func TestClientAttributes(t *testing.T) {
 	userAgent := "Test User Agent"
 
@@ -75,6 +75,17 @@ func (n *NsqdServer) statsdLoop() {
 					client.Gauge(stat, int64(item["value"]))
 				}
 
+				if topic.WriteLatencySLO != nil {
+					stat = fmt.Sprintf("topic.%s.write_latency_slo_current_us", statdName)
+					client.Gauge(stat, topic.WriteLatencySLO.CurrentUs)
+					var degraded int64
+					if topic.WriteLatencySLO.Degraded {
+						degraded = 1
+					}
+					stat = fmt.Sprintf("topic.%s.write_latency_slo_degraded", statdName)
+					client.Gauge(stat, degraded)
+				}
+
 				for _, channel := range topic.Channels {
 					// try to find the channel in the last collection
 					lastChannel := nsqd.ChannelStats{}
@@ -175,6 +186,24 @@ func (n *NsqdServer) statsdLoop() {
 					stat = fmt.Sprintf("topic.%s.channel.%s.clients", statdName, channel.ChannelName)
 					client.Gauge(stat, int64(channel.ClientNum))
 
+					if channel.SLO != nil {
+						// the ratio gauges are in per ten thousand
+						stat = fmt.Sprintf("topic.%s.channel.%s.slo_compliance", statdName, channel.ChannelName)
+						client.Gauge(stat, int64(channel.SLO.Compliance*10000))
+						stat = fmt.Sprintf("topic.%s.channel.%s.slo_burn_rate", statdName, channel.ChannelName)
+						client.Gauge(stat, int64(channel.SLO.BurnRate*10000))
+					}
+					if channel.Ordered != nil {
+						stat = fmt.Sprintf("topic.%s.channel.%s.ordered_blocked_ms", statdName, channel.ChannelName)
+						client.Gauge(stat, channel.Ordered.BlockedMs)
+						var stuck int64
+						if channel.Ordered.Stuck {
+							stuck = 1
+						}
+						stat = fmt.Sprintf("topic.%s.channel.%s.ordered_stuck", statdName, channel.ChannelName)
+						client.Gauge(stat, stuck)
+					}
+
 					for _, item := range channel.E2eProcessingLatency.Percentiles {
 						stat = fmt.Sprintf("topic.%s.channel.%s.e2e_processing_latency_%.0f", statdName, channel.ChannelName, item["quantile"]*100.0)
 						client.Gauge(stat, int64(item["value"]))
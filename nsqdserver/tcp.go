@@ -11,10 +11,22 @@ import (
 )
 
 type tcpServer struct {
-	ctx *context
+	ctx     *context
+	tcpOpts *nsqd.TCPOptions
 }
 
 func (p *tcpServer) Handle(clientConn net.Conn) {
+	// the per-IP limit is checked first, so the idle connections not sending the
+	// protocol magic are also limited.
+	remoteIP, _, _ := net.SplitHostPort(clientConn.RemoteAddr().String())
+	if err := p.ctx.nsqd.AcquireIPConn(remoteIP); err != nil {
+		protocol.SendFramedResponse(clientConn, frameTypeError, []byte(E_TOO_MANY_CONNS+" "+err.Error()))
+		clientConn.Close()
+		protocolLog.Logf("client(%s) rejected: %v", clientConn.RemoteAddr(), err)
+		return
+	}
+	defer p.ctx.nsqd.ReleaseIPConn(remoteIP)
+
 	// The client should initialize itself by sending a 4 byte sequence indicating
 	// the version of the protocol that it intends to communicate, this will allow us
 	// to gracefully upgrade the protocol away from text/line oriented to whatever...
@@ -22,32 +34,41 @@ func (p *tcpServer) Handle(clientConn net.Conn) {
 	buf := make([]byte, 4)
 	_, err := io.ReadFull(clientConn, buf)
 	if err != nil {
-		nsqd.NsqLogger().Logf(" failed to read protocol version - %s from client: %v", err, clientConn.RemoteAddr())
+		protocolLog.Logf(" failed to read protocol version - %s from client: %v", err, clientConn.RemoteAddr())
 		clientConn.Close()
 		return
 	}
 	protocolMagic := string(buf)
 
-	if nsqd.NsqLogger().Level() >= levellogger.LOG_DEBUG {
-		nsqd.NsqLogger().LogDebugf("new CLIENT(%s): desired protocol magic '%s'",
+	if protocolLog.Level() >= levellogger.LOG_DEBUG {
+		protocolLog.LogDebugf("new CLIENT(%s): desired protocol magic '%s'",
 			clientConn.RemoteAddr(), protocolMagic)
 	}
 
 	var prot protocol.Protocol
 	switch protocolMagic {
 	case "  V2":
-		prot = &protocolV2{ctx: p.ctx}
+		prot = &protocolV2{ctx: p.ctx, tcpOpts: p.tcpOpts}
 	default:
 		protocol.SendFramedResponse(clientConn, frameTypeError, []byte("E_BAD_PROTOCOL"))
 		clientConn.Close()
-		nsqd.NsqLogger().LogErrorf("client(%s) bad protocol magic '%s'",
+		protocolLog.LogErrorf("client(%s) bad protocol magic '%s'",
 			clientConn.RemoteAddr(), protocolMagic)
 		return
 	}
 
+	if p.ctx.isDraining() {
+		protocol.SendFramedResponse(clientConn, frameTypeError, []byte("E_DRAINING"))
+		clientConn.Close()
+		protocolLog.Logf("client(%s) rejected since the node is draining", clientConn.RemoteAddr())
+		return
+	}
+
+	p.ctx.nsqd.ProtocolConnOpened(nsqd.ProtocolTCP)
 	err = prot.IOLoop(clientConn)
+	p.ctx.nsqd.ProtocolConnClosed(nsqd.ProtocolTCP)
 	if err != nil {
-		nsqd.NsqLogger().Logf("client(%s) error - %s", clientConn.RemoteAddr(), err)
+		protocolLog.Logf("client(%s) error - %s", clientConn.RemoteAddr(), err)
 		return
 	}
 }
@@ -0,0 +1,54 @@
+package nsqdserver
+
+import (
+	"time"
+
+	"github.com/youzan/nsq/nsqd"
+)
+
+const topicPolicySyncInterval = time.Minute
+
+// topicPolicySyncLoop syncs the policy of the leader partitions to the replicas
+// periodically, so the replicas failed to sync or joined later can catch up.
+func (n *NsqdServer) topicPolicySyncLoop() {
+	ticker := time.NewTicker(topicPolicySyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.ctx.syncAllTopicPolicy()
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
+// syncTopicPolicy should be called on the leader after the topic policy (mirror,
+// archive, dedup, slo and the runtime config) changed.
+func (c *context) syncTopicPolicy(topic *nsqd.Topic) error {
+	if c.nsqdCoord == nil {
+		return nil
+	}
+	err := c.nsqdCoord.UpdateTopicPolicyToCluster(topic)
+	if err != nil {
+		nsqd.NsqLogger().LogWarningf("topic %v failed to sync policy to replicas: %v", topic.GetFullName(), err)
+	}
+	return err
+}
+
+func (c *context) syncAllTopicPolicy() {
+	if c.nsqdCoord == nil {
+		return
+	}
+	for _, topicParts := range c.nsqd.GetTopicMapCopy() {
+		for _, t := range topicParts {
+			if t.Exiting() || t.IsDefaultTopicPolicy() {
+				continue
+			}
+			if !c.checkForMasterWrite(t.GetTopicName(), t.GetTopicPart()) {
+				continue
+			}
+			c.syncTopicPolicy(t)
+		}
+	}
+}
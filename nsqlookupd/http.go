@@ -10,6 +10,7 @@ import (
 	"errors"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/youzan/nsq/consistence"
@@ -23,6 +24,10 @@ const (
 	MAX_PARTITION_NUM = 255
 	MAX_REPLICATOR    = 5
 	MAX_LOAD_FACTOR   = 10000
+	// the max length for each field of the topic owner meta
+	MAX_TOPIC_OWNER_META_LEN = 1024
+	// the max times to read and update again if the owner meta is changed by others
+	MAX_TOPIC_OWNER_META_RETRY = 3
 )
 
 func GetValidPartitionNum(numStr string) (int, error) {
@@ -75,6 +80,7 @@ func GetValidSuggestLF(r string) (int, error) {
 type httpServer struct {
 	ctx    *Context
 	router http.Handler
+	ci     *clusterinfo.ClusterInfo
 }
 
 func newHTTPServer(ctx *Context) *httpServer {
@@ -90,6 +96,7 @@ func newHTTPServer(ctx *Context) *httpServer {
 	s := &httpServer{
 		ctx:    ctx,
 		router: router,
+		ci:     clusterinfo.New(nil, http_api.NewClient(nil)),
 	}
 
 	router.Handle("GET", "/ping", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
@@ -102,9 +109,13 @@ func newHTTPServer(ctx *Context) *httpServer {
 	router.Handle("GET", "/nodes", http_api.Decorate(s.doNodes, log, http_api.NegotiateVersion))
 	router.Handle("GET", "/listlookup", http_api.Decorate(s.doListLookup, debugLog, http_api.NegotiateVersion))
 	router.Handle("GET", "/cluster/stats", http_api.Decorate(s.doClusterStats, debugLog, http_api.V1))
+	router.Handle("GET", "/cluster/topic/stats", http_api.Decorate(s.doClusterTopicStats, log, http_api.V1))
 	router.Handle("POST", "/cluster/node/remove", http_api.Decorate(s.doRemoveClusterDataNode, log, http_api.V1))
 	router.Handle("POST", "/cluster/upgrade/begin", http_api.Decorate(s.doClusterBeginUpgrade, log, http_api.V1))
 	router.Handle("POST", "/cluster/upgrade/done", http_api.Decorate(s.doClusterFinishUpgrade, log, http_api.V1))
+	router.Handle("GET", "/cluster/features", http_api.Decorate(s.doClusterFeatures, log, http_api.V1))
+	router.Handle("GET", "/cluster/replication/limits", http_api.Decorate(s.doReplicationLimits, log, http_api.V1))
+	router.Handle("POST", "/cluster/replication/limits/update", http_api.Decorate(s.doUpdateReplicationLimits, log, http_api.V1))
 	router.Handle("POST", "/cluster/lookupd/tombstone", http_api.Decorate(s.doClusterTombstoneLookupd, log, http_api.V1))
 
 	// only v1
@@ -114,7 +125,11 @@ func newHTTPServer(ctx *Context) *httpServer {
 	router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, log, http_api.V1))
 	router.Handle("POST", "/topic/partition/expand", http_api.Decorate(s.doChangeTopicPartitionNum, log, http_api.V1))
 	router.Handle("POST", "/topic/partition/move", http_api.Decorate(s.doMoveTopicParition, log, http_api.V1))
+	router.Handle("POST", "/topic/partition/standby/add", http_api.Decorate(s.doAddTopicStandbyReplica, log, http_api.V1))
+	router.Handle("POST", "/topic/partition/standby/remove", http_api.Decorate(s.doRemoveTopicStandbyReplica, log, http_api.V1))
 	router.Handle("POST", "/topic/meta/update", http_api.Decorate(s.doChangeTopicDynamicParam, log, http_api.V1))
+	router.Handle("GET", "/topic/owner", http_api.Decorate(s.doTopicOwnerMeta, log, http_api.V1))
+	router.Handle("POST", "/topic/owner/update", http_api.Decorate(s.doUpdateTopicOwnerMeta, log, http_api.V1))
 	//router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
 	//router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
 	router.Handle("POST", "/topic/tombstone", http_api.Decorate(s.doTombstoneTopicProducer, log, http_api.V1))
@@ -222,6 +237,52 @@ func (s *httpServer) doClusterStats(w http.ResponseWriter, req *http.Request, ps
 	}, nil
 }
 
+// merge the topic stats from all the nsqd nodes to get the cluster view of topics.
+func (s *httpServer) doClusterTopicStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName := reqParams.Get("topic")
+	if topicName != "" && !protocol.IsValidTopicName(topicName) {
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC"}
+	}
+
+	peers := s.ctx.nsqlookupd.DB.GetAllPeerClients().FilterByActive(
+		s.ctx.nsqlookupd.opts.InactiveProducerTimeout)
+	producers := make(clusterinfo.Producers, 0, len(peers))
+	for _, p := range peers {
+		producers = append(producers, &clusterinfo.Producer{
+			RemoteAddress:    p.RemoteAddress,
+			Hostname:         p.Hostname,
+			BroadcastAddress: p.BroadcastAddress,
+			TCPPort:          p.TCPPort,
+			HTTPPort:         p.HTTPPort,
+			Version:          p.Version,
+		})
+	}
+	if len(producers) == 0 {
+		return map[string]interface{}{
+			"topics": []*clusterinfo.TopicStats{},
+		}, nil
+	}
+	var message string
+	topicStats, err := s.ci.GetClusterTopicStats(producers, topicName)
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			nsqlookupLog.Logf("failed to get cluster topic stats: %v", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		nsqlookupLog.Logf("get cluster topic stats partial error: %v", pe)
+		message = pe.Error()
+	}
+	return map[string]interface{}{
+		"topics":  topicStats,
+		"message": message,
+	}, nil
+}
+
 func (s *httpServer) doTopics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	topics := s.ctx.nsqlookupd.DB.FindTopics()
 	//wrap topic meta info
@@ -541,7 +602,41 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 		return nil, http_api.Err{400, err.Error()}
 	}
 
-	return nil, nil
+	result := &topicCreateResult{
+		Topic:        topicName,
+		PartitionNum: meta.PartitionNum,
+		Replicator:   meta.Replica,
+		SyncDisk:     meta.SyncEvery,
+	}
+	partInfos, err := s.ctx.nsqlookupd.coordinator.GetTopicPartitionsInfo(topicName)
+	if err != nil {
+		// the topic is already created, so we just ignore the placement
+		nsqlookupLog.LogWarningf("get topic(%s) partitions placement failed: %v", topicName, err)
+	}
+	for _, info := range partInfos {
+		// the sync disk may be adjusted by the coordinator while creating
+		result.SyncDisk = info.SyncEvery
+		result.Partitions = append(result.Partitions, topicPartitionPlacement{
+			Partition: info.Partition,
+			Leader:    info.Leader,
+			ISR:       info.ISR,
+		})
+	}
+	return result, nil
+}
+
+type topicPartitionPlacement struct {
+	Partition int      `json:"partition"`
+	Leader    string   `json:"leader"`
+	ISR       []string `json:"isr"`
+}
+
+type topicCreateResult struct {
+	Topic        string                    `json:"topic"`
+	PartitionNum int                       `json:"partition_num"`
+	Replicator   int                       `json:"replicator"`
+	SyncDisk     int                       `json:"syncdisk"`
+	Partitions   []topicPartitionPlacement `json:"partitions"`
 }
 
 func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -664,6 +759,91 @@ func (s *httpServer) doChangeTopicDynamicParam(w http.ResponseWriter, req *http.
 	return nil, nil
 }
 
+func (s *httpServer) doTopicOwnerMeta(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName := reqParams.Get("topic")
+	if topicName == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	meta, _, err := s.ctx.nsqlookupd.coordinator.GetTopicOwnerMeta(topicName)
+	if err != nil {
+		if err == consistence.ErrTopicNotCreated {
+			return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+		}
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return meta, nil
+}
+
+// doUpdateTopicOwnerMeta only changes the fields in the query params, so we can
+// change the contact without touching the others. The meta is written only if not
+// changed since read, and read again to apply the changes if changed by others.
+func (s *httpServer) doUpdateTopicOwnerMeta(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	if !s.ctx.nsqlookupd.coordinator.IsMineLeader() {
+		nsqlookupLog.Logf("request from remote %v should request to leader", req.RemoteAddr)
+		return nil, http_api.Err{400, consistence.ErrFailedOnNotLeader}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName := reqParams.Get("topic")
+	if topicName == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	changes := make(map[string]string)
+	for _, name := range []string{"owner", "team", "contact", "description"} {
+		if v, ok := reqParams[name]; ok {
+			if len(v[0]) > MAX_TOPIC_OWNER_META_LEN {
+				return nil, http_api.Err{400, "INVALID_ARG_" + strings.ToUpper(name)}
+			}
+			changes[name] = v[0]
+		}
+	}
+	if len(changes) == 0 {
+		return nil, http_api.Err{400, "MISSING_ARG_OWNER_META"}
+	}
+	for retry := 0; retry < MAX_TOPIC_OWNER_META_RETRY; retry++ {
+		meta, epoch, err := s.ctx.nsqlookupd.coordinator.GetTopicOwnerMeta(topicName)
+		if err != nil {
+			if err == consistence.ErrTopicNotCreated {
+				return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+			}
+			return nil, http_api.Err{500, err.Error()}
+		}
+		fields := map[string]*string{
+			"owner":       &meta.Owner,
+			"team":        &meta.Team,
+			"contact":     &meta.Contact,
+			"description": &meta.Description,
+		}
+		for name, v := range changes {
+			*fields[name] = v
+		}
+		err = s.ctx.nsqlookupd.coordinator.UpdateTopicOwnerMeta(topicName, meta, epoch)
+		if err == consistence.ErrTopicOwnerMetaChanged {
+			nsqlookupLog.Logf("topic %v owner meta changed while updating, retry %v", topicName, retry)
+			continue
+		}
+		if err != nil {
+			nsqlookupLog.Logf("failed to update topic %v owner meta: %v", topicName, err)
+			return nil, http_api.Err{500, err.Error()}
+		}
+		nsqlookupLog.Logf("topic %v owner meta updated to %v from %v", topicName, meta, req.RemoteAddr)
+		return meta, nil
+	}
+	return nil, http_api.Err{409, "TOPIC_OWNER_META_CONFLICT"}
+}
+
 func (s *httpServer) doMoveTopicParition(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	if s.ctx.nsqlookupd.coordinator == nil {
 		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
@@ -699,6 +879,57 @@ func (s *httpServer) doMoveTopicParition(w http.ResponseWriter, req *http.Reques
 	return nil, nil
 }
 
+func (s *httpServer) doAddTopicStandbyReplica(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.doChangeTopicStandbyReplica(req, true)
+}
+
+func (s *httpServer) doRemoveTopicStandbyReplica(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.doChangeTopicStandbyReplica(req, false)
+}
+
+func (s *httpServer) doChangeTopicStandbyReplica(req *http.Request, add bool) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	if !s.ctx.nsqlookupd.coordinator.IsMineLeader() {
+		nsqlookupLog.Logf("request from remote %v should request to leader", req.RemoteAddr)
+		return nil, http_api.Err{400, consistence.ErrFailedOnNotLeader}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName := reqParams.Get("topic")
+	if topicName == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	pStr := reqParams.Get("partition")
+	if pStr == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC_PARTITION"}
+	}
+	pid, err := GetValidPartitionID(pStr)
+	if err != nil {
+		nsqlookupLog.Logf("invalid partition num: %v, %v", pStr, err)
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_PARTITION_NUM"}
+	}
+	node := reqParams.Get("node")
+	if node == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_NODE"}
+	}
+
+	if add {
+		err = s.ctx.nsqlookupd.coordinator.AddTopicStandbyReplica(topicName, pid, node)
+	} else {
+		err = s.ctx.nsqlookupd.coordinator.RemoveTopicStandbyReplica(topicName, pid, node)
+	}
+	if err != nil {
+		nsqlookupLog.Logf("change topic %v-%v standby %v failed: %v", topicName, pid, node, err)
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return nil, nil
+}
+
 func (s *httpServer) doClusterBeginUpgrade(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	if s.ctx.nsqlookupd.coordinator == nil {
 		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
@@ -721,6 +952,109 @@ func (s *httpServer) doClusterFinishUpgrade(w http.ResponseWriter, req *http.Req
 	return nil, nil
 }
 
+func (s *httpServer) doClusterFeatures(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	if !s.ctx.nsqlookupd.coordinator.IsMineLeader() {
+		nsqlookupLog.Logf("request from remote %v should request to leader", req.RemoteAddr)
+		return nil, http_api.Err{400, consistence.ErrFailedOnNotLeader}
+	}
+	status, err := s.ctx.nsqlookupd.coordinator.GetClusterVersionStatus()
+	if err != nil {
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return status, nil
+}
+
+func (s *httpServer) doReplicationLimits(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	limits, err := s.ctx.nsqlookupd.coordinator.GetReplicationLimits()
+	if err != nil {
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return limits, nil
+}
+
+// doUpdateReplicationLimits changes the default limit if no topic (or node pair) given,
+// otherwise changes the limit for the topic (or the node pair from the leader to the
+// replica), and -1 removes the limit for the topic (or the node pair).
+func (s *httpServer) doUpdateReplicationLimits(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	if !s.ctx.nsqlookupd.coordinator.IsMineLeader() {
+		nsqlookupLog.Logf("request from remote %v should request to leader", req.RemoteAddr)
+		return nil, http_api.Err{400, consistence.ErrFailedOnNotLeader}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	limits, err := s.ctx.nsqlookupd.coordinator.GetReplicationLimits()
+	if err != nil {
+		return nil, http_api.Err{500, err.Error()}
+	}
+	changed := false
+	if rateStr := reqParams.Get("topic_rate"); rateStr != "" {
+		rate, err := strconv.ParseInt(rateStr, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_RATE"}
+		}
+		if topicName := reqParams.Get("topic"); topicName != "" {
+			if limits.TopicRates == nil {
+				limits.TopicRates = make(map[string]int64)
+			}
+			if rate == -1 {
+				delete(limits.TopicRates, topicName)
+			} else {
+				limits.TopicRates[topicName] = rate
+			}
+		} else {
+			limits.TopicRate = rate
+		}
+		changed = true
+	}
+	if rateStr := reqParams.Get("node_pair_rate"); rateStr != "" {
+		rate, err := strconv.ParseInt(rateStr, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_NODE_PAIR_RATE"}
+		}
+		from := reqParams.Get("from")
+		to := reqParams.Get("to")
+		if from != "" || to != "" {
+			if from == "" || to == "" {
+				return nil, http_api.Err{400, "MISSING_ARG_NODE_PAIR"}
+			}
+			if limits.NodePairRates == nil {
+				limits.NodePairRates = make(map[string]int64)
+			}
+			if rate == -1 {
+				delete(limits.NodePairRates, consistence.ReplicationNodePairKey(from, to))
+			} else {
+				limits.NodePairRates[consistence.ReplicationNodePairKey(from, to)] = rate
+			}
+		} else {
+			limits.NodePairRate = rate
+		}
+		changed = true
+	}
+	if !changed {
+		return nil, http_api.Err{400, "MISSING_ARG_RATE"}
+	}
+	err = s.ctx.nsqlookupd.coordinator.UpdateReplicationLimits(limits)
+	if err == consistence.ErrInvalidReplicationLimits {
+		return nil, http_api.Err{400, "INVALID_REPLICATION_LIMITS"}
+	} else if err != nil {
+		nsqlookupLog.Logf("failed to update replication limits: %v", err)
+		return nil, http_api.Err{500, err.Error()}
+	}
+	nsqlookupLog.Logf("replication limits updated to %+v from %v", limits, req.RemoteAddr)
+	return limits, nil
+}
+
 func (s *httpServer) doRemoveClusterDataNode(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	if s.ctx.nsqlookupd.coordinator == nil {
 		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
@@ -72,6 +72,7 @@ func (l *NSQLookupd) Main() {
 	})
 
 	var node consistence.NsqLookupdNodeInfo
+	node.Version = version.Binary
 	_, node.HttpPort, _ = net.SplitHostPort(l.opts.HTTPAddress)
 	if l.opts.ReverseProxyPort != "" {
 		node.HttpPort = l.opts.ReverseProxyPort
@@ -3,6 +3,8 @@ package nsqlookupd
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
 	"reflect"
 	"runtime"
@@ -807,6 +809,90 @@ func TestOldNsqdTopicRegUnReg(t *testing.T) {
 	conn_p2.Close()
 }
 
+func mustStartFakeNsqdStats(stats string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+		w.Write([]byte(stats))
+	}))
+}
+
+func TestClusterTopicStats(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	topicName := "cluster_topic_stats"
+	// partition 0 leader on node1 and replica on node2, partition 1 leader on node2
+	node1 := mustStartFakeNsqdStats(`{"topics":[
+		{"topic_name":"` + topicName + `","topic_partition":"0","is_leader":true,"depth":10,"backend_depth":8,"message_count":100,
+		"msg_size_stats":[1,2,0,0,0,0,0,0,0,0,0,0,0,0,0,0],
+		"channels":[{"channel_name":"ch1","depth":5,"in_flight_count":1,"message_count":100}]}]}`)
+	defer node1.Close()
+	node2 := mustStartFakeNsqdStats(`{"topics":[
+		{"topic_name":"` + topicName + `","topic_partition":"0","is_leader":false,"depth":10,"backend_depth":8,"message_count":100,
+		"msg_size_stats":[1,2,0,0,0,0,0,0,0,0,0,0,0,0,0,0],
+		"channels":[{"channel_name":"ch1","depth":5,"in_flight_count":0,"message_count":100}]},
+		{"topic_name":"` + topicName + `","topic_partition":"1","is_leader":true,"depth":20,"backend_depth":10,"message_count":50,
+		"msg_size_stats":[3,0,0,0,0,0,0,0,0,0,0,0,0,0,0,1],
+		"channels":[{"channel_name":"ch1","depth":7,"in_flight_count":2,"message_count":50},
+		{"channel_name":"ch2","depth":3,"message_count":50}]}]}`)
+	defer node2.Close()
+
+	for i, srv := range []*httptest.Server{node1, node2} {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+		ci := make(map[string]interface{})
+		ci["tcp_port"] = 4150 + i
+		ci["http_port"] = srv.Listener.Addr().(*net.TCPAddr).Port
+		ci["broadcast_address"] = "127.0.0.1"
+		ci["hostname"] = fmt.Sprintf("node%d", i+1)
+		ci["version"] = "fake-version"
+		ci["id"] = fmt.Sprintf("node%d", i+1)
+		cmd, _ := nsq.Identify(ci)
+		_, err := cmd.WriteTo(conn)
+		equal(t, err, nil)
+		_, err = nsq.ReadResponse(conn)
+		equal(t, err, nil)
+	}
+
+	var resp struct {
+		Topics []*clusterinfo.TopicStats `json:"topics"`
+	}
+	endpoint := fmt.Sprintf("http://%s/cluster/topic/stats?topic=%s", httpAddr, topicName)
+	_, err := http_api.NewClient(nil).GETV1(endpoint, &resp)
+	equal(t, err, nil)
+	equal(t, len(resp.Topics), 1)
+	ts := resp.Topics[0]
+	equal(t, ts.TopicName, topicName)
+	// the replica should not be counted
+	equal(t, ts.Depth, int64(30))
+	equal(t, ts.BackendDepth, int64(18))
+	equal(t, ts.MessageCount, int64(150))
+	equal(t, ts.MessageSizeStats[0], int64(4))
+	equal(t, ts.MessageSizeStats[1], int64(2))
+	equal(t, ts.MessageSizeStats[15], int64(1))
+	equal(t, ts.TotalChannelDepth, int64(15))
+	equal(t, len(ts.NodeStats), 3)
+	leaderNum := 0
+	for _, n := range ts.NodeStats {
+		if n.IsLeader {
+			leaderNum++
+		}
+	}
+	equal(t, leaderNum, 2)
+	equal(t, len(ts.Channels), 2)
+	for _, ch := range ts.Channels {
+		if ch.ChannelName == "ch1" {
+			equal(t, ch.Depth, int64(12))
+			equal(t, ch.InFlightCount, int64(3))
+		} else {
+			equal(t, ch.ChannelName, "ch2")
+			equal(t, ch.Depth, int64(3))
+		}
+	}
+}
+
 // TODO: test performance for db
 func BenchmarkTopicProducerLookup(t *testing.B) {
 }